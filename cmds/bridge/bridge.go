@@ -0,0 +1,362 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Show and manipulate bridge forwarding databases and VLANs.
+//
+// Synopsis:
+//     bridge fdb show [dev DEV] [br BRIDGE]
+//     bridge fdb add LLADDR dev DEV [self] [master] [permanent | static | dynamic] [vlan VID]
+//     bridge fdb del LLADDR dev DEV [self] [master] [vlan VID]
+//     bridge vlan show [dev DEV]
+//
+// Description:
+//     Bridges themselves are created with "ip link add BRIDGE type bridge"
+//     and ports are added with "ip link set DEV master BRIDGE".
+//
+//     fdb shows and changes the forwarding database, which maps link layer
+//     addresses to the ports they are reachable on. Without master, fdb add
+//     and del change the database of the device itself (self). Addresses
+//     added to a device are permanent; ones added to a bridge default to
+//     static.
+//
+//     vlan shows the VLANs configured on bridge ports.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const usage = `usage:
+	bridge fdb show [dev DEV] [br BRIDGE]
+	bridge fdb add LLADDR dev DEV [self] [master] [permanent | static | dynamic] [vlan VID]
+	bridge fdb del LLADDR dev DEV [self] [master] [vlan VID]
+	bridge vlan show [dev DEV]`
+
+// args is the part of the command line that is still to be parsed.
+type args []string
+
+// next removes and returns the next argument, or "" if there is none.
+func (a *args) next() string {
+	if len(*a) == 0 {
+		return ""
+	}
+	s := (*a)[0]
+	*a = (*a)[1:]
+	return s
+}
+
+// value removes the next argument, which must exist, as the value of key.
+func (a *args) value(key string) (string, error) {
+	s := a.next()
+	if s == "" {
+		return "", fmt.Errorf("%s needs a value", key)
+	}
+	return s, nil
+}
+
+// linkNames maps interface indices to names.
+func linkNames() (map[int]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string)
+	for _, l := range links {
+		names[l.Attrs().Index] = l.Attrs().Name
+	}
+	return names, nil
+}
+
+// fdbSpec is a parsed fdb add or del command.
+type fdbSpec struct {
+	neigh *netlink.Neigh
+	name  string
+}
+
+func parseFDB(a *args, add bool) (*fdbSpec, error) {
+	addr, err := a.value("fdb entry")
+	if err != nil {
+		return nil, err
+	}
+	mac, err := net.ParseMAC(addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &netlink.Neigh{
+		Family:       unix.AF_BRIDGE,
+		HardwareAddr: mac,
+		State:        netlink.NUD_NOARP,
+	}
+	spec := &fdbSpec{neigh: n}
+	state := ""
+	for len(*a) > 0 {
+		key := a.next()
+		switch key {
+		case "dev":
+			if spec.name, err = a.value(key); err != nil {
+				return nil, err
+			}
+		case "self":
+			n.Flags |= netlink.NTF_SELF
+		case "master":
+			n.Flags |= netlink.NTF_MASTER
+		case "permanent", "static", "temp", "dynamic":
+			if !add {
+				return nil, fmt.Errorf("%s is only valid for add", key)
+			}
+			state = key
+		case "vlan":
+			s, err := a.value(key)
+			if err != nil {
+				return nil, err
+			}
+			vid, err := strconv.ParseUint(s, 10, 12)
+			if err != nil || vid == 0 {
+				return nil, fmt.Errorf("invalid vlan %q", s)
+			}
+			n.Vlan = int(vid)
+		default:
+			return nil, fmt.Errorf("unknown fdb option %q", key)
+		}
+	}
+	if spec.name == "" {
+		return nil, fmt.Errorf("fdb needs a device")
+	}
+	if n.Flags&(netlink.NTF_SELF|netlink.NTF_MASTER) == 0 {
+		n.Flags = netlink.NTF_SELF
+	}
+	// These are the states iproute2 uses.
+	switch state {
+	case "permanent":
+		n.State |= netlink.NUD_PERMANENT
+	case "static", "temp":
+		n.State |= netlink.NUD_REACHABLE
+	case "dynamic":
+		n.State = netlink.NUD_REACHABLE
+	case "":
+		// The kernel only takes permanent addresses for devices, and
+		// static is what bridges use for user entries.
+		if n.Flags&netlink.NTF_MASTER != 0 {
+			n.State |= netlink.NUD_REACHABLE
+		} else {
+			n.State |= netlink.NUD_PERMANENT
+		}
+	}
+	return spec, nil
+}
+
+func fdbModify(a *args, add bool) error {
+	spec, err := parseFDB(a, add)
+	if err != nil {
+		return err
+	}
+	l, err := netlink.LinkByName(spec.name)
+	if err != nil {
+		return err
+	}
+	spec.neigh.LinkIndex = l.Attrs().Index
+	if add {
+		err = netlink.NeighAppend(spec.neigh)
+	} else {
+		err = netlink.NeighDel(spec.neigh)
+	}
+	if err != nil {
+		return fmt.Errorf("%s on %s: %v", spec.neigh.HardwareAddr, spec.name, err)
+	}
+	return nil
+}
+
+// formatFDB formats an fdb entry as iproute2 does.
+func formatFDB(n netlink.Neigh, names map[int]string, masters map[int]int) string {
+	s := fmt.Sprintf("%s dev %s", n.HardwareAddr, names[n.LinkIndex])
+	if n.Vlan != 0 {
+		s += fmt.Sprintf(" vlan %d", n.Vlan)
+	}
+	if n.Flags&netlink.NTF_SELF != 0 {
+		s += " self"
+	}
+	// Without self, the entry is from the fdb of a bridge: either the one
+	// the device is a port of, or the device itself.
+	if n.Flags&netlink.NTF_SELF == 0 {
+		master := masters[n.LinkIndex]
+		if master == 0 {
+			master = n.LinkIndex
+		}
+		s += " master " + names[master]
+	}
+	switch {
+	case n.State&netlink.NUD_PERMANENT != 0:
+		s += " permanent"
+	case n.State&netlink.NUD_NOARP != 0:
+		s += " static"
+	}
+	return s
+}
+
+func fdbShow(w io.Writer, a *args) error {
+	var dev, br string
+	for len(*a) > 0 {
+		key := a.next()
+		v, err := a.value(key)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "dev":
+			dev = v
+		case "br", "brport":
+			br = v
+		default:
+			return fmt.Errorf("unknown fdb show option %q", key)
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	masters := make(map[int]int)
+	for _, l := range links {
+		names[l.Attrs().Index] = l.Attrs().Name
+		masters[l.Attrs().Index] = l.Attrs().MasterIndex
+	}
+
+	index := 0
+	if dev != "" {
+		l, err := netlink.LinkByName(dev)
+		if err != nil {
+			return err
+		}
+		index = l.Attrs().Index
+	}
+	neighs, err := netlink.NeighList(index, unix.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	for _, n := range neighs {
+		if dev != "" && n.LinkIndex != index {
+			continue
+		}
+		// Entries of a bridge are either on it or on one of its ports.
+		if br != "" && names[n.LinkIndex] != br && names[masters[n.LinkIndex]] != br {
+			continue
+		}
+		fmt.Fprintln(w, formatFDB(n, names, masters))
+	}
+	return nil
+}
+
+func fdb(w io.Writer, a *args) error {
+	cmd := a.next()
+	switch cmd {
+	case "show", "list", "ls", "":
+		return fdbShow(w, a)
+	case "add", "append":
+		return fdbModify(a, true)
+	case "del", "delete":
+		return fdbModify(a, false)
+	}
+	return fmt.Errorf("unknown fdb command %q", cmd)
+}
+
+// formatVLAN formats a VLAN as iproute2 does.
+func formatVLAN(v *nl.BridgeVlanInfo) string {
+	s := fmt.Sprintf(" %d", v.Vid)
+	if v.PortVID() {
+		s += " PVID"
+	}
+	if v.EngressUntag() {
+		s += " Egress Untagged"
+	}
+	return s
+}
+
+func vlanShow(w io.Writer, a *args) error {
+	var dev string
+	for len(*a) > 0 {
+		key := a.next()
+		v, err := a.value(key)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "dev":
+			dev = v
+		default:
+			return fmt.Errorf("unknown vlan show option %q", key)
+		}
+	}
+
+	names, err := linkNames()
+	if err != nil {
+		return err
+	}
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return err
+	}
+	// Show the ports in index order, as iproute2 does.
+	var indices []int
+	for i := range vlans {
+		indices = append(indices, int(i))
+	}
+	sort.Ints(indices)
+
+	fmt.Fprintln(w, "port\tvlan ids")
+	for _, i := range indices {
+		name := names[i]
+		if dev != "" && name != dev {
+			continue
+		}
+		for j, v := range vlans[int32(i)] {
+			if j == 0 {
+				fmt.Fprintf(w, "%s\t%s\n", name, formatVLAN(v))
+			} else {
+				fmt.Fprintf(w, "%s\t%s\n", strings.Repeat(" ", len(name)), formatVLAN(v))
+			}
+		}
+	}
+	return nil
+}
+
+func vlan(w io.Writer, a *args) error {
+	cmd := a.next()
+	switch cmd {
+	case "show", "list", "ls", "":
+		return vlanShow(w, a)
+	}
+	return fmt.Errorf("unknown vlan command %q", cmd)
+}
+
+func bridge(w io.Writer, a args) error {
+	obj := a.next()
+	switch obj {
+	case "fdb":
+		return fdb(w, &a)
+	case "vlan":
+		return vlan(w, &a)
+	}
+	return fmt.Errorf("unknown object %q", obj)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+	if err := bridge(os.Stdout, args(os.Args[1:])); err != nil {
+		log.Fatalf("bridge: %v\n%s", err, usage)
+	}
+}
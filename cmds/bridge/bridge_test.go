@@ -0,0 +1,131 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseFDB(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		flags int
+		state int
+		vlan  int
+	}{
+		{"aa:bb:cc:dd:ee:ff dev eth0", netlink.NTF_SELF, netlink.NUD_NOARP | netlink.NUD_PERMANENT, 0},
+		{"aa:bb:cc:dd:ee:ff dev eth0 master", netlink.NTF_MASTER, netlink.NUD_NOARP | netlink.NUD_REACHABLE, 0},
+		{"aa:bb:cc:dd:ee:ff dev eth0 master permanent vlan 10", netlink.NTF_MASTER, netlink.NUD_NOARP | netlink.NUD_PERMANENT, 10},
+		{"aa:bb:cc:dd:ee:ff dev eth0 self master dynamic", netlink.NTF_SELF | netlink.NTF_MASTER, netlink.NUD_REACHABLE, 0},
+	} {
+		a := args(strings.Fields(tt.in))
+		spec, err := parseFDB(&a, true)
+		if err != nil {
+			t.Errorf("parseFDB(%q) = %v", tt.in, err)
+			continue
+		}
+		n := spec.neigh
+		if spec.name != "eth0" || n.Family != unix.AF_BRIDGE || n.Flags != tt.flags || n.State != tt.state || n.Vlan != tt.vlan {
+			t.Errorf("parseFDB(%q) = %+v, %q, want flags %#x, state %#x, vlan %d", tt.in, n, spec.name, tt.flags, tt.state, tt.vlan)
+		}
+	}
+
+	for _, in := range []string{"", "aa:bb:cc:dd:ee:ff", "zz dev eth0", "aa:bb:cc:dd:ee:ff dev", "aa:bb:cc:dd:ee:ff dev eth0 vlan 4096", "aa:bb:cc:dd:ee:ff dev eth0 frob"} {
+		a := args(strings.Fields(in))
+		if _, err := parseFDB(&a, true); err == nil {
+			t.Errorf("parseFDB(%q) = nil, want error", in)
+		}
+	}
+	a := args(strings.Fields("aa:bb:cc:dd:ee:ff dev eth0 static"))
+	if _, err := parseFDB(&a, false); err == nil {
+		t.Errorf("parseFDB(static) for del = nil, want error")
+	}
+}
+
+func TestBadCommands(t *testing.T) {
+	for _, in := range []string{"", "link show", "fdb frob", "vlan frob", "vlan show frob x"} {
+		if err := bridge(&bytes.Buffer{}, args(strings.Fields(in))); err == nil {
+			t.Errorf("bridge %s = nil, want error", in)
+		}
+	}
+}
+
+func run(t *testing.T, in string) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := bridge(&b, args(strings.Fields(in))); err != nil {
+		t.Fatalf("bridge %s = %v", in, err)
+	}
+	return b.String()
+}
+
+func TestFDBAndVLAN(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, not root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Fatal(err)
+	}
+	defer netns.Set(orig)
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetMaster(veth, br); err != nil {
+		t.Fatal(err)
+	}
+
+	const mac = "02:00:00:00:00:01"
+	run(t, "fdb add "+mac+" dev veth0 master")
+	out := run(t, "fdb show br br0")
+	if want := mac + " dev veth0 master br0 static"; !strings.Contains(out, want) {
+		t.Errorf("fdb show = %q, want it to contain %q", out, want)
+	}
+	if out := run(t, "fdb show dev veth1"); strings.Contains(out, mac) {
+		t.Errorf("fdb show dev veth1 = %q, want no %s", out, mac)
+	}
+
+	// Ports get the default VLAN if the kernel supports VLAN filtering.
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = run(t, "vlan show")
+	if !strings.HasPrefix(out, "port\tvlan ids\n") {
+		t.Errorf("vlan show = %q, want a header", out)
+	}
+	if want := "veth0\t 1 PVID Egress Untagged"; len(vlans) > 0 && !strings.Contains(out, want) {
+		t.Errorf("vlan show = %q, want it to contain %q", out, want)
+	}
+	if out := run(t, "vlan show dev br0"); strings.Contains(out, "veth0") {
+		t.Errorf("vlan show dev br0 = %q, want no veth0", out)
+	}
+
+	run(t, "fdb del "+mac+" dev veth0 master")
+	if out := run(t, "fdb show br br0"); strings.Contains(out, mac) {
+		t.Errorf("fdb show after del = %q, want no %s", out, mac)
+	}
+}
@@ -5,40 +5,297 @@
 // Cat concatenates files and prints to stdout.
 //
 // Synopsis:
-//     cat [-u] [FILES]...
+//     cat [-u] [-hex|-binary] [-skip N] [-count N] [-direct] [FILES]...
+//     cat [-label] [-b|-n] [-s] [-E] [FILES]...
 //
 // Description:
 //     If no files are specified, read from stdin.
 //
+//     The line options can be spelled as in GNU cat, such as --number. Lines
+//     are numbered, and blank lines squeezed, across all files.
+//
 // Options:
 //     -u: ignored flag
+//     -hex: print an xxd style hex dump, 16 bytes per line
+//     -binary: copy raw bytes one block at a time, as /dev/mem needs
+//     -skip N: start at byte N of each file
+//     -count N: print at most N bytes of each file
+//     -direct: read with O_DIRECT, bypassing the page cache of block devices
+//     -label: prefix each line with the name of its file and a colon
+//     -b, -number-nonblank: number the lines that are not blank
+//     -n, -number: number all lines
+//     -s, -squeeze-blank: print only one of several blank lines in a row
+//     -E, -show-ends: print $ at the end of each line, and ^M for a
+//         carriage return before it
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"syscall"
+	"unsafe"
 )
 
 var (
-	_ = flag.Bool("u", false, "ignored")
+	_         = flag.Bool("u", false, "ignored")
+	hexOut    = flag.Bool("hex", false, "print an xxd style hex dump")
+	binaryOut = flag.Bool("binary", false, "copy raw bytes one block at a time, without buffering")
+	skip      = flag.Int64("skip", 0, "start at this byte of each file")
+	count     = flag.Int64("count", -1, "print at most this many bytes of each file")
+	direct    = flag.Bool("direct", false, "read with O_DIRECT")
+	label     = flag.Bool("label", false, "prefix each line with the name of its file")
+
+	numberNonblank, number, squeezeBlank, showEnds bool
 )
 
-func catFile(w io.Writer, file string) error {
-	f, err := os.Open(file)
+func init() {
+	for _, f := range []struct {
+		p           *bool
+		short, long string
+		usage       string
+	}{
+		{&numberNonblank, "b", "number-nonblank", "number nonempty lines"},
+		{&number, "n", "number", "number all lines"},
+		{&squeezeBlank, "s", "squeeze-blank", "suppress repeated empty lines"},
+		{&showEnds, "E", "show-ends", "print $ at the end of each line"},
+	} {
+		flag.BoolVar(f.p, f.short, false, f.usage)
+		flag.BoolVar(f.p, f.long, false, f.usage)
+	}
+}
+
+// lineMode is whether cat prints line by line.
+func lineMode() bool {
+	return *label || numberNonblank || number || squeezeBlank || showEnds
+}
+
+// lineState is what the line options need to know about the lines before,
+// which may be in earlier files.
+type lineState struct {
+	// n is the number of the last numbered line.
+	n int
+	// blank is whether the last line was blank.
+	blank bool
+	// midLine is whether the last file did not end with a newline, so its
+	// last line goes on in the next file.
+	midLine bool
+}
+
+// copyLines copies r, the file name, to w as the line options say.
+func (ls *lineState) copyLines(w io.Writer, r io.Reader, name string) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			ls.writeLine(bw, line, name)
+		}
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			bw.Flush()
+			return err
+		}
+	}
+}
+
+// writeLine writes line, which ends with a newline unless it is the last of
+// its file.
+func (ls *lineState) writeLine(w *bufio.Writer, line []byte, name string) {
+	if !ls.midLine {
+		blank := len(line) == 1 && line[0] == '\n'
+		if squeezeBlank && blank && ls.blank {
+			return
+		}
+		ls.blank = blank
+		if *label {
+			fmt.Fprintf(w, "%s:", name)
+		}
+		if (numberNonblank && !blank) || (number && !numberNonblank) {
+			ls.n++
+			fmt.Fprintf(w, "%6d\t", ls.n)
+		}
+	}
+	end := line[len(line)-1] == '\n'
+	ls.midLine = !end
+	if !showEnds || !end {
+		w.Write(line)
+		return
+	}
+	line = line[:len(line)-1]
+	cr := len(line) > 0 && line[len(line)-1] == '\r'
+	if cr {
+		line = line[:len(line)-1]
+	}
+	w.Write(line)
+	if cr {
+		w.WriteString("^M")
+	}
+	w.WriteString("$\n")
+}
+
+// blockSize is the size and alignment of -binary and -direct reads. It is a
+// page, which is what /dev/mem and O_DIRECT on any block device need.
+var blockSize = os.Getpagesize()
+
+func catFile(w io.Writer, file string, ls *lineState) error {
+	mode := os.O_RDONLY
+	if *direct {
+		mode |= syscall.O_DIRECT
+	}
+	f, err := os.OpenFile(file, mode, 0)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = io.Copy(w, f)
+	return catReader(w, f, file, ls)
+}
+
+// catReader prints f, the file name, to w as the flags say.
+func catReader(w io.Writer, f *os.File, name string, ls *lineState) error {
+	var r io.Reader = f
+	discard := *skip
+	if *skip > 0 {
+		off := *skip
+		if *direct {
+			// O_DIRECT reads must start at an aligned offset.
+			off -= off % int64(blockSize)
+		}
+		if _, err := f.Seek(off, io.SeekStart); err == nil {
+			discard -= off
+		}
+	}
+	if *direct {
+		r = &directReader{f: f, buf: alignedBlock(16 * blockSize)}
+	}
+	if discard > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, discard); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if *count >= 0 {
+		r = io.LimitReader(r, *count)
+	}
+
+	switch {
+	case *hexOut:
+		return hexdump(w, r, *skip)
+	case *binaryOut:
+		return copyBlocks(w, r)
+	case lineMode():
+		return ls.copyLines(w, r, name)
+	}
+	_, err := io.Copy(w, r)
 	return err
 }
 
+// copyBlocks copies r to w with one read and one write of at most a block,
+// rather than whatever io.Copy picks.
+func copyBlocks(w io.Writer, r io.Reader) error {
+	b := alignedBlock(blockSize)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if _, werr := w.Write(b[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// alignedBlock returns size bytes starting at a multiple of blockSize.
+func alignedBlock(size int) []byte {
+	b := make([]byte, size+blockSize)
+	off := int(uintptr(unsafe.Pointer(&b[0])) % uintptr(blockSize))
+	if off != 0 {
+		off = blockSize - off
+	}
+	return b[off : off+size]
+}
+
+// directReader reads an O_DIRECT file through an aligned buffer.
+type directReader struct {
+	f    *os.File
+	buf  []byte
+	data []byte
+}
+
+func (d *directReader) Read(p []byte) (int, error) {
+	if len(d.data) == 0 {
+		n, err := d.f.Read(d.buf)
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		d.data = d.buf[:n]
+	}
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	return n, nil
+}
+
+// hexdump writes r to w as xxd(1) does, numbering bytes from off.
+func hexdump(w io.Writer, r io.Reader, off int64) error {
+	bw := bufio.NewWriter(w)
+	b := make([]byte, 16)
+	for {
+		n, err := io.ReadFull(r, b)
+		if n > 0 {
+			hexLine(bw, off, b[:n])
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			bw.Flush()
+			return err
+		}
+	}
+}
+
+// hexLine writes one line of a hex dump of the up to 16 bytes in b.
+func hexLine(w *bufio.Writer, off int64, b []byte) {
+	fmt.Fprintf(w, "%08x: ", off)
+	for i := 0; i < 16; i++ {
+		if i < len(b) {
+			fmt.Fprintf(w, "%02x", b[i])
+		} else {
+			w.WriteString("  ")
+		}
+		if i%2 == 1 {
+			w.WriteByte(' ')
+		}
+	}
+	w.WriteByte(' ')
+	for _, c := range b {
+		if c < ' ' || c > '~' {
+			c = '.'
+		}
+		w.WriteByte(c)
+	}
+	w.WriteByte('\n')
+}
+
 func cat(w io.Writer, files []string) error {
+	ls := &lineState{}
 	for _, name := range files {
-		if err := catFile(w, name); err != nil {
+		if err := catFile(w, name, ls); err != nil {
 			return err
 		}
 	}
@@ -47,9 +304,15 @@ func cat(w io.Writer, files []string) error {
 
 func main() {
 	flag.Parse()
+	if *hexOut && *binaryOut {
+		log.Fatalf("cannot specify both -hex and -binary")
+	}
+	if (*hexOut || *binaryOut) && lineMode() {
+		log.Fatalf("cannot specify line options with -hex or -binary")
+	}
 
 	if flag.NArg() == 0 {
-		if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+		if err := catReader(os.Stdout, os.Stdin, "-", &lineState{}); err != nil {
 			log.Fatalf("error concatenating stdin to stdout: %v", err)
 		}
 	}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +60,188 @@ func TestCat(t *testing.T) {
 		t.Fatalf("Reading files failed: got %v, want %v", b.Bytes(), someData)
 	}
 }
+
+// Output of xxd(1) for the same input.
+func TestHexdump(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		off  int64
+		want string
+	}{
+		{"", 0, ""},
+		{"abc", 0, "00000000: 6162 63                                  abc\n"},
+		{
+			"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x7e\x7f\x80\xff",
+			0,
+			"00000000: 0001 0203 0405 0607 0809 0a0b 0c0d 0e0f  ................\n" +
+				"00000010: 7e7f 80ff                                ~...\n",
+		},
+		{"456789abcdefgh", 4, "00000004: 3435 3637 3839 6162 6364 6566 6768       456789abcdefgh\n"},
+	} {
+		var b bytes.Buffer
+		if err := hexdump(&b, strings.NewReader(tt.in), tt.off); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("hexdump(%q, %d) = %q, want %q", tt.in, tt.off, b.String(), tt.want)
+		}
+	}
+}
+
+// setFlags sets the output flags until the returned function is called.
+func setFlags(hex, binary, dir bool, s, c int64) func() {
+	oldHex, oldBinary, oldDirect, oldSkip, oldCount := *hexOut, *binaryOut, *direct, *skip, *count
+	*hexOut, *binaryOut, *direct, *skip, *count = hex, binary, dir, s, c
+	return func() {
+		*hexOut, *binaryOut, *direct, *skip, *count = oldHex, oldBinary, oldDirect, oldSkip, oldCount
+	}
+}
+
+func TestSkipCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	data := make([]byte, 3*blockSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		hex, binary bool
+		skip, count int64
+		want        string
+	}{
+		{name: "all", count: -1, want: string(data)},
+		{name: "skip", skip: 10, count: -1, want: string(data[10:])},
+		{name: "count", count: 5, want: string(data[:5])},
+		{name: "skip and count", skip: int64(blockSize) + 3, count: 100, want: string(data[blockSize+3 : blockSize+103])},
+		{name: "count past the end", skip: int64(len(data)) - 2, count: 100, want: string(data[len(data)-2:])},
+		{name: "binary", binary: true, skip: 1, count: int64(2 * blockSize), want: string(data[1 : 1+2*blockSize])},
+		{name: "hex", hex: true, skip: 251, count: 3, want: "000000fb: 0001 02                                  ...\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, d := range []bool{false, true} {
+				defer setFlags(tt.hex, tt.binary, d, tt.skip, tt.count)()
+				var b bytes.Buffer
+				if err := cat(&b, []string{file}); err != nil {
+					if d {
+						t.Skipf("O_DIRECT: %v", err)
+					}
+					t.Fatal(err)
+				}
+				if b.String() != tt.want {
+					t.Errorf("cat(direct = %v) printed %d bytes, want %d", d, b.Len(), len(tt.want))
+				}
+			}
+		})
+	}
+}
+
+// setLineFlags sets the line flags until the returned function is called.
+func setLineFlags(l, b, n, s, e bool) func() {
+	oldLabel, oldB, oldN, oldS, oldE := *label, numberNonblank, number, squeezeBlank, showEnds
+	*label, numberNonblank, number, squeezeBlank, showEnds = l, b, n, s, e
+	return func() {
+		*label, numberNonblank, number, squeezeBlank, showEnds = oldLabel, oldB, oldN, oldS, oldE
+	}
+}
+
+func TestLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := ioutil.WriteFile(a, []byte("one\n\n\n\ntwo\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte("three\nno newline"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name              string
+		label, b, n, s, e bool
+		files             []string
+		want              string
+	}{
+		{
+			name:  "label",
+			label: true,
+			files: []string{a, b},
+			want:  a + ":one\n" + a + ":\n" + a + ":\n" + a + ":\n" + a + ":two\r\n" + b + ":three\n" + b + ":no newline",
+		},
+		{
+			name:  "number",
+			n:     true,
+			files: []string{a, b},
+			want:  "     1\tone\n     2\t\n     3\t\n     4\t\n     5\ttwo\r\n     6\tthree\n     7\tno newline",
+		},
+		{
+			name:  "number nonblank",
+			b:     true,
+			files: []string{a},
+			want:  "     1\tone\n\n\n\n     2\ttwo\r\n",
+		},
+		{
+			name:  "number nonblank wins",
+			b:     true,
+			n:     true,
+			files: []string{a},
+			want:  "     1\tone\n\n\n\n     2\ttwo\r\n",
+		},
+		{
+			name:  "squeeze blank",
+			s:     true,
+			files: []string{a},
+			want:  "one\n\ntwo\r\n",
+		},
+		{
+			name:  "squeeze and number",
+			s:     true,
+			n:     true,
+			files: []string{a},
+			want:  "     1\tone\n     2\t\n     3\ttwo\r\n",
+		},
+		{
+			name:  "show ends",
+			e:     true,
+			files: []string{a, b},
+			want:  "one$\n$\n$\n$\ntwo^M$\nthree$\nno newline",
+		},
+		{
+			name:  "everything",
+			label: true,
+			b:     true,
+			s:     true,
+			e:     true,
+			files: []string{b, a},
+			want:  b + ":     1\tthree$\n" + b + ":     2\tno newlineone$\n" + a + ":$\n" + a + ":     3\ttwo^M$\n",
+		},
+		{
+			name:  "a line across files",
+			n:     true,
+			files: []string{b, b},
+			want:  "     1\tthree\n     2\tno newlinethree\n     3\tno newline",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setLineFlags(tt.label, tt.b, tt.n, tt.s, tt.e)()
+			var out bytes.Buffer
+			if err := cat(&out, tt.files); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("cat() = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -4,12 +4,34 @@
 
 // +build !windows !plan9
 
+// Change the root directory and run a command.
+//
+// Synopsis:
+//     chroot [-s] [-u UID:GID] [-g G1,G2,...] [--bind SRC:DST]... [--no-dev] [--no-proc] [--no-sys]
+//            [--resolv-conf] NEWROOT [COMMAND [ARGS]...]
+//
+// Description:
+//     Unless NEWROOT is the current root, the host's /dev, /proc and /sys
+//     are bind-mounted into NEWROOT before COMMAND is run, as arch-chroot
+//     does. All bind mounts are undone in reverse order once COMMAND exits.
+//     COMMAND defaults to /bin/sh -i.
+//
+// Options:
+//     -s:            do not change the working directory to NEWROOT
+//     -u:            user and group ID to run COMMAND as
+//     -g:            supplementary group IDs
+//     --bind:        additionally bind-mount SRC to DST, relative to NEWROOT
+//     --no-dev:      do not bind-mount /dev
+//     --no-proc:     do not bind-mount /proc
+//     --no-sys:      do not bind-mount /sys
+//     --resolv-conf: copy /etc/resolv.conf into NEWROOT
 package main
 
 import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -97,15 +119,56 @@ func (g *groupsSpec) String() string {
 	return buffer.String()
 }
 
+// bindMount is a bind mount of src on the host to dst in the new root.
+type bindMount struct {
+	src string
+	dst string
+}
+
+type bindsSpec struct {
+	mounts []bindMount
+}
+
+func (b *bindsSpec) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Expected bind flag to be \"SRC:DST\", received %s", s)
+	}
+	b.mounts = append(b.mounts, bindMount{src: parts[0], dst: parts[1]})
+	return nil
+}
+
+func (b *bindsSpec) Get() interface{} {
+	return *b
+}
+
+func (b *bindsSpec) String() string {
+	var s []string
+	for _, m := range b.mounts {
+		s = append(s, m.src+":"+m.dst)
+	}
+	return strings.Join(s, ",")
+}
+
 var (
 	skipchdirFlag bool
+	noDev         bool
+	noProc        bool
+	noSys         bool
+	resolvConf    bool
 	user          = defaultUser()
 	groups        = groupsSpec{}
+	binds         = bindsSpec{}
 )
 
 func init() {
 	flag.Var(&user, "u", "specify user and group (ID only) as USER:GROUP")
 	flag.Var(&groups, "g", "specify supplementary group ids as g1,g2,..,gN")
+	flag.Var(&binds, "bind", "bind mount SRC to DST inside newroot, as SRC:DST; may be repeated")
+	flag.BoolVar(&noDev, "no-dev", false, "do not bind mount /dev into newroot")
+	flag.BoolVar(&noProc, "no-proc", false, "do not bind mount /proc into newroot")
+	flag.BoolVar(&noSys, "no-sys", false, "do not bind mount /sys into newroot")
+	flag.BoolVar(&resolvConf, "resolv-conf", false, "copy /etc/resolv.conf into newroot")
 	flag.BoolVar(&skipchdirFlag, "s", false, fmt.Sprint("Use this option to not change",
 		"the working directory to / after changing the root directory to newroot, i.e., ",
 		"inside the chroot. This option is only permitted when newroot is the old / directory."))
@@ -149,6 +212,81 @@ func isRoot(dir string) (bool, error) {
 	return false, nil
 }
 
+// mountBinds bind-mounts each of mounts into root, creating the mount points
+// as needed. The returned function undoes the mounts in reverse order.
+func mountBinds(root string, mounts []bindMount) (func(), error) {
+	var done []string
+	unmount := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(done[i], syscall.MNT_DETACH); err != nil {
+				log.Printf("unmounting %s: %v", done[i], err)
+			}
+		}
+	}
+
+	for _, m := range mounts {
+		target := filepath.Join(root, m.dst)
+		fi, err := os.Stat(m.src)
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+		if fi.IsDir() {
+			err = os.MkdirAll(target, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644); err == nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+		if err := syscall.Mount(m.src, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			unmount()
+			return nil, fmt.Errorf("bind mounting %s on %s: %v", m.src, target, err)
+		}
+		done = append(done, target)
+	}
+	return unmount, nil
+}
+
+// copyResolvConf copies the host's /etc/resolv.conf into root.
+func copyResolvConf(root string) error {
+	b, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(root, "etc", "resolv.conf"), b, 0644)
+}
+
+// chroot runs cmd with its root directory changed to newRoot. Unless
+// newRoot is the current root, mounts are bind-mounted into it first and
+// unmounted again once cmd is done.
+func chroot(newRoot string, mounts []bindMount, cmd *exec.Cmd) error {
+	isOldroot, err := isRoot(newRoot)
+	if err != nil {
+		return err
+	}
+	if !isOldroot {
+		unmount, err := mountBinds(newRoot, mounts)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = newRoot
+	return cmd.Run()
+}
+
 func main() {
 	var (
 		newRoot   string
@@ -181,6 +319,27 @@ func main() {
 		log.Fatal("The -s option is only permitted when newroot is the old / directory")
 	}
 
+	if resolvConf && !isOldroot {
+		if err := copyResolvConf(newRoot); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var mounts []bindMount
+	for _, m := range []struct {
+		skip bool
+		dir  string
+	}{
+		{noDev, "/dev"},
+		{noProc, "/proc"},
+		{noSys, "/sys"},
+	} {
+		if !m.skip {
+			mounts = append(mounts, bindMount{src: m.dir, dst: m.dir})
+		}
+	}
+	mounts = append(mounts, binds.mounts...)
+
 	argv := parseCommand(flag.Args())
 
 	cmd := exec.Command(argv[0], argv[1:]...)
@@ -192,10 +351,15 @@ func main() {
 			Gid:    user.gid,
 			Groups: groups.groups,
 		},
-		Chroot: newRoot,
 	}
 
-	if err = cmd.Run(); err != nil {
+	err = chroot(newRoot, mounts, cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			os.Exit(ws.ExitStatus())
+		}
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -5,7 +5,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 )
 
@@ -129,3 +134,84 @@ func TestGroupsSet(t *testing.T) {
 	}
 
 }
+
+func TestBindsSet(t *testing.T) {
+	var b bindsSpec
+	for _, input := range []string{"/a:/b", "/c:/d"} {
+		if err := b.Set(input); err != nil {
+			t.Errorf("Unexpected error with input: %s, %v", input, err)
+		}
+	}
+	if s := b.String(); s != "/a:/b,/c:/d" {
+		t.Errorf("Unexpected binds %s, want /a:/b,/c:/d", s)
+	}
+
+	for _, input := range []string{"/a", "/a:", ":/b", "/a:/b:/c"} {
+		if err := b.Set(input); err == nil {
+			t.Errorf("Expected error on input: %s", input)
+		}
+	}
+}
+
+// TestHelperProcess is run inside the chroot by TestChroot.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	if _, err := os.Stat("/proc/self"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print("ok")
+	os.Exit(0)
+}
+
+func TestChroot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, requires root")
+	}
+
+	root, err := ioutil.TempDir("", "chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// The test binary is statically linked, so it can run as the helper inside
+	// the otherwise empty root.
+	self, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "helper"), self, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := []bindMount{{src: "/proc", dst: "/proc"}}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/helper", "-test.run=TestHelperProcess")
+	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := chroot(root, mounts, cmd); err != nil {
+		t.Fatalf("chroot: %v: %s", err, stderr.String())
+	}
+	if stdout.String() != "ok" {
+		t.Errorf("helper output = %q, want %q", stdout.String(), "ok")
+	}
+
+	// The bind mount is gone again.
+	fis, err := ioutil.ReadDir(filepath.Join(root, "proc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 0 {
+		t.Errorf("%s/proc still has %d entries after chroot returned", root, len(fis))
+	}
+
+	// Without the bind mount, /proc/self does not exist.
+	cmd = exec.Command("/helper", "-test.run=TestHelperProcess")
+	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	if err := chroot(root, nil, cmd); err == nil {
+		t.Errorf("chroot without /proc: helper found /proc/self")
+	}
+}
@@ -5,7 +5,8 @@
 // Copy files.
 //
 // Synopsis:
-//     cp [-rRfivwP] FROM... TO
+//     cp [-rRfivwPLH] [--progress] [--sparse=WHEN] [--reflink=WHEN]
+//        [--preserve=ATTRS] FROM... TO
 //
 // Options:
 //     -w n: number of worker goroutines
@@ -15,6 +16,18 @@
 //     -f: force overwrite files
 //     -v: verbose copy mode
 //     -P: don't follow symlinks
+//     -L: follow all symlinks
+//     -H: follow symlinks given on the command line
+//     --progress: show bytes copied and the time left per file
+//     --sparse=auto|always|never: keep the holes of sparse files (auto),
+//         also make holes of blocks of zeros (always), or write them out
+//     --reflink=auto|always|never: share the data of files copy-on-write
+//         where the file system can (auto), or fail if it cannot (always)
+//     --preserve=mode,ownership,timestamps,xattrs: keep these attributes,
+//         or all of them with "all"
+//
+// Without -P, -L or -H, cp follows symlinks unless copying recursively,
+// where it copies them as symlinks. -P wins over -L, and -L over -H.
 package main
 
 import (
@@ -28,6 +41,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // buffSize is the length of buffer during
@@ -40,7 +55,13 @@ var (
 	force     bool
 	verbose   bool
 	symlink   bool
+	followAll bool
+	followCmd bool
+	progress  bool
 	nwork     int
+	sparse    = choiceFlag{value: "auto", choices: []string{"auto", "always", "never"}}
+	reflink   = choiceFlag{value: "auto", choices: []string{"auto", "always", "never"}}
+	preserve  preserveFlag
 	input     = bufio.NewReader(os.Stdin)
 	// offchan is a channel used for indicate the nextbuffer to read with worker()
 	offchan = make(chan int64, 0)
@@ -51,7 +72,7 @@ var (
 func init() {
 	defUsage := flag.Usage
 	flag.Usage = func() {
-		os.Args[0] = "cp [-wRrifvP] file[s] ... dest"
+		os.Args[0] = "cp [-wRrifvPLH] [--progress] [--sparse=WHEN] [--reflink=WHEN] [--preserve=ATTRS] file[s] ... dest"
 		defUsage()
 	}
 	flag.IntVar(&nwork, "w", runtime.NumCPU(), "number of worker goroutines")
@@ -61,10 +82,78 @@ func init() {
 	flag.BoolVar(&force, "f", false, "force overwrite files")
 	flag.BoolVar(&verbose, "v", false, "verbose copy mode")
 	flag.BoolVar(&symlink, "P", false, "don't follow symlinks")
-	flag.Parse()
+	flag.BoolVar(&followAll, "L", false, "follow all symlinks")
+	flag.BoolVar(&followCmd, "H", false, "follow symlinks given on the command line")
+	flag.BoolVar(&progress, "progress", false, "show bytes copied and the time left per file")
+	flag.Var(&sparse, "sparse", "keep holes of sparse files: auto, always (also make holes of zeros) or never")
+	flag.Var(&reflink, "reflink", "share data copy-on-write: auto, always (or fail) or never")
+	flag.Var(&preserve, "preserve", "attributes to keep: mode, ownership, timestamps, xattrs or all")
 	go nextOff()
 }
 
+// choiceFlag is a flag whose value is one of choices.
+type choiceFlag struct {
+	value   string
+	choices []string
+}
+
+func (c *choiceFlag) String() string {
+	return c.value
+}
+
+func (c *choiceFlag) Set(s string) error {
+	for _, choice := range c.choices {
+		if s == choice {
+			c.value = s
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", s, strings.Join(c.choices, ", "))
+}
+
+// preserveFlag is the set of attributes --preserve keeps.
+type preserveFlag struct {
+	mode, ownership, timestamps, xattrs bool
+}
+
+func (p *preserveFlag) String() string {
+	var attrs []string
+	for _, a := range []struct {
+		name string
+		set  bool
+	}{
+		{"mode", p.mode},
+		{"ownership", p.ownership},
+		{"timestamps", p.timestamps},
+		{"xattrs", p.xattrs},
+	} {
+		if a.set {
+			attrs = append(attrs, a.name)
+		}
+	}
+	return strings.Join(attrs, ",")
+}
+
+func (p *preserveFlag) Set(s string) error {
+	for _, attr := range strings.Split(s, ",") {
+		switch attr {
+		case "mode":
+			p.mode = true
+		case "ownership":
+			p.ownership = true
+		case "timestamps":
+			p.timestamps = true
+		case "xattrs", "xattr":
+			p.xattrs = true
+		case "all":
+			*p = preserveFlag{mode: true, ownership: true, timestamps: true, xattrs: true}
+		default:
+			return fmt.Errorf("cannot preserve %q", attr)
+		}
+	}
+	return nil
+}
+
 // promptOverwrite ask if the user wants overwrite file
 func promptOverwrite(dst string) (bool, error) {
 	fmt.Printf("cp: overwrite %q? ", dst)
@@ -87,24 +176,44 @@ func copyFile(src, dst string, todir bool) error {
 		file := filepath.Base(src)
 		dst = filepath.Join(dst, file)
 	}
+	return copyEntry(src, dst, true)
+}
+
+// follow returns whether to copy what a symlink points to rather than the
+// symlink, for symlinks given on the command line if cmdline is true.
+func follow(cmdline bool) bool {
+	switch {
+	case symlink:
+		return false
+	case followAll:
+		return true
+	case followCmd:
+		return cmdline
+	default:
+		return !recursive
+	}
+}
 
+// copyEntry copies src to dst, where src was given on the command line if
+// cmdline is true.
+func copyEntry(src, dst string, cmdline bool) error {
 	srcb, err := os.Lstat(src)
 	if err != nil {
 		return fmt.Errorf("can't stat %v: %v", src, err)
 	}
 
-	// don't follow symlinks, copy symlink
-	if L := os.ModeSymlink; symlink && srcb.Mode()&L == L {
-		linkPath, err := filepath.EvalSymlinks(src)
-		if err != nil {
-			return fmt.Errorf("can't eval symlink %v: %v", src, err)
+	if srcb.Mode()&os.ModeSymlink != 0 {
+		if !follow(cmdline) {
+			return copySymlink(src, dst, srcb)
+		}
+		if srcb, err = os.Stat(src); err != nil {
+			return fmt.Errorf("can't stat %v: %v", src, err)
 		}
-		return os.Symlink(linkPath, dst)
 	}
 
 	if srcb.IsDir() {
 		if recursive {
-			return copyDir(src, dst)
+			return copyDir(src, dst, srcb)
 		}
 		return fmt.Errorf("%q is a directory, try use recursive option", src)
 	}
@@ -142,15 +251,101 @@ func copyFile(src, dst string, todir bool) error {
 	}
 	defer d.Close()
 
-	return copyOneFile(s, d, src, dst)
+	if err := copyOneFile(s, d, srcb.Size(), src, dst); err != nil {
+		return err
+	}
+	return preserveAttrs(src, dst, srcb)
+}
+
+// copySymlink copies the symlink src, not what it points to.
+func copySymlink(src, dst string, fi os.FileInfo) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("can't read symlink %v: %v", src, err)
+	}
+	if force {
+		os.Remove(dst)
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Printf("%q -> %q\n", src, dst)
+	}
+	return preserveAttrs(src, dst, fi)
+}
+
+// preserveAttrs gives dst the attributes of src, described by fi, that
+// --preserve asks for.
+func preserveAttrs(src, dst string, fi os.FileInfo) error {
+	link := fi.Mode()&os.ModeSymlink != 0
+	// Changing the owner clears the set-user-ID bit and file
+	// capabilities, so it goes first. Like GNU cp, give up quietly on
+	// files we may not give away.
+	if uid, gid, ok := fileOwner(fi); preserve.ownership && ok {
+		if err := os.Lchown(dst, uid, gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	if preserve.mode && !link {
+		if err := os.Chmod(dst, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if preserve.xattrs {
+		if err := copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+	if preserve.timestamps {
+		if err := setTimes(dst, fi); err != nil {
+			return fmt.Errorf("can't set times of %q: %v", dst, err)
+		}
+	}
+	return nil
+}
+
+// copyOneFile copies the content of s, size bytes long, to d: sharing it
+// copy-on-write by --reflink, skipping holes by --sparse, and else with
+// nwork workers in parallel.
+func copyOneFile(s *os.File, d *os.File, size int64, src, dst string) error {
+	p := startProgress(dst, size)
+	defer p.finish()
+
+	if err := copyContents(s, d, size, p); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("%q -> %q\n", src, dst)
+	}
+
+	return nil
 }
 
-// copyOneFile copy the content between two files
-func copyOneFile(s *os.File, d *os.File, src, dst string) error {
+func copyContents(s *os.File, d *os.File, size int64, p *progressMeter) error {
+	if reflink.value != "never" {
+		err := cloneFile(d, s)
+		if err == nil {
+			p.add(size)
+			return nil
+		}
+		if reflink.value == "always" {
+			return fmt.Errorf("can't reflink %s to %s: %v", s.Name(), d.Name(), err)
+		}
+	}
+
+	switch {
+	case sparse.value == "always":
+		return copySparse(s, d, size, true, p)
+	case sparse.value == "auto" && mayHaveHoles(s):
+		return copySparse(s, d, size, false, p)
+	}
+
 	zerochan <- 0
 	fail := make(chan error, nwork)
 	for i := 0; i < nwork; i++ {
-		go worker(s, d, fail)
+		go worker(s, d, fail, p)
 	}
 
 	// iterate the errors from channel
@@ -160,18 +355,156 @@ func copyOneFile(s *os.File, d *os.File, src, dst string) error {
 			return err
 		}
 	}
+	return nil
+}
 
-	if verbose {
-		fmt.Printf("%q -> %q\n", src, dst)
+// extent is a range of a file.
+type extent struct {
+	off, len int64
+}
+
+// copySparse copies the data extents of s, size bytes long, to d, leaving
+// holes where s has them. With zeros true, it leaves holes for blocks of
+// zeros in the data too.
+func copySparse(s *os.File, d *os.File, size int64, zeros bool, p *progressMeter) error {
+	extents, err := dataExtents(s, size)
+	if err != nil {
+		return fmt.Errorf("can't find holes in %s: %v", s.Name(), err)
+	}
+	buf := make([]byte, buffSize)
+	var pos int64
+	for _, e := range extents {
+		p.add(e.off - pos)
+		for pos = e.off; pos < e.off+e.len; {
+			b := buf
+			if rest := e.off + e.len - pos; rest < int64(len(b)) {
+				b = b[:rest]
+			}
+			n, err := s.ReadAt(b, pos)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("reading %s at %v: %v", s.Name(), pos, err)
+			}
+			if n == 0 {
+				break
+			}
+			if !zeros || !allZero(b[:n]) {
+				if _, err := d.WriteAt(b[:n], pos); err != nil {
+					return fmt.Errorf("writing %s: %v", d.Name(), err)
+				}
+			}
+			p.add(int64(n))
+			pos += int64(n)
+		}
 	}
+	p.add(size - pos)
+	// What is not written after the last extent is a hole still.
+	return d.Truncate(size)
+}
 
-	return nil
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// progressInterval is how often --progress updates.
+var progressInterval = time.Second
+
+// progressOut is where --progress writes.
+var progressOut io.Writer = os.Stderr
+
+// progressMeter shows how much of a file is copied, if --progress is set.
+// A nil progressMeter shows nothing.
+type progressMeter struct {
+	name  string
+	size  int64
+	start time.Time
+	// copied is updated atomically by the workers.
+	copied int64
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func startProgress(name string, size int64) *progressMeter {
+	if !progress {
+		return nil
+	}
+	p := &progressMeter{
+		name:  name,
+		size:  size,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case now := <-t.C:
+				fmt.Fprintf(progressOut, "\r%s", p.line(now))
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progressMeter) add(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.copied, n)
+	}
+}
+
+// finish stops updating p and writes its last line.
+func (p *progressMeter) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	fmt.Fprintf(progressOut, "\r%s\n", p.line(time.Now()))
+}
+
+// line returns the progress of p at now, as in
+// "dst: 512.0 KiB / 2.0 MiB (25%), ETA 3s".
+func (p *progressMeter) line(now time.Time) string {
+	copied := atomic.LoadInt64(&p.copied)
+	percent := int64(100)
+	if p.size > 0 {
+		percent = copied * 100 / p.size
+	}
+	eta := "unknown"
+	if copied > 0 {
+		elapsed := now.Sub(p.start)
+		left := time.Duration(float64(elapsed) * float64(p.size-copied) / float64(copied))
+		eta = left.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s: %s / %s (%d%%), ETA %s", p.name, humanBytes(copied), humanBytes(p.size), percent, eta)
+}
+
+// humanBytes returns n in B, KiB, MiB or GiB.
+func humanBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
 }
 
 // createDir populate dir destination if not exists
 // if exists verify is not a dir: return error if is file
 // cannot overwrite: dir -> file
-func createDir(src, dst string) error {
+func createDir(src, dst string, srcInfo os.FileInfo) error {
 	dstInfo, err := os.Stat(dst)
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -184,10 +517,6 @@ func createDir(src, dst string) error {
 		return nil
 	}
 
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
 	if err := os.Mkdir(dst, srcInfo.Mode()); err != nil {
 		return err
 	}
@@ -200,8 +529,8 @@ func createDir(src, dst string) error {
 
 // copyDir copy the file hierarchies
 // used at cp when -r or -R flag is true
-func copyDir(src, dst string) error {
-	if err := createDir(src, dst); err != nil {
+func copyDir(src, dst string, srcInfo os.FileInfo) error {
+	if err := createDir(src, dst, srcInfo); err != nil {
 		return err
 	}
 
@@ -212,19 +541,27 @@ func copyDir(src, dst string) error {
 	}
 
 	// copy recursively the src -> dst
+	failed := false
 	for _, file := range files {
 		fname := file.Name()
 		fpath := filepath.Join(src, fname)
 		newDst := filepath.Join(dst, fname)
-		copyFile(fpath, newDst, false)
+		if err := copyEntry(fpath, newDst, false); err != nil {
+			log.Printf("cp: %v", err)
+			failed = true
+		}
+	}
+	if failed {
+		return fmt.Errorf("can't copy all of %q", src)
 	}
 
-	return err
+	// Copying the entries changed the times of dst.
+	return preserveAttrs(src, dst, srcInfo)
 }
 
 // worker is a concurrent copy, used to copy part of the files
 // in parallel
-func worker(s *os.File, d *os.File, fail chan error) {
+func worker(s *os.File, d *os.File, fail chan error, p *progressMeter) {
 	var buf [buffSize]byte
 	var bp []byte
 
@@ -247,6 +584,7 @@ func worker(s *os.File, d *os.File, fail chan error) {
 			fail <- fmt.Errorf("writing %s: %v", d.Name(), err)
 			return
 		}
+		p.add(int64(n))
 		bp = buf[n:]
 		o += int64(n)
 		l -= n
@@ -298,6 +636,7 @@ func cp(args []string) (lastErr error) {
 }
 
 func main() {
+	flag.Parse()
 	if flag.NArg() < 2 {
 		flag.Usage()
 		os.Exit(1)
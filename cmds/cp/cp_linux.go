@@ -0,0 +1,118 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+
+	// ficlone is FICLONE, _IOW(0x94, 9, int), as most architectures
+	// encode it. Where it is encoded otherwise, cloning fails and
+	// --reflink=auto copies.
+	ficlone = 0x40049409
+)
+
+// cloneFile makes d share the data of s copy-on-write, on file systems
+// like btrfs and XFS that can.
+func cloneFile(d, s *os.File) error {
+	return unix.IoctlSetInt(int(d.Fd()), ficlone, int(s.Fd()))
+}
+
+// mayHaveHoles returns whether f takes fewer blocks than its size needs.
+func mayHaveHoles(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < fi.Size()
+}
+
+// dataExtents returns the extents of f, size bytes long, that are not
+// holes, by SEEK_DATA and SEEK_HOLE. If the file system cannot tell, all of f
+// is data.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	fd := int(f.Fd())
+	var extents []extent
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, seekData)
+		// ENXIO: there is no data after off.
+		if err == unix.ENXIO {
+			break
+		}
+		if err == unix.EINVAL && off == 0 {
+			return []extent{{0, size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		extents = append(extents, extent{data, hole - data})
+		off = hole
+	}
+	return extents, nil
+}
+
+// copyXattrs copies the extended attributes of src to dst, not following
+// symlinks.
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't list xattrs of %q: %v", src, err)
+	}
+	names := make([]byte, size)
+	if size, err = unix.Llistxattr(src, names); err != nil {
+		return fmt.Errorf("can't list xattrs of %q: %v", src, err)
+	}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := unix.Lgetxattr(src, string(name), nil)
+		if err != nil {
+			return fmt.Errorf("can't get xattr %s of %q: %v", name, src, err)
+		}
+		v := make([]byte, n)
+		if n, err = unix.Lgetxattr(src, string(name), v); err != nil {
+			return fmt.Errorf("can't get xattr %s of %q: %v", name, src, err)
+		}
+		if err := unix.Lsetxattr(dst, string(name), v[:n], 0); err != nil {
+			return fmt.Errorf("can't set xattr %s of %q: %v", name, dst, err)
+		}
+	}
+	return nil
+}
+
+// setTimes gives path, which may be a symlink, the access and modification
+// times of fi.
+func setTimes(path string, fi os.FileInfo) error {
+	atime := fi.ModTime().UnixNano()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		atime = st.Atim.Nano()
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime),
+		unix.NsecToTimespec(fi.ModTime().UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocated returns how many bytes of disk p takes.
+func allocated(t *testing.T, p string) int64 {
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+// TestCpSparse copies a sparse file, 8 MiB with 64 KiB of data at 2 MiB and
+// a block of zeros at 4 MiB, and back.
+func TestCpSparse(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "TestCpSparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const size = 8 << 20
+	src := filepath.Join(tempDir, "sparse")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0xaa}, 64<<10)
+	if _, err := f.WriteAt(data, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 64<<10), 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if a := allocated(t, src); a >= size/2 {
+		t.Skipf("%s does not make holes: %d bytes allocated", tempDir, a)
+	}
+	want, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		sparse string
+		// max and min bound the bytes allocated for the copy.
+		min, max int64
+	}{
+		// With the zeros, more than the data, less than half.
+		{sparse: "auto", min: 128 << 10, max: size / 2},
+		{sparse: "always", min: 64 << 10, max: 128 << 10},
+		{sparse: "never", min: size, max: size + 1<<20},
+	} {
+		t.Run(tt.sparse, func(t *testing.T) {
+			defer resetFlags()
+			sparse.value = tt.sparse
+			dst := filepath.Join(tempDir, tt.sparse)
+			if err := copyFile(src, dst, false); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("copy with --sparse=%s differs from the original", tt.sparse)
+			}
+			if a := allocated(t, dst); a < tt.min || a > tt.max {
+				t.Errorf("copy with --sparse=%s takes %d bytes, want %d to %d", tt.sparse, a, tt.min, tt.max)
+			}
+
+			// And back, to a file that is not sparse.
+			back := dst + ".back"
+			if err := copyFile(dst, back, false); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadFile(back); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("copy of copy with --sparse=%s differs from the original: %v", tt.sparse, err)
+			}
+		})
+	}
+
+	extents, err := dataExtents(mustOpen(t, src), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range extents {
+		if e.off > 2<<20 || e.off+e.len < 2<<20+64<<10 {
+			continue
+		}
+		return
+	}
+	t.Errorf("dataExtents(%s) = %v, want an extent covering the data at 2 MiB", src, extents)
+}
+
+func mustOpen(t *testing.T, p string) *os.File {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// TestCpReflink copies with --reflink, which only btrfs, XFS and the like
+// can do; elsewhere --reflink=always must fail.
+func TestCpReflink(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "TestCpReflink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	src := filepath.Join(tempDir, "src")
+	want := bytes.Repeat([]byte("copy on write "), 10000)
+	if err := ioutil.WriteFile(src, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	probe, err := os.Create(filepath.Join(tempDir, "probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	canClone := cloneFile(probe, mustOpen(t, src)) == nil
+	probe.Close()
+
+	for _, mode := range []string{"always", "auto", "never"} {
+		t.Run(mode, func(t *testing.T) {
+			defer resetFlags()
+			reflink.value = mode
+			dst := filepath.Join(tempDir, mode)
+			err := copyFile(src, dst, false)
+			if mode == "always" && !canClone {
+				if err == nil {
+					t.Errorf("--reflink=always succeeded where FICLONE fails")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("copy with --reflink=%s differs from the original: %v", mode, err)
+			}
+		})
+	}
+}
+
+// TestCpPreserveXattrs copies with --preserve=xattrs.
+func TestCpPreserveXattrs(t *testing.T) {
+	defer resetFlags()
+	tempDir, err := ioutil.TempDir("", "TestCpPreserveXattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	src := filepath.Join(tempDir, "src")
+	if err := ioutil.WriteFile(src, []byte("labeled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(src, "user.u-root.cp", []byte("label"), 0); err != nil {
+		t.Skipf("setting xattrs in %s: %v", tempDir, err)
+	}
+
+	for _, xattrs := range []bool{false, true} {
+		preserve.xattrs = xattrs
+		dst := filepath.Join(tempDir, "dst")
+		os.Remove(dst)
+		if err := copyFile(src, dst, false); err != nil {
+			t.Fatal(err)
+		}
+		v := make([]byte, 64)
+		n, err := unix.Getxattr(dst, "user.u-root.cp", v)
+		if xattrs && (err != nil || string(v[:n]) != "label") {
+			t.Errorf("xattr of copy with --preserve=xattrs = %q, %v, want label", v[:n], err)
+		}
+		if !xattrs && err != unix.ENODATA {
+			t.Errorf("xattr of copy without --preserve=xattrs = %q, %v, want ENODATA", v[:n], err)
+		}
+	}
+}
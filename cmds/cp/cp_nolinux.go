@@ -0,0 +1,41 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("not supported on this system")
+
+func cloneFile(d, s *os.File) error {
+	return errUnsupported
+}
+
+func mayHaveHoles(f *os.File) bool {
+	return false
+}
+
+// dataExtents returns all of f: there is no telling holes here.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	return []extent{{0, size}}, nil
+}
+
+func copyXattrs(src, dst string) error {
+	return errUnsupported
+}
+
+// setTimes gives path the modification time of fi, also as access time.
+// Symlinks keep theirs.
+func setTimes(path string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
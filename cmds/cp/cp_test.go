@@ -7,12 +7,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -37,6 +41,12 @@ func resetFlags() {
 	force = false
 	verbose = false
 	symlink = false
+	followAll = false
+	followCmd = false
+	progress = false
+	sparse.value = "auto"
+	reflink.value = "auto"
+	preserve = preserveFlag{}
 }
 
 // randomFile create a random file with random content
@@ -400,3 +410,279 @@ func TestCpSymlink(t *testing.T) {
 		t.Fatalf("checksum are different; copies failed %q -> %q: %v", linkName, dstFname, err)
 	}
 }
+
+// symlinkTree creates in dir a file, a directory with a file, and the
+// symlinks file-link and dir-link to them, and returns the tree's root.
+func symlinkTree(t *testing.T, dir string) string {
+	root := filepath.Join(dir, "tree")
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"file", "dir/file"} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"file-link": "file", "dir-link": "dir"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// TestCpSymlinkModes copies symlinks with -P, -L, -H and without any of
+// them, on the command line and in trees.
+func TestCpSymlinkModes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "TestCpSymlinkModes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := symlinkTree(t, tempDir)
+	if err := os.Symlink("tree", filepath.Join(tempDir, "tree-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		set       func()
+		recursive bool
+		src       string
+		// links are the paths below the copy that must be symlinks,
+		// files those that must not.
+		links, files []string
+	}{
+		{
+			name:  "default follows",
+			src:   "tree/file-link",
+			files: []string{""},
+		},
+		{
+			name:  "P",
+			set:   func() { symlink = true },
+			src:   "tree/file-link",
+			links: []string{""},
+		},
+		{
+			name:      "default recursive",
+			recursive: true,
+			src:       "tree",
+			links:     []string{"file-link", "dir-link"},
+			files:     []string{"file", "dir/file"},
+		},
+		{
+			name:      "L",
+			set:       func() { followAll = true },
+			recursive: true,
+			src:       "tree-link",
+			files:     []string{"file", "file-link", "dir-link/file"},
+		},
+		{
+			name:      "H",
+			set:       func() { followCmd = true },
+			recursive: true,
+			src:       "tree-link",
+			links:     []string{"file-link", "dir-link"},
+			files:     []string{"file", "dir/file"},
+		},
+		{
+			name:      "P wins",
+			set:       func() { symlink, followAll, followCmd = true, true, true },
+			recursive: true,
+			src:       "tree-link",
+			links:     []string{""},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetFlags()
+			recursive = tt.recursive
+			if tt.set != nil {
+				tt.set()
+			}
+			dst := filepath.Join(tempDir, "copy")
+			defer os.RemoveAll(dst)
+			if err := copyFile(filepath.Join(tempDir, tt.src), dst, false); err != nil {
+				t.Fatalf("copyFile(%s) = %v", tt.src, err)
+			}
+			for _, l := range tt.links {
+				p := filepath.Join(dst, l)
+				target, err := os.Readlink(p)
+				if err != nil {
+					t.Errorf("%s is not a symlink: %v", p, err)
+					continue
+				}
+				// Targets are copied as they are, not resolved.
+				if filepath.IsAbs(target) {
+					t.Errorf("%s points to %s, want a relative target", p, target)
+				}
+			}
+			for _, f := range tt.files {
+				p := filepath.Join(dst, f)
+				fi, err := os.Lstat(p)
+				if err != nil {
+					t.Errorf("%s: %v", p, err)
+				} else if fi.Mode()&os.ModeSymlink != 0 {
+					t.Errorf("%s is a symlink, want a copy", p)
+				}
+			}
+		})
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("copying changed the source: %v", err)
+	}
+}
+
+// TestCpProgress copies with --progress.
+func TestCpProgress(t *testing.T) {
+	defer resetFlags()
+	defer func(w io.Writer, d time.Duration) { progressOut, progressInterval = w, d }(progressOut, progressInterval)
+	var out bytes.Buffer
+	progress, progressOut, progressInterval = true, &out, time.Millisecond
+
+	tempDir, err := ioutil.TempDir("", "TestCpProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	src, dst := filepath.Join(tempDir, "src"), filepath.Join(tempDir, "dst")
+	if err := ioutil.WriteFile(src, bytes.Repeat([]byte("u-root"), 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dst, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\r")
+	if last, want := lines[len(lines)-1], dst+": 6.0 MiB / 6.0 MiB (100%), ETA 0s"; last != want {
+		t.Errorf("last progress line = %q, want %q", last, want)
+	}
+
+	start := time.Now()
+	p := &progressMeter{name: "vmlinuz", size: 4 << 20, start: start}
+	if got, want := p.line(start.Add(time.Second)), "vmlinuz: 0 B / 4.0 MiB (0%), ETA unknown"; got != want {
+		t.Errorf("line() = %q, want %q", got, want)
+	}
+	p.add(1 << 20)
+	if got, want := p.line(start.Add(2*time.Second)), "vmlinuz: 1.0 MiB / 4.0 MiB (25%), ETA 6s"; got != want {
+		t.Errorf("line() = %q, want %q", got, want)
+	}
+	// Without --progress, there is no meter, and that is fine.
+	progress = false
+	startProgress("vmlinuz", 1).add(1)
+}
+
+// TestCpPreserve copies with --preserve=mode,timestamps and, as root,
+// ownership.
+func TestCpPreserve(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "TestCpPreserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	src := filepath.Join(tempDir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "dir", "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)
+	for _, p := range []string{file, filepath.Join(src, "dir"), src} {
+		if err := os.Chmod(p, 0751); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := os.Getuid() == 0
+	if root {
+		if err := os.Lchown(file, 4242, 4242); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		preserve string
+		mode     os.FileMode
+		mtime    bool
+	}{
+		{name: "none", mode: 0751 &^ umask()},
+		{name: "mode", preserve: "mode", mode: 0751},
+		{name: "all", preserve: "all", mode: 0751, mtime: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetFlags()
+			recursive = true
+			if tt.preserve != "" {
+				if err := preserve.Set(tt.preserve); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dst := filepath.Join(tempDir, tt.name)
+			if err := copyFile(src, dst, false); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{dst, filepath.Join(dst, "dir"), filepath.Join(dst, "dir", "file")} {
+				fi, err := os.Stat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode().Perm() != tt.mode {
+					t.Errorf("%s has mode %v, want %v", p, fi.Mode().Perm(), tt.mode)
+				}
+				if got := fi.ModTime().Equal(mtime); got != tt.mtime {
+					t.Errorf("%s modified at %v, preserved = %v, want %v", p, fi.ModTime(), got, tt.mtime)
+				}
+			}
+			if uid, _, _ := fileOwner(mustStat(t, filepath.Join(dst, "dir", "file"))); root && (uid == 4242) != tt.mtime {
+				t.Errorf("copy of file owned by %d with --preserve=%s", uid, tt.preserve)
+			}
+		})
+	}
+}
+
+func mustStat(t *testing.T, p string) os.FileInfo {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+// umask returns the umask of the process.
+func umask() os.FileMode {
+	m := syscall.Umask(0)
+	syscall.Umask(m)
+	return os.FileMode(m)
+}
+
+func TestCpFlags(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"mode", "mode", true},
+		{"timestamps,ownership", "ownership,timestamps", true},
+		{"xattr", "xattrs", true},
+		{"all", "mode,ownership,timestamps,xattrs", true},
+		{"mode,links", "", false},
+	} {
+		var p preserveFlag
+		err := p.Set(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && p.String() != tt.want) {
+			t.Errorf("--preserve=%s = %q, %v, want %q", tt.in, p.String(), err, tt.want)
+		}
+	}
+
+	c := choiceFlag{value: "auto", choices: []string{"auto", "always", "never"}}
+	if err := c.Set("always"); err != nil || c.String() != "always" {
+		t.Errorf("Set(always) = %v, value %q", err, c.String())
+	}
+	if err := c.Set("sometimes"); err == nil || c.String() != "always" {
+		t.Errorf("Set(sometimes) = %v, value %q, want error and always", err, c.String())
+	}
+}
@@ -6,10 +6,22 @@
 
 package main
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
 
 func sameFile(sys1, sys2 interface{}) bool {
 	stat1 := sys1.(*syscall.Stat_t)
 	stat2 := sys2.(*syscall.Stat_t)
 	return stat1.Dev == stat2.Dev && stat1.Ino == stat2.Ino
 }
+
+// fileOwner returns the owner and group of fi.
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
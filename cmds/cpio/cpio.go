@@ -16,6 +16,7 @@
 //     i: output files from a stdin stream
 //     t: print table of contents
 //     -v: debug prints
+//     -xattrs: in o mode, add extended attributes
 //
 // Bugs: in i mode, it can't use non-seekable stdin, i.e. a pipe. Yep, this sucks.
 // But if we implement seek on such things, we have to do it by reading, which
@@ -40,6 +41,7 @@ var (
 	debug  = func(string, ...interface{}) {}
 	d      = flag.Bool("v", false, "Debug prints")
 	format = flag.String("H", "newc", "format")
+	xattrs = flag.Bool("xattrs", false, "Add extended attributes in o mode")
 )
 
 func usage() {
@@ -84,10 +86,14 @@ func main() {
 	case "o":
 		rw := archiver.Writer(os.Stdout)
 		scanner := bufio.NewScanner(os.Stdin)
+		getRecord := cpio.GetRecord
+		if *xattrs {
+			getRecord = cpio.GetRecordWithXAttrs
+		}
 
 		for scanner.Scan() {
 			name := scanner.Text()
-			rec, err := cpio.GetRecord(name)
+			rec, err := getRecord(name)
 			if err != nil {
 				log.Fatalf("Getting record of %q failed: %v", name, err)
 			}
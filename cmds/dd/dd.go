@@ -16,23 +16,35 @@
 //     -bs n:    input and output block size (default=0)
 //     -skip n:  skip n ibs-sized input blocks before reading (default=0)
 //     -seek n:  seek n obs-sized output blocks before writing (default=0)
-//     -conv s:  comma separated list of conversions (none|notrunc)
+//     -conv s:  comma separated list of conversions (none|notrunc|fsync|sparse)
 //     -count n: copy only n ibs-sized input blocks
 //     -if:      defaults to stdin
 //     -of:      defaults to stdout
-//     -oflag:   comma separated list of out flags (none|sync|dsync)
+//     -iflag:   comma separated list of in flags (none|sync|direct)
+//     -oflag:   comma separated list of out flags (none|sync|dsync|direct)
+//     -sparse-detect-size n: with conv=sparse, the size of zero blocks to
+//               skip rather than write (default=obs)
 //     -status:  print transfer stats to stderr, can be one of:
 //         none:     do not display
 //         xfer:     print on completion (default)
 //         progress: print throughout transfer (GNU)
 //
 // Notes:
+//     With conv=sparse, output blocks of only zeros are seeked over rather
+//     than written, which leaves holes in regular files.
+//
+//     The direct flags use O_DIRECT, which bypasses the page cache. Unless bs
+//     is given, block sizes are then rounded up to multiples of 512 bytes, as
+//     O_DIRECT needs. Files that do not support O_DIRECT, and the last block
+//     of a file if it is short, are copied without it.
+//
 //     Because UTF-8 clashes with block-oriented copying, `conv=lcase` and
 //     `conv=ucase` will not be supported. Additionally, research showed these
 //     arguments are rarely useful. Use tr instead.
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -45,19 +57,23 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/rck/unit"
+	"golang.org/x/sys/unix"
 )
 
 var (
 	ibs, obs, bs *unit.Value
 	skip         = flag.Int64("skip", 0, "skip N ibs-sized blocks before reading")
 	seek         = flag.Int64("seek", 0, "seek N obs-sized blocks before writing")
-	conv         = flag.String("conv", "none", "comma separated list of conversions (none|notrunc)")
+	conv         = flag.String("conv", "none", "comma separated list of conversions (none|notrunc|fsync|sparse)")
 	count        = flag.Int64("count", math.MaxInt64, "copy only N input blocks")
 	inName       = flag.String("if", "", "Input file")
 	outName      = flag.String("of", "", "Output file")
-	oFlag        = flag.String("oflag", "none", "comma separated list of out flags (none|sync|dsync)")
+	iFlag        = flag.String("iflag", "none", "comma separated list of in flags (none|sync|direct)")
+	oFlag        = flag.String("oflag", "none", "comma separated list of out flags (none|sync|dsync|direct)")
+	sparseSize   = flag.Int64("sparse-detect-size", 0, "with conv=sparse, skip zero blocks of N bytes (default obs)")
 	status       = flag.String("status", "xfer", "display status of transfer (none|xfer|progress)")
 
 	bytesWritten int64 // access atomically, must be global for correct alignedness
@@ -67,15 +83,31 @@ const (
 	convNoTrunc = 1 << iota
 	oFlagSync
 	oFlagDSync
+	convFsync
+	oFlagDirect
+	iFlagSync
+	iFlagDirect
+	convSparse
 )
 
+// sectorSize is the alignment O_DIRECT needs of buffers, sizes and offsets.
+const sectorSize = 512
+
 var convMap = map[string]int{
 	"notrunc": convNoTrunc,
+	"fsync":   convFsync,
+	"sparse":  convSparse,
 }
 
 var flagMap = map[string]int{
-	"sync":  oFlagSync,
-	"dsync": oFlagDSync,
+	"sync":   oFlagSync,
+	"dsync":  oFlagDSync,
+	"direct": oFlagDirect,
+}
+
+var iFlagMap = map[string]int{
+	"sync":   iFlagSync,
+	"direct": iFlagDirect,
 }
 
 // intermediateBuffer is a buffer that one can write to and read from.
@@ -111,14 +143,112 @@ func init() {
 // newChunkedBuffer returns an intermediateBuffer that stores inChunkSize-sized
 // chunks of data and writes them to writers in outChunkSize-sized chunks.
 func newChunkedBuffer(inChunkSize int64, outChunkSize int64, flags int) intermediateBuffer {
+	data := make([]byte, inChunkSize)
+	if flags&(iFlagDirect|oFlagDirect) != 0 {
+		data = alignedBuffer(inChunkSize)
+	}
 	return &chunkedBuffer{
 		outChunk: outChunkSize,
 		length:   0,
-		data:     make([]byte, inChunkSize),
+		data:     data,
 		flags:    flags,
 	}
 }
 
+// alignedBuffer returns a buffer of size bytes whose address is a multiple of
+// sectorSize.
+func alignedBuffer(size int64) []byte {
+	b := make([]byte, size+sectorSize)
+	off := 0
+	if r := int(uintptr(unsafe.Pointer(&b[0])) % sectorSize); r != 0 {
+		off = sectorSize - r
+	}
+	return b[off : off+int(size)]
+}
+
+// directFile is a file that may be opened with O_DIRECT.
+type directFile struct {
+	*os.File
+	direct bool
+}
+
+// openFile opens name like os.OpenFile, and with O_DIRECT if direct is set
+// and the file system supports it.
+func openFile(name string, flag int, perm os.FileMode, direct bool) (*directFile, error) {
+	if direct {
+		f, err := os.OpenFile(name, flag|unix.O_DIRECT, perm)
+		if err == nil {
+			return &directFile{File: f, direct: true}, nil
+		}
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EINVAL {
+			return nil, err
+		}
+		log.Printf("%s does not support direct I/O, using buffered I/O", name)
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &directFile{File: f}, nil
+}
+
+// buffered turns off O_DIRECT.
+func (f *directFile) buffered(why string) error {
+	fl, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err == nil {
+		_, err = unix.FcntlInt(f.Fd(), unix.F_SETFL, fl&^unix.O_DIRECT)
+	}
+	if err != nil {
+		return fmt.Errorf("turning off direct I/O on %s: %v", f.Name(), err)
+	}
+	if why != "" {
+		log.Printf("%s: %s, using buffered I/O", f.Name(), why)
+	}
+	f.direct = false
+	return nil
+}
+
+// ReadAt implements io.ReaderAt, falling back to buffered reads if direct ones
+// are refused.
+func (f *directFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.direct && (len(p)%sectorSize != 0 || off%sectorSize != 0) {
+		if err := f.buffered(fmt.Sprintf("reading %d bytes at %d is not sector aligned", len(p), off)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.File.ReadAt(p, off)
+	if f.direct && n == 0 && isEINVAL(err) {
+		if err := f.buffered("direct read failed"); err != nil {
+			return 0, err
+		}
+		return f.File.ReadAt(p, off)
+	}
+	return n, err
+}
+
+// Write implements io.Writer. A short last block cannot be written with
+// O_DIRECT, so it is written through the page cache.
+func (f *directFile) Write(p []byte) (int, error) {
+	if f.direct && len(p)%sectorSize != 0 {
+		if err := f.buffered(""); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.File.Write(p)
+	if f.direct && n == 0 && isEINVAL(err) {
+		if err := f.buffered("direct write failed"); err != nil {
+			return 0, err
+		}
+		return f.File.Write(p)
+	}
+	return n, err
+}
+
+func isEINVAL(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == syscall.EINVAL
+}
+
 // ReadFrom reads an inChunkSize-sized chunk from r into the buffer.
 func (cb *chunkedBuffer) ReadFrom(r io.Reader) (int64, error) {
 	n, err := r.Read(cb.data)
@@ -321,7 +451,7 @@ func (s *sectionReader) Read(p []byte) (int, error) {
 }
 
 // inFile opens the input file and seeks to the right position.
-func inFile(name string, inputBytes int64, skip int64, count int64) (io.Reader, error) {
+func inFile(name string, inputBytes int64, skip int64, count int64, flags int) (io.Reader, error) {
 	maxRead := int64(math.MaxInt64)
 	if count != math.MaxInt64 {
 		maxRead = count * inputBytes
@@ -333,16 +463,92 @@ func inFile(name string, inputBytes int64, skip int64, count int64) (io.Reader,
 		return newStreamSectionReader(os.Stdin, inputBytes*skip, maxRead), nil
 	}
 
-	in, err := os.Open(name)
+	perm := os.O_RDONLY
+	if flags&iFlagSync != 0 {
+		perm |= os.O_SYNC
+	}
+	in, err := openFile(name, perm, 0, flags&iFlagDirect != 0)
 	if err != nil {
 		return nil, fmt.Errorf("error opening input file %q: %v", name, err)
 	}
 	return io.NewSectionReader(in, inputBytes*skip, maxRead), nil
 }
 
-// outFile opens the output file and seeks to the right position.
-func outFile(name string, outputBytes int64, seek int64, flags int) (io.Writer, error) {
-	var out io.WriteSeeker
+// file is an output file that can have holes.
+type file interface {
+	io.WriteSeeker
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// sparseWriter seeks over blocks of zeros instead of writing them.
+type sparseWriter struct {
+	file
+	zeros []byte
+	// hole is whether the last block was seeked over.
+	hole bool
+}
+
+// newSparseWriter returns a writer that skips zero blocks of blockSize bytes
+// in f, or f if it is not a regular file and cannot have holes.
+func newSparseWriter(f file, blockSize int64) io.WriteSeeker {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return f
+	}
+	return &sparseWriter{file: f, zeros: make([]byte, blockSize)}
+}
+
+// Write implements io.Writer.
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		b := p
+		if len(b) > len(s.zeros) {
+			b = b[:len(s.zeros)]
+		}
+		if bytes.Equal(b, s.zeros[:len(b)]) {
+			if _, err := s.Seek(int64(len(b)), io.SeekCurrent); err != nil {
+				return n, err
+			}
+			s.hole = true
+		} else {
+			if m, err := s.file.Write(b); err != nil {
+				return n + m, err
+			}
+			s.hole = false
+		}
+		n += len(b)
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+// finish extends the file to the end of a trailing hole, which seeking alone
+// does not.
+func (s *sparseWriter) finish() error {
+	if !s.hole {
+		return nil
+	}
+	end, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	fi, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < end {
+		return s.Truncate(end)
+	}
+	return nil
+}
+
+// outFile opens the output file and seeks to the right position. With
+// conv=sparse, it skips zero blocks of sparseSize bytes.
+func outFile(name string, outputBytes int64, seek int64, flags int, sparseSize int64) (io.Writer, error) {
+	var out file
 	var err error
 	if name == "" {
 		out = os.Stdout
@@ -357,7 +563,7 @@ func outFile(name string, outputBytes int64, seek int64, flags int) (io.Writer,
 		if flags&oFlagDSync != 0 {
 			perm |= syscall.O_DSYNC
 		}
-		if out, err = os.OpenFile(name, perm, 0666); err != nil {
+		if out, err = openFile(name, perm, 0666, flags&oFlagDirect != 0); err != nil {
 			return nil, fmt.Errorf("error opening output file %q: %v", name, err)
 		}
 	}
@@ -366,6 +572,9 @@ func outFile(name string, outputBytes int64, seek int64, flags int) (io.Writer,
 			return nil, fmt.Errorf("error seeking output file: %v", err)
 		}
 	}
+	if flags&convSparse != 0 {
+		return newSparseWriter(out, sparseSize), nil
+	}
 	return out, nil
 }
 
@@ -435,11 +644,18 @@ func (p *progressData) print() {
 
 func usage() {
 	log.Fatal(`Usage: dd [if=file] [of=file] [conv=none|notrunc] [seek=#] [skip=#]
-			     [count=#] [bs=#] [ibs=#] [obs=#] [status=none|xfer|progress] [oflag=none|sync|dsync]
+			     [count=#] [bs=#] [ibs=#] [obs=#] [status=none|xfer|progress]
+			     [iflag=none|sync|direct] [oflag=none|sync|dsync|direct] [conv=fsync]
 		options may also be invoked Go-style as -opt value or -opt=value
+		[conv=sparse [sparse-detect-size=#]]
 		bs, if specified, overrides ibs and obs`)
 }
 
+// alignUp rounds n up to a multiple of sectorSize.
+func alignUp(n int64) int64 {
+	return (n + sectorSize - 1) / sectorSize * sectorSize
+}
+
 func convertArgs(osArgs []string) []string {
 	// EVERYTHING in dd follows x=y. So blindly split and convert.
 	var args []string
@@ -493,6 +709,18 @@ func main() {
 		}
 	}
 
+	// Convert iflag argument to bit set.
+	if *iFlag != "none" {
+		for _, f := range strings.Split(*iFlag, ",") {
+			if v, ok := iFlagMap[f]; ok {
+				flags |= v
+			} else {
+				log.Printf("unknown argument iflag=%s", f)
+				usage()
+			}
+		}
+	}
+
 	if *status != "none" && *status != "xfer" && *status != "progress" {
 		usage()
 	}
@@ -502,19 +730,37 @@ func main() {
 	if bs.IsSet {
 		ibs = bs
 		obs = bs
+	} else if flags&(iFlagDirect|oFlagDirect) != 0 {
+		ibs.Value = alignUp(ibs.Value)
+		obs.Value = alignUp(obs.Value)
 	}
 
-	in, err := inFile(*inName, ibs.Value, *skip, *count)
+	in, err := inFile(*inName, ibs.Value, *skip, *count, flags)
 	if err != nil {
 		log.Fatal(err)
 	}
-	out, err := outFile(*outName, obs.Value, *seek, flags)
+	if *sparseSize <= 0 {
+		*sparseSize = obs.Value
+	}
+	out, err := outFile(*outName, obs.Value, *seek, flags, *sparseSize)
 	if err != nil {
 		log.Fatal(err)
 	}
 	if err := parallelChunkedCopy(in, out, ibs.Value, obs.Value, flags); err != nil {
 		log.Fatal(err)
 	}
+	if s, ok := out.(*sparseWriter); ok {
+		if err := s.finish(); err != nil {
+			log.Fatalf("error extending output file: %v", err)
+		}
+	}
+	if flags&convFsync != 0 {
+		if err := out.(interface {
+			Sync() error
+		}).Sync(); err != nil {
+			log.Fatalf("error syncing output file: %v", err)
+		}
+	}
 
 	progress.end()
 }
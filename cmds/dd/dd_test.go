@@ -6,6 +6,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,9 +14,12 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
 	"testing"
+	"unsafe"
 
 	"github.com/u-root/u-root/pkg/testutil"
+	"golang.org/x/sys/unix"
 )
 
 // TestDd implements a table-driven test.
@@ -235,6 +239,30 @@ func TestFiles(t *testing.T) {
 			inFile:   []byte("y: defaults"),
 			expected: []byte("y: defaults"),
 		},
+		{
+			name:     "direct with a short last block",
+			flags:    []string{"iflag=direct", "oflag=direct"},
+			inFile:   bytes.Repeat([]byte("0123456789"), 100),
+			expected: bytes.Repeat([]byte("0123456789"), 100),
+		},
+		{
+			name:     "direct with unaligned block size",
+			flags:    []string{"iflag=direct", "oflag=direct", "bs=100"},
+			inFile:   bytes.Repeat([]byte("0123456789"), 100),
+			expected: bytes.Repeat([]byte("0123456789"), 100),
+		},
+		{
+			name:     "direct with aligned ibs, skip and count",
+			flags:    []string{"iflag=direct,sync", "oflag=direct", "ibs=300", "obs=1024", "skip=1", "count=1"},
+			inFile:   bytes.Repeat([]byte("0123456789abcdef"), 64),
+			expected: bytes.Repeat([]byte("0123456789abcdef"), 64)[512:1024],
+		},
+		{
+			name:     "fsync",
+			flags:    []string{"conv=fsync,notrunc"},
+			inFile:   []byte("z: defaults"),
+			expected: []byte("z: defaults"),
+		},
 	}
 
 	for _, tt := range tests {
@@ -286,6 +314,182 @@ func BenchmarkDd(b *testing.B) {
 	}
 }
 
+func TestDirectFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "out")
+	f, err := openFile(name, os.O_CREATE|os.O_WRONLY, 0666, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !f.direct {
+		t.Skipf("%s does not support O_DIRECT", tmpDir)
+	}
+	fl, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fl&unix.O_DIRECT == 0 {
+		t.Errorf("file opened with direct I/O has flags %#x, want O_DIRECT", fl)
+	}
+
+	want := append(bytes.Repeat([]byte{'a'}, sectorSize), "bc"...)
+	if _, err := f.Write(alignedBuffer(0)); err != nil {
+		t.Fatal(err)
+	}
+	b := alignedBuffer(sectorSize)
+	copy(b, want)
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if !f.direct {
+		t.Errorf("aligned write turned off direct I/O")
+	}
+	if _, err := f.Write([]byte("bc")); err != nil {
+		t.Fatal(err)
+	}
+	if f.direct {
+		t.Errorf("short write left direct I/O on")
+	}
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file has %q, want %q", got, want)
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, n := range []int64{0, 1, 512, 4096} {
+		b := alignedBuffer(n)
+		if int64(len(b)) != n {
+			t.Errorf("alignedBuffer(%d) has length %d", n, len(b))
+		}
+		if n > 0 && uintptr(unsafe.Pointer(&b[0]))%sectorSize != 0 {
+			t.Errorf("alignedBuffer(%d) is at %p, which is not aligned", n, &b[0])
+		}
+	}
+}
+
+// benchmarkFile copies a 64 MiB file with the given flags. Each "op" unit is
+// a copy.
+func benchmarkFile(b *testing.B, flags ...string) {
+	const size = 64 << 20
+	tmpDir, err := ioutil.TempDir("", "dd-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	in := filepath.Join(tmpDir, "in")
+	if err := ioutil.WriteFile(in, bytes.Repeat([]byte("u-root"), size/6), 0666); err != nil {
+		b.Fatal(err)
+	}
+	args := append([]string{"if=" + in, "of=" + filepath.Join(tmpDir, "out"), "bs=1M", "status=none"}, flags...)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := testutil.Command(b, args...).Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuffered(b *testing.B) {
+	benchmarkFile(b, "conv=fsync")
+}
+
+func BenchmarkDirect(b *testing.B) {
+	benchmarkFile(b, "iflag=direct", "oflag=direct", "conv=fsync")
+}
+
+// allocated returns the apparent size of name and the size of its blocks, as
+// du --apparent-size and du do.
+func allocated(t *testing.T, name string) (int64, int64) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(name, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Size, st.Blocks * 512
+}
+
+func TestSparse(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A sparse source with a 1 MiB hole after its first 4 KiB.
+	in := filepath.Join(tmpDir, "in")
+	f, err := os.Create(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("u-root"), 1000)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data, 1<<20+4096); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	want, err := ioutil.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, blocks := allocated(t, in); blocks >= size {
+		t.Skipf("%s does not support sparse files", tmpDir)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		flags []string
+		// trailing zeros are appended to the input.
+		trailing int
+		sparse   bool
+	}{
+		{name: "sparse", flags: []string{"conv=sparse", "bs=4K"}, sparse: true},
+		{name: "trailing hole", flags: []string{"conv=sparse", "bs=4K"}, trailing: 64 << 10, sparse: true},
+		{name: "detect size", flags: []string{"conv=sparse", "bs=64K", "sparse-detect-size=512"}, trailing: 1000, sparse: true},
+		{name: "blocks too big for holes", flags: []string{"conv=sparse", "bs=2M"}},
+		{name: "not sparse", flags: []string{"bs=4K"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := append(want, make([]byte, tt.trailing)...)
+			src := in
+			if tt.trailing > 0 {
+				src = filepath.Join(tmpDir, "trailing")
+				if err := ioutil.WriteFile(src, w, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out := filepath.Join(tmpDir, "out")
+			os.Remove(out)
+			args := append(tt.flags, "if="+src, "of="+out, "status=none")
+			if err := testutil.Command(t, args...).Run(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, w) {
+				t.Errorf("output has %d bytes, want the %d of the input", len(got), len(w))
+			}
+			size, blocks := allocated(t, out)
+			if sparse := size-blocks >= 1<<19; sparse != tt.sparse {
+				t.Errorf("output has %d bytes in %d bytes of blocks, want sparse %v", size, blocks, tt.sparse)
+			}
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	testutil.Run(m, main)
 }
@@ -5,19 +5,38 @@
 // Read the system log.
 //
 // Synopsis:
-//     dmesg [-clear|-read-clear]
+//     dmesg [-clear|-read-clear] [-follow] [-level LEVELS] [-facility FACILITIES]
+//
+// Description:
+//     With -follow, -level or -facility, records are read from /dev/kmsg and
+//     printed with their time stamp, in color by severity if stdout is a
+//     terminal.
 //
 // Options:
 //     -clear: clear the log
 //     -read-clear: clear the log after printing
+//     -follow, -w: keep printing new messages as they arrive
+//     -level, -l: only print messages of these comma separated severities
+//         (emerg, alert, crit, err, warn, notice, info, debug); "warn+" is
+//         warn and everything more severe
+//     -facility, -f: only print messages of these comma separated facilities
+//         (kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron,
+//         authpriv, ftp, local0 to local7)
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
+
+	"github.com/u-root/u-root/pkg/termios"
 )
 
 const (
@@ -28,14 +47,219 @@ const (
 )
 
 var (
-	clear     bool
-	readClear bool
+	clear      bool
+	readClear  bool
+	follow     bool
+	levels     string
+	facilities string
+
+	kmsgPath = "/dev/kmsg"
 )
 
 func init() {
 	flag.BoolVar(&clear, "clear", false, "Clear the log")
 	flag.BoolVar(&readClear, "read-clear", false, "Clear the log after printing")
 	flag.BoolVar(&readClear, "c", false, "Clear the log after printing")
+	flag.BoolVar(&follow, "follow", false, "Wait for new messages")
+	flag.BoolVar(&follow, "w", false, "Wait for new messages")
+	flag.StringVar(&levels, "level", "", "Only print messages of these comma separated severities")
+	flag.StringVar(&levels, "l", "", "Only print messages of these comma separated severities")
+	flag.StringVar(&facilities, "facility", "", "Only print messages of these comma separated facilities")
+	flag.StringVar(&facilities, "f", "", "Only print messages of these comma separated facilities")
+}
+
+// Severities and facilities by their syslog(3) number.
+var (
+	levelNames    = []string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug"}
+	facilityNames = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "", "", "", "",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+)
+
+const (
+	levelErr  = 3
+	levelWarn = 4
+)
+
+// lookup returns the index of name in names.
+func lookup(names []string, name string) (int, bool) {
+	for i, n := range names {
+		if n != "" && n == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseLevels returns the severities in the comma separated list s.
+func parseLevels(s string) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, name := range strings.Split(s, ",") {
+		orMore := strings.HasSuffix(name, "+")
+		l, ok := lookup(levelNames, strings.TrimSuffix(name, "+"))
+		if !ok {
+			return nil, fmt.Errorf("unknown level %q", name)
+		}
+		set[l] = true
+		for ; orMore && l >= 0; l-- {
+			set[l] = true
+		}
+	}
+	return set, nil
+}
+
+// parseFacilities returns the facilities in the comma separated list s.
+func parseFacilities(s string) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name == "kernel" {
+			name = "kern"
+		}
+		f, ok := lookup(facilityNames, name)
+		if !ok {
+			return nil, fmt.Errorf("unknown facility %q", name)
+		}
+		set[f] = true
+	}
+	return set, nil
+}
+
+// filter selects records by severity and facility. A nil set matches all.
+type filter struct {
+	levels     map[int]bool
+	facilities map[int]bool
+}
+
+func (f filter) match(r record) bool {
+	return (f.levels == nil || f.levels[r.level]) && (f.facilities == nil || f.facilities[r.facility])
+}
+
+// record is a /dev/kmsg record, see Documentation/ABI/testing/dev-kmsg.
+type record struct {
+	level    int
+	facility int
+	usec     uint64
+	msg      string
+}
+
+// parseRecord parses the first line of a record, "prio,seq,usec,flags;msg".
+func parseRecord(line string) (record, error) {
+	i := strings.IndexByte(line, ';')
+	if i < 0 {
+		return record{}, fmt.Errorf("no ';' in record %q", line)
+	}
+	f := strings.Split(line[:i], ",")
+	if len(f) < 3 {
+		return record{}, fmt.Errorf("record %q has %d fields, want at least 3", line, len(f))
+	}
+	prio, err := strconv.Atoi(f[0])
+	if err != nil {
+		return record{}, err
+	}
+	usec, err := strconv.ParseUint(f[2], 10, 64)
+	if err != nil {
+		return record{}, err
+	}
+	return record{level: prio & 7, facility: prio >> 3, usec: usec, msg: line[i+1:]}, nil
+}
+
+// format returns r as dmesg(1) prints it, colored by severity if color is
+// set.
+func (r record) format(color bool) string {
+	s := fmt.Sprintf("[%5d.%06d] %s", r.usec/1e6, r.usec%1e6, r.msg)
+	if !color {
+		return s
+	}
+	switch {
+	case r.level <= levelErr:
+		return "\033[31m" + s + "\033[0m"
+	case r.level == levelWarn:
+		return "\033[33m" + s + "\033[0m"
+	}
+	return s
+}
+
+// printRecords prints the records read from r that match f to w, until r
+// is exhausted.
+func printRecords(r io.Reader, w io.Writer, f filter, color bool) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// Continuation lines carry KEY=value pairs.
+		if line != "" && !strings.HasPrefix(line, " ") {
+			rec, perr := parseRecord(strings.TrimSuffix(line, "\n"))
+			if perr != nil {
+				log.Print(perr)
+			} else if f.match(rec) {
+				if _, err := fmt.Fprintln(w, rec.format(color)); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// kmsgReader reads records from a /dev/kmsg fd. If the fd is non-blocking,
+// running out of records is the end of the file.
+type kmsgReader struct {
+	fd int
+}
+
+func (k kmsgReader) Read(p []byte) (int, error) {
+	for {
+		n, err := syscall.Read(k.fd, p)
+		switch err {
+		case nil:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case syscall.EAGAIN:
+			return 0, io.EOF
+		case syscall.EPIPE, syscall.EINTR:
+			// EPIPE means records were overwritten before we
+			// got to them; the next read gets the oldest left.
+			continue
+		default:
+			return 0, err
+		}
+	}
+}
+
+func readKmsg() error {
+	var f filter
+	var err error
+	if levels != "" {
+		if f.levels, err = parseLevels(levels); err != nil {
+			return err
+		}
+	}
+	if facilities != "" {
+		if f.facilities, err = parseFacilities(facilities); err != nil {
+			return err
+		}
+	}
+
+	mode := syscall.O_RDONLY
+	if !follow {
+		mode |= syscall.O_NONBLOCK
+	}
+	fd, err := syscall.Open(kmsgPath, mode, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %v", kmsgPath, err)
+	}
+	defer syscall.Close(fd)
+
+	_, err = termios.GetTermios(os.Stdout.Fd())
+	return printRecords(kmsgReader{fd}, os.Stdout, f, err == nil)
 }
 
 func main() {
@@ -43,6 +267,15 @@ func main() {
 	if clear && readClear {
 		log.Fatalf("cannot specify both -clear and -read-clear")
 	}
+	if follow || levels != "" || facilities != "" {
+		if clear || readClear {
+			log.Fatalf("cannot clear the log with -follow, -level or -facility")
+		}
+		if err := readKmsg(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	level := uintptr(_SYSLOG_ACTION_READ_ALL)
 	if clear {
@@ -5,6 +5,12 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/u-root/u-root/pkg/testutil"
@@ -18,6 +24,116 @@ func TestDmesg(t *testing.T) {
 	}
 }
 
+// kmsg holds records as /dev/kmsg returns them: kern.info, kern.err with a
+// dictionary, user.warn, daemon.debug and kern.emerg.
+const kmsg = `6,1,1000,-;Linux version 4.17.0
+3,2,2500000,-;usb 1-1: device descriptor read/64, error -71
+ SUBSYSTEM=usb
+ DEVICE=c189:1
+12,3,3000001,-;init: something odd
+31,4,4000000,c;dhcpd: lease
+0,5,12345678901,-;Kernel panic - not syncing
+`
+
+func TestPrintRecords(t *testing.T) {
+	all := []string{
+		"[    0.001000] Linux version 4.17.0",
+		"[    2.500000] usb 1-1: device descriptor read/64, error -71",
+		"[    3.000001] init: something odd",
+		"[    4.000000] dhcpd: lease",
+		"[12345.678901] Kernel panic - not syncing",
+	}
+	for _, tt := range []struct {
+		levels, facilities string
+		want               []string
+	}{
+		{"", "", all},
+		{"warn+", "", []string{all[1], all[2], all[4]}},
+		{"info,debug", "", []string{all[0], all[3]}},
+		{"", "kernel", []string{all[0], all[1], all[4]}},
+		{"err+", "kern", []string{all[1], all[4]}},
+		{"", "user,daemon", []string{all[2], all[3]}},
+		{"notice", "", nil},
+	} {
+		var f filter
+		var err error
+		if tt.levels != "" {
+			if f.levels, err = parseLevels(tt.levels); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.facilities != "" {
+			if f.facilities, err = parseFacilities(tt.facilities); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var b bytes.Buffer
+		if err := printRecords(strings.NewReader(kmsg), &b, f, false); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		if b.Len() > 0 {
+			got = strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-level %q -facility %q printed %q, want %q", tt.levels, tt.facilities, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := parseLevels("warn,loud"); err == nil {
+		t.Errorf("parseLevels(warn,loud) succeeded")
+	}
+	if _, err := parseFacilities("kern,"); err == nil {
+		t.Errorf("parseFacilities(kern,) succeeded")
+	}
+}
+
+func TestColor(t *testing.T) {
+	for _, tt := range []struct {
+		level int
+		want  string
+	}{
+		{0, "\033[31m[    1.000000] m\033[0m"},
+		{3, "\033[31m[    1.000000] m\033[0m"},
+		{4, "\033[33m[    1.000000] m\033[0m"},
+		{6, "[    1.000000] m"},
+	} {
+		r := record{level: tt.level, usec: 1e6, msg: "m"}
+		if got := r.format(true); got != tt.want {
+			t.Errorf("level %d = %q, want %q", tt.level, got, tt.want)
+		}
+	}
+}
+
+// TestKmsgReader reads records from a mock /dev/kmsg fd.
+func TestKmsgReader(t *testing.T) {
+	f, err := ioutil.TempFile("", "kmsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(kmsg); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(f.Name(), syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	levels, _ := parseLevels("err")
+	var b bytes.Buffer
+	if err := printRecords(kmsgReader{fd}, &b, filter{levels: levels}, false); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[    2.500000] usb 1-1: device descriptor read/64, error -71\n"; b.String() != want {
+		t.Errorf("printed %q, want %q", b.String(), want)
+	}
+}
+
 func TestMain(m *testing.M) {
 	testutil.Run(m, main)
 }
@@ -54,6 +54,7 @@ func exit(fm *Frame, codes ...int) error {
 }
 
 func preExit(fm *Frame) {
+	fm.RunExitTrap()
 }
 
 var errNotSupportedOnWindows = errors.New("not supported on Windows")
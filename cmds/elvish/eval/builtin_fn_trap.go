@@ -0,0 +1,212 @@
+package eval
+
+// The trap builtin.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/u-root/u-root/cmds/elvish/parse"
+)
+
+func init() {
+	addBuiltinFns(map[string]interface{}{
+		"trap": trap,
+	})
+}
+
+// trapExit is the name of the trap run when the shell exits.
+const trapExit = "EXIT"
+
+var errTrapSignal = errors.New("trap: no signals given")
+
+// traps keeps the code run when the shell gets a signal or exits, by the
+// name of the signal without "SIG", or trapExit.
+//
+// The traps of signals are not run when the signal comes but before the
+// next pipeline, so that they never run concurrently with other code.
+type traps struct {
+	mu   sync.Mutex
+	code map[string]string
+	// sigCh gets the signals that have traps.
+	sigCh chan os.Signal
+	// pending are the signals that came and whose traps have not run.
+	pending []string
+	// running is set while traps run, so that they do not run their own
+	// traps.
+	running bool
+}
+
+func newTraps() *traps {
+	t := &traps{code: make(map[string]string), sigCh: make(chan os.Signal, 16)}
+	go func() {
+		for sig := range t.sigCh {
+			t.mu.Lock()
+			t.pending = append(t.pending, signalName(sig))
+			t.mu.Unlock()
+		}
+	}()
+	return t
+}
+
+// signalName returns the name trap has for sig.
+func signalName(sig os.Signal) string {
+	for name, s := range trapSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// trapName returns the name of the trap for the signal s, which may have
+// the "SIG" prefix.
+func trapName(s string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if _, ok := trapSignals[name]; !ok && name != trapExit {
+		return "", fmt.Errorf("trap: unknown signal %q", s)
+	}
+	return name, nil
+}
+
+// set sets or, if reset, removes the traps of names, and has the signals
+// with traps delivered to t.sigCh.
+func (t *traps) set(code string, reset bool, names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range names {
+		if reset {
+			delete(t.code, name)
+		} else {
+			t.code[name] = code
+		}
+	}
+	signal.Stop(t.sigCh)
+	var sigs []os.Signal
+	for name := range t.code {
+		if sig, ok := trapSignals[name]; ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(sigs) > 0 {
+		signal.Notify(t.sigCh, sigs...)
+	}
+}
+
+// Trapped returns whether sig has a trap, which replaces what the shell
+// does when it gets sig.
+func (ev *Evaler) Trapped(sig os.Signal) bool {
+	ev.traps.mu.Lock()
+	defer ev.traps.mu.Unlock()
+	_, ok := ev.traps.code[signalName(sig)]
+	return ok
+}
+
+// list writes a trap command for each trap to out, in the order of the
+// names of the signals.
+func (t *traps) list(out *os.File) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.code))
+	for name := range t.code {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "trap %s %s\n", parse.Quote(t.code[name]), name)
+	}
+}
+
+// take returns the code of the traps to run now: those of the pending
+// signals unless traps are running, and with exit that of trapExit, which
+// runs at most once, even from another trap.
+func (t *traps) take(exit bool) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var code []string
+	if !t.running {
+		for _, name := range t.pending {
+			if c := t.code[name]; c != "" {
+				code = append(code, c)
+			}
+		}
+		t.pending = nil
+	}
+	if exit {
+		if c := t.code[trapExit]; c != "" {
+			code = append(code, c)
+		}
+		delete(t.code, trapExit)
+	}
+	if len(code) > 0 {
+		t.running = true
+	}
+	return code
+}
+
+func (t *traps) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running = false
+}
+
+// runTraps runs the traps that are due, printing their errors to stderr.
+func (ev *Evaler) runTraps(exit bool) {
+	code := ev.traps.take(exit)
+	if len(code) == 0 {
+		return
+	}
+	defer ev.traps.done()
+	for _, c := range code {
+		src := &Source{SrcInternal, "[trap]", "[trap]", c}
+		n, err := parse.Parse(src.name, c)
+		if err == nil {
+			var op Op
+			if op, err = ev.Compile(n, src); err == nil {
+				stdPorts := newStdPorts(os.Stdin, os.Stdout, os.Stderr, ev.valuePrefix)
+				err = ev.eval(op, stdPorts.ports[:], src)
+				stdPorts.close()
+			}
+		}
+		if err != nil {
+			// TODO: Stack trace
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// RunExitTrap runs the trap of trapExit, and those of pending signals. The
+// shell calls it when it exits, however it exits.
+func (ev *Evaler) RunExitTrap() {
+	ev.runTraps(true)
+}
+
+// trap sets, resets or lists traps, like the trap of sh:
+//
+//	trap 'code' SIGINT TERM EXIT
+//	trap - INT
+//	trap
+func trap(fm *Frame, args ...string) error {
+	if len(args) == 0 {
+		fm.traps.list(fm.OutputFile())
+		return nil
+	}
+	if len(args) == 1 {
+		return errTrapSignal
+	}
+	names := make([]string, 0, len(args)-1)
+	for _, s := range args[1:] {
+		name, err := trapName(s)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	fm.traps.set(args[0], args[0] == "-", names)
+	return nil
+}
@@ -0,0 +1,122 @@
+// +build !windows,!plan9
+
+package eval
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTrap(t *testing.T) {
+	runTests(t, []Test{
+		That("trap").Prints(""),
+		That("trap 'echo bye' SIGINT TERM exit; trap").Prints(
+			"trap 'echo bye' EXIT\ntrap 'echo bye' INT\ntrap 'echo bye' TERM\n"),
+		// A trap replaces the one before.
+		That("trap a INT; trap b SIGINT; trap").Prints("trap b INT\n"),
+		That("trap a INT TERM; trap - SIGTERM; trap").Prints("trap a INT\n"),
+		That("trap '' HUP; trap").Prints("trap '' HUP\n"),
+		That("trap a").Errors(),
+		That("trap a BOGUS").Errors(),
+		That("trap a INT BOGUS; trap").Errors(),
+	})
+}
+
+// evalCode evaluates code with ev.
+func evalCode(t *testing.T, ev *Evaler, code string) {
+	t.Helper()
+	if err := ev.EvalSource(NewInteractiveSource(code)); err != nil {
+		t.Fatalf("%s: %v", code, err)
+	}
+}
+
+// waitForFile waits for the file at path to be written, evaluating code
+// which does nothing in the meantime for traps to run.
+func waitForFile(t *testing.T, ev *Evaler, path string) string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		evalCode(t, ev, "nop")
+		if b, err := ioutil.ReadFile(path); err == nil {
+			return string(b)
+		}
+	}
+	t.Fatalf("trap did not write %s", path)
+	return ""
+}
+
+func TestTrapSignals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-trap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name string
+		sig  syscall.Signal
+	}{
+		{"SIGINT", syscall.SIGINT},
+		{"TERM", syscall.SIGTERM},
+		{"HUP", syscall.SIGHUP},
+		{"SIGUSR1", syscall.SIGUSR1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := NewEvaler()
+			out := filepath.Join(dir, tt.name)
+			evalCode(t, ev, "trap 'echo cleaned up > "+out+"' "+tt.name)
+			if err := syscall.Kill(os.Getpid(), tt.sig); err != nil {
+				t.Fatal(err)
+			}
+			if got := waitForFile(t, ev, out); got != "cleaned up\n" {
+				t.Errorf("trap of %s wrote %q, want %q", tt.name, got, "cleaned up\n")
+			}
+		})
+	}
+
+	// A reset trap does not run.
+	ev := NewEvaler()
+	reset, out := filepath.Join(dir, "reset"), filepath.Join(dir, "after-reset")
+	evalCode(t, ev, "trap 'echo > "+reset+"' USR2; trap - USR2; trap 'echo > "+out+"' TERM")
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	waitForFile(t, ev, out)
+	if _, err := os.Stat(reset); !os.IsNotExist(err) {
+		t.Errorf("reset trap ran: %v", err)
+	}
+
+	// With a trap, SIGINT does not interrupt the code running.
+	ev = NewEvaler()
+	evalCode(t, ev, "trap 'echo trapped > "+filepath.Join(dir, "int")+"' INT")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	if err := ev.EvalSource(NewInteractiveSource("esleep 0.3; echo done > " + filepath.Join(dir, "done"))); err != nil {
+		t.Errorf("SIGINT with a trap interrupted: %v", err)
+	}
+	for _, f := range []string{"int", "done"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("%s not written: %v", f, err)
+		}
+	}
+}
+
+func TestTrapExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-trap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "exit")
+
+	ev := NewEvaler()
+	evalCode(t, ev, "trap 'echo bye >> "+out+"' EXIT")
+	ev.RunExitTrap()
+	ev.RunExitTrap()
+	if b, err := ioutil.ReadFile(out); err != nil || string(b) != "bye\n" {
+		t.Errorf("EXIT trap wrote %q, %v, want it to write bye once", b, err)
+	}
+}
@@ -0,0 +1,22 @@
+// +build !windows,!plan9
+
+package eval
+
+import (
+	"os"
+	"syscall"
+)
+
+// trapSignals are the signals trap takes, by name without "SIG".
+var trapSignals = map[string]os.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CHLD":  syscall.SIGCHLD,
+	"WINCH": syscall.SIGWINCH,
+}
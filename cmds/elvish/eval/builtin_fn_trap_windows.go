@@ -0,0 +1,14 @@
+package eval
+
+import (
+	"os"
+	"syscall"
+)
+
+// trapSignals are the signals trap takes, by name without "SIG".
+var trapSignals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
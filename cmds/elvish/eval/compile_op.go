@@ -40,11 +40,13 @@ type chunkOp struct {
 
 func (op chunkOp) Invoke(fm *Frame) error {
 	for _, subop := range op.subops {
+		fm.runTraps(false)
 		err := subop.Exec(fm)
 		if err != nil {
 			return err
 		}
 	}
+	fm.runTraps(false)
 	// Check for interrupts after the chunk.
 	// We also check for interrupts before each pipeline, so there is no
 	// need to check it before the chunk or after each pipeline.
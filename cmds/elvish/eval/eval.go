@@ -50,6 +50,7 @@ type Evaler struct {
 	Editor  Editor
 	libDir  string
 	intCh   chan struct{}
+	traps   *traps
 }
 
 type evalerScopes struct {
@@ -73,6 +74,7 @@ func NewEvaler() *Evaler {
 		bundled: bundled.Get(),
 		Editor:  nil,
 		intCh:   nil,
+		traps:   newTraps(),
 	}
 
 	beforeChdirElvish, afterChdirElvish := vector.Empty, vector.Empty
@@ -202,7 +204,11 @@ func (ev *Evaler) Eval(op Op, ports []*Port, src *Source) error {
 	loop:
 		for {
 			select {
-			case <-sigCh:
+			case sig := <-sigCh:
+				// A trap replaces the interrupt.
+				if ev.Trapped(sig) {
+					continue
+				}
 				if !closedIntCh {
 					close(ev.intCh)
 					closedIntCh = true
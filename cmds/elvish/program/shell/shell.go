@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/u-root/u-root/cmds/elvish/eval"
 	"github.com/u-root/u-root/cmds/elvish/runtime"
 	"github.com/u-root/u-root/cmds/elvish/sys"
 	"github.com/u-root/u-root/cmds/elvish/util"
@@ -34,8 +35,9 @@ func (sh *Shell) Main(args []string) int {
 
 	ev, dataDir := runtime.InitRuntime(sh.BinPath, sh.SockPath, sh.DbPath)
 	defer runtime.CleanupRuntime(ev)
+	defer ev.RunExitTrap()
 
-	handleSignals()
+	handleSignals(ev)
 
 	if len(args) > 0 {
 		err := script(ev, args, sh.Cmd, sh.CompileOnly)
@@ -62,13 +64,16 @@ func rescue() {
 	}
 }
 
-func handleSignals() {
+func handleSignals(ev *eval.Evaler) {
 	sigs := make(chan os.Signal)
 	signal.Notify(sigs)
 	go func() {
 		for sig := range sigs {
 			logger.Println("signal", sig)
-			handleSignal(sig)
+			// The trap of a signal, if any, replaces what it does.
+			if !ev.Trapped(sig) {
+				handleSignal(ev, sig)
+			}
 		}
 	}()
 }
@@ -7,13 +7,15 @@ import (
 	"os"
 	"syscall"
 
+	"github.com/u-root/u-root/cmds/elvish/eval"
 	"github.com/u-root/u-root/cmds/elvish/sys"
 )
 
-func handleSignal(sig os.Signal) {
+func handleSignal(ev *eval.Evaler, sig os.Signal) {
 	switch sig {
 	case syscall.SIGHUP:
 		syscall.Kill(0, syscall.SIGHUP)
+		ev.RunExitTrap()
 		os.Exit(0)
 	case syscall.SIGUSR1:
 		fmt.Print(sys.DumpStack())
@@ -2,7 +2,9 @@ package shell
 
 import (
 	"os"
+
+	"github.com/u-root/u-root/cmds/elvish/eval"
 )
 
-func handleSignal(_ os.Signal) {
+func handleSignal(_ *eval.Evaler, _ os.Signal) {
 }
@@ -0,0 +1,129 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// placeholder is replaced by the names of found files in -exec commands.
+const placeholder = "{}"
+
+// maxBatch is the most names an -exec ... + command gets at once.
+const maxBatch = 1024
+
+// execAction is an -exec or -execdir action.
+type execAction struct {
+	// argv is the command. For batch actions, the names are appended to
+	// it; otherwise each placeholder in it is replaced by the name.
+	argv []string
+	// inDir is whether the command runs in the directory of the file,
+	// as for -execdir, and gets ./name rather than the path.
+	inDir bool
+	// batch is whether the command ends with "{} +" and gets many names.
+	batch bool
+
+	// dirs are the directories of pending, in the order they were found.
+	dirs    []string
+	pending map[string][]string
+}
+
+// parseExecs takes the -exec and -execdir actions out of args, which may be
+// anywhere in it, and returns the rest of args and the actions.
+func parseExecs(args []string) ([]string, []*execAction, error) {
+	var rest []string
+	var actions []*execAction
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-exec" && args[i] != "-execdir" {
+			rest = append(rest, args[i])
+			continue
+		}
+		end := i + 1
+		for end < len(args) && args[end] != ";" && args[end] != "+" {
+			end++
+		}
+		if end == len(args) {
+			return nil, nil, fmt.Errorf("missing ';' or '+' after %s", args[i])
+		}
+		a := &execAction{
+			argv:    args[i+1 : end],
+			inDir:   args[i] == "-execdir",
+			batch:   args[end] == "+",
+			pending: make(map[string][]string),
+		}
+		if a.batch {
+			if len(a.argv) < 2 || a.argv[len(a.argv)-1] != placeholder {
+				return nil, nil, fmt.Errorf("%s ... + needs %s just before the +", args[i], placeholder)
+			}
+			a.argv = a.argv[:len(a.argv)-1]
+		}
+		if len(a.argv) == 0 {
+			return nil, nil, fmt.Errorf("%s needs a command", args[i])
+		}
+		actions = append(actions, a)
+		i = end
+	}
+	return rest, actions, nil
+}
+
+// add runs the command for the file at path or, for batch actions, saves
+// path for a later run.
+func (a *execAction) add(path string) error {
+	var dir string
+	name := path
+	if a.inDir {
+		dir = filepath.Dir(path)
+		name = "./" + filepath.Base(path)
+	}
+	if !a.batch {
+		argv := make([]string, len(a.argv))
+		for i, arg := range a.argv {
+			argv[i] = strings.Replace(arg, placeholder, name, -1)
+		}
+		return run(dir, argv)
+	}
+
+	if _, ok := a.pending[dir]; !ok {
+		a.dirs = append(a.dirs, dir)
+	}
+	a.pending[dir] = append(a.pending[dir], name)
+	if len(a.pending[dir]) < maxBatch {
+		return nil
+	}
+	names := a.pending[dir]
+	a.pending[dir] = []string{}
+	return run(dir, append(append([]string{}, a.argv...), names...))
+}
+
+// flush runs the command of a batch action for the names not yet run.
+func (a *execAction) flush() error {
+	var err error
+	for _, dir := range a.dirs {
+		names := a.pending[dir]
+		if len(names) == 0 {
+			continue
+		}
+		if e := run(dir, append(append([]string{}, a.argv...), names...)); e != nil {
+			err = e
+		}
+	}
+	a.dirs, a.pending = nil, make(map[string][]string)
+	return err
+}
+
+// run runs argv in dir, or the current directory if dir is empty.
+func run(dir string, argv []string) error {
+	c := exec.Command(argv[0], argv[1:]...)
+	c.Dir = dir
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s: %v", argv[0], err)
+	}
+	return nil
+}
@@ -11,6 +11,13 @@
 //     -type: match against a file type, e.g. -type f will match files
 //     -name: glob to match against file
 //     -l: long listing. It's not very good, yet, but it's useful enough.
+//     -exec cmd ... ;: run cmd for each file, with {} replaced by its name
+//     -exec cmd ... {} +: run cmd with the names of many files at the end
+//     -execdir cmd ... ; or +: as -exec, but run cmd in the directory of each
+//         file, with {} replaced by ./ and its base name
+//
+// The -exec and -execdir actions may come anywhere in the arguments. With
+// them, names are not printed, and find exits 1 if any command fails.
 package main
 
 import (
@@ -23,7 +30,7 @@ import (
 	"github.com/u-root/u-root/pkg/find"
 )
 
-const cmd = "find [opts] starting-at-path"
+const cmd = "find [opts] starting-at-path [-exec[dir] cmd ... ; | +]"
 
 var (
 	perm      = flag.Int("mode", -1, "Permissions")
@@ -49,7 +56,11 @@ func init() {
 }
 
 func main() {
-	flag.Parse()
+	args, actions, err := parseExecs(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	flag.CommandLine.Parse(args)
 	a := flag.Args()
 	if len(a) != 1 {
 		flag.Usage()
@@ -87,11 +98,21 @@ func main() {
 		log.Fatal(err)
 	}
 	go f.Find()
+	failed := false
 	for l := range f.Names {
 		if l.Err != nil {
 			fmt.Fprintf(os.Stderr, "%v: %v\n", l.Name, l.Err)
 			continue
 		}
+		if len(actions) > 0 {
+			for _, act := range actions {
+				if err := act.add(l.Name); err != nil {
+					fmt.Fprintf(os.Stderr, "find: %v\n", err)
+					failed = true
+				}
+			}
+			continue
+		}
 		// TODO: get long listing formats out of ls and into a package.
 		if *long {
 			fmt.Printf("%v\n", l.FileInfo)
@@ -99,4 +120,13 @@ func main() {
 		}
 		fmt.Printf("%s\n", l.Name)
 	}
+	for _, act := range actions {
+		if err := act.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "find: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
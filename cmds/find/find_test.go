@@ -0,0 +1,147 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+)
+
+// tree makes the files in a temporary directory and returns it.
+func tree(t *testing.T, files ...string) string {
+	dir, err := ioutil.TempDir("", "find")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func sortedLines(s string) []string {
+	l := strings.Fields(s)
+	sort.Strings(l)
+	return l
+}
+
+// exists returns the files of files that exist below dir.
+func exists(dir string, files ...string) []string {
+	var got []string
+	for _, f := range files {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			got = append(got, f)
+		}
+	}
+	return got
+}
+
+func TestExec(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "each",
+			args: []string{"-exec", "touch", "{}.done", ";"},
+			want: []string{"a.done", "sub/b.done"},
+		},
+		{
+			name: "twice",
+			args: []string{"-exec", "cp", "{}", "{}.copy", ";"},
+			want: []string{"a.copy", "sub/b.copy"},
+		},
+		{
+			name: "each in dir",
+			args: []string{"-execdir", "cp", "{}", "{}.copy", ";"},
+			want: []string{"a.copy", "sub/b.copy"},
+		},
+		{
+			name: "all",
+			args: []string{"-exec", "cp", "-t", "copies", "{}", "+"},
+			want: []string{"copies/a", "copies/b"},
+		},
+	} {
+		dir := tree(t, "a", "sub/b", "copies/.keep")
+		defer os.RemoveAll(dir)
+		// cp -t copies is relative to the working directory.
+		c := testutil.Command(t, append([]string{"-type", "f", "-name", "[ab]", dir}, tt.args...)...)
+		c.Dir = dir
+		if o, err := c.CombinedOutput(); err != nil || len(o) != 0 {
+			t.Errorf("%s: find = %v, %q, want no output", tt.name, err, o)
+			continue
+		}
+		want := []string{"a.done", "sub/b.done", "a.copy", "sub/b.copy", "copies/a", "copies/b"}
+		if got := exists(dir, want...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: made %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExecdirRelative(t *testing.T) {
+	dir := tree(t, "sub/b")
+	defer os.RemoveAll(dir)
+	o, err := testutil.Command(t, "-type", "f", dir, "-execdir", "echo", "{}", ";", "-execdir", "pwd", ";").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "./b\n" + filepath.Join(dir, "sub") + "\n"; string(o) != want {
+		t.Errorf("find -execdir printed %q, want %q", o, want)
+	}
+}
+
+func TestExecBatch(t *testing.T) {
+	dir := tree(t, "a", "b", "sub/c")
+	defer os.RemoveAll(dir)
+	// echo runs once, so all names are on one line.
+	o, err := testutil.Command(t, "-type", "f", dir, "-exec", "echo", "{}", "+").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(o)), "\n"); len(lines) != 1 {
+		t.Errorf("find -exec echo {} + printed %q, want one line", o)
+	}
+	if got, want := sortedLines(string(o)), []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "sub/c")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find -exec echo {} + printed %v, want %v", got, want)
+	}
+}
+
+func TestExecFailure(t *testing.T) {
+	dir := tree(t, "a", "b")
+	defer os.RemoveAll(dir)
+	for _, args := range [][]string{
+		{"-exec", "false", ";"},
+		{"-exec", "false", "{}", "+"},
+		{"-exec", "/does/not/exist", ";"},
+		// Bad actions.
+		{"-exec", "true"},
+		{"-exec", ";"},
+		{"-exec", "echo", "+"},
+		{"-exec", "echo", "{}", "x", "+"},
+	} {
+		err := testutil.Command(t, append([]string{"-type", "f", dir}, args...)...).Run()
+		if err := testutil.IsExitCode(err, 1); err != nil {
+			t.Errorf("find %v: %v", args, err)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	testutil.Run(m, main)
+}
@@ -5,7 +5,7 @@
 // Concurrent, parallel grep.
 //
 // Synopsis:
-//     grep [-vrlq] [FILE]...
+//     grep [-vrlq] [--include=PATTERN]... [--exclude=PATTERN]... [FILE]...
 //
 // Description:
 //     It has to deal with the EMFILE limit. To do so we have one chan that is
@@ -22,6 +22,10 @@
 //     -r: recursive
 //     -l: list only files
 //     -q: don't print matches; exit on first match
+//     --include=PATTERN: search only files whose name matches the glob
+//         PATTERN; may be given more than once
+//     --exclude=PATTERN: skip files whose name matches the glob PATTERN,
+//         even if they are included; may be given more than once
 package main
 
 import (
@@ -31,6 +35,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 type grepResult struct {
@@ -56,8 +61,50 @@ var (
 	quiet       = flag.Bool("q", false, "Don't print matches; exit on first match")
 	allGrep     = make(chan *oneGrep)
 	nGrep       = 0
+	includes    patterns
+	excludes    patterns
 )
 
+func init() {
+	flag.Var(&includes, "include", "Search only files whose name matches this glob")
+	flag.Var(&excludes, "exclude", "Skip files whose name matches this glob")
+}
+
+// patterns are the globs of a flag given more than once.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return fmt.Errorf("%q: %v", s, err)
+	}
+	*p = append(*p, s)
+	return nil
+}
+
+// match returns whether the file name matches any of p.
+func (p patterns) match(name string) bool {
+	for _, pat := range p {
+		if m, _ := filepath.Match(pat, name); m {
+			return true
+		}
+	}
+	return false
+}
+
+// skip returns whether the file at path is left out by --include and
+// --exclude, which look at its name only.
+func skip(path string) bool {
+	name := filepath.Base(path)
+	if excludes.match(name) {
+		return true
+	}
+	return len(includes) > 0 && !includes.match(name)
+}
+
 // grep reads data from the os.File embedded in grepCommand.
 // It creates a chan of grepResults and pushes a pointer to it into allGrep.
 // It matches each line against the re and pushes the matching result
@@ -67,7 +114,6 @@ var (
 // If we are only looking for a match, we exit as soon as the condition is met.
 // "match" means result of re.Match == match flag.
 func grep(f *grepCommand, re *regexp.Regexp) {
-	nGrep++
 	r := bufio.NewReader(f)
 	res := make(chan *grepResult, 1)
 	allGrep <- &oneGrep{res}
@@ -89,14 +135,15 @@ func grep(f *grepCommand, re *regexp.Regexp) {
 }
 
 func printmatch(r *grepResult) {
+	if *noshowmatch {
+		fmt.Println(r.c.name)
+		return
+	}
 	var prefix string
 	if showname {
 		fmt.Printf("%v", r.c.name)
 		prefix = ":"
 	}
-	if *noshowmatch {
-		return
-	}
 	if r.match == *match {
 		fmt.Printf("%v%v", prefix, *r.line)
 	}
@@ -112,9 +159,10 @@ func main() {
 	re := regexp.MustCompile(r)
 	// very special case, just stdin ...
 	if len(a) < 2 {
+		nGrep = 1
 		go grep(&grepCommand{"<stdin>", os.Stdin}, re)
 	} else {
-		showname = len(a[1:]) > 1
+		showname = len(a[1:]) > 1 || *recursive
 		// generate a chan of file names, bounded by the size of the chan. This in turn
 		// throttles the opens.
 		treenames := make(chan string, 128)
@@ -125,13 +173,16 @@ func main() {
 				// just ignore the errors. If there is not a single one that works,
 				// then all the sizes will be 0 and we'll just fall through.
 				filepath.Walk(v, func(name string, fi os.FileInfo, err error) error {
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+						return err
+					}
 					if fi.IsDir() && !*recursive {
 						fmt.Fprintf(os.Stderr, "grep: %v: Is a directory\n", name)
 						return filepath.SkipDir
 					}
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
-						return err
+					if fi.IsDir() || skip(name) {
+						return nil
 					}
 					treenames <- name
 					return nil
@@ -157,11 +208,13 @@ func main() {
 		// bug: file name order is not preserved here. Darn.
 
 		for f := range files {
+			nGrep++
 			go grep(f, re)
 		}
 	}
 
-	for c := range allGrep {
+	for ; nGrep > 0; nGrep-- {
+		c := <-allGrep
 		for r := range c.c {
 			// exit on first match.
 			if *quiet {
@@ -169,10 +222,6 @@ func main() {
 			}
 			printmatch(r)
 		}
-		nGrep--
-		if nGrep == 0 {
-			break
-		}
 	}
 	if *quiet {
 		os.Exit(1)
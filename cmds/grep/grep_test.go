@@ -8,6 +8,9 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/u-root/u-root/pkg/testutil"
@@ -50,6 +53,64 @@ func TestGrep(t *testing.T) {
 	}
 }
 
+func TestGrepIncludeExclude(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestGrepIncludeExclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files := []string{"a.go", "a_test.go", "notes.txt", "sub/b.go", "sub/c.txt", "sub/sub/d.go"}
+	for _, f := range files {
+		p := filepath.Join(tmpDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("needle\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, files},
+		{[]string{"--include=*.go"}, []string{"a.go", "a_test.go", "sub/b.go", "sub/sub/d.go"}},
+		{[]string{"--include=*.go", "--include=notes.*"}, []string{"a.go", "a_test.go", "notes.txt", "sub/b.go", "sub/sub/d.go"}},
+		{[]string{"--exclude=*.txt"}, []string{"a.go", "a_test.go", "sub/b.go", "sub/sub/d.go"}},
+		{[]string{"--exclude=*.txt", "--exclude=*_test.go"}, []string{"a.go", "sub/b.go", "sub/sub/d.go"}},
+		// Exclude wins over include.
+		{[]string{"--include=*.go", "--exclude=a*"}, []string{"sub/b.go", "sub/sub/d.go"}},
+		// Patterns match names, not paths.
+		{[]string{"--include=sub/*"}, nil},
+		{[]string{"--include=*.c"}, nil},
+	} {
+		args := append([]string{"-r", "-l"}, tt.args...)
+		args = append(args, "needle", tmpDir)
+		o, err := testutil.Command(t, args...).CombinedOutput()
+		if err != nil {
+			t.Errorf("grep %v: %v: %s", args, err, o)
+			continue
+		}
+		var got []string
+		for _, l := range strings.Fields(string(o)) {
+			rel, err := filepath.Rel(tmpDir, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, rel)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("grep %v: got %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	if err := testutil.Command(t, "--include=[", "needle", tmpDir).Run(); err == nil {
+		t.Errorf("grep with a bad pattern succeeded, want error")
+	}
+}
+
 func TestMain(m *testing.M) {
 	testutil.Run(m, main)
 }
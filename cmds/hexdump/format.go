@@ -0,0 +1,525 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Formats of the -C, -d, -o and -x flags, as util-linux hexdump(1) defines
+// them.
+var (
+	canonicalFormat = []string{
+		`"%08.8_Ax\n"`,
+		`"%08.8_ax  " 8/1 "%02x " "  " 8/1 "%02x " `,
+		`"  |" 16/1 "%_p" "|\n"`,
+	}
+	decimalFormat = []string{`"%07.7_Ad\n"`, `"%07.7_ad " 8/2 "  %05u " "\n"`}
+	octalFormat   = []string{`"%07.7_Ao\n"`, `"%07.7_ao " 8/2 " %06o " "\n"`}
+	hexFormat     = []string{`"%07.7_Ax\n"`, `"%07.7_ax " 8/2 "   %04x " "\n"`}
+)
+
+// Kinds of pieces of a format unit.
+const (
+	pieceText      = iota // literal text
+	pieceAddress          // %_a, the address of the next byte
+	pieceEnd              // %_A, the address after the input
+	pieceSigned           // %d, %i
+	pieceUnsigned         // %o, %u, %x, %X
+	pieceFloat            // %e, %E, %f, %g, %G
+	pieceChar             // %c
+	pieceNamedChar        // %_c
+	piecePrintable        // %_p
+	pieceASCIIName        // %_u
+	pieceString           // %s
+)
+
+// piece is literal text or one conversion of a format string.
+type piece struct {
+	kind int
+	// text is the literal text, or the Go format of the conversion.
+	text string
+	// pad is the Go format printing blanks as wide as the conversion.
+	pad  string
+	size int
+}
+
+// unit is a format unit: iterations of a format string, each taking bytes
+// from the input.
+type unit struct {
+	iter    int
+	setIter bool
+	pieces  []piece
+	size    int
+	hasEnd  bool
+}
+
+// format is the format units of one -e flag.
+type format struct {
+	units []unit
+	size  int
+}
+
+// unescape interprets the C escapes of a format string.
+func unescape(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\a`, "\a", `\b`, "\b", `\f`, "\f",
+		`\n`, "\n", `\r`, "\r", `\t`, "\t", `\v`, "\v", `\0`, "\x00")
+	return r.Replace(s)
+}
+
+// parsePieces splits the format string s of a unit with byte count bcnt
+// (0 if none) into text and conversions.
+func parsePieces(s string, bcnt int) ([]piece, error) {
+	var pieces []piece
+	var text strings.Builder
+	flushText := func() {
+		if text.Len() > 0 {
+			pieces = append(pieces, piece{kind: pieceText, text: text.String()})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			text.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '%' {
+			text.WriteByte('%')
+			i++
+			continue
+		}
+
+		// Flags, width and precision, which Go reads as C does.
+		j := i + 1
+		for j < len(s) && strings.IndexByte("-+ #0", s[j]) >= 0 {
+			j++
+		}
+		flags := s[i+1 : j]
+		k := j
+		for k < len(s) && (s[k] >= '0' && s[k] <= '9' || s[k] == '.') {
+			k++
+		}
+		width := s[j:k]
+		if k == len(s) {
+			return nil, fmt.Errorf("%q: incomplete conversion", s)
+		}
+		c := s[k]
+		if c == '_' {
+			if k+1 == len(s) {
+				return nil, fmt.Errorf("%q: incomplete conversion", s)
+			}
+			k++
+			c = s[k]
+		}
+		conv := s[i : k+1]
+
+		p := piece{pad: "%" + width + "s"}
+		switch {
+		case s[k-1] == '_' && (c == 'a' || c == 'A'):
+			if k+1 == len(s) || strings.IndexByte("dox", s[k+1]) < 0 {
+				return nil, fmt.Errorf("%q: %s needs d, o or x", s, conv)
+			}
+			k++
+			p.kind = pieceAddress
+			if c == 'A' {
+				p.kind = pieceEnd
+			}
+			p.text = "%" + flags + width + string(s[k])
+		case s[k-1] == '_' && (c == 'c' || c == 'p' || c == 'u'):
+			p.kind = map[byte]int{'c': pieceNamedChar, 'p': piecePrintable, 'u': pieceASCIIName}[c]
+			p.text = "%" + flags + width + "s"
+			p.size = 1
+		case s[k-1] == '_':
+			return nil, fmt.Errorf("%q: bad conversion %s", s, conv)
+		case strings.IndexByte("di", c) >= 0:
+			p.kind, p.text = pieceSigned, "%"+flags+width+"d"
+		case strings.IndexByte("ouxX", c) >= 0:
+			if c == 'u' {
+				c = 'd'
+			}
+			p.kind, p.text = pieceUnsigned, "%"+flags+width+string(c)
+		case strings.IndexByte("eEfgG", c) >= 0:
+			p.kind, p.text = pieceFloat, "%"+flags+width+string(c)
+		case c == 'c':
+			p.kind, p.text, p.size = pieceChar, "%"+flags+width+"c", 1
+		case c == 's':
+			p.kind, p.text = pieceString, "%"+flags+width+"s"
+		default:
+			return nil, fmt.Errorf("%q: bad conversion %s", s, conv)
+		}
+
+		switch p.kind {
+		case pieceSigned, pieceUnsigned:
+			p.size = 4
+			if bcnt != 0 {
+				if bcnt != 1 && bcnt != 2 && bcnt != 4 && bcnt != 8 {
+					return nil, fmt.Errorf("%q: bad byte count %d for %s", s, bcnt, conv)
+				}
+				p.size = bcnt
+			}
+		case pieceFloat:
+			p.size = 8
+			if bcnt != 0 {
+				if bcnt != 4 && bcnt != 8 {
+					return nil, fmt.Errorf("%q: bad byte count %d for %s", s, bcnt, conv)
+				}
+				p.size = bcnt
+			}
+		case pieceString:
+			if i := strings.IndexByte(width, '.'); i >= 0 {
+				p.size, _ = strconv.Atoi(width[i+1:])
+			}
+			if bcnt != 0 {
+				p.size = bcnt
+			}
+			if p.size == 0 {
+				return nil, fmt.Errorf("%q: %s needs a byte count or precision", s, conv)
+			}
+		case pieceChar, pieceNamedChar, piecePrintable, pieceASCIIName:
+			if bcnt > 1 {
+				return nil, fmt.Errorf("%q: bad byte count %d for %s", s, bcnt, conv)
+			}
+		}
+		flushText()
+		pieces = append(pieces, p)
+		i = k
+	}
+	flushText()
+	return pieces, nil
+}
+
+// parseFormat parses format units as in GNU hexdump's -e:
+// [iterations][/byte count] "format string", separated by spaces.
+func parseFormat(s string) (format, error) {
+	var f format
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		u := unit{iter: 1}
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i > 0 {
+			u.iter, _ = strconv.Atoi(s[:i])
+			u.setIter = true
+		}
+		s = strings.TrimSpace(s[i:])
+		bcnt := 0
+		if strings.HasPrefix(s, "/") {
+			s = strings.TrimSpace(s[1:])
+			i = 0
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			if i == 0 {
+				return format{}, fmt.Errorf("byte count missing after /")
+			}
+			bcnt, _ = strconv.Atoi(s[:i])
+			s = strings.TrimSpace(s[i:])
+		}
+		if !strings.HasPrefix(s, `"`) {
+			return format{}, fmt.Errorf("format string expected at %q", s)
+		}
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return format{}, fmt.Errorf("unterminated format string %s", s)
+		}
+		pieces, err := parsePieces(unescape(s[1:end]), bcnt)
+		if err != nil {
+			return format{}, err
+		}
+		s = s[end+1:]
+
+		convs := 0
+		for _, p := range pieces {
+			u.size += p.size
+			if p.size > 0 {
+				convs++
+			}
+			if p.kind == pieceEnd {
+				u.hasEnd = true
+			}
+		}
+		if bcnt != 0 && convs > 1 {
+			return format{}, fmt.Errorf("byte count with several conversions")
+		}
+		u.pieces = pieces
+		f.units = append(f.units, u)
+		f.size += u.iter * u.size
+	}
+	return f, nil
+}
+
+// Colors of -color.
+const (
+	colorNull      = "\033[90m"
+	colorControl   = "\033[31m"
+	colorPrintable = "\033[32m"
+	colorReset     = "\033[0m"
+)
+
+var asciiNames = [...]string{
+	"nul", "soh", "stx", "etx", "eot", "enq", "ack", "bel",
+	"bs", "ht", "lf", "vt", "ff", "cr", "so", "si",
+	"dle", "dc1", "dc2", "dc3", "dc4", "nak", "syn", "etb",
+	"can", "em", "sub", "esc", "fs", "gs", "rs", "us",
+}
+
+func printable(c byte) bool {
+	return c >= ' ' && c <= '~'
+}
+
+// colorOf returns the color of the bytes of a conversion.
+func colorOf(b []byte) string {
+	color := colorNull
+	for _, c := range b {
+		switch {
+		case c == 0:
+		case !printable(c):
+			return colorControl
+		default:
+			color = colorPrintable
+		}
+	}
+	return color
+}
+
+// convert returns the conversion p of b.
+func (p piece) convert(b []byte) string {
+	le := binary.LittleEndian
+	var u uint64
+	switch len(b) {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(le.Uint16(b))
+	case 4:
+		u = uint64(le.Uint32(b))
+	case 8:
+		u = le.Uint64(b)
+	}
+
+	switch p.kind {
+	case pieceSigned:
+		var v int64
+		switch len(b) {
+		case 1:
+			v = int64(int8(u))
+		case 2:
+			v = int64(int16(u))
+		case 4:
+			v = int64(int32(u))
+		default:
+			v = int64(u)
+		}
+		return fmt.Sprintf(p.text, v)
+	case pieceUnsigned:
+		return fmt.Sprintf(p.text, u)
+	case pieceFloat:
+		if len(b) == 4 {
+			return fmt.Sprintf(p.text, math.Float32frombits(uint32(u)))
+		}
+		return fmt.Sprintf(p.text, math.Float64frombits(u))
+	case pieceChar:
+		return fmt.Sprintf(p.text, b[0])
+	case pieceString:
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return fmt.Sprintf(p.text, b)
+	}
+
+	c := b[0]
+	var s string
+	switch {
+	case p.kind == piecePrintable && printable(c):
+		s = string(c)
+	case p.kind == piecePrintable:
+		s = "."
+	case p.kind == pieceNamedChar:
+		switch c {
+		case 0:
+			s = `\0`
+		case '\a':
+			s = `\a`
+		case '\b':
+			s = `\b`
+		case '\f':
+			s = `\f`
+		case '\n':
+			s = `\n`
+		case '\r':
+			s = `\r`
+		case '\t':
+			s = `\t`
+		case '\v':
+			s = `\v`
+		default:
+			if printable(c) {
+				s = string(c)
+			} else {
+				s = fmt.Sprintf("%03o", c)
+			}
+		}
+	case c < ' ':
+		s = asciiNames[c]
+	case c == 0x7f:
+		s = "del"
+	case printable(c):
+		s = string(c)
+	default:
+		s = fmt.Sprintf("%x", c)
+	}
+	return fmt.Sprintf(p.text, s)
+}
+
+// dumper prints its input in formats, as hexdump(1) does.
+type dumper struct {
+	formats   []format
+	blockSize int
+	// squeeze replaces repeated blocks with a "*" line.
+	squeeze bool
+	color   bool
+}
+
+func newDumper(formats []format, squeeze, color bool) *dumper {
+	d := &dumper{formats: formats, squeeze: squeeze, color: color}
+	for _, f := range formats {
+		if f.size > d.blockSize {
+			d.blockSize = f.size
+		}
+	}
+	// Like hexdump, the last unit of a format repeats to fill a block
+	// unless it has an explicit iteration count.
+	for i := range d.formats {
+		f := &d.formats[i]
+		if len(f.units) == 0 {
+			continue
+		}
+		last := &f.units[len(f.units)-1]
+		if !last.setIter && last.size > 0 && f.size < d.blockSize {
+			last.iter += (d.blockSize - f.size) / last.size
+		}
+	}
+	return d
+}
+
+// printBlock prints block, whose first byte is at addr and which has input
+// data up to end, in every format.
+func (d *dumper) printBlock(w *bufio.Writer, block []byte, addr, end int64) {
+	for _, f := range d.formats {
+		pos := 0
+	units:
+		for _, u := range f.units {
+			if u.hasEnd {
+				break units
+			}
+			for i := 0; i < u.iter; i++ {
+				for j, p := range u.pieces {
+					a := addr + int64(pos)
+					switch {
+					case p.kind == pieceText:
+						t := p.text
+						// Nor does hexdump print the last space
+						// of the last iteration.
+						if u.iter > 1 && i == u.iter-1 && j == len(u.pieces)-1 {
+							if c := t[len(t)-1]; c == ' ' || c == '\t' || c == '\n' {
+								t = t[:len(t)-1]
+							}
+						}
+						w.WriteString(t)
+					case a >= end:
+						fmt.Fprintf(w, p.pad, "")
+					case p.kind == pieceAddress:
+						fmt.Fprintf(w, p.text, a)
+					default:
+						s := p.convert(block[pos : pos+p.size])
+						if d.color {
+							s = colorOf(block[pos:pos+p.size]) + s + colorReset
+						}
+						w.WriteString(s)
+					}
+					pos += p.size
+				}
+			}
+		}
+	}
+}
+
+// dump prints r, whose first byte is at addr.
+func (d *dumper) dump(out io.Writer, r io.Reader, addr int64) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	start := addr
+
+	if d.blockSize > 0 {
+		block := make([]byte, d.blockSize)
+		prev := make([]byte, d.blockSize)
+		var havePrev, squeezed bool
+		for {
+			n, err := io.ReadFull(r, block)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			for i := n; i < len(block); i++ {
+				block[i] = 0
+			}
+			if n == len(block) && d.squeeze && havePrev && bytes.Equal(block, prev) {
+				if !squeezed {
+					w.WriteString("*\n")
+					squeezed = true
+				}
+				addr += int64(n)
+				continue
+			}
+			squeezed = false
+			d.printBlock(w, block, addr, addr+int64(n))
+			copy(prev, block)
+			havePrev = true
+			addr += int64(n)
+			if n < len(block) {
+				break
+			}
+		}
+	}
+	if addr == start {
+		return nil
+	}
+
+	// Print the last unit with %_A.
+	var end *unit
+	for _, f := range d.formats {
+		for i := range f.units {
+			if f.units[i].hasEnd {
+				end = &f.units[i]
+			}
+		}
+	}
+	if end != nil {
+		for _, p := range end.pieces {
+			switch p.kind {
+			case pieceText:
+				w.WriteString(p.text)
+			case pieceEnd:
+				fmt.Fprintf(w, p.text, addr)
+			}
+		}
+	}
+	return w.Flush()
+}
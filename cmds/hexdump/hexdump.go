@@ -5,21 +5,131 @@
 // Prints files in hexadecimal.
 //
 // Synopsis:
-//     hexdump [FILES]...
+//     hexdump [-C|-d|-o|-x] [-e FORMAT]... [-v] [-color] [-skip N] [-length N] [FILES]...
 //
 // Description:
 //     Concatenate the input files into a single hexdump. If there are no
 //     arguments, stdin is read.
+//
+//     Without a format flag, the dump is canonical but has no final offset
+//     and no squeezed lines; -color alone implies -C. Format flags may be
+//     repeated and combined; each format prints every block of input in
+//     turn.
+//
+// Options:
+//     -C: canonical hex and ASCII, as hexdump -C
+//     -d: two-byte decimal
+//     -o: two-byte octal
+//     -x: two-byte hexadecimal
+//     -e FORMAT: format string as in GNU hexdump, e.g. '16/1 "%02x " "\n"'
+//     -v: print repeated lines instead of a "*"
+//     -color: color printable characters, control characters and null bytes
+//     -skip, -s N: skip the first N bytes of input
+//     -length, -n N: print only N bytes of input
 package main
 
 import (
 	"encoding/hex"
 	"flag"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 )
 
+// formatList is the formats of the format flags, in command line order.
+type formatList []format
+
+var formats formatList
+
+// formatFlag adds a fixed format to formats.
+type formatFlag []string
+
+func (f formatFlag) String() string {
+	return ""
+}
+
+func (f formatFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f formatFlag) Set(s string) error {
+	if s != "true" {
+		return nil
+	}
+	for _, s := range f {
+		if err := formats.add(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *formatList) add(s string) error {
+	f, err := parseFormat(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, f)
+	return nil
+}
+
+func (l *formatList) String() string {
+	return ""
+}
+
+func (l *formatList) Set(s string) error {
+	return l.add(s)
+}
+
+var (
+	verbose = flag.Bool("v", false, "print repeated lines instead of a \"*\"")
+	color   = flag.Bool("color", false, "color printable characters, control characters and null bytes")
+	skip    int64
+	length  int64
+)
+
+func init() {
+	flag.Var(formatFlag(canonicalFormat), "C", "canonical hex and ASCII")
+	flag.Var(formatFlag(decimalFormat), "d", "two-byte decimal")
+	flag.Var(formatFlag(octalFormat), "o", "two-byte octal")
+	flag.Var(formatFlag(hexFormat), "x", "two-byte hexadecimal")
+	flag.Var(&formats, "e", "format string as in GNU hexdump")
+	flag.Int64Var(&skip, "skip", 0, "skip this many bytes of input")
+	flag.Int64Var(&skip, "s", 0, "skip this many bytes of input")
+	flag.Int64Var(&length, "length", -1, "print only this many bytes of input")
+	flag.Int64Var(&length, "n", -1, "print only this many bytes of input")
+}
+
+// dump prints r to w as the flags say.
+func dump(w io.Writer, r io.Reader) error {
+	if skip > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+
+	if len(formats) == 0 && !*color {
+		d := hex.Dumper(w)
+		if _, err := io.Copy(d, r); err != nil {
+			return err
+		}
+		return d.Close()
+	}
+	f := formats
+	if len(f) == 0 {
+		for _, s := range canonicalFormat {
+			if err := f.add(s); err != nil {
+				return err
+			}
+		}
+	}
+	return newDumper(f, !*verbose, *color).dump(w, r, skip)
+}
+
 func main() {
 	flag.Parse()
 
@@ -40,11 +150,7 @@ func main() {
 		}
 	}
 
-	r := io.MultiReader(readers...)
-	w := hex.Dumper(os.Stdout)
-	defer w.Close()
-
-	if _, err := io.Copy(w, r); err != nil {
+	if err := dump(os.Stdout, io.MultiReader(readers...)); err != nil {
 		log.Fatal(err)
 	}
 }
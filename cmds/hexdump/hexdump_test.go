@@ -6,35 +6,192 @@ package main
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/u-root/u-root/pkg/testutil"
 )
 
+var (
+	alphabet = []byte("abcdefghijklmnopqrstuvwxyz")
+	// mixed has a repeated line, control characters and an odd length.
+	mixed = append(make([]byte, 32), "\x01\x02hello\n\x7f\xff"...)
+)
+
+// The outputs are those of util-linux hexdump(1).
 var tests = []struct {
-	in  []byte
-	out []byte
+	name string
+	args []string
+	in   []byte
+	out  string
 }{
 	{
-		in: []byte("abcdefghijklmnopqrstuvwxyz"),
-		out: []byte(
-			`00000000  61 62 63 64 65 66 67 68  69 6a 6b 6c 6d 6e 6f 70  |abcdefghijklmnop|
+		name: "default",
+		in:   alphabet,
+		out: `00000000  61 62 63 64 65 66 67 68  69 6a 6b 6c 6d 6e 6f 70  |abcdefghijklmnop|
+00000010  71 72 73 74 75 76 77 78  79 7a                    |qrstuvwxyz|
+`,
+	},
+	{
+		name: "canonical",
+		args: []string{"-C"},
+		in:   alphabet,
+		out: `00000000  61 62 63 64 65 66 67 68  69 6a 6b 6c 6d 6e 6f 70  |abcdefghijklmnop|
 00000010  71 72 73 74 75 76 77 78  79 7a                    |qrstuvwxyz|
-`),
+0000001a
+`,
+	},
+	{
+		name: "canonical squeezed",
+		args: []string{"-C"},
+		in:   mixed,
+		out: `00000000  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|
+*
+00000020  01 02 68 65 6c 6c 6f 0a  7f ff                    |..hello...|
+0000002a
+`,
+	},
+	{
+		name: "canonical verbose",
+		args: []string{"-C", "-v"},
+		in:   mixed,
+		out: `00000000  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|
+00000010  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|
+00000020  01 02 68 65 6c 6c 6f 0a  7f ff                    |..hello...|
+0000002a
+`,
+	},
+	{
+		name: "empty",
+		args: []string{"-C"},
+	},
+	{
+		name: "hex",
+		args: []string{"-x"},
+		in:   alphabet,
+		out: "0000000    6261    6463    6665    6867    6a69    6c6b    6e6d    706f\n" +
+			"0000010    7271    7473    7675    7877    7a79                        \n" +
+			"000001a\n",
+	},
+	{
+		name: "hex squeezed",
+		args: []string{"-x"},
+		in:   mixed,
+		out: "0000000    0000    0000    0000    0000    0000    0000    0000    0000\n" +
+			"*\n" +
+			"0000020    0201    6568    6c6c    0a6f    ff7f                        \n" +
+			"000002a\n",
+	},
+	{
+		name: "decimal",
+		args: []string{"-d"},
+		in:   alphabet,
+		out: "0000000   25185   25699   26213   26727   27241   27755   28269   28783\n" +
+			"0000016   29297   29811   30325   30839   31353                        \n" +
+			"0000026\n",
+	},
+	{
+		name: "octal",
+		args: []string{"-o"},
+		in:   alphabet,
+		out: "0000000  061141  062143  063145  064147  065151  066153  067155  070157\n" +
+			"0000020  071161  072163  073165  074167  075171                        \n" +
+			"0000032\n",
+	},
+	{
+		name: "odd length",
+		args: []string{"-x"},
+		in:   []byte("abc"),
+		out: "0000000    6261    0063                                                \n" +
+			"0000003\n",
+	},
+	{
+		name: "combined",
+		args: []string{"-x", "-e", `"%07.7_ax " 16/1 "%3_c " "\n"`},
+		in:   []byte("ab\tc"),
+		out: "0000000    6261    6309" + strings.Repeat(" ", 48) + "\n" +
+			"0000000   a   b  \\t   c" + strings.Repeat(" ", 48) + "\n" +
+			"0000004\n",
+	},
+	{
+		name: "format words",
+		args: []string{"-e", `4/4 "%08x " "\n"`},
+		in:   alphabet,
+		out: "64636261 68676665 6c6b6a69 706f6e6d\n" +
+			"74737271 78777675 00007a79         \n",
+	},
+	{
+		name: "format signed",
+		args: []string{"-e", `"%_ao" 2/1 " %4d" 1/2 " %6d" "\n"`},
+		in:   []byte{0xff, 0x80, 0xfe, 0xff, 1, 2, 3, 4},
+		out:  "0   -1 -128     -2\n4    1    2   1027\n",
+	},
+	{
+		name: "format names",
+		args: []string{"-skip", "32", "-e", `"%_ad: " 4/1 "%_u " "\n"`},
+		in:   mixed,
+		out:  "32: soh stx h e\n36: l l o lf\n40: del ff  \n",
+	},
+	{
+		name: "format text",
+		args: []string{"-e", `"%_Ad bytes\n"`, "-e", `8/1 "%c" "|\n"`},
+		in:   []byte("12345678abc"),
+		out:  "12345678|\nabc|\n11 bytes\n",
+	},
+	{
+		name: "skip and length",
+		args: []string{"-s", "30", "-n", "6", "-C"},
+		in:   mixed,
+		out: `0000001e  00 00 01 02 68 65                                 |....he|
+00000024
+`,
+	},
+	{
+		name: "color",
+		args: []string{"-color", "-skip", "30", "-length", "4", "-e", `4/1 "%02x" 4/1 "%_p" "\n"`},
+		in:   mixed,
+		out:  "\033[90m00\033[0m\033[90m00\033[0m\033[31m01\033[0m\033[31m02\033[0m\n",
+	},
+	{
+		name: "color canonical",
+		args: []string{"-color", "-skip", "33", "-length", "2"},
+		in:   mixed,
+		out: "00000021  \033[31m02\033[0m \033[32m68\033[0m" + "                                           " +
+			"  |\033[31m.\033[0m\033[32mh\033[0m|\n00000023\n",
 	},
 }
 
 func TestHexdump(t *testing.T) {
 	for _, tt := range tests {
-		cmd := testutil.Command(t)
-		cmd.Stdin = bytes.NewReader(tt.in)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			t.Fatal(err)
-		}
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testutil.Command(t, tt.args...)
+			cmd.Stdin = bytes.NewReader(tt.in)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+
+			if string(out) != tt.out {
+				t.Errorf("hexdump %v = %q, want %q", tt.args, out, tt.out)
+			}
+		})
+	}
+}
 
-		if !bytes.Equal(out, tt.out) {
-			t.Errorf("want=%#v; got=%#v", tt.out, tt)
+func TestParseFormatErrors(t *testing.T) {
+	for _, s := range []string{
+		`"%`,
+		`"%q"`,
+		`"%_ay"`,
+		`/3 "%x"`,
+		`/1 "%x %x"`,
+		`"%s"`,
+		`4/ "%x"`,
+		`"%x`,
+		`%x`,
+	} {
+		if _, err := parseFormat(s); err == nil {
+			t.Errorf("parseFormat(%q) returned no error", s)
 		}
 	}
 }
@@ -23,12 +23,18 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/u-root/u-root/pkg/mdev"
 	"github.com/u-root/u-root/pkg/uroot/util"
 )
 
 var (
 	verbose  = flag.Bool("v", false, "print all build commands")
 	test     = flag.Bool("test", false, "Test mode: don't try to set control tty")
+	mdevFlag = flag.Bool("mdev", false, "Create and remove /dev nodes as devices come and go, for kernels without devtmpfs")
+	noProc   = flag.Bool("no-proc", false, "Do not mount /proc")
+	noSys    = flag.Bool("no-sys", false, "Do not mount /sys")
+	noRun    = flag.Bool("no-run", false, "Do not mount /run")
+	kmsgFlag = flag.Bool("log-to-kmsg", true, "Also write the output of the services /etc/inittab runs, but askfirst consoles, to /dev/kmsg")
 	debug    = func(string, ...interface{}) {}
 	osInitGo = func() {}
 	cmdList  = []string{
@@ -42,10 +48,22 @@ var (
 	}
 	cmdCount int
 	envs     []string
+
+	// kmsg, if set, gets the output of the services init supervises.
+	// uinit, /inito and the shell own the console and are left alone.
+	kmsg *kmsgMux
 )
 
 func main() {
 	flag.Parse()
+	// The kernel passes the arguments it does not know to init, so only
+	// the names of subcommands are taken as such.
+	if cmd, ok := subcommands[flag.Arg(0)]; ok {
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Fatalf("init: %v", err)
+		}
+		return
+	}
 	log.Printf("Welcome to u-root!")
 	fmt.Println(`                              _`)
 	fmt.Println(`   _   _      _ __ ___   ___ | |_`)
@@ -53,7 +71,18 @@ func main() {
 	fmt.Println(`  | |_| |____| | | (_) | (_) | |_`)
 	fmt.Println(`   \__,_|    |_|  \___/ \___/ \__|`)
 	fmt.Println()
-	util.Rootfs()
+	var opts []util.RootfsOption
+	for target, skip := range map[string]bool{"/proc": *noProc, "/sys": *noSys, "/run": *noRun} {
+		if skip {
+			opts = append(opts, util.SkipMount(target))
+		}
+	}
+	util.Rootfs(opts...)
+	if *mdevFlag {
+		go func() {
+			log.Printf("mdev: %v", mdev.Run("/dev"))
+		}()
+	}
 
 	if *verbose {
 		debug = log.Printf
@@ -126,6 +155,16 @@ func main() {
 		go startBgBuild()
 	}
 
+	if *kmsgFlag {
+		f, err := os.OpenFile("/dev/kmsg", os.O_WRONLY, 0)
+		if err != nil {
+			log.Printf("Not logging to kmsg: %v", err)
+		} else {
+			defer f.Close()
+			kmsg = &kmsgMux{w: f}
+		}
+	}
+
 	osInitGo()
 
 	for _, v := range cmdList {
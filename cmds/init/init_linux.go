@@ -6,6 +6,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"strconv"
 	"syscall"
 
@@ -35,4 +36,19 @@ func runOSInitGo() {
 		cmdList = cmdList[1:]
 		cmdCount++
 	}
+	if *ociBundle != "" {
+		cmdCount++
+		if err := RunOCIBundle(*ociBundle); err != nil {
+			log.Printf("OCI bundle %s: %v", *ociBundle, err)
+		}
+	}
+	t, err := readInittab(inittabFile, *runlevel, envs)
+	if err == nil {
+		cmdCount++
+		t.run()
+		// The inittab took the place of uinit and the shell.
+		cmdList = nil
+	} else if !os.IsNotExist(err) {
+		log.Printf("Not running %s: %v", inittabFile, err)
+	}
 }
@@ -0,0 +1,358 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var runlevel = flag.String("runlevel", "", "Run the /etc/inittab entries of this runlevel; the default is that of the initdefault entry, or 3")
+
+// inittabFile, if it exists, says what init runs instead of uinit and the
+// shell, as for SysV init.
+var inittabFile = "/etc/inittab"
+
+const defaultRunlevel = "3"
+
+// askfirstPrompt is printed before starting askfirst entries.
+const askfirstPrompt = "\nPlease press Enter to activate this console. "
+
+// shellMetachars make inittab run a process with sh -c, as Busybox does.
+const shellMetachars = "~`!$^&*()=|\\{}[];\"'<>?"
+
+// inittabEntry is an id:runlevels:action:process line of inittab(5).
+type inittabEntry struct {
+	ID        string
+	Runlevels string
+	Action    string
+	Process   string
+}
+
+// inRunlevel returns whether e runs in runlevel: entries with no runlevels
+// or runlevel S run in all of them.
+func (e inittabEntry) inRunlevel(runlevel string) bool {
+	return e.Runlevels == "" || strings.ContainsAny(e.Runlevels, "Ss") || strings.Contains(e.Runlevels, runlevel)
+}
+
+// argv returns the command line of e.
+func (e inittabEntry) argv() []string {
+	if strings.ContainsAny(e.Process, shellMetachars) {
+		return []string{"/bin/sh", "-c", e.Process}
+	}
+	return strings.Fields(e.Process)
+}
+
+// parseInittab parses r in the format of inittab(5). Comments start with
+// "#".
+func parseInittab(r io.Reader) ([]inittabEntry, error) {
+	var entries []inittabEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		// The process may have colons of its own.
+		f := strings.SplitN(l, ":", 4)
+		if len(f) != 4 {
+			return nil, fmt.Errorf("line %d: %q is not id:runlevels:action:process", n, l)
+		}
+		entries = append(entries, inittabEntry{
+			ID:        f[0],
+			Runlevels: f[1],
+			Action:    f[2],
+			Process:   strings.TrimSpace(f[3]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// supervised is an entry init restarts when it exits.
+type supervised struct {
+	entry inittabEntry
+	// starts are when the entry was started in the last respawnWindow.
+	starts []time.Time
+}
+
+// inittab runs the entries of an inittab(5).
+//
+// It reaps all children itself, as init does: a respawn entry is restarted
+// when its process is reaped, whichever entry is being waited for then.
+type inittab struct {
+	entries  []inittabEntry
+	runlevel string
+	env      []string
+
+	// The console, which askfirst prompts on and the processes use.
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	// setctty makes the console the controlling terminal of askfirst
+	// entries.
+	setctty bool
+	// kmsg, if set, also gets the output of the entries but askfirst
+	// ones, which are interactive.
+	kmsg *kmsgMux
+
+	// Entries started respawnLimit times in respawnWindow are disabled, as
+	// they are broken.
+	respawnLimit  int
+	respawnWindow time.Duration
+
+	// mu guards procs and pending. It is held from starting a process to
+	// recording it, so that reaping a process finds what it was.
+	mu    sync.Mutex
+	procs map[int]*supervised
+	// pending is the number of askfirst entries waiting for Enter.
+	pending int
+	// started wakes up wait when an askfirst entry starts.
+	started chan struct{}
+
+	// promptMu serializes reading the console.
+	promptMu sync.Mutex
+	console  *bufio.Reader
+}
+
+// readInittab returns the inittab at path, to run in the runlevel given, or
+// if that is empty, in that of its initdefault entry.
+func readInittab(path, level string, env []string) (*inittab, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := parseInittab(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if level == "" {
+		level = defaultRunlevel
+		for _, e := range entries {
+			if e.Action == "initdefault" && e.Runlevels != "" {
+				level = e.Runlevels[:1]
+			}
+		}
+	}
+	return &inittab{
+		entries:       entries,
+		runlevel:      level,
+		env:           env,
+		stdin:         os.Stdin,
+		stdout:        os.Stdout,
+		stderr:        os.Stderr,
+		setctty:       !*test,
+		kmsg:          kmsg,
+		respawnLimit:  10,
+		respawnWindow: 2 * time.Minute,
+	}, nil
+}
+
+// startLocked starts the process of e. t.mu is held.
+func (t *inittab) startLocked(e inittabEntry) (int, error) {
+	argv := e.argv()
+	if len(argv) == 0 {
+		return 0, fmt.Errorf("no process")
+	}
+	// A leading "-" starts a login shell.
+	login := strings.HasPrefix(argv[0], "-")
+	argv[0] = strings.TrimPrefix(argv[0], "-")
+	cmd := exec.Command(argv[0], argv[1:]...)
+	if login {
+		cmd.Args[0] = "-" + filepath.Base(argv[0])
+	}
+	cmd.Env = append(append([]string(nil), t.env...), "RUNLEVEL="+t.runlevel)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = t.stdin, t.stdout, t.stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if e.Action == "askfirst" && t.setctty {
+		cmd.SysProcAttr.Setctty = true
+	}
+	started := func() {}
+	if t.kmsg != nil && e.Action != "askfirst" {
+		var err error
+		if started, err = t.kmsg.pipes(cmd); err != nil {
+			log.Printf("inittab: not logging %s to kmsg: %v", e.ID, err)
+			started = func() {}
+		}
+	}
+	debug("inittab: starting %s: %v", e.ID, cmd.Args)
+	err := cmd.Start()
+	started()
+	if err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	// init reaps the process itself.
+	cmd.Process.Release()
+	return pid, nil
+}
+
+func (t *inittab) start(e inittabEntry) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.startLocked(e)
+}
+
+// launchLocked starts a supervised entry, unless it is respawning too fast.
+// t.mu is held.
+func (t *inittab) launchLocked(s *supervised) {
+	now := time.Now()
+	recent := s.starts[:0]
+	for _, st := range s.starts {
+		if now.Sub(st) < t.respawnWindow {
+			recent = append(recent, st)
+		}
+	}
+	s.starts = recent
+	if len(s.starts) >= t.respawnLimit {
+		log.Printf("inittab: %s respawning too fast: disabled", s.entry.ID)
+		return
+	}
+	s.starts = append(s.starts, now)
+	pid, err := t.startLocked(s.entry)
+	if err != nil {
+		log.Printf("inittab: %s: %v", s.entry.ID, err)
+		return
+	}
+	t.procs[pid] = s
+}
+
+// askFirst starts s once Enter is pressed on the console.
+func (t *inittab) askFirst(s *supervised) {
+	t.mu.Lock()
+	t.pending++
+	t.mu.Unlock()
+	go func() {
+		t.promptMu.Lock()
+		fmt.Fprint(t.stdout, askfirstPrompt)
+		_, err := t.console.ReadString('\n')
+		t.promptMu.Unlock()
+
+		t.mu.Lock()
+		t.pending--
+		if err != nil {
+			log.Printf("inittab: %s: reading console: %v", s.entry.ID, err)
+		} else {
+			t.launchLocked(s)
+		}
+		t.mu.Unlock()
+		select {
+		case t.started <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// exited handles the exit of pid.
+func (t *inittab) exited(pid int, s syscall.WaitStatus) {
+	t.mu.Lock()
+	sv, ok := t.procs[pid]
+	delete(t.procs, pid)
+	t.mu.Unlock()
+	if !ok {
+		debug("Reaped PID %d, exit status %d", pid, s.ExitStatus())
+		return
+	}
+	debug("inittab: %s exited, exit status %d", sv.entry.ID, s.ExitStatus())
+	if sv.entry.Action == "askfirst" {
+		t.askFirst(sv)
+		return
+	}
+	t.mu.Lock()
+	t.launchLocked(sv)
+	t.mu.Unlock()
+}
+
+// wait reaps children until pid exits or, if pid is 0, until there are no
+// children left and no askfirst entry is waiting to start.
+func (t *inittab) wait(pid int) {
+	for {
+		var s syscall.WaitStatus
+		p, err := syscall.Wait4(-1, &s, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			t.mu.Lock()
+			pending := t.pending
+			t.mu.Unlock()
+			if pending == 0 || pid != 0 {
+				return
+			}
+			<-t.started
+			continue
+		}
+		if p == pid {
+			return
+		}
+		t.exited(p, s)
+	}
+}
+
+// run runs the entries of t: first the sysinit entries, one after the
+// other, then the boot entries, and then those of the runlevel in order.
+// It returns once no respawn or askfirst entry is left running.
+func (t *inittab) run() {
+	t.procs = make(map[int]*supervised)
+	t.started = make(chan struct{}, 1)
+	t.console = bufio.NewReader(t.stdin)
+	log.Printf("inittab: entering runlevel %s", t.runlevel)
+
+	runAndWait := func(e inittabEntry) {
+		pid, err := t.start(e)
+		if err != nil {
+			log.Printf("inittab: %s: %v", e.ID, err)
+			return
+		}
+		t.wait(pid)
+	}
+	for _, e := range t.entries {
+		if e.Action == "sysinit" {
+			runAndWait(e)
+		}
+	}
+	for _, e := range t.entries {
+		if e.Action == "boot" {
+			if _, err := t.start(e); err != nil {
+				log.Printf("inittab: %s: %v", e.ID, err)
+			}
+		}
+	}
+	for _, e := range t.entries {
+		if !e.inRunlevel(t.runlevel) {
+			continue
+		}
+		switch e.Action {
+		case "once":
+			if _, err := t.start(e); err != nil {
+				log.Printf("inittab: %s: %v", e.ID, err)
+			}
+		case "wait":
+			runAndWait(e)
+		case "respawn":
+			t.mu.Lock()
+			t.launchLocked(&supervised{entry: e})
+			t.mu.Unlock()
+		case "askfirst":
+			t.askFirst(&supervised{entry: e})
+		case "sysinit", "boot", "off", "initdefault":
+		default:
+			log.Printf("inittab: %s: unsupported action %q", e.ID, e.Action)
+		}
+	}
+	t.wait(0)
+}
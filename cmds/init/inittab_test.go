@@ -0,0 +1,207 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInittab(t *testing.T) {
+	entries, err := parseInittab(strings.NewReader(`# Comment.
+id:3:initdefault:
+
+si::sysinit:/etc/init.d/rcS
+tty1:2345:respawn:/sbin/getty -L ttyS0:115200 vt100
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []inittabEntry{
+		{ID: "id", Runlevels: "3", Action: "initdefault"},
+		{ID: "si", Action: "sysinit", Process: "/etc/init.d/rcS"},
+		{ID: "tty1", Runlevels: "2345", Action: "respawn", Process: "/sbin/getty -L ttyS0:115200 vt100"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("parseInittab() = %+v, want %+v", entries, want)
+	}
+	if _, err := parseInittab(strings.NewReader("si::sysinit\n")); err == nil {
+		t.Errorf("parseInittab() of a line without a process succeeded")
+	}
+
+	for _, tt := range []struct {
+		e    inittabEntry
+		argv []string
+	}{
+		{inittabEntry{Process: "/sbin/getty -L ttyS0 vt100"}, []string{"/sbin/getty", "-L", "ttyS0", "vt100"}},
+		{inittabEntry{Process: "echo $HOME > /dev/null"}, []string{"/bin/sh", "-c", "echo $HOME > /dev/null"}},
+	} {
+		if got := tt.e.argv(); !reflect.DeepEqual(got, tt.argv) {
+			t.Errorf("argv(%q) = %q, want %q", tt.e.Process, got, tt.argv)
+		}
+	}
+	for _, tt := range []struct {
+		runlevels string
+		in        bool
+	}{
+		{"", true},
+		{"S", true},
+		{"2345", true},
+		{"12", false},
+	} {
+		if got := (inittabEntry{Runlevels: tt.runlevels}).inRunlevel("3"); got != tt.in {
+			t.Errorf("inRunlevel(3) of runlevels %q = %v, want %v", tt.runlevels, got, tt.in)
+		}
+	}
+}
+
+// runInittab runs the inittab content in runlevel, with stdin as the
+// console, and returns what its processes logged, one line per process, and
+// what was printed to the console.
+func runInittab(t *testing.T, content, runlevel, stdin string) ([]string, string) {
+	dir, err := ioutil.TempDir("", "inittab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "log")
+	p := filepath.Join(dir, "inittab")
+	if err := ioutil.WriteFile(p, []byte(strings.Replace(content, "LOG", logFile, -1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := readInittab(p, runlevel, os.Environ())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The processes share the console, which must be files for them to.
+	in, out := filepath.Join(dir, "stdin"), filepath.Join(dir, "console")
+	if err := ioutil.WriteFile(in, []byte(stdin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdinFile, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinFile.Close()
+	console, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer console.Close()
+	it.stdin, it.stdout, it.stderr = stdinFile, console, console
+	it.setctty = false
+	it.respawnLimit = 3
+	it.run()
+
+	b, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n"), string(c)
+}
+
+const testInittab = `
+id:3:initdefault:
+si1::sysinit:sleep 0.1; echo sysinit1 >> LOG
+si2::sysinit:echo sysinit2 >> LOG
+bt::boot:echo boot >> LOG
+l1:1:wait:echo level1 >> LOG
+w1:2345:wait:sleep 0.1; echo wait1 >> LOG
+o1:3:once:echo once >> LOG
+r1:S:respawn:echo respawn >> LOG
+a1::askfirst:echo askfirst $RUNLEVEL >> LOG
+w2:3:wait:sleep 0.1; echo wait2 >> LOG
+of:3:off:echo off >> LOG
+ca:3:ctrlaltdel:echo ctrlaltdel >> LOG
+`
+
+func TestInittab(t *testing.T) {
+	lines, console := runInittab(t, testInittab, "", "\n\n")
+
+	if len(lines) < 2 || lines[0] != "sysinit1" || lines[1] != "sysinit2" {
+		t.Fatalf("inittab ran %q, want sysinit1 and sysinit2 first", lines)
+	}
+	index := make(map[string]int)
+	count := make(map[string]int)
+	for i, l := range lines {
+		if _, ok := index[l]; !ok {
+			index[l] = i
+		}
+		count[l]++
+	}
+	for l, n := range map[string]int{
+		"boot":       1,
+		"wait1":      1,
+		"once":       1,
+		"wait2":      1,
+		"respawn":    3,
+		"askfirst 3": 2,
+	} {
+		if count[l] != n {
+			t.Errorf("inittab ran %q %d times, want %d: %q", l, count[l], n, lines)
+		}
+	}
+	for _, l := range []string{"level1", "off", "ctrlaltdel"} {
+		if count[l] != 0 {
+			t.Errorf("inittab ran %s: %q", l, lines)
+		}
+	}
+	// Wait entries finish before the entries after them start.
+	if index["wait1"] > index["once"] || index["wait1"] > index["wait2"] {
+		t.Errorf("wait1 did not finish before once and wait2 ran: %q", lines)
+	}
+	// askfirst prompts before each start, and once more before finding no
+	// more input.
+	if n := strings.Count(console, askfirstPrompt); n != 3 {
+		t.Errorf("askfirst prompted %d times, want 3: %q", n, console)
+	}
+}
+
+func TestInittabKmsg(t *testing.T) {
+	k := &mockKmsg{}
+	defer func(old *kmsgMux) { kmsg = old }(kmsg)
+	kmsg = &kmsgMux{w: k}
+
+	lines, _ := runInittab(t, "o1::once:echo service; echo once >> LOG\na1::askfirst:echo console; echo askfirst >> LOG\n", "", "\n")
+	if len(lines) != 2 {
+		t.Fatalf("inittab ran %q, want once and askfirst", lines)
+	}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = k.get(); len(got) > 0 {
+			break
+		}
+	}
+	// The askfirst console is not a service.
+	if len(got) != 1 || !strings.HasSuffix(got[0], "]: service") {
+		t.Errorf("kmsg records = %q, want only the output of the once entry", got)
+	}
+}
+
+func TestInittabRunlevel(t *testing.T) {
+	lines, _ := runInittab(t, testInittab, "1", "")
+	want := map[string]bool{"sysinit1": true, "sysinit2": true, "boot": true, "level1": true, "respawn": true}
+	for _, l := range lines {
+		if !want[l] {
+			t.Errorf("inittab ran %q in runlevel 1: %q", l, lines)
+		}
+	}
+	if len(lines) != 4+3 {
+		t.Errorf("inittab ran %q in runlevel 1, want sysinit1, sysinit2, boot, level1 and respawn 3 times", lines)
+	}
+}
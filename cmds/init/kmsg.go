@@ -0,0 +1,139 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// kmsgLineMax is the longest record written to /dev/kmsg, prefix included.
+// The kernel cuts longer ones off at LOG_LINE_MAX less its own prefix.
+const kmsgLineMax = 976
+
+const truncatedSuffix = "[truncated]"
+
+// syslog(3) severities of the output of services.
+const (
+	kmsgErr  = 3 // stderr
+	kmsgInfo = 6 // stdout
+)
+
+// kmsgMux writes lines of the output of services to /dev/kmsg, one record
+// per line, as "<priority>name[pid]: line".
+type kmsgMux struct {
+	// mu serializes writes to w, each of which is one record.
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// writeLine writes one record, truncating it to kmsgLineMax bytes.
+func (m *kmsgMux) writeLine(prio int, tag string, pid int, line []byte) error {
+	rec := fmt.Sprintf("<%d>%s[%d]: %s", prio, tag, pid, line)
+	if len(rec) > kmsgLineMax {
+		rec = rec[:kmsgLineMax-len(truncatedSuffix)] + truncatedSuffix
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := io.WriteString(m.w, rec)
+	return err
+}
+
+// copyLines writes each line read from r to kmsg. r is also copied to
+// console as it is read, so that nothing waits for the end of a line.
+func (m *kmsgMux) copyLines(prio int, tag string, pid int, r io.Reader, console io.Writer) error {
+	br := bufio.NewReaderSize(io.TeeReader(r, console), kmsgLineMax)
+	for {
+		line, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isPrefix {
+			// The record is truncated anyway; drop the rest of the line.
+			line = append([]byte(nil), line...)
+			for isPrefix && err == nil {
+				_, isPrefix, err = br.ReadLine()
+			}
+			line = append(line, truncatedSuffix...)
+		}
+		if err := m.writeLine(prio, tag, pid, line); err != nil {
+			return err
+		}
+	}
+}
+
+// ignoreErrors is a Writer whose write errors do not stop the copying of
+// service output to kmsg.
+type ignoreErrors struct {
+	io.Writer
+}
+
+func (w ignoreErrors) Write(p []byte) (int, error) {
+	w.Writer.Write(p)
+	return len(p), nil
+}
+
+// pipes sends the stdout and stderr of cmd, which must not be started
+// yet, to m as well as to its current stdout and stderr. The returned
+// function must be called once cmd is started, and starts a goroutine for
+// each pipe.
+func (m *kmsgMux) pipes(cmd *exec.Cmd) (func(), error) {
+	type pipe struct {
+		prio    int
+		r, w    *os.File
+		console io.Writer
+	}
+	var ps []*pipe
+	closeAll := func() {
+		for _, p := range ps {
+			p.r.Close()
+			p.w.Close()
+		}
+	}
+	for _, out := range []struct {
+		prio int
+		w    *io.Writer
+	}{{kmsgInfo, &cmd.Stdout}, {kmsgErr, &cmd.Stderr}} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		console := *out.w
+		if console == nil {
+			console = ioutil.Discard
+		}
+		ps = append(ps, &pipe{prio: out.prio, r: r, w: w, console: ignoreErrors{console}})
+		*out.w = w
+	}
+
+	tag := filepath.Base(cmd.Path)
+	return func() {
+		pid := -1
+		if cmd.Process != nil {
+			pid = cmd.Process.Pid
+		}
+		for _, p := range ps {
+			// Only the child writes now.
+			p.w.Close()
+			go func(p *pipe) {
+				defer p.r.Close()
+				if err := m.copyLines(p.prio, tag, pid, p.r, p.console); err != nil {
+					// Keep draining the pipe, or the service blocks.
+					io.Copy(p.console, p.r)
+				}
+			}(p)
+		}
+	}, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockKmsg records each write as /dev/kmsg takes it, as one record.
+type mockKmsg struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (k *mockKmsg) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.records = append(k.records, string(p))
+	return len(p), nil
+}
+
+func (k *mockKmsg) get() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.records...)
+}
+
+// syncBuffer is a bytes.Buffer safe for the pipe goroutines.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestCopyLines(t *testing.T) {
+	long := strings.Repeat("x", 2000)
+	in := "first\n\nsecond\r\n" + long + "\nlast without newline"
+
+	k := &mockKmsg{}
+	var console bytes.Buffer
+	m := &kmsgMux{w: k}
+	if err := m.copyLines(kmsgInfo, "uinit", 42, strings.NewReader(in), &console); err != nil {
+		t.Fatalf("copyLines() = %v", err)
+	}
+	if console.String() != in {
+		t.Errorf("console got %q, want the input unchanged", console.String())
+	}
+
+	prefix := "<6>uinit[42]: "
+	want := []string{
+		prefix + "first",
+		prefix,
+		prefix + "second",
+		prefix + long[:kmsgLineMax-len(prefix)-len(truncatedSuffix)] + truncatedSuffix,
+		prefix + "last without newline",
+	}
+	got := k.get()
+	if len(got) != len(want) {
+		t.Fatalf("records = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d = %q, want %q", i, got[i], want[i])
+		}
+		if len(got[i]) > kmsgLineMax {
+			t.Errorf("record %d is %d bytes, more than %d", i, len(got[i]), kmsgLineMax)
+		}
+	}
+}
+
+func TestWriteLineTruncates(t *testing.T) {
+	k := &mockKmsg{}
+	m := &kmsgMux{w: k}
+	for _, n := range []int{kmsgLineMax - len("<3>sh[1]: "), kmsgLineMax} {
+		if err := m.writeLine(kmsgErr, "sh", 1, bytes.Repeat([]byte("y"), n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := k.get()
+	if len(got[0]) != kmsgLineMax || strings.HasSuffix(got[0], truncatedSuffix) {
+		t.Errorf("record of exactly %d bytes was changed to %q", kmsgLineMax, got[0])
+	}
+	if len(got[1]) != kmsgLineMax || !strings.HasSuffix(got[1], truncatedSuffix) {
+		t.Errorf("long record = %d bytes %q, want %d bytes ending in %s", len(got[1]), got[1], kmsgLineMax, truncatedSuffix)
+	}
+}
+
+func TestPipes(t *testing.T) {
+	k := &mockKmsg{}
+	m := &kmsgMux{w: k}
+	var stdout, stderr syncBuffer
+
+	cmd := exec.Command("/bin/sh", "-c", "echo out; echo err >&2")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	started, err := m.pipes(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("no shell: %v", err)
+	}
+	started()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	pid := cmd.Process.Pid
+	want := []string{
+		"<3>sh[" + strconv.Itoa(pid) + "]: err",
+		"<6>sh[" + strconv.Itoa(pid) + "]: out",
+	}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = k.get(); len(got) == len(want) && stderr.String() != "" && stdout.String() != "" {
+			break
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("console got %q and %q, want out and err", stdout.String(), stderr.String())
+	}
+}
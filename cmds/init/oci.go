@@ -0,0 +1,988 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/u-root/u-root/pkg/mount"
+	"golang.org/x/sys/unix"
+)
+
+var ociBundle = flag.String("oci-bundle", "", "Run the OCI bundle in this directory before uinit")
+
+// The OCI runtime spec, or the part of it RunOCIBundle supports. See
+// https://github.com/opencontainers/runtime-spec/blob/master/config.md.
+type ociSpec struct {
+	Process  *ociProcess `json:"process"`
+	Root     *ociRoot    `json:"root"`
+	Hostname string      `json:"hostname"`
+	Mounts   []ociMount  `json:"mounts"`
+	Linux    *ociLinux   `json:"linux"`
+}
+
+type ociProcess struct {
+	User            ociUser          `json:"user"`
+	Args            []string         `json:"args"`
+	Env             []string         `json:"env"`
+	Cwd             string           `json:"cwd"`
+	Capabilities    *ociCapabilities `json:"capabilities"`
+	Rlimits         []ociRlimit      `json:"rlimits"`
+	NoNewPrivileges bool             `json:"noNewPrivileges"`
+}
+
+type ociUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids"`
+}
+
+type ociCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+	Ambient     []string `json:"ambient"`
+}
+
+type ociRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options"`
+}
+
+type ociLinux struct {
+	Namespaces    []ociNamespace    `json:"namespaces"`
+	UIDMappings   []ociIDMapping    `json:"uidMappings"`
+	GIDMappings   []ociIDMapping    `json:"gidMappings"`
+	Devices       []ociDevice       `json:"devices"`
+	CgroupsPath   string            `json:"cgroupsPath"`
+	Resources     *ociResources     `json:"resources"`
+	Seccomp       *ociSeccomp       `json:"seccomp"`
+	Sysctl        map[string]string `json:"sysctl"`
+	MaskedPaths   []string          `json:"maskedPaths"`
+	ReadonlyPaths []string          `json:"readonlyPaths"`
+}
+
+type ociNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+type ociIDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+type ociDevice struct {
+	Type     string  `json:"type"`
+	Path     string  `json:"path"`
+	Major    int64   `json:"major"`
+	Minor    int64   `json:"minor"`
+	FileMode *uint32 `json:"fileMode"`
+	UID      *uint32 `json:"uid"`
+	GID      *uint32 `json:"gid"`
+}
+
+type ociResources struct {
+	Memory *struct {
+		Limit *int64 `json:"limit"`
+	} `json:"memory"`
+	CPU *struct {
+		Shares *uint64 `json:"shares"`
+		Quota  *int64  `json:"quota"`
+		Period *uint64 `json:"period"`
+	} `json:"cpu"`
+	Pids *struct {
+		Limit int64 `json:"limit"`
+	} `json:"pids"`
+}
+
+type ociSeccomp struct {
+	DefaultAction   string       `json:"defaultAction"`
+	DefaultErrnoRet *uint        `json:"defaultErrnoRet"`
+	Architectures   []string     `json:"architectures"`
+	Syscalls        []ociSyscall `json:"syscalls"`
+}
+
+type ociSyscall struct {
+	Names    []string          `json:"names"`
+	Action   string            `json:"action"`
+	ErrnoRet *uint             `json:"errnoRet"`
+	Args     []json.RawMessage `json:"args"`
+}
+
+// namespaceFlags are the clone flags of the namespace types.
+var namespaceFlags = map[string]uintptr{
+	"mount":   unix.CLONE_NEWNS,
+	"pid":     unix.CLONE_NEWPID,
+	"network": unix.CLONE_NEWNET,
+	"ipc":     unix.CLONE_NEWIPC,
+	"uts":     unix.CLONE_NEWUTS,
+	"user":    unix.CLONE_NEWUSER,
+	"cgroup":  unix.CLONE_NEWCGROUP,
+}
+
+// joinableNamespaces are the namespaces the container can join by path.
+// The others cannot be joined by a thread of a Go program, or, for pid
+// namespaces, would only apply to its children.
+var joinableNamespaces = map[string]bool{"network": true, "ipc": true, "uts": true}
+
+// readSpec reads and checks the config.json of the bundle.
+func readSpec(bundle string) (*ociSpec, error) {
+	b, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	spec := &ociSpec{}
+	if err := json.Unmarshal(b, spec); err != nil {
+		return nil, fmt.Errorf("bad config.json: %v", err)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return nil, fmt.Errorf("config.json has no process to run")
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, fmt.Errorf("config.json has no root")
+	}
+	if spec.Linux == nil {
+		spec.Linux = &ociLinux{}
+	}
+	mountNS, utsNS := false, false
+	for _, ns := range spec.Linux.Namespaces {
+		if _, ok := namespaceFlags[ns.Type]; !ok {
+			return nil, fmt.Errorf("unknown namespace type %q", ns.Type)
+		}
+		if ns.Path != "" && !joinableNamespaces[ns.Type] {
+			return nil, fmt.Errorf("joining %s namespaces is not supported", ns.Type)
+		}
+		mountNS = mountNS || ns.Type == "mount"
+		utsNS = utsNS || ns.Type == "uts"
+	}
+	// Without its own mount namespace, the container would mount over
+	// the file systems of init.
+	if !mountNS {
+		return nil, fmt.Errorf("the container needs a mount namespace")
+	}
+	if spec.Hostname != "" && !utsNS {
+		return nil, fmt.Errorf("setting the hostname needs a uts namespace")
+	}
+	return spec, nil
+}
+
+// ociChildEnv is set to the bundle path when init runs itself as the first
+// process of a container.
+const ociChildEnv = "_UROOT_OCI_BUNDLE"
+
+func init() {
+	if bundle := os.Getenv(ociChildEnv); bundle != "" {
+		err := runOCIChild(bundle)
+		fmt.Fprintf(os.Stderr, "oci: starting container: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+// RunOCIBundle runs the container of the OCI bundle at bundlePath and waits
+// for it to exit.
+//
+// The container gets the namespaces, root file system, mounts, devices,
+// cgroup limits, user, capabilities and seccomp filter its config.json asks
+// for. It shares the standard input and output of init.
+func RunOCIBundle(bundlePath string) error {
+	return runOCIBundle(bundlePath, os.Stdin, os.Stdout, os.Stderr)
+}
+
+func runOCIBundle(bundlePath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	bundle, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return err
+	}
+	spec, err := readSpec(bundle)
+	if err != nil {
+		return err
+	}
+
+	attr := &syscall.SysProcAttr{}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path == "" {
+			attr.Cloneflags |= namespaceFlags[ns.Type]
+		}
+	}
+	if attr.Cloneflags&unix.CLONE_NEWUSER != 0 {
+		attr.UidMappings = idMappings(spec.Linux.UIDMappings)
+		attr.GidMappings = idMappings(spec.Linux.GIDMappings)
+		attr.GidMappingsEnableSetgroups = len(spec.Process.User.AdditionalGids) > 0
+	}
+
+	// The child waits for the end of sync, so that it is in its cgroup
+	// before it runs anything.
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncW.Close()
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = []string{"oci-init"}
+	cmd.Env = []string{ociChildEnv + "=" + bundle}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	cmd.ExtraFiles = []*os.File{syncR}
+	cmd.SysProcAttr = attr
+	err = cmd.Start()
+	syncR.Close()
+	if err != nil {
+		return err
+	}
+
+	removeCgroup, err := setupCgroup(spec.Linux, cmd.Process.Pid)
+	defer removeCgroup()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	syncW.Close()
+	return cmd.Wait()
+}
+
+func idMappings(m []ociIDMapping) []syscall.SysProcIDMap {
+	var ids []syscall.SysProcIDMap
+	for _, id := range m {
+		ids = append(ids, syscall.SysProcIDMap{ContainerID: int(id.ContainerID), HostID: int(id.HostID), Size: int(id.Size)})
+	}
+	return ids
+}
+
+// runOCIChild makes this process, in the new namespaces, the process of the
+// container in bundle. It only returns on error.
+func runOCIChild(bundle string) error {
+	// Credentials, capabilities and seccomp filters are set on this
+	// thread, which then execs the process.
+	runtime.LockOSThread()
+	if _, err := ioutil.ReadAll(os.NewFile(3, "sync")); err != nil {
+		return err
+	}
+	spec, err := readSpec(bundle)
+	if err != nil {
+		return err
+	}
+	p := spec.Process
+
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path == "" {
+			continue
+		}
+		f, err := os.Open(ns.Path)
+		if err != nil {
+			return err
+		}
+		err = unix.Setns(int(f.Fd()), int(namespaceFlags[ns.Type]))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("joining %s namespace %s: %v", ns.Type, ns.Path, err)
+		}
+	}
+	if spec.Hostname != "" {
+		if err := unix.Sethostname([]byte(spec.Hostname)); err != nil {
+			return fmt.Errorf("setting hostname: %v", err)
+		}
+	}
+	// The bounding set is dropped up to the last capability of this
+	// kernel, which must be read before /proc goes away.
+	lastCap, err := lastCapability()
+	if err != nil {
+		return err
+	}
+	var filter []unix.SockFilter
+	if spec.Linux.Seccomp != nil {
+		if filter, err = seccompFilter(spec.Linux.Seccomp); err != nil {
+			return err
+		}
+	}
+
+	root := spec.Root.Path
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(bundle, root)
+	}
+	if err := setupRootfs(spec, bundle, root); err != nil {
+		return err
+	}
+	for _, r := range p.Rlimits {
+		res, ok := rlimits[r.Type]
+		if !ok {
+			return fmt.Errorf("unknown rlimit %q", r.Type)
+		}
+		if err := unix.Setrlimit(res, &unix.Rlimit{Cur: r.Soft, Max: r.Hard}); err != nil {
+			return fmt.Errorf("setting %s: %v", r.Type, err)
+		}
+	}
+	cwd := p.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	if err := os.Chdir(cwd); err != nil {
+		return err
+	}
+
+	// Look the program up in the PATH of the container.
+	os.Clearenv()
+	for _, e := range p.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			os.Setenv(kv[0], kv[1])
+		}
+	}
+	path, err := exec.LookPath(p.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := setUser(p, lastCap); err != nil {
+		return err
+	}
+	if p.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("setting no_new_privs: %v", err)
+		}
+	}
+	if filter != nil {
+		if err := loadSeccomp(filter); err != nil {
+			return err
+		}
+	}
+	return unix.Exec(path, p.Args, p.Env)
+}
+
+// mountOptions are the mount(8) options that are mount flags. The others
+// are passed to the file system.
+var mountOptions = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":          {false, unix.MS_RDONLY},
+	"rw":          {true, unix.MS_RDONLY},
+	"nosuid":      {false, unix.MS_NOSUID},
+	"suid":        {true, unix.MS_NOSUID},
+	"nodev":       {false, unix.MS_NODEV},
+	"dev":         {true, unix.MS_NODEV},
+	"noexec":      {false, unix.MS_NOEXEC},
+	"exec":        {true, unix.MS_NOEXEC},
+	"sync":        {false, unix.MS_SYNCHRONOUS},
+	"async":       {true, unix.MS_SYNCHRONOUS},
+	"dirsync":     {false, unix.MS_DIRSYNC},
+	"mand":        {false, unix.MS_MANDLOCK},
+	"nomand":      {true, unix.MS_MANDLOCK},
+	"noatime":     {false, unix.MS_NOATIME},
+	"atime":       {true, unix.MS_NOATIME},
+	"nodiratime":  {false, unix.MS_NODIRATIME},
+	"diratime":    {true, unix.MS_NODIRATIME},
+	"relatime":    {false, unix.MS_RELATIME},
+	"norelatime":  {true, unix.MS_RELATIME},
+	"strictatime": {false, unix.MS_STRICTATIME},
+	"bind":        {false, unix.MS_BIND},
+	"rbind":       {false, unix.MS_BIND | unix.MS_REC},
+}
+
+// propagationOptions are the mount options that change the propagation of
+// a mount, which takes a mount(2) of its own.
+var propagationOptions = map[string]uintptr{
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"shared":      unix.MS_SHARED,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
+// parseMountOptions returns the mount flags, propagation flags and data of
+// the options of a mount.
+func parseMountOptions(options []string) (flags, propagation uintptr, data string) {
+	var d []string
+	for _, o := range options {
+		if f, ok := mountOptions[o]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+		} else if f, ok := propagationOptions[o]; ok {
+			propagation |= f
+		} else {
+			d = append(d, o)
+		}
+	}
+	return flags, propagation, strings.Join(d, ",")
+}
+
+// inRoot returns the path of the container's path in the root file system
+// at root.
+//
+// Symlinks in the root file system are not resolved within it, so bundles
+// must be trusted.
+func inRoot(root, path string) string {
+	return filepath.Join(root, filepath.Clean("/"+path))
+}
+
+// setupRootfs mounts the root file system of the container, with its mounts
+// and devices, and makes it the root of this process.
+func setupRootfs(spec *ociSpec, bundle, root string) error {
+	// Keep mounts from propagating to init's mount namespace.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making / private: %v", err)
+	}
+	// pivot_root needs the new root to be a mount.
+	if err := unix.Mount(root, root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mounting root %s: %v", root, err)
+	}
+	for _, m := range spec.Mounts {
+		if err := mountInRoot(bundle, root, m); err != nil {
+			return err
+		}
+	}
+	for _, d := range spec.Linux.Devices {
+		if err := createDevice(root, d); err != nil {
+			return err
+		}
+	}
+	if err := switchRoot(root); err != nil {
+		return err
+	}
+
+	for k, v := range spec.Linux.Sysctl {
+		p := filepath.Join("/proc/sys", strings.Replace(k, ".", "/", -1))
+		if err := ioutil.WriteFile(p, []byte(v), 0644); err != nil {
+			return fmt.Errorf("setting sysctl %s: %v", k, err)
+		}
+	}
+	for _, p := range spec.Linux.MaskedPaths {
+		if err := maskPath(p); err != nil {
+			return err
+		}
+	}
+	for _, p := range spec.Linux.ReadonlyPaths {
+		if err := readonlyPath(p); err != nil {
+			return err
+		}
+	}
+	if spec.Root.Readonly {
+		if err := unix.Mount("", "/", "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("making root read-only: %v", err)
+		}
+	}
+	return nil
+}
+
+// mountInRoot makes the mount m in the root file system at root.
+func mountInRoot(bundle, root string, m ociMount) error {
+	dest := inRoot(root, m.Destination)
+	flags, propagation, data := parseMountOptions(m.Options)
+	source := m.Source
+	bind := flags&unix.MS_BIND != 0
+	if bind && !filepath.IsAbs(source) {
+		source = filepath.Join(bundle, source)
+	}
+
+	// Bind mounts of files need a file to mount over.
+	if fi, err := os.Stat(source); bind && err == nil && !fi.IsDir() {
+		if err := createFile(dest); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	// Bind mounts ignore all flags but MS_REC, so the others take a
+	// remount.
+	if err := unix.Mount(source, dest, m.Type, flags, data); err != nil {
+		return fmt.Errorf("mounting %s on %s: %v", source, m.Destination, err)
+	}
+	if bind && flags&^(unix.MS_BIND|unix.MS_REC) != 0 {
+		if err := unix.Mount(dest, dest, "", flags|unix.MS_REMOUNT, ""); err != nil {
+			return fmt.Errorf("remounting %s: %v", m.Destination, err)
+		}
+	}
+	if propagation != 0 {
+		if err := unix.Mount("", dest, "", propagation, ""); err != nil {
+			return fmt.Errorf("changing propagation of %s: %v", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// createFile creates an empty file at path, unless there is one.
+func createFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+var deviceTypes = map[string]uint32{
+	"c": unix.S_IFCHR,
+	"u": unix.S_IFCHR,
+	"b": unix.S_IFBLK,
+	"p": unix.S_IFIFO,
+}
+
+// createDevice creates the device node d in the root file system at root.
+// Devices cannot be made in user namespaces, so there the host's device is
+// bind mounted instead.
+func createDevice(root string, d ociDevice) error {
+	typ, ok := deviceTypes[d.Type]
+	if !ok {
+		return fmt.Errorf("device %s has unknown type %q", d.Path, d.Type)
+	}
+	mode := uint32(0666)
+	if d.FileMode != nil {
+		mode = *d.FileMode & 07777
+	}
+	path := inRoot(root, d.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	os.Remove(path)
+	err := unix.Mknod(path, typ|mode, int(unix.Mkdev(uint32(d.Major), uint32(d.Minor))))
+	if err == unix.EPERM {
+		if err := createFile(path); err != nil {
+			return err
+		}
+		if err := unix.Mount(d.Path, path, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mounting device %s: %v", d.Path, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating device %s: %v", d.Path, err)
+	}
+	// mknod(2) applies the umask.
+	if err := os.Chmod(path, os.FileMode(mode&0777)); err != nil {
+		return err
+	}
+	if d.UID != nil || d.GID != nil {
+		uid, gid := -1, -1
+		if d.UID != nil {
+			uid = int(*d.UID)
+		}
+		if d.GID != nil {
+			gid = int(*d.GID)
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// switchRoot makes root the root of this process and unmounts the old one
+// from the container. The root of an initramfs cannot be pivoted away
+// from, so there root is moved over it instead.
+func switchRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(".", "."); err == nil {
+		// The old root is now on top of the new one.
+		if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmounting old root: %v", err)
+		}
+	} else if err == unix.EINVAL {
+		return mount.MoveRoot(".")
+	} else {
+		return fmt.Errorf("pivot_root to %s: %v", root, err)
+	}
+	return os.Chdir("/")
+}
+
+// maskPath hides path, if it exists, under an empty read-only file system
+// or /dev/null.
+func maskPath(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = unix.Mount("tmpfs", path, "tmpfs", unix.MS_RDONLY, "")
+	} else {
+		err = unix.Mount("/dev/null", path, "", unix.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("masking %s: %v", path, err)
+	}
+	return nil
+}
+
+// readonlyPath makes path, if it exists, read-only.
+func readonlyPath(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %v", path, err)
+	}
+	if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %v", path, err)
+	}
+	return nil
+}
+
+// rlimits are the resources of rlimits, from asm-generic/resource.h.
+var rlimits = map[string]int{
+	"RLIMIT_CPU":        0,
+	"RLIMIT_FSIZE":      1,
+	"RLIMIT_DATA":       2,
+	"RLIMIT_STACK":      3,
+	"RLIMIT_CORE":       4,
+	"RLIMIT_RSS":        5,
+	"RLIMIT_NPROC":      6,
+	"RLIMIT_NOFILE":     7,
+	"RLIMIT_MEMLOCK":    8,
+	"RLIMIT_AS":         9,
+	"RLIMIT_LOCKS":      10,
+	"RLIMIT_SIGPENDING": 11,
+	"RLIMIT_MSGQUEUE":   12,
+	"RLIMIT_NICE":       13,
+	"RLIMIT_RTPRIO":     14,
+	"RLIMIT_RTTIME":     15,
+}
+
+// capabilities are the names of the capabilities, in the order of their
+// numbers in linux/capability.h.
+var capabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// capMask returns the bit mask of the capabilities names.
+func capMask(names []string) (uint64, error) {
+	var mask uint64
+	for _, n := range names {
+		i := 0
+		for i < len(capabilities) && capabilities[i] != n {
+			i++
+		}
+		if i == len(capabilities) {
+			return 0, fmt.Errorf("unknown capability %q", n)
+		}
+		mask |= 1 << uint(i)
+	}
+	return mask, nil
+}
+
+// lastCapability returns the number of the last capability the kernel has.
+func lastCapability() (int, error) {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// capHeader and capData are struct __user_cap_header_struct and
+// __user_cap_data_struct, of which version 3 has two.
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+const linuxCapabilityVersion3 = 0x20080522
+
+// capset sets the capabilities of the calling thread.
+func capset(effective, permitted, inheritable uint64) error {
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{
+		{uint32(effective), uint32(permitted), uint32(inheritable)},
+		{uint32(effective >> 32), uint32(permitted >> 32), uint32(inheritable >> 32)},
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setUser makes the calling thread run as the user of p, with the
+// capabilities of p.
+func setUser(p *ociProcess, lastCap int) error {
+	caps := p.Capabilities
+	var bounding, effective, permitted, inheritable, ambient uint64
+	if caps != nil {
+		var err error
+		for _, c := range []struct {
+			mask  *uint64
+			names []string
+		}{
+			{&bounding, caps.Bounding},
+			{&effective, caps.Effective},
+			{&permitted, caps.Permitted},
+			{&inheritable, caps.Inheritable},
+			{&ambient, caps.Ambient},
+		} {
+			if *c.mask, err = capMask(c.names); err != nil {
+				return err
+			}
+		}
+		for i := 0; i <= lastCap; i++ {
+			if bounding&(1<<uint(i)) != 0 {
+				continue
+			}
+			if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(i), 0, 0, 0); err != nil {
+				return fmt.Errorf("dropping capability %d from the bounding set: %v", i, err)
+			}
+		}
+		// Keep the permitted capabilities when leaving uid 0.
+		if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+			return err
+		}
+	}
+
+	u := p.User
+	gids := make([]int, len(u.AdditionalGids))
+	for i, g := range u.AdditionalGids {
+		gids[i] = int(g)
+	}
+	// Without additional groups, setgroups may be denied, as in user
+	// namespaces.
+	if err := unix.Setgroups(gids); err != nil && (len(gids) > 0 || err != unix.EPERM) {
+		return fmt.Errorf("setting groups: %v", err)
+	}
+	if err := unix.Setresgid(int(u.GID), int(u.GID), int(u.GID)); err != nil {
+		return fmt.Errorf("setting gid: %v", err)
+	}
+	if err := unix.Setresuid(int(u.UID), int(u.UID), int(u.UID)); err != nil {
+		return fmt.Errorf("setting uid: %v", err)
+	}
+
+	if caps == nil {
+		return nil
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return err
+	}
+	if err := capset(effective, permitted, inheritable); err != nil {
+		return fmt.Errorf("setting capabilities: %v", err)
+	}
+	for i := 0; i <= lastCap; i++ {
+		if ambient&(1<<uint(i)) == 0 {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(i), 0, 0); err != nil {
+			return fmt.Errorf("raising ambient capability %s: %v", capabilities[i], err)
+		}
+	}
+	return nil
+}
+
+// cgroupRoot is where the cgroup file systems are mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupSetting is a value to write to a file of a cgroup controller.
+type cgroupSetting struct {
+	controller, file, value string
+}
+
+// cgroupSettings returns the settings of r for cgroup v2, or v1.
+func cgroupSettings(r *ociResources, v2 bool) []cgroupSetting {
+	var s []cgroupSetting
+	if r == nil {
+		return nil
+	}
+	if r.Memory != nil && r.Memory.Limit != nil {
+		if v2 {
+			s = append(s, cgroupSetting{"memory", "memory.max", limit(*r.Memory.Limit)})
+		} else {
+			s = append(s, cgroupSetting{"memory", "memory.limit_in_bytes", strconv.FormatInt(*r.Memory.Limit, 10)})
+		}
+	}
+	if c := r.CPU; c != nil {
+		if c.Shares != nil {
+			if v2 {
+				// runc's conversion of shares, 2 to 262144, to
+				// weights, 1 to 10000.
+				weight := 1 + ((*c.Shares-2)*9999)/262142
+				s = append(s, cgroupSetting{"cpu", "cpu.weight", strconv.FormatUint(weight, 10)})
+			} else {
+				s = append(s, cgroupSetting{"cpu", "cpu.shares", strconv.FormatUint(*c.Shares, 10)})
+			}
+		}
+		if c.Quota != nil || c.Period != nil {
+			period := uint64(100000)
+			if c.Period != nil {
+				period = *c.Period
+			}
+			quota := int64(-1)
+			if c.Quota != nil {
+				quota = *c.Quota
+			}
+			if v2 {
+				s = append(s, cgroupSetting{"cpu", "cpu.max", fmt.Sprintf("%s %d", limit(quota), period)})
+			} else {
+				s = append(s,
+					cgroupSetting{"cpu", "cpu.cfs_period_us", strconv.FormatUint(period, 10)},
+					cgroupSetting{"cpu", "cpu.cfs_quota_us", strconv.FormatInt(quota, 10)})
+			}
+		}
+	}
+	if r.Pids != nil {
+		s = append(s, cgroupSetting{"pids", "pids.max", limit(r.Pids.Limit)})
+	}
+	return s
+}
+
+// limit formats a cgroup limit, where -1 is no limit.
+func limit(n int64) string {
+	if n < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// setupCgroup puts the process pid in the cgroup of l, with the limits of
+// its resources, and returns a function that removes the cgroup once the
+// process has exited, even on error.
+func setupCgroup(l *ociLinux, pid int) (func(), error) {
+	path := l.CgroupsPath
+	if path == "" {
+		if l.Resources == nil {
+			return func() {}, nil
+		}
+		path = filepath.Join("u-root-oci", strconv.Itoa(pid))
+	}
+	path = filepath.Clean("/" + path)
+
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	v2 := err == nil
+	settings := cgroupSettings(l.Resources, v2)
+
+	// In v2, there is one hierarchy, whose controllers must be enabled
+	// for the subtree the cgroup is in.
+	dirs := map[string]string{"": filepath.Join(cgroupRoot, path)}
+	if v2 {
+		var enable []string
+		for _, s := range settings {
+			enable = append(enable, "+"+s.controller)
+		}
+		for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+			for _, c := range enable {
+				// Best effort: the controller may be enabled
+				// already, or unavailable.
+				ioutil.WriteFile(filepath.Join(cgroupRoot, dir, "cgroup.subtree_control"), []byte(c), 0644)
+			}
+			if dir == "/" {
+				break
+			}
+		}
+	} else {
+		dirs = map[string]string{}
+		for _, s := range settings {
+			dirs[s.controller] = filepath.Join(cgroupRoot, s.controller, path)
+		}
+	}
+
+	remove := func() {
+		for _, dir := range dirs {
+			if err := os.Remove(dir); err != nil {
+				log.Printf("oci: removing cgroup: %v", err)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return remove, err
+		}
+	}
+	for _, s := range settings {
+		dir := dirs[""]
+		if !v2 {
+			dir = dirs[s.controller]
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, s.file), []byte(s.value), 0644); err != nil {
+			return remove, fmt.Errorf("setting cgroup %s: %v", s.file, err)
+		}
+	}
+	for _, dir := range dirs {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return remove, fmt.Errorf("adding container to cgroup %s: %v", dir, err)
+		}
+	}
+	return remove, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Return values of seccomp filters, from linux/seccomp.h.
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// seccompAction returns the filter return value of an OCI seccomp action.
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(unix.EPERM)
+		if errnoRet != nil {
+			errno = uint32(*errnoRet) & 0xffff
+		}
+		return seccompRetErrno | errno, nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	}
+	return 0, fmt.Errorf("unknown seccomp action %q", action)
+}
+
+// bpfStmt and bpfJump are the BPF_STMT and BPF_JUMP macros.
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// Offsets of the architecture and system call number in struct
+// seccomp_data.
+const (
+	seccompDataNR   = 0
+	seccompDataArch = 4
+)
+
+// seccompFilter compiles s to a BPF program for PR_SET_SECCOMP.
+//
+// System calls run with another architecture's calling convention, like
+// 32-bit ones on amd64, kill the process. Rules with argument conditions
+// are not supported, and names of system calls this architecture does not
+// have are skipped, as runc does.
+func seccompFilter(s *ociSeccomp) ([]unix.SockFilter, error) {
+	if auditArch == 0 {
+		return nil, fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+	}
+	if len(s.Architectures) > 0 {
+		native := false
+		for _, a := range s.Architectures {
+			native = native || a == seccompArch
+		}
+		if !native {
+			return nil, fmt.Errorf("seccomp architectures %v do not include %s", s.Architectures, seccompArch)
+		}
+	}
+	def, err := seccompAction(s.DefaultAction, s.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	prog := []unix.SockFilter{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNR),
+	}
+	for _, sc := range s.Syscalls {
+		if len(sc.Args) > 0 {
+			return nil, fmt.Errorf("seccomp rules with args are not supported: %v", sc.Names)
+		}
+		action, err := seccompAction(sc.Action, sc.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range sc.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			prog = append(prog,
+				bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+				bpfStmt(unix.BPF_RET|unix.BPF_K, action))
+		}
+	}
+	prog = append(prog, bpfStmt(unix.BPF_RET|unix.BPF_K, def))
+	if len(prog) > 0xffff {
+		return nil, fmt.Errorf("seccomp filter of %d instructions is too long", len(prog))
+	}
+	return prog, nil
+}
+
+// loadSeccomp installs the filter prog on the calling thread, which must be
+// the one that execs the container process.
+func loadSeccomp(prog []unix.SockFilter) error {
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+		return fmt.Errorf("loading seccomp filter: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,!amd64,!arm64
+
+package main
+
+// There are no seccomp filters on other architectures yet.
+const (
+	auditArch   = 0
+	seccompArch = ""
+)
+
+var syscallNumbers map[string]uint32
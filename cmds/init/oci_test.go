@@ -0,0 +1,218 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("no seccomp filters on this architecture")
+	}
+	eperm := uint(unix.EPERM)
+	prog, err := seccompFilter(&ociSeccomp{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []ociSyscall{
+			{Names: []string{"mkdirat", "no_such_call"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm},
+			{Names: []string{"reboot"}, Action: "SCMP_ACT_KILL_PROCESS"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The architecture check, a test and return for each known name, and
+	// the default.
+	if len(prog) != 4+2*2+1 {
+		t.Errorf("filter has %d instructions, want 9: %v", len(prog), prog)
+	}
+	if last := prog[len(prog)-1]; last.K != seccompRetAllow {
+		t.Errorf("filter returns %#x by default, want SECCOMP_RET_ALLOW", last.K)
+	}
+	if ret := prog[5]; ret.K != seccompRetErrno|uint32(unix.EPERM) {
+		t.Errorf("mkdirat returns %#x, want SECCOMP_RET_ERRNO|EPERM", ret.K)
+	}
+
+	for _, s := range []*ociSeccomp{
+		{DefaultAction: "SCMP_ACT_EXPLODE"},
+		{DefaultAction: "SCMP_ACT_ALLOW", Architectures: []string{"SCMP_ARCH_MIPS"}},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []ociSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO", Args: []json.RawMessage{[]byte("{}")}}}},
+	} {
+		if _, err := seccompFilter(s); err == nil {
+			t.Errorf("seccompFilter(%+v) = nil, want error", s)
+		}
+	}
+}
+
+func TestParseMountOptions(t *testing.T) {
+	flags, propagation, data := parseMountOptions([]string{"rbind", "ro", "nosuid", "rw", "rprivate", "mode=755", "size=65536k"})
+	if want := uintptr(unix.MS_BIND | unix.MS_REC | unix.MS_NOSUID); flags != want {
+		t.Errorf("flags = %#x, want %#x", flags, want)
+	}
+	if want := uintptr(unix.MS_PRIVATE | unix.MS_REC); propagation != want {
+		t.Errorf("propagation = %#x, want %#x", propagation, want)
+	}
+	if want := "mode=755,size=65536k"; data != want {
+		t.Errorf("data = %q, want %q", data, want)
+	}
+}
+
+func TestReadSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, config := range []string{
+		`{`,
+		`{"root": {"path": "rootfs"}, "linux": {"namespaces": [{"type": "mount"}]}}`,
+		`{"process": {"args": ["/hello"]}, "linux": {"namespaces": [{"type": "mount"}]}}`,
+		`{"process": {"args": ["/hello"]}, "root": {"path": "rootfs"}}`,
+		`{"process": {"args": ["/hello"]}, "root": {"path": "rootfs"}, "linux": {"namespaces": [{"type": "mount"}, {"type": "time"}]}}`,
+		`{"process": {"args": ["/hello"]}, "root": {"path": "rootfs"}, "linux": {"namespaces": [{"type": "mount", "path": "/proc/1/ns/mnt"}]}}`,
+		`{"process": {"args": ["/hello"]}, "root": {"path": "rootfs"}, "hostname": "box", "linux": {"namespaces": [{"type": "mount"}]}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSpec(dir); err == nil {
+			t.Errorf("readSpec(%s) = nil, want error", config)
+		}
+	}
+}
+
+// helloBundle makes a bundle in dir with testdata/ocihello in its root.
+func helloBundle(t *testing.T, dir string) {
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go to build the container's program")
+	}
+	src, err := filepath.Abs("testdata/ocihello/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := exec.Command("go", "build", "-o", filepath.Join(rootfs, "hello"), src)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if o, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building ocihello: %v: %s", err, o)
+	}
+
+	eperm := uint(unix.EPERM)
+	caps := []string{"CAP_NET_BIND_SERVICE"}
+	nullMode := uint32(0666)
+	spec := ociSpec{
+		Process: &ociProcess{
+			User: ociUser{UID: 1000, GID: 1000, AdditionalGids: []uint32{2000}},
+			Args: []string{"hello"},
+			Env:  []string{"PATH=/"},
+			Cwd:  "/tmp",
+			Capabilities: &ociCapabilities{
+				Bounding:    caps,
+				Inheritable: caps,
+				Effective:   caps,
+				Permitted:   caps,
+				Ambient:     caps,
+			},
+			Rlimits:         []ociRlimit{{Type: "RLIMIT_NOFILE", Soft: 123, Hard: 123}},
+			NoNewPrivileges: true,
+		},
+		Root:     &ociRoot{Path: "rootfs", Readonly: true},
+		Hostname: "oci-test",
+		Mounts: []ociMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "mode=1777"}},
+		},
+		Linux: &ociLinux{
+			Namespaces: []ociNamespace{{Type: "mount"}, {Type: "pid"}, {Type: "uts"}, {Type: "ipc"}, {Type: "network"}},
+			Devices:    []ociDevice{{Type: "c", Path: "/dev/null", Major: 1, Minor: 3, FileMode: &nullMode}},
+			Seccomp: &ociSeccomp{
+				DefaultAction: "SCMP_ACT_ALLOW",
+				Syscalls:      []ociSyscall{{Names: []string{"mkdir", "mkdirat"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm}},
+			},
+		},
+	}
+	if auditArch == 0 {
+		spec.Linux.Seccomp = nil
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "pids")); err == nil {
+		spec.Linux.CgroupsPath = "u-root-oci-test"
+		spec.Linux.Resources = &ociResources{Pids: &struct {
+			Limit int64 `json:"limit"`
+		}{50}}
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunOCIBundle(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("containers need root")
+	}
+	if err := unix.Unshare(0); err != nil {
+		t.Skipf("no namespaces: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "oci-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	helloBundle(t, dir)
+
+	var stdout, stderr bytes.Buffer
+	err = runOCIBundle(dir, nil, &stdout, &stderr)
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 3 {
+		t.Fatalf("runOCIBundle() = %v, want exit status 3; stderr:\n%s", err, stderr.String())
+	}
+	got := stdout.String()
+	for _, want := range []string{
+		"hostname=oci-test\n",
+		"pid=1\n",
+		"uid=1000 gid=1000\n",
+		"groups=[2000]\n",
+		"cwd=/tmp\n",
+		"CapEff:0000000000000400\n",
+		"CapBnd:0000000000000400\n",
+		"NoNewPrivs:1\n",
+		"nofile=123\n",
+		"create=open /file: read-only file system\n",
+		"tmp=<nil>\n",
+		"null=Dcrw-rw-rw-\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("container printed\n%s\nwant %q", got, want)
+		}
+	}
+	if auditArch != 0 && !strings.Contains(got, "mkdir=mkdir /tmp/dir: operation not permitted\n") {
+		t.Errorf("container printed\n%s\nwant mkdir denied by seccomp", got)
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "pids")); err == nil {
+		if !strings.Contains(got, "cgroup=/u-root-oci-test\n") {
+			t.Errorf("container printed\n%s\nwant it in cgroup /u-root-oci-test", got)
+		}
+		if _, err := os.Stat(filepath.Join(cgroupRoot, "pids", "u-root-oci-test")); !os.IsNotExist(err) {
+			t.Errorf("cgroup not removed after the container exited: %v", err)
+		}
+	}
+}
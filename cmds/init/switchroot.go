@@ -0,0 +1,82 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/u-root/u-root/pkg/mount"
+	"golang.org/x/sys/unix"
+)
+
+// subcommands are run by init instead of starting the system when its first
+// argument names one.
+var subcommands = map[string]func(args []string) error{
+	"switch-root": func(args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("usage: init switch-root <newroot> <init> [args...]")
+		}
+		return switchRootExec(args[0], args[1], args[2:])
+	},
+	"pivot-root": func(args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: init pivot-root <newroot> <putold>")
+		}
+		if err := mount.PivotRoot(args[0], args[1]); err != nil {
+			return fmt.Errorf("pivot-root: %v", err)
+		}
+		return nil
+	},
+}
+
+// openFDs returns the file descriptors of this process but stdin, stdout
+// and stderr.
+func openFDs() []int {
+	names, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		// Without /proc, try them all.
+		var lim unix.Rlimit
+		if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+			return nil
+		}
+		fds := make([]int, 0, lim.Cur)
+		for fd := 3; uint64(fd) < lim.Cur; fd++ {
+			fds = append(fds, fd)
+		}
+		return fds
+	}
+	var fds []int
+	for _, n := range names {
+		if fd, err := strconv.Atoi(n.Name()); err == nil && fd > 2 {
+			fds = append(fds, fd)
+		}
+	}
+	return fds
+}
+
+// switchRootExec makes newRoot the root, as mount.SwitchRoot does, and
+// execs newInit in it with args. The file descriptors but stdin, stdout and
+// stderr close.
+func switchRootExec(newRoot, newInit string, args []string) error {
+	if _, err := os.Lstat(filepath.Join(newRoot, newInit)); err != nil {
+		return fmt.Errorf("switch-root: no init in %s: %v", newRoot, err)
+	}
+	// /proc moves with the rest, so look the descriptors up first.
+	fds := openFDs()
+	if err := mount.SwitchRoot(newRoot); err != nil {
+		return fmt.Errorf("switch-root: %v", err)
+	}
+	for _, fd := range fds {
+		unix.CloseOnExec(fd)
+	}
+	if err := unix.Exec(newInit, append([]string{newInit}, args...), os.Environ()); err != nil {
+		return fmt.Errorf("switch-root: exec %s: %v", newInit, err)
+	}
+	return nil
+}
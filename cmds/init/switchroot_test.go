@@ -0,0 +1,197 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tests run themselves with these set to switch or pivot the root in a
+// mount namespace of their own.
+const (
+	testSubcommandEnv = "_UROOT_TEST_ROOT_SUBCOMMAND"
+	testDirEnv        = "_UROOT_TEST_ROOT_DIR"
+	testTmpfsEnv      = "_UROOT_TEST_ROOT_TMPFS"
+)
+
+func init() {
+	if cmd := os.Getenv(testSubcommandEnv); cmd != "" {
+		err := runRootTest(cmd, os.Getenv(testDirEnv), os.Getenv(testTmpfsEnv) != "")
+		fmt.Printf("error=%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runRootTest runs the subcommand cmd with dir/root as the new root, which
+// it first fills with dir/rootreport and a mark. With tmpfs, the new root
+// is a tmpfs; otherwise it is a directory of the old root.
+func runRootTest(cmd, dir string, tmpfs bool) error {
+	os.Unsetenv(testSubcommandEnv)
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	newRoot := filepath.Join(dir, "root")
+	if tmpfs {
+		if err := unix.Mount("tmpfs", newRoot, "tmpfs", 0, ""); err != nil {
+			return err
+		}
+	}
+	report, err := ioutil.ReadFile(filepath.Join(dir, "rootreport"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(newRoot, "rootreport"), report, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(newRoot, "rootmark"), []byte("new root"), 0644); err != nil {
+		return err
+	}
+
+	// A mount beside the new root, which switch-root moves into it.
+	moved := filepath.Join(dir, "moved")
+	if err := unix.Mount("tmpfs", moved, "tmpfs", 0, ""); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(moved, "mark"), []byte("moved"), 0644); err != nil {
+		return err
+	}
+	os.Setenv("MOVED_MARK", filepath.Join(moved, "mark"))
+
+	// A descriptor that would stay open across exec.
+	fd, err := unix.Open("/dev/null", unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	os.Setenv("OPEN_FD", strconv.Itoa(fd))
+
+	switch cmd {
+	case "switch-root":
+		return subcommands[cmd]([]string{newRoot, "/rootreport", "a", "b"})
+	case "pivot-root":
+		if err := os.Mkdir(filepath.Join(newRoot, "old"), 0755); err != nil {
+			return err
+		}
+		if err := subcommands[cmd]([]string{newRoot, filepath.Join(newRoot, "old")}); err != nil {
+			return err
+		}
+		wd, _ := os.Getwd()
+		fmt.Printf("cwd=%s\n", wd)
+		mark, err := ioutil.ReadFile("/rootmark")
+		fmt.Printf("rootmark=%q %v\n", mark, err)
+		mark, err = ioutil.ReadFile(filepath.Join("/old", moved, "mark"))
+		fmt.Printf("old=%q %v\n", mark, err)
+		os.Exit(0)
+	}
+	return fmt.Errorf("unknown subcommand %q", cmd)
+}
+
+// rootTest runs the root test of cmd in a mount namespace and returns its
+// output.
+func rootTest(t *testing.T, cmd string, tmpfs bool) string {
+	if os.Getuid() != 0 {
+		t.Skip("changing the root needs root")
+	}
+	if err := unix.Unshare(0); err != nil {
+		t.Skipf("no namespaces: %v", err)
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go to build the new root's program")
+	}
+	dir, err := ioutil.TempDir("", "init-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"root", "moved"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := filepath.Abs("testdata/rootreport/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := exec.Command("go", "build", "-o", filepath.Join(dir, "rootreport"), src)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if o, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building rootreport: %v: %s", err, o)
+	}
+
+	c := exec.Command("/proc/self/exe")
+	c.Env = append(os.Environ(), testSubcommandEnv+"="+cmd, testDirEnv+"="+dir)
+	if tmpfs {
+		c.Env = append(c.Env, testTmpfsEnv+"=1")
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNS}
+	o, err := c.Output()
+	if err != nil {
+		t.Fatalf("init %s: %v; output:\n%s", cmd, err, o)
+	}
+	return string(o)
+}
+
+func TestSwitchRoot(t *testing.T) {
+	for _, tmpfs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tmpfs=%v", tmpfs), func(t *testing.T) {
+			got := rootTest(t, "switch-root", tmpfs)
+			for _, want := range []string{
+				`args=["a" "b"]`,
+				"cwd=/\n",
+				`rootmark="new root" <nil>`,
+				`moved="moved" <nil>`,
+				"proc=<nil>\n",
+				"fd=bad file descriptor\n",
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("new init printed\n%s\nwant %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPivotRoot(t *testing.T) {
+	for _, tmpfs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tmpfs=%v", tmpfs), func(t *testing.T) {
+			got := rootTest(t, "pivot-root", tmpfs)
+			for _, want := range []string{
+				"cwd=/\n",
+				`rootmark="new root" <nil>`,
+				`old="moved" <nil>`,
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("pivot-root printed\n%s\nwant %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSubcommandUsage(t *testing.T) {
+	for name, args := range map[string][]string{
+		"switch-root": {"/newroot"},
+		"pivot-root":  {"/newroot"},
+	} {
+		if err := subcommands[name](args); err == nil || !strings.Contains(err.Error(), "usage") {
+			t.Errorf("%s %q = %v, want usage", name, args, err)
+		}
+	}
+	if err := subcommands["switch-root"]([]string{"/", "/init"}); err == nil {
+		t.Errorf("switch-root / = nil, want error")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// ocihello prints what TestRunOCIBundle checks about its container.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	hostname, _ := os.Hostname()
+	fmt.Printf("hostname=%s\n", hostname)
+	fmt.Printf("pid=%d\n", os.Getpid())
+	fmt.Printf("uid=%d gid=%d\n", os.Getuid(), os.Getgid())
+	groups, _ := os.Getgroups()
+	fmt.Printf("groups=%v\n", groups)
+	wd, _ := os.Getwd()
+	fmt.Printf("cwd=%s\n", wd)
+
+	status, _ := ioutil.ReadFile("/proc/self/status")
+	for _, l := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(l, "CapEff:") || strings.HasPrefix(l, "CapBnd:") || strings.HasPrefix(l, "NoNewPrivs:") {
+			fmt.Println(strings.Join(strings.Fields(l), ""))
+		}
+	}
+	var r syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r)
+	fmt.Printf("nofile=%d\n", r.Cur)
+
+	// mkdir is denied by seccomp, and the root is read-only.
+	fmt.Printf("mkdir=%v\n", os.Mkdir("/tmp/dir", 0755))
+	fmt.Printf("create=%v\n", ioutil.WriteFile("/file", nil, 0644))
+	fmt.Printf("tmp=%v\n", ioutil.WriteFile("/tmp/file", nil, 0644))
+
+	if fi, err := os.Stat("/dev/null"); err == nil {
+		fmt.Printf("null=%v\n", fi.Mode())
+	}
+	cgroups, _ := ioutil.ReadFile("/proc/self/cgroup")
+	for _, l := range strings.Split(string(cgroups), "\n") {
+		if strings.Contains(l, ":pids:") || strings.HasPrefix(l, "0::") {
+			fmt.Printf("cgroup=%s\n", l[strings.LastIndex(l, ":")+1:])
+		}
+	}
+	os.Exit(3)
+}
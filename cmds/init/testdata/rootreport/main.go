@@ -0,0 +1,30 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// rootreport prints what TestSwitchRoot checks about the root it runs in.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+func main() {
+	fmt.Printf("args=%q\n", os.Args[1:])
+	wd, _ := os.Getwd()
+	fmt.Printf("cwd=%s\n", wd)
+	mark, err := ioutil.ReadFile("/rootmark")
+	fmt.Printf("rootmark=%q %v\n", mark, err)
+	moved, err := ioutil.ReadFile(os.Getenv("MOVED_MARK"))
+	fmt.Printf("moved=%q %v\n", moved, err)
+	_, err = os.Stat("/proc/self/fd")
+	fmt.Printf("proc=%v\n", err)
+	fd, _ := strconv.Atoi(os.Getenv("OPEN_FD"))
+	var st syscall.Stat_t
+	err = syscall.Fstat(fd, &st)
+	fmt.Printf("fd=%v\n", err)
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ipLink runs "ip link args".
+func ipLink(t *testing.T, args string) {
+	t.Helper()
+	arg = append([]string{"link"}, strings.Fields(args)...)
+	cursor = 0
+	if err := link(); err != nil {
+		t.Fatalf("ip link %s = %v", args, err)
+	}
+}
+
+// etherType is the IEEE local experimental EtherType.
+const etherType = 0x88b5
+
+func packetSocket(t *testing.T, name string) int {
+	t.Helper()
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto := int(etherType>>8 | etherType&0xff<<8)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: uint16(proto), Ifindex: l.Attrs().Index}); err != nil {
+		t.Fatal(err)
+	}
+	tv := unix.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestBridge(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		ipLink(t, "add br0 type bridge")
+		for _, p := range []string{"0", "1"} {
+			veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth" + p + "a"}, PeerName: "veth" + p + "b"}
+			if err := netlink.LinkAdd(veth); err != nil {
+				t.Fatal(err)
+			}
+			ipLink(t, "set veth"+p+"b master br0")
+			ipLink(t, "set veth"+p+"a up")
+			ipLink(t, "set veth"+p+"b up")
+		}
+		ipLink(t, "set br0 up")
+
+		var b bytes.Buffer
+		if err := showLinks(&b, false, "bridge"); err != nil {
+			t.Fatal(err)
+		}
+		if s := b.String(); !strings.Contains(s, ": br0: ") || strings.Contains(s, "veth") {
+			t.Errorf("show type bridge = %q, want only br0", s)
+		}
+		b.Reset()
+		if err := showLinks(&b, false, ""); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(b.String(), " master br0 "); got != 2 {
+			t.Errorf("show = %q, want 2 links with master br0", b.String())
+		}
+
+		// A broadcast sent into one port must come out of the other.
+		rx := packetSocket(t, "veth1a")
+		defer unix.Close(rx)
+		tx := packetSocket(t, "veth0a")
+		defer unix.Close(tx)
+		src, err := netlink.LinkByName("veth0a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, 60)
+		copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		copy(frame[6:], src.Attrs().HardwareAddr)
+		binary.BigEndian.PutUint16(frame[12:], etherType)
+		copy(frame[14:], "u-root bridge test")
+
+		got := false
+		buf := make([]byte, 1500)
+		for i := 0; i < 20 && !got; i++ {
+			if _, err := unix.Write(tx, frame); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				n, _, err := unix.Recvfrom(rx, buf, 0)
+				if err != nil {
+					break
+				}
+				if bytes.Equal(buf[:n], frame) {
+					got = true
+					break
+				}
+			}
+		}
+		if !got {
+			t.Fatalf("frame sent on veth0a was not forwarded to veth1a")
+		}
+
+		// The bridge learned where the sender is.
+		neighs, err := netlink.NeighList(0, unix.AF_BRIDGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, err := netlink.LinkByName("veth0b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		learned := false
+		for _, n := range neighs {
+			if n.LinkIndex == port.Attrs().Index && bytes.Equal(n.HardwareAddr, src.Attrs().HardwareAddr) {
+				learned = true
+			}
+		}
+		if !learned {
+			t.Errorf("bridge did not learn %s on veth0b", src.Attrs().HardwareAddr)
+		}
+
+		ipLink(t, "set veth0b nomaster")
+		if port, err = netlink.LinkByName("veth0b"); err != nil {
+			t.Fatal(err)
+		}
+		if port.Attrs().MasterIndex != 0 {
+			t.Errorf("veth0b still has master %d after nomaster", port.Attrs().MasterIndex)
+		}
+
+		arg, cursor = []string{"link", "set", "veth1b", "master", "veth0a"}, 0
+		if err := link(); err == nil {
+			t.Errorf("set master to a veth = nil, want error")
+		}
+
+		ipLink(t, "del br0")
+		if _, err := netlink.LinkByName("br0"); err == nil {
+			t.Errorf("br0 still exists after del")
+		}
+	})
+}
@@ -41,7 +41,12 @@ var (
 	cursor    int
 	arg       []string
 	whatIWant []string
-	log       = l.New(os.Stdout, "ip: ", 0)
+
+	egressQosMap  = flag.StringSlice("egress-qos-map", nil, "FROM:TO mappings of skb priorities to VLAN priorities for ip link add type vlan")
+	ingressQosMap = flag.StringSlice("ingress-qos-map", nil, "FROM:TO mappings of VLAN priorities to skb priorities for ip link add type vlan")
+	macAddr       = flag.String("macaddr", "", "MAC address for ip link add type macvlan")
+
+	log = l.New(os.Stdout, "ip: ", 0)
 
 	addrScopes = map[netlink.Scope]string{
 		netlink.SCOPE_UNIVERSE: "global",
@@ -92,7 +97,7 @@ func addrip() error {
 	var err error
 	var addr *netlink.Addr
 	if len(arg) == 1 {
-		return showLinks(os.Stdout, true)
+		return showLinks(os.Stdout, true, "")
 	}
 	cursor++
 	whatIWant = []string{"add", "del"}
@@ -131,9 +136,106 @@ func addrip() error {
 
 func linkshow() error {
 	cursor++
-	whatIWant = []string{"<nothing>", "<device name>"}
+	whatIWant = []string{"<nothing>", "type", "dev", "device name"}
 	if len(arg[cursor:]) == 0 {
-		return showLinks(os.Stdout, false)
+		return showLinks(os.Stdout, false, "")
+	}
+	if arg[cursor] == "type" {
+		cursor++
+		whatIWant = []string{"link type"}
+		return showLinks(os.Stdout, false, arg[cursor])
+	}
+	cursor--
+	iface, err := dev()
+	if err != nil {
+		return err
+	}
+	return showLink(os.Stdout, iface)
+}
+
+// linkadd adds a link. Only bridges, VLANs, VXLANs, MACVLANs, IPVLANs and
+// VRFs can be added for now.
+func linkadd() error {
+	cursor++
+	var parent netlink.Link
+	whatIWant = []string{"link", "name", "link name"}
+	if arg[cursor] == "link" {
+		cursor++
+		whatIWant = []string{"parent device name"}
+		l, err := netlink.LinkByName(arg[cursor])
+		if err != nil {
+			return err
+		}
+		parent = l
+		cursor++
+	}
+	whatIWant = []string{"name", "link name"}
+	if arg[cursor] == "name" {
+		cursor++
+	}
+	whatIWant = []string{"link name"}
+	name := arg[cursor]
+
+	cursor++
+	whatIWant = []string{"type"}
+	if arg[cursor] != "type" {
+		return usage()
+	}
+	cursor++
+	whatIWant = []string{"bridge", "vlan", "vxlan", "macvlan", "ipvlan", "vrf"}
+	switch arg[cursor] {
+	case "bridge":
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return fmt.Errorf("adding bridge %v failed: %v", name, err)
+		}
+		return nil
+	case "vlan":
+		if parent == nil {
+			return fmt.Errorf("VLAN %v needs a parent: add link DEV name %v type vlan id ID", name, name)
+		}
+		return vlanadd(name, parent)
+	case "vxlan":
+		return vxlanadd(name)
+	case "macvlan", "ipvlan":
+		if parent == nil {
+			return fmt.Errorf("%v %v needs a parent: add link DEV name %v type %v", strings.ToUpper(arg[cursor]), name, name, arg[cursor])
+		}
+		if arg[cursor] == "macvlan" {
+			return macvlanadd(name, parent)
+		}
+		return ipvlanadd(name, parent)
+	case "vrf":
+		return vrfadd(name)
+	}
+	return usage()
+}
+
+func linkdel() error {
+	iface, err := dev()
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkDel(iface); err != nil {
+		return fmt.Errorf("deleting %v failed: %v", iface.Attrs().Name, err)
+	}
+	return nil
+}
+
+func setMaster(iface netlink.Link) error {
+	cursor++
+	whatIWant = []string{"bridge or VRF name"}
+	master, err := netlink.LinkByName(arg[cursor])
+	if err != nil {
+		return err
+	}
+	switch master.(type) {
+	case *netlink.Bridge, *netlink.Vrf:
+	default:
+		return fmt.Errorf("%v is a %v, not a bridge or VRF", arg[cursor], master.Type())
+	}
+	if err := netlink.LinkSetMasterByIndex(iface, master.Attrs().Index); err != nil {
+		return fmt.Errorf("%v can't set master %v: %v", iface.Attrs().Name, arg[cursor], err)
 	}
 	return nil
 }
@@ -159,10 +261,20 @@ func linkset() error {
 	}
 
 	cursor++
-	whatIWant = []string{"address", "up", "down"}
+	whatIWant = []string{"address", "up", "down", "master", "nomaster", "vf", "numvfs"}
 	switch one(arg[cursor], whatIWant) {
 	case "address":
 		return setHardwareAddress(iface)
+	case "vf":
+		return vfset(iface)
+	case "numvfs":
+		return numvfs(iface)
+	case "master":
+		return setMaster(iface)
+	case "nomaster":
+		if err := netlink.LinkSetNoMaster(iface); err != nil {
+			return fmt.Errorf("%v can't unset master: %v", iface.Attrs().Name, err)
+		}
 	case "up":
 		if err := netlink.LinkSetUp(iface); err != nil {
 			return fmt.Errorf("%v can't make it up: %v", iface, err)
@@ -183,7 +295,7 @@ func link() error {
 	}
 
 	cursor++
-	whatIWant = []string{"show", "set"}
+	whatIWant = []string{"show", "set", "add", "delete"}
 	cmd := arg[cursor]
 
 	switch one(cmd, whatIWant) {
@@ -191,6 +303,10 @@ func link() error {
 		return linkshow()
 	case "set":
 		return linkset()
+	case "add":
+		return linkadd()
+	case "delete":
+		return linkdel()
 	}
 	return usage()
 }
@@ -266,7 +382,17 @@ func route() error {
 	whatIWant = []string{"show", "add"}
 	switch one(arg[cursor], whatIWant) {
 	case "show":
-		return routeshow()
+		cursor++
+		if len(arg[cursor:]) == 0 {
+			return routeshow()
+		}
+		whatIWant = []string{"vrf"}
+		if arg[cursor] != "vrf" {
+			return usage()
+		}
+		cursor++
+		whatIWant = []string{"VRF name"}
+		return routeShowVRF(os.Stdout, arg[cursor])
 	case "add":
 		return routeadd()
 	}
@@ -275,7 +401,7 @@ func route() error {
 
 func main() {
 	// When this is embedded in busybox we need to reinit some things.
-	whatIWant = []string{"addr", "route", "link"}
+	whatIWant = []string{"addr", "route", "link", "netns", "tunnel", "vrf", "mptcp"}
 	cursor = 0
 	flag.Parse()
 	arg = flag.Args()
@@ -305,6 +431,14 @@ func main() {
 		err = link()
 	case "route":
 		err = route()
+	case "netns":
+		err = netns()
+	case "tunnel":
+		err = tunnel()
+	case "vrf":
+		err = vrfcmd()
+	case "mptcp":
+		err = mptcp()
 	default:
 		usage()
 	}
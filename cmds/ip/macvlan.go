@@ -0,0 +1,111 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	macvlanModes = map[string]netlink.MacvlanMode{
+		"private":  netlink.MACVLAN_MODE_PRIVATE,
+		"vepa":     netlink.MACVLAN_MODE_VEPA,
+		"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+		"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+	}
+	ipvlanModes = map[string]netlink.IPVlanMode{
+		"l2":  netlink.IPVLAN_MODE_L2,
+		"l3":  netlink.IPVLAN_MODE_L3,
+		"l3s": netlink.IPVLAN_MODE_L3S,
+	}
+)
+
+// macvlanModeName returns the name of mode, as ip link show prints it.
+func macvlanModeName(mode netlink.MacvlanMode) string {
+	for name, m := range macvlanModes {
+		if m == mode {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", mode)
+}
+
+// ipvlanModeName returns the name of mode, as ip link show prints it.
+func ipvlanModeName(mode netlink.IPVlanMode) string {
+	for name, m := range ipvlanModes {
+		if m == mode {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", mode)
+}
+
+// parseMode parses the optional "mode MODE" that ends ip link add NAME type
+// macvlan or ipvlan, and returns MODE, or "" if there is none.
+func parseMode(modes []string) (string, error) {
+	var mode string
+	for cursor++; cursor < len(arg); cursor++ {
+		whatIWant = []string{"mode"}
+		if arg[cursor] != "mode" {
+			return "", usage()
+		}
+		cursor++
+		whatIWant = modes
+		mode = arg[cursor]
+	}
+	return mode, nil
+}
+
+// macvlanadd adds a MACVLAN on parent, with the MAC address of --macaddr if
+// it is set.
+func macvlanadd(name string, parent netlink.Link) error {
+	modes := []string{"private", "vepa", "bridge", "passthru"}
+	mode, err := parseMode(modes)
+	if err != nil {
+		return err
+	}
+	m := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index}}
+	if mode != "" {
+		var ok bool
+		if m.Mode, ok = macvlanModes[mode]; !ok {
+			return fmt.Errorf("MACVLAN %v: mode %q is not one of %v", name, mode, modes)
+		}
+	}
+	if *macAddr != "" {
+		hw, err := net.ParseMAC(*macAddr)
+		if err != nil {
+			return fmt.Errorf("MACVLAN %v: %v", name, err)
+		}
+		m.HardwareAddr = hw
+	}
+	if err := netlink.LinkAdd(m); err != nil {
+		return fmt.Errorf("adding MACVLAN %v failed: %v", name, err)
+	}
+	return nil
+}
+
+// ipvlanadd adds an IPVLAN on parent. Without a mode, it is l3, as in
+// iproute2.
+func ipvlanadd(name string, parent netlink.Link) error {
+	modes := []string{"l2", "l3", "l3s"}
+	mode, err := parseMode(modes)
+	if err != nil {
+		return err
+	}
+	v := &netlink.IPVlan{LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index}, Mode: netlink.IPVLAN_MODE_L3}
+	if mode != "" {
+		var ok bool
+		if v.Mode, ok = ipvlanModes[mode]; !ok {
+			return fmt.Errorf("IPVLAN %v: mode %q is not one of %v", name, mode, modes)
+		}
+	}
+	if err := netlink.LinkAdd(v); err != nil {
+		return fmt.Errorf("adding IPVLAN %v failed: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+// vethPeer connects the namespace of InNetNS, on veth0a without an address,
+// to a new one at 10.1.0.2 on veth0b, and returns the runner of the new one.
+func vethPeer(t *testing.T) func(f func()) {
+	t.Helper()
+	ns, inPeer := peerNetNS(t)
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0a"}, PeerName: "veth0b"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := netlink.LinkByName("veth0b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	l, err := netlink.LinkByName("veth0a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		t.Fatal(err)
+	}
+	inPeer(func() { addrUp(t, "veth0b", "10.1.0.2/24") })
+	return inPeer
+}
+
+func TestMacvlan(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		inPeer := vethPeer(t)
+		var peerMAC net.HardwareAddr
+		inPeer(func() {
+			l, err := netlink.LinkByName("veth0b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			peerMAC = l.Attrs().HardwareAddr
+		})
+
+		*macAddr = "02:00:00:00:00:42"
+		defer func() { *macAddr = "" }()
+		ipOrSkip(t, "link add link veth0a name mv0 type macvlan mode bridge")
+		*macAddr = ""
+		ipOrSkip(t, "link add link veth0a name mv1 type macvlan mode private")
+		addrUp(t, "mv0", "10.1.0.1/24")
+
+		l, err := netlink.LinkByName("mv0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, ok := l.(*netlink.Macvlan)
+		if !ok {
+			t.Fatalf("mv0 is a %v, want macvlan", l.Type())
+		}
+		if m.Mode != netlink.MACVLAN_MODE_BRIDGE || m.HardwareAddr.String() != "02:00:00:00:00:42" {
+			t.Errorf("mv0 has mode %v and address %v, want bridge and 02:00:00:00:00:42", m.Mode, m.HardwareAddr)
+		}
+
+		var b bytes.Buffer
+		if err := showLinks(&b, false, "macvlan"); err != nil {
+			t.Fatal(err)
+		}
+		s := b.String()
+		for _, want := range []string{": mv0@veth0a: ", "    link/ether 02:00:00:00:00:42\n", "    macvlan mode bridge\n", ": mv1@veth0a: ", "    macvlan mode private\n"} {
+			if !strings.Contains(s, want) {
+				t.Errorf("ip link show type macvlan = %q, want %q in it", s, want)
+			}
+		}
+		if strings.Contains(s, ": veth0a: ") {
+			t.Errorf("ip link show type macvlan = %q, want only MACVLANs", s)
+		}
+
+		// Traffic from mv0 reaches the peer once it has resolved its
+		// address with ARP.
+		var conn *net.UDPConn
+		inPeer(func() {
+			if conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(10, 1, 0, 2), Port: 9999}); err != nil {
+				t.Fatal(err)
+			}
+		})
+		defer conn.Close()
+		c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(10, 1, 0, 2), Port: 9999})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		buf := make([]byte, 64)
+		received := false
+		for i := 0; i < 20 && !received; i++ {
+			c.Write([]byte("hi"))
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, from, err := conn.ReadFromUDP(buf)
+			if err == nil {
+				received = true
+				if !from.IP.Equal(net.IPv4(10, 1, 0, 1)) {
+					t.Errorf("peer got a packet from %v, want 10.1.0.1", from)
+				}
+			}
+		}
+		if !received {
+			t.Fatalf("nothing from mv0 reached the peer")
+		}
+		neighs, err := netlink.NeighList(m.Index, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved := false
+		for _, n := range neighs {
+			if n.IP.Equal(net.IPv4(10, 1, 0, 2)) && n.HardwareAddr.String() == peerMAC.String() {
+				resolved = true
+			}
+		}
+		if !resolved {
+			t.Errorf("mv0 neighbours = %v, want 10.1.0.2 at %v", neighs, peerMAC)
+		}
+	})
+}
+
+func TestIPVlan(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0a"}, PeerName: "veth0b"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatal(err)
+		}
+		ipOrSkip(t, "link add link veth0a name ipv0 type ipvlan mode l2")
+		ipLink(t, "add link veth0a name ipv1 type ipvlan")
+
+		for name, want := range map[string]netlink.IPVlanMode{"ipv0": netlink.IPVLAN_MODE_L2, "ipv1": netlink.IPVLAN_MODE_L3} {
+			l, err := netlink.LinkByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, ok := l.(*netlink.IPVlan); !ok || v.Mode != want {
+				t.Errorf("%s is %#v, want an IPVLAN in mode %v", name, l, want)
+			}
+		}
+
+		var b bytes.Buffer
+		if err := showLinks(&b, false, "ipvlan"); err != nil {
+			t.Fatal(err)
+		}
+		s := b.String()
+		for _, want := range []string{": ipv0@veth0a: ", "    ipvlan mode l2\n", ": ipv1@veth0a: ", "    ipvlan mode l3\n"} {
+			if !strings.Contains(s, want) {
+				t.Errorf("ip link show type ipvlan = %q, want %q in it", s, want)
+			}
+		}
+	})
+}
+
+func TestMacvlanAddErrors(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0a"}, PeerName: "veth0b"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range []string{
+			"link add name mv0 type macvlan",
+			"link add link veth0a name mv0 type macvlan mode bogus",
+			"link add link veth0a name mv0 type macvlan bridge",
+			"link add link veth0a name ipv0 type ipvlan mode l4",
+			"link add name ipv0 type ipvlan",
+		} {
+			arg, cursor = strings.Fields(args), 0
+			if err := link(); err == nil {
+				t.Errorf("ip %s = nil, want error", args)
+			}
+		}
+
+		*macAddr = "bogus"
+		defer func() { *macAddr = "" }()
+		arg, cursor = strings.Fields("link add link veth0a name mv0 type macvlan"), 0
+		if err := link(); err == nil {
+			t.Errorf("ip link add type macvlan with --macaddr=bogus = nil, want error")
+		}
+	})
+}
@@ -0,0 +1,492 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Of <linux/mptcp.h>. The in-kernel path manager is the generic netlink
+// family mptcp_pm.
+const (
+	mptcpPMName      = "mptcp_pm"
+	mptcpPMVersion   = 1
+	mptcpPMEventsGrp = "mptcp_pm_events"
+
+	mptcpPMCmdAddAddr   = 1
+	mptcpPMCmdDelAddr   = 2
+	mptcpPMCmdGetAddr   = 3
+	mptcpPMCmdSetLimits = 5
+	mptcpPMCmdGetLimits = 6
+
+	mptcpPMAttrAddr        = 1
+	mptcpPMAttrRcvAddAddrs = 2
+	mptcpPMAttrSubflows    = 3
+
+	mptcpPMAddrAttrFamily = 1
+	mptcpPMAddrAttrID     = 2
+	mptcpPMAddrAttrAddr4  = 3
+	mptcpPMAddrAttrAddr6  = 4
+	mptcpPMAddrAttrPort   = 5
+	mptcpPMAddrAttrFlags  = 6
+	mptcpPMAddrAttrIfIdx  = 7
+
+	mptcpAttrToken      = 1
+	mptcpAttrLocID      = 3
+	mptcpAttrRemID      = 4
+	mptcpAttrSaddr4     = 5
+	mptcpAttrSaddr6     = 6
+	mptcpAttrDaddr4     = 7
+	mptcpAttrDaddr6     = 8
+	mptcpAttrSport      = 9
+	mptcpAttrDport      = 10
+	mptcpAttrBackup     = 11
+	mptcpAttrError      = 12
+	mptcpAttrIfIdx      = 15
+	mptcpAttrServerSide = 18
+)
+
+// mptcpEndpointFlags are the flags of endpoints, in bit order.
+var mptcpEndpointFlags = []string{"signal", "subflow", "backup", "fullmesh", "implicit"}
+
+// mptcpEvents are the names iproute2 gives MPTCP events.
+var mptcpEvents = map[uint8]string{
+	1:  "CREATED",
+	2:  "ESTABLISHED",
+	3:  "CLOSED",
+	6:  "ANNOUNCED",
+	7:  "REMOVED",
+	10: "SF_ESTABLISHED",
+	11: "SF_CLOSED",
+	13: "SF_PRIO",
+	15: "LISTENER_CREATED",
+	16: "LISTENER_CLOSED",
+}
+
+// mptcpFamily returns the ID and multicast groups of the path manager.
+func mptcpFamily() (*netlink.GenlFamily, error) {
+	f, err := netlink.GenlFamilyGet(mptcpPMName)
+	if err == syscall.ENOENT {
+		return nil, fmt.Errorf("MPTCP is not supported by the kernel")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("looking up generic netlink family %s: %v", mptcpPMName, err)
+	}
+	return f, nil
+}
+
+// mptcpRequest sends the path manager cmd with attrs and returns the
+// attributes of the replies.
+func mptcpRequest(cmd uint8, flags int, attrs ...*nl.RtAttr) ([][]syscall.NetlinkRouteAttr, error) {
+	f, err := mptcpFamily()
+	if err != nil {
+		return nil, err
+	}
+	req := nl.NewNetlinkRequest(int(f.ID), flags)
+	req.AddData(&nl.Genlmsg{Command: cmd, Version: mptcpPMVersion})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var replies [][]syscall.NetlinkRouteAttr
+	for _, m := range msgs {
+		if len(m) < nl.SizeofGenlmsg {
+			return nil, fmt.Errorf("short generic netlink message")
+		}
+		a, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, a)
+	}
+	return replies, nil
+}
+
+// mptcpAttrs maps the attribute types in attrs, without the nested flag,
+// to their data.
+func mptcpAttrs(attrs []syscall.NetlinkRouteAttr) map[uint16][]byte {
+	m := make(map[uint16][]byte)
+	for _, a := range attrs {
+		m[a.Attr.Type&^unix.NLA_F_NESTED] = a.Value
+	}
+	return m
+}
+
+// mptcpEndpoint is an address of the path manager.
+type mptcpEndpoint struct {
+	ip      net.IP
+	port    uint16
+	id      uint8
+	flags   uint32
+	ifindex int32
+}
+
+// attr returns the MPTCP_PM_ATTR_ADDR attribute for e. The address is
+// left out if e.ip is nil.
+func (e *mptcpEndpoint) attr() *nl.RtAttr {
+	native := nl.NativeEndian()
+	a := nl.NewRtAttr(mptcpPMAttrAddr|unix.NLA_F_NESTED, nil)
+	if e.ip != nil {
+		if ip4 := e.ip.To4(); ip4 != nil {
+			nl.NewRtAttrChild(a, mptcpPMAddrAttrFamily, nl.Uint16Attr(unix.AF_INET))
+			nl.NewRtAttrChild(a, mptcpPMAddrAttrAddr4, ip4)
+		} else {
+			nl.NewRtAttrChild(a, mptcpPMAddrAttrFamily, nl.Uint16Attr(unix.AF_INET6))
+			nl.NewRtAttrChild(a, mptcpPMAddrAttrAddr6, e.ip.To16())
+		}
+	}
+	if e.id != 0 || e.ip == nil {
+		nl.NewRtAttrChild(a, mptcpPMAddrAttrID, nl.Uint8Attr(e.id))
+	}
+	if e.port != 0 {
+		nl.NewRtAttrChild(a, mptcpPMAddrAttrPort, nl.Uint16Attr(e.port))
+	}
+	if e.flags != 0 {
+		nl.NewRtAttrChild(a, mptcpPMAddrAttrFlags, nl.Uint32Attr(e.flags))
+	}
+	if e.ifindex != 0 {
+		b := make([]byte, 4)
+		native.PutUint32(b, uint32(e.ifindex))
+		nl.NewRtAttrChild(a, mptcpPMAddrAttrIfIdx, b)
+	}
+	return a
+}
+
+// parseMPTCPEndpoint decodes an MPTCP_PM_ATTR_ADDR attribute.
+func parseMPTCPEndpoint(b []byte) (*mptcpEndpoint, error) {
+	native := nl.NativeEndian()
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	var e mptcpEndpoint
+	for typ, v := range mptcpAttrs(attrs) {
+		switch {
+		case typ == mptcpPMAddrAttrAddr4 && len(v) == 4, typ == mptcpPMAddrAttrAddr6 && len(v) == 16:
+			e.ip = net.IP(v)
+		case typ == mptcpPMAddrAttrID && len(v) >= 1:
+			e.id = v[0]
+		case typ == mptcpPMAddrAttrPort && len(v) >= 2:
+			e.port = native.Uint16(v)
+		case typ == mptcpPMAddrAttrFlags && len(v) >= 4:
+			e.flags = native.Uint32(v)
+		case typ == mptcpPMAddrAttrIfIdx && len(v) >= 4:
+			e.ifindex = int32(native.Uint32(v))
+		}
+	}
+	return &e, nil
+}
+
+// String returns e as iproute2 shows it: "ADDR [port PORT] id ID FLAGS [dev
+// DEV]".
+func (e *mptcpEndpoint) String() string {
+	s := []string{e.ip.String()}
+	if e.port != 0 {
+		s = append(s, "port", fmt.Sprint(e.port))
+	}
+	s = append(s, "id", fmt.Sprint(e.id))
+	for i, f := range mptcpEndpointFlags {
+		if e.flags&(1<<uint(i)) != 0 {
+			s = append(s, f)
+		}
+	}
+	if e.ifindex != 0 {
+		name := fmt.Sprintf("if%d", e.ifindex)
+		if l, err := netlink.LinkByIndex(int(e.ifindex)); err == nil {
+			name = l.Attrs().Name
+		}
+		s = append(s, "dev", name)
+	}
+	return strings.Join(s, " ")
+}
+
+// mptcpEndpointAdd adds an endpoint: ADDR [port PORT] [dev DEV] [id ID]
+// [signal|subflow|backup|fullmesh]...
+func mptcpEndpointAdd() error {
+	ip, err := parseIP()
+	if err != nil {
+		return err
+	}
+	e := &mptcpEndpoint{ip: ip}
+	for cursor++; cursor < len(arg); cursor++ {
+		whatIWant = append([]string{"port", "dev", "id"}, mptcpEndpointFlags[:4]...)
+		switch arg[cursor] {
+		case "port":
+			var n uint64
+			n, err = parseUint(16)
+			e.port = uint16(n)
+		case "id":
+			var n uint64
+			n, err = parseUint(8)
+			e.id = uint8(n)
+		case "dev":
+			var l netlink.Link
+			if l, err = dev(); err == nil {
+				e.ifindex = int32(l.Attrs().Index)
+			}
+		case "signal":
+			e.flags |= 1 << 0
+		case "subflow":
+			e.flags |= 1 << 1
+		case "backup":
+			e.flags |= 1 << 2
+		case "fullmesh":
+			e.flags |= 1 << 3
+		default:
+			return usage()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := mptcpRequest(mptcpPMCmdAddAddr, unix.NLM_F_ACK, e.attr()); err != nil {
+		return fmt.Errorf("adding MPTCP endpoint %v failed: %v", ip, err)
+	}
+	return nil
+}
+
+// mptcpEndpointDel deletes an endpoint: id ID.
+func mptcpEndpointDel() error {
+	cursor++
+	whatIWant = []string{"id"}
+	if arg[cursor] != "id" {
+		return usage()
+	}
+	id, err := parseUint(8)
+	if err != nil {
+		return err
+	}
+	e := &mptcpEndpoint{id: uint8(id)}
+	if _, err := mptcpRequest(mptcpPMCmdDelAddr, unix.NLM_F_ACK, e.attr()); err != nil {
+		return fmt.Errorf("deleting MPTCP endpoint %d failed: %v", id, err)
+	}
+	return nil
+}
+
+// mptcpEndpointShow lists the endpoints.
+func mptcpEndpointShow(w io.Writer) error {
+	replies, err := mptcpRequest(mptcpPMCmdGetAddr, unix.NLM_F_DUMP)
+	if err != nil {
+		return fmt.Errorf("listing MPTCP endpoints: %v", err)
+	}
+	for _, r := range replies {
+		b, ok := mptcpAttrs(r)[mptcpPMAttrAddr]
+		if !ok {
+			continue
+		}
+		e, err := parseMPTCPEndpoint(b)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, e)
+	}
+	return nil
+}
+
+// mptcpLimitsSet sets the limits: [subflows N] [add_addr_accepted N].
+func mptcpLimitsSet() error {
+	var attrs []*nl.RtAttr
+	for cursor++; cursor < len(arg); cursor++ {
+		whatIWant = []string{"subflows", "add_addr_accepted"}
+		var typ int
+		switch arg[cursor] {
+		case "subflows":
+			typ = mptcpPMAttrSubflows
+		case "add_addr_accepted":
+			typ = mptcpPMAttrRcvAddAddrs
+		default:
+			return usage()
+		}
+		n, err := parseUint(32)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, nl.NewRtAttr(typ, nl.Uint32Attr(uint32(n))))
+	}
+	if len(attrs) == 0 {
+		return fmt.Errorf("mptcp limits set: no limits given")
+	}
+	if _, err := mptcpRequest(mptcpPMCmdSetLimits, unix.NLM_F_ACK, attrs...); err != nil {
+		return fmt.Errorf("setting MPTCP limits failed: %v", err)
+	}
+	return nil
+}
+
+// mptcpLimitsShow shows the limits as "add_addr_accepted N subflows N".
+func mptcpLimitsShow(w io.Writer) error {
+	replies, err := mptcpRequest(mptcpPMCmdGetLimits, 0)
+	if err != nil {
+		return fmt.Errorf("getting MPTCP limits: %v", err)
+	}
+	if len(replies) == 0 {
+		return fmt.Errorf("getting MPTCP limits: no reply")
+	}
+	m := mptcpAttrs(replies[0])
+	var s []string
+	for _, l := range []struct {
+		name string
+		typ  uint16
+	}{
+		{"add_addr_accepted", mptcpPMAttrRcvAddAddrs},
+		{"subflows", mptcpPMAttrSubflows},
+	} {
+		if v, ok := m[l.typ]; ok && len(v) >= 4 {
+			s = append(s, l.name, fmt.Sprint(nl.NativeEndian().Uint32(v)))
+		}
+	}
+	fmt.Fprintln(w, strings.Join(s, " "))
+	return nil
+}
+
+// mptcpSubscribe returns a socket that receives the path manager's events.
+func mptcpSubscribe() (*nl.NetlinkSocket, error) {
+	f, err := mptcpFamily()
+	if err != nil {
+		return nil, err
+	}
+	var group uint32
+	for _, g := range f.Groups {
+		if g.Name == mptcpPMEventsGrp {
+			group = g.ID
+		}
+	}
+	if group == 0 {
+		return nil, fmt.Errorf("the kernel has no MPTCP events")
+	}
+	s, err := nl.Subscribe(unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	// Group IDs can be more than the 32 that Subscribe takes.
+	if err := unix.SetsockoptInt(s.GetFd(), unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, int(group)); err != nil {
+		s.Close()
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	return s, nil
+}
+
+// formatMPTCPEvent formats event as iproute2 does: the event name and the
+// attributes it has, as in "[       CREATED] token=1a2b3c4d remid=0 ...".
+func formatMPTCPEvent(event uint8, attrs []syscall.NetlinkRouteAttr) string {
+	name, ok := mptcpEvents[event]
+	if !ok {
+		name = fmt.Sprintf("UNKNOWN %d", event)
+	}
+	s := []string{fmt.Sprintf("[%16s]", name)}
+	m := mptcpAttrs(attrs)
+	be := func(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) }
+	for _, a := range []struct {
+		typ    uint16
+		name   string
+		size   int
+		format func([]byte) string
+	}{
+		{mptcpAttrToken, "token", 4, func(b []byte) string { return fmt.Sprintf("%08x", nl.NativeEndian().Uint32(b)) }},
+		{mptcpAttrRemID, "remid", 1, func(b []byte) string { return fmt.Sprint(b[0]) }},
+		{mptcpAttrLocID, "locid", 1, func(b []byte) string { return fmt.Sprint(b[0]) }},
+		{mptcpAttrSaddr4, "saddr4", 4, func(b []byte) string { return net.IP(b).String() }},
+		{mptcpAttrSaddr6, "saddr6", 16, func(b []byte) string { return net.IP(b).String() }},
+		{mptcpAttrDaddr4, "daddr4", 4, func(b []byte) string { return net.IP(b).String() }},
+		{mptcpAttrDaddr6, "daddr6", 16, func(b []byte) string { return net.IP(b).String() }},
+		// Ports are in network byte order.
+		{mptcpAttrSport, "sport", 2, func(b []byte) string { return fmt.Sprint(be(b)) }},
+		{mptcpAttrDport, "dport", 2, func(b []byte) string { return fmt.Sprint(be(b)) }},
+		{mptcpAttrBackup, "backup", 1, func(b []byte) string { return fmt.Sprint(b[0]) }},
+		{mptcpAttrError, "error", 1, func(b []byte) string { return fmt.Sprint(b[0]) }},
+		{mptcpAttrIfIdx, "ifindex", 4, func(b []byte) string { return fmt.Sprint(int32(nl.NativeEndian().Uint32(b))) }},
+	} {
+		if v, ok := m[a.typ]; ok && len(v) >= a.size {
+			s = append(s, a.name+"="+a.format(v))
+		}
+	}
+	if v, ok := m[mptcpAttrServerSide]; ok && (len(v) == 0 || v[0] != 0) {
+		s = append(s, "server_side")
+	}
+	return strings.Join(s, " ")
+}
+
+// mptcpMonitor prints the events received on s, one per line, until
+// receiving fails.
+func mptcpMonitor(w io.Writer, s *nl.NetlinkSocket) error {
+	for {
+		msgs, err := s.Receive()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if len(m.Data) < nl.SizeofGenlmsg {
+				continue
+			}
+			attrs, err := nl.ParseRouteAttr(m.Data[nl.SizeofGenlmsg:])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, formatMPTCPEvent(m.Data[0], attrs))
+		}
+	}
+}
+
+func mptcpEndpointCmd() error {
+	cursor++
+	whatIWant = []string{"show", "add", "delete"}
+	if len(arg[cursor:]) == 0 {
+		return mptcpEndpointShow(os.Stdout)
+	}
+	switch one(arg[cursor], whatIWant) {
+	case "show":
+		return mptcpEndpointShow(os.Stdout)
+	case "add":
+		return mptcpEndpointAdd()
+	case "delete":
+		return mptcpEndpointDel()
+	}
+	return usage()
+}
+
+func mptcpLimitsCmd() error {
+	cursor++
+	whatIWant = []string{"show", "set"}
+	if len(arg[cursor:]) == 0 {
+		return mptcpLimitsShow(os.Stdout)
+	}
+	switch one(arg[cursor], whatIWant) {
+	case "show":
+		return mptcpLimitsShow(os.Stdout)
+	case "set":
+		return mptcpLimitsSet()
+	}
+	return usage()
+}
+
+func mptcp() error {
+	cursor++
+	whatIWant = []string{"endpoint", "limits", "monitor"}
+	switch one(arg[cursor], whatIWant) {
+	case "endpoint":
+		return mptcpEndpointCmd()
+	case "limits":
+		return mptcpLimitsCmd()
+	case "monitor":
+		s, err := mptcpSubscribe()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return mptcpMonitor(os.Stdout, s)
+	}
+	return usage()
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ipprotoMPTCP is IPPROTO_MPTCP.
+const ipprotoMPTCP = 262
+
+func ipMPTCP(t *testing.T, args string) {
+	t.Helper()
+	arg, cursor = append([]string{"mptcp"}, strings.Fields(args)...), 0
+	if err := mptcp(); err != nil {
+		t.Fatalf("ip mptcp %s = %v", args, err)
+	}
+}
+
+// mptcpConnect connects an MPTCP client to an MPTCP server on 127.0.0.1 and
+// has them send each other a message. It returns how to close them; the
+// listener stays open for the subflows to join.
+func mptcpConnect(t *testing.T) func() {
+	t.Helper()
+	l, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, ipprotoMPTCP)
+	if err != nil {
+		t.Skipf("no MPTCP sockets: %v", err)
+	}
+	fds := []int{l}
+	closeAll := func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+	fatal := func(err error) {
+		t.Helper()
+		closeAll()
+		t.Fatal(err)
+	}
+	if err := unix.Bind(l, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		fatal(err)
+	}
+	if err := unix.Listen(l, 4); err != nil {
+		fatal(err)
+	}
+	sa, err := unix.Getsockname(l)
+	if err != nil {
+		fatal(err)
+	}
+
+	c, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, ipprotoMPTCP)
+	if err != nil {
+		fatal(err)
+	}
+	fds = append(fds, c)
+	if err := unix.Connect(c, sa); err != nil {
+		fatal(err)
+	}
+	s, _, err := unix.Accept(l)
+	if err != nil {
+		fatal(err)
+	}
+	fds = append(fds, s)
+	for _, p := range [][2]int{{c, s}, {s, c}} {
+		if _, err := unix.Write(p[0], []byte("ping")); err != nil {
+			fatal(err)
+		}
+		b := make([]byte, 4)
+		if n, err := unix.Read(p[1], b); err != nil || string(b[:n]) != "ping" {
+			fatal(fmt.Errorf("read %q, %v, want ping", b[:n], err))
+		}
+	}
+	return closeAll
+}
+
+func TestMPTCP(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		if _, err := mptcpFamily(); err != nil {
+			t.Skip(err)
+		}
+		ipLink(t, "set lo up")
+
+		ipMPTCP(t, "limits set subflows 2 add_addr_accepted 1")
+		var b bytes.Buffer
+		if err := mptcpLimitsShow(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := b.String(), "add_addr_accepted 1 subflows 2\n"; got != want {
+			t.Errorf("mptcp limits show = %q, want %q", got, want)
+		}
+
+		ipMPTCP(t, "endpoint add 127.0.0.3 id 7 signal backup dev lo")
+		ipMPTCP(t, "endpoint add 127.0.0.2 id 5 subflow")
+		b.Reset()
+		if err := mptcpEndpointShow(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := b.String(), "127.0.0.2 id 5 subflow\n127.0.0.3 id 7 signal backup dev lo\n"; got != want {
+			t.Errorf("mptcp endpoint show = %q, want %q", got, want)
+		}
+		ipMPTCP(t, "endpoint del id 7")
+		b.Reset()
+		if err := mptcpEndpointShow(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := b.String(), "127.0.0.2 id 5 subflow\n"; got != want {
+			t.Errorf("mptcp endpoint show after del = %q, want %q", got, want)
+		}
+
+		// The client adds a subflow from 127.0.0.2, which both ends
+		// report.
+		s, err := mptcpSubscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		defer mptcpConnect(t)()
+		if err := s.SetReceiveTimeout(&unix.Timeval{Sec: 1}); err != nil {
+			t.Fatal(err)
+		}
+		b.Reset()
+		if err := mptcpMonitor(&b, s); err != syscall.EAGAIN {
+			t.Fatalf("mptcp monitor = %v, want EAGAIN after the timeout", err)
+		}
+		events := strings.Split(strings.TrimSpace(b.String()), "\n")
+		for _, want := range [][]string{
+			{"[         CREATED]", "saddr4=127.0.0.1", "daddr4=127.0.0.1"},
+			{"[         CREATED]", "server_side"},
+			{"[     ESTABLISHED]", "token="},
+			{"[     ESTABLISHED]", "server_side"},
+			{"[  SF_ESTABLISHED]", "saddr4=127.0.0.2", "daddr4=127.0.0.1", "locid=5", "remid=0"},
+			{"[  SF_ESTABLISHED]", "saddr4=127.0.0.1", "daddr4=127.0.0.2", "locid=0", "remid=5"},
+		} {
+			found := false
+			for _, e := range events {
+				found = true
+				for _, w := range want {
+					found = found && strings.Contains(e, w)
+				}
+				if found {
+					break
+				}
+			}
+			if !found {
+				t.Errorf("mptcp monitor = %q, want an event with %q", events, want)
+			}
+		}
+
+		for _, bad := range []string{
+			"endpoint add 10.0.0.0.1",
+			"endpoint add 127.0.0.4 port x",
+			"endpoint add 127.0.0.4 id 256",
+			"endpoint add 127.0.0.4 dev nosuchdev",
+			"endpoint add 127.0.0.4 wrong",
+			"endpoint del 127.0.0.2",
+			"endpoint del id 99",
+			"limits set",
+			"limits set subflows",
+			"limits set subflows 2 bogus 3",
+			"limits set subflows 100",
+			"bogus",
+		} {
+			arg, cursor = append([]string{"mptcp"}, strings.Fields(bad)...), 0
+			func() {
+				// Missing arguments panic, as in main.
+				defer func() { recover() }()
+				if err := mptcp(); err == nil {
+					t.Errorf("ip mptcp %s = nil, want error", bad)
+				}
+			}()
+		}
+	})
+}
+
+func TestFormatMPTCPEvent(t *testing.T) {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(mptcpAttrToken, nl.Uint32Attr(0xdeadbeef)),
+		nl.NewRtAttr(mptcpAttrSaddr6, []byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}),
+		nl.NewRtAttr(mptcpAttrDport, []byte{0x1f, 0x90}),
+		nl.NewRtAttr(mptcpAttrServerSide, nil),
+		nl.NewRtAttr(mptcpAttrLocID, nil),
+	}
+	var b []byte
+	for _, a := range attrs {
+		b = append(b, a.Serialize()...)
+	}
+	parsed, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for event, want := range map[uint8]string{
+		1:  "[         CREATED] token=deadbeef saddr6=2001:db8::1 dport=8080 server_side",
+		16: "[ LISTENER_CLOSED] token=deadbeef saddr6=2001:db8::1 dport=8080 server_side",
+		99: "[      UNKNOWN 99] token=deadbeef saddr6=2001:db8::1 dport=8080 server_side",
+	} {
+		if got := formatMPTCPEvent(event, parsed); got != want {
+			t.Errorf("formatMPTCPEvent(%d) = %q, want %q", event, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// nsDir is where named network namespaces are bind-mounted, as with iproute2.
+var nsDir = "/run/netns"
+
+func nsPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid namespace name %q", name)
+	}
+	return filepath.Join(nsDir, name), nil
+}
+
+// threadNetNS is the network namespace file of the calling thread.
+func threadNetNS() string {
+	return fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+}
+
+// netnsAdd creates a new network namespace and pins it by bind-mounting it to
+// nsDir/name.
+func netnsAdd(name string) error {
+	p, err := nsPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(nsDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("creating %s: %v", p, err)
+	}
+	f.Close()
+
+	// Namespaces are per thread. Do the unshare on a locked thread and
+	// restore the original namespace before unlocking it again.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := os.Open(threadNetNS())
+	if err != nil {
+		os.Remove(p)
+		return err
+	}
+	defer orig.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		os.Remove(p)
+		return fmt.Errorf("unshare(CLONE_NEWNET): %v", err)
+	}
+	mntErr := unix.Mount(threadNetNS(), p, "none", unix.MS_BIND, "")
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		// We can't go back. Don't let this thread be reused.
+		panic(fmt.Sprintf("restoring network namespace: %v", err))
+	}
+	if mntErr != nil {
+		os.Remove(p)
+		return fmt.Errorf("bind mounting %s: %v", p, mntErr)
+	}
+	return nil
+}
+
+// netnsDel unmounts and removes a named network namespace.
+func netnsDel(name string) error {
+	p, err := nsPath(name)
+	if err != nil {
+		return err
+	}
+	if err := unix.Unmount(p, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("unmounting %s: %v", p, err)
+	}
+	return os.Remove(p)
+}
+
+// netnsList prints the names of all namespaces in nsDir.
+func netnsList(w io.Writer) error {
+	fis, err := ioutil.ReadDir(nsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		fmt.Fprintln(w, fi.Name())
+	}
+	return nil
+}
+
+// netnsExec runs the command given by args in the named network namespace.
+func netnsExec(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("netns exec: no command given")
+	}
+	p, err := nsPath(name)
+	if err != nil {
+		return err
+	}
+	ns, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	// The child inherits the namespace of the thread that forks it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := os.Open(threadNetNS())
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("setns(%s): %v", p, err)
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	runErr := c.Run()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		panic(fmt.Sprintf("restoring network namespace: %v", err))
+	}
+	return runErr
+}
+
+func netns() error {
+	cursor++
+	whatIWant = []string{"add", "delete", "list", "exec"}
+	if len(arg[cursor:]) == 0 {
+		return netnsList(os.Stdout)
+	}
+
+	switch one(arg[cursor], whatIWant) {
+	case "add":
+		cursor++
+		whatIWant = []string{"namespace name"}
+		return netnsAdd(arg[cursor])
+	case "delete":
+		cursor++
+		whatIWant = []string{"namespace name"}
+		return netnsDel(arg[cursor])
+	case "list":
+		return netnsList(os.Stdout)
+	case "exec":
+		cursor++
+		whatIWant = []string{"namespace name"}
+		name := arg[cursor]
+		return netnsExec(name, arg[cursor+1:], os.Stdin, os.Stdout, os.Stderr)
+	}
+	return usage()
+}
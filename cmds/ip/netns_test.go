@@ -0,0 +1,96 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNetnsPath(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", "../x"} {
+		if _, err := nsPath(name); err == nil {
+			t.Errorf("nsPath(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestNetns(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, not root")
+	}
+
+	dir, err := ioutil.TempDir("", "ip-netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { nsDir = old }(nsDir)
+	nsDir = dir
+
+	self, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"blue", "red"} {
+		if err := netnsAdd(name); err != nil {
+			t.Fatalf("netnsAdd(%q) = %v", name, err)
+		}
+	}
+	if err := netnsAdd("blue"); err == nil {
+		t.Errorf("netnsAdd(blue) twice = nil, want error")
+	}
+
+	var list bytes.Buffer
+	if err := netnsList(&list); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list.String(), "blue\nred\n"; got != want {
+		t.Errorf("netnsList = %q, want %q", got, want)
+	}
+
+	// The namespace we're in must not have changed.
+	if now, err := os.Readlink("/proc/self/ns/net"); err != nil || now != self {
+		t.Errorf("own namespace changed from %s to %s (%v)", self, now, err)
+	}
+
+	var blue, red bytes.Buffer
+	if err := netnsExec("blue", []string{"readlink", "/proc/self/ns/net"}, nil, &blue, os.Stderr); err != nil {
+		t.Fatalf("netnsExec(blue) = %v", err)
+	}
+	if err := netnsExec("red", []string{"readlink", "/proc/self/ns/net"}, nil, &red, os.Stderr); err != nil {
+		t.Fatalf("netnsExec(red) = %v", err)
+	}
+	b, r := strings.TrimSpace(blue.String()), strings.TrimSpace(red.String())
+	if b == self || r == self || b == r {
+		t.Errorf("namespaces not distinct: self %s, blue %s, red %s", self, b, r)
+	}
+
+	// A fresh namespace only has a loopback interface.
+	var links bytes.Buffer
+	if err := netnsExec("blue", []string{"cat", "/proc/net/dev"}, nil, &links, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(links.String(), "\n"); got != 3 {
+		t.Errorf("/proc/net/dev in new namespace has %d lines, want 3:\n%s", got, links.String())
+	}
+
+	for _, name := range []string{"blue", "red"} {
+		if err := netnsDel(name); err != nil {
+			t.Errorf("netnsDel(%q) = %v", name, err)
+		}
+	}
+	list.Reset()
+	if err := netnsList(&list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 0 {
+		t.Errorf("netnsList after delete = %q, want empty", list.String())
+	}
+}
@@ -13,21 +13,32 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-func showLinks(w io.Writer, withAddresses bool) error {
+// linkNames returns all links and their names by index.
+func linkNames() ([]netlink.Link, map[int]string, error) {
 	ifaces, err := netlink.LinkList()
 	if err != nil {
-		return fmt.Errorf("Can't enumerate interfaces? %v", err)
+		return nil, nil, fmt.Errorf("Can't enumerate interfaces? %v", err)
 	}
-
+	names := make(map[int]string)
 	for _, v := range ifaces {
-		l := v.Attrs()
-
-		fmt.Fprintf(w, "%d: %s: <%s> mtu %d state %s\n", l.Index, l.Name,
-			strings.Replace(strings.ToUpper(fmt.Sprintf("%s", l.Flags)), "|", ",", -1),
-			l.MTU, strings.ToUpper(l.OperState.String()))
+		names[v.Attrs().Index] = v.Attrs().Name
+	}
+	return ifaces, names, nil
+}
 
-		fmt.Fprintf(w, "    link/%s %s\n", l.EncapType, l.HardwareAddr)
+// showLinks shows all links or, if linkType is not empty, the links of that
+// type, e.g. "bridge".
+func showLinks(w io.Writer, withAddresses bool, linkType string) error {
+	ifaces, names, err := linkNames()
+	if err != nil {
+		return err
+	}
 
+	for _, v := range ifaces {
+		if linkType != "" && v.Type() != linkType {
+			continue
+		}
+		writeLink(w, v, names)
 		if withAddresses {
 			showLinkAddresses(w, v)
 		}
@@ -35,6 +46,51 @@ func showLinks(w io.Writer, withAddresses bool) error {
 	return nil
 }
 
+// showLink shows link, as ip link show DEV does.
+func showLink(w io.Writer, link netlink.Link) error {
+	_, names, err := linkNames()
+	if err != nil {
+		return err
+	}
+	writeLink(w, link, names)
+	return nil
+}
+
+// writeLink writes v, whose master and parent are named by names.
+func writeLink(w io.Writer, v netlink.Link, names map[int]string) {
+	l := v.Attrs()
+
+	var master string
+	if l.MasterIndex != 0 {
+		master = fmt.Sprintf(" master %s", names[l.MasterIndex])
+	}
+	name := l.Name
+	if l.ParentIndex != 0 {
+		parent, ok := names[l.ParentIndex]
+		if !ok {
+			// The parent is in another namespace.
+			parent = fmt.Sprintf("if%d", l.ParentIndex)
+		}
+		name += "@" + parent
+	}
+	fmt.Fprintf(w, "%d: %s: <%s> mtu %d%s state %s\n", l.Index, name,
+		strings.Replace(strings.ToUpper(fmt.Sprintf("%s", l.Flags)), "|", ",", -1),
+		l.MTU, master, strings.ToUpper(l.OperState.String()))
+
+	fmt.Fprintf(w, "    link/%s %s\n", l.EncapType, l.HardwareAddr)
+	switch v := v.(type) {
+	case *netlink.Vlan:
+		fmt.Fprintf(w, "    vlan id %d\n", v.VlanId)
+	case *netlink.Macvlan:
+		fmt.Fprintf(w, "    macvlan mode %s\n", macvlanModeName(v.Mode))
+	case *netlink.IPVlan:
+		fmt.Fprintf(w, "    ipvlan mode %s\n", ipvlanModeName(v.Mode))
+	case *netlink.Vrf:
+		fmt.Fprintf(w, "    vrf table %d\n", v.Table)
+	}
+	showVfs(w, l.Vfs)
+}
+
 func showLinkAddresses(w io.Writer, link netlink.Link) error {
 	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
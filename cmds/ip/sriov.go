@@ -0,0 +1,217 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// sysClassNet has a directory for each network device. Tests replace
+	// it.
+	sysClassNet = "/sys/class/net"
+
+	// The VF setters change a VF of a physical function. Tests replace
+	// them.
+	setVfHardwareAddr = netlink.LinkSetVfHardwareAddr
+	setVfVlan         = netlink.LinkSetVfVlan
+	setVfTxRate       = netlink.LinkSetVfTxRate
+	setVfLinkState    = linkSetVfLinkState
+
+	vfLinkStates = map[string]uint32{
+		"auto":    nl.IFLA_VF_LINK_STATE_AUTO,
+		"enable":  nl.IFLA_VF_LINK_STATE_ENABLE,
+		"disable": nl.IFLA_VF_LINK_STATE_DISABLE,
+	}
+)
+
+// vfLinkStateName returns the name of state, as ip link show prints it.
+func vfLinkStateName(state uint32) string {
+	for name, s := range vfLinkStates {
+		if s == state {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", state)
+}
+
+// linkSetVfLinkState sets the link state of VF vf of pf with RTM_SETLINK.
+// netlink has no setter for it, hence the request is built here.
+func linkSetVfLinkState(pf netlink.Link, vf int, state uint32) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(pf.Attrs().Index)
+	req.AddData(msg)
+
+	data := nl.NewRtAttr(unix.IFLA_VFINFO_LIST, nil)
+	info := nl.NewRtAttrChild(data, nl.IFLA_VF_INFO, nil)
+	ls := nl.VfLinkState{Vf: uint32(vf), LinkState: state}
+	nl.NewRtAttrChild(info, nl.IFLA_VF_LINK_STATE, ls.Serialize())
+	req.AddData(data)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// readSriovFile returns the number in file of the sysfs device directory of
+// pf, such as sriov_numvfs.
+func readSriovFile(pf, file string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(sysClassNet, pf, "device", file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// setNumVfs makes pf have n VFs. The kernel only changes a nonzero number
+// of VFs to 0, so other changes go by way of 0.
+func setNumVfs(pf string, n int) error {
+	if total, err := readSriovFile(pf, "sriov_totalvfs"); err != nil {
+		return fmt.Errorf("%v does not support SR-IOV: %v", pf, err)
+	} else if n < 0 || n > total {
+		return fmt.Errorf("%v supports 0-%d VFs, not %d", pf, total, n)
+	}
+	cur, err := readSriovFile(pf, "sriov_numvfs")
+	if err != nil {
+		return err
+	}
+	if cur == n {
+		return nil
+	}
+	f := filepath.Join(sysClassNet, pf, "device", "sriov_numvfs")
+	if cur != 0 && n != 0 {
+		if err := ioutil.WriteFile(f, []byte("0"), 0); err != nil {
+			return fmt.Errorf("removing VFs of %v failed: %v", pf, err)
+		}
+	}
+	if err := ioutil.WriteFile(f, []byte(strconv.Itoa(n)), 0); err != nil {
+		return fmt.Errorf("setting %d VFs on %v failed: %v", n, pf, err)
+	}
+	return nil
+}
+
+// numvfs sets the number of VFs of pf. The rest of the command line is the
+// number.
+func numvfs(pf netlink.Link) error {
+	cursor++
+	whatIWant = []string{"number of VFs"}
+	n, err := strconv.Atoi(arg[cursor])
+	if err != nil {
+		return fmt.Errorf("number of VFs %q: %v", arg[cursor], err)
+	}
+	return setNumVfs(pf.Attrs().Name, n)
+}
+
+// vfset changes a VF of pf. The rest of the command line is "VF [mac ADDR]
+// [vlan VID] [rate MBPS] [state auto|enable|disable]", with at least one
+// change.
+func vfset(pf netlink.Link) error {
+	cursor++
+	whatIWant = []string{"VF number"}
+	vf, err := strconv.Atoi(arg[cursor])
+	if err != nil || vf < 0 {
+		return fmt.Errorf("VF number %q is not a number", arg[cursor])
+	}
+	name := pf.Attrs().Name
+
+	var changes []func() error
+	for cursor++; cursor < len(arg) || len(changes) == 0; cursor++ {
+		whatIWant = []string{"mac", "vlan", "rate", "state"}
+		opt := arg[cursor]
+		cursor++
+		switch opt {
+		case "mac":
+			whatIWant = []string{"MAC address"}
+			mac, err := net.ParseMAC(arg[cursor])
+			if err != nil {
+				return fmt.Errorf("VF MAC address %q: %v", arg[cursor], err)
+			}
+			changes = append(changes, func() error {
+				if err := setVfHardwareAddr(pf, vf, mac); err != nil {
+					return fmt.Errorf("setting MAC address of VF %d of %v failed: %v", vf, name, err)
+				}
+				return nil
+			})
+		case "vlan":
+			whatIWant = []string{"VLAN id"}
+			vid, err := strconv.Atoi(arg[cursor])
+			if err != nil || vid < 0 || vid > 4095 {
+				return fmt.Errorf("VF VLAN id %q is not in 0-4095", arg[cursor])
+			}
+			changes = append(changes, func() error {
+				if err := setVfVlan(pf, vf, vid); err != nil {
+					return fmt.Errorf("setting VLAN of VF %d of %v failed: %v", vf, name, err)
+				}
+				return nil
+			})
+		case "rate":
+			whatIWant = []string{"rate in Mbps"}
+			rate, err := strconv.ParseUint(arg[cursor], 10, 32)
+			if err != nil {
+				return fmt.Errorf("VF rate %q: %v", arg[cursor], err)
+			}
+			changes = append(changes, func() error {
+				if err := setVfTxRate(pf, vf, int(rate)); err != nil {
+					return fmt.Errorf("setting rate of VF %d of %v failed: %v", vf, name, err)
+				}
+				return nil
+			})
+		case "state":
+			whatIWant = []string{"auto", "enable", "disable"}
+			state, ok := vfLinkStates[arg[cursor]]
+			if !ok {
+				return usage()
+			}
+			changes = append(changes, func() error {
+				if err := setVfLinkState(pf, vf, state); err != nil {
+					return fmt.Errorf("setting link state of VF %d of %v failed: %v", vf, name, err)
+				}
+				return nil
+			})
+		default:
+			cursor--
+			return usage()
+		}
+	}
+
+	// Check the whole command line before changing anything.
+	for _, change := range changes {
+		if err := change(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// showVfs shows the VFs of a physical function.
+func showVfs(w io.Writer, vfs []netlink.VfInfo) {
+	for _, vf := range vfs {
+		fmt.Fprintf(w, "    vf %d link/ether %s", vf.ID, vf.Mac)
+		if vf.Vlan != 0 {
+			fmt.Fprintf(w, ", vlan %d", vf.Vlan)
+			if vf.Qos != 0 {
+				fmt.Fprintf(w, ", qos %d", vf.Qos)
+			}
+		}
+		if vf.TxRate != 0 {
+			fmt.Fprintf(w, ", tx rate %d (Mbps)", vf.TxRate)
+		}
+		spoofchk := "off"
+		if vf.Spoofchk {
+			spoofchk = "on"
+		}
+		fmt.Fprintf(w, ", spoof checking %s, link-state %s\n", spoofchk, vfLinkStateName(vf.LinkState))
+	}
+}
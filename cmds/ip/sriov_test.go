@@ -0,0 +1,185 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// fakeSysfs makes a sysfs device directory for pf with total and num VFs,
+// and returns the path of its sriov_numvfs.
+func fakeSysfs(t *testing.T, pf string, total, num int) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysClassNet = dir
+	dev := filepath.Join(dir, pf, "device")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dev, "sriov_totalvfs"), []byte(fmt.Sprintf("%d\n", total)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dev, "sriov_numvfs")
+	if err := ioutil.WriteFile(f, []byte(fmt.Sprintf("%d\n", num)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSetNumVfs(t *testing.T) {
+	defer func(d string) { sysClassNet = d }(sysClassNet)
+	for _, tt := range []struct {
+		name    string
+		num, n  int
+		want    string
+		wantErr bool
+	}{
+		{name: "enable", num: 0, n: 4, want: "4"},
+		{name: "disable", num: 4, n: 0, want: "0"},
+		// Writing 0 first is not seen in a file, only in the result.
+		{name: "change", num: 4, n: 2, want: "2"},
+		{name: "same", num: 4, n: 4, want: "4\n"},
+		{name: "too many", num: 0, n: 9, want: "0\n", wantErr: true},
+		{name: "negative", num: 0, n: -1, want: "0\n", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := fakeSysfs(t, "pf0", 8, tt.num)
+			defer os.RemoveAll(sysClassNet)
+			if err := setNumVfs("pf0", tt.n); (err != nil) != tt.wantErr {
+				t.Errorf("setNumVfs(pf0, %d) = %v, want error %t", tt.n, err, tt.wantErr)
+			}
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("sriov_numvfs = %q, want %q", b, tt.want)
+			}
+		})
+	}
+
+	sysClassNet = "/nonexistent"
+	if err := setNumVfs("pf0", 1); err == nil {
+		t.Errorf("setNumVfs without SR-IOV = nil, want error")
+	}
+}
+
+func TestShowVfs(t *testing.T) {
+	var b bytes.Buffer
+	showVfs(&b, []netlink.VfInfo{
+		{ID: 0, Mac: net.HardwareAddr{2, 0, 0, 0, 0, 1}, Spoofchk: true},
+		{ID: 1, Mac: net.HardwareAddr{2, 0, 0, 0, 0, 2}, Vlan: 100, Qos: 3, TxRate: 1000, LinkState: nl.IFLA_VF_LINK_STATE_DISABLE},
+	})
+	want := "    vf 0 link/ether 02:00:00:00:00:01, spoof checking on, link-state auto\n" +
+		"    vf 1 link/ether 02:00:00:00:00:02, vlan 100, qos 3, tx rate 1000 (Mbps), spoof checking off, link-state disable\n"
+	if b.String() != want {
+		t.Errorf("showVfs = %q, want %q", b.String(), want)
+	}
+}
+
+// vfCalls records the changes the VF setters are asked to make.
+type vfCalls []string
+
+func (c *vfCalls) fake() {
+	setVfHardwareAddr = func(l netlink.Link, vf int, mac net.HardwareAddr) error {
+		*c = append(*c, fmt.Sprintf("%s vf %d mac %s", l.Attrs().Name, vf, mac))
+		return nil
+	}
+	setVfVlan = func(l netlink.Link, vf, vlan int) error {
+		*c = append(*c, fmt.Sprintf("%s vf %d vlan %d", l.Attrs().Name, vf, vlan))
+		return nil
+	}
+	setVfTxRate = func(l netlink.Link, vf, rate int) error {
+		*c = append(*c, fmt.Sprintf("%s vf %d rate %d", l.Attrs().Name, vf, rate))
+		return nil
+	}
+	setVfLinkState = func(l netlink.Link, vf int, state uint32) error {
+		*c = append(*c, fmt.Sprintf("%s vf %d state %s", l.Attrs().Name, vf, vfLinkStateName(state)))
+		return nil
+	}
+}
+
+func TestSriov(t *testing.T) {
+	defer func(d string) { sysClassNet = d }(sysClassNet)
+	oldMAC, oldVlan, oldRate, oldState := setVfHardwareAddr, setVfVlan, setVfTxRate, setVfLinkState
+	defer func() {
+		setVfHardwareAddr, setVfVlan, setVfTxRate, setVfLinkState = oldMAC, oldVlan, oldRate, oldState
+	}()
+
+	testutil.InNetNS(t, func() {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "pf0"}, PeerName: "pf0peer"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatal(err)
+		}
+		f := fakeSysfs(t, "pf0", 8, 0)
+		defer os.RemoveAll(sysClassNet)
+
+		ipLink(t, "set pf0 numvfs 2")
+		if b, err := ioutil.ReadFile(f); err != nil || string(b) != "2" {
+			t.Errorf("sriov_numvfs = %q, %v, want 2", b, err)
+		}
+
+		var calls vfCalls
+		calls.fake()
+		ipLink(t, "set pf0 vf 1 mac 02:00:00:00:00:42")
+		ipLink(t, "set dev pf0 vf 0 vlan 100 rate 500 state disable")
+		want := vfCalls{
+			"pf0 vf 1 mac 02:00:00:00:00:42",
+			"pf0 vf 0 vlan 100",
+			"pf0 vf 0 rate 500",
+			"pf0 vf 0 state disable",
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("VF changes = %q, want %q", calls, want)
+		}
+
+		calls = nil
+		for _, bad := range []string{
+			"link set pf0 vf x mac 02:00:00:00:00:42",
+			"link set pf0 vf 0 mac 02:00",
+			"link set pf0 vf 0 vlan 4096",
+			"link set pf0 vf 0 rate -1",
+			"link set pf0 vf 0 state up",
+			"link set pf0 vf 0 vlan 1 spoofchk on",
+			"link set pf0 numvfs 9",
+		} {
+			arg, cursor = strings.Fields(bad), 0
+			if err := link(); err == nil {
+				t.Errorf("ip %s = nil, want error", bad)
+			}
+		}
+		if len(calls) != 0 {
+			t.Errorf("bad commands made VF changes %q, want none", calls)
+		}
+
+		// A veth has no VFs, but is shown alone.
+		var b bytes.Buffer
+		l, err := netlink.LinkByName("pf0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := showLink(&b, l); err != nil {
+			t.Fatal(err)
+		}
+		if s := b.String(); !strings.Contains(s, ": pf0@pf0peer: ") || strings.Contains(s, ": lo: ") {
+			t.Errorf("show pf0 = %q, want only pf0", s)
+		}
+	})
+}
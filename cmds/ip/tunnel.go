@@ -0,0 +1,210 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+)
+
+// tunnelModes are the modes of "ip tunnel", which are also link types.
+var tunnelModes = []string{"gre", "ipip", "sit"}
+
+// parseIP parses the address after a keyword.
+func parseIP() (net.IP, error) {
+	cursor++
+	whatIWant = []string{"IP address"}
+	ip := net.ParseIP(arg[cursor])
+	if ip == nil {
+		return nil, fmt.Errorf("%v %q: not an IP address", arg[cursor-1], arg[cursor])
+	}
+	return ip, nil
+}
+
+// parseUint parses the unsigned number of at most bits bits after a
+// keyword.
+func parseUint(bits int) (uint64, error) {
+	cursor++
+	whatIWant = []string{"number"}
+	n, err := strconv.ParseUint(arg[cursor], 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("%v %q: %v", arg[cursor-1], arg[cursor], err)
+	}
+	return n, nil
+}
+
+// tunneladd adds an IPv4 tunnel:
+// NAME mode {gre|ipip|sit} [remote IP] [local IP] [ttl TTL] [dev DEV].
+func tunneladd() error {
+	cursor++
+	whatIWant = []string{"name", "tunnel name"}
+	if arg[cursor] == "name" {
+		cursor++
+	}
+	whatIWant = []string{"tunnel name"}
+	attrs := netlink.LinkAttrs{Name: arg[cursor]}
+
+	mode := "gre"
+	var local, remote net.IP
+	var ttl uint8
+	var devIndex uint32
+	for cursor++; cursor < len(arg); cursor++ {
+		whatIWant = []string{"mode", "remote", "local", "ttl", "dev"}
+		var err error
+		switch arg[cursor] {
+		case "mode":
+			cursor++
+			whatIWant = tunnelModes
+			if mode = one(arg[cursor], tunnelModes); mode == "" {
+				return usage()
+			}
+		case "remote":
+			remote, err = parseIP()
+		case "local":
+			local, err = parseIP()
+		case "ttl":
+			var n uint64
+			n, err = parseUint(8)
+			ttl = uint8(n)
+		case "dev":
+			var l netlink.Link
+			if l, err = dev(); err == nil {
+				devIndex = uint32(l.Attrs().Index)
+			}
+		default:
+			return usage()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, ip := range []net.IP{local, remote} {
+		if ip != nil && ip.To4() == nil {
+			return fmt.Errorf("tunnel mode %v: %v is not an IPv4 address", mode, ip)
+		}
+	}
+
+	// Path MTU discovery is on, as in iproute2: the kernel refuses a fixed
+	// TTL without it.
+	var l netlink.Link
+	switch mode {
+	case "gre":
+		if local == nil {
+			// netlink.Gretun takes a tunnel without a local address
+			// for ip6gre.
+			local = net.IPv4zero
+		}
+		l = &netlink.Gretun{LinkAttrs: attrs, Local: local, Remote: remote, Ttl: ttl, Link: devIndex, PMtuDisc: 1}
+	case "ipip":
+		l = &netlink.Iptun{LinkAttrs: attrs, Local: local, Remote: remote, Ttl: ttl, Link: devIndex, PMtuDisc: 1}
+	case "sit":
+		l = &netlink.Sittun{LinkAttrs: attrs, Local: local, Remote: remote, Ttl: ttl, Link: devIndex, PMtuDisc: 1}
+	}
+	if err := netlink.LinkAdd(l); err != nil {
+		return fmt.Errorf("adding %v tunnel %v failed: %v", mode, attrs.Name, err)
+	}
+	return nil
+}
+
+func tunnelshow() error {
+	for _, t := range tunnelModes {
+		if err := showLinks(os.Stdout, false, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tunnel() error {
+	cursor++
+	if len(arg[cursor:]) == 0 {
+		return tunnelshow()
+	}
+
+	whatIWant = []string{"show", "add", "delete"}
+	switch one(arg[cursor], whatIWant) {
+	case "show":
+		return tunnelshow()
+	case "add":
+		return tunneladd()
+	case "delete":
+		return linkdel()
+	}
+	return usage()
+}
+
+// vxlanadd adds VXLAN name. The rest of the command line is "id VNI
+// [remote IP] [local IP] [group IP] [dev DEV] [dstport PORT] [nolearning]".
+func vxlanadd(name string) error {
+	cursor++
+	whatIWant = []string{"id"}
+	if arg[cursor] != "id" {
+		return usage()
+	}
+	vni, err := parseUint(24)
+	if err != nil {
+		return err
+	}
+	// Without dstport, the kernel uses the pre-IANA port 8472, as in
+	// iproute2.
+	v := &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: name}, VxlanId: int(vni), Learning: true}
+
+	var remote, group net.IP
+	for cursor++; cursor < len(arg); cursor++ {
+		whatIWant = []string{"remote", "local", "group", "dev", "dstport", "nolearning"}
+		switch arg[cursor] {
+		case "remote":
+			remote, err = parseIP()
+		case "local":
+			v.SrcAddr, err = parseIP()
+		case "group":
+			group, err = parseIP()
+		case "dev":
+			var l netlink.Link
+			if l, err = dev(); err == nil {
+				v.VtepDevIndex = l.Attrs().Index
+			}
+		case "dstport":
+			var port uint64
+			port, err = parseUint(16)
+			v.Port = int(port)
+		case "nolearning":
+			v.Learning = false
+		default:
+			return usage()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Both are IFLA_VXLAN_GROUP to the kernel.
+	switch {
+	case remote != nil && group != nil:
+		return fmt.Errorf("VXLAN %v: remote and group are mutually exclusive", name)
+	case remote != nil:
+		if remote.IsMulticast() {
+			return fmt.Errorf("VXLAN %v: remote %v is a multicast address; use group", name, remote)
+		}
+		v.Group = remote
+	case group != nil:
+		if !group.IsMulticast() {
+			return fmt.Errorf("VXLAN %v: group %v is not a multicast address", name, group)
+		}
+		if v.VtepDevIndex == 0 {
+			return fmt.Errorf("VXLAN %v: group %v needs a dev", name, group)
+		}
+		v.Group = group
+	}
+
+	if err := netlink.LinkAdd(v); err != nil {
+		return fmt.Errorf("adding VXLAN %v failed: %v", name, err)
+	}
+	return nil
+}
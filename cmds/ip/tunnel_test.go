@@ -0,0 +1,233 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// peerNetNS creates a second network namespace while in one from InNetNS.
+// It returns the namespace and a function that runs f in it.
+func peerNetNS(t *testing.T) (*os.File, func(f func())) {
+	t.Helper()
+	here, err := os.Open(threadNetNS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Fatal(err)
+	}
+	there, err := os.Open(threadNetNS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setns(int(here.Fd()), unix.CLONE_NEWNET); err != nil {
+		t.Fatal(err)
+	}
+	return there, func(f func()) {
+		if err := unix.Setns(int(there.Fd()), unix.CLONE_NEWNET); err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Setns(int(here.Fd()), unix.CLONE_NEWNET)
+		f()
+	}
+}
+
+func addrUp(t *testing.T, name, addr string) {
+	t.Helper()
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := netlink.ParseAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(l, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tunnelPeers connects the namespace of InNetNS, at 10.1.0.1 on veth0a, to
+// a new one, at 10.1.0.2 on veth0b, and returns the runner of the new one.
+func tunnelPeers(t *testing.T) func(f func()) {
+	t.Helper()
+	ns, inPeer := peerNetNS(t)
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0a"}, PeerName: "veth0b"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := netlink.LinkByName("veth0b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	addrUp(t, "veth0a", "10.1.0.1/24")
+	inPeer(func() { addrUp(t, "veth0b", "10.1.0.2/24") })
+	return inPeer
+}
+
+// ipOrSkip runs "ip args", and skips the test if the kernel does not
+// support the link type.
+func ipOrSkip(t *testing.T, args string) {
+	t.Helper()
+	arg, cursor = strings.Fields(args), 0
+	var err error
+	switch arg[0] {
+	case "link":
+		err = link()
+	case "tunnel":
+		err = tunnel()
+	}
+	if err != nil && strings.Contains(err.Error(), "not supported") {
+		t.Skipf("ip %s: %v", args, err)
+	}
+	if err != nil {
+		t.Fatalf("ip %s = %v", args, err)
+	}
+}
+
+// sendThrough checks that UDP from 192.168.42.1 reaches the peer at
+// 192.168.42.2, that is through the tunnel.
+func sendThrough(t *testing.T, inPeer func(func())) {
+	t.Helper()
+	var conn *net.UDPConn
+	inPeer(func() {
+		var err error
+		if conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(192, 168, 42, 2), Port: 9999}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer conn.Close()
+
+	msg := []byte("u-root tunnel test")
+	buf := make([]byte, 1500)
+	// The first packets may be lost to neighbour resolution.
+	for i := 0; i < 20; i++ {
+		c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(192, 168, 42, 2), Port: 9999})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write(msg)
+		c.Close()
+
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(buf[:n], msg) || !from.IP.Equal(net.IPv4(192, 168, 42, 1)) {
+			t.Fatalf("got %q from %v, want %q from 192.168.42.1", buf[:n], from, msg)
+		}
+		return
+	}
+	t.Fatalf("nothing went through the tunnel")
+}
+
+func TestVxlan(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		inPeer := tunnelPeers(t)
+		ipOrSkip(t, "link add vx0 type vxlan id 42 remote 10.1.0.2 local 10.1.0.1 dev veth0a dstport 4789")
+		inPeer(func() {
+			ipOrSkip(t, "link add vx0 type vxlan id 42 remote 10.1.0.1 local 10.1.0.2 dev veth0b dstport 4789 nolearning")
+			addrUp(t, "vx0", "192.168.42.2/24")
+		})
+		addrUp(t, "vx0", "192.168.42.1/24")
+
+		l, err := netlink.LinkByName("vx0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vx, ok := l.(*netlink.Vxlan)
+		if !ok {
+			t.Fatalf("vx0 is a %v, want vxlan", l.Type())
+		}
+		if vx.VxlanId != 42 || vx.Port != 4789 || !vx.Group.Equal(net.IPv4(10, 1, 0, 2)) || !vx.SrcAddr.Equal(net.IPv4(10, 1, 0, 1)) || !vx.Learning {
+			t.Errorf("vx0 = %+v, want VNI 42, port 4789, remote 10.1.0.2, local 10.1.0.1, learning", vx)
+		}
+		inPeer(func() {
+			l, err := netlink.LinkByName("vx0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.(*netlink.Vxlan).Learning {
+				t.Errorf("peer vx0 learns, want nolearning")
+			}
+		})
+
+		sendThrough(t, inPeer)
+
+		for _, bad := range []string{
+			"link add vx1 type vxlan id 16777216",
+			"link add vx1 type vxlan id 1 dstport 65536",
+			"link add vx1 type vxlan id 1 remote 239.1.1.1",
+			"link add vx1 type vxlan id 1 group 10.1.0.2 dev veth0a",
+			"link add vx1 type vxlan id 1 group 239.1.1.1",
+			"link add vx1 type vxlan id 1 remote 10.1.0.2 group 239.1.1.1 dev veth0a",
+			"link add vx1 type vxlan id 1 remote nowhere",
+			"link add vx1 type vxlan id 1 learning",
+		} {
+			arg, cursor = strings.Fields(bad), 0
+			if err := link(); err == nil {
+				t.Errorf("ip %s = nil, want error", bad)
+			}
+		}
+	})
+}
+
+func TestTunnel(t *testing.T) {
+	for _, mode := range []string{"gre", "ipip"} {
+		t.Run(mode, func(t *testing.T) {
+			testutil.InNetNS(t, func() {
+				inPeer := tunnelPeers(t)
+				ipOrSkip(t, "tunnel add tun0 mode "+mode+" remote 10.1.0.2 local 10.1.0.1 ttl 255")
+				inPeer(func() {
+					ipOrSkip(t, "tunnel add tun0 mode "+mode+" remote 10.1.0.1 local 10.1.0.2 ttl 255")
+					addrUp(t, "tun0", "192.168.42.2/24")
+				})
+				addrUp(t, "tun0", "192.168.42.1/24")
+
+				l, err := netlink.LinkByName("tun0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if l.Type() != mode {
+					t.Errorf("tun0 is a %v, want %v", l.Type(), mode)
+				}
+				sendThrough(t, inPeer)
+
+				ipLink(t, "del tun0")
+			})
+		})
+	}
+}
+
+func TestTunnelAddErrors(t *testing.T) {
+	for _, bad := range []string{
+		"tunnel add tun0 mode vti remote 10.1.0.2",
+		"tunnel add tun0 mode gre remote fe80::1",
+		"tunnel add tun0 mode gre ttl 256",
+		"tunnel add tun0 mode gre key 1",
+	} {
+		arg, cursor = strings.Fields(bad), 0
+		if err := tunnel(); err == nil {
+			t.Errorf("ip %s = nil, want error", bad)
+		}
+	}
+}
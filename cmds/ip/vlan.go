@@ -0,0 +1,154 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ifla_vlan_qos_mapping attribute type, from <linux/if_link.h>.
+const iflaVlanQosMapping = 1
+
+// qosMapping maps a priority to another: skb priority to VLAN PCP for
+// egress, the other way around for ingress.
+type qosMapping struct {
+	from, to uint32
+}
+
+// parseQosMap parses FROM:TO mappings. The VLAN side of each mapping, to for
+// egress and from for ingress, is a 3 bit PCP.
+func parseQosMap(maps []string, egress bool) ([]qosMapping, error) {
+	var qos []qosMapping
+	for _, m := range maps {
+		f := strings.Split(m, ":")
+		if len(f) != 2 {
+			return nil, fmt.Errorf("QoS mapping %q is not FROM:TO", m)
+		}
+		from, err := strconv.ParseUint(f[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("QoS mapping %q: %v", m, err)
+		}
+		to, err := strconv.ParseUint(f[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("QoS mapping %q: %v", m, err)
+		}
+		pcp := from
+		if egress {
+			pcp = to
+		}
+		if pcp > 7 {
+			return nil, fmt.Errorf("QoS mapping %q: VLAN priority %d is more than 7", m, pcp)
+		}
+		qos = append(qos, qosMapping{from: uint32(from), to: uint32(to)})
+	}
+	return qos, nil
+}
+
+// vlan is a VLAN link to add.
+type vlan struct {
+	name    string
+	parent  netlink.Link
+	id      int
+	egress  []qosMapping
+	ingress []qosMapping
+}
+
+// qosAttr returns the IFLA_VLAN_EGRESS_QOS or IFLA_VLAN_INGRESS_QOS attribute
+// for qos.
+func qosAttr(attrType int, qos []qosMapping) *nl.RtAttr {
+	a := nl.NewRtAttr(attrType, nil)
+	for _, m := range qos {
+		b := make([]byte, 8)
+		nl.NativeEndian().PutUint32(b, m.from)
+		nl.NativeEndian().PutUint32(b[4:], m.to)
+		nl.NewRtAttrChild(a, iflaVlanQosMapping, b)
+	}
+	return a
+}
+
+// add creates v with RTM_NEWLINK. netlink.LinkAdd knows nothing of QoS
+// mappings, hence the request is built here.
+func (v *vlan) add() error {
+	if v.id < 1 || v.id > 4094 {
+		return fmt.Errorf("VLAN id %d is not in 1-4094", v.id)
+	}
+	native := nl.NativeEndian()
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+
+	b := make([]byte, 4)
+	native.PutUint32(b, uint32(v.parent.Attrs().Index))
+	req.AddData(nl.NewRtAttr(unix.IFLA_LINK, b))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(v.name)))
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("vlan"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	id := make([]byte, 2)
+	native.PutUint16(id, uint16(v.id))
+	nl.NewRtAttrChild(data, nl.IFLA_VLAN_ID, id)
+	if len(v.egress) > 0 {
+		data.AddChild(qosAttr(nl.IFLA_VLAN_EGRESS_QOS, v.egress))
+	}
+	if len(v.ingress) > 0 {
+		data.AddChild(qosAttr(nl.IFLA_VLAN_INGRESS_QOS, v.ingress))
+	}
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("adding VLAN %v on %v failed: %v", v.name, v.parent.Attrs().Name, err)
+	}
+	return nil
+}
+
+// vlanadd adds VLAN name on parent. The rest of the command line is "id
+// VID [egress-qos-map FROM:TO ...] [ingress-qos-map FROM:TO ...]", and its
+// mappings add to those of the --egress-qos-map and --ingress-qos-map flags.
+func vlanadd(name string, parent netlink.Link) error {
+	cursor++
+	whatIWant = []string{"id"}
+	if arg[cursor] != "id" {
+		return usage()
+	}
+	cursor++
+	whatIWant = []string{"VLAN id"}
+	id, err := strconv.Atoi(arg[cursor])
+	if err != nil {
+		return fmt.Errorf("VLAN id %q: %v", arg[cursor], err)
+	}
+
+	egress := append([]string(nil), *egressQosMap...)
+	ingress := append([]string(nil), *ingressQosMap...)
+	for cursor++; cursor < len(arg); {
+		whatIWant = []string{"egress-qos-map", "ingress-qos-map"}
+		var m *[]string
+		switch arg[cursor] {
+		case "egress-qos-map":
+			m = &egress
+		case "ingress-qos-map":
+			m = &ingress
+		default:
+			return usage()
+		}
+		for cursor++; cursor < len(arg) && strings.Contains(arg[cursor], ":"); cursor++ {
+			*m = append(*m, arg[cursor])
+		}
+	}
+
+	v := &vlan{name: name, parent: parent, id: id}
+	if v.egress, err = parseQosMap(egress, true); err != nil {
+		return err
+	}
+	if v.ingress, err = parseQosMap(ingress, false); err != nil {
+		return err
+	}
+	return v.add()
+}
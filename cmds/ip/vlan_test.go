@@ -0,0 +1,117 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseQosMap(t *testing.T) {
+	got, err := parseQosMap([]string{"0:1", "4294967295:7"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []qosMapping{{0, 1}, {4294967295, 7}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseQosMap = %v, want %v", got, want)
+	}
+	if _, err := parseQosMap([]string{"7:100"}, false); err != nil {
+		t.Errorf("parseQosMap(ingress 7:100) = %v, want nil", err)
+	}
+
+	for _, tt := range []struct {
+		m      string
+		egress bool
+	}{
+		{"1", true},
+		{"1:2:3", true},
+		{"a:1", true},
+		{"1:-1", true},
+		{"1:8", true},
+		{"8:1", false},
+	} {
+		if _, err := parseQosMap([]string{tt.m}, tt.egress); err == nil {
+			t.Errorf("parseQosMap(%q, %v) = nil, want error", tt.m, tt.egress)
+		}
+	}
+}
+
+func TestVlan(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0a"}, PeerName: "veth0b"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatal(err)
+		}
+
+		arg, cursor = strings.Fields("link add link veth0a name vlan100 type vlan id 100"), 0
+		if err := link(); err != nil {
+			if strings.Contains(err.Error(), "not supported") {
+				t.Skipf("no VLAN support in the kernel: %v", err)
+			}
+			t.Fatal(err)
+		}
+		ipLink(t, "add link veth0b name vlan200 type vlan id 200 egress-qos-map 1:2 2:3 ingress-qos-map 4:5")
+
+		l, err := netlink.LinkByName("vlan100")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := l.(*netlink.Vlan)
+		if !ok {
+			t.Fatalf("vlan100 is a %v, want vlan", l.Type())
+		}
+		if v.VlanId != 100 {
+			t.Errorf("vlan100 id = %d, want 100", v.VlanId)
+		}
+
+		var b bytes.Buffer
+		if err := showLinks(&b, false, "vlan"); err != nil {
+			t.Fatal(err)
+		}
+		s := b.String()
+		for _, want := range []string{": vlan100@veth0a: ", "    vlan id 100\n", ": vlan200@veth0b: ", "    vlan id 200\n"} {
+			if !strings.Contains(s, want) {
+				t.Errorf("show type vlan = %q, want it to contain %q", s, want)
+			}
+		}
+		if strings.Contains(s, ": veth0a") {
+			t.Errorf("show type vlan = %q, want no veth", s)
+		}
+
+		// The mappings are only shown in /proc, if at all.
+		if p, err := ioutil.ReadFile("/proc/net/vlan/vlan200"); err == nil {
+			for _, want := range []string{"EGRESS priority mappings: 1:2 2:3 ", "INGRESS priority mappings: 0:0  1:0  2:0  3:0  4:5 "} {
+				if !strings.Contains(string(p), want) {
+					t.Errorf("/proc/net/vlan/vlan200 = %q, want it to contain %q", p, want)
+				}
+			}
+		}
+
+		for _, bad := range []string{
+			"link add name vlan300 type vlan id 300",
+			"link add link veth0a name vlan300 type vlan id 4095",
+			"link add link veth0a name vlan300 type vlan id x",
+			"link add link veth0a name vlan300 type vlan id 300 egress-qos-map 1:8",
+			"link add link veth0a name vlan300 type vlan id 300 priority 1",
+			"link add link veth0a name vlan100 type vlan id 300",
+		} {
+			arg, cursor = strings.Fields(bad), 0
+			if err := link(); err == nil {
+				t.Errorf("ip %s = nil, want error", bad)
+			}
+		}
+
+		ipLink(t, "del vlan100")
+		if _, err := netlink.LinkByName("vlan100"); err == nil {
+			t.Errorf("vlan100 still exists after del")
+		}
+	})
+}
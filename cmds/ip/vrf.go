@@ -0,0 +1,359 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// vrfadd adds VRF name. The rest of the command line is "table ID", the
+// routing table of the VRF.
+func vrfadd(name string) error {
+	cursor++
+	whatIWant = []string{"table"}
+	if arg[cursor] != "table" {
+		return usage()
+	}
+	cursor++
+	whatIWant = []string{"table id"}
+	table, err := strconv.ParseUint(arg[cursor], 10, 32)
+	if err != nil || table == 0 {
+		return fmt.Errorf("VRF table %q is not a table id", arg[cursor])
+	}
+	vrf := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: name}, Table: uint32(table)}
+	if err := netlink.LinkAdd(vrf); err != nil {
+		return fmt.Errorf("adding VRF %v failed: %v", name, err)
+	}
+	return nil
+}
+
+// vrfByName returns the VRF called name.
+func vrfByName(name string) (*netlink.Vrf, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	vrf, ok := l.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("%v is a %v, not a VRF", name, l.Type())
+	}
+	return vrf, nil
+}
+
+var routeProtocols = map[int]string{
+	unix.RTPROT_REDIRECT: "redirect",
+	unix.RTPROT_KERNEL:   "kernel",
+	unix.RTPROT_BOOT:     "boot",
+	unix.RTPROT_STATIC:   "static",
+	unix.RTPROT_DHCP:     "dhcp",
+}
+
+var routeTypes = map[int]string{
+	unix.RTN_LOCAL:       "local",
+	unix.RTN_BROADCAST:   "broadcast",
+	unix.RTN_ANYCAST:     "anycast",
+	unix.RTN_MULTICAST:   "multicast",
+	unix.RTN_BLACKHOLE:   "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable",
+	unix.RTN_PROHIBIT:    "prohibit",
+}
+
+// showRoutes shows the routes of table in the format of iproute2.
+func showRoutes(w io.Writer, table int) error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("listing routes of table %d: %v", table, err)
+	}
+	ifaces, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("Can't enumerate interfaces? %v", err)
+	}
+	names := make(map[int]string)
+	for _, v := range ifaces {
+		names[v.Attrs().Index] = v.Attrs().Name
+	}
+
+	for _, r := range routes {
+		var s []string
+		if t, ok := routeTypes[r.Type]; ok {
+			s = append(s, t)
+		}
+		if r.Dst == nil {
+			s = append(s, "default")
+		} else if ones, bits := r.Dst.Mask.Size(); ones == bits {
+			s = append(s, r.Dst.IP.String())
+		} else {
+			s = append(s, r.Dst.String())
+		}
+		if r.Gw != nil {
+			s = append(s, "via", r.Gw.String())
+		}
+		if name, ok := names[r.LinkIndex]; ok {
+			s = append(s, "dev", name)
+		}
+		if p, ok := routeProtocols[r.Protocol]; ok {
+			s = append(s, "proto", p)
+		}
+		if r.Scope != netlink.SCOPE_UNIVERSE {
+			s = append(s, "scope", addrScopes[r.Scope])
+		}
+		if r.Src != nil {
+			s = append(s, "src", r.Src.String())
+		}
+		if r.Priority != 0 {
+			s = append(s, "metric", strconv.Itoa(r.Priority))
+		}
+		fmt.Fprintln(w, strings.Join(s, " "))
+	}
+	return nil
+}
+
+// routeShowVRF shows the routes of the VRF called name.
+func routeShowVRF(w io.Writer, name string) error {
+	vrf, err := vrfByName(name)
+	if err != nil {
+		return err
+	}
+	return showRoutes(w, int(vrf.Table))
+}
+
+// vrfShow lists the VRFs and their tables.
+func vrfShow(w io.Writer) error {
+	ifaces, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("Can't enumerate interfaces? %v", err)
+	}
+	for _, l := range ifaces {
+		if vrf, ok := l.(*netlink.Vrf); ok {
+			fmt.Fprintf(w, "%s table %d\n", vrf.Name, vrf.Table)
+		}
+	}
+	return nil
+}
+
+// Of <linux/bpf.h>.
+const (
+	bpfProgLoad             = 5
+	bpfProgAttach           = 8
+	bpfProgTypeCgroupSock   = 9
+	bpfCgroupInetSockCreate = 2
+
+	// eBPF instruction classes and operations.
+	bpfALU64 = 0x07
+	bpfMov   = 0xb0
+	bpfExit  = 0x90
+)
+
+// bpfInsn is struct bpf_insn. regs holds dst_reg in its low and src_reg in
+// its high nibble, as on little-endian machines.
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfProgLoadAttr is the part of union bpf_attr BPF_PROG_LOAD takes.
+type bpfProgLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+// bpfProgAttachAttr is the part of union bpf_attr BPF_PROG_ATTACH takes.
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// bindToDeviceProg loads a BPF program that binds the sockets it is run on
+// to ifindex, as SO_BINDTODEVICE does.
+func bindToDeviceProg(ifindex int) (int, error) {
+	insns := []bpfInsn{
+		// r3 = ifindex
+		{code: bpfALU64 | bpfMov | unix.BPF_K, regs: 3, imm: int32(ifindex)},
+		// sk->bound_dev_if = r3
+		{code: unix.BPF_STX | unix.BPF_MEM | unix.BPF_W, regs: 1 | 3<<4},
+		// Allow the socket.
+		{code: bpfALU64 | bpfMov | unix.BPF_K, regs: 0, imm: 1},
+		{code: unix.BPF_JMP | bpfExit},
+	}
+	license := []byte("GPL\x00")
+	attr := bpfProgLoadAttr{
+		progType:           bpfProgTypeCgroupSock,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		expectedAttachType: bpfCgroupInetSockCreate,
+	}
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return -1, fmt.Errorf("loading BPF program: %v", err)
+	}
+	return int(fd), nil
+}
+
+// cgroup2Root returns where the cgroup2 hierarchy is mounted.
+func cgroup2Root() (string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if f := strings.Fields(s.Text()); len(f) > 2 && f[2] == "cgroup2" {
+			return f[1], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cgroup2 is not mounted")
+}
+
+// currentCgroup2 returns the cgroup2 path of this process, relative to the
+// root of the hierarchy.
+func currentCgroup2() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(l, "0::") {
+			return l[len("0::"):], nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup2 in /proc/self/cgroup")
+}
+
+// vrfCgroup returns the cgroup of VRF vrf, root/vrf/NAME as with iproute2,
+// making it if need be. Sockets made in it are bound to the VRF.
+func vrfCgroup(root string, vrf *netlink.Vrf) (string, error) {
+	cg := filepath.Join(root, "vrf", vrf.Name)
+	if err := os.MkdirAll(cg, 0755); err != nil {
+		return "", err
+	}
+	prog, err := bindToDeviceProg(vrf.Index)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(prog)
+	dir, err := unix.Open(cg, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %v", cg, err)
+	}
+	defer unix.Close(dir)
+	attr := bpfProgAttachAttr{
+		targetFd:    uint32(dir),
+		attachBpfFd: uint32(prog),
+		attachType:  bpfCgroupInetSockCreate,
+	}
+	if _, err := bpf(bpfProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return "", fmt.Errorf("attaching BPF program to %s: %v", cg, err)
+	}
+	return cg, nil
+}
+
+// joinCgroup moves this process to the cgroup cg.
+func joinCgroup(cg string) error {
+	return ioutil.WriteFile(filepath.Join(cg, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// vrfExec runs the command given by args with its sockets bound to VRF name.
+//
+// SO_BINDTODEVICE cannot be set on sockets that are yet to be made, so,
+// like iproute2, the command is started in a cgroup whose BPF program sets
+// it on every socket made.
+func vrfExec(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("vrf exec: no command given")
+	}
+	vrf, err := vrfByName(name)
+	if err != nil {
+		return err
+	}
+	root, err := cgroup2Root()
+	if err != nil {
+		return err
+	}
+	orig, err := currentCgroup2()
+	if err != nil {
+		return err
+	}
+	cg, err := vrfCgroup(root, vrf)
+	if err != nil {
+		return err
+	}
+
+	// The child inherits the cgroup it is forked in. Join it only to
+	// start the command, so that ip's own sockets are left alone.
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	if err := joinCgroup(cg); err != nil {
+		return fmt.Errorf("joining %s: %v", cg, err)
+	}
+	startErr := c.Start()
+	if err := joinCgroup(filepath.Join(root, orig)); err != nil {
+		return fmt.Errorf("leaving %s: %v", cg, err)
+	}
+	if startErr != nil {
+		return startErr
+	}
+	return c.Wait()
+}
+
+func vrfcmd() error {
+	cursor++
+	whatIWant = []string{"show", "exec"}
+	if len(arg[cursor:]) == 0 {
+		return vrfShow(os.Stdout)
+	}
+
+	switch one(arg[cursor], whatIWant) {
+	case "show":
+		return vrfShow(os.Stdout)
+	case "exec":
+		cursor++
+		whatIWant = []string{"VRF name"}
+		name := arg[cursor]
+		return vrfExec(name, arg[cursor+1:], os.Stdin, os.Stdout, os.Stderr)
+	}
+	return usage()
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// TestVRFHelperProcess is run in a VRF by TestVRF. It prints the device its
+// sockets are bound to.
+func TestVRFHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dev, err := unix.GetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(dev)
+	os.Exit(0)
+}
+
+func TestVRF(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		arg, cursor = strings.Fields("link add red type vrf table 10"), 0
+		if err := link(); err != nil {
+			if strings.Contains(err.Error(), "not supported") {
+				t.Skipf("no VRF support in the kernel: %v", err)
+			}
+			t.Fatal(err)
+		}
+		ipLink(t, "add name blue type vrf table 20")
+
+		// Both VRFs have an interface on 10.0.0.0/24.
+		for i, vrf := range []string{"red", "blue"} {
+			a, b := fmt.Sprintf("veth%da", i), fmt.Sprintf("veth%db", i)
+			if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: a}, PeerName: b}); err != nil {
+				t.Fatal(err)
+			}
+			ipLink(t, fmt.Sprintf("set %s master %s", a, vrf))
+			for _, l := range []string{vrf, a, b} {
+				ipLink(t, fmt.Sprintf("set %s up", l))
+			}
+			arg, cursor = strings.Fields(fmt.Sprintf("addr add 10.0.0.1/24 dev %s", a)), 0
+			if err := addrip(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		l, err := netlink.LinkByName("red")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := l.(*netlink.Vrf); !ok || v.Table != 10 {
+			t.Fatalf("red is %#v, want a VRF with table 10", l)
+		}
+
+		var b bytes.Buffer
+		if err := showLinks(&b, false, ""); err != nil {
+			t.Fatal(err)
+		}
+		s := b.String()
+		for _, want := range []string{": red: ", "    vrf table 10\n", ": blue: ", "    vrf table 20\n", "master red ", "master blue "} {
+			if !strings.Contains(s, want) {
+				t.Errorf("link show = %q, want it to contain %q", s, want)
+			}
+		}
+
+		b.Reset()
+		if err := vrfShow(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := b.String(), "red table 10\nblue table 20\n"; got != want {
+			t.Errorf("vrf show = %q, want %q", got, want)
+		}
+
+		for vrf, dev := range map[string]string{"red": "veth0a", "blue": "veth1a"} {
+			b.Reset()
+			if err := routeShowVRF(&b, vrf); err != nil {
+				t.Fatal(err)
+			}
+			s := b.String()
+			if want := "10.0.0.0/24 dev " + dev + " proto kernel scope link src 10.0.0.1\n"; !strings.Contains(s, want) {
+				t.Errorf("route show vrf %s = %q, want it to contain %q", vrf, s, want)
+			}
+			if want := "local 10.0.0.1 dev " + dev + " proto kernel scope host src 10.0.0.1\n"; !strings.Contains(s, want) {
+				t.Errorf("route show vrf %s = %q, want it to contain %q", vrf, s, want)
+			}
+			if strings.Count(s, "10.0.0.0/24") != 1 {
+				t.Errorf("route show vrf %s = %q, want one route to 10.0.0.0/24", vrf, s)
+			}
+		}
+		b.Reset()
+		if err := showRoutes(&b, unix.RT_TABLE_MAIN); err != nil {
+			t.Fatal(err)
+		}
+		if s := b.String(); strings.Contains(s, "10.0.0.0/24") {
+			t.Errorf("main table = %q, want no route to 10.0.0.0/24", s)
+		}
+
+		root, err := cgroup2Root()
+		if err != nil {
+			t.Logf("Not testing vrf exec: %v", err)
+		} else {
+			defer os.Remove(filepath.Join(root, "vrf"))
+			defer os.Remove(filepath.Join(root, "vrf", "blue"))
+			defer os.Remove(filepath.Join(root, "vrf", "red"))
+			orig, err := currentCgroup2()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, vrf := range []string{"red", "blue"} {
+				os.Setenv("GO_WANT_HELPER_PROCESS", "1")
+				var stdout, stderr bytes.Buffer
+				err := vrfExec(vrf, []string{os.Args[0], "-test.run=TestVRFHelperProcess"}, nil, &stdout, &stderr)
+				os.Unsetenv("GO_WANT_HELPER_PROCESS")
+				if err != nil {
+					t.Fatalf("vrf exec %s = %v: %s", vrf, err, stderr.String())
+				}
+				if stdout.String() != vrf {
+					t.Errorf("vrf exec %s: sockets are bound to %q, want %q", vrf, stdout.String(), vrf)
+				}
+			}
+			if cg, err := currentCgroup2(); err != nil || cg != orig {
+				t.Errorf("after vrf exec, ip is in cgroup %q (%v), want %q", cg, err, orig)
+			}
+		}
+
+		for _, bad := range []string{
+			"link add green type vrf",
+			"link add green type vrf table x",
+			"link add green type vrf table 0",
+			"link add green type vrf id 30",
+			"link set veth0b master veth1b",
+		} {
+			arg, cursor = strings.Fields(bad), 0
+			if err := link(); err == nil {
+				t.Errorf("ip %s = nil, want error", bad)
+			}
+		}
+		if err := routeShowVRF(&b, "veth0b"); err == nil {
+			t.Errorf("route show vrf veth0b = nil, want error")
+		}
+		if err := vrfExec("veth0b", []string{"true"}, nil, nil, nil); err == nil {
+			t.Errorf("vrf exec veth0b = nil, want error")
+		}
+		if err := vrfExec("red", nil, nil, nil, nil); err == nil {
+			t.Errorf("vrf exec red without a command = nil, want error")
+		}
+
+		ipLink(t, "set veth1a nomaster")
+		l, err = netlink.LinkByName("veth1a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Attrs().MasterIndex != 0 {
+			t.Errorf("veth1a still has a master after nomaster")
+		}
+	})
+}
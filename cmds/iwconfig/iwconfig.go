@@ -0,0 +1,189 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Configure WiFi interfaces.
+//
+// Synopsis:
+//     iwconfig scan IFACE [-timeout DURATION]
+//     iwconfig status IFACE
+//     iwconfig connect IFACE SSID [-psk PASSPHRASE] [-timeout DURATION]
+//
+// Description:
+//     iwconfig talks to the kernel's nl80211 interface directly, so it needs
+//     neither wpa_supplicant nor iw.
+//
+//     scan triggers a scan and lists the networks found. status shows the
+//     network IFACE is associated with. connect associates with the
+//     strongest access point for SSID. With -psk, it then runs the WPA2
+//     4-way handshake and installs the keys; only WPA2-PSK with CCMP is
+//     supported. PASSPHRASE may also be the PSK in 64 hex digits.
+//
+// Options:
+//     -psk:     WPA2 passphrase
+//     -timeout: how long to wait for scans and the handshake (default 10s)
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const usage = `usage:
+  iwconfig scan IFACE [-timeout DURATION]
+  iwconfig status IFACE
+  iwconfig connect IFACE SSID [-psk PASSPHRASE] [-timeout DURATION]`
+
+const defaultTimeout = 10 * time.Second
+
+var (
+	dial = func() (genl, error) {
+		return dialGenl("nl80211")
+	}
+	interfaceByName = net.InterfaceByName
+)
+
+func open(name string, timeout time.Duration) (*wifi, error) {
+	iface, err := interfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &wifi{c: c, iface: iface, timeout: timeout}, nil
+}
+
+func scan(out io.Writer, w *wifi) error {
+	bsss, err := w.scan()
+	if err != nil {
+		return err
+	}
+	for _, b := range bsss {
+		fmt.Fprintln(out, formatBSS(b))
+	}
+	return nil
+}
+
+func status(out io.Writer, w *wifi) error {
+	b, err := w.status()
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		fmt.Fprintf(out, "%s: not associated\n", w.iface.Name)
+		return nil
+	}
+	fmt.Fprintf(out, "%s: SSID %q BSSID %s freq %d MHz signal %.0f dBm\n", w.iface.Name, b.ssid, b.bssid, b.freq, b.signal)
+	return nil
+}
+
+func connect(out io.Writer, w *wifi, ssid, psk string) error {
+	var key []byte
+	if psk != "" {
+		var err error
+		if key, err = pmk(psk, ssid); err != nil {
+			return err
+		}
+	}
+	bsss, err := w.scan()
+	if err != nil {
+		return err
+	}
+	b := findBSS(bsss, ssid)
+	if b == nil {
+		return fmt.Errorf("no network named %q", ssid)
+	}
+	if key == nil {
+		if b.rsn != nil {
+			return fmt.Errorf("%q needs a passphrase", ssid)
+		}
+		if err := w.connect(b, false); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s: connected to %q (%s)\n", w.iface.Name, ssid, b.bssid)
+		return nil
+	}
+	if b.rsn == nil {
+		return fmt.Errorf("%q is not a WPA2 network", ssid)
+	}
+
+	// Listen before associating so that we do not miss message 1.
+	e, err := dialEAPOL(w.iface, w.timeout)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	if err := w.connect(b, true); err != nil {
+		return err
+	}
+	k, err := handshake(e, newSupplicant(key, b.bssid, w.iface.HardwareAddr, b.rsn))
+	if err != nil {
+		return fmt.Errorf("4-way handshake with %s: %v", b.bssid, err)
+	}
+	if err := w.installKeys(b.bssid, k); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: connected to %q (%s) with WPA2\n", w.iface.Name, ssid, b.bssid)
+	return nil
+}
+
+func iwconfig(out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing command or interface")
+	}
+	cmd, name, args := args[0], args[1], args[2:]
+
+	var ssid string
+	if cmd == "connect" {
+		if len(args) == 0 {
+			return fmt.Errorf("missing SSID")
+		}
+		ssid, args = args[0], args[1:]
+	}
+	f := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	psk := f.String("psk", "", "WPA2 passphrase")
+	timeout := f.Duration("timeout", defaultTimeout, "how long to wait")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments %q", f.Args())
+	}
+	if *psk != "" && cmd != "connect" {
+		return fmt.Errorf("-psk is only for connect")
+	}
+
+	switch cmd {
+	case "scan", "status", "connect":
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	w, err := open(name, *timeout)
+	if err != nil {
+		return err
+	}
+	defer w.c.close()
+
+	switch cmd {
+	case "scan":
+		return scan(out, w)
+	case "status":
+		return status(out, w)
+	}
+	return connect(out, w, ssid, *psk)
+}
+
+func main() {
+	if err := iwconfig(os.Stdout, os.Args[1:]); err != nil {
+		log.Fatalf("iwconfig: %v\n%s", err, usage)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+	"golang.org/x/sys/unix"
+)
+
+// genlMsg is a generic netlink message.
+type genlMsg struct {
+	cmd   uint8
+	attrs []byte
+}
+
+// genl is a generic netlink family.
+type genl interface {
+	// execute sends a request and returns the replies, of which there are
+	// several if flags has NLM_F_DUMP.
+	execute(cmd uint8, flags uint16, attrs ...nlattr.Attr) ([]genlMsg, error)
+
+	// join subscribes to the multicast group with the given name.
+	join(group string) error
+
+	// event returns the next multicast message.
+	event() (genlMsg, error)
+
+	close() error
+}
+
+// genlConn is a generic netlink socket bound to one family.
+type genlConn struct {
+	fd     int
+	seq    uint32
+	family uint16
+	groups map[string]uint32
+	// events are multicast messages received while waiting for replies.
+	events []genlMsg
+}
+
+var _ genl = &genlConn{}
+
+// dialGenl opens a generic netlink socket for the named family.
+func dialGenl(name string) (*genlConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	c := &genlConn{fd: fd, family: unix.GENL_ID_CTRL}
+	msgs, err := c.execute(unix.CTRL_CMD_GETFAMILY, 0, nlattr.String(unix.CTRL_ATTR_FAMILY_NAME, name))
+	if err == syscall.ENOENT {
+		err = fmt.Errorf("generic netlink family %s is not available", name)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		unix.Close(fd)
+		return nil, fmt.Errorf("no reply for generic netlink family %s", name)
+	}
+	c.family, c.groups, err = parseFamily(msgs[0])
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseFamily returns the ID and multicast groups of a family.
+func parseFamily(m genlMsg) (uint16, map[string]uint32, error) {
+	attrs, err := nlattr.ParseMap(m.attrs)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, ok := attrs.U16(nlattr.Native, unix.CTRL_ATTR_FAMILY_ID)
+	if !ok {
+		return 0, nil, fmt.Errorf("generic netlink family has no ID")
+	}
+	groups := make(map[string]uint32)
+	list, err := nlattr.Parse(attrs[unix.CTRL_ATTR_MCAST_GROUPS])
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, g := range list {
+		ga, err := nlattr.ParseMap(g.Data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if gid, ok := ga.U32(nlattr.Native, unix.CTRL_ATTR_MCAST_GRP_ID); ok {
+			groups[ga.String(unix.CTRL_ATTR_MCAST_GRP_NAME)] = gid
+		}
+	}
+	return id, groups, nil
+}
+
+func (c *genlConn) close() error {
+	return unix.Close(c.fd)
+}
+
+func (c *genlConn) join(group string) error {
+	id, ok := c.groups[group]
+	if !ok {
+		return fmt.Errorf("no multicast group %q", group)
+	}
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(c.fd, unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, int(id)))
+}
+
+func (c *genlConn) send(cmd uint8, flags uint16, attrs []nlattr.Attr) (uint32, error) {
+	c.seq++
+	body := nlattr.Encode(attrs)
+	b := make([]byte, unix.SizeofNlMsghdr+unix.GENL_HDRLEN, unix.SizeofNlMsghdr+unix.GENL_HDRLEN+len(body))
+	nlattr.Native.PutUint32(b[0:], uint32(cap(b)))
+	nlattr.Native.PutUint16(b[4:], c.family)
+	nlattr.Native.PutUint16(b[6:], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	nlattr.Native.PutUint32(b[8:], c.seq)
+	b[unix.SizeofNlMsghdr] = cmd
+	// Version 1 is what all families use.
+	b[unix.SizeofNlMsghdr+1] = 1
+	b = append(b, body...)
+	return c.seq, os.NewSyscallError("sendto", unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}))
+}
+
+// toGenl returns the generic netlink message in m.
+func toGenl(m nlattr.Message) (genlMsg, error) {
+	if len(m.Data) < unix.GENL_HDRLEN {
+		return genlMsg{}, fmt.Errorf("short generic netlink message")
+	}
+	return genlMsg{cmd: m.Data[0], attrs: m.Data[unix.GENL_HDRLEN:]}, nil
+}
+
+func (c *genlConn) receive() ([]nlattr.Message, error) {
+	b := make([]byte, 64<<10)
+	n, _, err := unix.Recvfrom(c.fd, b, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("recvfrom", err)
+	}
+	return nlattr.ParseMessages(b[:n])
+}
+
+func (c *genlConn) execute(cmd uint8, flags uint16, attrs ...nlattr.Attr) ([]genlMsg, error) {
+	seq, err := c.send(cmd, flags, attrs)
+	if err != nil {
+		return nil, err
+	}
+	var replies []genlMsg
+	for {
+		msgs, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Seq != seq {
+				// Multicast messages have sequence number 0.
+				if g, err := toGenl(m); err == nil && m.Seq == 0 && m.Type == c.family {
+					c.events = append(c.events, g)
+				}
+				continue
+			}
+			switch m.Type {
+			case unix.NLMSG_ERROR:
+				// This is the ack that ends every request.
+				return replies, m.Err()
+			case unix.NLMSG_DONE:
+				if flags&unix.NLM_F_DUMP != 0 {
+					// Dumps end with DONE and no ack.
+					return replies, nil
+				}
+			default:
+				g, err := toGenl(m)
+				if err != nil {
+					return nil, err
+				}
+				replies = append(replies, g)
+			}
+		}
+	}
+}
+
+func (c *genlConn) event() (genlMsg, error) {
+	for len(c.events) == 0 {
+		msgs, err := c.receive()
+		if err != nil {
+			return genlMsg{}, err
+		}
+		for _, m := range msgs {
+			if m.Seq == 0 && m.Type == c.family {
+				g, err := toGenl(m)
+				if err != nil {
+					return genlMsg{}, err
+				}
+				c.events = append(c.events, g)
+			}
+		}
+	}
+	g := c.events[0]
+	c.events = c.events[1:]
+	return g, nil
+}
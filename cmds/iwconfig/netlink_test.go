@@ -0,0 +1,58 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+	"golang.org/x/sys/unix"
+)
+
+func TestToGenl(t *testing.T) {
+	g, err := toGenl(nlattr.Message{Type: 30, Data: []byte{cmdNewScanResults, 1, 0, 0, 9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.cmd != cmdNewScanResults || !bytes.Equal(g.attrs, []byte{9}) {
+		t.Errorf("genl message = %+v", g)
+	}
+	if _, err := toGenl(nlattr.Message{Type: 30, Data: []byte{cmdNewScanResults}}); err == nil {
+		t.Errorf("toGenl of a short message = nil, want error")
+	}
+}
+
+func TestDialGenl(t *testing.T) {
+	// The controller itself is always there.
+	c, err := dialGenl("nlctrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+	if c.family != unix.GENL_ID_CTRL {
+		t.Errorf("nlctrl family = %d, want %d", c.family, unix.GENL_ID_CTRL)
+	}
+	if _, err := dialGenl("no such family"); err == nil {
+		t.Errorf("dialGenl of a missing family = nil, want error")
+	}
+}
+
+func TestDialNL80211(t *testing.T) {
+	c, err := dialGenl("nl80211")
+	if err != nil {
+		t.Skipf("nl80211 is not available: %v", err)
+	}
+	defer c.close()
+	for _, g := range []string{"scan", "mlme"} {
+		if _, ok := c.groups[g]; !ok {
+			t.Errorf("nl80211 has no %s multicast group", g)
+		}
+	}
+	// Dumping interfaces works without any wireless hardware.
+	if _, err := c.execute(cmdGetInterface, unix.NLM_F_DUMP); err != nil {
+		t.Errorf("dumping interfaces: %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+	"golang.org/x/sys/unix"
+)
+
+// nl80211 commands, from linux/nl80211.h.
+const (
+	cmdGetInterface   = 5
+	cmdNewKey         = 11
+	cmdGetStation     = 17
+	cmdSetStation     = 18
+	cmdGetScan        = 32
+	cmdTriggerScan    = 33
+	cmdNewScanResults = 34
+	cmdScanAborted    = 35
+	cmdConnect        = 46
+	cmdDisconnect     = 48
+)
+
+// nl80211 attributes.
+const (
+	attrIfindex              = 3
+	attrIfname               = 4
+	attrMAC                  = 6
+	attrKeyData              = 7
+	attrKeyIdx               = 8
+	attrKeyCipher            = 9
+	attrKeySeq               = 10
+	attrKeyDefault           = 11
+	attrStaInfo              = 21
+	attrWiphyFreq            = 38
+	attrIE                   = 42
+	attrScanSSIDs            = 45
+	attrBSS                  = 47
+	attrSSID                 = 52
+	attrAuthType             = 53
+	attrKeyType              = 55
+	attrStaFlags2            = 67
+	attrControlPort          = 68
+	attrPrivacy              = 70
+	attrStatusCode           = 72
+	attrCipherSuitesPairwise = 73
+	attrCipherSuiteGroup     = 74
+	attrWPAVersions          = 75
+	attrAKMSuites            = 76
+)
+
+// Attributes nested in attrBSS.
+const (
+	bssBSSID     = 1
+	bssFrequency = 2
+	bssIEs       = 6
+	bssSignalMBM = 7
+	bssStatus    = 9
+)
+
+// Attributes nested in attrStaInfo.
+const (
+	staInfoSignal = 7
+)
+
+const (
+	bssStatusAssociated = 1
+	authOpenSystem      = 0
+	keyTypeGroup        = 0
+	keyTypePairwise     = 1
+	wpaVersion2         = 2
+	staFlagAuthorized   = 1 << 1
+
+	cipherCCMP = 0x000fac04
+	akmPSK     = 0x000fac02
+
+	// ieSSID and ieRSN are information element IDs.
+	ieSSID = 0
+	ieRSN  = 48
+)
+
+// rsnIE advertises WPA2 with CCMP for both ciphers and PSK key management,
+// the only combination we support.
+var rsnIE = []byte{
+	ieRSN, 20,
+	1, 0, // Version.
+	0x00, 0x0f, 0xac, 4, // Group cipher: CCMP.
+	1, 0, 0x00, 0x0f, 0xac, 4, // Pairwise ciphers: CCMP.
+	1, 0, 0x00, 0x0f, 0xac, 2, // AKM suites: PSK.
+	0, 0, // Capabilities.
+}
+
+// bss is a scan result.
+type bss struct {
+	bssid      net.HardwareAddr
+	ssid       string
+	freq       uint32
+	signal     float64 // dBm.
+	associated bool
+	// rsn is the RSN information element, if any.
+	rsn []byte
+}
+
+// ies returns the information elements in b by ID.
+func ies(b []byte) map[byte][]byte {
+	m := make(map[byte][]byte)
+	for len(b) >= 2 && len(b) >= 2+int(b[1]) {
+		if _, ok := m[b[0]]; !ok {
+			m[b[0]] = b[2 : 2+b[1]]
+		}
+		b = b[2+b[1]:]
+	}
+	return m
+}
+
+// parseBSS parses a NEW_SCAN_RESULTS message from a GET_SCAN dump.
+func parseBSS(m genlMsg) (*bss, error) {
+	attrs, err := nlattr.ParseMap(m.attrs)
+	if err != nil {
+		return nil, err
+	}
+	a, err := nlattr.ParseMap(attrs[attrBSS])
+	if err != nil {
+		return nil, err
+	}
+	if len(a[bssBSSID]) != 6 {
+		return nil, fmt.Errorf("scan result has no BSSID")
+	}
+	b := &bss{bssid: net.HardwareAddr(append([]byte(nil), a[bssBSSID]...))}
+	b.freq, _ = a.U32(nlattr.Native, bssFrequency)
+	if s, ok := a.U32(nlattr.Native, bssSignalMBM); ok {
+		b.signal = float64(int32(s)) / 100
+	}
+	if s, ok := a.U32(nlattr.Native, bssStatus); ok {
+		b.associated = s == bssStatusAssociated
+	}
+	ie := ies(a[bssIEs])
+	b.ssid = string(ie[ieSSID])
+	if r, ok := ie[ieRSN]; ok {
+		b.rsn = append([]byte{ieRSN, byte(len(r))}, r...)
+	}
+	return b, nil
+}
+
+// wifi is an nl80211 interface.
+type wifi struct {
+	c     genl
+	iface *net.Interface
+	// timeout bounds waiting for scans and connections.
+	timeout time.Duration
+}
+
+func (w *wifi) ifindex() nlattr.Attr {
+	return nlattr.U32(nlattr.Native, attrIfindex, uint32(w.iface.Index))
+}
+
+// scanResults returns the BSSs from the last scan.
+func (w *wifi) scanResults() ([]*bss, error) {
+	msgs, err := w.c.execute(cmdGetScan, unix.NLM_F_DUMP, w.ifindex())
+	if err != nil {
+		return nil, fmt.Errorf("getting scan results: %v", err)
+	}
+	var bsss []*bss
+	for _, m := range msgs {
+		b, err := parseBSS(m)
+		if err != nil {
+			return nil, err
+		}
+		bsss = append(bsss, b)
+	}
+	return bsss, nil
+}
+
+// waitFor returns the first event with one of cmds for our interface.
+func (w *wifi) waitFor(cmds ...uint8) (genlMsg, error) {
+	type result struct {
+		m   genlMsg
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		for {
+			m, err := w.c.event()
+			if err != nil {
+				c <- result{err: err}
+				return
+			}
+			a, err := nlattr.ParseMap(m.attrs)
+			if err != nil {
+				continue
+			}
+			if i, ok := a.U32(nlattr.Native, attrIfindex); ok && int(i) != w.iface.Index {
+				continue
+			}
+			for _, cmd := range cmds {
+				if m.cmd == cmd {
+					c <- result{m: m}
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case r := <-c:
+		return r.m, r.err
+	case <-time.After(w.timeout):
+		return genlMsg{}, fmt.Errorf("%s: timed out after %v", w.iface.Name, w.timeout)
+	}
+}
+
+// scan triggers a scan and returns its results.
+func (w *wifi) scan() ([]*bss, error) {
+	if err := w.c.join("scan"); err != nil {
+		return nil, err
+	}
+	// An empty SSID asks for a wildcard probe.
+	if _, err := w.c.execute(cmdTriggerScan, 0, w.ifindex(), nlattr.Nested(attrScanSSIDs, nlattr.Attr{Type: 1})); err != nil {
+		return nil, fmt.Errorf("triggering scan: %v", err)
+	}
+	m, err := w.waitFor(cmdNewScanResults, cmdScanAborted)
+	if err != nil {
+		return nil, err
+	}
+	if m.cmd == cmdScanAborted {
+		return nil, fmt.Errorf("%s: scan aborted", w.iface.Name)
+	}
+	return w.scanResults()
+}
+
+// status returns the BSS we are associated with, and the signal of the
+// station, which is more current than that of the last scan.
+func (w *wifi) status() (*bss, error) {
+	bsss, err := w.scanResults()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bsss {
+		if !b.associated {
+			continue
+		}
+		msgs, err := w.c.execute(cmdGetStation, 0, w.ifindex(), nlattr.Attr{Type: attrMAC, Data: b.bssid})
+		if err != nil || len(msgs) == 0 {
+			return b, nil
+		}
+		a, err := nlattr.ParseMap(msgs[0].attrs)
+		if err != nil {
+			return nil, err
+		}
+		info, err := nlattr.ParseMap(a[attrStaInfo])
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := info[staInfoSignal]; ok && len(s) == 1 {
+			b.signal = float64(int8(s[0]))
+		}
+		return b, nil
+	}
+	return nil, nil
+}
+
+// findBSS returns the BSS with the given SSID and the strongest signal.
+func findBSS(bsss []*bss, ssid string) *bss {
+	var best *bss
+	for _, b := range bsss {
+		if b.ssid == ssid && (best == nil || b.signal > best.signal) {
+			best = b
+		}
+	}
+	return best
+}
+
+// connect associates with b, leaving the 4-way handshake to the caller if
+// psk is set.
+func (w *wifi) connect(b *bss, psk bool) error {
+	if err := w.c.join("mlme"); err != nil {
+		return err
+	}
+	attrs := []nlattr.Attr{
+		w.ifindex(),
+		nlattr.Attr{Type: attrSSID, Data: []byte(b.ssid)},
+		nlattr.Attr{Type: attrMAC, Data: b.bssid},
+		nlattr.U32(nlattr.Native, attrAuthType, authOpenSystem),
+	}
+	if b.freq != 0 {
+		attrs = append(attrs, nlattr.U32(nlattr.Native, attrWiphyFreq, b.freq))
+	}
+	if psk {
+		attrs = append(attrs,
+			nlattr.Flag(attrPrivacy),
+			nlattr.Flag(attrControlPort),
+			nlattr.U32(nlattr.Native, attrWPAVersions, wpaVersion2),
+			nlattr.U32(nlattr.Native, attrCipherSuitesPairwise, cipherCCMP),
+			nlattr.U32(nlattr.Native, attrCipherSuiteGroup, cipherCCMP),
+			nlattr.U32(nlattr.Native, attrAKMSuites, akmPSK),
+			nlattr.Attr{Type: attrIE, Data: rsnIE},
+		)
+	}
+	if _, err := w.c.execute(cmdConnect, 0, attrs...); err != nil {
+		return fmt.Errorf("connecting to %s: %v", b.ssid, err)
+	}
+	m, err := w.waitFor(cmdConnect, cmdDisconnect)
+	if err != nil {
+		return err
+	}
+	a, err := nlattr.ParseMap(m.attrs)
+	if err != nil {
+		return err
+	}
+	if m.cmd == cmdDisconnect {
+		return fmt.Errorf("connecting to %s: disconnected", b.ssid)
+	}
+	if s, ok := a.U16(nlattr.Native, attrStatusCode); ok && s != 0 {
+		return fmt.Errorf("connecting to %s: status %d", b.ssid, s)
+	}
+	return nil
+}
+
+// installKeys installs the keys from a 4-way handshake and marks the AP as
+// authorized, so that the kernel passes data frames.
+func (w *wifi) installKeys(bssid net.HardwareAddr, k *keys) error {
+	if _, err := w.c.execute(cmdNewKey, 0,
+		w.ifindex(),
+		nlattr.Attr{Type: attrMAC, Data: bssid},
+		nlattr.Attr{Type: attrKeyData, Data: k.tk},
+		nlattr.U32(nlattr.Native, attrKeyCipher, cipherCCMP),
+		nlattr.U8(attrKeyIdx, 0),
+		nlattr.U32(nlattr.Native, attrKeyType, keyTypePairwise),
+	); err != nil {
+		return fmt.Errorf("installing pairwise key: %v", err)
+	}
+	if _, err := w.c.execute(cmdNewKey, 0,
+		w.ifindex(),
+		nlattr.Attr{Type: attrKeyData, Data: k.gtk},
+		nlattr.U32(nlattr.Native, attrKeyCipher, cipherCCMP),
+		nlattr.U8(attrKeyIdx, k.gtkIndex),
+		nlattr.Attr{Type: attrKeySeq, Data: k.rsc[:6]},
+		nlattr.U32(nlattr.Native, attrKeyType, keyTypeGroup),
+		nlattr.Flag(attrKeyDefault),
+	); err != nil {
+		return fmt.Errorf("installing group key: %v", err)
+	}
+	flags := make([]byte, 8)
+	nlattr.Native.PutUint32(flags[0:], staFlagAuthorized)
+	nlattr.Native.PutUint32(flags[4:], staFlagAuthorized)
+	if _, err := w.c.execute(cmdSetStation, 0, w.ifindex(), nlattr.Attr{Type: attrMAC, Data: bssid}, nlattr.Attr{Type: attrStaFlags2, Data: flags}); err != nil {
+		return fmt.Errorf("authorizing %s: %v", bssid, err)
+	}
+	return nil
+}
+
+// formatBSS formats b as a line of scan output.
+func formatBSS(b *bss) string {
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "%s %4d MHz %6.2f dBm", b.bssid, b.freq, b.signal)
+	if b.rsn != nil {
+		s.WriteString(" WPA2")
+	} else {
+		s.WriteString(" open")
+	}
+	fmt.Fprintf(&s, " %q", b.ssid)
+	if b.associated {
+		s.WriteString(" (associated)")
+	}
+	return s.String()
+}
@@ -0,0 +1,349 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+)
+
+// request is a request made to fakeGenl.
+type request struct {
+	cmd   uint8
+	flags uint16
+	attrs nlattr.Map
+}
+
+// fakeGenl answers requests with canned replies and sends an event after
+// some commands, like the kernel does when a scan or connection completes.
+type fakeGenl struct {
+	replies  map[uint8][]genlMsg
+	errs     map[uint8]error
+	after    map[uint8]genlMsg
+	requests []request
+	joined   []string
+	events   chan genlMsg
+}
+
+func newFakeGenl() *fakeGenl {
+	return &fakeGenl{
+		replies: make(map[uint8][]genlMsg),
+		errs:    make(map[uint8]error),
+		after:   make(map[uint8]genlMsg),
+		events:  make(chan genlMsg, 10),
+	}
+}
+
+func (f *fakeGenl) execute(cmd uint8, flags uint16, attrs ...nlattr.Attr) ([]genlMsg, error) {
+	// Round trip the attributes to check that they encode.
+	m, err := nlattr.ParseMap(nlattr.Encode(attrs))
+	if err != nil {
+		return nil, err
+	}
+	f.requests = append(f.requests, request{cmd, flags, m})
+	if e, ok := f.after[cmd]; ok {
+		f.events <- e
+	}
+	return f.replies[cmd], f.errs[cmd]
+}
+
+func (f *fakeGenl) join(group string) error {
+	f.joined = append(f.joined, group)
+	return nil
+}
+
+func (f *fakeGenl) event() (genlMsg, error) {
+	return <-f.events, nil
+}
+
+func (f *fakeGenl) close() error {
+	return nil
+}
+
+func (f *fakeGenl) find(cmd uint8) []request {
+	var r []request
+	for _, q := range f.requests {
+		if q.cmd == cmd {
+			r = append(r, q)
+		}
+	}
+	return r
+}
+
+var (
+	testIface = &net.Interface{Index: 3, Name: "wlan0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	apAddr    = net.HardwareAddr{0x10, 0x20, 0x30, 0x40, 0x50, 0x60}
+)
+
+// scanResult returns a NEW_SCAN_RESULTS message as GET_SCAN dumps it.
+func scanResult(bssid net.HardwareAddr, ssid string, mbm int32, rsn bool, associated bool) genlMsg {
+	ie := append([]byte{ieSSID, byte(len(ssid))}, ssid...)
+	if rsn {
+		ie = append(ie, rsnIE...)
+	}
+	a := []nlattr.Attr{
+		nlattr.Attr{Type: bssBSSID, Data: bssid},
+		nlattr.U32(nlattr.Native, bssFrequency, 2412),
+		nlattr.U32(nlattr.Native, bssSignalMBM, uint32(mbm)),
+		nlattr.Attr{Type: bssIEs, Data: ie},
+	}
+	if associated {
+		a = append(a, nlattr.U32(nlattr.Native, bssStatus, bssStatusAssociated))
+	}
+	return genlMsg{
+		cmd:   cmdNewScanResults,
+		attrs: nlattr.Encode([]nlattr.Attr{nlattr.U32(nlattr.Native, attrIfindex, 3), nlattr.Nested(attrBSS, a...)}),
+	}
+}
+
+func newTestWifi(f *fakeGenl) *wifi {
+	return &wifi{c: f, iface: testIface, timeout: time.Second}
+}
+
+func TestScan(t *testing.T) {
+	f := newFakeGenl()
+	f.replies[cmdGetScan] = []genlMsg{
+		scanResult(apAddr, "home", -4500, true, false),
+		scanResult(net.HardwareAddr{1, 2, 3, 4, 5, 6}, "café", -7025, false, true),
+	}
+	// An event for another interface must be ignored.
+	f.events <- genlMsg{cmd: cmdScanAborted, attrs: nlattr.Encode([]nlattr.Attr{nlattr.U32(nlattr.Native, attrIfindex, 9)})}
+	f.after[cmdTriggerScan] = genlMsg{cmd: cmdNewScanResults, attrs: nlattr.Encode([]nlattr.Attr{nlattr.U32(nlattr.Native, attrIfindex, 3)})}
+
+	var out bytes.Buffer
+	if err := scan(&out, newTestWifi(f)); err != nil {
+		t.Fatal(err)
+	}
+	want := `10:20:30:40:50:60 2412 MHz -45.00 dBm WPA2 "home"
+01:02:03:04:05:06 2412 MHz -70.25 dBm open "café" (associated)
+`
+	if out.String() != want {
+		t.Errorf("scan output:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if len(f.joined) != 1 || f.joined[0] != "scan" {
+		t.Errorf("joined %v, want scan", f.joined)
+	}
+	if tr := f.find(cmdTriggerScan); len(tr) != 1 {
+		t.Errorf("got %d TRIGGER_SCAN requests, want 1", len(tr))
+	} else if i, _ := tr[0].attrs.U32(nlattr.Native, attrIfindex); i != 3 {
+		t.Errorf("TRIGGER_SCAN ifindex = %d, want 3", i)
+	}
+}
+
+func TestScanAborted(t *testing.T) {
+	f := newFakeGenl()
+	f.after[cmdTriggerScan] = genlMsg{cmd: cmdScanAborted}
+	if _, err := newTestWifi(f).scan(); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("scan = %v, want aborted", err)
+	}
+
+	f = newFakeGenl()
+	f.errs[cmdTriggerScan] = fmt.Errorf("device busy")
+	if _, err := newTestWifi(f).scan(); err == nil {
+		t.Errorf("scan with a failing trigger = nil, want error")
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	w := newTestWifi(newFakeGenl())
+	w.timeout = 10 * time.Millisecond
+	if _, err := w.scan(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("scan without results = %v, want timeout", err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	f := newFakeGenl()
+	f.replies[cmdGetScan] = []genlMsg{
+		scanResult(net.HardwareAddr{1, 2, 3, 4, 5, 6}, "other", -3000, false, false),
+		scanResult(apAddr, "home", -4500, true, true),
+	}
+	f.replies[cmdGetStation] = []genlMsg{{
+		attrs: nlattr.Encode([]nlattr.Attr{nlattr.Nested(attrStaInfo, nlattr.U8(staInfoSignal, uint8(256-52)))}),
+	}}
+	var out bytes.Buffer
+	if err := status(&out, newTestWifi(f)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "wlan0: SSID \"home\" BSSID 10:20:30:40:50:60 freq 2412 MHz signal -52 dBm\n"; out.String() != want {
+		t.Errorf("status = %q, want %q", out.String(), want)
+	}
+	if st := f.find(cmdGetStation); len(st) != 1 || !bytes.Equal(st[0].attrs[attrMAC], apAddr) {
+		t.Errorf("GET_STATION requests = %v, want one for %s", st, apAddr)
+	}
+
+	f = newFakeGenl()
+	out.Reset()
+	if err := status(&out, newTestWifi(f)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "wlan0: not associated\n"; out.String() != want {
+		t.Errorf("status = %q, want %q", out.String(), want)
+	}
+}
+
+func TestConnectOpen(t *testing.T) {
+	f := newFakeGenl()
+	f.replies[cmdGetScan] = []genlMsg{
+		scanResult(net.HardwareAddr{1, 2, 3, 4, 5, 6}, "cafe", -8000, false, false),
+		scanResult(apAddr, "cafe", -5000, false, false),
+	}
+	f.after[cmdTriggerScan] = genlMsg{cmd: cmdNewScanResults}
+	f.after[cmdConnect] = genlMsg{cmd: cmdConnect, attrs: nlattr.Encode([]nlattr.Attr{nlattr.U16(nlattr.Native, attrStatusCode, 0)})}
+	var out bytes.Buffer
+	if err := connect(&out, newTestWifi(f), "cafe", ""); err != nil {
+		t.Fatal(err)
+	}
+	c := f.find(cmdConnect)
+	if len(c) != 1 {
+		t.Fatalf("got %d CONNECT requests, want 1", len(c))
+	}
+	// The strongest AP wins.
+	if !bytes.Equal(c[0].attrs[attrMAC], apAddr) {
+		t.Errorf("CONNECT to %s, want %s", net.HardwareAddr(c[0].attrs[attrMAC]), apAddr)
+	}
+	if string(c[0].attrs[attrSSID]) != "cafe" {
+		t.Errorf("CONNECT SSID = %q, want cafe", c[0].attrs[attrSSID])
+	}
+	if _, ok := c[0].attrs[attrPrivacy]; ok {
+		t.Errorf("CONNECT to an open network asks for privacy")
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		results []genlMsg
+		event   genlMsg
+		ssid    string
+		psk     string
+		want    string
+	}{
+		{"missing", nil, genlMsg{}, "home", "", "no network"},
+		{"needs passphrase", []genlMsg{scanResult(apAddr, "home", 0, true, false)}, genlMsg{}, "home", "", "needs a passphrase"},
+		{"not WPA2", []genlMsg{scanResult(apAddr, "home", 0, false, false)}, genlMsg{}, "home", "password", "not a WPA2"},
+		{"short passphrase", nil, genlMsg{}, "home", "short", "8..63"},
+		{"refused", []genlMsg{scanResult(apAddr, "home", 0, false, false)},
+			genlMsg{cmd: cmdConnect, attrs: nlattr.Encode([]nlattr.Attr{nlattr.U16(nlattr.Native, attrStatusCode, 17)})}, "home", "", "status 17"},
+		{"disconnected", []genlMsg{scanResult(apAddr, "home", 0, false, false)},
+			genlMsg{cmd: cmdDisconnect}, "home", "", "disconnected"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGenl()
+			f.replies[cmdGetScan] = tt.results
+			f.after[cmdTriggerScan] = genlMsg{cmd: cmdNewScanResults}
+			f.after[cmdConnect] = tt.event
+			err := connect(&bytes.Buffer{}, newTestWifi(f), tt.ssid, tt.psk)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("connect = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectParams(t *testing.T) {
+	f := newFakeGenl()
+	f.after[cmdConnect] = genlMsg{cmd: cmdConnect}
+	b := &bss{bssid: apAddr, ssid: "home", freq: 5180, rsn: rsnIE}
+	if err := newTestWifi(f).connect(b, true); err != nil {
+		t.Fatal(err)
+	}
+	c := f.find(cmdConnect)[0].attrs
+	for typ, want := range map[uint16]uint32{
+		attrWiphyFreq:            5180,
+		attrWPAVersions:          wpaVersion2,
+		attrCipherSuitesPairwise: cipherCCMP,
+		attrCipherSuiteGroup:     cipherCCMP,
+		attrAKMSuites:            akmPSK,
+	} {
+		if got, _ := c.U32(nlattr.Native, typ); got != want {
+			t.Errorf("CONNECT attribute %d = %#x, want %#x", typ, got, want)
+		}
+	}
+	for _, typ := range []uint16{attrPrivacy, attrControlPort} {
+		if _, ok := c[typ]; !ok {
+			t.Errorf("CONNECT has no attribute %d", typ)
+		}
+	}
+	if !bytes.Equal(c[attrIE], rsnIE) {
+		t.Errorf("CONNECT IE = % x, want % x", c[attrIE], rsnIE)
+	}
+}
+
+func TestInstallKeys(t *testing.T) {
+	f := newFakeGenl()
+	k := &keys{
+		tk:       bytes.Repeat([]byte{1}, 16),
+		gtk:      bytes.Repeat([]byte{2}, 16),
+		gtkIndex: 1,
+		rsc:      []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	if err := newTestWifi(f).installKeys(apAddr, k); err != nil {
+		t.Fatal(err)
+	}
+	nk := f.find(cmdNewKey)
+	if len(nk) != 2 {
+		t.Fatalf("got %d NEW_KEY requests, want 2", len(nk))
+	}
+	pw, gr := nk[0].attrs, nk[1].attrs
+	if !bytes.Equal(pw[attrKeyData], k.tk) || !bytes.Equal(pw[attrMAC], apAddr) {
+		t.Errorf("pairwise key %v", pw)
+	}
+	if typ, _ := pw.U32(nlattr.Native, attrKeyType); typ != keyTypePairwise {
+		t.Errorf("pairwise key type = %d", typ)
+	}
+	if !bytes.Equal(gr[attrKeyData], k.gtk) || !bytes.Equal(gr[attrKeyIdx], []byte{1}) || !bytes.Equal(gr[attrKeySeq], k.rsc[:6]) {
+		t.Errorf("group key %v", gr)
+	}
+	if _, ok := gr[attrMAC]; ok {
+		t.Errorf("group key has a MAC")
+	}
+	ss := f.find(cmdSetStation)
+	if len(ss) != 1 {
+		t.Fatalf("got %d SET_STATION requests, want 1", len(ss))
+	}
+	if got, want := ss[0].attrs[attrStaFlags2], []byte{2, 0, 0, 0, 2, 0, 0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("station flags = %v, want %v", got, want)
+	}
+}
+
+func TestIwconfigArgs(t *testing.T) {
+	interfaceByName = func(string) (*net.Interface, error) {
+		return testIface, nil
+	}
+	dial = func() (genl, error) {
+		return nil, fmt.Errorf("dialed")
+	}
+	defer func() {
+		interfaceByName = net.InterfaceByName
+		dial = func() (genl, error) {
+			return dialGenl("nl80211")
+		}
+	}()
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "missing"},
+		{[]string{"scan"}, "missing"},
+		{[]string{"connect", "wlan0"}, "missing SSID"},
+		{[]string{"fly", "wlan0"}, "unknown command"},
+		{[]string{"scan", "wlan0", "extra"}, "unexpected"},
+		{[]string{"status", "wlan0", "-psk", "password"}, "only for connect"},
+		{[]string{"scan", "wlan0", "-timeout", "soon"}, "invalid value"},
+		{[]string{"scan", "wlan0", "-timeout", "1s"}, "dialed"},
+		{[]string{"connect", "wlan0", "home", "-psk", "password"}, "dialed"},
+	} {
+		if err := iwconfig(&bytes.Buffer{}, tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("iwconfig(%q) = %v, want error containing %q", tt.args, err, tt.want)
+		}
+	}
+}
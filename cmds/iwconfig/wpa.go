@@ -0,0 +1,402 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/sys/unix"
+)
+
+// ethPAE is the EtherType of EAPOL.
+const ethPAE = 0x888e
+
+// EAPOL-Key key information bits, from IEEE 802.11-2016 12.7.2.
+const (
+	keyInfoVersionAES = 2 // HMAC-SHA1 MIC and AES key wrap.
+	keyInfoVersion    = 7
+	keyInfoPairwise   = 1 << 3
+	keyInfoInstall    = 1 << 6
+	keyInfoAck        = 1 << 7
+	keyInfoMIC        = 1 << 8
+	keyInfoSecure     = 1 << 9
+	keyInfoEncrypted  = 1 << 12
+)
+
+const (
+	eapolVersion    = 2
+	eapolTypeKey    = 3
+	keyDescRSN      = 2
+	eapolHeaderLen  = 4
+	keyFrameLen     = 95
+	micOffset       = eapolHeaderLen + 77
+	keyDataLenOff   = eapolHeaderLen + 93
+	nonceLen        = 32
+	ptkLen          = 48
+	pmkLen          = 32
+	wpaIterations   = 4096
+	keyWrapBlockLen = 8
+)
+
+// pmk returns the pairwise master key for a passphrase or a hex PSK.
+func pmk(psk, ssid string) ([]byte, error) {
+	if len(psk) == 2*pmkLen {
+		if k, err := hex.DecodeString(psk); err == nil {
+			return k, nil
+		}
+	}
+	if len(psk) < 8 || len(psk) > 63 {
+		return nil, fmt.Errorf("passphrase must be 8..63 characters")
+	}
+	return pbkdf2.Key([]byte(psk), []byte(ssid), wpaIterations, pmkLen, sha1.New), nil
+}
+
+// prf is the IEEE 802.11 PRF with HMAC-SHA1, returning n bytes.
+func prf(key []byte, label string, data []byte, n int) []byte {
+	var out []byte
+	for i := byte(0); len(out) < n; i++ {
+		h := hmac.New(sha1.New, key)
+		h.Write([]byte(label))
+		h.Write([]byte{0})
+		h.Write(data)
+		h.Write([]byte{i})
+		out = h.Sum(out)
+	}
+	return out[:n]
+}
+
+func minMax(a, b []byte) ([]byte, []byte) {
+	if bytes.Compare(a, b) < 0 {
+		return a, b
+	}
+	return b, a
+}
+
+// keys are the keys from a 4-way handshake.
+type keys struct {
+	kck, kek, tk []byte
+	gtk          []byte
+	gtkIndex     uint8
+	// rsc is the receive sequence counter of the GTK.
+	rsc []byte
+}
+
+// ptk derives the KCK, KEK and TK for CCMP.
+func ptk(pmk []byte, aa, spa net.HardwareAddr, anonce, snonce []byte) *keys {
+	var data []byte
+	a1, a2 := minMax(aa, spa)
+	n1, n2 := minMax(anonce, snonce)
+	data = append(data, a1...)
+	data = append(data, a2...)
+	data = append(data, n1...)
+	data = append(data, n2...)
+	p := prf(pmk, "Pairwise key expansion", data, ptkLen)
+	return &keys{kck: p[0:16], kek: p[16:32], tk: p[32:48]}
+}
+
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// keyUnwrap is the AES key unwrap of RFC 3394.
+func keyUnwrap(kek, c []byte) ([]byte, error) {
+	if len(c)%keyWrapBlockLen != 0 || len(c) < 3*keyWrapBlockLen {
+		return nil, fmt.Errorf("wrapped key of %d bytes", len(c))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(c)/keyWrapBlockLen - 1
+	a := append([]byte(nil), c[:8]...)
+	r := append([]byte(nil), c[8:]...)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	if !hmac.Equal(a, keyWrapIV) {
+		return nil, fmt.Errorf("key unwrap integrity check failed")
+	}
+	return r, nil
+}
+
+// keyFrame is an EAPOL-Key frame.
+type keyFrame struct {
+	info    uint16
+	keyLen  uint16
+	replay  [8]byte
+	nonce   [nonceLen]byte
+	rsc     [8]byte
+	mic     [16]byte
+	keyData []byte
+}
+
+func parseKeyFrame(b []byte) (*keyFrame, error) {
+	if len(b) < eapolHeaderLen+keyFrameLen {
+		return nil, fmt.Errorf("EAPOL frame of %d bytes is too short", len(b))
+	}
+	if b[1] != eapolTypeKey {
+		return nil, fmt.Errorf("EAPOL frame of type %d is not a key frame", b[1])
+	}
+	if b[eapolHeaderLen] != keyDescRSN {
+		return nil, fmt.Errorf("EAPOL-Key descriptor %d is not RSN", b[eapolHeaderLen])
+	}
+	k := b[eapolHeaderLen:]
+	f := &keyFrame{
+		info:   binary.BigEndian.Uint16(k[1:]),
+		keyLen: binary.BigEndian.Uint16(k[3:]),
+	}
+	copy(f.replay[:], k[5:13])
+	copy(f.nonce[:], k[13:45])
+	copy(f.rsc[:], k[61:69])
+	copy(f.mic[:], k[77:93])
+	l := int(binary.BigEndian.Uint16(k[93:]))
+	if l > len(k)-keyFrameLen {
+		return nil, fmt.Errorf("EAPOL-Key data of %d bytes in %d", l, len(k)-keyFrameLen)
+	}
+	f.keyData = k[keyFrameLen : keyFrameLen+l]
+	return f, nil
+}
+
+// marshal encodes f, computing its MIC with kck if f has keyInfoMIC.
+func (f *keyFrame) marshal(kck []byte) []byte {
+	b := make([]byte, eapolHeaderLen+keyFrameLen, eapolHeaderLen+keyFrameLen+len(f.keyData))
+	b[0] = eapolVersion
+	b[1] = eapolTypeKey
+	binary.BigEndian.PutUint16(b[2:], uint16(keyFrameLen+len(f.keyData)))
+	k := b[eapolHeaderLen:]
+	k[0] = keyDescRSN
+	binary.BigEndian.PutUint16(k[1:], f.info)
+	binary.BigEndian.PutUint16(k[3:], f.keyLen)
+	copy(k[5:], f.replay[:])
+	copy(k[13:], f.nonce[:])
+	copy(k[61:], f.rsc[:])
+	binary.BigEndian.PutUint16(k[93:], uint16(len(f.keyData)))
+	b = append(b, f.keyData...)
+	if f.info&keyInfoMIC != 0 {
+		copy(b[micOffset:], mic(kck, b))
+	}
+	return b
+}
+
+// mic is the HMAC-SHA1-128 of an EAPOL frame whose MIC field is zero.
+func mic(kck, frame []byte) []byte {
+	h := hmac.New(sha1.New, kck)
+	h.Write(frame)
+	return h.Sum(nil)[:16]
+}
+
+// verifyMIC checks the MIC of the EAPOL frame b.
+func verifyMIC(kck, b []byte) bool {
+	c := append([]byte(nil), b...)
+	got := c[micOffset : micOffset+16]
+	want := append([]byte(nil), got...)
+	for i := range got {
+		got[i] = 0
+	}
+	return hmac.Equal(mic(kck, c), want)
+}
+
+// parseGTK returns the index and key of the GTK KDE in key data.
+func parseGTK(data []byte) (uint8, []byte, error) {
+	for len(data) >= 2 {
+		typ, l := data[0], int(data[1])
+		if 2+l > len(data) {
+			break
+		}
+		body := data[2 : 2+l]
+		// The GTK KDE is vendor specific element 00-0f-ac:1, followed by
+		// the key ID, a reserved byte and the key.
+		if typ == 0xdd && l >= 6 && bytes.Equal(body[:4], []byte{0x00, 0x0f, 0xac, 1}) {
+			return body[4] & 3, append([]byte(nil), body[6:]...), nil
+		}
+		// A 0xdd with no length starts the padding.
+		if typ == 0xdd && l == 0 {
+			break
+		}
+		data = data[2+l:]
+	}
+	return 0, nil, fmt.Errorf("no GTK in EAPOL-Key data")
+}
+
+// supplicant runs our end of the 4-way handshake.
+type supplicant struct {
+	pmk     []byte
+	aa, spa net.HardwareAddr
+	// ie is the RSN IE we associated with, which message 2 repeats.
+	ie []byte
+	// apIE is the RSN IE from the AP's beacon, which message 3 must match.
+	apIE []byte
+	rand io.Reader
+
+	snonce [nonceLen]byte
+	anonce [nonceLen]byte
+	replay [8]byte
+	ptk    *keys
+}
+
+// handle processes an EAPOL-Key frame from the authenticator. It returns the
+// frame to reply with, and the keys once the handshake is complete.
+func (s *supplicant) handle(b []byte) ([]byte, *keys, error) {
+	f, err := parseKeyFrame(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.info&keyInfoVersion != keyInfoVersionAES {
+		return nil, nil, fmt.Errorf("EAPOL-Key version %d is not supported", f.info&keyInfoVersion)
+	}
+	if f.info&keyInfoPairwise == 0 || f.info&keyInfoAck == 0 {
+		return nil, nil, fmt.Errorf("unexpected EAPOL-Key frame with key info %#x", f.info)
+	}
+	if s.ptk != nil && bytes.Compare(f.replay[:], s.replay[:]) <= 0 {
+		return nil, nil, fmt.Errorf("EAPOL-Key replay counter did not increase")
+	}
+
+	if f.info&keyInfoMIC == 0 {
+		// Message 1: pick a nonce and derive the PTK.
+		if _, err := io.ReadFull(s.rand, s.snonce[:]); err != nil {
+			return nil, nil, err
+		}
+		s.anonce = f.nonce
+		s.replay = f.replay
+		s.ptk = ptk(s.pmk, s.aa, s.spa, s.anonce[:], s.snonce[:])
+		reply := &keyFrame{
+			info:    keyInfoVersionAES | keyInfoPairwise | keyInfoMIC,
+			replay:  f.replay,
+			nonce:   s.snonce,
+			keyData: s.ie,
+		}
+		return reply.marshal(s.ptk.kck), nil, nil
+	}
+
+	// Message 3.
+	if s.ptk == nil {
+		return nil, nil, fmt.Errorf("EAPOL-Key message 3 before message 1")
+	}
+	if f.nonce != s.anonce {
+		return nil, nil, fmt.Errorf("EAPOL-Key message 3 has a different ANonce")
+	}
+	if !verifyMIC(s.ptk.kck, b) {
+		return nil, nil, fmt.Errorf("EAPOL-Key message 3 has a bad MIC")
+	}
+	if f.info&keyInfoEncrypted == 0 || f.info&keyInfoInstall == 0 {
+		return nil, nil, fmt.Errorf("EAPOL-Key message 3 with key info %#x", f.info)
+	}
+	data, err := keyUnwrap(s.ptk.kek, f.keyData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.apIE != nil && !bytes.HasPrefix(data, s.apIE) {
+		return nil, nil, fmt.Errorf("RSN IE in EAPOL-Key message 3 does not match the beacon")
+	}
+	k := *s.ptk
+	if k.gtkIndex, k.gtk, err = parseGTK(data); err != nil {
+		return nil, nil, err
+	}
+	k.rsc = append([]byte(nil), f.rsc[:]...)
+	s.replay = f.replay
+	reply := &keyFrame{
+		info:   keyInfoVersionAES | keyInfoPairwise | keyInfoMIC | keyInfoSecure,
+		replay: f.replay,
+	}
+	return reply.marshal(k.kck), &k, nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// eapolConn sends and receives EAPOL frames on an interface.
+type eapolConn struct {
+	fd    int
+	iface *net.Interface
+}
+
+func dialEAPOL(iface *net.Interface, timeout time.Duration) (*eapolConn, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(ethPAE)))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(ethPAE), Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	return &eapolConn{fd: fd, iface: iface}, nil
+}
+
+func (e *eapolConn) read() ([]byte, net.HardwareAddr, error) {
+	b := make([]byte, 2048)
+	n, from, err := unix.Recvfrom(e.fd, b, 0)
+	if err == unix.EAGAIN {
+		return nil, nil, fmt.Errorf("%s: timed out waiting for EAPOL", e.iface.Name)
+	}
+	if err != nil {
+		return nil, nil, os.NewSyscallError("recvfrom", err)
+	}
+	var addr net.HardwareAddr
+	if ll, ok := from.(*unix.SockaddrLinklayer); ok {
+		addr = net.HardwareAddr(append([]byte(nil), ll.Addr[:ll.Halen]...))
+	}
+	return b[:n], addr, nil
+}
+
+func (e *eapolConn) write(b []byte, to net.HardwareAddr) error {
+	sa := &unix.SockaddrLinklayer{Protocol: htons(ethPAE), Ifindex: e.iface.Index, Halen: uint8(len(to))}
+	copy(sa.Addr[:], to)
+	return os.NewSyscallError("sendto", unix.Sendto(e.fd, b, 0, sa))
+}
+
+func (e *eapolConn) close() error {
+	return unix.Close(e.fd)
+}
+
+// handshake runs the 4-way handshake with the AP at aa.
+func handshake(e *eapolConn, s *supplicant) (*keys, error) {
+	for {
+		b, from, err := e.read()
+		if err != nil {
+			return nil, err
+		}
+		if from != nil && !bytes.Equal(from, s.aa) {
+			continue
+		}
+		reply, k, err := s.handle(b)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.write(reply, s.aa); err != nil {
+			return nil, err
+		}
+		if k != nil {
+			return k, nil
+		}
+	}
+}
+
+func newSupplicant(pmk []byte, aa, spa net.HardwareAddr, apIE []byte) *supplicant {
+	return &supplicant{pmk: pmk, aa: aa, spa: spa, ie: rsnIE, apIE: apIE, rand: rand.Reader}
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// keyWrap is the AES key wrap of RFC 3394, which the authenticator uses.
+func keyWrap(t *testing.T, kek, p []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(p) / 8
+	a := append([]byte(nil), keyWrapIV...)
+	r := append([]byte(nil), p...)
+	b := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b)^uint64(n*j+i))
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+func TestPMK(t *testing.T) {
+	// The first passphrase test vector of IEEE 802.11 Annex J.
+	want := unhex(t, "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e")
+	k, err := pmk("password", "IEEE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k, want) {
+		t.Errorf("pmk = %x, want %x", k, want)
+	}
+	k, err = pmk(hex.EncodeToString(want), "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k, want) {
+		t.Errorf("pmk of a hex PSK = %x, want %x", k, want)
+	}
+	for _, p := range []string{"short", string(make([]byte, 64))} {
+		if _, err := pmk(p, "IEEE"); err == nil {
+			t.Errorf("pmk(%q) = nil, want error", p)
+		}
+	}
+}
+
+func TestKeyUnwrap(t *testing.T) {
+	// From RFC 3394 4.1.
+	kek := unhex(t, "000102030405060708090a0b0c0d0e0f")
+	key := unhex(t, "00112233445566778899aabbccddeeff")
+	c := unhex(t, "1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5")
+	if got := keyWrap(t, kek, key); !bytes.Equal(got, c) {
+		t.Errorf("keyWrap = %x, want %x", got, c)
+	}
+	got, err := keyUnwrap(kek, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("keyUnwrap = %x, want %x", got, key)
+	}
+	c[3] ^= 1
+	if _, err := keyUnwrap(kek, c); err == nil {
+		t.Errorf("keyUnwrap of a corrupt key = nil, want error")
+	}
+	if _, err := keyUnwrap(kek, c[:12]); err == nil {
+		t.Errorf("keyUnwrap of 12 bytes = nil, want error")
+	}
+}
+
+// authenticator is the AP's end of the 4-way handshake.
+type authenticator struct {
+	t      *testing.T
+	pmk    []byte
+	aa     []byte
+	spa    []byte
+	anonce [nonceLen]byte
+	gtk    []byte
+	ptk    *keys
+}
+
+func (a *authenticator) msg1() []byte {
+	f := &keyFrame{
+		info:   keyInfoVersionAES | keyInfoPairwise | keyInfoAck,
+		replay: [8]byte{7: 1},
+		nonce:  a.anonce,
+	}
+	return f.marshal(nil)
+}
+
+// msg3 checks message 2 and answers it.
+func (a *authenticator) msg3(msg2 []byte, rsn []byte) []byte {
+	t := a.t
+	f, err := parseKeyFrame(msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.info != keyInfoVersionAES|keyInfoPairwise|keyInfoMIC {
+		t.Errorf("message 2 key info = %#x", f.info)
+	}
+	if f.replay != [8]byte{7: 1} {
+		t.Errorf("message 2 replay counter = %v", f.replay)
+	}
+	if !bytes.Equal(f.keyData, rsnIE) {
+		t.Errorf("message 2 key data = % x, want our RSN IE", f.keyData)
+	}
+	a.ptk = ptk(a.pmk, a.aa, a.spa, a.anonce[:], f.nonce[:])
+	if !verifyMIC(a.ptk.kck, msg2) {
+		t.Fatalf("message 2 has a bad MIC")
+	}
+	return a.build(rsn)
+}
+
+// build returns message 3 with the RSN IE rsn.
+func (a *authenticator) build(rsn []byte) []byte {
+	data := append([]byte(nil), rsn...)
+	data = append(data, 0xdd, byte(6+len(a.gtk)), 0x00, 0x0f, 0xac, 1, 2, 0)
+	data = append(data, a.gtk...)
+	data = append(data, 0xdd)
+	for len(data)%8 != 0 {
+		data = append(data, 0)
+	}
+	m := &keyFrame{
+		info:    keyInfoVersionAES | keyInfoPairwise | keyInfoAck | keyInfoInstall | keyInfoMIC | keyInfoSecure | keyInfoEncrypted,
+		keyLen:  16,
+		replay:  [8]byte{7: 2},
+		nonce:   a.anonce,
+		rsc:     [8]byte{5, 4, 3, 2, 1},
+		keyData: keyWrap(a.t, a.ptk.kek, data),
+	}
+	return m.marshal(a.ptk.kck)
+}
+
+func newHandshake(t *testing.T) (*authenticator, *supplicant) {
+	key, err := pmk("correct horse battery", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{
+		t:   t,
+		pmk: key,
+		aa:  apAddr,
+		spa: testIface.HardwareAddr,
+		gtk: bytes.Repeat([]byte{0x77}, 16),
+	}
+	copy(a.anonce[:], bytes.Repeat([]byte{0xaa}, nonceLen))
+	s := newSupplicant(key, apAddr, testIface.HardwareAddr, rsnIE)
+	s.rand = bytes.NewReader(bytes.Repeat([]byte{0x55}, nonceLen))
+	return a, s
+}
+
+func TestHandshake(t *testing.T) {
+	a, s := newHandshake(t)
+
+	msg2, k, err := s.handle(a.msg1())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != nil {
+		t.Fatalf("handshake done after message 1")
+	}
+	msg4, k, err := s.handle(a.msg3(msg2, rsnIE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k == nil {
+		t.Fatalf("no keys after message 3")
+	}
+
+	f, err := parseKeyFrame(msg4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.info != keyInfoVersionAES|keyInfoPairwise|keyInfoMIC|keyInfoSecure {
+		t.Errorf("message 4 key info = %#x", f.info)
+	}
+	if f.replay != [8]byte{7: 2} {
+		t.Errorf("message 4 replay counter = %v", f.replay)
+	}
+	if !verifyMIC(a.ptk.kck, msg4) {
+		t.Errorf("message 4 has a bad MIC")
+	}
+
+	if !bytes.Equal(k.tk, a.ptk.tk) {
+		t.Errorf("TK = %x, want %x", k.tk, a.ptk.tk)
+	}
+	if !bytes.Equal(k.gtk, a.gtk) || k.gtkIndex != 2 {
+		t.Errorf("GTK = %x index %d, want %x index 2", k.gtk, k.gtkIndex, a.gtk)
+	}
+	if !bytes.Equal(k.rsc, []byte{5, 4, 3, 2, 1, 0, 0, 0}) {
+		t.Errorf("RSC = %v", k.rsc)
+	}
+
+	// A replay of message 3 is dropped.
+	if _, _, err := s.handle(a.msg3(msg2, rsnIE)); err == nil {
+		t.Errorf("replayed message 3 = nil, want error")
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	t.Run("bad MIC", func(t *testing.T) {
+		a, s := newHandshake(t)
+		msg2, _, _ := s.handle(a.msg1())
+		msg3 := a.msg3(msg2, rsnIE)
+		msg3[len(msg3)-1] ^= 1
+		if _, _, err := s.handle(msg3); err == nil {
+			t.Errorf("message 3 with a bad MIC = nil, want error")
+		}
+	})
+	t.Run("wrong passphrase", func(t *testing.T) {
+		a, s := newHandshake(t)
+		s.pmk, _ = pmk("wrong horse battery", "home")
+		msg2, _, _ := s.handle(a.msg1())
+		f, err := parseKeyFrame(msg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.ptk = ptk(a.pmk, a.aa, a.spa, a.anonce[:], f.nonce[:])
+		if verifyMIC(a.ptk.kck, msg2) {
+			t.Errorf("message 2 with the wrong passphrase has a good MIC")
+		}
+		if _, _, err := s.handle(a.build(rsnIE)); err == nil {
+			t.Errorf("handshake with the wrong passphrase = nil, want error")
+		}
+	})
+	t.Run("downgraded RSN IE", func(t *testing.T) {
+		a, s := newHandshake(t)
+		msg2, _, _ := s.handle(a.msg1())
+		other := append([]byte(nil), rsnIE...)
+		other[7] = 2 // TKIP group cipher.
+		if _, _, err := s.handle(a.msg3(msg2, other)); err == nil {
+			t.Errorf("message 3 with a different RSN IE = nil, want error")
+		}
+	})
+	t.Run("message 3 first", func(t *testing.T) {
+		a, s := newHandshake(t)
+		_, s2 := newHandshake(t)
+		msg2, _, _ := s2.handle(a.msg1())
+		if _, _, err := s.handle(a.msg3(msg2, rsnIE)); err == nil {
+			t.Errorf("message 3 before message 1 = nil, want error")
+		}
+	})
+	t.Run("not a key frame", func(t *testing.T) {
+		_, s := newHandshake(t)
+		if _, _, err := s.handle([]byte{2, 0, 0, 0}); err == nil {
+			t.Errorf("EAPOL start = nil, want error")
+		}
+	})
+}
+
+func TestPRF(t *testing.T) {
+	// The second PRF test vector of IEEE 802.11 Annex J.
+	want := unhex(t, "51f4de5b33f249adf81aeb713a3c20f4fe631446fabdfa58244759ae58ef9009a99abf4eac2ca5fa87e692c440eb40023e7babb206d61de7b92f41529092b8fc")
+	if got := prf([]byte("Jefe"), "prefix", []byte("what do ya want for nothing?"), 64); !bytes.Equal(got, want) {
+		t.Errorf("prf = %x, want %x", got, want)
+	}
+}
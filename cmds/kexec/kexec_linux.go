@@ -5,46 +5,100 @@
 // kexec executes a new kernel over the running kernel (u-root).
 //
 // Synopsis:
-//     kexec [--initrd=FILE] [--command-line=STRING] [-l] [-e] [KERNELIMAGE]
+//     kexec [--initrd=FILE] [--cmdline=STRING | --reuse-cmdline]
+//           [--override-param=KEY=VALUE]... [--remove-param=KEY]...
+//           [--append=STRING] [-l] [-e] [--json] [--dry-run] [KERNELIMAGE]
 //
 // Description:
 //		 Loads a kernel for later execution.
 //
 // Options:
 //     --cmdline=STRING or -c=STRING: Set the kernel command line
-//     --reuse-commandline:           Use the kernel command line from running system
+//     --reuse-cmdline:               Use the kernel command line from running system
+//     --override-param=KEY=VALUE:    Replace or add a kernel parameter (repeatable)
+//     --remove-param=KEY:            Remove a kernel parameter (repeatable)
+//     --append=STRING:               Append STRING to the kernel command line
 //     --i=FILE or --initrd=FILE:     Use file as the kernel's initial ramdisk
 //     -l or --load:                  Load the new kernel into the current kernel
 //     -e or --exec:		      Execute a currently loaded kernel
+//     --json:                        Print what is loaded as JSON to stdout first
+//     --dry-run:                     Print the memory map of the segments
+//                                    kexec_load(2) would be given, and
+//                                    overlaps between them, without loading
 package main
 
 import (
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	flag "github.com/spf13/pflag"
+	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/pkg/kexec"
 )
 
 type options struct {
-	cmdline      string
-	reuseCmdline bool
-	initramfs    string
-	load         bool
-	exec         bool
+	cmdline        string
+	reuseCmdline   bool
+	overrideParams []string
+	removeParams   []string
+	appendCmdline  string
+	initramfs      string
+	load           bool
+	exec           bool
+	json           bool
+	dryRun         bool
 }
 
+// procCmdline is the command line of the running kernel.
+var procCmdline = "/proc/cmdline"
+
 func registerFlags() *options {
 	o := &options{}
 	flag.StringVarP(&o.cmdline, "cmdline", "c", "", "Set the kernel command line")
 	flag.BoolVar(&o.reuseCmdline, "reuse-cmdline", false, "Use the kernel command line from running system")
+	flag.StringArrayVar(&o.overrideParams, "override-param", nil, "Replace or add the kernel parameter KEY=VALUE; may be repeated")
+	flag.StringArrayVar(&o.removeParams, "remove-param", nil, "Remove the kernel parameter KEY; may be repeated")
+	flag.StringVar(&o.appendCmdline, "append", "", "Append to the kernel command line")
 	flag.StringVarP(&o.initramfs, "initrd", "i", "", "Use file as the kernel's initial ramdisk")
 	flag.BoolVarP(&o.load, "load", "l", false, "Load the new kernel into the current kernel")
 	flag.BoolVarP(&o.exec, "exec", "e", false, "Execute a currently loaded kernel")
+	flag.BoolVar(&o.json, "json", false, "Print what is loaded as JSON to stdout first")
+	flag.BoolVar(&o.dryRun, "dry-run", false, "Print the memory map of the segments kexec_load(2) would be given, without loading")
 	return o
 }
 
+// newCmdline returns the command line of the new kernel: --cmdline or that
+// of the running kernel, with parameters removed, then overridden, then
+// appended.
+func newCmdline(o *options) (string, error) {
+	c := o.cmdline
+	if o.reuseCmdline {
+		b, err := ioutil.ReadFile(procCmdline)
+		if err != nil {
+			return "", err
+		}
+		c = strings.TrimSpace(string(b))
+	}
+	for _, key := range o.removeParams {
+		c = cmdline.RemoveParam(c, key)
+	}
+	for _, p := range o.overrideParams {
+		key, value := p, ""
+		if i := strings.Index(p, "="); i >= 0 {
+			key, value = p[:i], p[i+1:]
+		}
+		c = cmdline.OverrideParam(c, cmdline.Param(key, value))
+	}
+	if o.appendCmdline != "" {
+		c = cmdline.AppendCmdline(c, o.appendCmdline)
+	}
+	return c, nil
+}
+
 func main() {
 	opts := registerFlags()
 	flag.Parse()
@@ -59,19 +113,16 @@ func main() {
 		log.Fatalf("--reuse-cmdline and other command line options are mutually exclusive")
 	}
 
-	if opts.load == false && opts.exec == false {
+	if opts.dryRun {
+		opts.load, opts.exec = true, false
+	} else if opts.load == false && opts.exec == false {
 		opts.load = true
 		opts.exec = true
 	}
 
-	newCmdLine := opts.cmdline
-	if opts.reuseCmdline {
-		procCmdLine := cmdline.NewCmdLine()
-		if procCmdLine.Err != nil {
-			log.Fatal("Couldn't read /proc/cmdline")
-		} else {
-			newCmdLine = procCmdLine.Raw
-		}
+	newCmdLine, err := newCmdline(opts)
+	if err != nil {
+		log.Fatalf("Couldn't read the running kernel's command line: %v", err)
 	}
 
 	if opts.load {
@@ -93,6 +144,28 @@ func main() {
 			defer ramfs.Close()
 		}
 
+		if opts.json {
+			var initrd io.ReaderAt
+			if ramfs != nil {
+				initrd = ramfs
+			}
+			if err := boot.NewLinuxImage(kernel, initrd, newCmdLine).ExecutionInfoJSON(os.Stdout); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+
+		if opts.dryRun {
+			segs, err := kexec.InspectSegments(kernel, ramfs, newCmdLine)
+			if err != nil {
+				log.Fatalf("Inspecting segments: %v", err)
+			}
+			boot.VisualizeSegments(segs, os.Stdout)
+			if len(boot.SegmentConflicts(segs)) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
 		if err := kexec.FileLoad(kernel, ramfs, newCmdLine); err != nil {
 			log.Fatalf("%v", err)
 		}
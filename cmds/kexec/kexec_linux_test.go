@@ -0,0 +1,77 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewCmdline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	procCmdline = filepath.Join(dir, "cmdline")
+	if err := ioutil.WriteFile(procCmdline, []byte("console=ttyS0 root=/dev/sda1 quiet -- single\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		o    options
+		want string
+	}{
+		{
+			name: "cmdline",
+			o:    options{cmdline: "root=/dev/sdb1", appendCmdline: "ro"},
+			want: "root=/dev/sdb1 ro",
+		},
+		{
+			name: "reuse",
+			o:    options{reuseCmdline: true},
+			want: "console=ttyS0 root=/dev/sda1 quiet -- single",
+		},
+		{
+			name: "override and add",
+			o: options{
+				reuseCmdline:   true,
+				overrideParams: []string{"root=/dev/sdb2", "init=/bin/sh", "uroot.initflags=a b"},
+			},
+			want: `console=ttyS0 root=/dev/sdb2 quiet init=/bin/sh uroot.initflags="a b" -- single`,
+		},
+		{
+			name: "remove and append",
+			o: options{
+				reuseCmdline:  true,
+				removeParams:  []string{"quiet", "console"},
+				appendCmdline: "loglevel=7",
+			},
+			want: "root=/dev/sda1 -- single loglevel=7",
+		},
+		{
+			name: "remove then override",
+			o: options{
+				reuseCmdline:   true,
+				removeParams:   []string{"console"},
+				overrideParams: []string{"console=tty0"},
+			},
+			want: "root=/dev/sda1 quiet console=tty0 -- single",
+		},
+	} {
+		got, err := newCmdline(&tt.o)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: newCmdline() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	procCmdline = filepath.Join(dir, "missing")
+	if _, err := newCmdline(&options{reuseCmdline: true}); err == nil {
+		t.Errorf("newCmdline() with a missing %s = nil, want error", procCmdline)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// ldd prints the shared libraries ELF files need.
+//
+// Synopsis:
+//     ldd FILE...
+//
+// Description:
+//     ldd reads DT_NEEDED from the dynamic section of each FILE and of the
+//     libraries it needs, and finds them the way ld.so would: in DT_RPATH,
+//     LD_LIBRARY_PATH, DT_RUNPATH, /etc/ld.so.cache, the directories in
+//     /etc/ld.so.conf and the default directories. Unlike GNU ldd, it does
+//     not run ld.so, so it works on files for other machines too.
+//
+//     The address printed is the one a library is linked at, which is 0
+//     for position independent libraries.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/u-root/u-root/pkg/ldd"
+)
+
+func run(w io.Writer, r *ldd.Resolver, names []string) error {
+	for _, n := range names {
+		deps, err := r.Needed(n)
+		if err != nil {
+			return err
+		}
+		if len(names) > 1 {
+			fmt.Fprintf(w, "%s:\n", n)
+		}
+		for _, d := range deps {
+			if d.Path == "" {
+				fmt.Fprintf(w, "\t%s => not found\n", d.Name)
+				continue
+			}
+			fmt.Fprintf(w, "\t%s => %s (%#016x)\n", d.Name, d.Path, d.Addr)
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("Usage: ldd FILE...")
+	}
+	r, err := ldd.NewResolver()
+	if err != nil {
+		log.Fatalf("ldd: %v", err)
+	}
+	if err := run(os.Stdout, r, os.Args[1:]); err != nil {
+		log.Fatalf("ldd: %v", err)
+	}
+}
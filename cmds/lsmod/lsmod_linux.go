@@ -5,45 +5,199 @@
 // List modules currently loaded in the Linux kernel
 //
 // Synopsis:
-//	lsmod
+//	lsmod [-v] [--json]
 //
 // Description:
 //	lsmod is a clone of lsmod(8)
 //
+// Options:
+//	-v, --verbose: also show the parameters of each module and the
+//	               modules holding it, as a tree
+//	--json:        use JSON for output
+//
 // Author:
 //     Roland Kammerer <dev.rck@gmail.com>
 package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+
+	flag "github.com/spf13/pflag"
 )
 
+var (
+	verbose = flag.BoolP("verbose", "v", false, "Show module parameters and holders")
+	toJSON  = flag.Bool("json", false, "Use JSON for output")
+
+	procModules = "/proc/modules"
+	sysModule   = "/sys/module"
+)
+
+// module is a line of /proc/modules and, with -v, what /sys/module has about
+// it.
+type module struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+	// Used is the use count.
+	Used   int      `json:"used"`
+	UsedBy []string `json:"used_by"`
+	// State is Live, Loading or Unloading.
+	State   string `json:"state"`
+	Address string `json:"address"`
+
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Holders    []string          `json:"holders,omitempty"`
+}
+
+// parseModules parses r, in the format of /proc/modules:
+//	name size used used,by, state address [taints]
+func parseModules(r io.Reader) ([]module, error) {
+	var mods []module
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s := strings.Fields(scanner.Text())
+		if len(s) == 0 {
+			continue
+		}
+		if len(s) < 6 {
+			return nil, fmt.Errorf("%q: want at least 6 fields, got %d", scanner.Text(), len(s))
+		}
+		m := module{Name: s[0], State: s[4], Address: s[5], UsedBy: []string{}}
+		var err error
+		if m.Size, err = strconv.ParseUint(s[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: bad size: %v", m.Name, err)
+		}
+		if m.Used, err = strconv.Atoi(s[2]); err != nil {
+			return nil, fmt.Errorf("%s: bad use count: %v", m.Name, err)
+		}
+		if s[3] != "-" {
+			for _, u := range strings.Split(s[3], ",") {
+				if u != "" {
+					m.UsedBy = append(m.UsedBy, u)
+				}
+			}
+		}
+		mods = append(mods, m)
+	}
+	return mods, scanner.Err()
+}
+
+// readSysModule fills in the parameters and holders of m from sysModule.
+// Modules built into the kernel, or without parameters or holders, have no
+// directory for them.
+func readSysModule(m *module) error {
+	dir := filepath.Join(sysModule, m.Name)
+	params, err := ioutil.ReadDir(filepath.Join(dir, "parameters"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, p := range params {
+		if m.Parameters == nil {
+			m.Parameters = make(map[string]string)
+		}
+		// Some parameters can only be written.
+		v, err := ioutil.ReadFile(filepath.Join(dir, "parameters", p.Name()))
+		if err != nil {
+			m.Parameters[p.Name()] = "?"
+			continue
+		}
+		m.Parameters[p.Name()] = strings.TrimSuffix(string(v), "\n")
+	}
+	holders, err := ioutil.ReadDir(filepath.Join(dir, "holders"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, h := range holders {
+		m.Holders = append(m.Holders, h.Name())
+	}
+	return nil
+}
+
+// printHolders prints the modules holding name, and the ones holding them,
+// as a tree. seen stops it from going around a loop.
+func printHolders(w io.Writer, byName map[string]*module, name, indent string, seen map[string]bool) {
+	m, ok := byName[name]
+	if !ok {
+		return
+	}
+	seen[name] = true
+	for _, h := range m.Holders {
+		fmt.Fprintf(w, "%s%s\n", indent, h)
+		if !seen[h] {
+			printHolders(w, byName, h, indent+"  ", seen)
+		}
+	}
+	delete(seen, name)
+}
+
+func lsmod(w io.Writer, mods []module, verbose bool) {
+	byName := make(map[string]*module)
+	for i := range mods {
+		byName[mods[i].Name] = &mods[i]
+	}
+
+	fmt.Fprintln(w, "Module                  Size  Used by")
+	for _, m := range mods {
+		final := fmt.Sprintf("%-19s %8d  %d", m.Name, m.Size, m.Used)
+		if len(m.UsedBy) > 0 {
+			final += " " + strings.Join(m.UsedBy, ",")
+		}
+		fmt.Fprintln(w, final)
+		if !verbose {
+			continue
+		}
+		var params []string
+		for p := range m.Parameters {
+			params = append(params, p)
+		}
+		sort.Strings(params)
+		for _, p := range params {
+			fmt.Fprintf(w, "    parm %s=%s\n", p, m.Parameters[p])
+		}
+		if len(m.Holders) > 0 {
+			fmt.Fprintln(w, "    holders:")
+			printHolders(w, byName, m.Name, "      ", map[string]bool{})
+		}
+	}
+}
+
 func main() {
-	file, err := os.Open("/proc/modules")
+	flag.Parse()
+
+	file, err := os.Open(procModules)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer file.Close()
-
-	fmt.Println("Module                  Size  Used by")
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		s := strings.Split(scanner.Text(), " ")
-		name, size, used, usedBy := s[0], s[1], s[2], s[3]
-		final := fmt.Sprintf("%-19s %8s  %s", name, size, used)
-		if usedBy != "-" {
-			usedBy = usedBy[:len(usedBy)-1]
-			final += fmt.Sprintf(" %s", usedBy)
+	mods, err := parseModules(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *verbose {
+		for i := range mods {
+			if err := readSysModule(&mods[i]); err != nil {
+				log.Fatal(err)
+			}
 		}
-		fmt.Println(final)
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	if *toJSON {
+		jsonData, err := json.Marshal(mods)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(jsonData))
+		return
 	}
+	lsmod(os.Stdout, mods, *verbose)
 }
@@ -0,0 +1,134 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const procModulesContent = `nft_chain_nat 16384 3 - Live 0xffffffffc0b3a000
+nf_nat 49152 1 nft_chain_nat, Live 0xffffffffc0b2d000
+nf_conntrack 172032 2 nf_nat,nft_chain_nat, Live 0xffffffffc0aff000
+vboxdrv 491520 0 - Loading 0x0000000000000000 (OE)
+`
+
+var wantModules = []module{
+	{Name: "nft_chain_nat", Size: 16384, Used: 3, UsedBy: []string{}, State: "Live", Address: "0xffffffffc0b3a000"},
+	{Name: "nf_nat", Size: 49152, Used: 1, UsedBy: []string{"nft_chain_nat"}, State: "Live", Address: "0xffffffffc0b2d000"},
+	{Name: "nf_conntrack", Size: 172032, Used: 2, UsedBy: []string{"nf_nat", "nft_chain_nat"}, State: "Live", Address: "0xffffffffc0aff000"},
+	{Name: "vboxdrv", Size: 491520, Used: 0, UsedBy: []string{}, State: "Loading", Address: "0x0000000000000000"},
+}
+
+func TestParseModules(t *testing.T) {
+	mods, err := parseModules(strings.NewReader(procModulesContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mods, wantModules) {
+		t.Errorf("parseModules() = %+v, want %+v", mods, wantModules)
+	}
+
+	for _, bad := range []string{
+		"nf_nat 49152 1 - Live\n",
+		"nf_nat big 1 - Live 0x0\n",
+		"nf_nat 49152 one - Live 0x0\n",
+	} {
+		if _, err := parseModules(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseModules(%q) = nil, want error", bad)
+		}
+	}
+}
+
+func TestLsmod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { sysModule = old }(sysModule)
+	sysModule = dir
+
+	for _, f := range []string{
+		"nf_conntrack/parameters/hashsize=16384\n",
+		"nf_conntrack/parameters/expect_hashsize=256\n",
+		"nf_conntrack/holders/nf_nat",
+		"nf_conntrack/holders/nft_chain_nat",
+		"nf_nat/holders/nft_chain_nat",
+		"nft_chain_nat/parameters/",
+	} {
+		kv := strings.SplitN(f, "=", 2)
+		p := filepath.Join(dir, kv[0])
+		if strings.HasSuffix(f, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var v string
+		if len(kv) == 2 {
+			v = kv[1]
+		}
+		if err := ioutil.WriteFile(p, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mods, err := parseModules(strings.NewReader(procModulesContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	lsmod(&b, mods, false)
+	want := `Module                  Size  Used by
+nft_chain_nat          16384  3
+nf_nat                 49152  1 nft_chain_nat
+nf_conntrack          172032  2 nf_nat,nft_chain_nat
+vboxdrv               491520  0
+`
+	if b.String() != want {
+		t.Errorf("lsmod = %q, want %q", b.String(), want)
+	}
+
+	for i := range mods {
+		if err := readSysModule(&mods[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := map[string]string{"hashsize": "16384", "expect_hashsize": "256"}; !reflect.DeepEqual(mods[2].Parameters, want) {
+		t.Errorf("nf_conntrack parameters = %v, want %v", mods[2].Parameters, want)
+	}
+	if mods[0].Parameters != nil || mods[3].Parameters != nil {
+		t.Errorf("parameters of nft_chain_nat = %v and vboxdrv = %v, want none", mods[0].Parameters, mods[3].Parameters)
+	}
+
+	b.Reset()
+	lsmod(&b, mods, true)
+	want = `Module                  Size  Used by
+nft_chain_nat          16384  3
+nf_nat                 49152  1 nft_chain_nat
+    holders:
+      nft_chain_nat
+nf_conntrack          172032  2 nf_nat,nft_chain_nat
+    parm expect_hashsize=256
+    parm hashsize=16384
+    holders:
+      nf_nat
+        nft_chain_nat
+      nft_chain_nat
+vboxdrv               491520  0
+`
+	if b.String() != want {
+		t.Errorf("lsmod -v = %q, want %q", b.String(), want)
+	}
+}
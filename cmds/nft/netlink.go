@@ -0,0 +1,165 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+	"golang.org/x/sys/unix"
+)
+
+// nf_tables messages, from linux/netfilter/nf_tables.h.
+const (
+	msgNewTable = 0
+	msgGetTable = 1
+	msgDelTable = 2
+	msgNewChain = 3
+	msgGetChain = 4
+	msgDelChain = 5
+	msgNewRule  = 6
+	msgGetRule  = 7
+)
+
+// nf_tables attributes are in network byte order.
+var be = binary.BigEndian
+
+// nfMsg is an nf_tables message.
+type nfMsg struct {
+	typ    uint16
+	flags  uint16
+	family uint8
+	attrs  []nlattr.Attr
+}
+
+// reply is an nf_tables message from the kernel.
+type reply struct {
+	family uint8
+	attrs  nlattr.Map
+}
+
+// conn is a netfilter netlink socket.
+type conn struct {
+	fd  int
+	seq uint32
+}
+
+func dial() (*conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &conn{fd: fd}, nil
+}
+
+func (c *conn) close() error {
+	return unix.Close(c.fd)
+}
+
+// marshal appends a netlink message with an nfgenmsg header to b.
+func (c *conn) marshal(b []byte, typ, flags uint16, family uint8, resID uint16, attrs []nlattr.Attr) ([]byte, uint32) {
+	c.seq++
+	body := nlattr.Encode(attrs)
+	h := make([]byte, unix.SizeofNlMsghdr+4)
+	nlattr.Native.PutUint32(h[0:], uint32(len(h)+len(body)))
+	nlattr.Native.PutUint16(h[4:], typ)
+	nlattr.Native.PutUint16(h[6:], flags|unix.NLM_F_REQUEST)
+	nlattr.Native.PutUint32(h[8:], c.seq)
+	h[unix.SizeofNlMsghdr] = family
+	h[unix.SizeofNlMsghdr+1] = unix.NFNETLINK_V0
+	be.PutUint16(h[unix.SizeofNlMsghdr+2:], resID)
+	return append(append(b, h...), body...), c.seq
+}
+
+func nftType(msg uint16) uint16 {
+	return unix.NFNL_SUBSYS_NFTABLES<<8 | msg
+}
+
+func (c *conn) receive() ([]nlattr.Message, error) {
+	b := make([]byte, 64<<10)
+	n, _, err := unix.Recvfrom(c.fd, b, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("recvfrom", err)
+	}
+	return nlattr.ParseMessages(b[:n])
+}
+
+// commit sends msgs as one transaction, which the kernel applies entirely
+// or not at all.
+func (c *conn) commit(msgs []nfMsg) error {
+	b, _ := c.marshal(nil, unix.NFNL_MSG_BATCH_BEGIN, 0, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES, nil)
+	pending := make(map[uint32]int)
+	for i, m := range msgs {
+		var seq uint32
+		b, seq = c.marshal(b, nftType(m.typ), m.flags|unix.NLM_F_ACK, m.family, 0, m.attrs)
+		pending[seq] = i
+	}
+	b, _ = c.marshal(b, unix.NFNL_MSG_BATCH_END, 0, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES, nil)
+	if err := unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	// Every message is acked, or the first failing one gets an error and
+	// the rest are not processed.
+	for len(pending) > 0 {
+		rs, err := c.receive()
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if _, ok := pending[r.Seq]; !ok || r.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			delete(pending, r.Seq)
+			if err := r.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dump returns all objects for a GET message, in all families.
+func (c *conn) dump(typ uint16) ([]reply, error) {
+	b, seq := c.marshal(nil, nftType(typ), unix.NLM_F_DUMP, unix.AF_UNSPEC, 0, nil)
+	if err := unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+	var replies []reply
+	for {
+		rs, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			if r.Seq != seq {
+				continue
+			}
+			switch r.Type {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if err := r.Err(); err != nil {
+					return nil, err
+				}
+			default:
+				if len(r.Data) < 4 {
+					return nil, fmt.Errorf("short nf_tables message")
+				}
+				a, err := nlattr.ParseMap(r.Data[4:])
+				if err != nil {
+					return nil, err
+				}
+				replies = append(replies, reply{family: r.Data[0], attrs: a})
+			}
+		}
+	}
+}
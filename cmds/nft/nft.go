@@ -0,0 +1,376 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Manage nftables rules.
+//
+// Synopsis:
+//     nft add|delete table [FAMILY] TABLE
+//     nft add chain [FAMILY] TABLE CHAIN [{ type TYPE hook HOOK priority PRIORITY; [policy accept|drop;] }]
+//     nft delete chain [FAMILY] TABLE CHAIN
+//     nft add|insert rule [FAMILY] TABLE CHAIN RULE
+//     nft list ruleset
+//     nft flush ruleset
+//
+// Description:
+//     nft is a small subset of the nft command of nftables. It talks to the
+//     kernel's nf_tables directly.
+//
+//     FAMILY is ip, ip6 or inet, and defaults to ip. add rule appends to a
+//     chain and insert rule prepends.
+//
+//     A RULE is a sequence of matches, each of the form FIELD [OP] VALUE,
+//     an optional counter and an optional verdict. FIELD is one of
+//     ip saddr, ip daddr, ip protocol, ip6 saddr, ip6 daddr, ip6 nexthdr,
+//     tcp sport, tcp dport, udp sport, udp dport, iifname, oifname,
+//     meta l4proto or meta nfproto. OP is ==, !=, <, <=, > or >=, and
+//     defaults to ==. Addresses may have a prefix length. The verdict is
+//     accept, drop, continue, return, jump CHAIN or goto CHAIN.
+//
+// Example:
+//     nft add table ip filter
+//     nft add chain ip filter input { type filter hook input priority 0\; }
+//     nft add rule ip filter input tcp dport 22 accept
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+	"golang.org/x/sys/unix"
+)
+
+const usage = `usage:
+  nft add|delete table [FAMILY] TABLE
+  nft add chain [FAMILY] TABLE CHAIN [{ type TYPE hook HOOK priority PRIORITY; [policy accept|drop;] }]
+  nft delete chain [FAMILY] TABLE CHAIN
+  nft add|insert rule [FAMILY] TABLE CHAIN RULE
+  nft list ruleset
+  nft flush ruleset`
+
+// Table and chain attributes.
+const (
+	attrTableName = 1
+
+	attrChainTable  = 1
+	attrChainName   = 3
+	attrChainHook   = 4
+	attrChainPolicy = 5
+	attrChainType   = 7
+
+	attrHookNum      = 1
+	attrHookPriority = 2
+)
+
+var hooks = []string{"prerouting", "input", "forward", "output", "postrouting"}
+
+var priorities = map[string]int32{
+	"raw":      -300,
+	"mangle":   -150,
+	"dstnat":   -100,
+	"filter":   0,
+	"security": 50,
+	"srcnat":   100,
+}
+
+var policies = map[string]uint32{
+	"drop":   verdictDrop,
+	"accept": verdictAccept,
+}
+
+// tokenize splits the arguments into words, with braces and semicolons as
+// words of their own, since they may or may not be separated by spaces.
+func tokenize(args []string) []string {
+	s := strings.Join(args, " ")
+	for _, c := range []string{"{", "}", ";"} {
+		s = strings.Replace(s, c, " "+c+" ", -1)
+	}
+	var words []string
+	for _, w := range strings.Fields(s) {
+		words = append(words, strings.Trim(w, `"`))
+	}
+	return words
+}
+
+// family removes the family from the front of words, if it is there.
+func family(words []string) (uint8, []string) {
+	if len(words) > 0 {
+		if f, ok := families[words[0]]; ok {
+			return f, words[1:]
+		}
+	}
+	return familyIPv4, words
+}
+
+// names removes a name for each of what from the front of words.
+func names(words []string, what ...string) ([]string, []string, error) {
+	if len(words) < len(what) {
+		return nil, nil, fmt.Errorf("missing %s", what[len(words)])
+	}
+	return words[:len(what)], words[len(what):], nil
+}
+
+// parseChainSpec parses the braced part of add chain.
+func parseChainSpec(words []string) ([]nlattr.Attr, error) {
+	if len(words) == 0 {
+		return nil, nil
+	}
+	if words[0] != "{" || words[len(words)-1] != "}" {
+		return nil, fmt.Errorf("chain specification must be in braces")
+	}
+	words = words[1 : len(words)-1]
+	var (
+		typ      string
+		hook     = -1
+		priority *int32
+		policy   *uint32
+	)
+	for len(words) > 0 {
+		if words[0] == ";" {
+			words = words[1:]
+			continue
+		}
+		if len(words) < 2 {
+			return nil, fmt.Errorf("%s needs a value", words[0])
+		}
+		k, v := words[0], words[1]
+		words = words[2:]
+		switch k {
+		case "type":
+			typ = v
+		case "hook":
+			for i, h := range hooks {
+				if h == v {
+					hook = i
+				}
+			}
+			if hook < 0 {
+				return nil, fmt.Errorf("unknown hook %q", v)
+			}
+		case "priority":
+			p, ok := priorities[v]
+			if !ok {
+				n, err := strconv.ParseInt(v, 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("bad priority %q", v)
+				}
+				p = int32(n)
+			}
+			priority = &p
+		case "policy":
+			p, ok := policies[v]
+			if !ok {
+				return nil, fmt.Errorf("bad policy %q", v)
+			}
+			policy = &p
+		default:
+			return nil, fmt.Errorf("unknown chain option %q", k)
+		}
+	}
+	if typ == "" || hook < 0 || priority == nil {
+		return nil, fmt.Errorf("base chains need a type, hook and priority")
+	}
+	attrs := []nlattr.Attr{
+		nlattr.String(attrChainType, typ),
+		nlattr.Nested(attrChainHook, nlattr.U32(be, attrHookNum, uint32(hook)), nlattr.U32(be, attrHookPriority, uint32(*priority))),
+	}
+	if policy != nil {
+		attrs = append(attrs, nlattr.U32(be, attrChainPolicy, *policy))
+	}
+	return attrs, nil
+}
+
+// request turns a command into the messages to commit.
+func request(words []string) ([]nfMsg, error) {
+	if len(words) < 2 {
+		return nil, fmt.Errorf("missing command")
+	}
+	verb, object := words[0], words[1]
+	f, words := family(words[2:])
+
+	switch verb + " " + object {
+	case "add table":
+		n, rest, err := names(words, "table")
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("unexpected %q", strings.Join(rest, " "))
+		}
+		return []nfMsg{{typ: msgNewTable, flags: unix.NLM_F_CREATE, family: f, attrs: []nlattr.Attr{nlattr.String(attrTableName, n[0])}}}, nil
+	case "delete table":
+		n, rest, err := names(words, "table")
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("unexpected %q", strings.Join(rest, " "))
+		}
+		return []nfMsg{{typ: msgDelTable, family: f, attrs: []nlattr.Attr{nlattr.String(attrTableName, n[0])}}}, nil
+	case "add chain", "delete chain":
+		n, rest, err := names(words, "table", "chain")
+		if err != nil {
+			return nil, err
+		}
+		attrs := []nlattr.Attr{nlattr.String(attrChainTable, n[0]), nlattr.String(attrChainName, n[1])}
+		if verb == "delete" {
+			if len(rest) != 0 {
+				return nil, fmt.Errorf("unexpected %q", strings.Join(rest, " "))
+			}
+			return []nfMsg{{typ: msgDelChain, family: f, attrs: attrs}}, nil
+		}
+		spec, err := parseChainSpec(rest)
+		if err != nil {
+			return nil, err
+		}
+		return []nfMsg{{typ: msgNewChain, flags: unix.NLM_F_CREATE, family: f, attrs: append(attrs, spec...)}}, nil
+	case "add rule", "insert rule":
+		n, rest, err := names(words, "table", "chain")
+		if err != nil {
+			return nil, err
+		}
+		exprs, err := parseRule(f, rest)
+		if err != nil {
+			return nil, err
+		}
+		flags := uint16(unix.NLM_F_CREATE)
+		if verb == "add" {
+			flags |= unix.NLM_F_APPEND
+		}
+		return []nfMsg{{typ: msgNewRule, flags: flags, family: f, attrs: []nlattr.Attr{
+			nlattr.String(attrRuleTable, n[0]),
+			nlattr.String(attrRuleChain, n[1]),
+			nlattr.Nested(attrRuleExpressions, exprs...),
+		}}}, nil
+	case "flush ruleset":
+		if len(words) != 0 {
+			return nil, fmt.Errorf("unexpected %q", strings.Join(words, " "))
+		}
+		// Deleting tables of no family and no name deletes them all.
+		return []nfMsg{{typ: msgDelTable, family: unix.AF_UNSPEC}}, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", verb+" "+object)
+}
+
+// ruleset is the contents of all tables.
+type ruleset struct {
+	tables, chains, rules []reply
+}
+
+func getRuleset(c *conn) (*ruleset, error) {
+	var r ruleset
+	var err error
+	if r.tables, err = c.dump(msgGetTable); err != nil {
+		return nil, fmt.Errorf("listing tables: %v", err)
+	}
+	if r.chains, err = c.dump(msgGetChain); err != nil {
+		return nil, fmt.Errorf("listing chains: %v", err)
+	}
+	if r.rules, err = c.dump(msgGetRule); err != nil {
+		return nil, fmt.Errorf("listing rules: %v", err)
+	}
+	return &r, nil
+}
+
+func formatChainSpec(c reply) string {
+	typ := c.attrs.String(attrChainType)
+	h, err := nlattr.ParseMap(c.attrs[attrChainHook])
+	if typ == "" || err != nil {
+		return ""
+	}
+	num, _ := h.U32(be, attrHookNum)
+	hook := strconv.Itoa(int(num))
+	if int(num) < len(hooks) {
+		hook = hooks[num]
+	}
+	prio, _ := h.U32(be, attrHookPriority)
+	s := fmt.Sprintf("type %s hook %s priority %d;", typ, hook, int32(prio))
+	if p, ok := c.attrs.U32(be, attrChainPolicy); ok {
+		for n, v := range policies {
+			if v == p {
+				s += " policy " + n + ";"
+			}
+		}
+	}
+	return s
+}
+
+// format writes the ruleset in the syntax of nft list ruleset.
+func (r *ruleset) format(w io.Writer) error {
+	var b bytes.Buffer
+	for i, t := range r.tables {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		table := t.attrs.String(attrTableName)
+		fmt.Fprintf(&b, "table %s %s {\n", familyName(t.family), table)
+		first := true
+		for _, c := range r.chains {
+			if c.family != t.family || c.attrs.String(attrChainTable) != table {
+				continue
+			}
+			if !first {
+				b.WriteString("\n")
+			}
+			first = false
+			chain := c.attrs.String(attrChainName)
+			fmt.Fprintf(&b, "\tchain %s {\n", chain)
+			if s := formatChainSpec(c); s != "" {
+				fmt.Fprintf(&b, "\t\t%s\n", s)
+			}
+			for _, rl := range r.rules {
+				if rl.family != t.family || rl.attrs.String(attrRuleTable) != table || rl.attrs.String(attrRuleChain) != chain {
+					continue
+				}
+				s, err := formatRule(rl.attrs[attrRuleExpressions])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(&b, "\t\t%s\n", s)
+			}
+			b.WriteString("\t}\n")
+		}
+		b.WriteString("}\n")
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func nft(w io.Writer, args []string) error {
+	words := tokenize(args)
+	if len(words) == 2 && words[0] == "list" && words[1] == "ruleset" {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.close()
+		r, err := getRuleset(c)
+		if err != nil {
+			return err
+		}
+		return r.format(w)
+	}
+
+	msgs, err := request(words)
+	if err != nil {
+		return err
+	}
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	return c.commit(msgs)
+}
+
+func main() {
+	if err := nft(os.Stdout, os.Args[1:]); err != nil {
+		log.Fatalf("nft: %v\n%s", err, usage)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+	"github.com/u-root/u-root/pkg/testutil"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"add", "chain", "filter", "input", "{type filter hook input priority 0;}"},
+			[]string{"add", "chain", "filter", "input", "{", "type", "filter", "hook", "input", "priority", "0", ";", "}"}},
+		{[]string{"add", "chain", "filter", "input", "{", "type", "filter", "hook", "input", "priority", "0;", "policy", "drop;", "}"},
+			[]string{"add", "chain", "filter", "input", "{", "type", "filter", "hook", "input", "priority", "0", ";", "policy", "drop", ";", "}"}},
+		{[]string{"add rule filter input iifname \"eth0\" accept"},
+			[]string{"add", "rule", "filter", "input", "iifname", "eth0", "accept"}},
+	} {
+		if got := tokenize(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestBadCommands(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"add",
+		"add table",
+		"add table ip filter extra",
+		"frob table filter",
+		"add chain filter",
+		"add chain filter input type filter",
+		"add chain filter input { type filter hook sideways priority 0; }",
+		"add chain filter input { type filter hook input priority high; }",
+		"add chain filter input { type filter hook input priority 0; policy maybe; }",
+		"add chain filter input { type filter priority 0; }",
+		"add chain filter input { color blue; }",
+		"delete chain filter input extra",
+		"add rule filter",
+		"add rule filter input tcp dport ssh",
+		"flush ruleset now",
+	} {
+		if _, err := request(tokenize([]string{s})); err == nil {
+			t.Errorf("nft %s = nil, want error", s)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	msgs, err := request(tokenize([]string{"add chain inet nat post { type nat hook postrouting priority srcnat; }"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].typ != msgNewChain || msgs[0].family != familyINet {
+		t.Fatalf("request = %+v", msgs)
+	}
+	a, err := nlattr.ParseMap(nlattr.Encode(msgs[0].attrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String(attrChainTable) != "nat" || a.String(attrChainName) != "post" || a.String(attrChainType) != "nat" {
+		t.Errorf("chain attributes = %v", a)
+	}
+	h, err := nlattr.ParseMap(a[attrChainHook])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := h.U32(be, attrHookNum); n != 4 {
+		t.Errorf("hook = %d, want 4", n)
+	}
+	if p, _ := h.U32(be, attrHookPriority); int32(p) != 100 {
+		t.Errorf("priority = %d, want 100", int32(p))
+	}
+	if _, ok := a[attrChainPolicy]; ok {
+		t.Errorf("chain has a policy")
+	}
+
+	// Tables default to ip.
+	msgs, err = request([]string{"add", "table", "filter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].family != familyIPv4 {
+		t.Errorf("family = %d, want %d", msgs[0].family, familyIPv4)
+	}
+}
+
+func run(t *testing.T, args ...string) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := nft(&b, args); err != nil {
+		t.Fatalf("nft %s: %v", strings.Join(args, " "), err)
+	}
+	return b.String()
+}
+
+func TestRuleset(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		c, err := dial()
+		if err != nil {
+			t.Skipf("Skipping, no nf_tables: %v", err)
+		}
+		_, err = c.dump(msgGetTable)
+		c.close()
+		if err != nil {
+			t.Skipf("Skipping, no nf_tables: %v", err)
+		}
+
+		run(t, "add", "table", "ip", "filter")
+		run(t, "add", "chain", "ip", "filter", "input", "{", "type", "filter", "hook", "input", "priority", "0;", "}")
+		run(t, "add", "chain", "ip", "filter", "output", "{ type filter hook output priority 0; policy accept; }")
+		run(t, "add", "chain", "ip", "filter", "blocked")
+		run(t, "add", "rule", "ip", "filter", "input", "tcp", "dport", "22", "accept")
+		run(t, "add", "rule", "ip", "filter", "input", "ip saddr 10.0.0.0/8 udp dport != 53 drop")
+		run(t, "insert", "rule", "ip", "filter", "input", "iifname", "lo", "accept")
+		run(t, "add rule filter blocked counter drop")
+		run(t, "add rule filter output udp dport 9999 jump blocked")
+		run(t, "add table inet other")
+
+		want := `table ip filter {
+	chain input {
+		type filter hook input priority 0; policy accept;
+		iifname "lo" accept
+		tcp dport 22 accept
+		ip saddr 10.0.0.0/8 udp dport != 53 drop
+	}
+
+	chain output {
+		type filter hook output priority 0; policy accept;
+		udp dport 9999 jump blocked
+	}
+
+	chain blocked {
+		counter packets 0 bytes 0 drop
+	}
+}
+
+table inet other {
+}
+`
+		if got := run(t, "list", "ruleset"); got != want {
+			t.Errorf("list ruleset:\n%s\nwant:\n%s", got, want)
+		}
+
+		// The rules are in effect.
+		conn, err := net.Dial("udp", "127.0.0.1:9999")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("hello"))
+		conn.Close()
+		if err == nil {
+			t.Errorf("writing to a blocked port = nil, want error")
+		}
+		if got := run(t, "list", "ruleset"); !strings.Contains(got, "counter packets 1 bytes 33 drop") {
+			t.Errorf("counter did not count the blocked packet:\n%s", got)
+		}
+
+		// Adding to a missing chain fails, and the failure changes nothing.
+		var b bytes.Buffer
+		if err := nft(&b, []string{"add", "rule", "filter", "nosuchchain", "accept"}); err == nil {
+			t.Errorf("adding a rule to a missing chain = nil, want error")
+		}
+
+		run(t, "delete", "chain", "filter", "output")
+		run(t, "delete", "chain", "filter", "blocked")
+		run(t, "delete", "table", "inet", "other")
+		if got := run(t, "list", "ruleset"); strings.Contains(got, "output") || strings.Contains(got, "other") {
+			t.Errorf("deleted chains and tables are still listed:\n%s", got)
+		}
+
+		run(t, "flush", "ruleset")
+		if got := run(t, "list", "ruleset"); got != "" {
+			t.Errorf("list ruleset after flush = %q, want nothing", got)
+		}
+	})
+}
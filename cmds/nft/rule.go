@@ -0,0 +1,558 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+)
+
+// Rule and expression attributes, from linux/netfilter/nf_tables.h.
+const (
+	attrRuleTable       = 1
+	attrRuleChain       = 2
+	attrRuleHandle      = 3
+	attrRuleExpressions = 4
+
+	attrListElem = 1
+	attrExprName = 1
+	attrExprData = 2
+
+	attrDataValue   = 1
+	attrDataVerdict = 2
+
+	attrVerdictCode  = 1
+	attrVerdictChain = 2
+
+	attrPayloadDreg   = 1
+	attrPayloadBase   = 2
+	attrPayloadOffset = 3
+	attrPayloadLen    = 4
+
+	attrMetaDreg = 1
+	attrMetaKey  = 2
+
+	attrCmpSreg = 1
+	attrCmpOp   = 2
+	attrCmpData = 3
+
+	attrBitwiseSreg = 1
+	attrBitwiseDreg = 2
+	attrBitwiseLen  = 3
+	attrBitwiseMask = 4
+	attrBitwiseXor  = 5
+
+	attrImmediateDreg = 1
+	attrImmediateData = 2
+
+	attrCounterBytes   = 1
+	attrCounterPackets = 2
+)
+
+const (
+	regVerdict = 0
+	reg1       = 1
+
+	payloadNetwork   = 1
+	payloadTransport = 2
+
+	metaIifname = 6
+	metaOifname = 7
+	metaNfproto = 15
+	metaL4proto = 16
+
+	ifNameSize = 16
+)
+
+// Verdicts. The negative ones are nf_tables' own.
+const (
+	verdictDrop     = 0
+	verdictAccept   = 1
+	verdictContinue = -1
+	verdictJump     = -3
+	verdictGoto     = -4
+	verdictReturn   = -5
+)
+
+// Address families of tables.
+const (
+	familyINet = 1
+	familyIPv4 = 2
+	familyIPv6 = 10
+)
+
+var families = map[string]uint8{
+	"ip":   familyIPv4,
+	"ip6":  familyIPv6,
+	"inet": familyINet,
+}
+
+func familyName(f uint8) string {
+	for n, v := range families {
+		if v == f {
+			return n
+		}
+	}
+	return fmt.Sprintf("family%d", f)
+}
+
+// cmpOps are the comparison operators, in the order of enum nft_cmp_ops.
+var cmpOps = []string{"==", "!=", "<", "<=", ">", ">="}
+
+// kind is the type of the value of a field.
+type kind int
+
+const (
+	kindIPv4 kind = iota
+	kindIPv6
+	kindProto
+	kindPort
+	kindIfname
+	kindNfproto
+)
+
+// field is something a rule can match on.
+type field struct {
+	name string
+	meta bool
+	// key is the meta key of meta fields.
+	key uint32
+	// base and offset locate payload fields.
+	base, offset uint32
+	len          uint32
+	kind         kind
+	// nfproto and l4proto are the protocols a field needs, which rules
+	// check for first.
+	nfproto uint8
+	l4proto uint8
+}
+
+var fields = []*field{
+	{name: "ip saddr", base: payloadNetwork, offset: 12, len: 4, kind: kindIPv4, nfproto: familyIPv4},
+	{name: "ip daddr", base: payloadNetwork, offset: 16, len: 4, kind: kindIPv4, nfproto: familyIPv4},
+	{name: "ip protocol", base: payloadNetwork, offset: 9, len: 1, kind: kindProto, nfproto: familyIPv4},
+	{name: "ip6 saddr", base: payloadNetwork, offset: 8, len: 16, kind: kindIPv6, nfproto: familyIPv6},
+	{name: "ip6 daddr", base: payloadNetwork, offset: 24, len: 16, kind: kindIPv6, nfproto: familyIPv6},
+	{name: "ip6 nexthdr", base: payloadNetwork, offset: 6, len: 1, kind: kindProto, nfproto: familyIPv6},
+	{name: "tcp sport", base: payloadTransport, offset: 0, len: 2, kind: kindPort, l4proto: protocols["tcp"]},
+	{name: "tcp dport", base: payloadTransport, offset: 2, len: 2, kind: kindPort, l4proto: protocols["tcp"]},
+	{name: "udp sport", base: payloadTransport, offset: 0, len: 2, kind: kindPort, l4proto: protocols["udp"]},
+	{name: "udp dport", base: payloadTransport, offset: 2, len: 2, kind: kindPort, l4proto: protocols["udp"]},
+	{name: "iifname", meta: true, key: metaIifname, len: ifNameSize, kind: kindIfname},
+	{name: "oifname", meta: true, key: metaOifname, len: ifNameSize, kind: kindIfname},
+	{name: "meta l4proto", meta: true, key: metaL4proto, len: 1, kind: kindProto},
+	{name: "meta nfproto", meta: true, key: metaNfproto, len: 1, kind: kindNfproto},
+}
+
+func lookupField(name string) *field {
+	for _, f := range fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+var protocols = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+var nfprotos = map[string]uint8{
+	"ipv4": familyIPv4,
+	"ipv6": familyIPv6,
+}
+
+func lookupName(m map[string]uint8, v uint8) string {
+	for n, p := range m {
+		if p == v {
+			return n
+		}
+	}
+	return strconv.Itoa(int(v))
+}
+
+// parseValue returns the data for s, and the mask for a prefix.
+func (f *field) parseValue(s string) ([]byte, []byte, error) {
+	switch f.kind {
+	case kindIPv4, kindIPv6:
+		bits := 8 * int(f.len)
+		ones := bits
+		if i := strings.IndexByte(s, '/'); i >= 0 {
+			n, err := strconv.Atoi(s[i+1:])
+			if err != nil || n < 0 || n > bits {
+				return nil, nil, fmt.Errorf("bad prefix length in %q", s)
+			}
+			ones, s = n, s[:i]
+		}
+		ip := net.ParseIP(s)
+		if f.kind == kindIPv4 {
+			ip = ip.To4()
+		} else if ip.To4() != nil {
+			ip = nil
+		}
+		if ip == nil {
+			return nil, nil, fmt.Errorf("%s: bad address %q", f.name, s)
+		}
+		if ones == bits {
+			return []byte(ip), nil, nil
+		}
+		mask := net.CIDRMask(ones, bits)
+		return []byte(ip.Mask(mask)), []byte(mask), nil
+	case kindProto, kindNfproto:
+		names := protocols
+		if f.kind == kindNfproto {
+			names = nfprotos
+		}
+		if p, ok := names[s]; ok {
+			return []byte{p}, nil, nil
+		}
+		n, err := strconv.ParseUint(s, 0, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: bad protocol %q", f.name, s)
+		}
+		return []byte{byte(n)}, nil, nil
+	case kindPort:
+		n, err := strconv.ParseUint(s, 0, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: bad port %q", f.name, s)
+		}
+		b := make([]byte, 2)
+		be.PutUint16(b, uint16(n))
+		return b, nil, nil
+	case kindIfname:
+		if len(s) >= ifNameSize {
+			return nil, nil, fmt.Errorf("%s: interface name %q is too long", f.name, s)
+		}
+		b := make([]byte, ifNameSize)
+		copy(b, s)
+		return b, nil, nil
+	}
+	return nil, nil, fmt.Errorf("%s: unknown field type", f.name)
+}
+
+// formatValue is the inverse of parseValue.
+func (f *field) formatValue(b, mask []byte) string {
+	switch f.kind {
+	case kindIPv4, kindIPv6:
+		s := net.IP(b).String()
+		if mask != nil {
+			ones, _ := net.IPMask(mask).Size()
+			s += "/" + strconv.Itoa(ones)
+		}
+		return s
+	case kindProto:
+		return lookupName(protocols, b[0])
+	case kindNfproto:
+		return lookupName(nfprotos, b[0])
+	case kindPort:
+		return strconv.Itoa(int(be.Uint16(b)))
+	case kindIfname:
+		return strconv.Quote(strings.TrimRight(string(b), "\x00"))
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func expr(name string, attrs ...nlattr.Attr) nlattr.Attr {
+	return nlattr.Nested(attrListElem, nlattr.String(attrExprName, name), nlattr.Nested(attrExprData, attrs...))
+}
+
+// load returns the expression loading f into register 1.
+func (f *field) load() nlattr.Attr {
+	if f.meta {
+		return expr("meta", nlattr.U32(be, attrMetaDreg, reg1), nlattr.U32(be, attrMetaKey, f.key))
+	}
+	return expr("payload",
+		nlattr.U32(be, attrPayloadDreg, reg1),
+		nlattr.U32(be, attrPayloadBase, f.base),
+		nlattr.U32(be, attrPayloadOffset, f.offset),
+		nlattr.U32(be, attrPayloadLen, f.len))
+}
+
+func cmp(op int, data []byte) nlattr.Attr {
+	return expr("cmp",
+		nlattr.U32(be, attrCmpSreg, reg1),
+		nlattr.U32(be, attrCmpOp, uint32(op)),
+		nlattr.Nested(attrCmpData, nlattr.Attr{Type: attrDataValue, Data: data}))
+}
+
+// match returns the expressions for f op value.
+func (f *field) match(op int, value []byte, mask []byte) []nlattr.Attr {
+	e := []nlattr.Attr{f.load()}
+	if mask != nil {
+		e = append(e, expr("bitwise",
+			nlattr.U32(be, attrBitwiseSreg, reg1),
+			nlattr.U32(be, attrBitwiseDreg, reg1),
+			nlattr.U32(be, attrBitwiseLen, f.len),
+			nlattr.Nested(attrBitwiseMask, nlattr.Attr{Type: attrDataValue, Data: mask}),
+			nlattr.Nested(attrBitwiseXor, nlattr.Attr{Type: attrDataValue, Data: make([]byte, len(mask))})))
+	}
+	return append(e, cmp(op, value))
+}
+
+func verdict(code int32, chain string) nlattr.Attr {
+	v := []nlattr.Attr{nlattr.U32(be, attrVerdictCode, uint32(code))}
+	if chain != "" {
+		v = append(v, nlattr.String(attrVerdictChain, chain))
+	}
+	return expr("immediate",
+		nlattr.U32(be, attrImmediateDreg, regVerdict),
+		nlattr.Nested(attrImmediateData, nlattr.Nested(attrDataVerdict, v...)))
+}
+
+var verdicts = map[string]int32{
+	"accept":   verdictAccept,
+	"drop":     verdictDrop,
+	"continue": verdictContinue,
+	"return":   verdictReturn,
+	"jump":     verdictJump,
+	"goto":     verdictGoto,
+}
+
+// parseRule returns the expressions for a rule in a table of family. Rules
+// are a sequence of matches of the form FIELD [OP] VALUE, then an optional
+// counter and a verdict.
+func parseRule(family uint8, words []string) ([]nlattr.Attr, error) {
+	var exprs []nlattr.Attr
+	// deps are the protocols already checked for.
+	deps := make(map[*field]uint8)
+	for len(words) > 0 {
+		w := words[0]
+		if w == "counter" {
+			exprs = append(exprs, expr("counter"))
+			words = words[1:]
+			continue
+		}
+		if code, ok := verdicts[w]; ok {
+			var chain string
+			words = words[1:]
+			if code == verdictJump || code == verdictGoto {
+				if len(words) == 0 {
+					return nil, fmt.Errorf("%s needs a chain", w)
+				}
+				chain, words = words[0], words[1:]
+			}
+			exprs = append(exprs, verdict(code, chain))
+			if len(words) > 0 {
+				return nil, fmt.Errorf("unexpected %q after verdict", strings.Join(words, " "))
+			}
+			break
+		}
+
+		f := lookupField(w)
+		if f == nil && len(words) > 1 {
+			f = lookupField(w + " " + words[1])
+			words = words[1:]
+		}
+		if f == nil {
+			return nil, fmt.Errorf("unknown match %q", w)
+		}
+		words = words[1:]
+		op := 0
+		if len(words) > 0 {
+			for i, o := range cmpOps {
+				if words[0] == o {
+					op, words = i, words[1:]
+					break
+				}
+			}
+		}
+		if len(words) == 0 {
+			return nil, fmt.Errorf("%s needs a value", f.name)
+		}
+		value, mask, err := f.parseValue(words[0])
+		if err != nil {
+			return nil, err
+		}
+		if mask != nil && op > 1 {
+			return nil, fmt.Errorf("%s: prefixes only work with == and !=", f.name)
+		}
+		words = words[1:]
+
+		if f.nfproto != 0 && f.nfproto != family {
+			if family != familyINet {
+				return nil, fmt.Errorf("%s does not match in %s tables", f.name, familyName(family))
+			}
+			nf := lookupField("meta nfproto")
+			if deps[nf] != f.nfproto {
+				exprs = append(exprs, nf.match(0, []byte{f.nfproto}, nil)...)
+				deps[nf] = f.nfproto
+			}
+		}
+		if f.l4proto != 0 {
+			l4 := lookupField("meta l4proto")
+			if deps[l4] != f.l4proto {
+				exprs = append(exprs, l4.match(0, []byte{f.l4proto}, nil)...)
+				deps[l4] = f.l4proto
+			}
+		}
+		exprs = append(exprs, f.match(op, value, mask)...)
+	}
+	return exprs, nil
+}
+
+// match is a decoded comparison.
+type match struct {
+	f     *field
+	op    int
+	value []byte
+	mask  []byte
+}
+
+func (m match) String() string {
+	op := ""
+	if m.op != 0 {
+		op = cmpOps[m.op] + " "
+	}
+	return fmt.Sprintf("%s %s%s", m.f.name, op, m.f.formatValue(m.value, m.mask))
+}
+
+// implied tells whether m only checks for a protocol that next needs.
+func (m match) implied(next *match) bool {
+	if next == nil || m.op != 0 || len(m.value) != 1 {
+		return false
+	}
+	switch m.f.name {
+	case "meta l4proto":
+		return next.f.l4proto == m.value[0]
+	case "meta nfproto":
+		return next.f.nfproto == m.value[0]
+	}
+	return false
+}
+
+// formatRule turns the expressions of a rule back into the rule language.
+func formatRule(b []byte) (string, error) {
+	elems, err := nlattr.Parse(b)
+	if err != nil {
+		return "", err
+	}
+	var (
+		words  []string
+		loaded *field
+		mask   []byte
+		// l4 is the transport protocol checked for last, which tells tcp
+		// and udp ports apart.
+		l4 uint8
+	)
+	// matches are buffered to drop implied protocol checks.
+	var pending []*match
+	flush := func() {
+		for i, m := range pending {
+			var next *match
+			if i+1 < len(pending) {
+				next = pending[i+1]
+			}
+			if !m.implied(next) {
+				words = append(words, m.String())
+			}
+		}
+		pending = nil
+	}
+	for _, e := range elems {
+		ea, err := nlattr.ParseMap(e.Data)
+		if err != nil {
+			return "", err
+		}
+		name := ea.String(attrExprName)
+		d, err := nlattr.ParseMap(ea[attrExprData])
+		if err != nil {
+			return "", err
+		}
+		switch name {
+		case "meta":
+			key, _ := d.U32(be, attrMetaKey)
+			loaded, mask = nil, nil
+			for _, f := range fields {
+				if f.meta && f.key == key {
+					loaded = f
+				}
+			}
+			if loaded == nil {
+				words = append(words, fmt.Sprintf("[meta %d]", key))
+			}
+			continue
+		case "payload":
+			base, _ := d.U32(be, attrPayloadBase)
+			off, _ := d.U32(be, attrPayloadOffset)
+			l, _ := d.U32(be, attrPayloadLen)
+			loaded, mask = nil, nil
+			for _, f := range fields {
+				if !f.meta && f.base == base && f.offset == off && f.len == l && (f.l4proto == 0 || f.l4proto == l4) {
+					loaded = f
+					break
+				}
+			}
+			if loaded == nil {
+				words = append(words, fmt.Sprintf("[payload base %d offset %d len %d]", base, off, l))
+			}
+			continue
+		case "bitwise":
+			m, err := nlattr.ParseMap(d[attrBitwiseMask])
+			if err != nil {
+				return "", err
+			}
+			mask = m[attrDataValue]
+			continue
+		case "cmp":
+			if loaded == nil {
+				continue
+			}
+			op, _ := d.U32(be, attrCmpOp)
+			v, err := nlattr.ParseMap(d[attrCmpData])
+			if err != nil {
+				return "", err
+			}
+			if int(op) >= len(cmpOps) || len(v[attrDataValue]) != int(loaded.len) {
+				words = append(words, "[cmp]")
+				continue
+			}
+			m := &match{f: loaded, op: int(op), value: v[attrDataValue], mask: mask}
+			if m.f.key == metaL4proto && m.f.meta && m.op == 0 {
+				l4 = m.value[0]
+			}
+			pending = append(pending, m)
+			continue
+		}
+
+		flush()
+		switch name {
+		case "counter":
+			packets, _ := d.U64(be, attrCounterPackets)
+			nbytes, _ := d.U64(be, attrCounterBytes)
+			words = append(words, fmt.Sprintf("counter packets %d bytes %d", packets, nbytes))
+		case "immediate":
+			v, err := nlattr.ParseMap(d[attrImmediateData])
+			if err != nil {
+				return "", err
+			}
+			vd, err := nlattr.ParseMap(v[attrDataVerdict])
+			if err != nil {
+				return "", err
+			}
+			code, _ := vd.U32(be, attrVerdictCode)
+			w := fmt.Sprintf("[verdict %d]", int32(code))
+			for n, c := range verdicts {
+				if c == int32(code) {
+					w = n
+				}
+			}
+			if c := vd.String(attrVerdictChain); c != "" {
+				w += " " + c
+			}
+			words = append(words, w)
+		default:
+			words = append(words, "["+name+"]")
+		}
+	}
+	flush()
+	return strings.Join(words, " "), nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/nlattr"
+)
+
+func TestRuleRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		family uint8
+		rule   string
+		want   string
+		exprs  []string
+	}{
+		{familyIPv4, "tcp dport 22 accept", "", []string{"meta", "cmp", "payload", "cmp", "immediate"}},
+		{familyIPv4, "udp sport != 53 drop", "", []string{"meta", "cmp", "payload", "cmp", "immediate"}},
+		{familyIPv4, "ip saddr 10.0.0.0/8 tcp dport >= 1024 counter accept",
+			"ip saddr 10.0.0.0/8 tcp dport >= 1024 counter packets 0 bytes 0 accept",
+			[]string{"payload", "bitwise", "cmp", "meta", "cmp", "payload", "cmp", "counter", "immediate"}},
+		{familyIPv4, "ip protocol icmp ip daddr 192.168.1.1 return", "", []string{"payload", "cmp", "payload", "cmp", "immediate"}},
+		{familyINet, "ip saddr 1.2.3.4 drop", "", []string{"meta", "cmp", "payload", "cmp", "immediate"}},
+		{familyINet, "ip6 daddr fe80::/10 udp dport 546 accept", "", []string{"meta", "cmp", "payload", "bitwise", "cmp", "meta", "cmp", "payload", "cmp", "immediate"}},
+		{familyIPv6, "ip6 saddr ::1 ip6 nexthdr tcp jump local", "", []string{"payload", "cmp", "payload", "cmp", "immediate"}},
+		{familyIPv4, `iifname "eth0" oifname != "lo" goto out`, `iifname "eth0" oifname != "lo" goto out`, []string{"meta", "cmp", "meta", "cmp", "immediate"}},
+		{familyIPv4, "meta l4proto udp", "", []string{"meta", "cmp"}},
+		// The protocol is checked once.
+		{familyIPv4, "tcp sport 80 tcp dport 8080", "", []string{"meta", "cmp", "payload", "cmp", "payload", "cmp"}},
+		{familyIPv4, "counter", "counter packets 0 bytes 0", []string{"counter"}},
+	} {
+		t.Run(tt.rule, func(t *testing.T) {
+			exprs, err := parseRule(tt.family, tokenize([]string{tt.rule}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, e := range exprs {
+				a, err := nlattr.ParseMap(e.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, a.String(attrExprName))
+			}
+			if strings.Join(names, " ") != strings.Join(tt.exprs, " ") {
+				t.Errorf("expressions = %v, want %v", names, tt.exprs)
+			}
+
+			got, err := formatRule(nlattr.Encode(exprs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.rule
+			}
+			if got != want {
+				t.Errorf("formatRule = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseRuleValues(t *testing.T) {
+	exprs, err := parseRule(familyIPv4, []string{"ip", "saddr", "10.1.2.3/16", "tcp", "dport", "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := func(i int, outer, inner uint16) []byte {
+		e, _ := nlattr.ParseMap(exprs[i].Data)
+		d, _ := nlattr.ParseMap(e[attrExprData])
+		v, _ := nlattr.ParseMap(d[outer])
+		return v[inner]
+	}
+	// The address is masked like the packet will be.
+	if got := data(1, attrBitwiseMask, attrDataValue); !bytes.Equal(got, []byte{255, 255, 0, 0}) {
+		t.Errorf("mask = %v", got)
+	}
+	if got := data(2, attrCmpData, attrDataValue); !bytes.Equal(got, []byte{10, 1, 0, 0}) {
+		t.Errorf("address = %v", got)
+	}
+	if got := data(4, attrCmpData, attrDataValue); !bytes.Equal(got, []byte{6}) {
+		t.Errorf("l4proto = %v", got)
+	}
+	if got := data(6, attrCmpData, attrDataValue); !bytes.Equal(got, []byte{0, 22}) {
+		t.Errorf("port = %v", got)
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, tt := range []struct {
+		family uint8
+		rule   string
+		want   string
+	}{
+		{familyIPv4, "tcp frobnicate 1", "unknown match"},
+		{familyIPv4, "tcp dport", "needs a value"},
+		{familyIPv4, "tcp dport 65536", "bad port"},
+		{familyIPv4, "ip saddr 1.2.3.4/33", "bad prefix"},
+		{familyIPv4, "ip saddr ::1", "bad address"},
+		{familyIPv6, "ip6 saddr 1.2.3.4", "bad address"},
+		{familyIPv4, "ip saddr < 10.0.0.0/8", "prefixes"},
+		{familyIPv4, "ip protocol sctpish", "bad protocol"},
+		{familyIPv4, "iifname averyveryverylongname", "too long"},
+		{familyIPv6, "ip saddr 1.2.3.4", "does not match in ip6"},
+		{familyIPv4, "ip6 saddr ::1", "does not match in ip"},
+		{familyIPv4, "jump", "needs a chain"},
+		{familyIPv4, "accept tcp dport 22", "after verdict"},
+	} {
+		if _, err := parseRule(tt.family, tokenize([]string{tt.rule})); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseRule(%q) = %v, want error containing %q", tt.rule, err, tt.want)
+		}
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	b := nlattr.Encode([]nlattr.Attr{
+		expr("payload", nlattr.U32(be, attrPayloadDreg, reg1), nlattr.U32(be, attrPayloadBase, 0), nlattr.U32(be, attrPayloadOffset, 6), nlattr.U32(be, attrPayloadLen, 6)),
+		expr("cmp", nlattr.U32(be, attrCmpSreg, reg1), nlattr.U32(be, attrCmpOp, 0), nlattr.Nested(attrCmpData, nlattr.Attr{Type: attrDataValue, Data: make([]byte, 6)})),
+		expr("log"),
+		verdict(verdictAccept, ""),
+	})
+	got, err := formatRule(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[payload base 0 offset 6 len 6] [log] accept"; got != want {
+		t.Errorf("formatRule = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Run a program in the namespaces of other processes.
+//
+// Synopsis:
+//     nsenter [-t PID] [--no-fork] [--user[=FILE]] [--cgroup[=FILE]] [--ipc[=FILE]]
+//             [--uts[=FILE]] [--net[=FILE]] [--pid[=FILE]] [--mnt[=FILE]] PROGRAM [ARGS]...
+//
+// Description:
+//     nsenter opens each given namespace file (e.g. /proc/N/ns/net) and
+//     joins it with setns(2) before running PROGRAM. If a namespace flag is
+//     given without a FILE, the namespace of the -t process is used.
+//
+//     The user namespace is entered first, so that the privileges it grants
+//     apply to joining the others, and the mount namespace is entered last, so
+//     that the namespace files are all opened before the view of the file
+//     system changes.
+//
+//     setns(2) only joins a user namespace from a single-threaded process,
+//     and the Go runtime starts threads before main. For a user namespace
+//     other than its own, nsenter therefore re-executes itself, and a cgo
+//     constructor joins the user namespace before the runtime starts. The
+//     other namespaces are entered as usual after that. nsenter built
+//     without cgo cannot enter another user namespace.
+//
+//     A pid namespace only applies to children of the caller, so unless
+//     --no-fork is given PROGRAM is run as a child and nsenter exits with
+//     its exit status.
+//
+// Options:
+//     -t:        target process to take namespaces from
+//     --no-fork: exec PROGRAM directly instead of forking
+//     --user, --cgroup, --ipc, --uts, --net, --pid, --mnt:
+//                namespace to enter
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// namespaces lists namespace types in the order they are entered.
+var namespaces = []struct {
+	name string
+	flag int
+}{
+	{"user", unix.CLONE_NEWUSER},
+	{"cgroup", unix.CLONE_NEWCGROUP},
+	{"ipc", unix.CLONE_NEWIPC},
+	{"uts", unix.CLONE_NEWUTS},
+	{"net", unix.CLONE_NEWNET},
+	{"pid", unix.CLONE_NEWPID},
+	{"mnt", unix.CLONE_NEWNS},
+}
+
+// nsFlag is a namespace flag that may be given with or without a file.
+type nsFlag struct {
+	set  bool
+	path string
+}
+
+func (n *nsFlag) String() string {
+	return n.path
+}
+
+func (n *nsFlag) Set(s string) error {
+	n.set = true
+	if s != "true" {
+		n.path = s
+	}
+	return nil
+}
+
+// IsBoolFlag lets --net be given without a value.
+func (n *nsFlag) IsBoolFlag() bool {
+	return true
+}
+
+// errUserNS is returned for a user namespace other than our own, which
+// only the constructor in userns_cgo.go can join.
+var errUserNS = errors.New("another user namespace can only be entered before the Go runtime starts threads")
+
+// userNSEnv names the user namespace file for the constructor in
+// userns_cgo.go to join when nsenter re-executes itself.
+const userNSEnv = "_NSENTER_USERNS"
+
+var (
+	target = flag.Int("t", 0, "target process to get namespaces from")
+	noFork = flag.Bool("no-fork", false, "do not fork before exec'ing the program")
+	nsArgs = make(map[string]*nsFlag)
+)
+
+func init() {
+	for _, ns := range namespaces {
+		f := &nsFlag{}
+		nsArgs[ns.name] = f
+		flag.Var(f, ns.name, fmt.Sprintf("enter %s namespace [from FILE]", ns.name))
+	}
+}
+
+// sameNS reports whether f refers to the namespace at path.
+func sameNS(f *os.File, path string) bool {
+	var a, b unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &a); err != nil {
+		return false
+	}
+	if err := unix.Stat(path, &b); err != nil {
+		return false
+	}
+	return a.Dev == b.Dev && a.Ino == b.Ino
+}
+
+// ownUserNS reports whether path is the user namespace we are in.
+func ownUserNS(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return sameNS(f, fmt.Sprintf("/proc/self/task/%d/ns/user", unix.Gettid())), nil
+}
+
+// enter joins the namespaces in paths, a map of namespace name to file.
+//
+// The calling goroutine must be locked to its OS thread, which afterwards
+// must not be reused by other goroutines.
+func enter(paths map[string]string) error {
+	type nsFile struct {
+		f    *os.File
+		flag int
+	}
+
+	// Open everything before entering any namespace; in particular,
+	// entering the mount namespace changes what paths refer to.
+	var files []nsFile
+	defer func() {
+		for _, ns := range files {
+			ns.f.Close()
+		}
+	}()
+	for _, ns := range namespaces {
+		p, ok := paths[ns.name]
+		if !ok {
+			continue
+		}
+		if ns.flag == unix.CLONE_NEWUSER {
+			// Joining our own user namespace is not allowed, but it
+			// is also a no-op. Another one is joined by the
+			// re-executed nsenter before it gets here.
+			own, err := ownUserNS(p)
+			if err != nil {
+				return err
+			}
+			if !own {
+				return errUserNS
+			}
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, nsFile{f: f, flag: ns.flag})
+	}
+
+	for _, ns := range files {
+		if ns.flag == unix.CLONE_NEWNS {
+			// A thread sharing its file system attributes with other
+			// threads may not change mount namespaces.
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				return fmt.Errorf("unshare(CLONE_FS): %v", err)
+			}
+		}
+		if err := unix.Setns(int(ns.f.Fd()), ns.flag); err != nil {
+			return fmt.Errorf("setns(%s): %v", ns.f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// nsenter runs args in the given namespaces. Unless fork is false, it waits for
+// the program to exit; otherwise, it replaces the current process.
+func nsenter(paths map[string]string, args []string, fork bool, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no program given")
+	}
+
+	errc := make(chan error)
+	// Run on a dedicated goroutine that never unlocks its thread, so that
+	// the thread with changed namespaces is discarded once we are done.
+	go func() {
+		runtime.LockOSThread()
+		if err := enter(paths); err != nil {
+			errc <- err
+			return
+		}
+		if !fork {
+			p, err := exec.LookPath(args[0])
+			if err != nil {
+				errc <- err
+				return
+			}
+			errc <- syscall.Exec(p, args, os.Environ())
+			return
+		}
+		c := exec.Command(args[0], args[1:]...)
+		c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+		errc <- c.Run()
+	}()
+	return <-errc
+}
+
+func main() {
+	flag.Parse()
+
+	paths := make(map[string]string)
+	for _, ns := range namespaces {
+		f := nsArgs[ns.name]
+		if !f.set {
+			continue
+		}
+		switch {
+		case f.path != "":
+			paths[ns.name] = f.path
+		case *target != 0:
+			paths[ns.name] = fmt.Sprintf("/proc/%d/ns/%s", *target, ns.name)
+		default:
+			log.Fatalf("--%s needs a FILE or -t PID", ns.name)
+		}
+	}
+
+	// Having been re-executed, the user namespace has been joined or
+	// failed to be, and the program must not see the variable.
+	reexeced := os.Getenv(userNSEnv) != ""
+	if err := userNSErr(); err != nil {
+		log.Fatalf("nsenter: %v", err)
+	}
+	os.Unsetenv(userNSEnv)
+	if p, ok := paths["user"]; ok && !reexeced {
+		own, err := ownUserNS(p)
+		if err != nil {
+			log.Fatalf("nsenter: %v", err)
+		}
+		if !own {
+			log.Fatalf("nsenter: %v", reexecInUserNS(p))
+		}
+	}
+
+	err := nsenter(paths, flag.Args(), !*noFork, os.Stdin, os.Stdout, os.Stderr)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			os.Exit(ws.ExitStatus())
+		}
+	}
+	if err != nil {
+		log.Fatalf("nsenter: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestNSFlag(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want nsFlag
+	}{
+		{"true", nsFlag{set: true}},
+		{"/proc/1/ns/net", nsFlag{set: true, path: "/proc/1/ns/net"}},
+	} {
+		var f nsFlag
+		if err := f.Set(tt.in); err != nil {
+			t.Fatal(err)
+		}
+		if f != tt.want {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.in, f, tt.want)
+		}
+	}
+}
+
+func TestNoProgram(t *testing.T) {
+	if err := nsenter(nil, nil, true, nil, nil, nil); err == nil {
+		t.Errorf("nsenter with no program = nil, want error")
+	}
+}
+
+func TestOwnUserNS(t *testing.T) {
+	var out bytes.Buffer
+	paths := map[string]string{"user": "/proc/self/ns/user"}
+	if err := nsenter(paths, []string{"true"}, true, nil, &out, &out); err != nil {
+		t.Errorf("entering our own user namespace: %v: %s", err, out.String())
+	}
+}
+
+// TestMain runs nsenter itself when re-executed by TestEnterUserNS, for
+// which the test binary is nsenter.
+func TestMain(m *testing.M) {
+	if os.Getenv("NSENTER_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestEnterUserNS(t *testing.T) {
+	if !canEnterUserNS {
+		t.Skip("Skipping, nsenter is built without cgo")
+	}
+	c := exec.Command("sleep", "60")
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWUTS}
+	if err := c.Start(); err != nil {
+		t.Skipf("Skipping, cannot create a user namespace: %v", err)
+	}
+	defer c.Wait()
+	defer c.Process.Kill()
+
+	var want []string
+	for _, ns := range []string{"user", "uts"} {
+		l, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", c.Process.Pid, ns))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, l)
+	}
+
+	// The user namespace is entered first, and gives the privileges to
+	// enter the uts namespace, which it owns.
+	cmd := exec.Command(os.Args[0],
+		"-t", strconv.Itoa(c.Process.Pid), "--user", "--uts",
+		"sh", "-c", "readlink /proc/self/ns/user /proc/self/ns/uts; echo \"[$_NSENTER_USERNS]\"")
+	cmd.Env = append(os.Environ(), "NSENTER_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("nsenter: %v: %s", err, out)
+	}
+	if got, want := string(out), strings.Join(want, "\n")+"\n[]\n"; got != want {
+		t.Errorf("nsenter output = %q, want %q", got, want)
+	}
+}
+
+func TestOtherUserNS(t *testing.T) {
+	c := exec.Command("sleep", "60")
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER}
+	if err := c.Start(); err != nil {
+		t.Skipf("Skipping, cannot create a user namespace: %v", err)
+	}
+	defer c.Wait()
+	defer c.Process.Kill()
+
+	// Without re-executing nsenter, the user namespace is refused before
+	// any other is entered.
+	paths := map[string]string{
+		"user": fmt.Sprintf("/proc/%d/ns/user", c.Process.Pid),
+		"net":  "/nonexistent",
+	}
+	if err := nsenter(paths, []string{"true"}, true, nil, nil, nil); err != errUserNS {
+		t.Errorf("entering another user namespace = %v, want %v", err, errUserNS)
+	}
+}
+
+func TestEnter(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, requires root")
+	}
+
+	c := exec.Command("sleep", "60")
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS,
+	}
+	if err := c.Start(); err != nil {
+		t.Skipf("Skipping, cannot create namespaces: %v", err)
+	}
+	defer c.Wait()
+	defer c.Process.Kill()
+
+	paths := make(map[string]string)
+	for _, ns := range []string{"net", "uts", "mnt"} {
+		paths[ns] = fmt.Sprintf("/proc/%d/ns/%s", c.Process.Pid, ns)
+	}
+	for _, ns := range []string{"net", "uts", "mnt"} {
+		want, err := os.Readlink(paths[ns])
+		if err != nil {
+			t.Fatal(err)
+		}
+		self, err := os.Readlink("/proc/self/ns/" + ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if self == want {
+			t.Fatalf("%s namespace of child is not new", ns)
+		}
+
+		var out bytes.Buffer
+		if err := nsenter(paths, []string{"readlink", "/proc/self/ns/" + ns}, true, nil, &out, &out); err != nil {
+			t.Fatalf("nsenter: %v: %s", err, out.String())
+		}
+		if got := strings.TrimSpace(out.String()); got != want {
+			t.Errorf("%s namespace = %q, want %q", ns, got, want)
+		}
+	}
+
+	// Our own namespaces are unaffected.
+	self, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := os.Readlink(paths["net"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self == child {
+		t.Errorf("nsenter changed the namespace of the calling process")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	err := nsenter(nil, []string{"sh", "-c", "exit 3"}, true, nil, nil, nil)
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("nsenter(exit 3) = %v, want *exec.ExitError", err)
+	}
+	if ws := exitErr.Sys().(syscall.WaitStatus); ws.ExitStatus() != 3 {
+		t.Errorf("exit status = %d, want 3", ws.ExitStatus())
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build cgo
+
+package main
+
+/*
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <sched.h>
+#include <stdlib.h>
+#include <unistd.h>
+
+static int userns_errno;
+
+// enter_userns joins the user namespace in _NSENTER_USERNS. As a
+// constructor, it runs before the Go runtime starts any threads.
+__attribute__((constructor)) static void enter_userns(void) {
+	const char *path = getenv("_NSENTER_USERNS");
+	int fd;
+
+	if (path == NULL || *path == '\0')
+		return;
+	fd = open(path, O_RDONLY | O_CLOEXEC);
+	if (fd < 0) {
+		userns_errno = errno;
+		return;
+	}
+	if (setns(fd, CLONE_NEWUSER) < 0)
+		userns_errno = errno;
+	close(fd);
+}
+
+static int get_userns_errno(void) {
+	return userns_errno;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// canEnterUserNS is whether reexecInUserNS can join another user namespace.
+const canEnterUserNS = true
+
+// reexecInUserNS runs nsenter again with the same arguments, having the
+// constructor join the user namespace in path first. It only returns on
+// error.
+func reexecInUserNS(path string) error {
+	env := append(os.Environ(), userNSEnv+"="+path)
+	return os.NewSyscallError("execve", syscall.Exec("/proc/self/exe", os.Args, env))
+}
+
+// userNSErr returns why the constructor failed to join the user namespace.
+func userNSErr() error {
+	if errno := C.get_userns_errno(); errno != 0 {
+		return fmt.Errorf("setns(%s): %v", os.Getenv(userNSEnv), syscall.Errno(errno))
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !cgo
+
+package main
+
+// canEnterUserNS is whether reexecInUserNS can join another user namespace.
+const canEnterUserNS = false
+
+// reexecInUserNS cannot join another user namespace without the constructor
+// in userns_cgo.go.
+func reexecInUserNS(path string) error {
+	return errUserNS
+}
+
+func userNSErr() error {
+	return nil
+}
@@ -5,7 +5,13 @@
 // Send icmp packets to a server to test network connectivity.
 //
 // Synopsis:
-//     ping [-hV] [-c COUNT] [-i INTERVAL] [-s PACKETSIZE] [-w DEADLINE] DESTINATION
+//     ping [-hV6] [--flood] [-c COUNT] [-i INTERVAL] [-s PACKETSIZE] [-w DEADLINE] DESTINATION
+//
+// Description:
+//     ping sends ICMP (or ICMPv6) echo requests to DESTINATION. If
+//     DESTINATION resolves to an IPv6 address, ICMPv6 is used automatically.
+//     When COUNT packets have been sent, or on SIGINT, ping prints summary
+//     statistics and exits.
 //
 // Options:
 //     -6: use ipv6 (ip6:ipv6-icmp)
@@ -15,16 +21,24 @@
 //     -V: version
 //     -w: wait time in milliseconds (default: 100)
 //     -h: help
+//     --flood: send as fast as possible, printing . per request and
+//              backspace per reply
 package main
 
 import (
-	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"os/signal"
 	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 var (
@@ -35,17 +49,17 @@ var (
 	version    = flag.Bool("V", false, "version")
 	wtf        = flag.Int("w", 100, "wait time in milliseconds")
 	help       = flag.Bool("h", false, "help")
+	flood      = flag.Bool("flood", false, "send packets as fast as possible")
 )
 
+// IANA protocol numbers, as expected by icmp.ParseMessage.
 const (
-	ICMP_TYPE_ECHO_REQUEST             = 8
-	ICMP_TYPE_ECHO_REPLY               = 0
-	ICMP_ECHO_REPLY_HEADER_IPV4_OFFSET = 20
-	ICMP_ECHO_REPLY_HEADER_IPV6_OFFSET = 40
+	protoICMP   = 1
+	protoICMPv6 = 58
 )
 
 func usage() {
-	fmt.Fprintf(os.Stdout, "ping [-hV] [-c count] [-i interval] [-s packetsize] [-w deadline] destination\n")
+	fmt.Fprintf(os.Stdout, "ping [-hV6] [--flood] [-c count] [-i interval] [-s packetsize] [-w deadline] destination\n")
 	os.Exit(0)
 }
 
@@ -62,8 +76,8 @@ func optwithoutparam() {
 	usage()
 }
 
-func beatifulLatency(before time.Time) (latency string) {
-	now := float64(time.Since(before).Nanoseconds())
+func beatifulLatency(d time.Duration) (latency string) {
+	now := float64(d.Nanoseconds())
 
 	switch {
 	case now > 1e6:
@@ -77,75 +91,202 @@ func beatifulLatency(before time.Time) (latency string) {
 	return latency
 }
 
-func cksum(bs []byte) uint16 {
-	sum := uint32(0)
+// stats accumulates round trip statistics.
+type stats struct {
+	host     string
+	sent     int
+	received int
+	rtts     []time.Duration
+	start    time.Time
+	end      time.Time
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
 
-	for k := 0; k < len(bs)/2; k++ {
-		sum += uint32(bs[k*2]) << 8
-		sum += uint32(bs[k*2+1])
+// String formats stats like iputils ping does.
+func (s *stats) String() string {
+	var loss float64
+	if s.sent > 0 {
+		loss = 100 * float64(s.sent-s.received) / float64(s.sent)
 	}
-	if len(bs)%2 != 0 {
-		sum += uint32(bs[len(bs)-1]) << 8
+	str := fmt.Sprintf("--- %s ping statistics ---\n%d packets transmitted, %d received, %.0f%% packet loss, time %.0fms\n",
+		s.host, s.sent, s.received, loss, ms(s.end.Sub(s.start)))
+	if len(s.rtts) == 0 {
+		return str
 	}
-	sum = (sum >> 16) + (sum & 0xffff)
-	sum = (sum >> 16) + (sum & 0xffff)
-	if sum == 0xffff {
-		sum = 0
+
+	min, max := s.rtts[0], s.rtts[0]
+	var sum, sum2 float64
+	for _, rtt := range s.rtts {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += ms(rtt)
+		sum2 += ms(rtt) * ms(rtt)
 	}
+	n := float64(len(s.rtts))
+	avg := sum / n
+	mdev := math.Sqrt(sum2/n - avg*avg)
+	return str + fmt.Sprintf("rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms\n", ms(min), avg, ms(max), mdev)
+}
 
-	return ^uint16(sum)
+// pinger sends echo requests to a single destination.
+type pinger struct {
+	conn  *icmp.PacketConn
+	dst   net.Addr
+	proto int
+	id    int
+	// dgram is set for unprivileged ICMP sockets, where the kernel
+	// rewrites the echo ID.
+	dgram bool
+	size  int
+	wait  time.Duration
 }
 
-func ping1(netname string, host string, i uint64) (string, error) {
-	c, derr := net.Dial(netname, host)
-	if derr != nil {
-		return "", fmt.Errorf("net.Dial(%v %v) failed: %v", netname, host, derr)
+// newPinger resolves host and opens an ICMP endpoint of the matching family.
+func newPinger(host string, force6 bool, size int, wait time.Duration) (*pinger, error) {
+	network := "ip"
+	if force6 {
+		network = "ip6"
+	}
+	addr, err := net.ResolveIPAddr(network, host)
+	if err != nil {
+		return nil, err
 	}
-	defer c.Close()
 
-	// Send ICMP Echo Request
-	waitFor := time.Duration(*wtf) * time.Millisecond
-	c.SetDeadline(time.Now().Add(waitFor))
-	msg := make([]byte, *packetSize)
-	msg[0] = ICMP_TYPE_ECHO_REQUEST
-	msg[1] = 0
-	binary.BigEndian.PutUint16(msg[6:], uint16(i))
-	binary.BigEndian.PutUint16(msg[4:], uint16(i>>16))
-	binary.BigEndian.PutUint16(msg[2:], cksum(msg))
-	if _, err := c.Write(msg[:]); err != nil {
-		return "", fmt.Errorf("Write failed: %v", err)
+	p := &pinger{
+		proto: protoICMP,
+		id:    os.Getpid() & 0xffff,
+		size:  size,
+		wait:  wait,
+	}
+	raw, dgram, laddr := "ip4:icmp", "udp4", "0.0.0.0"
+	if addr.IP.To4() == nil {
+		p.proto = protoICMPv6
+		raw, dgram, laddr = "ip6:ipv6-icmp", "udp6", "::"
 	}
 
-	// Get ICMP Echo Reply
-	before := time.Now()
-	c.SetDeadline(time.Now().Add(waitFor))
-	rmsg := make([]byte, *packetSize+256)
-	amt, rerr := c.Read(rmsg[:])
-	if rerr != nil {
-		return "", fmt.Errorf("Read failed: %v", rerr)
+	if p.conn, err = icmp.ListenPacket(raw, laddr); err == nil {
+		p.dst = addr
+		return p, nil
+	}
+	// Fall back to unprivileged ping sockets.
+	if p.conn, err = icmp.ListenPacket(dgram, laddr); err != nil {
+		return nil, fmt.Errorf("opening ICMP socket: %v", err)
+	}
+	p.dgram = true
+	p.dst = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	return p, nil
+}
+
+func (p *pinger) close() error {
+	return p.conn.Close()
+}
+
+func (p *pinger) echoTypes() (icmp.Type, icmp.Type) {
+	if p.proto == protoICMPv6 {
+		return ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	return ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+}
+
+func (p *pinger) send(seq int) error {
+	req, _ := p.echoTypes()
+	body := &icmp.Echo{
+		ID:   p.id,
+		Seq:  seq & 0xffff,
+		Data: make([]byte, p.size-8),
+	}
+	msg := icmp.Message{Type: req, Body: body}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := p.conn.WriteTo(b, p.dst); err != nil {
+		return fmt.Errorf("Write failed: %v", err)
 	}
-	if (rmsg[0] & 0x0F) == 6 {
-		rmsg = rmsg[ICMP_ECHO_REPLY_HEADER_IPV6_OFFSET:]
-	} else {
-		rmsg = rmsg[ICMP_ECHO_REPLY_HEADER_IPV4_OFFSET:]
+	return nil
+}
+
+// recv waits for the echo reply matching seq and returns its size.
+func (p *pinger) recv(seq int) (int, error) {
+	_, reply := p.echoTypes()
+	deadline := time.Now().Add(p.wait)
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
 	}
-	if rmsg[0] != ICMP_TYPE_ECHO_REPLY {
-		return "", fmt.Errorf("Bad ICMP echo reply type: %v", msg[0])
+	buf := make([]byte, p.size+256)
+	for {
+		n, _, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, fmt.Errorf("Read failed: %v", err)
+		}
+		msg, err := icmp.ParseMessage(p.proto, buf[:n])
+		if err != nil || msg.Type != reply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq&0xffff || (!p.dgram && echo.ID != p.id) {
+			continue
+		}
+		return n, nil
 	}
-	cks := binary.BigEndian.Uint16(rmsg[2:])
-	binary.BigEndian.PutUint16(rmsg[2:], 0)
-	if cks != cksum(rmsg) {
-		return "", fmt.Errorf("Bad ICMP checksum: %v (expected %v)", cks, cksum(rmsg))
+}
+
+// ping1 sends one echo request and waits for the reply, returning a line
+// describing it.
+func (p *pinger) ping1(host string, seq int) (string, time.Duration, error) {
+	before := time.Now()
+	if err := p.send(seq); err != nil {
+		return "", 0, err
 	}
-	latency := beatifulLatency(before)
-	id := binary.BigEndian.Uint16(rmsg[4:])
-	seq := binary.BigEndian.Uint16(rmsg[6:])
-	rseq := uint64(id)<<16 + uint64(seq)
-	if rseq != i {
-		return "", fmt.Errorf("wrong sequence number %v (expected %v)", rseq, i)
+	n, err := p.recv(seq)
+	if err != nil {
+		return "", 0, err
 	}
+	rtt := time.Since(before)
+	return fmt.Sprintf("%d bytes from %v: icmp_seq=%v, time=%v", n, host, seq, beatifulLatency(rtt)), rtt, nil
+}
+
+// run pings count times (forever if count is 0), every interval, until
+// stop is signalled. It returns the accumulated statistics.
+func (p *pinger) run(w io.Writer, host string, count uint64, interval time.Duration, flooding bool, stop <-chan os.Signal) *stats {
+	s := &stats{host: host, start: time.Now()}
+	defer func() { s.end = time.Now() }()
 
-	return fmt.Sprintf("%d bytes from %v: icmp_seq=%v, time=%v", amt, host, i, latency), nil
+	for i := uint64(1); count == 0 || i <= count; i++ {
+		if flooding {
+			fmt.Fprint(w, ".")
+		}
+		s.sent++
+		msg, rtt, err := p.ping1(host, int(i))
+		if err == nil {
+			s.received++
+			s.rtts = append(s.rtts, rtt)
+			if flooding {
+				fmt.Fprint(w, "\b")
+			} else {
+				fmt.Fprintln(w, msg)
+			}
+		} else if !flooding {
+			fmt.Fprintf(w, "ping failed: %v\n", err)
+		}
+
+		if count != 0 && i == count {
+			break
+		}
+		select {
+		case <-stop:
+			return s
+		case <-time.After(interval):
+		}
+	}
+	return s
 }
 
 func main() {
@@ -159,22 +300,27 @@ func main() {
 		log.Fatalf("packet size too small (must be >= 8): %v", *packetSize)
 	}
 
-	netname := "ip4:icmp"
-	interval := time.Duration(*intv)
 	host := flag.Args()[0]
-	// todo: just figure out if it's an ip6 address and go from there.
-	if *net6 {
-		netname = "ip6:ipv6-icmp"
+	interval := time.Duration(*intv) * time.Millisecond
+	if *flood {
+		interval = 0
 	}
 
-	// ping needs to run forever, except if '*iter' is not zero
-	var i uint64
-	for i = 1; *iter == 0 || i < *iter; i++ {
-		msg, err := ping1(netname, host, i)
-		if err != nil {
-			log.Fatalf("ping failed: %v", err)
-		}
-		log.Print(msg)
-		time.Sleep(time.Millisecond * interval)
+	p, err := newPinger(host, *net6, *packetSize, time.Duration(*wtf)*time.Millisecond)
+	if err != nil {
+		log.Fatalf("ping: %v", err)
+	}
+	defer p.close()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+
+	s := p.run(os.Stdout, host, *iter, interval, *flood, stop)
+	if *flood {
+		fmt.Println()
+	}
+	fmt.Print(s)
+	if s.received == 0 {
+		os.Exit(1)
 	}
 }
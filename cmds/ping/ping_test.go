@@ -0,0 +1,109 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	start := time.Unix(100, 0)
+	for _, tt := range []struct {
+		s    stats
+		want string
+	}{
+		{
+			s: stats{
+				host:     "localhost",
+				sent:     4,
+				received: 2,
+				rtts:     []time.Duration{time.Millisecond, 3 * time.Millisecond},
+				start:    start,
+				end:      start.Add(3 * time.Second),
+			},
+			want: "--- localhost ping statistics ---\n" +
+				"4 packets transmitted, 2 received, 50% packet loss, time 3000ms\n" +
+				"rtt min/avg/max/mdev = 1.000/2.000/3.000/1.000 ms\n",
+		},
+		{
+			s: stats{
+				host:  "10.0.0.1",
+				sent:  3,
+				start: start,
+				end:   start.Add(2 * time.Second),
+			},
+			want: "--- 10.0.0.1 ping statistics ---\n" +
+				"3 packets transmitted, 0 received, 100% packet loss, time 2000ms\n",
+		},
+	} {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("stats.String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func testLoopback(t *testing.T, host string, force6 bool) {
+	p, err := newPinger(host, force6, 64, time.Second)
+	if err != nil {
+		t.Skipf("Skipping, cannot open ICMP socket: %v", err)
+	}
+	defer p.close()
+
+	var out bytes.Buffer
+	s := p.run(&out, host, 3, 10*time.Millisecond, false, make(chan os.Signal))
+	if s.sent != 3 || s.received != 3 {
+		t.Fatalf("sent %d, received %d, want 3 and 3; output:\n%s", s.sent, s.received, out.String())
+	}
+	if got := strings.Count(out.String(), "icmp_seq="); got != 3 {
+		t.Errorf("got %d reply lines, want 3:\n%s", got, out.String())
+	}
+	if !strings.Contains(s.String(), "3 packets transmitted, 3 received, 0% packet loss") {
+		t.Errorf("unexpected statistics %q", s.String())
+	}
+}
+
+func TestLoopback4(t *testing.T) {
+	testLoopback(t, "127.0.0.1", false)
+}
+
+func TestLoopback6(t *testing.T) {
+	testLoopback(t, "::1", false)
+}
+
+func TestFlood(t *testing.T) {
+	p, err := newPinger("127.0.0.1", false, 64, time.Second)
+	if err != nil {
+		t.Skipf("Skipping, cannot open ICMP socket: %v", err)
+	}
+	defer p.close()
+
+	var out bytes.Buffer
+	s := p.run(&out, "127.0.0.1", 5, 0, true, make(chan os.Signal))
+	if want := strings.Repeat(".\b", 5); out.String() != want {
+		t.Errorf("flood output = %q, want %q", out.String(), want)
+	}
+	if s.received != 5 {
+		t.Errorf("received %d, want 5", s.received)
+	}
+}
+
+func TestStop(t *testing.T) {
+	p, err := newPinger("127.0.0.1", false, 64, time.Second)
+	if err != nil {
+		t.Skipf("Skipping, cannot open ICMP socket: %v", err)
+	}
+	defer p.close()
+
+	stop := make(chan os.Signal, 1)
+	stop <- os.Interrupt
+	s := p.run(&bytes.Buffer{}, "127.0.0.1", 0, time.Hour, false, stop)
+	if s.sent != 1 {
+		t.Errorf("sent %d packets after interrupt, want 1", s.sent)
+	}
+}
@@ -14,27 +14,60 @@
 //     If no files are specified, read from stdin.
 //
 // Options:
-//     -n number: the minimum string length (default is 4)
+//     -n, --min-length number: the minimum string length (default is 4)
+//     -e, --encoding s|l|b|auto: the character encoding: s for ASCII (the
+//         default), l for UTF-16LE, b for UTF-16BE, or auto for UTF-16 if
+//         the input starts with a byte order mark and ASCII otherwise. UTF-16
+//         strings are printed as UTF-8.
 package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"io"
 	"log"
 	"os"
+	"unicode"
+	"unicode/utf16"
 
 	flag "github.com/spf13/pflag"
 )
 
 var (
-	n = flag.Int("n", 4, "the minimum string length")
+	n        = flag.Int("n", 4, "the minimum string length")
+	encoding = flag.StringP("encoding", "e", "s", "the character encoding: s (ASCII), l (UTF-16LE), b (UTF-16BE) or auto")
 )
 
+func init() {
+	flag.IntVar(n, "min-length", 4, "the minimum string length")
+}
+
 func asciiIsPrint(char byte) bool {
 	return char >= 32 && char <= 126
 }
 
 func stringsIO(r *bufio.Reader, w io.Writer) error {
+	switch *encoding {
+	case "l":
+		return stringsUTF16(r, w, binary.LittleEndian)
+	case "b":
+		return stringsUTF16(r, w, binary.BigEndian)
+	case "auto":
+		if bom, err := r.Peek(2); err == nil {
+			switch {
+			case bom[0] == 0xff && bom[1] == 0xfe:
+				r.Discard(2)
+				return stringsUTF16(r, w, binary.LittleEndian)
+			case bom[0] == 0xfe && bom[1] == 0xff:
+				r.Discard(2)
+				return stringsUTF16(r, w, binary.BigEndian)
+			}
+		}
+	}
+	return stringsASCII(r, w)
+}
+
+func stringsASCII(r *bufio.Reader, w io.Writer) error {
 	var o []byte
 	for {
 		b, err := r.ReadByte()
@@ -65,6 +98,59 @@ func stringsIO(r *bufio.Reader, w io.Writer) error {
 	}
 }
 
+// stringsUTF16 prints the strings of r, which is UTF-16 in the given byte
+// order, as UTF-8. Unpaired surrogates end a string.
+func stringsUTF16(r *bufio.Reader, w io.Writer, order binary.ByteOrder) error {
+	var o []rune
+	end := func() {
+		if len(o) >= *n {
+			io.WriteString(w, string(o))
+			w.Write([]byte{'\n'})
+		}
+		o = o[:0]
+	}
+	var u [2]byte
+	// high is the first half of a surrogate pair, or 0.
+	var high rune
+	for {
+		if _, err := io.ReadFull(r, u[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			end()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c := rune(order.Uint16(u[:]))
+		switch {
+		case c >= 0xd800 && c < 0xdc00:
+			if high != 0 {
+				end()
+			}
+			high = c
+			continue
+		case c >= 0xdc00 && c < 0xe000:
+			if high == 0 {
+				end()
+				continue
+			}
+			c = utf16.DecodeRune(high, c)
+			high = 0
+		case high != 0:
+			end()
+			high = 0
+		}
+		if !unicode.IsPrint(c) {
+			end()
+			continue
+		}
+		// Prevent the buffer from growing indefinitely.
+		if len(o) >= *n+1024 {
+			io.WriteString(w, string(o[:1024]))
+			o = o[1024:]
+		}
+		o = append(o, c)
+	}
+}
+
 func stringsFile(file string, w io.Writer) error {
 	f, err := os.Open(file)
 	if err != nil {
@@ -98,6 +184,11 @@ func main() {
 	if *n < 1 {
 		log.Fatalf("strings: invalid minimum string length %v", *n)
 	}
+	switch *encoding {
+	case "s", "l", "b", "auto":
+	default:
+		log.Fatalf("strings: invalid encoding %q", *encoding)
+	}
 
 	// Buffer reduces number of syscalls.
 	wb := bufio.NewWriter(os.Stdout)
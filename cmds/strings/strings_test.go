@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"unicode/utf16"
 
 	"github.com/u-root/u-root/pkg/testutil"
 )
@@ -62,6 +63,60 @@ var stringsTests = []test{
 		"larger value of n",
 		[]string{"--n", "6"}, "\n\na123456\nab\n\nabc\nabcde\xff\n01\n", "a123456\n",
 	},
+	{
+		"min-length",
+		[]string{"--min-length", "6"}, "\n\na123456\nab\n\nabc\nabcde\xff\n01\n", "a123456\n",
+	},
+	{
+		"UTF-16 is not ASCII",
+		[]string{}, utf16le("EFI boot"), "",
+	},
+	{
+		"UTF-16LE",
+		[]string{"--encoding=l"}, "\x00\x00" + utf16le("EFI boot") + "\x00\x00" + utf16le("abc") + "\x01\x00" + utf16le("Boot0001\tx"), "EFI boot\nBoot0001\n",
+	},
+	{
+		"UTF-16LE beyond ASCII",
+		[]string{"-e", "l"}, utf16le("Grüße, 世界 \U0001F600") + "\x00\xd8" + utf16le("abcd") + "\x00\xdc", "Grüße, 世界 \U0001F600\nabcd\n",
+	},
+	{
+		"UTF-16LE odd length",
+		[]string{"-e", "l"}, utf16le("abcd") + "x", "abcd\n",
+	},
+	{
+		"UTF-16BE",
+		[]string{"-e", "b"}, utf16be("UEFI shell") + "\x00\x00" + utf16be("fs0:"), "UEFI shell\nfs0:\n",
+	},
+	{
+		"auto UTF-16LE",
+		[]string{"-e", "auto"}, "\xff\xfe" + utf16le("EFI boot"), "EFI boot\n",
+	},
+	{
+		"auto UTF-16BE",
+		[]string{"-e", "auto"}, "\xfe\xff" + utf16be("EFI boot"), "EFI boot\n",
+	},
+	{
+		"auto without BOM",
+		[]string{"-e", "auto"}, "abcdefg\x00" + utf16le("EFI boot"), "abcdefg\n",
+	},
+}
+
+// utf16le returns s in UTF-16LE.
+func utf16le(s string) string {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return string(b)
+}
+
+// utf16be returns s in UTF-16BE.
+func utf16be(s string) string {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return string(b)
 }
 
 // strings < in > out
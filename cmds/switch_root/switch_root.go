@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/u-root/u-root/pkg/mount"
 	"golang.org/x/sys/unix"
 )
 
@@ -179,11 +180,6 @@ func switchRoot(newRoot string, init string) error {
 		return fmt.Errorf("switch_root: moving mounts failed %v", err)
 	}
 
-	log.Printf("switch_root: Changing directory")
-	if err := unix.Chdir(newRoot); err != nil {
-		return fmt.Errorf("switch_root: failed change directory to new_root %v", err)
-	}
-
 	// Open "/" now, we need the file descriptor later.
 	oldRoot, err := os.Open("/")
 	if err != nil {
@@ -191,14 +187,9 @@ func switchRoot(newRoot string, init string) error {
 	}
 	defer oldRoot.Close()
 
-	log.Printf("switch_root: Moving /")
-	if err := moveMount(newRoot, "/"); err != nil {
-		return err
-	}
-
-	log.Printf("switch_root: Changing root!")
-	if err := unix.Chroot("."); err != nil {
-		return fmt.Errorf("switch_root: fatal chroot error %v", err)
+	log.Printf("switch_root: Moving / and changing root!")
+	if err := mount.MoveRoot(newRoot); err != nil {
+		return fmt.Errorf("switch_root: %v", err)
 	}
 
 	log.Printf("switch_root: Deleting old /")
@@ -0,0 +1,528 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Show and manipulate traffic control settings.
+//
+// Synopsis:
+//     tc qdisc add dev DEV root netem [delay TIME [JITTER [CORRELATION]]]
+//         [loss PERCENT [CORRELATION]] [duplicate PERCENT [CORRELATION]]
+//         [limit PACKETS]
+//     tc qdisc add dev DEV root tbf rate RATE burst SIZE (latency TIME | limit SIZE)
+//     tc qdisc del dev DEV root
+//     tc qdisc show [dev DEV]
+//
+// Description:
+//     tc sets the root queueing discipline of a device, which is enough to
+//     simulate slow or lossy networks in tests. netem delays, drops and
+//     duplicates packets; tbf limits the rate with a token bucket.
+//
+//     TIME is a number with an optional unit of us, ms or s (default us).
+//     RATE is a number with a unit of bit, kbit, mbit, gbit (bits per
+//     second), bps, kbps, mbps or gbps (bytes per second); the default is
+//     bit. SIZE is a number with a unit of b, k, kb, m, mb, kbit or mbit;
+//     the default is bytes. PERCENT and CORRELATION are percentages with an
+//     optional % sign.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const usage = `usage:
+	tc qdisc add dev DEV root netem [delay TIME [JITTER [CORRELATION]]] [loss PERCENT [CORRELATION]] [duplicate PERCENT [CORRELATION]] [limit PACKETS]
+	tc qdisc add dev DEV root tbf rate RATE burst SIZE (latency TIME | limit SIZE)
+	tc qdisc del dev DEV root
+	tc qdisc show [dev DEV]`
+
+// args is the part of the command line that is still to be parsed.
+type args []string
+
+// next removes and returns the next argument, or "" if there is none.
+func (a *args) next() string {
+	if len(*a) == 0 {
+		return ""
+	}
+	s := (*a)[0]
+	*a = (*a)[1:]
+	return s
+}
+
+// peek returns the next argument without removing it.
+func (a *args) peek() string {
+	if len(*a) == 0 {
+		return ""
+	}
+	return (*a)[0]
+}
+
+// want removes the next argument, which must be one of words.
+func (a *args) want(words ...string) (string, error) {
+	s := a.next()
+	for _, w := range words {
+		if s == w {
+			return s, nil
+		}
+	}
+	if s == "" {
+		return "", fmt.Errorf("expected %s", strings.Join(words, " or "))
+	}
+	return "", fmt.Errorf("expected %s, got %q", strings.Join(words, " or "), s)
+}
+
+// value removes the next argument, which must exist, as the value of key.
+func (a *args) value(key string) (string, error) {
+	s := a.next()
+	if s == "" {
+		return "", fmt.Errorf("%s needs a value", key)
+	}
+	return s, nil
+}
+
+// number splits s into its leading number and unit.
+func number(s string) (float64, string, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || v < 0 {
+		return 0, "", fmt.Errorf("invalid number %q", s)
+	}
+	return v, strings.ToLower(s[i:]), nil
+}
+
+// parseTime parses a TIME and returns it in microseconds.
+func parseTime(s string) (uint32, error) {
+	v, unit, err := number(s)
+	if err != nil {
+		return 0, err
+	}
+	switch unit {
+	case "", "us", "usec", "usecs":
+	case "ms", "msec", "msecs":
+		v *= 1e3
+	case "s", "sec", "secs":
+		v *= 1e6
+	default:
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	if v > math.MaxUint32 {
+		return 0, fmt.Errorf("time %q is too large", s)
+	}
+	return uint32(v), nil
+}
+
+// parseRate parses a RATE and returns it in bytes per second.
+func parseRate(s string) (uint64, error) {
+	v, unit, err := number(s)
+	if err != nil {
+		return 0, err
+	}
+	switch unit {
+	case "", "bit":
+		v /= 8
+	case "kbit":
+		v *= 1e3 / 8
+	case "mbit":
+		v *= 1e6 / 8
+	case "gbit":
+		v *= 1e9 / 8
+	case "bps":
+	case "kbps":
+		v *= 1e3
+	case "mbps":
+		v *= 1e6
+	case "gbps":
+		v *= 1e9
+	default:
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if v < 1 {
+		return 0, fmt.Errorf("rate %q is too small", s)
+	}
+	return uint64(v), nil
+}
+
+// parseSize parses a SIZE and returns it in bytes.
+func parseSize(s string) (uint32, error) {
+	v, unit, err := number(s)
+	if err != nil {
+		return 0, err
+	}
+	switch unit {
+	case "", "b":
+	case "k", "kb":
+		v *= 1024
+	case "m", "mb":
+		v *= 1024 * 1024
+	case "kbit":
+		v *= 1024 / 8
+	case "mbit":
+		v *= 1024 * 1024 / 8
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if v > math.MaxUint32 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return uint32(v), nil
+}
+
+// parsePercent parses a PERCENT.
+func parsePercent(s string) (float32, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 32)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return float32(v), nil
+}
+
+// isNumber tells whether s starts like a number, i.e. is an optional value
+// and not the next keyword.
+func isNumber(s string) bool {
+	return s != "" && (s[0] >= '0' && s[0] <= '9' || s[0] == '.')
+}
+
+// parseNetem parses the netem options.
+func parseNetem(a *args, attrs netlink.QdiscAttrs) (netlink.Qdisc, error) {
+	var n netlink.NetemQdiscAttrs
+	for len(*a) > 0 {
+		key := a.next()
+		s, err := a.value(key)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "delay", "latency":
+			if n.Latency, err = parseTime(s); err != nil {
+				return nil, err
+			}
+			if isNumber(a.peek()) {
+				if n.Jitter, err = parseTime(a.next()); err != nil {
+					return nil, err
+				}
+				if isNumber(a.peek()) {
+					if n.DelayCorr, err = parsePercent(a.next()); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case "loss":
+			// iproute2 also accepts "loss random PERCENT".
+			if s == "random" {
+				if s, err = a.value(key); err != nil {
+					return nil, err
+				}
+			}
+			if n.Loss, err = parsePercent(s); err != nil {
+				return nil, err
+			}
+			if isNumber(a.peek()) {
+				if n.LossCorr, err = parsePercent(a.next()); err != nil {
+					return nil, err
+				}
+			}
+		case "duplicate":
+			if n.Duplicate, err = parsePercent(s); err != nil {
+				return nil, err
+			}
+			if isNumber(a.peek()) {
+				if n.DuplicateCorr, err = parsePercent(a.next()); err != nil {
+					return nil, err
+				}
+			}
+		case "limit":
+			l, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit %q", s)
+			}
+			n.Limit = uint32(l)
+		default:
+			return nil, fmt.Errorf("unknown netem option %q", key)
+		}
+	}
+	return netlink.NewNetem(attrs, n), nil
+}
+
+// parseTbf parses the tbf options.
+func parseTbf(a *args, attrs netlink.QdiscAttrs) (netlink.Qdisc, error) {
+	var (
+		rate         uint64
+		burst, limit uint32
+		latency      uint32
+		haveLatency  bool
+		haveLimit    bool
+	)
+	for len(*a) > 0 {
+		key := a.next()
+		s, err := a.value(key)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "rate":
+			rate, err = parseRate(s)
+		case "burst", "buffer", "maxburst":
+			burst, err = parseSize(s)
+		case "latency":
+			latency, err = parseTime(s)
+			haveLatency = true
+		case "limit":
+			limit, err = parseSize(s)
+			haveLimit = true
+		default:
+			return nil, fmt.Errorf("unknown tbf option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case rate == 0:
+		return nil, fmt.Errorf("tbf needs a rate")
+	case burst == 0:
+		return nil, fmt.Errorf("tbf needs a burst")
+	case haveLatency == haveLimit:
+		return nil, fmt.Errorf("tbf needs either a latency or a limit")
+	}
+	if haveLatency {
+		// The queue holds what can be sent in latency, plus the bucket.
+		l := float64(rate)*float64(latency)/1e6 + float64(burst)
+		if l > math.MaxUint32 {
+			return nil, fmt.Errorf("tbf latency is too large")
+		}
+		limit = uint32(l)
+	}
+	return &netlink.Tbf{
+		QdiscAttrs: attrs,
+		Rate:       rate,
+		Limit:      limit,
+		// The kernel wants the bucket size as the time to send it.
+		Buffer: uint32(netlink.Xmittime(rate, burst)),
+	}, nil
+}
+
+// link parses "dev DEV".
+func link(a *args) (netlink.Link, error) {
+	if _, err := a.want("dev"); err != nil {
+		return nil, err
+	}
+	name, err := a.value("dev")
+	if err != nil {
+		return nil, err
+	}
+	return netlink.LinkByName(name)
+}
+
+// qdiscAdd implements "tc qdisc add".
+func qdiscAdd(a *args) error {
+	l, err := link(a)
+	if err != nil {
+		return err
+	}
+	if _, err := a.want("root"); err != nil {
+		return err
+	}
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: l.Attrs().Index,
+		Parent:    netlink.HANDLE_ROOT,
+		Handle:    netlink.MakeHandle(1, 0),
+	}
+	if a.peek() == "handle" {
+		a.next()
+		s, err := a.value("handle")
+		if err != nil {
+			return err
+		}
+		major, err := strconv.ParseUint(strings.TrimSuffix(s, ":"), 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid handle %q", s)
+		}
+		attrs.Handle = netlink.MakeHandle(uint16(major), 0)
+	}
+
+	var q netlink.Qdisc
+	kind, err := a.want("netem", "tbf")
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "netem":
+		q, err = parseNetem(a, attrs)
+	case "tbf":
+		q, err = parseTbf(a, attrs)
+	}
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscAdd(q); err != nil {
+		return fmt.Errorf("adding %s qdisc to %s: %v", kind, l.Attrs().Name, err)
+	}
+	return nil
+}
+
+// qdiscDel implements "tc qdisc del".
+func qdiscDel(a *args) error {
+	l, err := link(a)
+	if err != nil {
+		return err
+	}
+	if _, err := a.want("root"); err != nil {
+		return err
+	}
+	// The kernel finds the qdisc by its parent; the kind does not matter.
+	q := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: l.Attrs().Index,
+			Parent:    netlink.HANDLE_ROOT,
+		},
+	}
+	if err := netlink.QdiscDel(q); err != nil {
+		return fmt.Errorf("deleting root qdisc of %s: %v", l.Attrs().Name, err)
+	}
+	return nil
+}
+
+// qdiscShow implements "tc qdisc show".
+func qdiscShow(w io.Writer, a *args) error {
+	var l netlink.Link
+	if len(*a) > 0 {
+		var err error
+		if l, err = link(a); err != nil {
+			return err
+		}
+	}
+	qs, err := netlink.QdiscList(l)
+	if err != nil {
+		return err
+	}
+	for _, q := range qs {
+		fmt.Fprintln(w, formatQdisc(q))
+	}
+	return nil
+}
+
+func ticksToTime(ticks uint32) uint32 {
+	return uint32(float64(ticks) / netlink.TickInUsec())
+}
+
+func formatTime(us uint32) string {
+	switch {
+	case us >= 1e6 && us%1e5 == 0:
+		return strconv.FormatFloat(float64(us)/1e6, 'f', -1, 64) + "s"
+	case us >= 1e3:
+		return strconv.FormatFloat(float64(us)/1e3, 'f', 1, 64) + "ms"
+	}
+	return fmt.Sprintf("%dus", us)
+}
+
+// formatRate formats bytes per second as bits per second, as tc does.
+func formatRate(bps uint64) string {
+	bits := float64(bps) * 8
+	switch {
+	case bits >= 1e9:
+		return strconv.FormatFloat(bits/1e9, 'f', -1, 64) + "Gbit"
+	case bits >= 1e6:
+		return strconv.FormatFloat(bits/1e6, 'f', -1, 64) + "Mbit"
+	case bits >= 1e3:
+		return strconv.FormatFloat(bits/1e3, 'f', -1, 64) + "Kbit"
+	}
+	return strconv.FormatFloat(bits, 'f', -1, 64) + "bit"
+}
+
+func formatSize(b uint32) string {
+	switch {
+	case b >= 1024*1024 && b%(1024*1024) == 0:
+		return fmt.Sprintf("%dMb", b/(1024*1024))
+	case b >= 1024 && b%1024 == 0:
+		return fmt.Sprintf("%dKb", b/1024)
+	}
+	return fmt.Sprintf("%db", b)
+}
+
+// formatPercent formats a netlink probability, where MaxUint32 is 100%.
+func formatPercent(p uint32) string {
+	return strconv.FormatFloat(float64(p)*100/math.MaxUint32, 'f', -1, 32) + "%"
+}
+
+func formatQdisc(q netlink.Qdisc) string {
+	a := q.Attrs()
+	major, _ := netlink.MajorMinor(a.Handle)
+	s := fmt.Sprintf("qdisc %s %x: ", q.Type(), major)
+	if a.Parent == netlink.HANDLE_ROOT {
+		s += "root"
+	} else {
+		s += "parent " + netlink.HandleStr(a.Parent)
+	}
+	s += fmt.Sprintf(" refcnt %d", a.Refcnt)
+
+	switch q := q.(type) {
+	case *netlink.Netem:
+		s += fmt.Sprintf(" limit %d", q.Limit)
+		if q.Latency > 0 {
+			s += " delay " + formatTime(ticksToTime(q.Latency))
+			if q.Jitter > 0 {
+				s += " " + formatTime(ticksToTime(q.Jitter))
+				if q.DelayCorr > 0 {
+					s += " " + formatPercent(q.DelayCorr)
+				}
+			}
+		}
+		if q.Loss > 0 {
+			s += " loss " + formatPercent(q.Loss)
+			if q.LossCorr > 0 {
+				s += " " + formatPercent(q.LossCorr)
+			}
+		}
+		if q.Duplicate > 0 {
+			s += " duplicate " + formatPercent(q.Duplicate)
+			if q.DuplicateCorr > 0 {
+				s += " " + formatPercent(q.DuplicateCorr)
+			}
+		}
+	case *netlink.Tbf:
+		burst := float64(q.Rate) * float64(ticksToTime(q.Buffer)) / 1e6
+		s += fmt.Sprintf(" rate %s burst %s", formatRate(q.Rate), formatSize(uint32(math.Round(burst))))
+		lat := 1e6*float64(q.Limit)/float64(q.Rate) - float64(ticksToTime(q.Buffer))
+		if lat > 0 {
+			s += " lat " + formatTime(uint32(math.Round(lat)))
+		}
+	}
+	return s
+}
+
+func tc(w io.Writer, a args) error {
+	if _, err := a.want("qdisc"); err != nil {
+		return err
+	}
+	cmd := a.next()
+	switch cmd {
+	case "add":
+		return qdiscAdd(&a)
+	case "del", "delete":
+		return qdiscDel(&a)
+	case "show", "list", "ls", "":
+		return qdiscShow(w, &a)
+	}
+	return fmt.Errorf("unknown qdisc command %q", cmd)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+	if err := tc(os.Stdout, args(os.Args[1:])); err != nil {
+		log.Fatalf("tc: %v\n%s", err, usage)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseUnits(t *testing.T) {
+	for _, tt := range []struct {
+		s     string
+		parse func(string) (uint64, error)
+		want  uint64
+	}{
+		{"100ms", func(s string) (uint64, error) { v, err := parseTime(s); return uint64(v), err }, 100000},
+		{"1.5s", func(s string) (uint64, error) { v, err := parseTime(s); return uint64(v), err }, 1500000},
+		{"250", func(s string) (uint64, error) { v, err := parseTime(s); return uint64(v), err }, 250},
+		{"1mbit", parseRate, 125000},
+		{"8kbit", parseRate, 1000},
+		{"2mbps", parseRate, 2000000},
+		{"800", parseRate, 100},
+		{"32kbit", func(s string) (uint64, error) { v, err := parseSize(s); return uint64(v), err }, 4096},
+		{"10kb", func(s string) (uint64, error) { v, err := parseSize(s); return uint64(v), err }, 10240},
+		{"1500", func(s string) (uint64, error) { v, err := parseSize(s); return uint64(v), err }, 1500},
+	} {
+		got, err := tt.parse(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("parse(%q) = %d, %v, want %d, nil", tt.s, got, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "ms", "10 parsecs", "-1ms", "1..2s"} {
+		if _, err := parseTime(s); err == nil {
+			t.Errorf("parseTime(%q) = nil, want error", s)
+		}
+	}
+	for _, s := range []string{"1furlong", "1bit"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("parseRate(%q) = nil, want error", s)
+		}
+	}
+	for _, s := range []string{"101%", "x", "-1"} {
+		if _, err := parsePercent(s); err == nil {
+			t.Errorf("parsePercent(%q) = nil, want error", s)
+		}
+	}
+	if p, err := parsePercent("25%"); err != nil || p != 25 {
+		t.Errorf("parsePercent(25%%) = %v, %v, want 25, nil", p, err)
+	}
+}
+
+func TestParseNetem(t *testing.T) {
+	a := args(strings.Fields("delay 100ms 10ms 25% loss 1% duplicate 2 limit 50"))
+	q, err := parseNetem(&a, netlink.QdiscAttrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := q.(*netlink.Netem)
+	if n.Limit != 50 || n.Loss != netlink.Percentage2u32(1) || n.Duplicate != netlink.Percentage2u32(2) || n.DelayCorr != netlink.Percentage2u32(25) {
+		t.Errorf("parseNetem = %+v", n)
+	}
+	if got := ticksToTime(n.Latency); got < 99990 || got > 100000 {
+		t.Errorf("delay = %dus, want 100000us", got)
+	}
+
+	for _, s := range []string{"delay", "delay 1ms loss", "jitter 1ms", "loss 200%"} {
+		a := args(strings.Fields(s))
+		if _, err := parseNetem(&a, netlink.QdiscAttrs{}); err == nil {
+			t.Errorf("parseNetem(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestParseTbf(t *testing.T) {
+	a := args(strings.Fields("rate 1mbit burst 32kbit latency 400ms"))
+	q, err := parseTbf(&a, netlink.QdiscAttrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbf := q.(*netlink.Tbf)
+	if tbf.Rate != 125000 {
+		t.Errorf("rate = %d, want 125000", tbf.Rate)
+	}
+	// 400ms at 125000 bytes/s plus the 4096 byte bucket.
+	if tbf.Limit != 54096 {
+		t.Errorf("limit = %d, want 54096", tbf.Limit)
+	}
+
+	for _, s := range []string{"rate 1mbit", "burst 10kb latency 1ms", "rate 1mbit burst 10kb", "rate 1mbit burst 10kb latency 1ms limit 1000"} {
+		a := args(strings.Fields(s))
+		if _, err := parseTbf(&a, netlink.QdiscAttrs{}); err == nil {
+			t.Errorf("parseTbf(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, tt := range []struct {
+		got, want string
+	}{
+		{formatTime(100000), "100.0ms"},
+		{formatTime(2000000), "2s"},
+		{formatTime(12), "12us"},
+		{formatRate(125000), "1Mbit"},
+		{formatRate(1000), "8Kbit"},
+		{formatSize(4096), "4Kb"},
+		{formatSize(1500), "1500b"},
+		{formatPercent(netlink.Percentage2u32(100)), "100%"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestBadCommands(t *testing.T) {
+	for _, s := range []string{"", "filter show", "qdisc frob", "qdisc add lo root netem", "qdisc add dev lo netem", "qdisc add dev lo root sfq"} {
+		var b bytes.Buffer
+		if err := tc(&b, args(strings.Fields(s))); err == nil {
+			t.Errorf("tc %s = nil, want error", s)
+		}
+	}
+}
+
+func run(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := tc(&b, args(strings.Fields(s))); err != nil {
+		t.Fatalf("tc %s = %v", s, err)
+	}
+	return b.String()
+}
+
+// add runs "tc s", skipping the test if the kernel lacks the qdisc.
+func add(t *testing.T, s string) {
+	t.Helper()
+	if err := tc(&bytes.Buffer{}, args(strings.Fields(s))); err != nil {
+		if strings.Contains(err.Error(), "no such file") || strings.Contains(err.Error(), "not supported") {
+			t.Skipf("Skipping, kernel lacks qdisc: %v", err)
+		}
+		t.Fatalf("tc %s = %v", s, err)
+	}
+}
+
+func TestNetem(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		add(t, "qdisc add dev lo root netem delay 100ms 10ms 25% loss 1% duplicate 1%")
+		out := run(t, "qdisc show dev lo")
+		for _, want := range []string{"qdisc netem 1: root", "delay 100.0ms 10.0ms 25%", "loss 1%", "duplicate 1%"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("show = %q, want it to contain %q", out, want)
+			}
+		}
+
+		// There can only be one root qdisc.
+		if err := tc(&bytes.Buffer{}, args(strings.Fields("qdisc add dev lo root netem delay 1ms"))); err == nil {
+			t.Errorf("second add = nil, want error")
+		}
+
+		run(t, "qdisc del dev lo root")
+		if out := run(t, "qdisc show dev lo"); strings.Contains(out, "netem") {
+			t.Errorf("show after del = %q, want no netem", out)
+		}
+	})
+}
+
+func TestTbf(t *testing.T) {
+	testutil.InNetNS(t, func() {
+		add(t, "qdisc add dev lo root tbf rate 1mbit burst 32kbit latency 400ms")
+		out := run(t, "qdisc show dev lo")
+		for _, want := range []string{"qdisc tbf 1: root", "rate 1Mbit burst 4Kb lat 400.0ms"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("show = %q, want it to contain %q", out, want)
+			}
+		}
+		run(t, "qdisc del dev lo root")
+		if out := run(t, "qdisc show dev lo"); strings.Contains(out, "tbf") {
+			t.Errorf("show after del = %q, want no tbf", out)
+		}
+	})
+}
@@ -0,0 +1,481 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// The filter language is a small subset of pcap-filter(7):
+//
+//     expr      := term { "or" term }
+//     term      := factor { "and" factor }
+//     factor    := "not" factor | "(" expr ")" | primitive
+//     primitive := proto [qualifier] | qualifier
+//     proto     := "ip" | "ip6" | "arp" | "tcp" | "udp" | "icmp"
+//     qualifier := [ "src" | "dst" ] ( "host" ADDR | "port" NUMBER )
+//
+// Filters are compiled to classic BPF for Ethernet frames. The generated code
+// is deliberately naive; it is not meant to compete with libpcap's optimizer.
+
+// Ethernet frame offsets.
+const (
+	ethTypeOff = 12
+	ethHdrLen  = 14
+
+	ipv4ProtoOff = ethHdrLen + 9
+	ipv4FragOff  = ethHdrLen + 6
+	ipv4SrcOff   = ethHdrLen + 12
+	ipv4DstOff   = ethHdrLen + 16
+
+	ipv6NextOff = ethHdrLen + 6
+	ipv6SrcOff  = ethHdrLen + 8
+	ipv6DstOff  = ethHdrLen + 24
+	ipv6HdrLen  = 40
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	// snapLen is the number of bytes a matching filter accepts.
+	snapLen = 0x40000
+)
+
+type label int
+
+// fall is the label of the instruction directly following a jump.
+const fall label = 0
+
+// insn is either a plain BPF instruction, a label-relative conditional jump,
+// or a label definition.
+type insn struct {
+	ins bpf.Instruction
+
+	// Conditional jump.
+	cond   bpf.JumpTest
+	val    uint32
+	jt, jf label
+	isCond bool
+
+	// Label definition; takes up no instruction slot.
+	mark   label
+	isMark bool
+}
+
+// assembler generates BPF programs with symbolic jump targets.
+type assembler struct {
+	prog   []insn
+	labels label
+}
+
+func (a *assembler) newLabel() label {
+	a.labels++
+	return a.labels
+}
+
+func (a *assembler) emit(ins ...bpf.Instruction) {
+	for _, i := range ins {
+		a.prog = append(a.prog, insn{ins: i})
+	}
+}
+
+func (a *assembler) jumpIf(cond bpf.JumpTest, val uint32, t, f label) {
+	a.prog = append(a.prog, insn{cond: cond, val: val, jt: t, jf: f, isCond: true})
+}
+
+func (a *assembler) mark(l label) {
+	a.prog = append(a.prog, insn{mark: l, isMark: true})
+}
+
+// resolve turns symbolic jumps into relative skips.
+func (a *assembler) resolve() ([]bpf.Instruction, error) {
+	pos := make(map[label]int)
+	n := 0
+	for _, i := range a.prog {
+		if i.isMark {
+			pos[i.mark] = n
+		} else {
+			n++
+		}
+	}
+
+	skip := func(from int, to label) (int, error) {
+		if to == fall {
+			return 0, nil
+		}
+		p, ok := pos[to]
+		if !ok {
+			return 0, fmt.Errorf("undefined label %d", to)
+		}
+		if p <= from {
+			return 0, fmt.Errorf("backwards jump to label %d", to)
+		}
+		return p - from - 1, nil
+	}
+
+	var out []bpf.Instruction
+	for _, i := range a.prog {
+		switch {
+		case i.isMark:
+			continue
+
+		case i.isCond:
+			t, err := skip(len(out), i.jt)
+			if err != nil {
+				return nil, err
+			}
+			f, err := skip(len(out), i.jf)
+			if err != nil {
+				return nil, err
+			}
+			if t > 255 || f > 255 {
+				return nil, fmt.Errorf("filter too large")
+			}
+			out = append(out, bpf.JumpIf{Cond: i.cond, Val: i.val, SkipTrue: uint8(t), SkipFalse: uint8(f)})
+
+		default:
+			out = append(out, i.ins)
+		}
+	}
+	return out, nil
+}
+
+// node is a parsed filter expression that can generate code jumping to t if
+// the packet matches and to f otherwise.
+type node interface {
+	gen(a *assembler, t, f label)
+}
+
+type orNode struct{ l, r node }
+
+func (n orNode) gen(a *assembler, t, f label) {
+	next := a.newLabel()
+	n.l.gen(a, t, next)
+	a.mark(next)
+	n.r.gen(a, t, f)
+}
+
+type andNode struct{ l, r node }
+
+func (n andNode) gen(a *assembler, t, f label) {
+	next := a.newLabel()
+	n.l.gen(a, next, f)
+	a.mark(next)
+	n.r.gen(a, t, f)
+}
+
+type notNode struct{ n node }
+
+func (n notNode) gen(a *assembler, t, f label) {
+	n.n.gen(a, f, t)
+}
+
+type etherNode struct{ typ uint32 }
+
+func (n etherNode) gen(a *assembler, t, f label) {
+	a.emit(bpf.LoadAbsolute{Off: ethTypeOff, Size: 2})
+	a.jumpIf(bpf.JumpEqual, n.typ, t, f)
+}
+
+type protoNode struct {
+	v4, v6 uint32
+}
+
+func (n protoNode) gen(a *assembler, t, f label) {
+	v6 := a.newLabel()
+	a.emit(bpf.LoadAbsolute{Off: ethTypeOff, Size: 2})
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv4, fall, v6)
+	a.emit(bpf.LoadAbsolute{Off: ipv4ProtoOff, Size: 1})
+	a.jumpIf(bpf.JumpEqual, n.v4, t, f)
+
+	a.mark(v6)
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv6, fall, f)
+	a.emit(bpf.LoadAbsolute{Off: ipv6NextOff, Size: 1})
+	a.jumpIf(bpf.JumpEqual, n.v6, t, f)
+}
+
+type hostNode struct {
+	ip       net.IP
+	src, dst bool
+}
+
+func (n hostNode) gen(a *assembler, t, f label) {
+	if ip4 := n.ip.To4(); ip4 != nil {
+		a.emit(bpf.LoadAbsolute{Off: ethTypeOff, Size: 2})
+		a.jumpIf(bpf.JumpEqual, etherTypeIPv4, fall, f)
+		val := binary.BigEndian.Uint32(ip4)
+		if n.src {
+			a.emit(bpf.LoadAbsolute{Off: ipv4SrcOff, Size: 4})
+			if n.dst {
+				a.jumpIf(bpf.JumpEqual, val, t, fall)
+			} else {
+				a.jumpIf(bpf.JumpEqual, val, t, f)
+			}
+		}
+		if n.dst {
+			a.emit(bpf.LoadAbsolute{Off: ipv4DstOff, Size: 4})
+			a.jumpIf(bpf.JumpEqual, val, t, f)
+		}
+		return
+	}
+
+	ip6 := n.ip.To16()
+	a.emit(bpf.LoadAbsolute{Off: ethTypeOff, Size: 2})
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv6, fall, f)
+	cmp := func(off uint32, t, f label) {
+		for i := uint32(0); i < 4; i++ {
+			a.emit(bpf.LoadAbsolute{Off: off + 4*i, Size: 4})
+			w := binary.BigEndian.Uint32(ip6[4*i:])
+			if i == 3 {
+				a.jumpIf(bpf.JumpEqual, w, t, f)
+			} else {
+				a.jumpIf(bpf.JumpEqual, w, fall, f)
+			}
+		}
+	}
+	if n.src && n.dst {
+		other := a.newLabel()
+		cmp(ipv6SrcOff, t, other)
+		a.mark(other)
+		cmp(ipv6DstOff, t, f)
+	} else if n.src {
+		cmp(ipv6SrcOff, t, f)
+	} else {
+		cmp(ipv6DstOff, t, f)
+	}
+}
+
+type portNode struct {
+	port     uint32
+	src, dst bool
+}
+
+func (n portNode) gen(a *assembler, t, f label) {
+	v6 := a.newLabel()
+	a.emit(bpf.LoadAbsolute{Off: ethTypeOff, Size: 2})
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv4, fall, v6)
+
+	// IPv4: must be TCP or UDP and not a fragment.
+	a.emit(bpf.LoadAbsolute{Off: ipv4ProtoOff, Size: 1})
+	isL4 := a.newLabel()
+	a.jumpIf(bpf.JumpEqual, protoTCP, isL4, fall)
+	a.jumpIf(bpf.JumpEqual, protoUDP, isL4, f)
+	a.mark(isL4)
+	a.emit(bpf.LoadAbsolute{Off: ipv4FragOff, Size: 2})
+	a.jumpIf(bpf.JumpBitsSet, 0x1fff, f, fall)
+	a.emit(bpf.LoadMemShift{Off: ethHdrLen})
+	n.ports(a, ethHdrLen, true, t, f)
+
+	a.mark(v6)
+	a.jumpIf(bpf.JumpEqual, etherTypeIPv6, fall, f)
+	a.emit(bpf.LoadAbsolute{Off: ipv6NextOff, Size: 1})
+	isL46 := a.newLabel()
+	a.jumpIf(bpf.JumpEqual, protoTCP, isL46, fall)
+	a.jumpIf(bpf.JumpEqual, protoUDP, isL46, f)
+	a.mark(isL46)
+	n.ports(a, ethHdrLen+ipv6HdrLen, false, t, f)
+}
+
+// ports compares the source and/or destination port at off. If indirect is
+// set, off is relative to the X register.
+func (n portNode) ports(a *assembler, off uint32, indirect bool, t, f label) {
+	load := func(o uint32) {
+		if indirect {
+			a.emit(bpf.LoadIndirect{Off: o, Size: 2})
+		} else {
+			a.emit(bpf.LoadAbsolute{Off: o, Size: 2})
+		}
+	}
+	if n.src {
+		load(off)
+		if n.dst {
+			a.jumpIf(bpf.JumpEqual, n.port, t, fall)
+		} else {
+			a.jumpIf(bpf.JumpEqual, n.port, t, f)
+		}
+	}
+	if n.dst {
+		load(off + 2)
+		a.jumpIf(bpf.JumpEqual, n.port, t, f)
+	}
+}
+
+type parser struct {
+	toks []string
+	pos  int
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *parser) take() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expr() (node, error) {
+	l, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.take()
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) term() (node, error) {
+	l, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.take()
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) factor() (node, error) {
+	switch tok := p.peek(); tok {
+	case "not", "!":
+		p.take()
+		n, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+
+	case "(":
+		p.take()
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.take() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return n, nil
+
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	return p.primitive()
+}
+
+var protos = map[string]node{
+	"ip":   etherNode{etherTypeIPv4},
+	"ip6":  etherNode{etherTypeIPv6},
+	"arp":  etherNode{etherTypeARP},
+	"tcp":  protoNode{protoTCP, protoTCP},
+	"udp":  protoNode{protoUDP, protoUDP},
+	"icmp": protoNode{protoICMP, protoICMPv6},
+}
+
+func (p *parser) primitive() (node, error) {
+	if n, ok := protos[p.peek()]; ok {
+		p.take()
+		// "tcp port 22" is shorthand for "tcp and port 22".
+		switch p.peek() {
+		case "src", "dst", "host", "port":
+			q, err := p.qualifier()
+			if err != nil {
+				return nil, err
+			}
+			return andNode{n, q}, nil
+		}
+		return n, nil
+	}
+	return p.qualifier()
+}
+
+func (p *parser) qualifier() (node, error) {
+	src, dst := true, true
+	switch p.peek() {
+	case "src":
+		p.take()
+		dst = false
+	case "dst":
+		p.take()
+		src = false
+	}
+
+	switch tok := p.take(); tok {
+	case "host":
+		arg := p.take()
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q", arg)
+		}
+		return hostNode{ip: ip, src: src, dst: dst}, nil
+
+	case "port":
+		arg := p.take()
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		return portNode{port: uint32(port), src: src, dst: dst}, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected token %q", tok)
+	}
+}
+
+// tokenize splits a filter expression into tokens, separating parentheses
+// from adjacent words.
+func tokenize(expr string) []string {
+	expr = strings.Replace(expr, "(", " ( ", -1)
+	expr = strings.Replace(expr, ")", " ) ", -1)
+	return strings.Fields(expr)
+}
+
+// compileFilter compiles expr into a classic BPF program for Ethernet frames.
+func compileFilter(expr string) ([]bpf.Instruction, error) {
+	p := &parser{toks: tokenize(expr)}
+	n, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %v", expr, err)
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("filter %q: unexpected token %q", expr, p.peek())
+	}
+
+	a := &assembler{}
+	accept, reject := a.newLabel(), a.newLabel()
+	n.gen(a, accept, reject)
+	a.mark(accept)
+	a.emit(bpf.RetConstant{Val: snapLen})
+	a.mark(reject)
+	a.emit(bpf.RetConstant{Val: 0})
+	return a.resolve()
+}
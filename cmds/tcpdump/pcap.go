@@ -0,0 +1,139 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// libpcap file format constants.
+//
+// See https://wiki.wireshark.org/Development/LibpcapFileFormat.
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	linkTypeEthernet = 1
+)
+
+type pcapFileHeader struct {
+	Magic        uint32
+	VersionMajor uint16
+	VersionMinor uint16
+	ThisZone     int32
+	SigFigs      uint32
+	SnapLen      uint32
+	Network      uint32
+}
+
+type pcapRecordHeader struct {
+	TsSec   uint32
+	TsUsec  uint32
+	InclLen uint32
+	OrigLen uint32
+}
+
+// packet is a captured link-layer frame.
+type packet struct {
+	ts      time.Time
+	data    []byte
+	origLen int
+}
+
+// pcapWriter writes packets in libpcap format.
+type pcapWriter struct {
+	w io.Writer
+}
+
+func newPcapWriter(w io.Writer, snaplen uint32) (*pcapWriter, error) {
+	hdr := pcapFileHeader{
+		Magic:        pcapMagic,
+		VersionMajor: pcapVersionMajor,
+		VersionMinor: pcapVersionMinor,
+		SnapLen:      snaplen,
+		Network:      linkTypeEthernet,
+	}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+func (pw *pcapWriter) writePacket(p packet) error {
+	hdr := pcapRecordHeader{
+		TsSec:   uint32(p.ts.Unix()),
+		TsUsec:  uint32(p.ts.Nanosecond() / 1000),
+		InclLen: uint32(len(p.data)),
+		OrigLen: uint32(p.origLen),
+	}
+	if err := binary.Write(pw.w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(p.data)
+	return err
+}
+
+// pcapReader reads packets from a libpcap file of either byte order.
+type pcapReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	hdr   pcapFileHeader
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var buf [24]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %v", err)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(buf[:]) == pcapMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(buf[:]) == pcapMagic:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a pcap file: magic %#x", buf[:4])
+	}
+
+	var hdr pcapFileHeader
+	if err := binary.Read(bytes.NewReader(buf[:]), order, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.VersionMajor != pcapVersionMajor {
+		return nil, fmt.Errorf("unsupported pcap version %d", hdr.VersionMajor)
+	}
+	if hdr.Network != linkTypeEthernet {
+		return nil, fmt.Errorf("unsupported pcap link type %d", hdr.Network)
+	}
+	return &pcapReader{r: r, order: order, hdr: hdr}, nil
+}
+
+// readPacket returns the next packet or io.EOF.
+func (pr *pcapReader) readPacket() (packet, error) {
+	var hdr pcapRecordHeader
+	if err := binary.Read(pr.r, pr.order, &hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return packet{}, fmt.Errorf("truncated pcap record header")
+		}
+		return packet{}, err
+	}
+	if hdr.InclLen > pr.hdr.SnapLen && pr.hdr.SnapLen != 0 {
+		return packet{}, fmt.Errorf("pcap record length %d exceeds snaplen %d", hdr.InclLen, pr.hdr.SnapLen)
+	}
+	data := make([]byte, hdr.InclLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return packet{}, fmt.Errorf("truncated pcap record: %v", err)
+	}
+	return packet{
+		ts:      time.Unix(int64(hdr.TsSec), int64(hdr.TsUsec)*1000),
+		data:    data,
+		origLen: int(hdr.OrigLen),
+	}, nil
+}
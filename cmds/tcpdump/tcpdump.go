@@ -0,0 +1,369 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Capture and print network packets.
+//
+// Synopsis:
+//     tcpdump [-n] [-c COUNT] [-i INTERFACE] [-w FILE | -r FILE] [EXPRESSION]
+//
+// Description:
+//     tcpdump opens a raw AF_PACKET socket on an interface and prints a
+//     one-line summary of every packet matching EXPRESSION. EXPRESSION is a
+//     subset of the pcap-filter(7) language: the primitives ip, ip6, arp,
+//     tcp, udp, icmp, [src|dst] host ADDR and [src|dst] port PORT combined
+//     with and, or, not and parentheses. It is compiled to classic BPF and
+//     attached to the socket so that only matching packets are copied to
+//     user space.
+//
+// Options:
+//     -i: interface to capture on (default: all interfaces)
+//     -n: do not resolve addresses to names
+//     -c: exit after receiving COUNT packets
+//     -w: write raw packets to FILE in libpcap format instead of printing
+//     -r: read packets from the libpcap FILE instead of the network
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	iface     = flag.String("i", "", "interface to capture on")
+	noResolve = flag.Bool("n", false, "do not convert addresses to names")
+	count     = flag.Int("c", 0, "exit after receiving count packets")
+	writeFile = flag.String("w", "", "write raw packets to file in pcap format")
+	readFile  = flag.String("r", "", "read packets from pcap file")
+)
+
+// packetSource yields captured packets. It returns io.EOF when done.
+type packetSource interface {
+	readPacket() (packet, error)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// socketSource captures live packets from an AF_PACKET socket.
+type socketSource struct {
+	fd  int
+	buf []byte
+}
+
+func newSocketSource(ifname string, filter []bpf.Instruction) (*socketSource, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("socket(AF_PACKET, SOCK_RAW): %v", err)
+	}
+
+	if filter != nil {
+		if err := attachFilter(fd, filter); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	if ifname != "" {
+		ifc, err := net.InterfaceByName(ifname)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		sa := &unix.SockaddrLinklayer{
+			Protocol: htons(unix.ETH_P_ALL),
+			Ifindex:  ifc.Index,
+		}
+		if err := unix.Bind(fd, sa); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("binding to %s: %v", ifname, err)
+		}
+	}
+	return &socketSource{fd: fd, buf: make([]byte, snapLen)}, nil
+}
+
+func attachFilter(fd int, filter []bpf.Instruction) error {
+	raw, err := bpf.Assemble(filter)
+	if err != nil {
+		return fmt.Errorf("assembling filter: %v", err)
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(raw)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&raw[0])),
+	}
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd),
+		unix.SOL_SOCKET, unix.SO_ATTACH_FILTER,
+		uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0); errno != 0 {
+		return fmt.Errorf("setsockopt(SO_ATTACH_FILTER): %v", errno)
+	}
+	return nil
+}
+
+func (s *socketSource) readPacket() (packet, error) {
+	n, _, err := unix.Recvfrom(s.fd, s.buf, unix.MSG_TRUNC)
+	if err != nil {
+		return packet{}, err
+	}
+	data := s.buf
+	if n < len(data) {
+		data = data[:n]
+	}
+	return packet{
+		ts:      time.Now(),
+		data:    append([]byte(nil), data...),
+		origLen: n,
+	}, nil
+}
+
+func (s *socketSource) close() error {
+	return unix.Close(s.fd)
+}
+
+// filteredSource applies a BPF filter in user space, for pcap files.
+type filteredSource struct {
+	src packetSource
+	vm  *bpf.VM
+}
+
+func (f *filteredSource) readPacket() (packet, error) {
+	for {
+		p, err := f.src.readPacket()
+		if err != nil {
+			return p, err
+		}
+		n, err := f.vm.Run(p.data)
+		if err != nil {
+			return packet{}, err
+		}
+		if n > 0 {
+			if n < len(p.data) {
+				p.data = p.data[:n]
+			}
+			return p, nil
+		}
+	}
+}
+
+// printer formats one-line packet summaries.
+type printer struct {
+	w io.Writer
+
+	// resolve maps an IP to a name. If nil, addresses are printed
+	// numerically.
+	resolve func(net.IP) string
+}
+
+func dnsResolver() func(net.IP) string {
+	cache := make(map[string]string)
+	return func(ip net.IP) string {
+		s := ip.String()
+		if name, ok := cache[s]; ok {
+			return name
+		}
+		name := s
+		if names, err := net.LookupAddr(s); err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+		cache[s] = name
+		return name
+	}
+}
+
+func (p *printer) host(ip net.IP) string {
+	if p.resolve == nil {
+		return ip.String()
+	}
+	return p.resolve(ip)
+}
+
+func tcpFlags(f byte) string {
+	var s string
+	for _, fl := range []struct {
+		bit byte
+		c   string
+	}{
+		{0x02, "S"},
+		{0x01, "F"},
+		{0x08, "P"},
+		{0x04, "R"},
+		{0x20, "U"},
+	} {
+		if f&fl.bit != 0 {
+			s += fl.c
+		}
+	}
+	if f&0x10 != 0 {
+		s += "."
+	}
+	if s == "" {
+		s = "none"
+	}
+	return s
+}
+
+// transport formats the layer 4 payload of an IP packet.
+func (p *printer) transport(proto byte, src, dst net.IP, b []byte) string {
+	switch proto {
+	case protoTCP:
+		if len(b) < 20 {
+			break
+		}
+		hlen := int(b[12]>>4) * 4
+		if hlen < 20 || hlen > len(b) {
+			break
+		}
+		return fmt.Sprintf("%s.%d > %s.%d: tcp [%s] length %d",
+			p.host(src), binary.BigEndian.Uint16(b[0:]),
+			p.host(dst), binary.BigEndian.Uint16(b[2:]),
+			tcpFlags(b[13]), len(b)-hlen)
+
+	case protoUDP:
+		if len(b) < 8 {
+			break
+		}
+		return fmt.Sprintf("%s.%d > %s.%d: udp length %d",
+			p.host(src), binary.BigEndian.Uint16(b[0:]),
+			p.host(dst), binary.BigEndian.Uint16(b[2:]),
+			len(b)-8)
+
+	case protoICMP, protoICMPv6:
+		return fmt.Sprintf("%s > %s: icmp length %d", p.host(src), p.host(dst), len(b))
+	}
+	return fmt.Sprintf("%s > %s: proto %d length %d", p.host(src), p.host(dst), proto, len(b))
+}
+
+// summary returns the one-line description of an Ethernet frame.
+func (p *printer) summary(pkt packet) string {
+	b := pkt.data
+	ts := pkt.ts.Format("15:04:05.000000")
+	if len(b) < ethHdrLen {
+		return fmt.Sprintf("%s [|ether] length %d", ts, pkt.origLen)
+	}
+
+	l3 := b[ethHdrLen:]
+	switch typ := binary.BigEndian.Uint16(b[ethTypeOff:]); typ {
+	case etherTypeIPv4:
+		if len(l3) < 20 || l3[0]>>4 != 4 {
+			break
+		}
+		hlen := int(l3[0]&0xf) * 4
+		total := int(binary.BigEndian.Uint16(l3[2:]))
+		if hlen < 20 || hlen > len(l3) {
+			break
+		}
+		end := len(l3)
+		if total >= hlen && total < end {
+			end = total
+		}
+		return fmt.Sprintf("%s IP %s", ts, p.transport(l3[9], net.IP(l3[12:16]), net.IP(l3[16:20]), l3[hlen:end]))
+
+	case etherTypeIPv6:
+		if len(l3) < ipv6HdrLen || l3[0]>>4 != 6 {
+			break
+		}
+		return fmt.Sprintf("%s IP6 %s", ts, p.transport(l3[6], net.IP(l3[8:24]), net.IP(l3[24:40]), l3[ipv6HdrLen:]))
+
+	case etherTypeARP:
+		return fmt.Sprintf("%s ARP, length %d", ts, len(l3))
+
+	default:
+		return fmt.Sprintf("%s ethertype %#04x, length %d", ts, typ, pkt.origLen)
+	}
+	return fmt.Sprintf("%s [|ip] length %d", ts, pkt.origLen)
+}
+
+// capture reads up to count packets (0 means unlimited) from src and either
+// prints them with p or writes them with pw.
+func capture(src packetSource, count int, p *printer, pw *pcapWriter) error {
+	for i := 0; count == 0 || i < count; i++ {
+		pkt, err := src.readPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pw != nil {
+			if err := pw.writePacket(pkt); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintln(p.w, p.summary(pkt))
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	var filter []bpf.Instruction
+	if flag.NArg() > 0 {
+		var err error
+		filter, err = compileFilter(strings.Join(flag.Args(), " "))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var src packetSource
+	if *readFile != "" {
+		f, err := os.Open(*readFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		pr, err := newPcapReader(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src = pr
+		if filter != nil {
+			vm, err := bpf.NewVM(filter)
+			if err != nil {
+				log.Fatal(err)
+			}
+			src = &filteredSource{src: pr, vm: vm}
+		}
+	} else {
+		s, err := newSocketSource(*iface, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.close()
+		src = s
+	}
+
+	var pw *pcapWriter
+	if *writeFile != "" {
+		f, err := os.Create(*writeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		pw, err = newPcapWriter(f, snapLen)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	p := &printer{w: os.Stdout}
+	if !*noResolve {
+		p.resolve = dnsResolver()
+	}
+	if err := capture(src, *count, p, pw); err != nil {
+		log.Fatal(err)
+	}
+}
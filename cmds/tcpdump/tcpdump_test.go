@@ -0,0 +1,266 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// frame builds an Ethernet frame carrying an IPv4 or IPv6 packet with a TCP
+// or UDP header.
+func frame(src, dst string, proto byte, sport, dport uint16, flags byte, payload []byte) []byte {
+	var l4 []byte
+	switch proto {
+	case protoTCP:
+		l4 = make([]byte, 20)
+		l4[12] = 5 << 4
+		l4[13] = flags
+	case protoUDP:
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4[4:], uint16(8+len(payload)))
+	default:
+		l4 = make([]byte, 4)
+	}
+	if proto == protoTCP || proto == protoUDP {
+		binary.BigEndian.PutUint16(l4[0:], sport)
+		binary.BigEndian.PutUint16(l4[2:], dport)
+	}
+	l4 = append(l4, payload...)
+
+	b := make([]byte, ethHdrLen)
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	if s.To4() != nil {
+		binary.BigEndian.PutUint16(b[ethTypeOff:], etherTypeIPv4)
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(l4)))
+		ip[9] = proto
+		copy(ip[12:], s.To4())
+		copy(ip[16:], d.To4())
+		b = append(b, ip...)
+	} else {
+		binary.BigEndian.PutUint16(b[ethTypeOff:], etherTypeIPv6)
+		ip := make([]byte, ipv6HdrLen)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(l4)))
+		ip[6] = proto
+		copy(ip[8:], s.To16())
+		copy(ip[24:], d.To16())
+		b = append(b, ip...)
+	}
+	return append(b, l4...)
+}
+
+func arpFrame() []byte {
+	b := make([]byte, ethHdrLen+28)
+	binary.BigEndian.PutUint16(b[ethTypeOff:], etherTypeARP)
+	return b
+}
+
+func TestFilter(t *testing.T) {
+	tcp22 := frame("10.0.0.1", "10.0.0.2", protoTCP, 5000, 22, 0x02, nil)
+	udp53 := frame("10.0.0.3", "10.0.0.1", protoUDP, 53, 4000, 0, []byte("abc"))
+	tcp6 := frame("fe80::1", "fe80::2", protoTCP, 22, 6000, 0x12, nil)
+	icmp := frame("10.0.0.2", "10.0.0.9", protoICMP, 0, 0, 0, nil)
+	arp := arpFrame()
+
+	for _, tt := range []struct {
+		expr  string
+		match []bool // tcp22, udp53, tcp6, icmp, arp
+	}{
+		{"tcp", []bool{true, false, true, false, false}},
+		{"udp", []bool{false, true, false, false, false}},
+		{"icmp", []bool{false, false, false, true, false}},
+		{"arp", []bool{false, false, false, false, true}},
+		{"ip", []bool{true, true, false, true, false}},
+		{"ip6", []bool{false, false, true, false, false}},
+		{"port 22", []bool{true, false, true, false, false}},
+		{"dst port 22", []bool{true, false, false, false, false}},
+		{"src port 22", []bool{false, false, true, false, false}},
+		{"tcp port 22", []bool{true, false, true, false, false}},
+		{"udp port 22", []bool{false, false, false, false, false}},
+		{"host 10.0.0.1", []bool{true, true, false, false, false}},
+		{"src host 10.0.0.1", []bool{true, false, false, false, false}},
+		{"dst host 10.0.0.1", []bool{false, true, false, false, false}},
+		{"host fe80::2", []bool{false, false, true, false, false}},
+		{"not tcp", []bool{false, true, false, true, true}},
+		{"tcp or udp", []bool{true, true, true, false, false}},
+		{"ip and not icmp", []bool{true, true, false, false, false}},
+		{"(udp or icmp) and host 10.0.0.1", []bool{false, true, false, false, false}},
+		{"arp or (tcp and src port 5000)", []bool{true, false, false, false, true}},
+	} {
+		t.Run(tt.expr, func(t *testing.T) {
+			prog, err := compileFilter(tt.expr)
+			if err != nil {
+				t.Fatalf("compileFilter(%q) = %v", tt.expr, err)
+			}
+			vm, err := bpf.NewVM(prog)
+			if err != nil {
+				t.Fatalf("bpf.NewVM = %v", err)
+			}
+			for i, pkt := range [][]byte{tcp22, udp53, tcp6, icmp, arp} {
+				n, err := vm.Run(pkt)
+				if err != nil {
+					t.Fatalf("packet %d: Run = %v", i, err)
+				}
+				if got := n > 0; got != tt.match[i] {
+					t.Errorf("packet %d: match = %t, want %t", i, got, tt.match[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"tcp and",
+		"port http",
+		"host 10.0.0.256",
+		"(tcp",
+		"tcp)",
+		"frobnicate",
+	} {
+		if _, err := compileFilter(expr); err == nil {
+			t.Errorf("compileFilter(%q) = nil, want error", expr)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	ts := time.Date(2018, 1, 1, 13, 14, 15, 123456000, time.UTC)
+	p := &printer{}
+	for _, tt := range []struct {
+		data []byte
+		want string
+	}{
+		{
+			frame("10.0.0.1", "10.0.0.2", protoTCP, 5000, 22, 0x12, []byte("hi")),
+			"13:14:15.123456 IP 10.0.0.1.5000 > 10.0.0.2.22: tcp [S.] length 2",
+		},
+		{
+			frame("10.0.0.3", "10.0.0.1", protoUDP, 53, 4000, 0, []byte("abc")),
+			"13:14:15.123456 IP 10.0.0.3.53 > 10.0.0.1.4000: udp length 3",
+		},
+		{
+			frame("fe80::1", "fe80::2", protoTCP, 22, 6000, 0x18, nil),
+			"13:14:15.123456 IP6 fe80::1.22 > fe80::2.6000: tcp [P.] length 0",
+		},
+		{
+			frame("10.0.0.2", "10.0.0.9", protoICMP, 0, 0, 0, nil),
+			"13:14:15.123456 IP 10.0.0.2 > 10.0.0.9: icmp length 4",
+		},
+		{
+			arpFrame(),
+			"13:14:15.123456 ARP, length 28",
+		},
+	} {
+		pkt := packet{ts: ts, data: tt.data, origLen: len(tt.data)}
+		if got := p.summary(pkt); got != tt.want {
+			t.Errorf("summary = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestPcapRoundTrip(t *testing.T) {
+	pkts := []packet{
+		{ts: time.Unix(1500000000, 1000), data: frame("10.0.0.1", "10.0.0.2", protoTCP, 1, 2, 0x02, nil)},
+		{ts: time.Unix(1500000001, 2000), data: frame("10.0.0.3", "10.0.0.1", protoUDP, 53, 4000, 0, []byte("abc"))},
+		{ts: time.Unix(1500000002, 3000), data: arpFrame()},
+	}
+	for i := range pkts {
+		pkts[i].origLen = len(pkts[i].data)
+	}
+
+	var buf bytes.Buffer
+	pw, err := newPcapWriter(&buf, snapLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pkts {
+		if err := pw.writePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pr, err := newPcapReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := compileFilter("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := capture(&filteredSource{src: pr, vm: vm}, 0, &printer{w: &out}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%s IP 10.0.0.3.53 > 10.0.0.1.4000: udp length 3\n", pkts[1].ts.Format("15:04:05.000000"))
+	if out.String() != want {
+		t.Errorf("capture = %q, want %q", out.String(), want)
+	}
+}
+
+func TestPcapBadMagic(t *testing.T) {
+	if _, err := newPcapReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Errorf("newPcapReader(zeros) = nil, want error")
+	}
+	if _, err := newPcapReader(bytes.NewReader(nil)); err == nil {
+		t.Errorf("newPcapReader(empty) = nil, want error")
+	}
+}
+
+func TestCaptureLoopback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, requires root for AF_PACKET")
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	prog, err := compileFilter(fmt.Sprintf("udp and dst port %d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSocketSource("lo", prog)
+	if err != nil {
+		t.Skipf("Skipping, cannot open raw socket: %v", err)
+	}
+	defer src.close()
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			conn.WriteToUDP([]byte("u-root"), conn.LocalAddr().(*net.UDPAddr))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var out bytes.Buffer
+	if err := capture(src, 1, &printer{w: &out}, nil); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("IP 127.0.0.1.%d > 127.0.0.1.%d: udp length 6\n", port, port)
+	if !bytes.HasSuffix(out.Bytes(), []byte(want)) {
+		t.Errorf("capture = %q, want suffix %q", out.String(), want)
+	}
+}
@@ -20,36 +20,115 @@
 //     it is not possible to use `syscall.Unshare` from Go with any reasonable
 //     expectation of success.
 //
+//     Instead, unshare starts PROGRAM with the requested namespaces given as
+//     clone flags, so PROGRAM runs in them from its first instruction. With
+//     -pid, PROGRAM is PID 1 in the new pid namespace.
+//
 //     If PROGRAM is not specified, unshare defaults to /ubin/elvish.
 //
 // Options:
+//     -cgroup:        Unshare the cgroup namespace
 //     -ipc:           Unshare the IPC namespace
 //     -mount:         Unshare the mount namespace
 //     -pid:           Unshare the pid namespace
 //     -net:           Unshare the net namespace
 //     -uts:           Unshare the uts namespace
 //     -user:          Unshare the user namespace
-//     -map-root-user: Map current uid to root. Not working
+//     -uid-map:       uid mappings for -user, as INSIDE:OUTSIDE:COUNT[,...]
+//     -gid-map:       gid mappings for -user, as INSIDE:OUTSIDE:COUNT[,...]
+//     -map-root-user: Map current uid and gid to root; implies -user
 package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 var (
+	cgroup  = flag.Bool("cgroup", false, "Unshare the cgroup namespace")
 	ipc     = flag.Bool("ipc", false, "Unshare the IPC namespace")
 	mount   = flag.Bool("mount", false, "Unshare the mount namespace")
 	pid     = flag.Bool("pid", false, "Unshare the pid namespace")
 	net     = flag.Bool("net", false, "Unshare the net namespace")
 	uts     = flag.Bool("uts", false, "Unshare the uts namespace")
 	user    = flag.Bool("user", false, "Unshare the user namespace")
-	maproot = flag.Bool("map-root-user", false, "Map current uid to root. Not working")
+	uidMap  = flag.String("uid-map", "", "uid mappings as INSIDE:OUTSIDE:COUNT[,...]")
+	gidMap  = flag.String("gid-map", "", "gid mappings as INSIDE:OUTSIDE:COUNT[,...]")
+	maproot = flag.Bool("map-root-user", false, "Map current uid and gid to root")
 )
 
+// usernsClone is where Debian-derived kernels allow disabling unprivileged
+// user namespaces.
+var usernsClone = "/proc/sys/kernel/unprivileged_userns_clone"
+
+// parseIDMap parses comma-separated INSIDE:OUTSIDE:COUNT mappings.
+func parseIDMap(s string) ([]syscall.SysProcIDMap, error) {
+	var m []syscall.SysProcIDMap
+	if s == "" {
+		return nil, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		f := strings.Split(e, ":")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid id mapping %q, want INSIDE:OUTSIDE:COUNT", e)
+		}
+		var n [3]int
+		for i := range f {
+			v, err := strconv.ParseUint(f[i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id mapping %q: %v", e, err)
+			}
+			n[i] = int(v)
+		}
+		m = append(m, syscall.SysProcIDMap{ContainerID: n[0], HostID: n[1], Size: n[2]})
+	}
+	return m, nil
+}
+
+// checkUserns returns an error if the kernel is known to refuse creating a
+// user namespace for us.
+func checkUserns() error {
+	if os.Getuid() == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(usernsClone)
+	if err != nil {
+		// Upstream kernels do not have the knob and always allow it.
+		return nil
+	}
+	if strings.TrimSpace(string(b)) == "0" {
+		return fmt.Errorf("unprivileged user namespaces are disabled by %s", usernsClone)
+	}
+	return nil
+}
+
+// command returns a command running a in new namespaces given by flags.
+// The id mappings only apply if flags includes CLONE_NEWUSER.
+func command(a []string, flags uintptr, uids, gids []syscall.SysProcIDMap) (*exec.Cmd, error) {
+	c := exec.Command(a[0], a[1:]...)
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: flags}
+	if flags&syscall.CLONE_NEWUSER != 0 {
+		if err := checkUserns(); err != nil {
+			return nil, err
+		}
+		c.SysProcAttr.UidMappings = uids
+		c.SysProcAttr.GidMappings = gids
+		// Unprivileged processes may only write a gid map after
+		// denying setgroups.
+		c.SysProcAttr.GidMappingsEnableSetgroups = os.Getuid() == 0
+	}
+	return c, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -58,32 +137,52 @@ func main() {
 		a = []string{"/ubin/elvish", "elvish"}
 	}
 
-	c := exec.Command(a[0], a[1:]...)
-	c.SysProcAttr = &syscall.SysProcAttr{}
-	if *mount {
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	var flags uintptr
+	for _, ns := range []struct {
+		set  bool
+		flag uintptr
+	}{
+		{*mount, syscall.CLONE_NEWNS},
+		{*uts, syscall.CLONE_NEWUTS},
+		{*ipc, syscall.CLONE_NEWIPC},
+		{*net, syscall.CLONE_NEWNET},
+		{*pid, syscall.CLONE_NEWPID},
+		{*user || *maproot, syscall.CLONE_NEWUSER},
+		{*cgroup, unix.CLONE_NEWCGROUP},
+	} {
+		if ns.set {
+			flags |= ns.flag
+		}
 	}
-	if *uts {
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUTS
-	}
-	if *ipc {
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWIPC
-	}
-	if *net {
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+
+	uids, err := parseIDMap(*uidMap)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *pid {
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWPID
+	gids, err := parseIDMap(*gidMap)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *user {
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	if *maproot {
+		uids = append(uids, syscall.SysProcIDMap{ContainerID: 0, HostID: os.Getuid(), Size: 1})
+		gids = append(gids, syscall.SysProcIDMap{ContainerID: 0, HostID: os.Getgid(), Size: 1})
 	}
 
+	c, err := command(a, flags, uids, gids)
+	if err != nil {
+		log.Fatal(err)
+	}
 	c.Stdin = os.Stdin
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 
-	if err := c.Run(); err != nil {
-		log.Printf(err.Error())
+	err = c.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			os.Exit(ws.ExitStatus())
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 }
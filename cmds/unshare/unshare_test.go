@@ -0,0 +1,128 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseIDMap(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []syscall.SysProcIDMap
+	}{
+		{"", nil},
+		{"0:1000:1", []syscall.SysProcIDMap{{ContainerID: 0, HostID: 1000, Size: 1}}},
+		{"0:1000:1,1:100000:65536", []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: 1000, Size: 1},
+			{ContainerID: 1, HostID: 100000, Size: 65536},
+		}},
+	} {
+		got, err := parseIDMap(tt.in)
+		if err != nil {
+			t.Errorf("parseIDMap(%q) = %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIDMap(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"0:1000", "0:1000:1:2", "a:1000:1", "0:-1:1", "0:1000:1,"} {
+		if _, err := parseIDMap(in); err == nil {
+			t.Errorf("parseIDMap(%q) = nil, want error", in)
+		}
+	}
+}
+
+func TestUsernsDisabled(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("Skipping, root may always create user namespaces")
+	}
+	dir, err := ioutil.TempDir("", "unshare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old string) { usernsClone = old }(usernsClone)
+	usernsClone = filepath.Join(dir, "unprivileged_userns_clone")
+	if err := ioutil.WriteFile(usernsClone, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := command([]string{"true"}, syscall.CLONE_NEWUSER, nil, nil); err == nil {
+		t.Errorf("command with user namespaces disabled = nil, want error")
+	}
+}
+
+// run runs a in a new user namespace, plus the namespaces in flags, with the
+// current user mapped to root.
+func run(t *testing.T, flags uintptr, a ...string) string {
+	root := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	groot := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	c, err := command(a, syscall.CLONE_NEWUSER|flags, root, groot)
+	if err != nil {
+		t.Skipf("Skipping, cannot use user namespaces: %v", err)
+	}
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	if err := c.Run(); err != nil {
+		if strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("Skipping, cannot create user namespace: %v", err)
+		}
+		t.Fatalf("%v: %v: %s", a, err, out.String())
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func TestUser(t *testing.T) {
+	self, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := run(t, 0, "readlink", "/proc/self/ns/user"); got == self {
+		t.Errorf("user namespace of child is %s, same as ours", got)
+	}
+	if got := run(t, 0, "id", "-u"); got != "0" {
+		t.Errorf("uid in user namespace = %s, want 0", got)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		flag uintptr
+	}{
+		{"net", syscall.CLONE_NEWNET},
+		{"uts", syscall.CLONE_NEWUTS},
+		{"ipc", syscall.CLONE_NEWIPC},
+		{"mnt", syscall.CLONE_NEWNS},
+		{"cgroup", unix.CLONE_NEWCGROUP},
+	} {
+		self, err := os.Readlink("/proc/self/ns/" + tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := run(t, tt.flag, "readlink", "/proc/self/ns/"+tt.name); got == self {
+			t.Errorf("%s namespace of child is %s, same as ours", tt.name, got)
+		}
+	}
+}
+
+func TestPID(t *testing.T) {
+	if got := run(t, syscall.CLONE_NEWPID, "sh", "-c", "echo $$"); got != "1" {
+		t.Errorf("pid in new pid namespace = %s, want 1", got)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	active      = flag.Bool("active", false, "use active FTP, where the server connects back, instead of passive")
+	ftpUser     = flag.String("ftp-user", "", "FTP user, unless the URL has one; the default is anonymous")
+	ftpPassword = flag.String("ftp-password", "", "FTP password, unless the URL has one")
+)
+
+var (
+	// ftpRetries is how often a download is retried when the server
+	// replies 421, Service not available.
+	ftpRetries = 3
+	// ftpRetryDelay is how long to wait before retrying.
+	ftpRetryDelay = time.Second
+	// ftpTimeout limits connecting and waiting for the server.
+	ftpTimeout = 30 * time.Second
+)
+
+const ftpServiceNotAvailable = 421
+
+// ftpConn is the control connection to an FTP server.
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// cmd sends a command and reads the reply, which must have a code starting
+// with expect, as for textproto.Conn.ReadResponse.
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(expect)
+}
+
+// dialFTP connects to the server of u and logs in.
+func dialFTP(u *url.URL) (*ftpConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+	conn, err := net.DialTimeout("tcp", host, ftpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+
+	user, pass := "anonymous", "anonymous@"
+	if *ftpUser != "" {
+		user, pass = *ftpUser, *ftpPassword
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", pass)
+	}
+	if err == nil && code != 230 {
+		err = &textproto.Error{Code: code, Msg: "login failed"}
+	}
+	if err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// passive returns a connection to the address of a 227 reply,
+// "Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+func (c *ftpConn) passive() (net.Conn, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+	start, end := strings.IndexByte(msg, '('), strings.IndexByte(msg, ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("bad passive mode reply %q", msg)
+	}
+	var b [6]byte
+	for i, f := range strings.Split(msg[start+1:end], ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(f), 10, 8)
+		if err != nil || i >= len(b) {
+			return nil, fmt.Errorf("bad passive mode reply %q", msg)
+		}
+		b[i] = byte(n)
+	}
+	addr := &net.TCPAddr{IP: net.IP(b[:4]), Port: int(b[4])<<8 | int(b[5])}
+	return net.DialTimeout("tcp", addr.String(), ftpTimeout)
+}
+
+// activeListener returns a listener that the server is told with PORT to
+// connect to.
+func (c *ftpConn) activeListener() (net.Listener, error) {
+	ip := c.conn.LocalAddr().(*net.TCPAddr).IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("active FTP needs IPv4")
+	}
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	if _, _, err := c.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// retrieve writes the file of u to w.
+func (c *ftpConn) retrieve(u *url.URL, w io.Writer) error {
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return err
+	}
+	var (
+		data net.Conn
+		l    net.Listener
+		err  error
+	)
+	if *active {
+		if l, err = c.activeListener(); err != nil {
+			return err
+		}
+		defer l.Close()
+	} else {
+		if data, err = c.passive(); err != nil {
+			return err
+		}
+		defer data.Close()
+	}
+
+	// The path is relative to where the login starts, as RFC 1738 has it.
+	if _, _, err := c.cmd(1, "RETR %s", strings.TrimPrefix(u.Path, "/")); err != nil {
+		return err
+	}
+	if l != nil {
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(ftpTimeout))
+		if data, err = l.Accept(); err != nil {
+			return err
+		}
+		defer data.Close()
+	}
+	if _, err := io.Copy(w, data); err != nil {
+		return err
+	}
+	data.Close()
+	c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	_, _, err = c.text.ReadResponse(2)
+	return err
+}
+
+// isServiceNotAvailable returns whether err is a 421 reply, after which the
+// server closes the connection and may take the next.
+func isServiceNotAvailable(err error) bool {
+	e, ok := err.(*textproto.Error)
+	return ok && e.Code == ftpServiceNotAvailable
+}
+
+// ftpGet downloads the ftp:// URL u to fileName, writing it to the hash of
+// sum too unless sum is nil.
+func ftpGet(u *url.URL, fileName string, sum *checksum) error {
+	for try := 0; ; try++ {
+		err := ftpGetOnce(u, fileName, sum)
+		if err == nil || !isServiceNotAvailable(err) || try == ftpRetries {
+			return err
+		}
+		log.Printf("%s: %v, retrying", u.Host, err)
+		time.Sleep(ftpRetryDelay)
+	}
+}
+
+func ftpGetOnce(u *url.URL, fileName string, sum *checksum) error {
+	c, err := dialFTP(u)
+	if err != nil {
+		return err
+	}
+	defer c.text.Close()
+
+	w, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	var dst io.Writer = w
+	if sum != nil {
+		sum.hash.Reset()
+		dst = io.MultiWriter(w, sum.hash)
+	}
+	if err := c.retrieve(u, dst); err != nil {
+		return err
+	}
+	c.cmd(221, "QUIT")
+	return nil
+}
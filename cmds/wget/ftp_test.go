@@ -0,0 +1,296 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/testutil"
+)
+
+// ftpServer serves files over FTP on raw TCP.
+type ftpServer struct {
+	l     net.Listener
+	files map[string]string
+	// user and pass are required to log in, unless user is empty.
+	user, pass string
+
+	mu sync.Mutex
+	// unavailable is how many more connections get 421.
+	unavailable int
+	// cmds are the commands received, but for their arguments.
+	cmds []string
+}
+
+func newFTPServer(t *testing.T, files map[string]string, user, pass string) *ftpServer {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpServer{l: l, files: files, user: user, pass: pass}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *ftpServer) url(path string) string {
+	return "ftp://" + s.l.Addr().String() + path
+}
+
+// refuse makes the next n connections get 421.
+func (s *ftpServer) refuse(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unavailable = n
+}
+
+func (s *ftpServer) commands() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.cmds, " ")
+}
+
+func (s *ftpServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(c, format+"\r\n", args...)
+	}
+	s.mu.Lock()
+	unavailable := s.unavailable > 0
+	s.unavailable--
+	s.mu.Unlock()
+	if unavailable {
+		reply("421 Service not available, too many users")
+		return
+	}
+	reply("220-Welcome")
+	reply("220 u-root test FTP")
+
+	var user string
+	loggedIn := false
+	var data func() (net.Conn, error)
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.SplitN(strings.TrimSpace(l), " ", 2)
+		cmd, arg := f[0], ""
+		if len(f) > 1 {
+			arg = f[1]
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "USER":
+			user = arg
+			reply("331 Password required")
+		case "PASS":
+			if s.user != "" && (user != s.user || arg != s.pass) {
+				reply("530 Login incorrect")
+				continue
+			}
+			loggedIn = true
+			reply("230 Logged in")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			if !loggedIn {
+				reply("530 Not logged in")
+				continue
+			}
+			switch cmd {
+			case "TYPE":
+				reply("200 Type set to %s", arg)
+			case "PASV":
+				dl, err := net.Listen("tcp4", "127.0.0.1:0")
+				if err != nil {
+					reply("425 %v", err)
+					continue
+				}
+				port := dl.Addr().(*net.TCPAddr).Port
+				data = func() (net.Conn, error) {
+					defer dl.Close()
+					return dl.Accept()
+				}
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d).", port>>8, port&0xff)
+			case "PORT":
+				var h [6]int
+				for i, n := range strings.Split(arg, ",") {
+					h[i], _ = strconv.Atoi(n)
+				}
+				addr := fmt.Sprintf("%d.%d.%d.%d:%d", h[0], h[1], h[2], h[3], h[4]<<8|h[5])
+				data = func() (net.Conn, error) {
+					return net.Dial("tcp4", addr)
+				}
+				reply("200 PORT command successful")
+			case "RETR":
+				content, ok := s.files[arg]
+				if !ok {
+					reply("550 %s: No such file", arg)
+					continue
+				}
+				if data == nil {
+					reply("425 Use PORT or PASV first")
+					continue
+				}
+				reply("150 Opening BINARY mode data connection for %s", arg)
+				dc, err := data()
+				data = nil
+				if err != nil {
+					reply("425 %v", err)
+					continue
+				}
+				dc.Write([]byte(content))
+				dc.Close()
+				reply("226 Transfer complete")
+			default:
+				reply("502 %s not implemented", cmd)
+			}
+		}
+	}
+}
+
+const ftpContent = "kernel served over FTP"
+
+func TestFTPGet(t *testing.T) {
+	defer func(r bool) { *active = r }(*active)
+	dir, err := ioutil.TempDir("", "wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	s := newFTPServer(t, map[string]string{"boot/vmlinuz": ftpContent}, "", "")
+	defer s.l.Close()
+	for _, tt := range []struct {
+		name   string
+		active bool
+		path   string
+		want   string
+	}{
+		{name: "passive", path: "/boot/vmlinuz", want: "USER PASS TYPE PASV RETR QUIT"},
+		{name: "active", active: true, path: "/boot/vmlinuz", want: "USER PASS TYPE PORT RETR QUIT"},
+		{name: "missing", path: "/boot/initrd"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s.mu.Lock()
+			s.cmds = nil
+			s.mu.Unlock()
+			*active = tt.active
+			u, err := url.Parse(s.url(tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ftpGet(u, out, nil)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("ftpGet(%s) succeeded", u)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ftpGet(%s) = %v", u, err)
+			}
+			if b, err := ioutil.ReadFile(out); err != nil || string(b) != ftpContent {
+				t.Errorf("ftpGet(%s) wrote %q, %v, want %q", u, b, err, ftpContent)
+			}
+			if got := s.commands(); got != tt.want {
+				t.Errorf("ftpGet(%s) sent %s, want %s", u, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFTPServiceNotAvailable(t *testing.T) {
+	defer func(d time.Duration) { ftpRetryDelay = d }(ftpRetryDelay)
+	ftpRetryDelay = 0
+	dir, err := ioutil.TempDir("", "wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	s := newFTPServer(t, map[string]string{"vmlinuz": ftpContent}, "", "")
+	defer s.l.Close()
+	u, _ := url.Parse(s.url("/vmlinuz"))
+
+	s.refuse(2)
+	if err := ftpGet(u, out, nil); err != nil {
+		t.Errorf("ftpGet() after two 421 replies = %v", err)
+	}
+	s.refuse(ftpRetries + 1)
+	if err := ftpGet(u, out, nil); !isServiceNotAvailable(err) {
+		t.Errorf("ftpGet() after %d 421 replies = %v, want 421", ftpRetries+1, err)
+	}
+}
+
+func TestFTPLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newFTPServer(t, map[string]string{"vmlinuz": ftpContent}, "boot", "secret")
+	defer s.l.Close()
+	u := s.url("/vmlinuz")
+	withCreds := strings.Replace(u, "ftp://", "ftp://boot:secret@", 1)
+	for _, tt := range []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{name: "anonymous", args: []string{u}},
+		{name: "flags", args: []string{"--ftp-user=boot", "--ftp-password=secret", u}, ok: true},
+		{name: "url", args: []string{withCreds}, ok: true},
+		{name: "url wins", args: []string{"-ftp-user", "boot", "-ftp-password", "wrong", withCreds}, ok: true},
+		{name: "wrong password", args: []string{"-ftp-user", "boot", "-ftp-password", "wrong", u}},
+		{name: "active", args: []string{"-active", withCreds}, ok: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, "out")
+			os.Remove(out)
+			args := append([]string{"-O", out}, tt.args...)
+			stderr, err := testutil.Command(t, args...).CombinedOutput()
+			if !tt.ok {
+				if err := testutil.IsExitCode(err, 1); err != nil {
+					t.Errorf("wget %v: %v", args, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("wget %v: %v: %s", args, err, stderr)
+			}
+			if b, err := ioutil.ReadFile(out); err != nil || string(b) != ftpContent {
+				t.Errorf("wget %v wrote %q, %v, want %q", args, b, err, ftpContent)
+			}
+		})
+	}
+}
@@ -8,12 +8,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/u-root/u-root/pkg/testutil"
 )
@@ -144,6 +151,229 @@ func TestWget(t *testing.T) {
 	}
 }
 
+// rangeHandler serves data, with or without ranges, and fails the first
+// request for each range in fail.
+type rangeHandler struct {
+	data   []byte
+	ranges bool
+	fail   map[string]bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (h *rangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rng := r.Header.Get("Range")
+	h.mu.Lock()
+	h.requests = append(h.requests, r.Method+" "+rng)
+	fail := h.fail[rng]
+	delete(h.fail, rng)
+	h.mu.Unlock()
+
+	switch {
+	case fail:
+		w.WriteHeader(500)
+	case h.ranges:
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(h.data))
+	case r.Method == "HEAD":
+		w.Header().Set("Content-Length", fmt.Sprint(len(h.data)))
+	default:
+		w.Write(h.data)
+	}
+}
+
+func TestParallelSegments(t *testing.T) {
+	data := make([]byte, 1<<20+3)
+	rand.Read(data)
+	dir, err := ioutil.TempDir("", "wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name     string
+		h        *rangeHandler
+		segments int
+		// requests are the GETs made, in any order.
+		requests []string
+	}{
+		{
+			name:     "ranges",
+			h:        &rangeHandler{data: data, ranges: true},
+			segments: 4,
+			requests: []string{"GET bytes=0-262143", "GET bytes=262144-524288", "GET bytes=524289-786433", "GET bytes=786434-1048578"},
+		},
+		{
+			name:     "retry",
+			h:        &rangeHandler{data: data, ranges: true, fail: map[string]bool{"bytes=524289-786433": true}},
+			segments: 4,
+			requests: []string{"GET bytes=0-262143", "GET bytes=262144-524288", "GET bytes=524289-786433", "GET bytes=524289-786433", "GET bytes=786434-1048578"},
+		},
+		{
+			name:     "no ranges",
+			h:        &rangeHandler{data: data},
+			segments: 4,
+			requests: []string{"GET "},
+		},
+		{
+			name:     "one segment",
+			h:        &rangeHandler{data: data, ranges: true},
+			segments: 1,
+			requests: []string{"GET "},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(tt.h)
+			defer s.Close()
+			out := filepath.Join(dir, "out")
+			if err := wget(s.URL+"/kernel", out, tt.segments, nil); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes that differ from the %d served", len(got), len(data))
+			}
+
+			var gets []string
+			for _, r := range tt.h.requests {
+				if strings.HasPrefix(r, "GET") {
+					gets = append(gets, r)
+				}
+			}
+			if len(gets) != len(tt.requests) {
+				t.Fatalf("requests = %q, want %q", gets, tt.requests)
+			}
+			want := make(map[string]int)
+			for _, r := range tt.requests {
+				want[r]++
+			}
+			for _, r := range gets {
+				want[r]--
+			}
+			for _, n := range want {
+				if n != 0 {
+					t.Errorf("requests = %q, want %q", gets, tt.requests)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestParallelSegmentsFail(t *testing.T) {
+	h := &rangeHandler{data: []byte(content), ranges: true, fail: make(map[string]bool)}
+	// Fail more often than the segment is retried.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=11-21" {
+			w.WriteHeader(500)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := wget(s.URL+"/kernel", filepath.Join(dir, "out"), 2, nil); err == nil {
+		t.Errorf("wget() with a failing segment succeeded")
+	}
+}
+
+// Digests of content.
+const (
+	contentMD5    = "11994669e8469f2a51f7f2801648d237"
+	contentSHA256 = "6ca789a59a530b874a3fc924bd0b02309302f66ace8144e1c486568b89a11cdd"
+	contentSHA512 = "d0d58316bacd1706a271a58ff91603c6d1e8d779092288588c010422ae899d8f" +
+		"581124d7938e91fb8b70717fd85c3c7c5a255918498889a110985baebbc6e058"
+)
+
+func TestChecksum(t *testing.T) {
+	s := httptest.NewServer(handler{})
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sums := filepath.Join(dir, "SUMS")
+	if err := ioutil.WriteFile(sums, []byte(
+		strings.Repeat("0", 64)+"  other\n"+
+			contentSHA512+" *200\n"+
+			strings.Repeat("0", 64)+"  404\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		flags []string
+		url   string
+		ok    bool
+	}{
+		{name: "md5", flags: []string{"-checksum", "md5:" + contentMD5}, url: "/200", ok: true},
+		{name: "sha256", flags: []string{"--checksum=sha256:" + contentSHA256}, url: "/200", ok: true},
+		{name: "sha512 upper case", flags: []string{"-checksum", "SHA512:" + strings.ToUpper(contentSHA512)}, url: "/200", ok: true},
+		{name: "segments", flags: []string{"-checksum", "sha256:" + contentSHA256, "-parallel-segments", "4"}, url: "/200", ok: true},
+		{name: "mismatch", flags: []string{"-checksum", "md5:" + strings.Repeat("0", 32)}, url: "/200"},
+		{name: "bad length", flags: []string{"-checksum", "sha256:" + contentMD5}, url: "/200"},
+		{name: "bad algorithm", flags: []string{"-checksum", "sha1:" + contentMD5}, url: "/200"},
+		{name: "no algorithm", flags: []string{"-checksum", contentSHA256}, url: "/200"},
+		{name: "sums file", flags: []string{"--checksum-file=" + sums}, url: "/200", ok: true},
+		{name: "not in sums file", flags: []string{"-checksum-file", sums}, url: "/302"},
+		{name: "sums mismatch", flags: []string{"-checksum-file", sums}, url: "/404"},
+		{name: "both", flags: []string{"-checksum", "md5:" + contentMD5, "-checksum-file", sums}, url: "/200"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, "out")
+			os.Remove(out)
+			args := append(tt.flags, "-O", out, s.URL+tt.url)
+			stderr, err := testutil.Command(t, args...).CombinedOutput()
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("wget %v: %v: %s", args, err, stderr)
+				}
+				if b, err := ioutil.ReadFile(out); err != nil || string(b) != content {
+					t.Errorf("wget %v wrote %q, %v; want %q", args, b, err, content)
+				}
+				return
+			}
+			if err := testutil.IsExitCode(err, 1); err != nil {
+				t.Errorf("wget %v: %v", args, err)
+			}
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("wget %v left %s behind", args, out)
+			}
+		})
+	}
+}
+
+func TestLookupChecksum(t *testing.T) {
+	sums := contentMD5 + "  a\n" + contentSHA256 + " *b\nbogus line\n"
+	for _, tt := range []struct {
+		name, algo, digest string
+	}{
+		{"a", "md5", contentMD5},
+		{"b", "sha256", contentSHA256},
+		{"c", "", ""},
+	} {
+		c, err := lookupChecksum(strings.NewReader(sums), tt.name)
+		switch {
+		case tt.algo == "" && err == nil:
+			t.Errorf("lookupChecksum(%q) = %v, want error", tt.name, c)
+		case tt.algo != "" && err != nil:
+			t.Errorf("lookupChecksum(%q) = %v", tt.name, err)
+		case tt.algo != "" && (c.algo != tt.algo || fmt.Sprintf("%x", c.want) != tt.digest):
+			t.Errorf("lookupChecksum(%q) = %s:%x, want %s:%s", tt.name, c.algo, c.want, tt.algo, tt.digest)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	testutil.Run(m, main)
 }
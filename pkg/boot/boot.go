@@ -34,3 +34,9 @@ var (
 		"multiboot": newMultibootImage,
 	}
 )
+
+// RegisterOSImage makes Package.Unpack read packages of type packageType
+// with newFromArchive, for OSImages defined outside this package.
+func RegisterOSImage(packageType string, newFromArchive func(*cpio.Archive) (OSImage, error)) {
+	osimageMap[packageType] = newFromArchive
+}
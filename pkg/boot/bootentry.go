@@ -0,0 +1,117 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// espRelative returns p as a path from the root of an ESP, which uses / as
+// separator, as it would on FAT.
+func espRelative(p string) string {
+	return path.Clean("/" + strings.Replace(p, "\\", "/", -1))
+}
+
+// ToSystemdBootEntry returns a Type 1 entry of the Boot Loader Specification
+// that boots li, for $ESP/loader/entries/*.conf. The kernel and initrd are
+// expected at kernelDest and initrdDest, paths from the root of the ESP;
+// InstallSystemdBootEntry puts them there. machineID may be empty, as may
+// initrdDest if li has no initrd.
+func (li *LinuxImage) ToSystemdBootEntry(title, machineID, kernelDest, initrdDest string) (string, error) {
+	if li.Kernel == nil {
+		return "", ErrKernelMissing
+	}
+	if kernelDest == "" {
+		return "", fmt.Errorf("no kernel path")
+	}
+	if li.hasInitrd() && initrdDest == "" {
+		return "", fmt.Errorf("no initrd path")
+	}
+	type keyValue struct{ key, value string }
+	lines := []keyValue{
+		{"title", title},
+		{"machine-id", machineID},
+		{"linux", espRelative(kernelDest)},
+	}
+	if li.hasInitrd() {
+		lines = append(lines, keyValue{"initrd", espRelative(initrdDest)})
+	}
+	lines = append(lines, keyValue{"options", li.Cmdline})
+
+	var b strings.Builder
+	for _, kv := range lines {
+		if kv.value == "" {
+			continue
+		}
+		// Each key takes the rest of its line.
+		if strings.ContainsAny(kv.value, "\r\n") {
+			return "", fmt.Errorf("%s %q has a newline", kv.key, kv.value)
+		}
+		fmt.Fprintf(&b, "%s %s\n", kv.key, strings.TrimSpace(kv.value))
+	}
+	return b.String(), nil
+}
+
+// copyToESP copies r to the ESP-relative path p below esp.
+func copyToESP(r io.ReaderAt, esp, p string) error {
+	dest := filepath.Join(esp, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, uio.Reader(r)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// InstallSystemdBootEntry installs li on the ESP at espPath as the
+// systemd-boot entry entryName: its kernel and initrd, with any overlays,
+// go in $ESP/<entryName>/, and the entry, titled entryName, in
+// $ESP/loader/entries/<entryName>.conf.
+func InstallSystemdBootEntry(li *LinuxImage, espPath, entryName string) error {
+	if entryName == "" || strings.ContainsAny(entryName, `/\`) {
+		return fmt.Errorf("invalid entry name %q", entryName)
+	}
+	kernelDest, initrdDest := path.Join("/", entryName, "linux"), ""
+	if li.hasInitrd() {
+		initrdDest = path.Join("/", entryName, "initrd")
+	}
+	conf, err := li.ToSystemdBootEntry(entryName, "", kernelDest, initrdDest)
+	if err != nil {
+		return err
+	}
+	initrd, closeInitrd, err := li.InitrdWithOverlays()
+	if err != nil {
+		return fmt.Errorf("building initrd: %v", err)
+	}
+	defer closeInitrd()
+	if err := copyToESP(li.Kernel, espPath, kernelDest); err != nil {
+		return fmt.Errorf("copying kernel: %v", err)
+	}
+	if initrd != nil {
+		if err := copyToESP(initrd, espPath, initrdDest); err != nil {
+			return fmt.Errorf("copying initrd: %v", err)
+		}
+	}
+	// The entry goes last, so that it is not found without its files.
+	dir := filepath.Join(espPath, "loader", "entries")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, entryName+".conf"), []byte(conf), 0644)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestToSystemdBootEntry(t *testing.T) {
+	kernel, initrd := strings.NewReader("kernel"), strings.NewReader("initrd")
+	for _, tt := range []struct {
+		name                             string
+		li                               *LinuxImage
+		title, machineID, kernel, initrd string
+		want                             string
+	}{
+		{
+			name:      "all",
+			li:        NewLinuxImage(kernel, initrd, "root=/dev/sda2 quiet"),
+			title:     "u-root",
+			machineID: "6a9857a393724b7a981ebb5b8495b9ea",
+			kernel:    "6a9857a393724b7a981ebb5b8495b9ea/linux",
+			initrd:    `\EFI\u-root\initrd`,
+			want: `title u-root
+machine-id 6a9857a393724b7a981ebb5b8495b9ea
+linux /6a9857a393724b7a981ebb5b8495b9ea/linux
+initrd /EFI/u-root/initrd
+options root=/dev/sda2 quiet
+`,
+		},
+		{
+			name:   "no initrd",
+			li:     NewLinuxImage(kernel, nil, ""),
+			kernel: "/linux",
+			initrd: "/unused",
+			want:   "linux /linux\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.li.ToSystemdBootEntry(tt.title, tt.machineID, tt.kernel, tt.initrd)
+			if err != nil || got != tt.want {
+				t.Errorf("ToSystemdBootEntry() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		name           string
+		li             *LinuxImage
+		title          string
+		kernel, initrd string
+	}{
+		{"no kernel", &LinuxImage{}, "", "/linux", ""},
+		{"no kernel path", NewLinuxImage(kernel, nil, ""), "", "", ""},
+		{"no initrd path", NewLinuxImage(kernel, initrd, ""), "", "/linux", ""},
+		{"newline", NewLinuxImage(kernel, nil, ""), "u-root\nlinux /other", "/linux", ""},
+		{"newline in cmdline", NewLinuxImage(kernel, nil, "quiet\r\n"), "", "/linux", ""},
+	} {
+		if got, err := tt.li.ToSystemdBootEntry(tt.title, "", tt.kernel, tt.initrd); err == nil {
+			t.Errorf("%s: ToSystemdBootEntry() = %q, want error", tt.name, got)
+		}
+	}
+}
+
+func TestInstallSystemdBootEntry(t *testing.T) {
+	esp, err := ioutil.TempDir("", "esp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(esp)
+
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "quiet")
+	if err := InstallSystemdBootEntry(li, esp, "u-root"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"u-root/linux":               "kernel",
+		"u-root/initrd":              "initrd",
+		"loader/entries/u-root.conf": "title u-root\nlinux /u-root/linux\ninitrd /u-root/initrd\noptions quiet\n",
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(esp, name)); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", name, b, err, want)
+		}
+	}
+
+	for _, name := range []string{"", "../u-root", `EFI\u-root`} {
+		if err := InstallSystemdBootEntry(li, esp, name); err == nil {
+			t.Errorf("InstallSystemdBootEntry(%q) succeeded", name)
+		}
+	}
+	// Nothing is written for an entry that cannot be made.
+	if err := InstallSystemdBootEntry(&LinuxImage{}, esp, "empty"); err != ErrKernelMissing {
+		t.Errorf("InstallSystemdBootEntry() without kernel = %v, want %v", err, ErrKernelMissing)
+	}
+	if _, err := os.Stat(filepath.Join(esp, "empty")); !os.IsNotExist(err) {
+		t.Errorf("InstallSystemdBootEntry() without kernel made $ESP/empty: %v", err)
+	}
+}
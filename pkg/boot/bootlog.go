@@ -0,0 +1,135 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBootLogSize is how many entries a BootLog keeps.
+const DefaultBootLogSize = 1024
+
+// PhaseLog is the phase of entries written with BootLog.Logger.
+const PhaseLog = "log"
+
+// LogEntry is a message logged while booting.
+type LogEntry struct {
+	Time    time.Time
+	Phase   string
+	Message string
+}
+
+// String formats e as a line of a log file.
+func (e LogEntry) String() string {
+	return fmt.Sprintf("%s %s: %s", e.Time.Format(time.RFC3339Nano), e.Phase, e.Message)
+}
+
+// BootLog keeps the last DefaultBootLogSize messages logged while booting,
+// so that it can be inspected if booting fails.
+type BootLog struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	// next is where the next entry goes once entries is full.
+	next int
+	// path, if set, is a file every entry is appended to.
+	path string
+}
+
+// NewBootLog returns an empty BootLog.
+func NewBootLog() *BootLog {
+	return &BootLog{}
+}
+
+// SetPath makes bl append each entry to the file at path from now on, so that
+// the log survives the process.
+func (bl *BootLog) SetPath(path string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.path = path
+}
+
+// Log adds an entry for phase.
+func (bl *BootLog) Log(phase, format string, v ...interface{}) {
+	e := LogEntry{Time: time.Now(), Phase: phase, Message: fmt.Sprintf(format, v...)}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if len(bl.entries) < DefaultBootLogSize {
+		bl.entries = append(bl.entries, e)
+	} else {
+		bl.entries[bl.next] = e
+		bl.next = (bl.next + 1) % DefaultBootLogSize
+	}
+	if bl.path != "" {
+		if err := appendLine(bl.path, e.String()); err != nil {
+			log.Printf("Boot log: %v", err)
+		}
+	}
+}
+
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	// Whatever comes next may well be a reboot.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries returns the entries of bl, oldest first.
+func (bl *BootLog) Entries() []LogEntry {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	entries := make([]LogEntry, 0, len(bl.entries))
+	entries = append(entries, bl.entries[bl.next:]...)
+	return append(entries, bl.entries[:bl.next]...)
+}
+
+// logWriter adds each line written to it to a BootLog.
+type logWriter struct {
+	bl    *BootLog
+	phase string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.bl.Log(w.phase, "%s", l)
+	}
+	return len(p), nil
+}
+
+// Logger returns a logger whose messages are added to bl with the phase
+// PhaseLog.
+func (bl *BootLog) Logger() *log.Logger {
+	return log.New(logWriter{bl, PhaseLog}, "", 0)
+}
+
+// WithBootLog makes LinuxImage.ExecutionInfo and LinuxImage.Execute log what
+// they do to bl.
+func WithBootLog(bl *BootLog) LinuxImageOption {
+	return func(li *LinuxImage) {
+		li.bootLog = bl
+	}
+}
+
+// logf logs to the BootLog of li, if it has one.
+func (li *LinuxImage) logf(phase, format string, v ...interface{}) {
+	if li.bootLog != nil {
+		li.bootLog.Log(phase, format, v...)
+	}
+}
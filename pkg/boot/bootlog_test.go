@@ -0,0 +1,125 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func messages(entries []LogEntry) []string {
+	var m []string
+	for _, e := range entries {
+		m = append(m, e.Phase+": "+e.Message)
+	}
+	return m
+}
+
+func TestBootLog(t *testing.T) {
+	bl := NewBootLog()
+	bl.Log("prepare", "one %d", 1)
+	bl.Logger().Printf("two\nthree")
+	bl.Log("load", "four")
+
+	entries := bl.Entries()
+	want := []string{"prepare: one 1", "log: two", "log: three", "load: four"}
+	if got := messages(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries() = %q, want %q", got, want)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.Before(entries[i-1].Time) {
+			t.Errorf("entry %d at %v is before entry %d at %v", i, entries[i].Time, i-1, entries[i-1].Time)
+		}
+	}
+}
+
+func TestBootLogRing(t *testing.T) {
+	bl := NewBootLog()
+	for i := 0; i < DefaultBootLogSize+10; i++ {
+		bl.Log("load", "%d", i)
+	}
+	entries := bl.Entries()
+	if len(entries) != DefaultBootLogSize {
+		t.Fatalf("Entries() has %d entries, want %d", len(entries), DefaultBootLogSize)
+	}
+	for i, e := range entries {
+		if want := fmt.Sprint(i + 10); e.Message != want {
+			t.Fatalf("entry %d = %q, want %q", i, e.Message, want)
+		}
+	}
+}
+
+func TestBootLogPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "boot.log")
+
+	bl := NewBootLog()
+	bl.Log("prepare", "not persisted")
+	bl.SetPath(path)
+	bl.Log("load", "first")
+	bl.Log("reboot", "second")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	entries := bl.Entries()[1:]
+	if len(lines) != len(entries) {
+		t.Fatalf("log file has %q, want %d lines", lines, len(entries))
+	}
+	for i, e := range entries {
+		if lines[i] != e.String() {
+			t.Errorf("line %d = %q, want %q", i, lines[i], e.String())
+		}
+	}
+}
+
+func TestLinuxImageBootLog(t *testing.T) {
+	bl := NewBootLog()
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "console=ttyS0", WithBootLog(bl))
+	li.ExecutionInfo(log.New(ioutil.Discard, "", 0))
+	got := messages(bl.Entries())
+	if len(got) != 3 || !strings.HasPrefix(got[0], "info: Kernel: ") || !strings.HasPrefix(got[1], "info: Initrd: ") || got[2] != "info: Command line: console=ttyS0" {
+		t.Errorf("ExecutionInfo() logged %q, want kernel, initrd and command line", got)
+	}
+
+	// Fail before anything is loaded.
+	bl = NewBootLog()
+	li = NewLinuxImage(&errorReaderAt{errSkip}, nil, "", WithBootLog(bl))
+	if err := li.Execute(); err == nil {
+		t.Fatalf("Execute() succeeded")
+	}
+	want := []string{"prepare: Copying kernel to file: " + errSkip.Error()}
+	if got := messages(bl.Entries()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Execute() logged %q, want %q", got, want)
+	}
+}
+
+func TestLinuxImageKernelVersion(t *testing.T) {
+	k, err := os.Open("../bzimage/testdata/bzImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	bl := NewBootLog()
+	li := NewLinuxImage(k, nil, "", WithBootLog(bl))
+	li.ExecutionInfo(log.New(ioutil.Discard, "", 0))
+	got := messages(bl.Entries())
+	want := "info: Kernel version: 4.12.7 (rminnich@uroot) #6 Fri Aug 10 14:47:18 PDT 2018"
+	if len(got) != 3 || got[1] != want {
+		t.Errorf("ExecutionInfo() logged %q, want %q second", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PhaseReport is how long a phase of booting took.
+type PhaseReport struct {
+	Phase string
+	Start time.Time
+	// End is zero while the phase is running.
+	End      time.Time
+	Duration time.Duration
+}
+
+// BootPhaseTimer records when the phases of booting begin and end, so that
+// a regression in boot time can be told apart by phase.
+//
+// LinuxImage.Execute times its phases with a BootPhaseTimer given with
+// WithBootPhaseTimer. The phases do not overlap, but they need not be back
+// to back, and a phase may run more than once.
+type BootPhaseTimer struct {
+	mu     sync.Mutex
+	phases []PhaseReport
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+// NewBootPhaseTimer returns a BootPhaseTimer with no phases.
+func NewBootPhaseTimer() *BootPhaseTimer {
+	return &BootPhaseTimer{now: time.Now}
+}
+
+func (t *BootPhaseTimer) time() time.Time {
+	if t.now == nil {
+		return time.Now()
+	}
+	return t.now()
+}
+
+// Begin records that phase begins now.
+func (t *BootPhaseTimer) Begin(phase string) {
+	now := t.time()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, PhaseReport{Phase: phase, Start: now})
+}
+
+// End records that the last begun run of phase ends now. It does nothing
+// if phase is not running.
+func (t *BootPhaseTimer) End(phase string) {
+	now := t.time()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.phases) - 1; i >= 0; i-- {
+		if p := &t.phases[i]; p.Phase == phase && p.End.IsZero() {
+			p.End = now
+			p.Duration = now.Sub(p.Start)
+			return
+		}
+	}
+}
+
+// Report returns the phases recorded, in the order they began.
+func (t *BootPhaseTimer) Report() []PhaseReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := make([]PhaseReport, len(t.phases))
+	copy(r, t.phases)
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].Start.Before(r[j].Start)
+	})
+	return r
+}
+
+type jsonPhase struct {
+	Phase string     `json:"phase"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	// DurationNS is 0 while the phase is running.
+	DurationNS int64 `json:"duration_ns"`
+}
+
+// WriteJSON writes the report of t as a JSON object with the phases in
+// order. Running phases have no end.
+func (t *BootPhaseTimer) WriteJSON(w io.Writer) error {
+	report := t.Report()
+	phases := make([]jsonPhase, 0, len(report))
+	for _, p := range report {
+		jp := jsonPhase{Phase: p.Phase, Start: p.Start, DurationNS: int64(p.Duration)}
+		if !p.End.IsZero() {
+			end := p.End
+			jp.End = &end
+		}
+		phases = append(phases, jp)
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Phases []jsonPhase `json:"phases"`
+	}{phases})
+}
+
+// prometheusLabel escapes s as a Prometheus label value.
+var prometheusLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the report of t as gauges in the Prometheus text
+// format: when each phase began and, once it ended, how long it took. Of a
+// phase that ran more than once, only the last run is written.
+func (t *BootPhaseTimer) WritePrometheus(w io.Writer) error {
+	var last []PhaseReport
+	index := make(map[string]int)
+	for _, p := range t.Report() {
+		if i, ok := index[p.Phase]; ok {
+			last[i] = p
+			continue
+		}
+		index[p.Phase] = len(last)
+		last = append(last, p)
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP boot_phase_start_timestamp_seconds When the phase of booting began.\n")
+	b.WriteString("# TYPE boot_phase_start_timestamp_seconds gauge\n")
+	for _, p := range last {
+		fmt.Fprintf(&b, "boot_phase_start_timestamp_seconds{phase=\"%s\"} %.9f\n",
+			prometheusLabel.Replace(p.Phase), float64(p.Start.UnixNano())/1e9)
+	}
+	b.WriteString("# HELP boot_phase_duration_seconds How long the phase of booting took.\n")
+	b.WriteString("# TYPE boot_phase_duration_seconds gauge\n")
+	for _, p := range last {
+		if p.End.IsZero() {
+			continue
+		}
+		fmt.Fprintf(&b, "boot_phase_duration_seconds{phase=\"%s\"} %.9f\n",
+			prometheusLabel.Replace(p.Phase), p.Duration.Seconds())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WithBootPhaseTimer makes LinuxImage.Execute time its phases with t:
+// validate, copy-kernel, copy-initrd, kexec-load and kexec-reboot.
+func WithBootPhaseTimer(t *BootPhaseTimer) LinuxImageOption {
+	return func(li *LinuxImage) {
+		li.phaseTimer = t
+	}
+}
+
+// timePhase runs fn as phase of the BootPhaseTimer of li, if it has one.
+func (li *LinuxImage) timePhase(phase string, fn func() error) error {
+	if li.phaseTimer != nil {
+		li.phaseTimer.Begin(phase)
+		defer li.phaseTimer.End(phase)
+	}
+	return fn()
+}
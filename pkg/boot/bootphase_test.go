@@ -0,0 +1,146 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a time a second after the last one each call.
+func fakeClock() func() time.Time {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+}
+
+func TestBootPhaseTimer(t *testing.T) {
+	bt := NewBootPhaseTimer()
+	bt.now = fakeClock()
+	bt.Begin("validate") // 1s
+	bt.End("validate")   // 2s
+	bt.Begin("load")     // 3s
+	bt.End("nothing")    // 4s, ignored
+	bt.Begin("load")     // 5s
+	bt.End("load")       // 6s, ends the second run
+	bt.Begin("reboot")   // 7s
+	bt.End("validate")   // 8s, ignored: not running
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	want := []PhaseReport{
+		{Phase: "validate", Start: at(1), End: at(2), Duration: time.Second},
+		{Phase: "load", Start: at(3)},
+		{Phase: "load", Start: at(5), End: at(6), Duration: time.Second},
+		{Phase: "reboot", Start: at(7)},
+	}
+	if got := bt.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Report() = %+v, want %+v", got, want)
+	}
+
+	// The zero BootPhaseTimer uses the real time.
+	var zero BootPhaseTimer
+	zero.Begin("a")
+	zero.End("a")
+	if r := zero.Report(); len(r) != 1 || r[0].End.Before(r[0].Start) {
+		t.Errorf("Report() of zero timer = %+v", r)
+	}
+}
+
+func TestBootPhaseTimerWriteJSON(t *testing.T) {
+	bt := NewBootPhaseTimer()
+	bt.now = fakeClock()
+	bt.Begin("validate")
+	bt.End("validate")
+	bt.Begin("kexec-load")
+
+	var b bytes.Buffer
+	if err := bt.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Phases []map[string]interface{} `json:"phases"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("WriteJSON() wrote %s: %v", b.String(), err)
+	}
+	want := []map[string]interface{}{
+		{"phase": "validate", "start": "2018-01-01T00:00:01Z", "end": "2018-01-01T00:00:02Z", "duration_ns": 1e9},
+		{"phase": "kexec-load", "start": "2018-01-01T00:00:03Z", "duration_ns": 0.0},
+	}
+	if !reflect.DeepEqual(got.Phases, want) {
+		t.Errorf("WriteJSON() = %s, want phases %v", b.String(), want)
+	}
+}
+
+func TestBootPhaseTimerWritePrometheus(t *testing.T) {
+	bt := NewBootPhaseTimer()
+	bt.now = fakeClock()
+	for _, p := range []string{"validate", "copy-kernel", "copy-kernel"} {
+		bt.Begin(p)
+		bt.End(p)
+	}
+	bt.Begin(`odd "phase"`)
+
+	var b strings.Builder
+	if err := bt.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP boot_phase_start_timestamp_seconds When the phase of booting began.
+# TYPE boot_phase_start_timestamp_seconds gauge
+boot_phase_start_timestamp_seconds{phase="validate"} 1514764801.000000000
+boot_phase_start_timestamp_seconds{phase="copy-kernel"} 1514764805.000000000
+boot_phase_start_timestamp_seconds{phase="odd \"phase\""} 1514764807.000000000
+# HELP boot_phase_duration_seconds How long the phase of booting took.
+# TYPE boot_phase_duration_seconds gauge
+boot_phase_duration_seconds{phase="validate"} 1.000000000
+boot_phase_duration_seconds{phase="copy-kernel"} 1.000000000
+`
+	if got := b.String(); got != want {
+		t.Errorf("WritePrometheus() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLinuxImageExecutePhases(t *testing.T) {
+	bt := NewBootPhaseTimer()
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "", WithBootPhaseTimer(bt))
+	// The kernel is not one, so loading it fails.
+	if err := li.Execute(); err == nil {
+		t.Fatalf("Execute() succeeded")
+	}
+	var got []string
+	for i, p := range bt.Report() {
+		got = append(got, p.Phase)
+		if p.End.IsZero() {
+			t.Errorf("phase %s did not end", p.Phase)
+		}
+		if r := bt.Report(); i > 0 && p.Start.Before(r[i-1].End) {
+			t.Errorf("phase %s began before %s ended", p.Phase, r[i-1].Phase)
+		}
+	}
+	if want := []string{"validate", "copy-kernel", "copy-initrd", "kexec-load"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Execute() timed phases %q, want %q", got, want)
+	}
+
+	// A command line the schema rejects fails validation.
+	bt = NewBootPhaseTimer()
+	li = NewLinuxImage(strings.NewReader("kernel"), nil, "init=/bin/sh", WithBootPhaseTimer(bt))
+	li.SetCmdlineSchema(CmdlineSchema{Forbidden: []string{"init"}})
+	if err := li.Execute(); err == nil || !strings.Contains(err.Error(), "init=/bin/sh") {
+		t.Errorf("Execute() = %v, want an error about init=/bin/sh", err)
+	}
+	if r := bt.Report(); len(r) != 1 || r[0].Phase != "validate" {
+		t.Errorf("Execute() timed %+v, want only validate", r)
+	}
+	if err := NewLinuxImage(nil, nil, "").Execute(); err != ErrKernelMissing {
+		t.Errorf("Execute() without kernel = %v, want %v", err, ErrKernelMissing)
+	}
+}
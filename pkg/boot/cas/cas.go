@@ -0,0 +1,189 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cas stores the files of boot images by their SHA-256 digest, so
+// that images sharing a kernel or initrd, such as A/B and rollback images,
+// store it once.
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// CAS is a content-addressable store of files in Dir, each named by the
+// hex SHA-256 digest of its content.
+type CAS struct {
+	Dir string
+}
+
+// validDigest returns whether digest names a file in the store, so that it
+// cannot name one outside it.
+func validDigest(digest string) bool {
+	if len(digest) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil && strings.ToLower(digest) == digest
+}
+
+// Put stores the size bytes of r and returns their digest. Content that is
+// already stored is not stored again.
+func (s *CAS) Put(r io.ReaderAt, size int64) (string, error) {
+	f, err := ioutil.TempFile(s.Dir, ".put")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("read %d bytes, want %d", n, size)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	p := filepath.Join(s.Dir, digest)
+	if _, err := os.Stat(p); err == nil {
+		return digest, nil
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Chmod(0444); err != nil {
+		return "", err
+	}
+	// Renaming makes the whole file appear at once.
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+func (s *CAS) open(digest string) (*os.File, error) {
+	if !validDigest(digest) {
+		return nil, fmt.Errorf("%q is not a SHA-256 digest", digest)
+	}
+	return os.Open(filepath.Join(s.Dir, digest))
+}
+
+// Get returns the content stored as digest. It is not checked against the
+// digest.
+func (s *CAS) Get(digest string) (io.ReaderAt, error) {
+	f, err := s.open(digest)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// LinuxImage returns a LinuxImage of the kernel stored as kernelDigest and,
+// unless initrdDigest is empty, the initrd stored as initrdDigest.
+func (s *CAS) LinuxImage(kernelDigest, initrdDigest, cmdline string) (*boot.LinuxImage, error) {
+	kernel, err := s.Get(kernelDigest)
+	if err != nil {
+		return nil, fmt.Errorf("kernel: %v", err)
+	}
+	var initrd io.ReaderAt
+	if initrdDigest != "" {
+		if initrd, err = s.Get(initrdDigest); err != nil {
+			return nil, fmt.Errorf("initrd: %v", err)
+		}
+	}
+	return boot.NewLinuxImage(kernel, initrd, cmdline), nil
+}
+
+// moduleFile returns the module of an archive path modules/MODULE/file, or
+// "".
+func moduleFile(name, file string) string {
+	dir, base := path.Split(name)
+	if base != file || path.Dir(path.Clean(dir)) != "modules" {
+		return ""
+	}
+	return path.Base(dir)
+}
+
+type writer struct {
+	s *CAS
+	w cpio.RecordWriter
+}
+
+// Writer returns a RecordWriter that stores the content of each module of
+// the boot package written to it, such as modules/kernel/content, in s and
+// writes a reference to it, modules/kernel/digest, to w instead.
+func (s *CAS) Writer(w cpio.RecordWriter) cpio.RecordWriter {
+	return &writer{s: s, w: w}
+}
+
+// WriteRecord implements cpio.RecordWriter.
+func (w *writer) WriteRecord(r cpio.Record) error {
+	name := cpio.Normalize(r.Name)
+	m := moduleFile(name, "content")
+	if m == "" {
+		return w.w.WriteRecord(r)
+	}
+	digest, err := w.s.Put(r, int64(r.FileSize))
+	if err != nil {
+		return fmt.Errorf("storing %s: %v", name, err)
+	}
+	info := r.Info
+	info.Name = path.Join("modules", m, "digest")
+	return w.w.WriteRecord(cpio.StaticRecord([]byte(digest), info))
+}
+
+type reader struct {
+	s *CAS
+	r cpio.RecordReader
+}
+
+// Reader returns a RecordReader of the archive r, written by Writer, with
+// the references to content stored in s replaced by the content, so that
+// boot.Package.Unpack can read it.
+func (s *CAS) Reader(r cpio.RecordReader) cpio.RecordReader {
+	return &reader{s: s, r: r}
+}
+
+// ReadRecord implements cpio.RecordReader.
+func (r *reader) ReadRecord() (cpio.Record, error) {
+	rec, err := r.r.ReadRecord()
+	if err != nil {
+		return rec, err
+	}
+	name := cpio.Normalize(rec.Name)
+	m := moduleFile(name, "digest")
+	if m == "" {
+		return rec, nil
+	}
+	digest, err := uio.ReadAll(rec)
+	if err != nil {
+		return rec, err
+	}
+	content, err := r.s.open(strings.TrimSpace(string(digest)))
+	if err != nil {
+		return rec, fmt.Errorf("%s: %v", name, err)
+	}
+	fi, err := content.Stat()
+	if err != nil {
+		content.Close()
+		return rec, err
+	}
+	rec.Info.Name = path.Join("modules", m, "content")
+	rec.Info.FileSize = uint64(fi.Size())
+	rec.ReaderAt = content
+	return rec, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func tempCAS(t *testing.T) (*CAS, func()) {
+	dir, err := ioutil.TempDir("", "cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CAS{Dir: dir}, func() { os.RemoveAll(dir) }
+}
+
+// stored returns the names of the files in s.
+func stored(t *testing.T, s *CAS) []string {
+	fis, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func digestOf(s string) string {
+	d := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(d[:])
+}
+
+func TestPutGet(t *testing.T) {
+	s, cleanup := tempCAS(t)
+	defer cleanup()
+
+	const kernel = "bzImage"
+	d1, err := s.Put(strings.NewReader(kernel), int64(len(kernel)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 != digestOf(kernel) {
+		t.Errorf("Put() = %s, want the SHA-256 of the kernel, %s", d1, digestOf(kernel))
+	}
+	d2, err := s.Put(strings.NewReader(kernel), int64(len(kernel)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2 != d1 {
+		t.Errorf("Put() of the same kernel = %s, then %s", d1, d2)
+	}
+	if names := stored(t, s); len(names) != 1 || names[0] != d1 {
+		t.Errorf("store has %v, want just %s", names, d1)
+	}
+
+	r, err := s.Get(d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := uio.ReadAll(r); err != nil || string(b) != kernel {
+		t.Errorf("Get() = %q, %v, want %q", b, err, kernel)
+	}
+
+	for _, d := range []string{
+		digestOf("not stored"),
+		"../" + d1[3:],
+		strings.ToUpper(d1),
+		"",
+	} {
+		if _, err := s.Get(d); err == nil {
+			t.Errorf("Get(%q) succeeded", d)
+		}
+	}
+	if _, err := s.Put(strings.NewReader(kernel), 100); err == nil {
+		t.Errorf("Put() of more bytes than there are succeeded")
+	}
+	if names := stored(t, s); len(names) != 1 {
+		t.Errorf("store has %v after a failed Put, want just %s", names, d1)
+	}
+}
+
+func TestLinuxImage(t *testing.T) {
+	s, cleanup := tempCAS(t)
+	defer cleanup()
+	k, _ := s.Put(strings.NewReader("kernel"), 6)
+	i, _ := s.Put(strings.NewReader("initrd"), 6)
+
+	li, err := s.LinuxImage(k, i, "quiet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := uio.ReadAll(li.Kernel)
+	ib, _ := uio.ReadAll(li.Initrd)
+	if string(kb) != "kernel" || string(ib) != "initrd" || li.Cmdline != "quiet" {
+		t.Errorf("LinuxImage() = %q, %q, %q, want kernel, initrd, quiet", kb, ib, li.Cmdline)
+	}
+	if li, err := s.LinuxImage(k, "", ""); err != nil || li.Initrd != nil {
+		t.Errorf("LinuxImage() without initrd = %v, %v, want no initrd", li, err)
+	}
+	if _, err := s.LinuxImage(digestOf("other"), i, ""); err == nil {
+		t.Errorf("LinuxImage() of a kernel that is not stored succeeded")
+	}
+	if _, err := s.LinuxImage(k, digestOf("other"), ""); err == nil {
+		t.Errorf("LinuxImage() of an initrd that is not stored succeeded")
+	}
+}
+
+func TestPackages(t *testing.T) {
+	s, cleanup := tempCAS(t)
+	defer cleanup()
+
+	// Slots A and B have the same kernel, and different initrds.
+	var archives []*cpio.Archive
+	for _, initrd := range []string{"initrd A", "initrd B"} {
+		li := boot.NewLinuxImage(strings.NewReader("kernel"), strings.NewReader(initrd), "root=/dev/sda1")
+		a := cpio.InMemArchive()
+		if err := boot.NewPackage(li).Pack(s.Writer(a), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := a.Get("modules/kernel/content"); ok {
+			t.Errorf("package has the kernel")
+		}
+		r, ok := a.Get("modules/kernel/digest")
+		if !ok {
+			t.Fatalf("package has no kernel digest: %v", a)
+		}
+		if d, _ := uio.ReadAll(r); string(d) != digestOf("kernel") {
+			t.Errorf("kernel digest = %q, want %q", d, digestOf("kernel"))
+		}
+		archives = append(archives, a)
+	}
+	if names := stored(t, s); len(names) != 3 {
+		t.Errorf("store has %v, want the kernel and both initrds", names)
+	}
+
+	for i, initrd := range []string{"initrd A", "initrd B"} {
+		var p boot.Package
+		if err := p.Unpack(s.Reader(archives[i].Reader()), nil); err != nil {
+			t.Fatal(err)
+		}
+		li, ok := p.OSImage.(*boot.LinuxImage)
+		if !ok {
+			t.Fatalf("Unpack() = %T, want *boot.LinuxImage", p.OSImage)
+		}
+		kb, _ := uio.ReadAll(li.Kernel)
+		ib, _ := uio.ReadAll(li.Initrd)
+		if string(kb) != "kernel" || string(ib) != initrd || li.Cmdline != "root=/dev/sda1" {
+			t.Errorf("Unpack() = %q, %q, %q, want kernel, %s, root=/dev/sda1", kb, ib, li.Cmdline, initrd)
+		}
+	}
+
+	// Packages refer to content, so it must be in the store.
+	os.RemoveAll(s.Dir)
+	var p boot.Package
+	if err := p.Unpack(s.Reader(archives[0].Reader()), nil); err == nil {
+		t.Errorf("Unpack() with an empty store succeeded")
+	}
+}
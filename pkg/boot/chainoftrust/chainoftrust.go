@@ -0,0 +1,201 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package chainoftrust verifies signed boot archives against a certificate
+// authority rather than a single public key.
+//
+// A signed archive is a cpio archive written by boot.SigningWriter that
+// also contains, before the signature, a CertChainPath record. The record
+// holds the PEM-encoded certificate of the signing key, followed by any
+// intermediate certificates between it and the root.
+package chainoftrust
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// CertChainPath is the archive path of the certificate chain.
+const CertChainPath = "modules/cert-chain"
+
+// ChainError is an error verifying the certificate chain of an archive.
+type ChainError struct {
+	Err error
+}
+
+// Error implements error.Error.
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("certificate chain: %v", e.Err)
+}
+
+// IsChainError returns true iff err is a ChainError.
+func IsChainError(err error) bool {
+	_, ok := err.(*ChainError)
+	return ok
+}
+
+// SignatureError is an error verifying the signature of an archive with a
+// trusted certificate.
+type SignatureError struct {
+	Err error
+}
+
+// Error implements error.Error.
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("archive signature: %v", e.Err)
+}
+
+// IsSignatureError returns true iff err is a SignatureError.
+func IsSignatureError(err error) bool {
+	_, ok := err.(*SignatureError)
+	return ok
+}
+
+// TrustChain is the set of certificates archives are verified against.
+type TrustChain struct {
+	// RootCert is the certificate authority the chain of an archive must
+	// end at.
+	RootCert *x509.Certificate
+
+	// IntermediateCerts are intermediate certificates that may be used to
+	// build the chain, in addition to those in the archive.
+	IntermediateCerts []*x509.Certificate
+
+	// roots are used instead of RootCert if it is nil.
+	roots *x509.CertPool
+}
+
+// TrustChainFromSystemAnchors returns a TrustChain that trusts the system's
+// certificate authorities.
+func TrustChainFromSystemAnchors() (*TrustChain, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	return &TrustChain{roots: pool}, nil
+}
+
+// VerifyArchive verifies that the cpio archive r is signed by the key of
+// the leaf certificate in its CertChainPath record, and that the
+// certificate chains up to the root of tc.
+//
+// Errors in the chain are *ChainError, and a signature not matching the
+// leaf certificate is a *SignatureError.
+func (tc *TrustChain) VerifyArchive(r io.ReaderAt) error {
+	mr := boot.NewMeasuringReader(cpio.Newc.Reader(r))
+	var chain []byte
+	err := cpio.ForEachRecord(mr, func(rec cpio.Record) error {
+		if cpio.Normalize(rec.Name) != CertChainPath {
+			return nil
+		}
+		if chain != nil {
+			return &ChainError{errors.New("archive has more than one certificate chain")}
+		}
+		var err error
+		chain, err = uio.ReadAll(rec)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		return &ChainError{fmt.Errorf("archive has no %s", CertChainPath)}
+	}
+
+	leaf, err := tc.verifyChain(chain)
+	if err != nil {
+		return &ChainError{err}
+	}
+
+	pk, ok := leaf.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return &SignatureError{fmt.Errorf("unsupported public key type %T", leaf.PublicKey)}
+	}
+	if err := mr.Verify(pk); err != nil {
+		return &SignatureError{err}
+	}
+	return nil
+}
+
+// verifyChain returns the leaf certificate of the PEM chain if it is
+// trusted by tc.
+func (tc *TrustChain) verifyChain(chain []byte) (*x509.Certificate, error) {
+	certs, err := ParseCertChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := tc.roots
+	if tc.RootCert != nil {
+		roots = x509.NewCertPool()
+		roots.AddCert(tc.RootCert)
+	}
+	if roots == nil {
+		return nil, errors.New("no root certificate to verify against")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range tc.IntermediateCerts {
+		intermediates.AddCert(c)
+	}
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// ParseCertChain parses PEM-encoded certificates, leaf first.
+func ParseCertChain(chain []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var b *pem.Block
+		b, chain = pem.Decode(chain)
+		if b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %q", b.Type)
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(bytes.TrimSpace(chain)) > 0 {
+		return nil, errors.New("trailing data after the certificates")
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	return certs, nil
+}
+
+// CertChainRecord returns the CertChainPath record for the certificate of
+// the signing key, leaf, and the intermediates between it and the root.
+//
+// It is to be written with boot.SigningWriter before the signature.
+func CertChainRecord(leaf *x509.Certificate, intermediates ...*x509.Certificate) cpio.Record {
+	var b bytes.Buffer
+	for _, c := range append([]*x509.Certificate{leaf}, intermediates...) {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return cpio.StaticFile(CertChainPath, b.String(), 0444)
+}
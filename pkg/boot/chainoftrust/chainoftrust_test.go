@@ -0,0 +1,200 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chainoftrust
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+type identity struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// newIdentity returns a certificate for a new key, signed by parent, or
+// self-signed if parent is nil.
+func newIdentity(t *testing.T, name string, isCA bool, parent *identity) *identity {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &identity{key: key, cert: cert}
+}
+
+// signedArchive returns an archive of recs signed by signer.
+func signedArchive(t *testing.T, signer *rsa.PrivateKey, recs ...cpio.Record) *bytes.Reader {
+	var b bytes.Buffer
+	w := cpio.Newc.Writer(&b)
+	sw := boot.NewSigningWriter(w)
+	for _, rec := range recs {
+		if err := sw.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.WriteSignature(signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+func TestVerifyArchive(t *testing.T) {
+	root := newIdentity(t, "root CA", true, nil)
+	intermediate := newIdentity(t, "intermediate CA", true, root)
+	leaf := newIdentity(t, "archive signer", false, intermediate)
+	otherRoot := newIdentity(t, "other CA", true, nil)
+
+	kernel := cpio.StaticFile("modules/kernel", "bzImage", 0644)
+
+	for _, tt := range []struct {
+		name    string
+		tc      *TrustChain
+		archive *bytes.Reader
+		isErr   func(error) bool
+	}{
+		{
+			name:    "intermediate in archive",
+			tc:      &TrustChain{RootCert: root.cert},
+			archive: signedArchive(t, leaf.key, kernel, CertChainRecord(leaf.cert, intermediate.cert)),
+		},
+		{
+			name:    "intermediate in trust chain",
+			tc:      &TrustChain{RootCert: root.cert, IntermediateCerts: []*x509.Certificate{intermediate.cert}},
+			archive: signedArchive(t, leaf.key, CertChainRecord(leaf.cert), kernel),
+		},
+		{
+			name:    "missing intermediate",
+			tc:      &TrustChain{RootCert: root.cert},
+			archive: signedArchive(t, leaf.key, kernel, CertChainRecord(leaf.cert)),
+			isErr:   IsChainError,
+		},
+		{
+			name:    "other root",
+			tc:      &TrustChain{RootCert: otherRoot.cert},
+			archive: signedArchive(t, leaf.key, kernel, CertChainRecord(leaf.cert, intermediate.cert)),
+			isErr:   IsChainError,
+		},
+		{
+			name:    "no certificate chain",
+			tc:      &TrustChain{RootCert: root.cert},
+			archive: signedArchive(t, leaf.key, kernel),
+			isErr:   IsChainError,
+		},
+		{
+			name:    "no root",
+			tc:      &TrustChain{},
+			archive: signedArchive(t, leaf.key, kernel, CertChainRecord(leaf.cert, intermediate.cert)),
+			isErr:   IsChainError,
+		},
+		{
+			name:    "signed by another key",
+			tc:      &TrustChain{RootCert: root.cert},
+			archive: signedArchive(t, otherRoot.key, kernel, CertChainRecord(leaf.cert, intermediate.cert)),
+			isErr:   IsSignatureError,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tc.VerifyArchive(tt.archive)
+			if tt.isErr == nil && err != nil {
+				t.Errorf("VerifyArchive() = %v, want nil", err)
+			}
+			if tt.isErr != nil && !tt.isErr(err) {
+				t.Errorf("VerifyArchive() = %v (%T), want a different error", err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyArchiveTampered(t *testing.T) {
+	root := newIdentity(t, "root CA", true, nil)
+	leaf := newIdentity(t, "archive signer", false, root)
+
+	archive := signedArchive(t, leaf.key, CertChainRecord(leaf.cert), cpio.StaticFile("modules/kernel", "bzImage", 0644))
+	b := make([]byte, archive.Len())
+	archive.Read(b)
+	i := bytes.Index(b, []byte("bzImage"))
+	if i < 0 {
+		t.Fatal("kernel not found in archive")
+	}
+	b[i] = 'Z'
+
+	tc := &TrustChain{RootCert: root.cert}
+	if err := tc.VerifyArchive(bytes.NewReader(b)); !IsSignatureError(err) {
+		t.Errorf("VerifyArchive(tampered) = %v, want SignatureError", err)
+	}
+}
+
+func TestParseCertChain(t *testing.T) {
+	root := newIdentity(t, "root CA", true, nil)
+	leaf := newIdentity(t, "archive signer", false, root)
+
+	chain, err := uio.ReadAll(CertChainRecord(leaf.cert, root.cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ParseCertChain(chain)
+	if err != nil {
+		t.Fatalf("ParseCertChain() = %v", err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(leaf.cert) || !certs[1].Equal(root.cert) {
+		t.Errorf("ParseCertChain() = %v, want the leaf and the root", certs)
+	}
+
+	for _, bad := range []string{"", "not PEM", string(chain) + "garbage"} {
+		if _, err := ParseCertChain([]byte(bad)); err == nil {
+			t.Errorf("ParseCertChain(%q) = nil, want error", bad)
+		}
+	}
+}
+
+func TestTrustChainFromSystemAnchors(t *testing.T) {
+	tc, err := TrustChainFromSystemAnchors()
+	if err != nil {
+		t.Skipf("no system certificate pool: %v", err)
+	}
+	root := newIdentity(t, "root CA", true, nil)
+	leaf := newIdentity(t, "archive signer", false, root)
+	err = tc.VerifyArchive(signedArchive(t, leaf.key, CertChainRecord(leaf.cert)))
+	if !IsChainError(err) {
+		t.Errorf("VerifyArchive(untrusted root) = %v, want ChainError", err)
+	}
+}
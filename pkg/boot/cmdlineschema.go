@@ -0,0 +1,186 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// cmdlineSchemaPath is where LinuxImage.Pack writes the command line schema
+// of an image.
+const cmdlineSchemaPath = "modules/cmdline-schema"
+
+// CmdlineSchema says which kernel command lines a kernel boots with.
+//
+// Entries of Required and Forbidden are parameters: "key=value" stands for
+// itself, and a bare "key" for the key with any or no value. Each pattern
+// of AllowedPatterns is a regular expression that matches whole
+// parameters.
+type CmdlineSchema struct {
+	Required        []string `json:"required,omitempty"`
+	Forbidden       []string `json:"forbidden,omitempty"`
+	AllowedPatterns []string `json:"allowed_patterns,omitempty"`
+}
+
+// cmdlineParams splits cmdline into parameters as the kernel does, keeping
+// double-quoted spaces in their parameter.
+func cmdlineParams(cmdline string) []string {
+	inQuote := false
+	return strings.FieldsFunc(cmdline, func(c rune) bool {
+		if c == '"' {
+			inQuote = !inQuote
+		}
+		return !inQuote && (c == ' ' || c == '\t' || c == '\n' || c == '\r')
+	})
+}
+
+// matchParam returns whether param is the parameter p of a schema.
+func matchParam(param, p string) bool {
+	if param == p {
+		return true
+	}
+	key := strings.SplitN(param, "=", 2)[0]
+	return !strings.Contains(p, "=") && key == p
+}
+
+// Validate returns an error listing the parameters of cmdline that break s.
+func (s CmdlineSchema) Validate(cmdline string) error {
+	params := cmdlineParams(cmdline)
+	var problems []string
+
+	var missing []string
+	for _, r := range s.Required {
+		found := false
+		for _, p := range params {
+			if matchParam(p, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing required %q", missing))
+	}
+
+	var forbidden []string
+	for _, p := range params {
+		for _, f := range s.Forbidden {
+			if matchParam(p, f) {
+				forbidden = append(forbidden, p)
+				break
+			}
+		}
+	}
+	if len(forbidden) > 0 {
+		problems = append(problems, fmt.Sprintf("forbidden %q", forbidden))
+	}
+
+	if len(s.AllowedPatterns) > 0 {
+		patterns := make([]*regexp.Regexp, 0, len(s.AllowedPatterns))
+		for _, p := range s.AllowedPatterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return fmt.Errorf("command line schema: bad pattern %q: %v", p, err)
+			}
+			patterns = append(patterns, re)
+		}
+		var disallowed []string
+		for _, p := range params {
+			allowed := false
+			for _, re := range patterns {
+				if re.MatchString(p) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				disallowed = append(disallowed, p)
+			}
+		}
+		if len(disallowed) > 0 {
+			problems = append(problems, fmt.Sprintf("not allowed %q", disallowed))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("kernel command line %q: %s", cmdline, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseCmdlineSchema decodes the JSON schema in r.
+func parseCmdlineSchema(r io.ReaderAt) (CmdlineSchema, error) {
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		return CmdlineSchema{}, err
+	}
+	var s CmdlineSchema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return CmdlineSchema{}, fmt.Errorf("bad command line schema: %v", err)
+	}
+	return s, nil
+}
+
+// CmdlineSchemaForKernel returns the schema in the modules/cmdline-schema
+// record of the boot package r, which may be compressed, or an empty
+// schema that any command line passes if there is no such record.
+func CmdlineSchemaForKernel(r io.ReaderAt) (CmdlineSchema, error) {
+	r, err := cpio.AutoDecompressReader(r)
+	if err != nil {
+		return CmdlineSchema{}, err
+	}
+	var s CmdlineSchema
+	err = cpio.ForEachRecord(cpio.Newc.Reader(r), func(rec cpio.Record) error {
+		if cpio.Normalize(rec.Name) != cmdlineSchemaPath {
+			return nil
+		}
+		var err error
+		s, err = parseCmdlineSchema(rec)
+		return err
+	})
+	return s, err
+}
+
+// SetCmdlineSchema makes li.Validate check li.Cmdline against s. Pack writes
+// s to the package as JSON.
+func (li *LinuxImage) SetCmdlineSchema(s CmdlineSchema) {
+	li.cmdlineSchema = &s
+}
+
+// packCmdlineSchema writes the command line schema of li, if any, to sw.
+func (li *LinuxImage) packCmdlineSchema(sw cpio.RecordWriter) error {
+	if li.cmdlineSchema == nil {
+		return nil
+	}
+	b, err := json.Marshal(li.cmdlineSchema)
+	if err != nil {
+		return err
+	}
+	return sw.WriteRecord(cpio.StaticFile(cmdlineSchemaPath, string(b), 0700))
+}
+
+// unpackCmdlineSchema reads the command line schema in a, if any, into li.
+func (li *LinuxImage) unpackCmdlineSchema(a *cpio.Archive) error {
+	r, ok := a.Files[cmdlineSchemaPath]
+	if !ok {
+		return nil
+	}
+	s, err := parseCmdlineSchema(r)
+	if err != nil {
+		return err
+	}
+	li.cmdlineSchema = &s
+	return nil
+}
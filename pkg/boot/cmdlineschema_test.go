@@ -0,0 +1,179 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestCmdlineParams(t *testing.T) {
+	got := cmdlineParams(" console=ttyS0\tquiet  dyndbg=\"file init.c +p\"\n")
+	want := []string{"console=ttyS0", "quiet", `dyndbg="file init.c +p"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cmdlineParams() = %q, want %q", got, want)
+	}
+}
+
+func TestCmdlineSchemaValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		schema  CmdlineSchema
+		cmdline string
+		// errs are what the error must mention; none for no error.
+		errs []string
+	}{
+		{"empty schema", CmdlineSchema{}, "anything goes init=/bin/sh", nil},
+		{"empty cmdline", CmdlineSchema{}, "", nil},
+
+		{"required key", CmdlineSchema{Required: []string{"root"}}, "quiet root=/dev/sda1", nil},
+		{"required flag", CmdlineSchema{Required: []string{"ro"}}, "root=/dev/sda1 ro", nil},
+		{"required value", CmdlineSchema{Required: []string{"console=ttyS0"}}, "console=tty0 console=ttyS0", nil},
+		{"missing required", CmdlineSchema{Required: []string{"root", "console=ttyS0", "ro"}}, "console=tty0 ro",
+			[]string{`missing required ["root" "console=ttyS0"]`}},
+		{"key is not a prefix", CmdlineSchema{Required: []string{"root"}}, "rootwait rootfstype=ext4",
+			[]string{`missing required ["root"]`}},
+
+		{"forbidden key", CmdlineSchema{Forbidden: []string{"init"}}, "quiet init=/bin/sh",
+			[]string{`forbidden ["init=/bin/sh"]`}},
+		{"forbidden value", CmdlineSchema{Forbidden: []string{"selinux=0"}}, "selinux=1", nil},
+		{"forbidden flag", CmdlineSchema{Forbidden: []string{"single", "selinux=0"}}, "single selinux=0 quiet",
+			[]string{`forbidden ["single" "selinux=0"]`}},
+
+		{"allowed", CmdlineSchema{AllowedPatterns: []string{`console=tty(S[0-9]+|0)`, `root=/dev/.*`, "quiet"}}, "console=ttyS1 root=/dev/sda quiet", nil},
+		{"patterns match whole parameters", CmdlineSchema{AllowedPatterns: []string{"quiet", "console=tty0"}}, "quietly console=tty0,115200",
+			[]string{`not allowed ["quietly" "console=tty0,115200"]`}},
+		{"alternatives are anchored", CmdlineSchema{AllowedPatterns: []string{"a|b"}}, "ab b",
+			[]string{`not allowed ["ab"]`}},
+
+		{"all rules", CmdlineSchema{
+			Required:        []string{"root"},
+			Forbidden:       []string{"init"},
+			AllowedPatterns: []string{"init=.*", "quiet"},
+		}, "init=/bin/sh quiet debug",
+			[]string{`missing required ["root"]`, `forbidden ["init=/bin/sh"]`, `not allowed ["debug"]`}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schema.Validate(tt.cmdline)
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Errorf("Validate(%q) = %v, want nil", tt.cmdline, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate(%q) = nil, want error", tt.cmdline)
+			}
+			for _, e := range tt.errs {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("Validate(%q) = %v, want it to mention %s", tt.cmdline, err, e)
+				}
+			}
+		})
+	}
+
+	if err := (CmdlineSchema{AllowedPatterns: []string{"("}}).Validate("quiet"); err == nil {
+		t.Errorf("Validate() with a bad pattern = nil, want error")
+	}
+}
+
+func TestCmdlineSchemaForKernel(t *testing.T) {
+	schema := CmdlineSchema{Required: []string{"root"}, Forbidden: []string{"init"}, AllowedPatterns: []string{"root=.*"}}
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "root=/dev/sda1")
+	li.SetCmdlineSchema(schema)
+
+	var b bytes.Buffer
+	w := cpio.Newc.Writer(&b)
+	if err := li.Pack(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(b.Bytes())
+	zw.Close()
+
+	for name, archive := range map[string][]byte{"newc": b.Bytes(), "gzip": gz.Bytes()} {
+		got, err := CmdlineSchemaForKernel(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatalf("CmdlineSchemaForKernel(%s) = %v", name, err)
+		}
+		if !reflect.DeepEqual(got, schema) {
+			t.Errorf("CmdlineSchemaForKernel(%s) = %+v, want %+v", name, got, schema)
+		}
+	}
+
+	// Without the record, the schema is empty.
+	b.Reset()
+	w = cpio.Newc.Writer(&b)
+	if err := NewLinuxImage(strings.NewReader("kernel"), nil, "").Pack(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CmdlineSchemaForKernel(bytes.NewReader(b.Bytes())); err != nil || !reflect.DeepEqual(got, CmdlineSchema{}) {
+		t.Errorf("CmdlineSchemaForKernel() without schema = %+v, %v, want empty schema", got, err)
+	}
+
+	b.Reset()
+	w = cpio.Newc.Writer(&b)
+	if err := w.WriteRecord(cpio.StaticFile(cmdlineSchemaPath, `{"required": "root"}`, 0700)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CmdlineSchemaForKernel(bytes.NewReader(b.Bytes())); err == nil {
+		t.Errorf("CmdlineSchemaForKernel() of a bad schema = nil, want error")
+	}
+	if _, err := CmdlineSchemaForKernel(strings.NewReader(strings.Repeat("not a cpio archive ", 10))); err == nil {
+		t.Errorf("CmdlineSchemaForKernel() of garbage = nil, want error")
+	}
+}
+
+func TestLinuxImageValidateCmdlineSchema(t *testing.T) {
+	schema := CmdlineSchema{Required: []string{"console"}, Forbidden: []string{"init"}}
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "console=ttyS0 init=/bin/sh")
+	if err := li.Validate(); err != nil {
+		t.Fatalf("Validate() without schema = %v, want nil", err)
+	}
+	li.SetCmdlineSchema(schema)
+	if err := li.Validate(); err == nil || !strings.Contains(err.Error(), "init=/bin/sh") {
+		t.Errorf("Validate() = %v, want an error about init=/bin/sh", err)
+	}
+
+	// The schema survives packing.
+	a := cpio.InMemArchive()
+	if err := li.Pack(a); err != nil {
+		t.Fatal(err)
+	}
+	got, err := NewLinuxImageFromArchive(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Validate(); err == nil {
+		t.Errorf("Validate() of unpacked image = nil, want error")
+	}
+	got.Cmdline = "console=ttyS0"
+	if err := got.Validate(); err != nil {
+		t.Errorf("Validate() of unpacked image with %q = %v, want nil", got.Cmdline, err)
+	}
+
+	bad := cpio.ArchiveFromRecords([]cpio.Record{
+		cpio.StaticFile("modules/kernel/content", "kernel", 0700),
+		cpio.StaticFile(cmdlineSchemaPath, "{", 0700),
+	})
+	if _, err := NewLinuxImageFromArchive(bad); err == nil {
+		t.Errorf("NewLinuxImageFromArchive() with bad schema = nil, want error")
+	}
+}
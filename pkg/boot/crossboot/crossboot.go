@@ -0,0 +1,127 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package crossboot boots Linux images built for another architecture in
+// QEMU, which is useful to test them in CI.
+package crossboot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// qemuArch maps GOARCH values to the architecture in the name of the QEMU
+// system emulator, and the machine options it needs, if any.
+var qemuArch = map[string]struct {
+	name    string
+	machine []string
+}{
+	"386":     {name: "i386"},
+	"amd64":   {name: "x86_64"},
+	"arm":     {name: "arm", machine: []string{"-machine", "virt"}},
+	"arm64":   {name: "aarch64", machine: []string{"-machine", "virt", "-cpu", "cortex-a57"}},
+	"ppc64":   {name: "ppc64"},
+	"ppc64le": {name: "ppc64"},
+	"riscv64": {name: "riscv64", machine: []string{"-machine", "virt"}},
+	"s390x":   {name: "s390x"},
+}
+
+var (
+	// goarch is the architecture we run on. Tests change it.
+	goarch = runtime.GOARCH
+	// execute boots li with kexec. Tests replace it.
+	execute = func(li *boot.LinuxImage) error { return li.Execute() }
+)
+
+// QEMUBinary returns the name of the QEMU system emulator for arch, a GOARCH
+// value, such as qemu-system-aarch64 for arm64.
+func QEMUBinary(arch string) (string, error) {
+	a, ok := qemuArch[arch]
+	if !ok {
+		return "", fmt.Errorf("no QEMU system emulator for architecture %q", arch)
+	}
+	return "qemu-system-" + a.name, nil
+}
+
+// qemuArgs returns the arguments to QEMU for arch to boot kernel and, unless
+// it is empty, initrd with cmdline.
+func qemuArgs(arch, kernel, initrd, cmdline string) []string {
+	args := append([]string{}, qemuArch[arch].machine...)
+	args = append(args, "-nographic", "-kernel", kernel)
+	if initrd != "" {
+		args = append(args, "-initrd", initrd)
+	}
+	return append(args, "-append", cmdline)
+}
+
+// writeFile copies r into a file called name in dir.
+func writeFile(dir, name string, r io.ReaderAt) (string, error) {
+	p := filepath.Join(dir, name)
+	f, err := os.Create(p)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, uio.Reader(r)); err != nil {
+		f.Close()
+		return "", err
+	}
+	return p, f.Close()
+}
+
+// CrossBoot boots li, whose kernel is for targetArch, a GOARCH value. On
+// targetArch, li is executed with kexec as usual. Anywhere else, it is run
+// in the QEMU system emulator for targetArch, which must be in $PATH, with
+// its console on stdin and stdout. CrossBoot then returns when QEMU exits.
+func CrossBoot(li *boot.LinuxImage, targetArch string) error {
+	if targetArch == goarch {
+		return execute(li)
+	}
+	bin, err := QEMUBinary(targetArch)
+	if err != nil {
+		return err
+	}
+	qemu, err := exec.LookPath(bin)
+	if err != nil {
+		return fmt.Errorf("booting a %s kernel on %s: %v", targetArch, goarch, err)
+	}
+	if li.Kernel == nil {
+		return boot.ErrKernelMissing
+	}
+
+	dir, err := ioutil.TempDir("", "crossboot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	kernel, err := writeFile(dir, "kernel", li.Kernel)
+	if err != nil {
+		return fmt.Errorf("copying kernel: %v", err)
+	}
+	initrd, closeInitrd, err := li.InitrdWithOverlays()
+	if err != nil {
+		return fmt.Errorf("building initrd: %v", err)
+	}
+	defer closeInitrd()
+	var initrdPath string
+	if initrd != nil {
+		if initrdPath, err = writeFile(dir, "initrd", initrd); err != nil {
+			return fmt.Errorf("copying initrd: %v", err)
+		}
+	}
+
+	cmd := exec.Command(qemu, qemuArgs(targetArch, kernel, initrdPath, li.Cmdline)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", bin, err)
+	}
+	return nil
+}
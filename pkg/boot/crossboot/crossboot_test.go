@@ -0,0 +1,150 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package crossboot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// fakeQEMU puts a qemu-system-aarch64 in $PATH that writes its arguments,
+// one per line, and then the kernel and initrd it was given to the returned
+// log file. It exits with exit.
+func fakeQEMU(t *testing.T, exit int) (string, func()) {
+	dir, err := ioutil.TempDir("", "crossboot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "log")
+	script := `#!/bin/sh
+printf '%s\n' "$@" > ` + log + `
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-kernel|-initrd) cat "$2" >> ` + log + `; echo >> ` + log + `; shift;;
+	esac
+	shift
+done
+exit ` + strconv.Itoa(exit) + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "qemu-system-aarch64"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldArch := os.Getenv("PATH"), goarch
+	os.Setenv("PATH", dir+":"+oldPath)
+	goarch = "amd64"
+	return log, func() {
+		os.Setenv("PATH", oldPath)
+		goarch = oldArch
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCrossBoot(t *testing.T) {
+	log, done := fakeQEMU(t, 0)
+	defer done()
+
+	li := boot.NewLinuxImage(strings.NewReader("arm64 kernel"), strings.NewReader("initrd"), "console=ttyAMA0 quiet")
+	if err := CrossBoot(li, "arm64"); err != nil {
+		t.Fatalf("CrossBoot() = %v", err)
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 13 {
+		t.Fatalf("qemu got %q, want 11 arguments, the kernel and the initrd", lines)
+	}
+	args, files := lines[:11], lines[11:]
+	// The files are removed once QEMU exits.
+	dir := filepath.Dir(args[6])
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory %s was not removed", dir)
+	}
+	want := []string{
+		"-machine", "virt", "-cpu", "cortex-a57", "-nographic",
+		"-kernel", filepath.Join(dir, "kernel"),
+		"-initrd", filepath.Join(dir, "initrd"),
+		"-append", "console=ttyAMA0 quiet",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("qemu arguments = %q, want %q", args, want)
+	}
+	if want := []string{"arm64 kernel", "initrd"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("qemu got files %q, want %q", files, want)
+	}
+}
+
+func TestCrossBootWithoutInitrd(t *testing.T) {
+	log, done := fakeQEMU(t, 0)
+	defer done()
+
+	if err := CrossBoot(boot.NewLinuxImage(strings.NewReader("kernel"), nil, ""), "arm64"); err != nil {
+		t.Fatalf("CrossBoot() = %v", err)
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "-initrd") || !strings.Contains(string(b), "-append\n\n") {
+		t.Errorf("qemu got %q, want no -initrd and an empty -append", b)
+	}
+}
+
+func TestCrossBootErrors(t *testing.T) {
+	_, done := fakeQEMU(t, 1)
+	defer done()
+
+	li := boot.NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	if err := CrossBoot(li, "arm64"); err == nil {
+		t.Errorf("CrossBoot() with failing QEMU = nil, want error")
+	}
+	// There is no qemu-system-riscv64 in $PATH.
+	if err := CrossBoot(li, "riscv64"); err == nil {
+		t.Errorf("CrossBoot(riscv64) without QEMU = nil, want error")
+	}
+	if err := CrossBoot(li, "vax"); err == nil {
+		t.Errorf("CrossBoot(vax) = nil, want error")
+	}
+	if err := CrossBoot(boot.NewLinuxImage(nil, nil, ""), "arm64"); err != boot.ErrKernelMissing {
+		t.Errorf("CrossBoot() without kernel = %v, want %v", err, boot.ErrKernelMissing)
+	}
+}
+
+func TestCrossBootNative(t *testing.T) {
+	_, done := fakeQEMU(t, 0)
+	defer done()
+	old := execute
+	defer func() { execute = old }()
+	var executed *boot.LinuxImage
+	execute = func(li *boot.LinuxImage) error {
+		executed = li
+		return nil
+	}
+
+	li := boot.NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	if err := CrossBoot(li, "amd64"); err != nil || executed != li {
+		t.Errorf("CrossBoot(amd64) on amd64 = %v and executed %p, want kexec of %p", err, executed, li)
+	}
+}
+
+func TestQEMUBinary(t *testing.T) {
+	for arch, want := range map[string]string{
+		"amd64":   "qemu-system-x86_64",
+		"arm64":   "qemu-system-aarch64",
+		"arm":     "qemu-system-arm",
+		"riscv64": "qemu-system-riscv64",
+	} {
+		if got, err := QEMUBinary(arch); err != nil || got != want {
+			t.Errorf("QEMUBinary(%s) = %q, %v, want %q", arch, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package efiapp boots EFI applications, like grubx64.efi or shimx64.efi.
+//
+// Linux cannot run an EFI application itself. Instead, an EFIApplication
+// is booted by adding a firmware boot entry for it, making it the one-shot
+// BootNext entry and rebooting into the firmware.
+package efiapp
+
+import (
+	"bufio"
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/gpt"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// EFIApplication is an EFI application on a mounted GPT partition, usually
+// the EFI system partition.
+type EFIApplication struct {
+	// Path is the path of the application.
+	Path string
+	// Args are the load options passed to the application.
+	Args []string
+}
+
+var _ boot.OSImage = &EFIApplication{}
+
+// packageType is the package_type of packed EFIApplications.
+const packageType = "efiapp"
+
+func init() {
+	boot.RegisterOSImage(packageType, newFromArchive)
+}
+
+// newFromArchive reads an EFIApplication from a CPIO file archive written
+// by Pack.
+func newFromArchive(a *cpio.Archive) (boot.OSImage, error) {
+	p, ok := a.Files["modules/efiapp/path"]
+	if !ok {
+		return nil, fmt.Errorf("path missing from archive")
+	}
+	b, err := uio.ReadAll(p)
+	if err != nil {
+		return nil, err
+	}
+	app := &EFIApplication{Path: string(b)}
+	if args, ok := a.Files["modules/efiapp/args"]; ok {
+		b, err := uio.ReadAll(args)
+		if err != nil {
+			return nil, err
+		}
+		app.Args = strings.Split(string(b), "\x00")
+	}
+	return app, nil
+}
+
+// Pack implements OSImage.Pack and writes the path of the application and
+// its arguments, separated by NULs, to the modules directory of sw. The
+// application itself stays where it is.
+func (e *EFIApplication) Pack(sw cpio.RecordWriter) error {
+	recs := []cpio.Record{
+		cpio.Directory("modules", 0700),
+		cpio.Directory("modules/efiapp", 0700),
+		cpio.StaticFile("modules/efiapp/path", e.Path, 0700),
+	}
+	if len(e.Args) > 0 {
+		recs = append(recs, cpio.StaticFile("modules/efiapp/args", strings.Join(e.Args, "\x00"), 0700))
+	}
+	recs = append(recs, cpio.StaticFile("package_type", packageType, 0700))
+	return cpio.WriteRecords(sw, recs)
+}
+
+// ExecutionInfo implements OSImage.ExecutionInfo.
+func (e *EFIApplication) ExecutionInfo(l *log.Logger) {
+	l.Printf("EFI application: %s", e.Path)
+	if len(e.Args) > 0 {
+		l.Printf("Load options: %s", strings.Join(e.Args, " "))
+	}
+}
+
+// String implements fmt.Stringer.
+func (e *EFIApplication) String() string {
+	return fmt.Sprintf("EFIApplication(%s %s)", e.Path, strings.Join(e.Args, " "))
+}
+
+// imageMachine maps GOARCH to the PE machine type of EFI applications the
+// firmware runs.
+var imageMachine = map[string]uint16{
+	"386":   pe.IMAGE_FILE_MACHINE_I386,
+	"amd64": pe.IMAGE_FILE_MACHINE_AMD64,
+	"arm":   pe.IMAGE_FILE_MACHINE_ARMNT,
+	"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+}
+
+// subsystemEFIApplication is the PE subsystem of EFI applications, as
+// opposed to boot or runtime drivers.
+const subsystemEFIApplication = 10
+
+// Validate returns an error if e.Path is not a PE32+ EFI application for
+// this machine.
+func (e *EFIApplication) Validate() error {
+	f, err := pe.Open(e.Path)
+	if err != nil {
+		return fmt.Errorf("%s is not a PE image: %v", e.Path, err)
+	}
+	defer f.Close()
+
+	opt, ok := f.OptionalHeader.(*pe.OptionalHeader64)
+	if !ok {
+		return fmt.Errorf("%s is not a PE32+ image", e.Path)
+	}
+	if opt.Subsystem != subsystemEFIApplication {
+		return fmt.Errorf("%s has PE subsystem %d, want EFI application (%d)", e.Path, opt.Subsystem, subsystemEFIApplication)
+	}
+	if m, ok := imageMachine[runtime.GOARCH]; ok && f.Machine != m {
+		return fmt.Errorf("%s is for PE machine %#x, want %#x", e.Path, f.Machine, m)
+	}
+	return nil
+}
+
+// Execute implements OSImage.Execute. It adds a boot entry for the
+// application, makes it BootNext and reboots. It only returns on errors.
+func (e *EFIApplication) Execute() error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	part, file, err := findPartition(e.Path)
+	if err != nil {
+		return err
+	}
+	opt := loadOption("u-root "+filepath.Base(e.Path), devicePath(part, file), e.Args)
+
+	n, err := freeBootNumber()
+	if err != nil {
+		return err
+	}
+	if err := writeEFIVar(fmt.Sprintf("Boot%04X", n), opt); err != nil {
+		return err
+	}
+	var next [2]byte
+	binary.LittleEndian.PutUint16(next[:], n)
+	if err := writeEFIVar("BootNext", next[:]); err != nil {
+		return err
+	}
+
+	// RESTART2 takes a command for the firmware; without one, it is the
+	// same as RESTART, which older kernels may be limited to.
+	if err := reboot(unix.LINUX_REBOOT_CMD_RESTART2); err != nil {
+		if err := reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+			return fmt.Errorf("reboot: %v", err)
+		}
+	}
+	return nil
+}
+
+var (
+	// efivarsDir is where efivarfs is mounted.
+	efivarsDir = "/sys/firmware/efi/efivars"
+	// mountInfo lists the mounts of this process.
+	mountInfo = "/proc/self/mountinfo"
+	// sysDevBlock has the sysfs directories of block devices by number.
+	sysDevBlock = "/sys/dev/block"
+	// devDir has the device nodes of disks.
+	devDir = "/dev"
+
+	reboot = unix.Reboot
+)
+
+// globalGUID is the vendor GUID of the boot manager's EFI variables.
+const globalGUID = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// Attributes of the boot variables: non-volatile, and accessible at boot
+// and run time.
+const efiVarAttrs = 0x1 | 0x2 | 0x4
+
+// writeEFIVar sets the global EFI variable name to value.
+func writeEFIVar(name string, value []byte) error {
+	b := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint32(b, efiVarAttrs)
+	b = append(b, value...)
+
+	// efivarfs takes a variable in a single write and does not support
+	// truncating it.
+	path := filepath.Join(efivarsDir, name+"-"+globalGUID)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("setting EFI variable %s: %v", name, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("setting EFI variable %s: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("setting EFI variable %s: %v", name, err)
+	}
+	return nil
+}
+
+// freeBootNumber returns the lowest number no Boot#### variable has.
+func freeBootNumber() (uint16, error) {
+	fis, err := ioutil.ReadDir(efivarsDir)
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[uint16]bool)
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), "-"+globalGUID)
+		if len(name) != len("Boot0000") || !strings.HasPrefix(name, "Boot") || len(name) == len(fi.Name()) {
+			continue
+		}
+		if n, err := strconv.ParseUint(name[4:], 16, 16); err == nil {
+			used[uint16(n)] = true
+		}
+	}
+	for n := 0; n <= 0xffff; n++ {
+		if !used[uint16(n)] {
+			return uint16(n), nil
+		}
+	}
+	return 0, fmt.Errorf("all boot entries are in use")
+}
+
+// partition is the GPT partition a file is on, in the terms of a hard drive
+// media device path node.
+type partition struct {
+	Number uint32
+	// Start and Size are in 512-byte blocks.
+	Start uint64
+	Size  uint64
+	GUID  gpt.GUID
+}
+
+// findPartition returns the partition path is on and the path of the file
+// in the partition's file system.
+func findPartition(path string) (*partition, string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return nil, "", err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return nil, "", fmt.Errorf("stat %s: %v", path, err)
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+
+	file, err := pathInMount(path, dev)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sys, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, dev))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s is not on a block device: %v", path, err)
+	}
+	var p partition
+	for name, v := range map[string]*uint64{"start": &p.Start, "size": &p.Size} {
+		if *v, err = readSysUint(filepath.Join(sys, name)); err != nil {
+			return nil, "", err
+		}
+	}
+	n, err := readSysUint(filepath.Join(sys, "partition"))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s is not on a partition: %v", path, err)
+	}
+	p.Number = uint32(n)
+
+	disk := filepath.Join(devDir, filepath.Base(filepath.Dir(sys)))
+	f, err := os.Open(disk)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	g, err := gpt.Table(f, gpt.HeaderOff)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading GPT of %s: %v", disk, err)
+	}
+	if p.Number == 0 || int(p.Number) > len(g.Parts) {
+		return nil, "", fmt.Errorf("%s has no partition %d", disk, p.Number)
+	}
+	p.GUID = g.Parts[p.Number-1].UniqueGUID
+	return &p, file, nil
+}
+
+// pathInMount returns the path of path in the file system of device dev,
+// maj:min, that it is mounted from.
+func pathInMount(path, dev string) (string, error) {
+	f, err := os.Open(mountInfo)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// See proc(5): the fields are mount and parent ID, maj:min, the root
+	// of the mount in its file system and the mount point.
+	var root, point string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || fields[2] != dev {
+			continue
+		}
+		mp := mount.UnescapeMountInfo(fields[4])
+		if len(mp) > len(point) && (path == mp || strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/")) {
+			root, point = mount.UnescapeMountInfo(fields[3]), mp
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	if point == "" {
+		return "", fmt.Errorf("no mount of device %s has %s", dev, path)
+	}
+	return filepath.Join(root, strings.TrimPrefix(path, point)), nil
+}
+
+func readSysUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// utf16z returns s as NUL-terminated UTF-16LE.
+func utf16z(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u)+2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// devicePath returns the EFI device path of file on part: a hard drive media
+// node, a file path node and the end node.
+func devicePath(part *partition, file string) []byte {
+	le := binary.LittleEndian
+	var b bytes.Buffer
+
+	hd := make([]byte, 42)
+	hd[0], hd[1] = 4, 1
+	le.PutUint16(hd[2:], uint16(len(hd)))
+	le.PutUint32(hd[4:], part.Number)
+	le.PutUint64(hd[8:], part.Start)
+	le.PutUint64(hd[16:], part.Size)
+	var guid bytes.Buffer
+	binary.Write(&guid, le, part.GUID)
+	copy(hd[24:], guid.Bytes())
+	// GPT partition, GUID signature.
+	hd[40], hd[41] = 2, 2
+	b.Write(hd)
+
+	name := utf16z(strings.Replace(file, "/", `\`, -1))
+	fp := make([]byte, 4, 4+len(name))
+	fp[0], fp[1] = 4, 4
+	le.PutUint16(fp[2:], uint16(4+len(name)))
+	b.Write(append(fp, name...))
+
+	b.Write([]byte{0x7f, 0xff, 4, 0})
+	return b.Bytes()
+}
+
+// loadOptionActive marks a boot entry as one the boot manager boots.
+const loadOptionActive = 0x1
+
+// loadOption returns the EFI_LOAD_OPTION of a boot entry. The args are
+// passed as a UTF-16 command line, as efibootmgr --unicode does.
+func loadOption(description string, path []byte, args []string) []byte {
+	b := make([]byte, 6)
+	binary.LittleEndian.PutUint32(b, loadOptionActive)
+	binary.LittleEndian.PutUint16(b[4:], uint16(len(path)))
+	b = append(b, utf16z(description)...)
+	b = append(b, path...)
+	if len(args) > 0 {
+		b = append(b, utf16z(strings.Join(args, " "))...)
+	}
+	return b
+}
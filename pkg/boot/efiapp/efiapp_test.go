@@ -0,0 +1,324 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package efiapp
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/gpt"
+	"golang.org/x/sys/unix"
+)
+
+// efiImage returns a PE image without sections with the given optional
+// header magic, subsystem and machine.
+func efiImage(magic, subsystem, machine uint16) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 0x200)
+	copy(b, "MZ")
+	le.PutUint32(b[0x3c:], 0x40)
+	copy(b[0x40:], "PE\x00\x00")
+
+	coff := 0x44
+	le.PutUint16(b[coff:], machine)
+	le.PutUint16(b[coff+16:], 240)
+	le.PutUint16(b[coff+18:], 0x22)
+
+	opt := coff + 20
+	le.PutUint16(b[opt:], magic)
+	le.PutUint32(b[opt+32:], 0x1000)
+	le.PutUint32(b[opt+36:], 0x200)
+	le.PutUint32(b[opt+56:], 0x1000)
+	le.PutUint32(b[opt+60:], 0x200)
+	le.PutUint16(b[opt+68:], subsystem)
+	le.PutUint32(b[opt+108:], 16)
+	return b
+}
+
+func machine() uint16 {
+	if m, ok := imageMachine[runtime.GOARCH]; ok {
+		return m
+	}
+	return pe.IMAGE_FILE_MACHINE_AMD64
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "efiapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	other := uint16(pe.IMAGE_FILE_MACHINE_ARM64)
+	if machine() == other {
+		other = pe.IMAGE_FILE_MACHINE_AMD64
+	}
+	for _, tt := range []struct {
+		name  string
+		image []byte
+		ok    bool
+	}{
+		{"app", efiImage(0x20b, 10, machine()), true},
+		{"pe32", efiImage(0x10b, 10, machine()), false},
+		{"driver", efiImage(0x20b, 11, machine()), false},
+		{"console", efiImage(0x20b, 3, machine()), false},
+		{"other-machine", efiImage(0x20b, 10, other), false},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), false},
+	} {
+		path := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(path, tt.image, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := (&EFIApplication{Path: path}).Validate()
+		if tt.ok && err != nil {
+			t.Errorf("Validate(%s) = %v, want nil", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("Validate(%s) succeeded, want error", tt.name)
+		}
+	}
+	if err := (&EFIApplication{Path: filepath.Join(dir, "missing")}).Validate(); err == nil {
+		t.Errorf("Validate() of a missing file succeeded")
+	}
+}
+
+var espGUID = gpt.GUID{L: 0x11223344, W1: 0x5566, W2: 0x7788, B: [8]byte{0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00}}
+
+// fakeESP mounts, as far as efiapp can tell, partition 2 of disk vda at a
+// directory in dir, and returns it and how to undo that.
+func fakeESP(t *testing.T, dir string) (string, func()) {
+	esp := filepath.Join(dir, "EFI System")
+	var st unix.Stat_t
+	if err := os.Mkdir(esp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Stat(esp, &st); err != nil {
+		t.Fatal(err)
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+
+	// The ESP is mounted from /boot of its file system; the same device
+	// is also mounted elsewhere and another device is mounted below.
+	mounts := fmt.Sprintf(`22 1 0:1 / / rw - rootfs rootfs rw
+30 22 %[1]s /boot %[2]s rw,relatime - vfat /dev/vda2 rw
+31 22 %[1]s / /mnt rw,relatime - vfat /dev/vda2 rw
+32 30 9:9 / %[2]s/EFI/other rw - tmpfs tmpfs rw
+`, dev, strings.Replace(esp, " ", `\040`, -1))
+	if err := ioutil.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	part := filepath.Join(dir, "sys/devices/virtio0/block/vda/vda2")
+	if err := os.MkdirAll(part, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]string{"partition": "2\n", "start": "2048\n", "size": "1048576\n"} {
+		if err := ioutil.WriteFile(filepath.Join(part, name), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sys/dev/block"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../devices/virtio0/block/vda/vda2", filepath.Join(dir, "sys/dev/block", dev)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := os.Create(filepath.Join(dir, "dev/vda"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	header := gpt.Header{
+		Signature:  gpt.Signature,
+		Revision:   gpt.Revision,
+		HeaderSize: gpt.HeaderSize,
+		NPart:      4,
+		PartSize:   128,
+	}
+	primary, backup := &gpt.GPT{Header: header, Parts: make([]gpt.Part, 4)}, &gpt.GPT{Header: header, Parts: make([]gpt.Part, 4)}
+	primary.CurrentLBA, primary.BackupLBA, primary.PartStart = 1, 7, 2
+	backup.CurrentLBA, backup.BackupLBA, backup.PartStart = 7, 1, 6
+	for _, g := range []*gpt.GPT{primary, backup} {
+		g.Parts[1] = gpt.Part{UniqueGUID: espGUID, FirstLBA: 2048, LastLBA: 2048 + 1048576 - 1}
+	}
+	if err := gpt.Write(disk, &gpt.PartitionTable{MasterBootRecord: &gpt.MBR{}, Primary: primary, Backup: backup}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := []string{efivarsDir, mountInfo, sysDevBlock, devDir}
+	efivarsDir = filepath.Join(dir, "efivars")
+	mountInfo = filepath.Join(dir, "mountinfo")
+	sysDevBlock = filepath.Join(dir, "sys/dev/block")
+	devDir = filepath.Join(dir, "dev")
+	if err := os.Mkdir(efivarsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return esp, func() {
+		efivarsDir, mountInfo, sysDevBlock, devDir = saved[0], saved[1], saved[2], saved[3]
+	}
+}
+
+// utf16le spells the ASCII string s as UTF-16LE, without a NUL.
+func utf16le(s string) []byte {
+	var b []byte
+	for _, c := range []byte(s) {
+		b = append(b, c, 0)
+	}
+	return b
+}
+
+func TestExecute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "efiapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	esp, restore := fakeESP(t, dir)
+	defer restore()
+
+	app := filepath.Join(esp, "EFI/ubuntu/shimx64.efi")
+	if err := os.MkdirAll(filepath.Dir(app), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(app, efiImage(0x20b, 10, machine()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Boot0000, Boot0001 and Boot000A are taken; variables of other
+	// vendors and names are not boot entries.
+	for _, name := range []string{
+		"Boot0000-" + globalGUID,
+		"Boot0001-" + globalGUID,
+		"Boot000A-" + globalGUID,
+		"BootOrder-" + globalGUID,
+		"Boot0002-4a67b082-0a4c-41cf-b6c7-440b29bb8c4f",
+		"BootNext-" + globalGUID,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(efivarsDir, name), []byte("\x07\x00\x00\x00\x09\x00"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(r func(int) error) { reboot = r }(reboot)
+	var cmds []int
+	reboot = func(cmd int) error {
+		cmds = append(cmds, cmd)
+		if cmd == unix.LINUX_REBOOT_CMD_RESTART2 {
+			return unix.EINVAL
+		}
+		return nil
+	}
+
+	e := &EFIApplication{Path: app, Args: []string{`\grubx64.efi`, "quiet"}}
+	if err := e.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{unix.LINUX_REBOOT_CMD_RESTART2, unix.LINUX_REBOOT_CMD_RESTART}; !reflect.DeepEqual(cmds, want) {
+		t.Errorf("Execute() rebooted with %#x, want %#x", cmds, want)
+	}
+
+	next, err := ioutil.ReadFile(filepath.Join(efivarsDir, "BootNext-"+globalGUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{7, 0, 0, 0, 2, 0}; !bytes.Equal(next, want) {
+		t.Errorf("BootNext = %x, want %x", next, want)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(efivarsDir, "Boot0002-"+globalGUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := utf16le(`\boot\EFI\ubuntu\shimx64.efi` + "\x00")
+	var want []byte
+	want = append(want, 7, 0, 0, 0)
+	// Attributes and the length of the device path.
+	want = append(want, 1, 0, 0, 0, byte(42+4+len(file)+4), 0)
+	want = append(want, utf16le("u-root shimx64.efi\x00")...)
+	// The hard drive node.
+	want = append(want, 4, 1, 42, 0, 2, 0, 0, 0)
+	want = append(want, 0x00, 0x08, 0, 0, 0, 0, 0, 0)
+	want = append(want, 0, 0, 0x10, 0, 0, 0, 0, 0)
+	want = append(want, 0x44, 0x33, 0x22, 0x11, 0x66, 0x55, 0x88, 0x77, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00)
+	want = append(want, 2, 2)
+	// The file path node and the end.
+	want = append(want, 4, 4, byte(4+len(file)), 0)
+	want = append(want, file...)
+	want = append(want, 0x7f, 0xff, 4, 0)
+	want = append(want, utf16le(`\grubx64.efi quiet`+"\x00")...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Boot0002 =\n%x\nwant\n%x", got, want)
+	}
+
+	// Without arguments, the entry has no optional data.
+	if err := os.Remove(filepath.Join(efivarsDir, "Boot0002-"+globalGUID)); err != nil {
+		t.Fatal(err)
+	}
+	cmds = nil
+	if err := (&EFIApplication{Path: app}).Execute(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadFile(filepath.Join(efivarsDir, "Boot0002-"+globalGUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := want[:len(want)-len(utf16le(`\grubx64.efi quiet`+"\x00"))]; !bytes.Equal(got, w) {
+		t.Errorf("Boot0002 without arguments =\n%x\nwant\n%x", got, w)
+	}
+
+	// Reboot errors are returned, and so are files outside of partitions.
+	reboot = func(int) error { return unix.EPERM }
+	if err := (&EFIApplication{Path: app}).Execute(); err == nil {
+		t.Errorf("Execute() succeeded though reboot failed")
+	}
+	outside := filepath.Join(dir, "outside.efi")
+	if err := ioutil.WriteFile(outside, efiImage(0x20b, 10, machine()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reboot = func(int) error { t.Errorf("Execute() of file outside the ESP rebooted"); return nil }
+	if err := (&EFIApplication{Path: outside}).Execute(); err == nil {
+		t.Errorf("Execute() of file outside the ESP succeeded")
+	}
+	if err := (&EFIApplication{Path: filepath.Join(dir, "mountinfo")}).Execute(); err == nil {
+		t.Errorf("Execute() of a file that is not an EFI application succeeded")
+	}
+}
+
+func TestPack(t *testing.T) {
+	for _, e := range []*EFIApplication{
+		{Path: "/boot/efi/EFI/ubuntu/shimx64.efi", Args: []string{`\grubx64.efi`, "a b"}},
+		{Path: "/boot/efi/EFI/BOOT/BOOTX64.EFI"},
+	} {
+		a := cpio.InMemArchive()
+		if err := boot.NewPackage(e).Pack(a, nil); err != nil {
+			t.Fatal(err)
+		}
+		var p boot.Package
+		if err := p.Unpack(a.Reader(), nil); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := p.OSImage.(*EFIApplication)
+		if !ok {
+			t.Fatalf("Unpack() = %T, want *EFIApplication", p.OSImage)
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("Unpack(Pack(%v)) = %v", e, got)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+const (
+	// CurrentFormatVersion is the version of the boot package format that
+	// Package.Pack writes.
+	CurrentFormatVersion = 1
+
+	// MaxSupportedVersion is the newest version of the boot package format
+	// that can be read.
+	MaxSupportedVersion = 1
+)
+
+// formatVersionPath holds the format version of a boot package. Packages
+// from before there were versions have none, which is version 0.
+const formatVersionPath = "format_version"
+
+// ErrUnsupportedVersion is returned when a boot package is in a newer format
+// than can be read.
+type ErrUnsupportedVersion struct {
+	// Got is the format version of the package.
+	Got int
+	// Max is MaxSupportedVersion.
+	Max int
+}
+
+func (e *ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("boot package format version %d is newer than the supported %d", e.Got, e.Max)
+}
+
+// formatVersion returns the format version of the boot package a.
+func formatVersion(a *cpio.Archive) (int, error) {
+	rec, ok := a.Files[formatVersionPath]
+	if !ok {
+		return 0, nil
+	}
+	b, err := uio.ReadAll(rec)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("bad boot package format version %q", b)
+	}
+	return v, nil
+}
+
+// checkFormatVersion returns ErrUnsupportedVersion if the boot package a is
+// in a newer format than can be read.
+func checkFormatVersion(a *cpio.Archive) error {
+	v, err := formatVersion(a)
+	if err != nil {
+		return err
+	}
+	if v > MaxSupportedVersion {
+		return &ErrUnsupportedVersion{Got: v, Max: MaxSupportedVersion}
+	}
+	return nil
+}
+
+// OpenArchive reads the boot package in r, which may be compressed. It
+// returns ErrUnsupportedVersion rather than a package in a newer format than
+// can be read.
+func OpenArchive(r io.ReaderAt) (*cpio.Archive, error) {
+	r, err := cpio.AutoDecompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cpio.ReadArchive(cpio.Newc.Reader(r))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFormatVersion(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
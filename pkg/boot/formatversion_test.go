@@ -0,0 +1,100 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// packWithVersion packs li as a boot package with format version version,
+// or none if version is empty, and returns it as a newc archive.
+func packWithVersion(t *testing.T, li *LinuxImage, version string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := cpio.Newc.Writer(&b)
+	if version != "" {
+		if err := w.WriteRecord(cpio.StaticFile(formatVersionPath, version, 0700)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := li.Pack(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestOpenArchive(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "quiet")
+	for _, tt := range []struct {
+		name    string
+		version string
+		wantErr error
+	}{
+		{name: "version 0", version: ""},
+		{name: "version 1", version: "1"},
+		{name: "version 999", version: "999", wantErr: &ErrUnsupportedVersion{Got: 999, Max: MaxSupportedVersion}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := OpenArchive(bytes.NewReader(packWithVersion(t, li, tt.version)))
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("OpenArchive() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := NewLinuxImageFromArchive(a)
+			if err != nil {
+				t.Fatalf("NewLinuxImageFromArchive() = %v", err)
+			}
+			if !imageEqual(got, li) {
+				t.Errorf("NewLinuxImageFromArchive() = %v, want %v", got, li)
+			}
+		})
+	}
+}
+
+func TestOpenArchiveBadVersion(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	for _, v := range []string{"one", "-1"} {
+		if _, err := OpenArchive(bytes.NewReader(packWithVersion(t, li, v))); err == nil {
+			t.Errorf("OpenArchive() with version %q = nil, want error", v)
+		}
+	}
+}
+
+func TestPackageFormatVersion(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "quiet")
+	a := cpio.InMemArchive()
+	if err := NewPackage(li).Pack(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	v, err := formatVersion(a)
+	if err != nil || v != CurrentFormatVersion {
+		t.Errorf("format version of packed package = %d, %v, want %d", v, err, CurrentFormatVersion)
+	}
+
+	future := cpio.InMemArchive()
+	future.WriteRecord(cpio.StaticFile(formatVersionPath, "999", 0700))
+	for _, name := range a.Order {
+		if name != formatVersionPath {
+			future.WriteRecord(a.Files[name])
+		}
+	}
+	var p Package
+	if err := p.Unpack(future.Reader(), nil); !reflect.DeepEqual(err, &ErrUnsupportedVersion{Got: 999, Max: MaxSupportedVersion}) {
+		t.Errorf("Unpack() of version 999 = %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := NewLinuxImageFromArchive(future); err == nil {
+		t.Errorf("NewLinuxImageFromArchive() of version 999 = nil, want error")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fwcfg reads files QEMU passes to the guest with -fw_cfg, and boots
+// kernels from them.
+//
+// See docs/specs/fw_cfg.txt in QEMU. Linux shows the files in sysfs if it
+// has CONFIG_FW_CFG_SYSFS.
+package fwcfg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// Names of the files LinuxImageFromFWCfg reads, as in
+// -fw_cfg name=opt/u-root/kernel,file=bzImage.
+const (
+	KernelKey  = "opt/u-root/kernel"
+	InitrdKey  = "opt/u-root/initrd"
+	CmdlineKey = "opt/u-root/cmdline"
+)
+
+// byName is where sysfs shows fw_cfg files by name. Tests change it.
+var byName = "/sys/firmware/qemu_fw_cfg/by_name"
+
+// ReadFWCfg returns the contents of the fw_cfg file named key. If there is
+// none, the error satisfies os.IsNotExist.
+func ReadFWCfg(key string) ([]byte, error) {
+	if key == "" || path.Clean("/"+key) != "/"+key {
+		return nil, fmt.Errorf("invalid fw_cfg name %q", key)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(byName, filepath.FromSlash(key), "raw"))
+	if os.IsNotExist(err) {
+		if _, serr := os.Stat(byName); os.IsNotExist(serr) {
+			return nil, &os.PathError{Op: "read fw_cfg", Path: key, Err: fmt.Errorf("%s does not exist; is qemu_fw_cfg loaded?", byName)}
+		}
+	}
+	return b, err
+}
+
+// readOptional reads key, which may not exist.
+func readOptional(key string) ([]byte, error) {
+	b, err := ReadFWCfg(key)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// LinuxImageFromFWCfg returns a LinuxImage of the kernel in the fw_cfg file
+// opt/u-root/kernel, with the initrd and command line in opt/u-root/initrd
+// and opt/u-root/cmdline if there are such files.
+func LinuxImageFromFWCfg() (*boot.LinuxImage, error) {
+	kernel, err := ReadFWCfg(KernelKey)
+	if err != nil {
+		return nil, err
+	}
+	initrd, err := readOptional(InitrdKey)
+	if err != nil {
+		return nil, err
+	}
+	cmdline, err := readOptional(CmdlineKey)
+	if err != nil {
+		return nil, err
+	}
+
+	li := &boot.LinuxImage{
+		Kernel: bytes.NewReader(kernel),
+		// -fw_cfg string= does not add a newline, but files often end
+		// in one.
+		Cmdline: strings.TrimSpace(string(cmdline)),
+	}
+	if initrd != nil {
+		li.Initrd = bytes.NewReader(initrd)
+	}
+	return li, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fwcfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// fakeFWCfg creates fw_cfg files with their contents, as sysfs shows them,
+// and returns a function to remove them.
+func fakeFWCfg(t *testing.T, files map[string]string) func() {
+	dir, err := ioutil.TempDir("", "fwcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := byName
+	byName = filepath.Join(dir, "by_name")
+	if err := os.Mkdir(byName, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range files {
+		d := filepath.Join(byName, filepath.FromSlash(name))
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for f, c := range map[string]string{"raw": s, "name": name, "size": fmt.Sprint(len(s))} {
+			if err := ioutil.WriteFile(filepath.Join(d, f), []byte(c), 0444); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return func() {
+		byName = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReadFWCfg(t *testing.T) {
+	defer fakeFWCfg(t, map[string]string{"opt/org.example/config": "hello"})()
+
+	b, err := ReadFWCfg("opt/org.example/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("ReadFWCfg() = %q, want %q", b, "hello")
+	}
+	if _, err := ReadFWCfg("opt/org.example/missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadFWCfg() of a missing file = %v, want not exist", err)
+	}
+	for _, key := range []string{"", "/opt/x", "opt/../etc", "opt/x/"} {
+		if _, err := ReadFWCfg(key); err == nil || os.IsNotExist(err) {
+			t.Errorf("ReadFWCfg(%q) = %v, want invalid name", key, err)
+		}
+	}
+}
+
+func TestNoFWCfg(t *testing.T) {
+	defer fakeFWCfg(t, nil)()
+	os.Remove(byName)
+	if _, err := LinuxImageFromFWCfg(); err == nil {
+		t.Errorf("LinuxImageFromFWCfg() without fw_cfg succeeded")
+	}
+}
+
+func TestLinuxImageFromFWCfg(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		files   map[string]string
+		initrd  string
+		cmdline string
+		err     bool
+	}{
+		{
+			name:    "all",
+			files:   map[string]string{KernelKey: "kernel", InitrdKey: "initrd", CmdlineKey: "console=ttyS0\n"},
+			initrd:  "initrd",
+			cmdline: "console=ttyS0",
+		},
+		{
+			name:  "kernel only",
+			files: map[string]string{KernelKey: "kernel"},
+		},
+		{
+			name:  "no kernel",
+			files: map[string]string{InitrdKey: "initrd"},
+			err:   true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer fakeFWCfg(t, tt.files)()
+			li, err := LinuxImageFromFWCfg()
+			if tt.err {
+				if err == nil {
+					t.Errorf("LinuxImageFromFWCfg() = %v, want error", li)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			k, err := uio.ReadAll(li.Kernel)
+			if err != nil || string(k) != "kernel" {
+				t.Errorf("kernel = %q, %v, want %q", k, err, "kernel")
+			}
+			if li.Cmdline != tt.cmdline {
+				t.Errorf("Cmdline = %q, want %q", li.Cmdline, tt.cmdline)
+			}
+			if tt.initrd == "" {
+				if li.Initrd != nil {
+					t.Errorf("Initrd = %v, want none", li.Initrd)
+				}
+				return
+			}
+			i, err := uio.ReadAll(li.Initrd)
+			if err != nil || string(i) != tt.initrd {
+				t.Errorf("initrd = %q, %v, want %q", i, err, tt.initrd)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PreBootHook does something a deployment needs before booting li, like
+// decrypting a disk or writing the hostname. It may change li, such as its
+// Cmdline or Initrd.
+type PreBootHook func(li *LinuxImage) error
+
+// AddPreExecuteHook adds h to the hooks Execute calls, in the order they
+// were added, before it loads li.
+func (li *LinuxImage) AddPreExecuteHook(h PreBootHook) {
+	li.preExecuteHooks = append(li.preExecuteHooks, h)
+}
+
+// runPreExecuteHooks calls the hooks of li in order, stopping at the first
+// error.
+func (li *LinuxImage) runPreExecuteHooks() error {
+	for i, h := range li.preExecuteHooks {
+		if err := h(li); err != nil {
+			li.logf("prepare", "Pre-execute hook %d: %v", i, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// WithTimeout returns a hook that calls h, but fails if h does not return
+// within d.
+//
+// h is not stopped after d and keeps running in the background, so it
+// should not change li after it was given up on.
+func WithTimeout(h PreBootHook, d time.Duration) PreBootHook {
+	return func(li *LinuxImage) error {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- h(li)
+		}()
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return fmt.Errorf("pre-execute hook did not finish in %v: %v", d, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreExecuteHooks(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "quiet")
+	var ran []int
+	hook := func(i int, err error) PreBootHook {
+		return func(li *LinuxImage) error {
+			ran = append(ran, i)
+			li.Cmdline += " hook"
+			return err
+		}
+	}
+	errHook := errors.New("cannot unlock disk")
+	li.AddPreExecuteHook(hook(1, nil))
+	li.AddPreExecuteHook(hook(2, nil))
+	li.AddPreExecuteHook(hook(3, errHook))
+	li.AddPreExecuteHook(hook(4, nil))
+
+	// The failing hook stops Execute before it loads anything.
+	if err := li.Execute(); err != errHook {
+		t.Errorf("Execute() = %v, want %v", err, errHook)
+	}
+	if want := []int{1, 2, 3}; fmt.Sprint(ran) != fmt.Sprint(want) {
+		t.Errorf("ran hooks %v, want %v", ran, want)
+	}
+	if want := "quiet hook hook hook"; li.Cmdline != want {
+		t.Errorf("Cmdline = %q, want %q", li.Cmdline, want)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	errHook := errors.New("no NFS server")
+	for _, tt := range []struct {
+		name    string
+		hook    PreBootHook
+		wantErr bool
+	}{
+		{
+			name: "in time",
+			hook: func(*LinuxImage) error { return nil },
+		},
+		{
+			name:    "error in time",
+			hook:    func(*LinuxImage) error { return errHook },
+			wantErr: true,
+		},
+		{
+			name: "too slow",
+			hook: func(*LinuxImage) error {
+				time.Sleep(time.Second)
+				return nil
+			},
+			wantErr: true,
+		},
+	} {
+		start := time.Now()
+		err := WithTimeout(tt.hook, 50*time.Millisecond)(li)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: hook = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("%s: hook took %v, want at most the timeout", tt.name, d)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ima sets up the Linux Integrity Measurement Architecture before
+// kexec.
+//
+// IMA measures files as the kernel opens them, as its policy says, and logs
+// their digests in the securityfs. LoadPolicy replaces the policy, and
+// MeasureFile has a file measured and returns its digest from the log.
+package ima
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// securityfs is where the securityfs is mounted.
+var securityfs = "/sys/kernel/security"
+
+// ErrNotMeasured is returned by MeasureFile if IMA has not logged the file,
+// because its policy does not measure it.
+var ErrNotMeasured = errors.New("file not in the IMA measurement log")
+
+// imaFile returns the path of the IMA file name in the securityfs, or an
+// error if IMA is not there.
+func imaFile(name string) (string, error) {
+	dir := filepath.Join(securityfs, "ima")
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("IMA is not in the securityfs at %s; is it mounted? %v", securityfs, err)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// LoadPolicy writes the IMA policy in the file at policyPath to the kernel.
+//
+// Unless the kernel was built with CONFIG_IMA_WRITE_POLICY, the policy can
+// be loaded only once per boot.
+func LoadPolicy(policyPath string) error {
+	policy, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return err
+	}
+	path, err := imaFile("policy")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	// The kernel checks the whole policy when the file is closed.
+	if _, err := f.Write(policy); err != nil {
+		f.Close()
+		return fmt.Errorf("loading IMA policy %s: %v", policyPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("loading IMA policy %s: %v", policyPath, err)
+	}
+	return nil
+}
+
+// MeasureFile reads the file at path, so that IMA measures it if its policy
+// says to, and returns its SHA-256 digest from the IMA measurement log.
+//
+// The policy must measure the file with SHA-256, as the ima-ng and ima-sig
+// templates do with ima_hash=sha256.
+func MeasureFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(ioutil.Discard, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// IMA logs the path the file was opened at, without symlinks.
+	name, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := filepath.EvalSymlinks(name); err == nil {
+		name = n
+	}
+	log, err := imaFile("ascii_runtime_measurements")
+	if err != nil {
+		return nil, err
+	}
+	return findMeasurement(log, name)
+}
+
+// findMeasurement returns the digest of the last measurement of the file
+// name in the log at path.
+//
+// Each line of the log is
+//
+//	pcr template-hash template-name algorithm:file-hash file-name ...
+//
+// and templates like ima-sig may add more fields after the name.
+func findMeasurement(path, name string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var digest string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 5 && fields[4] == name {
+			digest = fields[3]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if digest == "" {
+		return nil, ErrNotMeasured
+	}
+	i := strings.Index(digest, ":")
+	if i < 0 || digest[:i] != "sha256" {
+		return nil, fmt.Errorf("%s was measured as %q, not with sha256", name, digest)
+	}
+	return hex.DecodeString(digest[i+1:])
+}
+
+// PolicyHook returns a pre-boot hook that loads the IMA policy at
+// policyPath and then measures the files at measure. Kernels built with
+// CONFIG_IMA_KEXEC pass the log on to the kernel they kexec.
+func PolicyHook(policyPath string, measure ...string) boot.PreBootHook {
+	return func(*boot.LinuxImage) error {
+		if err := LoadPolicy(policyPath); err != nil {
+			return err
+		}
+		for _, m := range measure {
+			if _, err := MeasureFile(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ima
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// fakeSecurityfs makes a securityfs with IMA in a temporary directory and
+// returns it and a function that undoes it.
+func fakeSecurityfs(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "securityfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ima"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"policy", "ascii_runtime_measurements"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "ima", f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := securityfs
+	securityfs = dir
+	return dir, func() {
+		securityfs = old
+		os.RemoveAll(dir)
+	}
+}
+
+const policy = "measure func=KEXEC_KERNEL_CHECK\nmeasure func=FILE_CHECK mask=MAY_READ uid=0\n"
+
+func TestLoadPolicy(t *testing.T) {
+	dir, cleanup := fakeSecurityfs(t)
+	defer cleanup()
+
+	p := filepath.Join(dir, "my-policy")
+	if err := ioutil.WriteFile(p, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "ima", "policy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != policy {
+		t.Errorf("loaded policy %q, want %q", got, policy)
+	}
+
+	if err := LoadPolicy(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("LoadPolicy() of missing file = nil, want error")
+	}
+	securityfs = filepath.Join(dir, "unmounted")
+	if err := LoadPolicy(p); err == nil || !strings.Contains(err.Error(), "mounted") {
+		t.Errorf("LoadPolicy() without securityfs = %v, want error about mounting", err)
+	}
+}
+
+func TestMeasureFile(t *testing.T) {
+	dir, cleanup := fakeSecurityfs(t)
+	defer cleanup()
+
+	kernel := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(kernel, []byte("vmlinuz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("kernel", link); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("vmlinuz"))
+	old := sha256.Sum256([]byte("old"))
+	measurements := fmt.Sprintf(
+		"10 %x ima-ng sha256:%x boot_aggregate\n"+
+			"10 %x ima-ng sha256:%x %s\n"+
+			"10 %x ima-sig sha256:%x %s 030204\n"+
+			"10 %x ima sha1:%x %s/sha1\n",
+		sum, old, sum, old, kernel, sum, sum, kernel, sum, sum[:20], dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ima", "ascii_runtime_measurements"), []byte(measurements), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last measurement counts, and symlinks are resolved.
+	for _, p := range []string{kernel, link} {
+		got, err := MeasureFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, sum[:]) {
+			t.Errorf("MeasureFile(%s) = %x, want %x", p, got, sum)
+		}
+	}
+
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MeasureFile(other); err != ErrNotMeasured {
+		t.Errorf("MeasureFile() of unmeasured file = %v, want %v", err, ErrNotMeasured)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sha1"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MeasureFile(filepath.Join(dir, "sha1")); err == nil {
+		t.Errorf("MeasureFile() of file measured with SHA-1 = nil, want error")
+	}
+	if _, err := MeasureFile(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("MeasureFile() of missing file = nil, want error")
+	}
+}
+
+func TestPolicyHook(t *testing.T) {
+	dir, cleanup := fakeSecurityfs(t)
+	defer cleanup()
+	p := filepath.Join(dir, "my-policy")
+	if err := ioutil.WriteFile(p, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	li := boot.NewLinuxImage(strings.NewReader("kernel"), nil, "")
+
+	if err := PolicyHook(p)(li); err != nil {
+		t.Errorf("PolicyHook() = %v, want nil", err)
+	}
+	// The hook fails if a file is not measured.
+	if err := PolicyHook(p, p)(li); err != ErrNotMeasured {
+		t.Errorf("PolicyHook() measuring %s = %v, want %v", p, err, ErrNotMeasured)
+	}
+}
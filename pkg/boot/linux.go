@@ -5,13 +5,21 @@
 package boot
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/u-root/u-root/pkg/boot/zboot"
+	"github.com/u-root/u-root/pkg/bzimage"
 	"github.com/u-root/u-root/pkg/cpio"
 	"github.com/u-root/u-root/pkg/kexec"
 	"github.com/u-root/u-root/pkg/uio"
@@ -25,13 +33,62 @@ type LinuxImage struct {
 	Kernel  io.ReaderAt
 	Initrd  io.ReaderAt
 	Cmdline string
+
+	// Placement, if set, decides where in physical memory the kernel and
+	// initrd go, and is reported by ExecutionInfo.
+	//
+	// Execute loads the kernel and initrd at the start of the segments
+	// named "kernel" and "initrd" with kexec_load(2), which only bzImages
+	// on amd64 support. If Placement returns neither, Execute leaves
+	// placement to the running kernel, as without Placement.
+	Placement func(kernel, initrd []byte) ([]kexec.Segment, error)
+
+	// overlays write archives to be appended to Initrd at Execute time.
+	overlays []func(io.Writer) error
+
+	// bootLog, if set, records what ExecutionInfo and Execute do.
+	bootLog *BootLog
+
+	// normalization, if set, is applied to the records Pack writes.
+	normalization *cpio.NormalizationOptions
+
+	// metadata, if set, is written by Pack.
+	metadata *ImageMetadata
+
+	// cmdlineSchema, if set, is checked by Validate and written by Pack.
+	cmdlineSchema *CmdlineSchema
+
+	// preExecuteHooks are called by Execute before it loads the image.
+	preExecuteHooks []PreBootHook
+
+	// phaseTimer, if set, times the phases of Execute.
+	phaseTimer *BootPhaseTimer
 }
 
 var _ OSImage = &LinuxImage{}
 
+// LinuxImageOption configures a LinuxImage.
+type LinuxImageOption func(*LinuxImage)
+
+// NewLinuxImage returns a LinuxImage configured by opts.
+func NewLinuxImage(kernel, initrd io.ReaderAt, cmdline string, opts ...LinuxImageOption) *LinuxImage {
+	li := &LinuxImage{
+		Kernel:  kernel,
+		Initrd:  initrd,
+		Cmdline: cmdline,
+	}
+	for _, opt := range opts {
+		opt(li)
+	}
+	return li
+}
+
 // NewLinuxImageFromArchive reads a netboot21 Linux OSImage from a CPIO file
-// archive.
+// archive, such as one from OpenArchive.
 func NewLinuxImageFromArchive(a *cpio.Archive) (*LinuxImage, error) {
+	if err := checkFormatVersion(a); err != nil {
+		return nil, err
+	}
 	kernel, ok := a.Files["modules/kernel/content"]
 	if !ok {
 		return nil, fmt.Errorf("kernel missing from archive")
@@ -51,12 +108,59 @@ func NewLinuxImageFromArchive(a *cpio.Archive) (*LinuxImage, error) {
 	if initrd, ok := a.Files["modules/initrd/content"]; ok {
 		li.Initrd = initrd
 	}
+	if err := li.unpackMetadata(a); err != nil {
+		return nil, err
+	}
+	if err := li.unpackCmdlineSchema(a); err != nil {
+		return nil, err
+	}
 	return li, nil
 }
 
+// LinuxImageFromFSPath returns a LinuxImage of the kernel and, unless
+// initrdPath is empty, the initrd at the given paths below root, where a file
+// system is mounted.
+func LinuxImageFromFSPath(root, kernelPath, initrdPath, cmdline string) (*LinuxImage, error) {
+	li := &LinuxImage{Cmdline: cmdline}
+	k, err := os.Open(filepath.Join(root, filepath.Clean("/"+kernelPath)))
+	if err != nil {
+		return nil, err
+	}
+	li.Kernel = k
+	if initrdPath != "" {
+		i, err := os.Open(filepath.Join(root, filepath.Clean("/"+initrdPath)))
+		if err != nil {
+			k.Close()
+			return nil, err
+		}
+		li.Initrd = i
+	}
+	return li, nil
+}
+
+// WithNormalization makes LinuxImage.Pack normalize the records it writes as
+// opts say, so that packages of the same image are identical wherever they
+// are built.
+func WithNormalization(opts cpio.NormalizationOptions) LinuxImageOption {
+	return func(li *LinuxImage) {
+		li.normalization = &opts
+	}
+}
+
 // Pack implements OSImage.Pack and writes all necessary files to the modules
 // directory of `sw`.
 func (li *LinuxImage) Pack(sw cpio.RecordWriter) error {
+	if li.normalization == nil {
+		return li.pack(sw)
+	}
+	nw := cpio.NewNormalizingWriter(sw, *li.normalization)
+	if err := li.pack(nw); err != nil {
+		return err
+	}
+	return nw.Flush()
+}
+
+func (li *LinuxImage) pack(sw cpio.RecordWriter) error {
 	if err := sw.WriteRecord(cpio.Directory("modules", 0700)); err != nil {
 		return err
 	}
@@ -89,6 +193,12 @@ func (li *LinuxImage) Pack(sw cpio.RecordWriter) error {
 			return err
 		}
 	}
+	if err := li.packMetadata(sw); err != nil {
+		return err
+	}
+	if err := li.packCmdlineSchema(sw); err != nil {
+		return err
+	}
 
 	return sw.WriteRecord(cpio.StaticFile("package_type", "linux", 0700))
 }
@@ -113,49 +223,574 @@ func copyToFile(r io.Reader) (*os.File, error) {
 	return readOnlyF, nil
 }
 
+// appendWriter appends to a DiskBackedBuffer.
+type appendWriter struct {
+	b *uio.DiskBackedBuffer
+}
+
+func (w appendWriter) Write(p []byte) (int, error) {
+	return w.b.WriteAt(p, w.b.Size())
+}
+
+// initrd returns li.Initrd followed by a cpio archive for each overlay. The
+// kernel unpacks concatenated archives in order, so files from overlays win.
+//
+// The returned close function releases the combined initrd.
+func (li *LinuxImage) initrd() (io.ReaderAt, func() error, error) {
+	if len(li.overlays) == 0 {
+		return li.Initrd, func() error { return nil }, nil
+	}
+
+	b := uio.NewDiskBackedBuffer(0)
+	w := appendWriter{b}
+	if li.Initrd != nil {
+		if _, err := io.Copy(w, uio.Reader(li.Initrd)); err != nil {
+			b.Close()
+			return nil, nil, err
+		}
+		// The kernel wants each archive to start 4-byte aligned.
+		if pad := (4 - b.Size()%4) % 4; pad > 0 {
+			if _, err := w.Write(make([]byte, pad)); err != nil {
+				b.Close()
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Each overlay gets its own archive, so that later overlays win, too.
+	for _, o := range li.overlays {
+		if err := o(w); err != nil {
+			b.Close()
+			return nil, nil, fmt.Errorf("initrd overlay: %v", err)
+		}
+	}
+	return b.Reader(), b.Close, nil
+}
+
+// countingWriter counts the bytes written to it and drops them.
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// initrdSize returns the size of the initrd that initrd returns, without
+// building it.
+func (li *LinuxImage) initrdSize() (int64, error) {
+	var size countingWriter
+	if li.Initrd != nil {
+		n, err := uio.Size(li.Initrd)
+		if err != nil {
+			return 0, err
+		}
+		size = countingWriter(n)
+		if len(li.overlays) > 0 {
+			size += (4 - size%4) % 4
+		}
+	}
+	for _, o := range li.overlays {
+		if err := o(&size); err != nil {
+			return 0, fmt.Errorf("initrd overlay: %v", err)
+		}
+	}
+	return int64(size), nil
+}
+
+// hasInitrd returns whether li boots with an initrd, which it does with
+// overlays even without Initrd.
+func (li *LinuxImage) hasInitrd() bool {
+	return li.Initrd != nil || len(li.overlays) > 0
+}
+
+// InitrdWithOverlays returns the initrd that Execute loads, which is Initrd
+// followed by an archive for each overlay, or nil if there is none. The
+// returned close function releases it.
+func (li *LinuxImage) InitrdWithOverlays() (io.ReaderAt, func() error, error) {
+	return li.initrd()
+}
+
 // ExecutionInfo implements OSImage.ExecutionInfo.
 func (li *LinuxImage) ExecutionInfo(l *log.Logger) {
-	k, err := copyToFile(uio.Reader(li.Kernel))
+	printf := func(format string, v ...interface{}) {
+		l.Printf(format, v...)
+		li.logf("info", format, v...)
+	}
+
+	kernel, err := kernelImage(li.Kernel)
+	if err != nil {
+		printf("Unpacking kernel: %v", err)
+		return
+	}
+	k, err := copyToFile(uio.Reader(kernel))
 	if err != nil {
-		l.Printf("Copying kernel to file: %v", err)
+		printf("Copying kernel to file: %v", err)
 	}
 	defer k.Close()
 
+	initrd, closeInitrd, err := li.initrd()
+	if err != nil {
+		printf("Building initrd: %v", err)
+		return
+	}
+	defer closeInitrd()
+
 	var i *os.File
-	if li.Initrd != nil {
-		i, err = copyToFile(uio.Reader(li.Initrd))
+	if initrd != nil {
+		i, err = copyToFile(uio.Reader(initrd))
 		if err != nil {
-			l.Printf("Copying initrd to file: %v", err)
+			printf("Copying initrd to file: %v", err)
 		}
 		defer i.Close()
 	}
 
-	l.Printf("Kernel: %s", k.Name())
+	printf("Kernel: %s", k.Name())
+	if v, err := bzimage.KernelVersion(kernel); err == nil {
+		printf("Kernel version: %s", v)
+	}
 	if i != nil {
-		l.Printf("Initrd: %s", i.Name())
+		printf("Initrd: %s", i.Name())
+	}
+	printf("Command line: %s", li.Cmdline)
+
+	if li.Placement == nil {
+		return
+	}
+	kb, err := uio.ReadAll(kernel)
+	if err != nil {
+		printf("Reading kernel: %v", err)
+		return
+	}
+	var ib []byte
+	if initrd != nil {
+		if ib, err = uio.ReadAll(initrd); err != nil {
+			printf("Reading initrd: %v", err)
+			return
+		}
+	}
+	segs, err := li.Placement(kb, ib)
+	if err != nil {
+		printf("Placing segments: %v", err)
+		return
+	}
+	for _, s := range segs {
+		printf("Segment: %v", s)
+	}
+}
+
+// executionInfo is what ExecutionInfoJSON writes.
+type executionInfo struct {
+	KernelTempPath string `json:"kernel_temp_path"`
+	InitrdTempPath string `json:"initrd_temp_path"`
+	Cmdline        string `json:"cmdline"`
+	KernelSize     int64  `json:"kernel_size_bytes"`
+	InitrdSize     int64  `json:"initrd_size_bytes"`
+
+	// ValidateResult is why li cannot boot, or nil.
+	ValidateResult *string `json:"validate_result"`
+}
+
+// ErrInitrdTooLarge is returned by LinuxImage.Validate if the initrd does not
+// fit in the available memory below the highest address the kernel takes it
+// from.
+type ErrInitrdTooLarge struct {
+	// MaxAddr is initrd_addr_max from the setup header of the kernel.
+	MaxAddr uint64
+	// AvailMem is the memory the initrd could go in.
+	AvailMem uint64
+	// InitrdSize is the size of the initrd.
+	InitrdSize uint64
+}
+
+func (e *ErrInitrdTooLarge) Error() string {
+	return fmt.Sprintf("initrd of %d bytes does not fit in the %d bytes of available memory below %#x", e.InitrdSize, e.AvailMem, e.MaxAddr)
+}
+
+// procMeminfo is read for the available memory.
+var procMeminfo = "/proc/meminfo"
+
+// availableMemory returns MemAvailable, or MemFree for kernels without it,
+// from procMeminfo.
+func availableMemory() (uint64, error) {
+	b, err := ioutil.ReadFile(procMeminfo)
+	if err != nil {
+		return 0, err
+	}
+	fields := make(map[string]uint64)
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(f) > 2 && f[2] == "kB" {
+			v *= 1024
+		}
+		fields[strings.TrimSuffix(f[0], ":")] = v
+	}
+	if v, ok := fields["MemAvailable"]; ok {
+		return v, nil
+	}
+	if v, ok := fields["MemFree"]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("%s has neither MemAvailable nor MemFree", procMeminfo)
+}
+
+// checkInitrdSize returns an ErrInitrdTooLarge if an initrd of size bytes
+// cannot fit below the initrd_addr_max of kernel.
+//
+// This is a heuristic: /proc/meminfo does not say where the available memory
+// is, so it is taken to be below initrd_addr_max, up to that address. A
+// kernel that is not a bzImage, or a missing /proc/meminfo, passes.
+func checkInitrdSize(kernel io.ReaderAt, size uint64) error {
+	if size == 0 {
+		return nil
+	}
+	max, err := bzimage.InitrdAddrMax(kernel)
+	if err != nil {
+		return nil
+	}
+	avail, err := availableMemory()
+	if err != nil {
+		return nil
+	}
+	if limit := uint64(max) + 1; avail > limit {
+		avail = limit
+	}
+	if size > avail {
+		return &ErrInitrdTooLarge{MaxAddr: uint64(max), AvailMem: avail, InitrdSize: size}
+	}
+	return nil
+}
+
+// Validate returns why li cannot boot, as far as can be told without loading
+// it.
+func (li *LinuxImage) Validate() error {
+	if li.Kernel == nil {
+		return ErrKernelMissing
+	}
+	if li.cmdlineSchema != nil {
+		if err := li.cmdlineSchema.Validate(li.Cmdline); err != nil {
+			return err
+		}
+	}
+	size, err := li.initrdSize()
+	if err != nil {
+		return fmt.Errorf("building initrd: %v", err)
+	}
+	// Only Placement needs the initrd itself.
+	var initrd io.ReaderAt
+	if li.Placement != nil {
+		var closeInitrd func() error
+		if initrd, closeInitrd, err = li.initrd(); err != nil {
+			return fmt.Errorf("building initrd: %v", err)
+		}
+		defer closeInitrd()
+	}
+	return li.validate(li.Kernel, size, initrd)
+}
+
+// kernelImage returns the Image in kernel if it is a zboot image, which
+// kexec_file_load(2) does not take, and kernel itself otherwise.
+func kernelImage(kernel io.ReaderAt) (io.ReaderAt, error) {
+	if !zboot.IsZBoot(kernel) {
+		return kernel, nil
+	}
+	return zboot.DecompressZBoot(kernel)
+}
+
+// validate returns why the kernel and an initrd of initrdSize bytes of li
+// cannot boot, as far as can be told without loading them. initrd is only
+// read for Placement, and may be nil without it.
+func (li *LinuxImage) validate(kernel io.ReaderAt, initrdSize int64, initrd io.ReaderAt) error {
+	kernel, err := kernelImage(kernel)
+	if err != nil {
+		return err
+	}
+	size, err := uio.Size(kernel)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("kernel is empty")
+	}
+	if err := checkInitrdSize(kernel, uint64(initrdSize)); err != nil {
+		return err
+	}
+	if li.Placement == nil {
+		return nil
+	}
+	kb, err := uio.ReadAll(kernel)
+	if err != nil {
+		return err
+	}
+	var ib []byte
+	if initrd != nil {
+		if ib, err = uio.ReadAll(initrd); err != nil {
+			return err
+		}
+	}
+	if _, err := li.Placement(kb, ib); err != nil {
+		return fmt.Errorf("placing segments: %v", err)
+	}
+	return nil
+}
+
+// ExecutionInfoJSON is ExecutionInfo for machines: it writes a JSON object
+// with the temporary files that Execute would load, their sizes, the command
+// line and, in validate_result, null or why the image cannot boot.
+//
+// An error is returned only if the files cannot be prepared or w fails.
+func (li *LinuxImage) ExecutionInfoJSON(w io.Writer) error {
+	info := executionInfo{Cmdline: li.Cmdline}
+	var verr error
+	if li.Kernel == nil {
+		verr = ErrKernelMissing
+	} else {
+		kernel, err := kernelImage(li.Kernel)
+		if err != nil {
+			return fmt.Errorf("unpacking kernel: %v", err)
+		}
+		k, err := copyToFile(uio.Reader(kernel))
+		if err != nil {
+			return fmt.Errorf("copying kernel to file: %v", err)
+		}
+		defer k.Close()
+		fi, err := k.Stat()
+		if err != nil {
+			return err
+		}
+		info.KernelTempPath, info.KernelSize = k.Name(), fi.Size()
+
+		initrd, closeInitrd, err := li.initrd()
+		if err != nil {
+			return fmt.Errorf("building initrd: %v", err)
+		}
+		defer closeInitrd()
+
+		if initrd != nil {
+			i, err := copyToFile(uio.Reader(initrd))
+			if err != nil {
+				return fmt.Errorf("copying initrd to file: %v", err)
+			}
+			defer i.Close()
+			fi, err := i.Stat()
+			if err != nil {
+				return err
+			}
+			info.InitrdTempPath, info.InitrdSize = i.Name(), fi.Size()
+		}
+		verr = li.validate(k, info.InitrdSize, initrd)
+	}
+	if verr != nil {
+		s := verr.Error()
+		info.ValidateResult = &s
+	}
+	return json.NewEncoder(w).Encode(info)
+}
+
+// inspectSegments is kexec.InspectSegments, replaced in tests.
+var inspectSegments = kexec.InspectSegments
+
+// dryRunSegment is a segment as DryRun prints it.
+type dryRunSegment struct {
+	PhysAddr uint64 `json:"phys_addr"`
+	Size     uint64 `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// dryRun is what DryRun prints.
+type dryRun struct {
+	KernelTempPath string          `json:"kernel_temp_path"`
+	InitrdTempPath string          `json:"initrd_temp_path"`
+	Cmdline        string          `json:"cmdline"`
+	Segments       []dryRunSegment `json:"segments"`
+}
+
+// DryRun prepares li as Execute does, copying the kernel and initrd to
+// temporary files, and writes the physical memory segments that kexec would
+// load as JSON to w instead of loading them. Each segment has its address,
+// its size in memory and the SHA-256 digest of its content.
+func (li *LinuxImage) DryRun(w io.Writer) error {
+	if li.Kernel == nil {
+		return ErrKernelMissing
+	}
+	kernel, err := kernelImage(li.Kernel)
+	if err != nil {
+		li.logf("prepare", "Unpacking kernel: %v", err)
+		return err
+	}
+	k, err := copyToFile(uio.Reader(kernel))
+	if err != nil {
+		li.logf("prepare", "Copying kernel to file: %v", err)
+		return err
+	}
+	defer k.Close()
+	li.logf("prepare", "Kernel: %s", k.Name())
+	out := dryRun{KernelTempPath: k.Name(), Cmdline: li.Cmdline}
+
+	initrd, closeInitrd, err := li.initrd()
+	if err != nil {
+		li.logf("prepare", "Building initrd: %v", err)
+		return err
+	}
+	defer closeInitrd()
+
+	var i *os.File
+	if initrd != nil {
+		i, err = copyToFile(uio.Reader(initrd))
+		if err != nil {
+			li.logf("prepare", "Copying initrd to file: %v", err)
+			return err
+		}
+		defer i.Close()
+		li.logf("prepare", "Initrd: %s", i.Name())
+		out.InitrdTempPath = i.Name()
+	}
+
+	segs, err := inspectSegments(k, i, li.Cmdline)
+	if err != nil {
+		li.logf("load", "Inspecting segments failed: %v", err)
+		return err
+	}
+	out.Segments = make([]dryRunSegment, 0, len(segs))
+	for _, s := range segs {
+		li.logf("load", "Segment: %v", s)
+		sum := sha256.Sum256(s.Buf)
+		out.Segments = append(out.Segments, dryRunSegment{
+			PhysAddr: uint64(s.Phys.Start),
+			Size:     uint64(s.Phys.Size),
+			SHA256:   hex.EncodeToString(sum[:]),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// loadBzImageAt is kexec.LoadBzImageAt, replaced in tests.
+var loadBzImageAt = kexec.LoadBzImageAt
+
+// place returns where Placement puts the kernel and initrd files Execute
+// loads, or 0 where it leaves that to kexec.
+func (li *LinuxImage) place(kernel, initrd *os.File) (uintptr, uintptr, error) {
+	if li.Placement == nil {
+		return 0, 0, nil
+	}
+	kb, err := uio.ReadAll(kernel)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ib []byte
+	if initrd != nil {
+		if ib, err = uio.ReadAll(initrd); err != nil {
+			return 0, 0, err
+		}
 	}
-	l.Printf("Command line: %s", li.Cmdline)
+	segs, err := li.Placement(kb, ib)
+	if err != nil {
+		return 0, 0, err
+	}
+	var kernelAddr, initrdAddr uintptr
+	for _, s := range segs {
+		switch s.Name {
+		case "kernel":
+			kernelAddr = s.Phys.Start
+		case "initrd":
+			initrdAddr = s.Phys.Start
+		}
+	}
+	return kernelAddr, initrdAddr, nil
 }
 
 // Execute implements OSImage.Execute and kexec's the kernel with its initramfs.
 func (li *LinuxImage) Execute() error {
-	k, err := copyToFile(uio.Reader(li.Kernel))
-	if err != nil {
+	if err := li.timePhase("validate", func() error {
+		if err := li.runPreExecuteHooks(); err != nil {
+			return err
+		}
+		if li.Kernel == nil {
+			li.logf("prepare", "No kernel")
+			return ErrKernelMissing
+		}
+		if li.cmdlineSchema != nil {
+			if err := li.cmdlineSchema.Validate(li.Cmdline); err != nil {
+				li.logf("prepare", "Bad command line: %v", err)
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var k *os.File
+	if err := li.timePhase("copy-kernel", func() error {
+		kernel, err := kernelImage(li.Kernel)
+		if err != nil {
+			li.logf("prepare", "Unpacking kernel: %v", err)
+			return err
+		}
+		if k, err = copyToFile(uio.Reader(kernel)); err != nil {
+			li.logf("prepare", "Copying kernel to file: %v", err)
+			return err
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
 	defer k.Close()
+	li.logf("prepare", "Kernel: %s", k.Name())
 
 	var i *os.File
-	if li.Initrd != nil {
-		i, err = copyToFile(uio.Reader(li.Initrd))
+	if err := li.timePhase("copy-initrd", func() error {
+		initrd, closeInitrd, err := li.initrd()
 		if err != nil {
+			li.logf("prepare", "Building initrd: %v", err)
+			return err
+		}
+		// The initrd is loaded from its copy.
+		defer closeInitrd()
+		if initrd == nil {
+			return nil
+		}
+		if i, err = copyToFile(uio.Reader(initrd)); err != nil {
+			li.logf("prepare", "Copying initrd to file: %v", err)
 			return err
 		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if i != nil {
 		defer i.Close()
+		li.logf("prepare", "Initrd: %s", i.Name())
 	}
 
-	if err := kexec.FileLoad(k, i, li.Cmdline); err != nil {
+	li.logf("load", "Loading with command line: %s", li.Cmdline)
+	if err := li.timePhase("kexec-load", func() error {
+		kernelAddr, initrdAddr, err := li.place(k, i)
+		if err != nil {
+			li.logf("load", "Placing segments: %v", err)
+			return err
+		}
+		if kernelAddr == 0 && initrdAddr == 0 {
+			return kexec.FileLoad(k, i, li.Cmdline)
+		}
+		li.logf("load", "Placing kernel at %#x and initrd at %#x", kernelAddr, initrdAddr)
+		return loadBzImageAt(k, i, li.Cmdline, kernelAddr, initrdAddr)
+	}); err != nil {
+		li.logf("load", "Loading failed: %v", err)
+		return err
+	}
+	li.logf("reboot", "Rebooting into the new kernel")
+	if err := li.timePhase("kexec-reboot", kexec.Reboot); err != nil {
+		li.logf("reboot", "Rebooting failed: %v", err)
 		return err
 	}
-	return kexec.Reboot()
+	return nil
 }
@@ -5,11 +5,21 @@
 package boot
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/kexec"
 )
 
 func imageEqual(li1, li2 *LinuxImage) bool {
@@ -97,3 +107,489 @@ func TestLinuxImage(t *testing.T) {
 		}
 	}
 }
+
+func TestLinuxImageFromFSPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "boot"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]string{"boot/vmlinuz": "kernel", "boot/initrd.img": "initrd"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	li, err := LinuxImageFromFSPath(root, "/boot/vmlinuz", "boot/initrd.img", "console=ttyS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LinuxImage{Kernel: strings.NewReader("kernel"), Initrd: strings.NewReader("initrd"), Cmdline: "console=ttyS0"}
+	if !imageEqual(li, want) || !cpio.ReaderAtEqual(li.Initrd, want.Initrd) {
+		t.Errorf("LinuxImageFromFSPath() = %v, want %v", li, want)
+	}
+
+	// Paths may not leave root.
+	if li, err := LinuxImageFromFSPath(filepath.Join(root, "boot"), "../boot/vmlinuz", "", ""); err == nil {
+		t.Errorf("LinuxImageFromFSPath() = %v, want error", li)
+	}
+	if li, err := LinuxImageFromFSPath(root, "boot/vmlinuz", "boot/missing", ""); err == nil {
+		t.Errorf("LinuxImageFromFSPath() = %v, want error", li)
+	}
+}
+
+func TestExecutionInfoJSON(t *testing.T) {
+	errPlace := errors.New("no room")
+	for _, tt := range []struct {
+		name     string
+		li       *LinuxImage
+		kernel   string
+		initrd   string
+		validate string
+	}{
+		{
+			name:   "kernel and initrd",
+			li:     NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd!"), "console=ttyS0"),
+			kernel: "kernel",
+			initrd: "initrd!",
+		},
+		{
+			name:   "no initrd",
+			li:     NewLinuxImage(strings.NewReader("kernel"), nil, ""),
+			kernel: "kernel",
+		},
+		{
+			name:     "no kernel",
+			li:       NewLinuxImage(nil, nil, "quiet"),
+			validate: ErrKernelMissing.Error(),
+		},
+		{
+			name:     "empty kernel",
+			li:       NewLinuxImage(strings.NewReader(""), nil, ""),
+			validate: "kernel is empty",
+		},
+		{
+			name: "placement fails",
+			li: NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "", func(li *LinuxImage) {
+				li.Placement = func(kernel, initrd []byte) ([]kexec.Segment, error) {
+					if string(kernel) != "kernel" || string(initrd) != "initrd" {
+						t.Errorf("Placement(%q, %q), want (kernel, initrd)", kernel, initrd)
+					}
+					return nil, errPlace
+				}
+			}),
+			kernel:   "kernel",
+			initrd:   "initrd",
+			validate: "placing segments: no room",
+		},
+		{
+			name: "zboot kernel",
+			li: NewLinuxImage(bytes.NewReader(zbootKernel(t, "gzip", []byte("arm64 Image"))), nil, "", func(li *LinuxImage) {
+				li.Placement = func(kernel, initrd []byte) ([]kexec.Segment, error) {
+					if string(kernel) != "arm64 Image" {
+						t.Errorf("Placement got kernel %q, want the decompressed Image", kernel)
+					}
+					return nil, nil
+				}
+			}),
+			kernel: "arm64 Image",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tt.li.ExecutionInfoJSON(&b); err != nil {
+				t.Fatalf("ExecutionInfoJSON() = %v", err)
+			}
+			var got struct {
+				KernelTempPath *string `json:"kernel_temp_path"`
+				InitrdTempPath *string `json:"initrd_temp_path"`
+				Cmdline        *string `json:"cmdline"`
+				KernelSize     *int64  `json:"kernel_size_bytes"`
+				InitrdSize     *int64  `json:"initrd_size_bytes"`
+				ValidateResult *string `json:"validate_result"`
+			}
+			if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+				t.Fatalf("ExecutionInfoJSON() wrote %q: %v", b.String(), err)
+			}
+			if got.KernelTempPath == nil || got.InitrdTempPath == nil || got.Cmdline == nil || got.KernelSize == nil || got.InitrdSize == nil {
+				t.Fatalf("ExecutionInfoJSON() wrote %q, want all keys", b.String())
+			}
+
+			for _, f := range []struct {
+				name, path, want string
+				size             int64
+			}{
+				{"kernel", *got.KernelTempPath, tt.kernel, *got.KernelSize},
+				{"initrd", *got.InitrdTempPath, tt.initrd, *got.InitrdSize},
+			} {
+				if f.size != int64(len(f.want)) {
+					t.Errorf("%s size = %d, want %d", f.name, f.size, len(f.want))
+				}
+				if f.path == "" {
+					if f.want != "" {
+						t.Errorf("%s has no temp path", f.name)
+					}
+					continue
+				}
+				b, err := ioutil.ReadFile(f.path)
+				os.Remove(f.path)
+				if err != nil || string(b) != f.want {
+					t.Errorf("%s temp file = %q, %v; want %q", f.name, b, err, f.want)
+				}
+			}
+			if *got.Cmdline != tt.li.Cmdline {
+				t.Errorf("cmdline = %q, want %q", *got.Cmdline, tt.li.Cmdline)
+			}
+			switch {
+			case tt.validate == "" && got.ValidateResult != nil:
+				t.Errorf("validate_result = %q, want null", *got.ValidateResult)
+			case tt.validate != "" && (got.ValidateResult == nil || *got.ValidateResult != tt.validate):
+				t.Errorf("validate_result = %v, want %q", got.ValidateResult, tt.validate)
+			}
+		})
+	}
+
+	li := NewLinuxImage(&errorReaderAt{err: errSkip}, nil, "")
+	if err := li.ExecutionInfoJSON(ioutil.Discard); err == nil {
+		t.Errorf("ExecutionInfoJSON() of unreadable kernel = nil, want error")
+	}
+}
+
+func TestLinuxImagePackNormalized(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "quiet",
+		WithNormalization(cpio.NormalizationOptions{ZeroTimestamps: true, ZeroOwnership: true, SortByName: true}))
+	var b bytes.Buffer
+	if err := li.Pack(cpio.Newc.Writer(&b)); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := cpio.ReadAllRecords(cpio.Newc.Reader(bytes.NewReader(b.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rec := range recs {
+		names = append(names, rec.Name)
+	}
+	want := []string{
+		"modules",
+		"modules/initrd",
+		"modules/initrd/content",
+		"modules/kernel",
+		"modules/kernel/content",
+		"modules/kernel/params",
+		"package_type",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("Pack() wrote %v, want %v", names, want)
+	}
+
+	got, err := NewLinuxImageFromArchive(cpio.ArchiveFromRecords(recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imageEqual(got, li) {
+		t.Errorf("Pack() = %v, want %v", got, li)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	old := inspectSegments
+	defer func() { inspectSegments = old }()
+	var gotKernel, gotInitrd, gotCmdline string
+	inspectSegments = func(kernel, initrd *os.File, cmdline string) ([]kexec.Segment, error) {
+		k, err := ioutil.ReadAll(kernel)
+		if err != nil {
+			return nil, err
+		}
+		gotKernel, gotCmdline = string(k), cmdline
+		if initrd != nil {
+			i, err := ioutil.ReadAll(initrd)
+			if err != nil {
+				return nil, err
+			}
+			gotInitrd = string(i)
+		}
+		return []kexec.Segment{
+			{Buf: []byte("kernel"), Phys: kexec.Range{Start: 0x1000000, Size: 0x400000}},
+			{Buf: []byte("initrd"), Phys: kexec.Range{Start: 0x7ffdf000, Size: 6}},
+		}, nil
+	}
+
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "console=ttyS0")
+	var b bytes.Buffer
+	if err := li.DryRun(&b); err != nil {
+		t.Fatalf("DryRun() = %v", err)
+	}
+	if gotKernel != "kernel" || gotInitrd != "initrd" || gotCmdline != "console=ttyS0" {
+		t.Errorf("InspectSegments(%q, %q, %q), want (kernel, initrd, console=ttyS0)", gotKernel, gotInitrd, gotCmdline)
+	}
+
+	var got dryRun
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("DryRun() wrote %q: %v", b.String(), err)
+	}
+	os.Remove(got.KernelTempPath)
+	os.Remove(got.InitrdTempPath)
+	if got.KernelTempPath == "" || got.InitrdTempPath == "" || got.Cmdline != "console=ttyS0" {
+		t.Errorf("DryRun() = %+v, want temp paths and the command line", got)
+	}
+	want := []dryRunSegment{
+		// sha256sum of "kernel" and of "initrd".
+		{PhysAddr: 0x1000000, Size: 0x400000, SHA256: "6923dd1bc0460082c5d55a831908c24a282860b7f1cd6c2b79cf1bc8857c639c"},
+		{PhysAddr: 0x7ffdf000, Size: 6, SHA256: "09e6c018d2c8c4903308613dd1b72484d57eadf12ec50ddc8f52e5accce470f2"},
+	}
+	if len(got.Segments) != len(want) {
+		t.Fatalf("DryRun() segments = %+v, want %+v", got.Segments, want)
+	}
+	for i := range want {
+		if got.Segments[i] != want[i] {
+			t.Errorf("DryRun() segment %d = %+v, want %+v", i, got.Segments[i], want[i])
+		}
+	}
+
+	inspectSegments = func(kernel, initrd *os.File, cmdline string) ([]kexec.Segment, error) {
+		return nil, errSkip
+	}
+	if err := li.DryRun(ioutil.Discard); err != errSkip {
+		t.Errorf("DryRun() = %v, want %v", err, errSkip)
+	}
+	if err := NewLinuxImage(nil, nil, "").DryRun(ioutil.Discard); err != ErrKernelMissing {
+		t.Errorf("DryRun() without kernel = %v, want %v", err, ErrKernelMissing)
+	}
+}
+
+// setupHeader returns the start of a bzImage with the given initrd_addr_max.
+func setupHeader(initrdAddrMax uint32) []byte {
+	b := make([]byte, 0x1000)
+	copy(b[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(b[0x206:], 0x20d)
+	binary.LittleEndian.PutUint32(b[0x22c:], initrdAddrMax)
+	return b
+}
+
+func TestValidateInitrdSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := procMeminfo
+	defer func() { procMeminfo = old }()
+	procMeminfo = filepath.Join(dir, "meminfo")
+
+	for _, tt := range []struct {
+		name    string
+		kernel  []byte
+		initrd  int
+		meminfo string
+		want    error
+	}{
+		{
+			name:    "fits",
+			kernel:  setupHeader(0x7fffffff),
+			initrd:  4096,
+			meminfo: "MemTotal:       16 kB\nMemFree:        4 kB\nMemAvailable:   8 kB\n",
+		},
+		{
+			name:    "too large for available memory",
+			kernel:  setupHeader(0x7fffffff),
+			initrd:  8193,
+			meminfo: "MemTotal:       16 kB\nMemFree:        4 kB\nMemAvailable:   8 kB\n",
+			want:    &ErrInitrdTooLarge{MaxAddr: 0x7fffffff, AvailMem: 8192, InitrdSize: 8193},
+		},
+		{
+			name:    "too large for initrd_addr_max",
+			kernel:  setupHeader(0xfff),
+			initrd:  4097,
+			meminfo: "MemAvailable:   1048576 kB\n",
+			want:    &ErrInitrdTooLarge{MaxAddr: 0xfff, AvailMem: 4096, InitrdSize: 4097},
+		},
+		{
+			name:    "no MemAvailable",
+			kernel:  setupHeader(0x7fffffff),
+			initrd:  4097,
+			meminfo: "MemTotal:       16 kB\nMemFree:        4 kB\n",
+			want:    &ErrInitrdTooLarge{MaxAddr: 0x7fffffff, AvailMem: 4096, InitrdSize: 4097},
+		},
+		{
+			name:    "not a bzImage",
+			kernel:  []byte("kernel"),
+			initrd:  8193,
+			meminfo: "MemAvailable:   8 kB\n",
+		},
+		{
+			name:    "no initrd",
+			kernel:  setupHeader(0x7fffffff),
+			meminfo: "MemAvailable:   0 kB\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(procMeminfo, []byte(tt.meminfo), 0644); err != nil {
+				t.Fatal(err)
+			}
+			li := NewLinuxImage(bytes.NewReader(tt.kernel), bytes.NewReader(make([]byte, tt.initrd)), "")
+			err := li.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Without /proc/meminfo, there is nothing to check against.
+	os.Remove(procMeminfo)
+	li := NewLinuxImage(bytes.NewReader(setupHeader(0xfff)), bytes.NewReader(make([]byte, 8192)), "")
+	if err := li.Validate(); err != nil {
+		t.Errorf("Validate() without meminfo = %v, want nil", err)
+	}
+}
+
+// unreadable is an initrd of a known size that fails to be read.
+type unreadable int64
+
+func (u unreadable) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("initrd read")
+}
+
+func (u unreadable) Size() int64 {
+	return int64(u)
+}
+
+func TestValidateInitrdSizeWithoutReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := procMeminfo
+	defer func() { procMeminfo = old }()
+	procMeminfo = filepath.Join(dir, "meminfo")
+	if err := ioutil.WriteFile(procMeminfo, []byte("MemAvailable:   8 kB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	li := NewLinuxImage(bytes.NewReader(setupHeader(0x7fffffff)), unreadable(8193), "")
+	want := &ErrInitrdTooLarge{MaxAddr: 0x7fffffff, AvailMem: 8192, InitrdSize: 8193}
+	if err := li.Validate(); !reflect.DeepEqual(err, want) {
+		t.Errorf("Validate() = %v, want %v", err, want)
+	}
+	li.Initrd = unreadable(8192)
+	if err := li.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}
+
+// zbootKernel returns a zboot image of image compressed with comp.
+func zbootKernel(t *testing.T, comp string, image []byte) []byte {
+	var payload bytes.Buffer
+	w := gzip.NewWriter(&payload)
+	if _, err := w.Write(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 0x40)
+	copy(b, "MZ")
+	copy(b[4:], "zimg")
+	binary.LittleEndian.PutUint32(b[0x08:], 0x40)
+	binary.LittleEndian.PutUint32(b[0x0c:], uint32(payload.Len()))
+	copy(b[0x18:], comp)
+	return append(b, payload.Bytes()...)
+}
+
+func TestValidateZBoot(t *testing.T) {
+	var placed []byte
+	li := NewLinuxImage(bytes.NewReader(zbootKernel(t, "gzip", []byte("arm64 Image"))), nil, "")
+	li.Placement = func(kernel, initrd []byte) ([]kexec.Segment, error) {
+		placed = kernel
+		return nil, nil
+	}
+	if err := li.Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil", err)
+	}
+	if string(placed) != "arm64 Image" {
+		t.Errorf("Placement got kernel %q, want the decompressed Image", placed)
+	}
+
+	for _, comp := range []string{"zstd", "lz4"} {
+		li := NewLinuxImage(bytes.NewReader(zbootKernel(t, comp, []byte("arm64 Image"))), nil, "")
+		if err := li.Validate(); err == nil {
+			t.Errorf("Validate() of a gzip payload labelled %s = nil, want error", comp)
+		}
+	}
+}
+
+func TestExecutionInfoZBoot(t *testing.T) {
+	var placed []byte
+	li := NewLinuxImage(bytes.NewReader(zbootKernel(t, "gzip", []byte("arm64 Image"))), nil, "")
+	li.Placement = func(kernel, initrd []byte) ([]kexec.Segment, error) {
+		placed = kernel
+		return []kexec.Segment{{Buf: kernel, Phys: kexec.Range{Start: 0x80000, Size: uint(len(kernel))}, Name: "kernel"}}, nil
+	}
+	var out bytes.Buffer
+	li.ExecutionInfo(log.New(&out, "", 0))
+	if string(placed) != "arm64 Image" {
+		t.Errorf("Placement got kernel %q, want the decompressed Image", placed)
+	}
+	if want := "Segment: 11 bytes at [0x80000, 0x8000b)"; !strings.Contains(out.String(), want) {
+		t.Errorf("ExecutionInfo() = %q, want it to contain %q", out.String(), want)
+	}
+
+	li = NewLinuxImage(bytes.NewReader(zbootKernel(t, "zstd", []byte("arm64 Image"))), nil, "")
+	out.Reset()
+	li.ExecutionInfo(log.New(&out, "", 0))
+	if !strings.Contains(out.String(), "Unpacking kernel") {
+		t.Errorf("ExecutionInfo() of a bad zboot image = %q, want it to fail unpacking", out.String())
+	}
+}
+
+func TestExecutePlacement(t *testing.T) {
+	old := loadBzImageAt
+	defer func() { loadBzImageAt = old }()
+	errLoaded := errors.New("loaded")
+	var kernelAddr, initrdAddr uintptr
+	var kernel, initrd []byte
+	loadBzImageAt = func(k, i *os.File, cmdline string, ka, ia uintptr) error {
+		kernelAddr, initrdAddr = ka, ia
+		kernel, _ = ioutil.ReadAll(k)
+		initrd, _ = ioutil.ReadAll(i)
+		return errLoaded
+	}
+
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "")
+	li.Placement = func(k, i []byte) ([]kexec.Segment, error) {
+		if string(k) != "kernel" || string(i) != "initrd" {
+			t.Errorf("Placement(%q, %q), want (kernel, initrd)", k, i)
+		}
+		return []kexec.Segment{
+			{Phys: kexec.Range{Start: 0x2000000, Size: 6}, Name: "kernel"},
+			{Phys: kexec.Range{Start: 0x3000000, Size: 6}, Name: "initrd"},
+		}, nil
+	}
+	if err := li.Execute(); err != errLoaded {
+		t.Fatalf("Execute() = %v, want %v", err, errLoaded)
+	}
+	if kernelAddr != 0x2000000 || initrdAddr != 0x3000000 {
+		t.Errorf("loaded kernel at %#x and initrd at %#x, want 0x2000000 and 0x3000000", kernelAddr, initrdAddr)
+	}
+	if string(kernel) != "kernel" || string(initrd) != "initrd" {
+		t.Errorf("loaded %q and %q, want kernel and initrd", kernel, initrd)
+	}
+
+	errPlace := errors.New("no room")
+	li.Placement = func(k, i []byte) ([]kexec.Segment, error) {
+		return nil, errPlace
+	}
+	if err := li.Execute(); err != errPlace {
+		t.Errorf("Execute() = %v, want %v", err, errPlace)
+	}
+}
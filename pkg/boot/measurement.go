@@ -16,6 +16,7 @@ import (
 	//"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/google/go-tpm/tpm"
 	"github.com/u-root/u-root/pkg/cpio"
@@ -92,6 +93,60 @@ func (mr *MeasuringReader) ReadRecord() (cpio.Record, error) {
 	}
 }
 
+// maxSignatureSize bounds the signature record StreamVerify reads. RSA
+// signatures are as long as the key.
+const maxSignatureSize = 16384
+
+// StreamVerify verifies the signature of the cpio archive read from r, as
+// written by SigningWriter, without keeping the archive in memory. Only RSA
+// public keys are supported.
+//
+// The signature must come after all regular files, as it only covers the
+// files before it.
+func StreamVerify(r io.Reader, publicKey interface{}) error {
+	pk, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	signed := sha256.New()
+	var signature []byte
+	err := cpio.StreamRecords(r, func(rec cpio.Record, content io.Reader) error {
+		switch {
+		case rec.Name == "signature":
+			if signature != nil {
+				return fmt.Errorf("archive has more than one signature")
+			}
+			if rec.FileSize > maxSignatureSize {
+				return fmt.Errorf("signature is %d bytes, more than the maximum of %d", rec.FileSize, maxSignatureSize)
+			}
+			var err error
+			signature, err = ioutil.ReadAll(content)
+			return err
+
+		case rec.Name == "signature_algo":
+			return nil
+
+		case rec.Info.Mode&unix.S_IFMT == unix.S_IFREG:
+			if signature != nil {
+				return fmt.Errorf("file %q is after the signature", rec.Name)
+			}
+			if _, err := io.WriteString(signed, rec.Name); err != nil {
+				return err
+			}
+			_, err := io.Copy(signed, content)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		return fmt.Errorf("archive has no signature")
+	}
+	return rsa.VerifyPKCS1v15(pk, crypto.SHA256, signed.Sum(nil), signature)
+}
+
 // SigningWriter is a cpio.RecordWriter that collects digests as it writes
 // files to the cpio archive.
 type SigningWriter struct {
@@ -0,0 +1,46 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.18
+
+package boot
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"golang.org/x/sys/unix"
+)
+
+func FuzzStreamVerify(f *testing.F) {
+	key := signingKey(f)
+	good := signedArchive(f, key, testRecords, nil)
+	f.Add(good)
+	f.Add(good[:len(good)/2])
+	f.Add(bytes.Replace(good, []byte("arrgh"), []byte("arrgg"), 1))
+	f.Add([]byte("070701"))
+	f.Fuzz(func(t *testing.T, archive []byte) {
+		if err := StreamVerify(bytes.NewReader(archive), &key.PublicKey); err != nil {
+			return
+		}
+		// Headers are not signed, but the names and contents of all
+		// regular files must be what was signed.
+		var signed bytes.Buffer
+		if err := cpio.StreamRecords(bytes.NewReader(archive), func(rec cpio.Record, content io.Reader) error {
+			if rec.Info.Mode&unix.S_IFMT == unix.S_IFREG && rec.Name != "signature" && rec.Name != "signature_algo" {
+				signed.WriteString(rec.Name)
+				_, err := signed.ReadFrom(content)
+				return err
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("StreamVerify(%q) succeeded, but the archive does not read: %v", archive, err)
+		}
+		if want := "modules/kernelfoobarmetadataarrgh"; signed.String() != want {
+			t.Errorf("StreamVerify(%q) succeeded for files %q, want %q", archive, signed.String(), want)
+		}
+	})
+}
@@ -6,10 +6,13 @@ package boot
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/u-root/u-root/pkg/cpio"
@@ -135,3 +138,116 @@ func TestWriterAndReader(t *testing.T) {
 		t.Errorf("Verify() = %v, want nil", err)
 	}
 }
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// signingKey returns a key shared by the tests, as generating one is slow.
+func signingKey(tb testing.TB) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return testKey
+}
+
+// signedArchive returns a newc archive of records signed by key, then
+// followed by after.
+func signedArchive(tb testing.TB, key *rsa.PrivateKey, records, after []cpio.Record) []byte {
+	var b bytes.Buffer
+	w := cpio.Newc.Writer(&b)
+	s := NewSigningWriter(w)
+	if err := cpio.WriteRecords(s, records); err != nil {
+		tb.Fatal(err)
+	}
+	if err := s.WriteSignature(key); err != nil {
+		tb.Fatal(err)
+	}
+	if err := cpio.WriteRecords(w, after); err != nil {
+		tb.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+var testRecords = []cpio.Record{
+	cpio.Directory("modules", 0700),
+	cpio.StaticFile("modules/kernel", "foobar", 0700),
+	cpio.StaticFile("metadata", "arrgh", 0700),
+}
+
+func TestStreamVerify(t *testing.T) {
+	key := signingKey(t)
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := signedArchive(t, key, testRecords, nil)
+
+	noSignature := &bytes.Buffer{}
+	if err := cpio.WriteRecords(cpio.Newc.Writer(noSignature), testRecords); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		archive []byte
+		key     interface{}
+		err     string
+	}{
+		{name: "good", archive: good, key: &key.PublicKey},
+		{name: "no trailer", archive: good[:bytes.LastIndex(good, []byte("070701"))], key: &key.PublicKey},
+		{name: "tampered", archive: bytes.Replace(good, []byte("foobar"), []byte("foobaz"), 1), key: &key.PublicKey, err: "verification error"},
+		{name: "wrong key", archive: good, key: &other.PublicKey, err: "verification error"},
+		{name: "unsupported key", archive: good, key: &ecdsa.PublicKey{}, err: "unsupported public key type"},
+		{name: "no signature", archive: noSignature.Bytes(), key: &key.PublicKey, err: "no signature"},
+		{
+			name:    "file after signature",
+			archive: signedArchive(t, key, testRecords, []cpio.Record{cpio.StaticFile("evil", "x", 0700)}),
+			key:     &key.PublicKey,
+			err:     `file "evil" is after the signature`,
+		},
+		{
+			name:    "directory after signature",
+			archive: signedArchive(t, key, testRecords, []cpio.Record{cpio.Directory("dir", 0700)}),
+			key:     &key.PublicKey,
+		},
+		{name: "truncated", archive: good[:100], key: &key.PublicKey, err: "EOF"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := StreamVerify(bytes.NewReader(tt.archive), tt.key)
+			if tt.err == "" && err != nil {
+				t.Errorf("StreamVerify() = %v, want nil", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("StreamVerify() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func BenchmarkStreamVerify(b *testing.B) {
+	key := signingKey(b)
+	// 100 MB in 100 files.
+	content := make([]byte, 1<<20)
+	var records []cpio.Record
+	for i := 0; i < 100; i++ {
+		records = append(records, cpio.Record{
+			ReaderAt: bytes.NewReader(content),
+			Info:     cpio.Info{Name: fmt.Sprintf("file%d", i), Mode: 0100644, FileSize: uint64(len(content))},
+		})
+	}
+	archive := signedArchive(b, key, records, nil)
+	b.SetBytes(int64(len(archive)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := StreamVerify(bytes.NewReader(archive), &key.PublicKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package memenc tells whether the CPU can encrypt memory, with AMD Secure
+// Memory Encryption (SME) or Intel Total Memory Encryption (TME), and
+// whether a kernel was built to use it.
+//
+// CPUID and MSRs are read through the Linux cpuid and msr drivers, at
+// /dev/cpu/0/cpuid and /dev/cpu/0/msr.
+package memenc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+const (
+	cpuidDevice = "/dev/cpu/0/cpuid"
+	msrDevice   = "/dev/cpu/0/msr"
+)
+
+const (
+	// leafVendor has the highest basic leaf in EAX and the vendor in EBX,
+	// EDX and ECX.
+	leafVendor = 0
+	// leafFeatures has TME_EN, bit 13 of ECX.
+	leafFeatures = 7
+	// leafMaxExtended has the highest extended leaf in EAX.
+	leafMaxExtended = 0x80000000
+	// leafEncryptedMemory has SME, bit 0 of EAX.
+	leafEncryptedMemory = 0x8000001f
+
+	// msrTMECapability is IA32_TME_CAPABILITY, whose bit 0 says that TME
+	// can encrypt with AES-XTS.
+	msrTMECapability = 0x981
+)
+
+var (
+	// cpuid returns EAX, EBX, ECX and EDX of CPUID leaf and subleaf.
+	// Tests replace it.
+	cpuid = devCPUID
+
+	// readMSR returns the MSR at addr. Tests replace it.
+	readMSR = devMSR
+)
+
+// devCPUID reads CPUID from the cpuid driver, which answers reads at
+// subleaf<<32|leaf.
+func devCPUID(leaf, subleaf uint32) (eax, ebx, ecx, edx uint32, err error) {
+	f, err := os.Open(cpuidDevice)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	defer f.Close()
+	var b [16]byte
+	if _, err := f.ReadAt(b[:], int64(subleaf)<<32|int64(leaf)); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint32(b[4:]),
+		binary.LittleEndian.Uint32(b[8:]), binary.LittleEndian.Uint32(b[12:]), nil
+}
+
+// devMSR reads the MSR at addr from the msr driver.
+func devMSR(addr uint32) (uint64, error) {
+	f, err := os.Open(msrDevice)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var b [8]byte
+	if _, err := f.ReadAt(b[:], int64(addr)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+// vendor returns the vendor of the CPU, such as "AuthenticAMD", and its
+// highest basic leaf, or "" if CPUID cannot be read.
+func vendor() (string, uint32) {
+	max, ebx, ecx, edx, err := cpuid(leafVendor, 0)
+	if err != nil {
+		return "", 0
+	}
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:], ebx)
+	binary.LittleEndian.PutUint32(b[4:], edx)
+	binary.LittleEndian.PutUint32(b[8:], ecx)
+	return string(b[:]), max
+}
+
+// SMESupported returns whether the CPU is an AMD one with SME.
+func SMESupported() bool {
+	if v, _ := vendor(); v != "AuthenticAMD" {
+		return false
+	}
+	max, _, _, _, err := cpuid(leafMaxExtended, 0)
+	if err != nil || max < leafEncryptedMemory {
+		return false
+	}
+	eax, _, _, _, err := cpuid(leafEncryptedMemory, 0)
+	return err == nil && eax&1 != 0
+}
+
+// TMESupported returns whether the CPU is an Intel one with TME. If the MSRs
+// can be read, TME must also be able to encrypt with AES-XTS.
+func TMESupported() bool {
+	v, max := vendor()
+	if v != "GenuineIntel" || max < leafFeatures {
+		return false
+	}
+	_, _, ecx, _, err := cpuid(leafFeatures, 0)
+	if err != nil || ecx&(1<<13) == 0 {
+		return false
+	}
+	capability, err := readMSR(msrTMECapability)
+	if err != nil {
+		// Without the msr driver, CPUID has to do.
+		return true
+	}
+	return capability&1 != 0
+}
+
+// Technology is a way the CPU encrypts memory.
+type Technology int
+
+// Technologies of memory encryption.
+const (
+	None Technology = iota
+	SME
+	TME
+)
+
+func (t Technology) String() string {
+	switch t {
+	case SME:
+		return "AMD SME"
+	case TME:
+		return "Intel TME"
+	}
+	return "none"
+}
+
+// Detect returns how the CPU can encrypt memory.
+func Detect() Technology {
+	switch {
+	case SMESupported():
+		return SME
+	case TMESupported():
+		return TME
+	}
+	return None
+}
+
+// ErrNoKernelConfig is returned by KernelConfig if the kernel has no
+// uncompressed CONFIG_IKCONFIG config in it.
+var ErrNoKernelConfig = errors.New("kernel has no embedded config")
+
+var (
+	ikconfigStart = []byte("IKCFG_ST")
+	ikconfigEnd   = []byte("IKCFG_ED")
+)
+
+// KernelConfig returns the options that kernel was built with, by name,
+// such as "CONFIG_AMD_MEM_ENCRYPT": "y", from the gzipped config that
+// CONFIG_IKCONFIG puts between IKCFG_ST and IKCFG_ED.
+//
+// The config of a compressed kernel, such as most bzImages, cannot be seen
+// and ErrNoKernelConfig is returned.
+func KernelConfig(kernel io.ReaderAt) (map[string]string, error) {
+	b, err := uio.ReadAll(kernel)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.Index(b, ikconfigStart)
+	if i < 0 {
+		return nil, ErrNoKernelConfig
+	}
+	b = b[i+len(ikconfigStart):]
+	if j := bytes.Index(b, ikconfigEnd); j >= 0 {
+		b = b[:j]
+	}
+	z, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrNoKernelConfig
+	}
+	z.Multistream(false)
+
+	config := make(map[string]string)
+	s := bufio.NewScanner(z)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		config[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memenc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// regs are the EAX, EBX, ECX and EDX of a CPUID leaf.
+type regs [4]uint32
+
+// fakeCPU answers CPUID from leaves and MSRs from msrs. Missing leaves are
+// zero; missing MSRs cannot be read.
+type fakeCPU struct {
+	leaves map[uint32]regs
+	msrs   map[uint32]uint64
+}
+
+func (c fakeCPU) cpuid(leaf, subleaf uint32) (uint32, uint32, uint32, uint32, error) {
+	r := c.leaves[leaf]
+	return r[0], r[1], r[2], r[3], nil
+}
+
+func (c fakeCPU) readMSR(addr uint32) (uint64, error) {
+	v, ok := c.msrs[addr]
+	if !ok {
+		return 0, errors.New("no msr driver")
+	}
+	return v, nil
+}
+
+// vendorLeaf returns leaf 0 of a CPU from vendor with highest basic leaf max.
+func vendorLeaf(vendor string, max uint32) regs {
+	b := []byte(vendor)
+	return regs{
+		max,
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint32(b[8:]),
+		binary.LittleEndian.Uint32(b[4:]),
+	}
+}
+
+func TestDetect(t *testing.T) {
+	oldCPUID, oldMSR := cpuid, readMSR
+	defer func() { cpuid, readMSR = oldCPUID, oldMSR }()
+	for _, tt := range []struct {
+		name string
+		cpu  fakeCPU
+		want Technology
+	}{
+		{
+			name: "AMD with SME",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:          vendorLeaf("AuthenticAMD", 0xd),
+				leafMaxExtended:     {0x80000020},
+				leafEncryptedMemory: {0x1},
+			}},
+			want: SME,
+		},
+		{
+			name: "AMD without SME",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:          vendorLeaf("AuthenticAMD", 0xd),
+				leafMaxExtended:     {0x80000020},
+				leafEncryptedMemory: {0x2},
+			}},
+			want: None,
+		},
+		{
+			name: "AMD without encrypted memory leaf",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:          vendorLeaf("AuthenticAMD", 0xd),
+				leafMaxExtended:     {0x8000001e},
+				leafEncryptedMemory: {0x1},
+			}},
+			want: None,
+		},
+		{
+			name: "Intel with TME",
+			cpu: fakeCPU{
+				leaves: map[uint32]regs{
+					leafVendor:   vendorLeaf("GenuineIntel", 0x1b),
+					leafFeatures: {0, 0, 1 << 13, 0},
+				},
+				msrs: map[uint32]uint64{msrTMECapability: 0x1},
+			},
+			want: TME,
+		},
+		{
+			name: "Intel with TME and no msr driver",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:   vendorLeaf("GenuineIntel", 0x1b),
+				leafFeatures: {0, 0, 1 << 13, 0},
+			}},
+			want: TME,
+		},
+		{
+			name: "Intel with TME without AES-XTS",
+			cpu: fakeCPU{
+				leaves: map[uint32]regs{
+					leafVendor:   vendorLeaf("GenuineIntel", 0x1b),
+					leafFeatures: {0, 0, 1 << 13, 0},
+				},
+				msrs: map[uint32]uint64{msrTMECapability: 0},
+			},
+			want: None,
+		},
+		{
+			name: "Intel without TME",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:   vendorLeaf("GenuineIntel", 0x1b),
+				leafFeatures: {0, 0, 1 << 12, 0},
+			}},
+			want: None,
+		},
+		{
+			name: "Intel without feature leaf",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:   vendorLeaf("GenuineIntel", 0x6),
+				leafFeatures: {0, 0, 1 << 13, 0},
+			}},
+			want: None,
+		},
+		{
+			name: "SME bit on Intel",
+			cpu: fakeCPU{leaves: map[uint32]regs{
+				leafVendor:          vendorLeaf("GenuineIntel", 0x1b),
+				leafMaxExtended:     {0x80000020},
+				leafEncryptedMemory: {0x1},
+			}},
+			want: None,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cpuid, readMSR = tt.cpu.cpuid, tt.cpu.readMSR
+			if got := Detect(); got != tt.want {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoCPUID(t *testing.T) {
+	oldCPUID := cpuid
+	defer func() { cpuid = oldCPUID }()
+	cpuid = func(uint32, uint32) (uint32, uint32, uint32, uint32, error) {
+		return 0, 0, 0, 0, errors.New("no cpuid driver")
+	}
+	if SMESupported() || TMESupported() {
+		t.Errorf("SMESupported() || TMESupported() = true without CPUID, want false")
+	}
+}
+
+// ikconfig returns a kernel with config embedded as CONFIG_IKCONFIG does.
+func ikconfig(t *testing.T, config string) []byte {
+	var b bytes.Buffer
+	b.WriteString("kernel code IKCFG_ST")
+	z := gzip.NewWriter(&b)
+	if _, err := z.Write([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString("IKCFG_ED more kernel")
+	return b.Bytes()
+}
+
+func TestKernelConfig(t *testing.T) {
+	kernel := ikconfig(t, "#\n# Automatically generated file; DO NOT EDIT.\n#\n"+
+		"CONFIG_AMD_MEM_ENCRYPT=y\n"+
+		"# CONFIG_AMD_MEM_ENCRYPT_ACTIVE_BY_DEFAULT is not set\n"+
+		"CONFIG_CMDLINE=\"console=ttyS0\"\n")
+	config, err := KernelConfig(bytes.NewReader(kernel))
+	if err != nil {
+		t.Fatalf("KernelConfig() = %v", err)
+	}
+	for k, want := range map[string]string{
+		"CONFIG_AMD_MEM_ENCRYPT":                   "y",
+		"CONFIG_AMD_MEM_ENCRYPT_ACTIVE_BY_DEFAULT": "",
+		"CONFIG_CMDLINE":                           "console=ttyS0",
+	} {
+		if got := config[k]; got != want {
+			t.Errorf("config[%q] = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestKernelConfigMissing(t *testing.T) {
+	for _, kernel := range []string{
+		"kernel without config",
+		"kernel IKCFG_ST not gzip IKCFG_ED",
+	} {
+		if _, err := KernelConfig(bytes.NewReader([]byte(kernel))); err != ErrNoKernelConfig {
+			t.Errorf("KernelConfig(%q) = %v, want %v", kernel, err, ErrNoKernelConfig)
+		}
+	}
+}
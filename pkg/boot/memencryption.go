@@ -0,0 +1,58 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"errors"
+	"log"
+
+	"github.com/u-root/u-root/pkg/boot/memenc"
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+// ErrNoMemoryEncryption is returned by LinuxImage.EnableMemoryEncryption if
+// the CPU has neither AMD SME nor Intel TME.
+var ErrNoMemoryEncryption = errors.New("CPU cannot encrypt memory")
+
+// detectMemoryEncryption tells how the CPU encrypts memory. Tests replace it.
+var detectMemoryEncryption = memenc.Detect
+
+// smeParam turns AMD SME on in kernels with CONFIG_AMD_MEM_ENCRYPT.
+const smeParam = "mem_encrypt=on"
+
+// EnableMemoryEncryption makes the kernel of li encrypt memory if the CPU
+// can.
+//
+// With AMD SME, mem_encrypt=on replaces any mem_encrypt in li.Cmdline, and a
+// warning is logged if the kernel config, when it can be seen, does not
+// have CONFIG_AMD_MEM_ENCRYPT. Intel TME is activated by firmware and needs
+// nothing from the kernel, so li is left as it is.
+func (li *LinuxImage) EnableMemoryEncryption() error {
+	if li.Kernel == nil {
+		return ErrKernelMissing
+	}
+	switch detectMemoryEncryption() {
+	case memenc.SME:
+	case memenc.TME:
+		return nil
+	default:
+		return ErrNoMemoryEncryption
+	}
+
+	li.Cmdline = cmdline.OverrideParam(li.Cmdline, smeParam)
+	kernel, err := kernelImage(li.Kernel)
+	if err != nil {
+		return err
+	}
+	config, err := memenc.KernelConfig(kernel)
+	switch {
+	case err == memenc.ErrNoKernelConfig:
+	case err != nil:
+		return err
+	case config["CONFIG_AMD_MEM_ENCRYPT"] != "y":
+		log.Printf("Kernel was built without CONFIG_AMD_MEM_ENCRYPT, so %s does nothing", smeParam)
+	}
+	return nil
+}
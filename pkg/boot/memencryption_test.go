@@ -0,0 +1,113 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot/memenc"
+)
+
+// kernelWithConfig returns a kernel with config embedded as CONFIG_IKCONFIG
+// does.
+func kernelWithConfig(t *testing.T, config string) *bytes.Reader {
+	var b bytes.Buffer
+	b.WriteString("kernel IKCFG_ST")
+	z := gzip.NewWriter(&b)
+	z.Write([]byte(config))
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString("IKCFG_ED")
+	return bytes.NewReader(b.Bytes())
+}
+
+func TestEnableMemoryEncryption(t *testing.T) {
+	oldDetect := detectMemoryEncryption
+	defer func() { detectMemoryEncryption = oldDetect }()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		name        string
+		tech        memenc.Technology
+		kernel      *bytes.Reader
+		cmdline     string
+		wantCmdline string
+		wantErr     error
+		wantWarning bool
+	}{
+		{
+			name:        "SME",
+			tech:        memenc.SME,
+			kernel:      kernelWithConfig(t, "CONFIG_AMD_MEM_ENCRYPT=y\n"),
+			cmdline:     "console=ttyS0",
+			wantCmdline: "console=ttyS0 mem_encrypt=on",
+		},
+		{
+			name:        "SME replaces mem_encrypt",
+			tech:        memenc.SME,
+			kernel:      kernelWithConfig(t, "CONFIG_AMD_MEM_ENCRYPT=y\n"),
+			cmdline:     "mem_encrypt=off quiet -- init",
+			wantCmdline: "mem_encrypt=on quiet -- init",
+		},
+		{
+			name:        "SME without CONFIG_AMD_MEM_ENCRYPT",
+			tech:        memenc.SME,
+			kernel:      kernelWithConfig(t, "# CONFIG_AMD_MEM_ENCRYPT is not set\n"),
+			wantCmdline: "mem_encrypt=on",
+			wantWarning: true,
+		},
+		{
+			name:        "SME without config",
+			tech:        memenc.SME,
+			kernel:      bytes.NewReader([]byte("compressed kernel")),
+			wantCmdline: "mem_encrypt=on",
+		},
+		{
+			name:        "TME",
+			tech:        memenc.TME,
+			kernel:      bytes.NewReader([]byte("kernel")),
+			cmdline:     "quiet",
+			wantCmdline: "quiet",
+		},
+		{
+			name:        "none",
+			tech:        memenc.None,
+			kernel:      bytes.NewReader([]byte("kernel")),
+			cmdline:     "quiet",
+			wantCmdline: "quiet",
+			wantErr:     ErrNoMemoryEncryption,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			detectMemoryEncryption = func() memenc.Technology { return tt.tech }
+			logged.Reset()
+			li := NewLinuxImage(tt.kernel, nil, tt.cmdline)
+			if err := li.EnableMemoryEncryption(); err != tt.wantErr {
+				t.Errorf("EnableMemoryEncryption() = %v, want %v", err, tt.wantErr)
+			}
+			if li.Cmdline != tt.wantCmdline {
+				t.Errorf("Cmdline = %q, want %q", li.Cmdline, tt.wantCmdline)
+			}
+			if got := strings.Contains(logged.String(), "CONFIG_AMD_MEM_ENCRYPT"); got != tt.wantWarning {
+				t.Errorf("warned = %t (%q), want %t", got, logged.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestEnableMemoryEncryptionNoKernel(t *testing.T) {
+	li := &LinuxImage{}
+	if err := li.EnableMemoryEncryption(); err != ErrKernelMissing {
+		t.Errorf("EnableMemoryEncryption() = %v, want %v", err, ErrKernelMissing)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// ErrNoMetadata is returned by LinuxImage.GetMetadata if the image has no
+// metadata.
+var ErrNoMetadata = errors.New("image has no metadata")
+
+// metadataPath is where LinuxImage.Pack writes the metadata of an image.
+const metadataPath = "modules/metadata"
+
+// ImageMetadata describes how a boot image was built, so that operators can
+// keep an inventory of what their machines boot.
+type ImageMetadata struct {
+	Version    string            `json:"version,omitempty"`
+	BuildHost  string            `json:"build_host,omitempty"`
+	CommitSHA  string            `json:"commit_sha,omitempty"`
+	BuildTime  time.Time         `json:"build_time"`
+	CustomTags map[string]string `json:"custom_tags,omitempty"`
+}
+
+// SetMetadata attaches m to li. Pack writes it to the package as JSON.
+func (li *LinuxImage) SetMetadata(m ImageMetadata) {
+	li.metadata = &m
+}
+
+// GetMetadata returns the metadata attached to li by SetMetadata or read
+// from its package, or ErrNoMetadata if there is none.
+func (li *LinuxImage) GetMetadata() (ImageMetadata, error) {
+	if li.metadata == nil {
+		return ImageMetadata{}, ErrNoMetadata
+	}
+	return *li.metadata, nil
+}
+
+// packMetadata writes the metadata of li, if any, to sw.
+func (li *LinuxImage) packMetadata(sw cpio.RecordWriter) error {
+	if li.metadata == nil {
+		return nil
+	}
+	b, err := json.Marshal(li.metadata)
+	if err != nil {
+		return err
+	}
+	return sw.WriteRecord(cpio.StaticFile(metadataPath, string(b), 0700))
+}
+
+// unpackMetadata reads the metadata in a, if any, into li.
+func (li *LinuxImage) unpackMetadata(a *cpio.Archive) error {
+	r, ok := a.Files[metadataPath]
+	if !ok {
+		return nil
+	}
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var m ImageMetadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("bad image metadata: %v", err)
+	}
+	li.metadata = &m
+	return nil
+}
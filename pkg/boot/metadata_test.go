@@ -0,0 +1,80 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	want := ImageMetadata{
+		Version:    "v1.2.3",
+		BuildHost:  "builder-7",
+		CommitSHA:  "8266e25b",
+		BuildTime:  time.Date(2018, 7, 1, 12, 30, 0, 0, time.UTC),
+		CustomTags: map[string]string{"fleet": "west", "tier": "canary"},
+	}
+	li := NewLinuxImage(strings.NewReader("kernel"), strings.NewReader("initrd"), "quiet")
+	li.SetMetadata(want)
+
+	a := cpio.InMemArchive()
+	if err := li.Pack(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Files[metadataPath]; !ok {
+		t.Fatalf("Pack() did not write %s", metadataPath)
+	}
+	got, err := NewLinuxImageFromArchive(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imageEqual(got, li) {
+		t.Errorf("NewLinuxImageFromArchive() = %v, want %v", got, li)
+	}
+	m, err := got.GetMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("GetMetadata() = %+v, want %+v", m, want)
+	}
+}
+
+func TestNoMetadata(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	if _, err := li.GetMetadata(); err != ErrNoMetadata {
+		t.Errorf("GetMetadata() = %v, want %v", err, ErrNoMetadata)
+	}
+
+	a := cpio.InMemArchive()
+	if err := li.Pack(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Files[metadataPath]; ok {
+		t.Errorf("Pack() wrote %s without metadata", metadataPath)
+	}
+	got, err := NewLinuxImageFromArchive(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := got.GetMetadata(); err != ErrNoMetadata {
+		t.Errorf("GetMetadata() of archive = %v, want %v", err, ErrNoMetadata)
+	}
+}
+
+func TestBadMetadata(t *testing.T) {
+	a := cpio.ArchiveFromRecords([]cpio.Record{
+		cpio.StaticFile("modules/kernel/content", "kernel", 0700),
+		cpio.StaticFile(metadataPath, "{", 0700),
+	})
+	if _, err := NewLinuxImageFromArchive(a); err == nil {
+		t.Errorf("NewLinuxImageFromArchive() with bad metadata = nil, want error")
+	}
+}
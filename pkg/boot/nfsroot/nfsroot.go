@@ -0,0 +1,129 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nfsroot boots kernels whose root file system is an NFS export.
+//
+// See Documentation/filesystems/nfs/nfsroot.txt in Linux for the kernel
+// command line options.
+package nfsroot
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/mount"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultVersion is the NFS version used unless one is given.
+const DefaultVersion = 3
+
+var (
+	// nfsPort is the port NFS servers listen on. Tests change it.
+	nfsPort = 2049
+	// dialTimeout bounds checking that the server is up.
+	dialTimeout = 10 * time.Second
+	// mountFn mounts file systems. Tests replace it.
+	mountFn = mount.Mount
+)
+
+type options struct {
+	version int
+}
+
+// Option configures how an export is mounted.
+type Option func(*options)
+
+// Version sets the NFS version, 3 or 4.
+func Version(v int) Option {
+	return func(o *options) {
+		o.version = v
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{version: DefaultVersion}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// host formats server for the host part of an NFS source.
+func host(server net.IP) string {
+	if server.To4() == nil {
+		return "[" + server.String() + "]"
+	}
+	return server.String()
+}
+
+// NfsRootCmdline returns the kernel command line options to mount path on
+// server as root, after configuring iface, or all interfaces if it is
+// empty, with DHCP.
+func NfsRootCmdline(server net.IP, path string, iface string, opts ...Option) string {
+	o := newOptions(opts)
+	ip := "dhcp"
+	if iface != "" {
+		// ip=<client>:<server>:<gateway>:<netmask>:<hostname>:<device>:<autoconf>
+		ip = ":::::" + iface + ":dhcp"
+	}
+	return fmt.Sprintf("root=/dev/nfs nfsroot=%s:%s,vers=%d,tcp ip=%s", host(server), path, o.version, ip)
+}
+
+// mountData returns the options of mount(2) for NFS.
+func mountData(server net.IP, o options) (string, error) {
+	data := []string{"addr=" + server.String(), "vers=" + strconv.Itoa(o.version), "proto=tcp"}
+	switch o.version {
+	case 3:
+		// There is no statd to do locking with this early, and the
+		// kernel asks the server's mountd for the file handle itself.
+		data = append(data, "mountproto=tcp", "nolock")
+	case 4:
+	default:
+		return "", fmt.Errorf("unsupported NFS version %d", o.version)
+	}
+	return strings.Join(data, ","), nil
+}
+
+// MountNFSRoot mounts path on server read-only at localMnt, which is created
+// if needed. Mounting it before kexec checks that the new kernel will be
+// able to.
+func MountNFSRoot(server net.IP, path, localMnt string, opts ...Option) error {
+	o := newOptions(opts)
+	data, err := mountData(server, o)
+	if err != nil {
+		return err
+	}
+	// Fail quickly, rather than after the kernel's RPC retries.
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(server.String(), strconv.Itoa(nfsPort)), dialTimeout)
+	if err != nil {
+		return fmt.Errorf("NFS server %v is not reachable: %v", server, err)
+	}
+	c.Close()
+
+	if err := os.MkdirAll(localMnt, 0755); err != nil {
+		return err
+	}
+	return mountFn(host(server)+":"+path, localMnt, "nfs", data, unix.MS_RDONLY)
+}
+
+// LinuxImage mounts path on server at localMnt and returns a LinuxImage of
+// the kernel and initrd at the given paths in the export, which boots with
+// the export as root. The initrd is optional.
+func LinuxImage(server net.IP, path, iface, localMnt, kernelPath, initrdPath, cmdline string, opts ...Option) (*boot.LinuxImage, error) {
+	if err := MountNFSRoot(server, path, localMnt, opts...); err != nil {
+		return nil, err
+	}
+	cmdline = strings.TrimSpace(cmdline + " " + NfsRootCmdline(server, path, iface, opts...))
+	li, err := boot.LinuxImageFromFSPath(localMnt, kernelPath, initrdPath, cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("reading kernel from %s:%s: %v", server, path, err)
+	}
+	return li, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfsroot
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestNfsRootCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		server net.IP
+		path   string
+		iface  string
+		opts   []Option
+		want   string
+	}{
+		{
+			server: net.ParseIP("192.168.1.1"),
+			path:   "/srv/root",
+			want:   "root=/dev/nfs nfsroot=192.168.1.1:/srv/root,vers=3,tcp ip=dhcp",
+		},
+		{
+			server: net.ParseIP("10.0.0.1"),
+			path:   "/export",
+			iface:  "eth1",
+			opts:   []Option{Version(4)},
+			want:   "root=/dev/nfs nfsroot=10.0.0.1:/export,vers=4,tcp ip=:::::eth1:dhcp",
+		},
+		{
+			server: net.ParseIP("fd00::1"),
+			path:   "/srv/root",
+			want:   "root=/dev/nfs nfsroot=[fd00::1]:/srv/root,vers=3,tcp ip=dhcp",
+		},
+	} {
+		if got := NfsRootCmdline(tt.server, tt.path, tt.iface, tt.opts...); got != tt.want {
+			t.Errorf("NfsRootCmdline(%v, %q, %q) = %q, want %q", tt.server, tt.path, tt.iface, got, tt.want)
+		}
+	}
+}
+
+// mockServer is an NFS server as far as MountNFSRoot can tell: something
+// listening on the NFS port, and a mount that fills in the export.
+type mockServer struct {
+	l     net.Listener
+	files map[string]string
+
+	source, fsType, data string
+	flags                uintptr
+}
+
+// newMockServer starts a server and returns it with a function to restore
+// the real NFS.
+func newMockServer(t *testing.T, files map[string]string) (*mockServer, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	s := &mockServer{l: l, files: files}
+	oldPort, oldMount := nfsPort, mountFn
+	nfsPort = l.Addr().(*net.TCPAddr).Port
+	mountFn = s.mount
+	return s, func() {
+		l.Close()
+		nfsPort, mountFn = oldPort, oldMount
+	}
+}
+
+func (s *mockServer) mount(source, path, fsType, data string, flags uintptr) error {
+	s.source, s.fsType, s.data, s.flags = source, fsType, data, flags
+	for name, c := range s.files {
+		p := filepath.Join(path, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(c), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMountNFSRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfsroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, stop := newMockServer(t, nil)
+	defer stop()
+
+	for _, tt := range []struct {
+		opts []Option
+		data string
+	}{
+		{data: "addr=127.0.0.1,vers=3,proto=tcp,mountproto=tcp,nolock"},
+		{opts: []Option{Version(4)}, data: "addr=127.0.0.1,vers=4,proto=tcp"},
+	} {
+		if err := MountNFSRoot(net.ParseIP("127.0.0.1"), "/srv/root", filepath.Join(dir, "mnt"), tt.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if s.source != "127.0.0.1:/srv/root" || s.fsType != "nfs" || s.data != tt.data || s.flags != 1 {
+			t.Errorf("mounted %q type %q with %q flags %#x, want %q type nfs with %q flags 0x1", s.source, s.fsType, s.data, s.flags, "127.0.0.1:/srv/root", tt.data)
+		}
+	}
+
+	if err := MountNFSRoot(net.ParseIP("127.0.0.1"), "/srv/root", filepath.Join(dir, "mnt"), Version(2)); err == nil {
+		t.Errorf("MountNFSRoot() with NFSv2 succeeded")
+	}
+
+	s.l.Close()
+	s.source = ""
+	if err := MountNFSRoot(net.ParseIP("127.0.0.1"), "/srv/root", filepath.Join(dir, "mnt")); err == nil {
+		t.Errorf("MountNFSRoot() with the server down succeeded")
+	}
+	if s.source != "" {
+		t.Errorf("MountNFSRoot() mounted with the server down")
+	}
+}
+
+func TestLinuxImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfsroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, stop := newMockServer(t, map[string]string{"boot/vmlinuz": "kernel", "boot/initrd.img": "initrd"})
+	defer stop()
+	server := net.ParseIP("127.0.0.1")
+
+	li, err := LinuxImage(server, "/srv/root", "eth0", dir, "/boot/vmlinuz", "/boot/initrd.img", "console=ttyS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "console=ttyS0 root=/dev/nfs nfsroot=127.0.0.1:/srv/root,vers=3,tcp ip=:::::eth0:dhcp"; li.Cmdline != want {
+		t.Errorf("Cmdline = %q, want %q", li.Cmdline, want)
+	}
+	for _, f := range []struct {
+		name string
+		r    io.ReaderAt
+		want string
+	}{{"kernel", li.Kernel, "kernel"}, {"initrd", li.Initrd, "initrd"}} {
+		b, err := uio.ReadAll(f.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != f.want {
+			t.Errorf("%s = %q, want %q", f.name, b, f.want)
+		}
+	}
+
+	if li, err := LinuxImage(server, "/srv/root", "", dir, "/boot/missing", "", ""); err == nil {
+		t.Errorf("LinuxImage() = %v, want error", li)
+	}
+}
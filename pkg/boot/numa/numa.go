@@ -0,0 +1,310 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package numa places kexec segments according to the NUMA topology.
+//
+// The kexec'd kernel runs its early boot on node 0, so the kernel is placed
+// there, while the initrd, which is only unpacked later, goes to the node
+// with the most free memory.
+package numa
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/bzimage"
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+var (
+	// nodeDir is the sysfs directory with one nodeN directory per node.
+	nodeDir = "/sys/devices/system/node"
+
+	// memoryDir has the memory block size.
+	memoryDir = "/sys/devices/system/memory"
+)
+
+const (
+	pageSize = 4096
+
+	// kernelAlign and kernelMin are the alignment and lowest address of a
+	// relocatable x86 kernel with the default CONFIG_PHYSICAL_START.
+	kernelAlign = 2 << 20
+	kernelMin   = 16 << 20
+)
+
+// NUMANode is a NUMA node with its memory and CPUs.
+type NUMANode struct {
+	ID int
+
+	// MemTotal and MemFree are in bytes.
+	MemTotal uint64
+	MemFree  uint64
+
+	// CPUs are the CPUs local to the node.
+	CPUs []int
+
+	// Memory is the physical memory of the node, sorted by address.
+	Memory []kexec.Range
+}
+
+// NUMATopology returns the NUMA nodes of the running system, sorted by ID.
+func NUMATopology() ([]*NUMANode, error) {
+	dirs, err := filepath.Glob(filepath.Join(nodeDir, "node[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no NUMA nodes in %s", nodeDir)
+	}
+
+	blockSize, err := memoryBlockSize()
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*NUMANode
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		n := &NUMANode{ID: id}
+		if err := n.readMeminfo(filepath.Join(dir, "meminfo")); err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, "cpumap"))
+		if err != nil {
+			return nil, err
+		}
+		if n.CPUs, err = parseCPUMap(string(b)); err != nil {
+			return nil, fmt.Errorf("node %d: %v", id, err)
+		}
+		if n.Memory, err = memoryRanges(dir, blockSize); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// readMeminfo reads lines like "Node 0 MemFree:  1234 kB".
+func (n *NUMANode) readMeminfo(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q: %v", path, s.Text(), err)
+		}
+		if len(fields) > 4 && fields[4] == "kB" {
+			v *= 1024
+		}
+		switch fields[2] {
+		case "MemTotal:":
+			n.MemTotal = v
+		case "MemFree:":
+			n.MemFree = v
+		}
+	}
+	return s.Err()
+}
+
+// parseCPUMap parses a hex CPU mask like "00000000,0000000f".
+func parseCPUMap(s string) ([]int, error) {
+	hex := strings.Replace(strings.TrimSpace(s), ",", "", -1)
+	var cpus []int
+	for i := len(hex) - 1; i >= 0; i-- {
+		d, err := strconv.ParseUint(hex[i:i+1], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpumap %q", s)
+		}
+		for bit := 0; bit < 4; bit++ {
+			if d&(1<<uint(bit)) != 0 {
+				cpus = append(cpus, (len(hex)-1-i)*4+bit)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+func memoryBlockSize() (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(memoryDir, "block_size_bytes"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 16, 64)
+}
+
+// memoryRanges returns the physical memory of a node from its memoryN
+// entries, each of which is one memory block.
+func memoryRanges(dir string, blockSize uint64) ([]kexec.Range, error) {
+	blocks, err := filepath.Glob(filepath.Join(dir, "memory[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	var idx []uint64
+	for _, b := range blocks {
+		i, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(b), "memory"), 10, 64)
+		if err != nil {
+			continue
+		}
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(i, j int) bool { return idx[i] < idx[j] })
+
+	var ranges []kexec.Range
+	for _, i := range idx {
+		start := uintptr(i * blockSize)
+		if l := len(ranges); l > 0 && ranges[l-1].End() == start {
+			ranges[l-1].Size += uint(blockSize)
+			continue
+		}
+		ranges = append(ranges, kexec.Range{Start: start, Size: uint(blockSize)})
+	}
+	return ranges, nil
+}
+
+func alignUp(v, align uintptr) uintptr {
+	return (v + align - 1) &^ (align - 1)
+}
+
+func alignDown(v, align uintptr) uintptr {
+	return v &^ (align - 1)
+}
+
+// lowest returns the lowest range of size in mem at or above min, aligned to
+// align.
+func lowest(mem []kexec.Range, size uint, min, align uintptr) (kexec.Range, bool) {
+	for _, r := range mem {
+		start := r.Start
+		if start < min {
+			start = min
+		}
+		start = alignUp(start, align)
+		if start >= r.Start && start+uintptr(size) <= r.End() {
+			return kexec.Range{Start: start, Size: size}, true
+		}
+	}
+	return kexec.Range{}, false
+}
+
+// highest returns the highest page-aligned range of size in mem that does
+// not overlap avoid.
+func highest(mem []kexec.Range, size uint, avoid kexec.Range) (kexec.Range, bool) {
+	for i := len(mem) - 1; i >= 0; i-- {
+		r := mem[i]
+		if uint(r.Size) < size {
+			continue
+		}
+		start := alignDown(r.End()-uintptr(size), pageSize)
+		if start < r.Start {
+			continue
+		}
+		c := kexec.Range{Start: start, Size: size}
+		if c.Overlaps(avoid) {
+			// Try right below the range to avoid.
+			if avoid.Start < r.Start+uintptr(size) {
+				continue
+			}
+			start = alignDown(avoid.Start-uintptr(size), pageSize)
+			if start < r.Start {
+				continue
+			}
+			c.Start = start
+		}
+		return c, true
+	}
+	return kexec.Range{}, false
+}
+
+func pages(n int) uint {
+	return uint(alignUp(uintptr(n), pageSize))
+}
+
+// kernelSize returns the memory kernel takes once loaded. A bzImage says in
+// init_size how much it needs to decompress itself.
+func kernelSize(kernel []byte) uint {
+	size := len(kernel)
+	if h, err := bzimage.ReadHeader(bytes.NewReader(kernel)); err == nil && int(h.InitSize) > size {
+		size = int(h.InitSize)
+	}
+	return pages(size)
+}
+
+// KexecSegmentsForNUMA places kernel on node 0 and initrd, if any, on the node
+// with the most free memory.
+//
+// The kernel goes as low as a relocatable kernel may be loaded and the initrd
+// as high as possible, as kexec-tools does.
+func KexecSegmentsForNUMA(kernel, initrd []byte, topology []*NUMANode) ([]kexec.Segment, error) {
+	if len(topology) == 0 {
+		return nil, fmt.Errorf("empty NUMA topology")
+	}
+
+	var node0 *NUMANode
+	most := topology[0]
+	for _, n := range topology {
+		if n.ID == 0 {
+			node0 = n
+		}
+		if n.MemFree > most.MemFree {
+			most = n
+		}
+	}
+	if node0 == nil {
+		return nil, fmt.Errorf("no NUMA node 0")
+	}
+
+	k, ok := lowest(node0.Memory, kernelSize(kernel), kernelMin, kernelAlign)
+	if !ok {
+		return nil, fmt.Errorf("no room for %d byte kernel on node 0", len(kernel))
+	}
+	segs := []kexec.Segment{{Buf: kernel, Phys: k, Name: "kernel"}}
+	if len(initrd) == 0 {
+		return segs, nil
+	}
+
+	i, ok := highest(most.Memory, pages(len(initrd)), k)
+	if !ok {
+		return nil, fmt.Errorf("no room for %d byte initrd on node %d", len(initrd), most.ID)
+	}
+	return append(segs, kexec.Segment{Buf: initrd, Phys: i, Name: "initrd"}), nil
+}
+
+// WithNUMAAwareness makes a LinuxImage place its kernel and initrd according
+// to the NUMA topology of the running system. Without NUMA support in the
+// running kernel, placement is left to kexec.
+func WithNUMAAwareness() boot.LinuxImageOption {
+	return func(li *boot.LinuxImage) {
+		li.Placement = func(kernel, initrd []byte) ([]kexec.Segment, error) {
+			if _, err := os.Stat(nodeDir); os.IsNotExist(err) {
+				return nil, nil
+			}
+			topology, err := NUMATopology()
+			if err != nil {
+				return nil, err
+			}
+			return KexecSegmentsForNUMA(kernel, initrd, topology)
+		}
+	}
+}
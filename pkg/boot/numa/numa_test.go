@@ -0,0 +1,276 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package numa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/bzimage"
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+const mib = 1 << 20
+
+// mockSysfs creates a sysfs with two nodes of 128 MiB memory blocks: node 0
+// with 1 GiB at 0 and node 1 with 1 GiB at 4 GiB.
+func mockSysfs(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "numa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("memory/block_size_bytes", "8000000\n")
+	for _, n := range []struct {
+		id            int
+		total, free   int
+		cpumap        string
+		first, blocks int
+	}{
+		{0, 1048576, 204800, "00000000,0000000f\n", 0, 8},
+		{1, 1048576, 921600, "00000000,000000f0\n", 32, 8},
+	} {
+		node := fmt.Sprintf("node/node%d", n.id)
+		write(node+"/meminfo", fmt.Sprintf(
+			"Node %d MemTotal:       %d kB\nNode %d MemFree:        %d kB\nNode %d MemUsed:        %d kB\nNode %d HugePages_Total:     0\n",
+			n.id, n.total, n.id, n.free, n.id, n.total-n.free, n.id))
+		write(node+"/cpumap", n.cpumap)
+		for b := n.first; b < n.first+n.blocks; b++ {
+			write(fmt.Sprintf("%s/memory%d/online", node, b), "1\n")
+		}
+	}
+	return dir
+}
+
+func TestNUMATopology(t *testing.T) {
+	dir := mockSysfs(t)
+	defer os.RemoveAll(dir)
+	defer func(n, m string) { nodeDir, memoryDir = n, m }(nodeDir, memoryDir)
+	nodeDir, memoryDir = filepath.Join(dir, "node"), filepath.Join(dir, "memory")
+
+	nodes, err := NUMATopology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*NUMANode{
+		{
+			ID:       0,
+			MemTotal: 1048576 * 1024,
+			MemFree:  204800 * 1024,
+			CPUs:     []int{0, 1, 2, 3},
+			Memory:   []kexec.Range{{Start: 0, Size: 1024 * mib}},
+		},
+		{
+			ID:       1,
+			MemTotal: 1048576 * 1024,
+			MemFree:  921600 * 1024,
+			CPUs:     []int{4, 5, 6, 7},
+			Memory:   []kexec.Range{{Start: 4096 * mib, Size: 1024 * mib}},
+		},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		for _, n := range nodes {
+			t.Logf("got %+v", n)
+		}
+		t.Errorf("NUMATopology differs from mock")
+	}
+}
+
+func TestParseCPUMap(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []int
+	}{
+		{"1", []int{0}},
+		{"00000000,00000000", nil},
+		{"00000001,00000003\n", []int{0, 1, 32}},
+		{"a0", []int{5, 7}},
+	} {
+		got, err := parseCPUMap(tt.in)
+		if err != nil {
+			t.Errorf("parseCPUMap(%q) = %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCPUMap(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	if _, err := parseCPUMap("xyz"); err == nil {
+		t.Errorf("parseCPUMap(xyz) = nil, want error")
+	}
+}
+
+func TestKexecSegmentsForNUMA(t *testing.T) {
+	kernel := make([]byte, 8*mib+1)
+	initrd := make([]byte, 30*mib)
+
+	node0 := &NUMANode{ID: 0, MemFree: 100 * mib, Memory: []kexec.Range{
+		{Start: 0, Size: 640 << 10},
+		{Start: 1 * mib, Size: 1023 * mib},
+	}}
+	node1 := &NUMANode{ID: 1, MemFree: 900 * mib, Memory: []kexec.Range{{Start: 4096 * mib, Size: 1024 * mib}}}
+	small0 := &NUMANode{ID: 0, MemFree: 10 * mib, Memory: []kexec.Range{{Start: 0, Size: 32 * mib}}}
+
+	for _, tt := range []struct {
+		name     string
+		topology []*NUMANode
+		initrd   []byte
+		want     []kexec.Range
+	}{
+		{
+			name:     "initrd on other node",
+			topology: []*NUMANode{node0, node1},
+			initrd:   initrd,
+			want: []kexec.Range{
+				{Start: 16 * mib, Size: 8*mib + 4096},
+				{Start: 5120*mib - 30*mib, Size: 30 * mib},
+			},
+		},
+		{
+			name:     "single node",
+			topology: []*NUMANode{node0},
+			initrd:   initrd,
+			want: []kexec.Range{
+				{Start: 16 * mib, Size: 8*mib + 4096},
+				{Start: 1024*mib - 30*mib, Size: 30 * mib},
+			},
+		},
+		{
+			name:     "no initrd",
+			topology: []*NUMANode{node1, node0},
+			want:     []kexec.Range{{Start: 16 * mib, Size: 8*mib + 4096}},
+		},
+		{
+			name:     "tight",
+			topology: []*NUMANode{small0},
+			initrd:   make([]byte, 7*mib),
+			want: []kexec.Range{
+				{Start: 16 * mib, Size: 8*mib + 4096},
+				{Start: 32*mib - 7*mib, Size: 7 * mib},
+			},
+		},
+		{
+			name:     "below kernel",
+			topology: []*NUMANode{small0},
+			initrd:   make([]byte, 8*mib),
+			want: []kexec.Range{
+				{Start: 16 * mib, Size: 8*mib + 4096},
+				{Start: 8 * mib, Size: 8 * mib},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			segs, err := KexecSegmentsForNUMA(kernel, tt.initrd, tt.topology)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []kexec.Range
+			for _, s := range segs {
+				got = append(got, s.Phys)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("segments = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		name     string
+		topology []*NUMANode
+		initrd   []byte
+	}{
+		{"empty", nil, nil},
+		{"no node 0", []*NUMANode{node1}, nil},
+		{"kernel too big", []*NUMANode{{ID: 0, Memory: []kexec.Range{{Start: 0, Size: 20 * mib}}}}, nil},
+		{"initrd too big", []*NUMANode{small0}, make([]byte, 17*mib)},
+	} {
+		if _, err := KexecSegmentsForNUMA(kernel, tt.initrd, tt.topology); err == nil {
+			t.Errorf("%s: KexecSegmentsForNUMA = nil, want error", tt.name)
+		}
+	}
+}
+
+func TestWithNUMAAwareness(t *testing.T) {
+	dir := mockSysfs(t)
+	defer os.RemoveAll(dir)
+	defer func(n, m string) { nodeDir, memoryDir = n, m }(nodeDir, memoryDir)
+	nodeDir, memoryDir = filepath.Join(dir, "node"), filepath.Join(dir, "memory")
+
+	li := boot.NewLinuxImage(bytes.NewReader([]byte("kernel")), bytes.NewReader([]byte("initrd")), "", WithNUMAAwareness())
+	if li.Placement == nil {
+		t.Fatal("WithNUMAAwareness did not set Placement")
+	}
+
+	var out bytes.Buffer
+	li.ExecutionInfo(log.New(&out, "", 0))
+	for _, want := range []string{
+		"Segment: 6 bytes at [0x1000000, 0x1001000)",
+		"Segment: 6 bytes at [0x13ffff000, 0x140000000)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("ExecutionInfo = %q, want it to contain %q", out.String(), want)
+		}
+	}
+}
+
+func TestKexecSegmentsForNUMABzImage(t *testing.T) {
+	// A bzImage takes init_size bytes, not its file size.
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, bzimage.LinuxHeader{HeaderMagic: bzimage.HeaderMagic, InitSize: 20 * mib}); err != nil {
+		t.Fatal(err)
+	}
+	node0 := &NUMANode{ID: 0, Memory: []kexec.Range{{Start: 0, Size: 64 * mib}}}
+	segs, err := KexecSegmentsForNUMA(b.Bytes(), make([]byte, 8*mib), []*NUMANode{node0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []kexec.Range
+	for _, s := range segs {
+		got = append(got, s.Phys)
+	}
+	if want := []kexec.Range{{Start: 16 * mib, Size: 20 * mib}, {Start: 56 * mib, Size: 8 * mib}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segments = %v, want %v", got, want)
+	}
+
+	// 30 MiB fits above the file, but not above init_size.
+	if segs, err := KexecSegmentsForNUMA(b.Bytes(), make([]byte, 30*mib), []*NUMANode{node0}); err == nil {
+		t.Errorf("KexecSegmentsForNUMA = %v, want error", segs)
+	}
+}
+
+func TestWithNUMAAwarenessNoNUMA(t *testing.T) {
+	defer func(n string) { nodeDir = n }(nodeDir)
+	nodeDir = "/nonexistent"
+
+	li := boot.NewLinuxImage(bytes.NewReader([]byte("kernel")), bytes.NewReader([]byte("initrd")), "", WithNUMAAwareness())
+	if segs, err := li.Placement([]byte("kernel"), []byte("initrd")); segs != nil || err != nil {
+		t.Errorf("Placement without NUMA = %v, %v, want nil, nil", segs, err)
+	}
+	if err := li.Validate(); err != nil {
+		t.Errorf("Validate() without NUMA = %v, want nil", err)
+	}
+	var out bytes.Buffer
+	li.ExecutionInfo(log.New(&out, "", 0))
+	if strings.Contains(out.String(), "Placing segments") || strings.Contains(out.String(), "Segment:") {
+		t.Errorf("ExecutionInfo without NUMA = %q, want no segments", out.String())
+	}
+}
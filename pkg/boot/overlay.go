@@ -0,0 +1,27 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package boot
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// WithInitrdOverlay adds the files in overlay to the initrd li boots with,
+// and returns li.
+//
+// The overlay is appended as another cpio archive when li is executed, so
+// the base initrd is not changed. Since the kernel unpacks archives in
+// order, overlay files replace files of the same name in the base initrd.
+func (li *LinuxImage) WithInitrdOverlay(overlay fs.FS) *LinuxImage {
+	li.overlays = append(li.overlays, func(w io.Writer) error {
+		return cpio.ArchiveFromFS(w, overlay, cpio.ArchiveOptions{})
+	})
+	return li
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package boot
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// unpack returns the contents of the files in the newc archive b, by name.
+func unpack(t *testing.T, files map[string]string, b []byte) {
+	t.Helper()
+	recs, err := cpio.ReadAllRecords(cpio.Newc.Reader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		c, err := uio.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Later archives replace earlier files, as in the kernel.
+		files[cpio.Normalize(r.Name)] = string(c)
+	}
+}
+
+func TestInitrdOverlay(t *testing.T) {
+	var base bytes.Buffer
+	w := cpio.Newc.Writer(&base)
+	if err := cpio.WriteRecords(w, []cpio.Record{
+		cpio.Directory("etc", 0755),
+		cpio.StaticFile("etc/hostname", "base\n", 0644),
+		cpio.StaticFile("init", "#!/bin/sh\n", 0755),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	// Make the base end unaligned.
+	base.WriteString("x")
+
+	overlay := fstest.MapFS{
+		"etc/hostname": {Data: []byte("overlay\n"), Mode: 0644},
+	}
+	li := &LinuxImage{
+		Kernel: strings.NewReader("kernel"),
+		Initrd: bytes.NewReader(base.Bytes()),
+	}
+	if got := li.WithInitrdOverlay(overlay); got != li {
+		t.Errorf("WithInitrdOverlay = %p, want %p", got, li)
+	}
+
+	r, closeInitrd, err := li.initrd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeInitrd()
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(b, base.Bytes()) {
+		t.Fatalf("initrd does not start with the base initrd")
+	}
+	off := (base.Len() + 3) &^ 3
+	if !bytes.Equal(b[base.Len():off], make([]byte, off-base.Len())) {
+		t.Errorf("padding after base = %q, want zeroes", b[base.Len():off])
+	}
+
+	files := make(map[string]string)
+	unpack(t, files, base.Bytes())
+	unpack(t, files, b[off:])
+	if got := files["etc/hostname"]; got != "overlay\n" {
+		t.Errorf("etc/hostname = %q, want overlay", got)
+	}
+	if got := files["init"]; got != "#!/bin/sh\n" {
+		t.Errorf("init = %q, want it from the base initrd", got)
+	}
+	if _, ok := files["etc"]; !ok {
+		t.Errorf("overlay has no etc directory")
+	}
+
+	// The base image itself is left alone.
+	if _, err := li.Initrd.ReadAt(make([]byte, 1), int64(base.Len())); err == nil {
+		t.Errorf("li.Initrd grew")
+	}
+}
+
+func TestInitrdSizeOverlay(t *testing.T) {
+	for _, initrd := range []io.ReaderAt{nil, strings.NewReader("initrd")} {
+		li := &LinuxImage{Kernel: strings.NewReader("kernel"), Initrd: initrd}
+		li = li.WithInitrdOverlay(fstest.MapFS{"a": {Data: []byte("1")}}).
+			WithInitrdOverlay(fstest.MapFS{"b": {Data: []byte("22")}})
+
+		r, closeInitrd, err := li.initrd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeInitrd()
+		want, err := uio.Size(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := li.initrdSize(); err != nil || got != want {
+			t.Errorf("initrdSize() with initrd %v = %d, %v, want %d", initrd != nil, got, err, want)
+		}
+	}
+}
+
+func TestInitrdOverlayWithoutInitrd(t *testing.T) {
+	li := (&LinuxImage{Kernel: strings.NewReader("kernel")}).
+		WithInitrdOverlay(fstest.MapFS{"a": {Data: []byte("1")}}).
+		WithInitrdOverlay(fstest.MapFS{"a": {Data: []byte("2")}, "b": {Data: []byte("3")}})
+
+	r, closeInitrd, err := li.initrd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeInitrd()
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	// The second overlay is an archive of its own.
+	var first bytes.Buffer
+	w := cpio.Newc.Writer(&first)
+	if err := cpio.WriteRecords(w, []cpio.Record{cpio.StaticFile("a", "1", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	cpio.WriteTrailer(w)
+	if !bytes.HasPrefix(b, first.Bytes()) {
+		t.Fatalf("initrd does not start with an archive of the first overlay")
+	}
+	unpack(t, files, b[:first.Len()])
+	unpack(t, files, b[first.Len():])
+	if files["a"] != "2" || files["b"] != "3" {
+		t.Errorf("files = %v, want a=2 and b=3", files)
+	}
+}
+
+func TestInitrdOverlaySymlink(t *testing.T) {
+	overlay := fstest.MapFS{"link": {Data: []byte("target"), Mode: fs.ModeSymlink | 0777}}
+	li := (&LinuxImage{Kernel: strings.NewReader("kernel")}).WithInitrdOverlay(overlay)
+	r, closeInitrd, err := li.initrd()
+	// Symlinks are only archived from file systems that can read them.
+	if _, ok := fs.FS(overlay).(interface{ ReadLink(string) (string, error) }); !ok {
+		if err == nil {
+			t.Errorf("initrd with a symlink overlay = nil, want error")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeInitrd()
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	unpack(t, files, b)
+	if files["link"] != "target" {
+		t.Errorf("link = %q, want a symlink to target", files["link"])
+	}
+}
+
+func TestInstallSystemdBootEntryOverlay(t *testing.T) {
+	esp, err := ioutil.TempDir("", "esp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(esp)
+
+	// Without Initrd, the overlay is the initrd.
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "quiet").
+		WithInitrdOverlay(fstest.MapFS{"etc/hostname": {Data: []byte("overlay\n")}})
+	if err := InstallSystemdBootEntry(li, esp, "u-root"); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ioutil.ReadFile(filepath.Join(esp, "loader/entries/u-root.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "title u-root\nlinux /u-root/linux\ninitrd /u-root/initrd\noptions quiet\n"; string(conf) != want {
+		t.Errorf("entry = %q, want %q", conf, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(esp, "u-root/initrd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	unpack(t, files, b)
+	if files["etc/hostname"] != "overlay\n" {
+		t.Errorf("installed initrd has files %q, want etc/hostname from the overlay", files)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/u-root/u-root/pkg/cpio"
@@ -46,6 +47,9 @@ func (p *Package) AddMetadata(relPath string, content string) {
 // to keep using RSA here. Make usable with TPM.
 func (p *Package) Pack(w cpio.RecordWriter, signer *rsa.PrivateKey) error {
 	sw := NewSigningWriter(w)
+	if err := sw.WriteRecord(cpio.StaticFile(formatVersionPath, strconv.Itoa(CurrentFormatVersion), 0700)); err != nil {
+		return err
+	}
 
 	if len(p.Metadata) > 0 {
 		if err := sw.WriteRecord(cpio.Directory("metadata", 0700)); err != nil {
@@ -82,6 +86,10 @@ func (p *Package) Unpack(rr cpio.RecordReader, pk *rsa.PublicKey) error {
 	if err != nil {
 		return err
 	}
+	// A newer format may also be signed differently.
+	if err := checkFormatVersion(a); err != nil {
+		return err
+	}
 	if pk != nil {
 		if err := recs.Verify(pk); err != nil {
 			return err
@@ -0,0 +1,100 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// ctxReader is a Reader that fails once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// prefetch reads all of r into a temporary file. The file is removed at
+// once, so it lasts as long as it is open.
+func prefetch(ctx context.Context, r io.ReaderAt) (*os.File, error) {
+	f, err := ioutil.TempFile("", "nerf-prefetch")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := io.Copy(f, ctxReader{ctx, uio.Reader(r)}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// PrefetchParallel reads all of the kernel and initrd of li into temporary
+// files at the same time, and replaces them with the files, so that Execute
+// loads them from local storage. When the kernel and initrd come from the
+// network, this takes as long as the slower of them, where Execute on its
+// own would fetch one after the other.
+//
+// li is changed only if both are read. Reading stops once ctx is done.
+func (li *LinuxImage) PrefetchParallel(ctx context.Context) error {
+	if li.Kernel == nil {
+		return ErrKernelMissing
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		f   *os.File
+		err error
+	}
+	start := func(r io.ReaderAt) <-chan result {
+		c := make(chan result, 1)
+		if r == nil {
+			c <- result{}
+			return c
+		}
+		go func() {
+			f, err := prefetch(ctx, r)
+			if err != nil {
+				// The other has no use any more.
+				cancel()
+			}
+			c <- result{f, err}
+		}()
+		return c
+	}
+	kc, ic := start(li.Kernel), start(li.Initrd)
+	k, i := <-kc, <-ic
+
+	if k.err != nil || i.err != nil {
+		for _, f := range []*os.File{k.f, i.f} {
+			if f != nil {
+				f.Close()
+			}
+		}
+		// The first error is what cancelled the other.
+		if k.err != nil && (i.err == nil || i.err == context.Canceled) {
+			return fmt.Errorf("prefetching kernel: %v", k.err)
+		}
+		return fmt.Errorf("prefetching initrd: %v", i.err)
+	}
+	li.logf("prepare", "Prefetched kernel and initrd")
+	li.Kernel = k.f
+	if i.f != nil {
+		li.Initrd = i.f
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// httpReaderAt reads url with a range request for each ReadAt.
+type httpReaderAt struct {
+	url string
+}
+
+func (h httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	req, err := http.NewRequest("GET", h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// slowReader reads at rate bytes a second.
+type slowReader struct {
+	*bytes.Reader
+	rate int
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(s.rate))
+	return n, err
+}
+
+// slowServer serves data at rate bytes a second, on a link of its own.
+func slowServer(data []byte, rate int, handler func()) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil {
+			handler()
+		}
+		http.ServeContent(w, r, "file", time.Time{}, slowReader{bytes.NewReader(data), rate})
+	}))
+}
+
+func TestPrefetchParallel(t *testing.T) {
+	kernel := bytes.Repeat([]byte("kernel"), 100000)
+	initrd := bytes.Repeat([]byte("initrd"), 50000)
+
+	// Each server holds its first request until the other has one, so
+	// fetching one after the other times out.
+	kernelReq, initrdReq := make(chan struct{}), make(chan struct{})
+	var kernelOnce, initrdOnce sync.Once
+	meet := func(once *sync.Once, mine, other chan struct{}) func() {
+		return func() {
+			once.Do(func() {
+				close(mine)
+				select {
+				case <-other:
+				case <-time.After(5 * time.Second):
+					t.Errorf("kernel and initrd were not fetched at the same time")
+				}
+			})
+		}
+	}
+	ks := slowServer(kernel, 1<<30, meet(&kernelOnce, kernelReq, initrdReq))
+	defer ks.Close()
+	is := slowServer(initrd, 1<<30, meet(&initrdOnce, initrdReq, kernelReq))
+	defer is.Close()
+
+	li := NewLinuxImage(httpReaderAt{ks.URL}, httpReaderAt{is.URL}, "")
+	if err := li.PrefetchParallel(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		r    io.ReaderAt
+		want []byte
+	}{
+		{"kernel", li.Kernel, kernel},
+		{"initrd", li.Initrd, initrd},
+	} {
+		f, ok := tt.r.(*os.File)
+		if !ok {
+			t.Errorf("%s is a %T after PrefetchParallel, want a file", tt.name, tt.r)
+			continue
+		}
+		defer f.Close()
+		// The servers are gone: what is read now comes from the file.
+		ks.Close()
+		is.Close()
+		if b, err := uio.ReadAll(f); err != nil || !bytes.Equal(b, tt.want) {
+			t.Errorf("%s after PrefetchParallel has %d bytes, %v, want %d bytes", tt.name, len(b), err, len(tt.want))
+		}
+	}
+}
+
+func TestPrefetchParallelNoInitrd(t *testing.T) {
+	li := NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	if err := li.PrefetchParallel(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if li.Initrd != nil {
+		t.Errorf("initrd is %v after PrefetchParallel, want none", li.Initrd)
+	}
+	if b, err := uio.ReadAll(li.Kernel); err != nil || string(b) != "kernel" {
+		t.Errorf("kernel after PrefetchParallel = %q, %v, want kernel", b, err)
+	}
+	li.Kernel.(*os.File).Close()
+
+	if err := (&LinuxImage{}).PrefetchParallel(context.Background()); err != ErrKernelMissing {
+		t.Errorf("PrefetchParallel() without kernel = %v, want %v", err, ErrKernelMissing)
+	}
+}
+
+func TestPrefetchParallelErrors(t *testing.T) {
+	kernel, initrd := strings.NewReader("kernel"), strings.NewReader("initrd")
+	bad := &errorReaderAt{io.ErrUnexpectedEOF}
+	for _, tt := range []struct {
+		name           string
+		kernel, initrd io.ReaderAt
+		want           string
+	}{
+		{"kernel fails", bad, initrd, "prefetching kernel: unexpected EOF"},
+		{"initrd fails", kernel, bad, "prefetching initrd: unexpected EOF"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			li := NewLinuxImage(tt.kernel, tt.initrd, "")
+			err := li.PrefetchParallel(context.Background())
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("PrefetchParallel() = %v, want %s", err, tt.want)
+			}
+			if li.Kernel != tt.kernel || li.Initrd != tt.initrd {
+				t.Errorf("PrefetchParallel() changed the image on error")
+			}
+		})
+	}
+
+	// A slow fetch stops when the context is done.
+	s := slowServer(make([]byte, 1<<20), 1<<20, nil)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	li := NewLinuxImage(httpReaderAt{s.URL}, nil, "")
+	if err := li.PrefetchParallel(ctx); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("PrefetchParallel() past the deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("PrefetchParallel() took %v past the deadline", d)
+	}
+}
+
+// BenchmarkPrefetch fetches a 50 MB kernel and a 50 MB initrd, each from a
+// server on a 100 Mbps link, one after the other and in parallel.
+func BenchmarkPrefetch(b *testing.B) {
+	const size = 50 << 20
+	const rate = 100 << 20 / 8
+	ks := slowServer(make([]byte, size), rate, nil)
+	defer ks.Close()
+	is := slowServer(make([]byte, size), rate, nil)
+	defer is.Close()
+
+	for _, parallel := range []bool{false, true} {
+		b.Run(fmt.Sprintf("parallel=%v", parallel), func(b *testing.B) {
+			b.SetBytes(2 * size)
+			for i := 0; i < b.N; i++ {
+				li := NewLinuxImage(httpReaderAt{ks.URL}, httpReaderAt{is.URL}, "")
+				if parallel {
+					if err := li.PrefetchParallel(context.Background()); err != nil {
+						b.Fatal(err)
+					}
+					li.Kernel.(*os.File).Close()
+					li.Initrd.(*os.File).Close()
+					continue
+				}
+				for _, r := range []io.ReaderAt{li.Kernel, li.Initrd} {
+					f, err := prefetch(context.Background(), r)
+					if err != nil {
+						b.Fatal(err)
+					}
+					f.Close()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pxeserver serves a Linux kernel and initramfs to PXE clients.
+//
+// A PXEServer answers DHCP requests on one interface with an address and
+// the location of a syslinux config, and serves that config, the kernel and
+// the initramfs over TFTP.
+package pxeserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u-root/dhcp4"
+	"github.com/u-root/dhcp4/dhcp4client"
+	"github.com/u-root/dhcp4/dhcp4opts"
+	"pack.ag/tftp"
+)
+
+// ConfigPath is the path of the syslinux config clients are pointed to.
+const ConfigPath = "pxelinux.cfg/default"
+
+// The names the kernel and initramfs are served as.
+const (
+	kernelName = "linux"
+	initrdName = "initrd"
+)
+
+// LeaseTime is how long clients may keep their address.
+const LeaseTime = time.Hour
+
+var (
+	dhcpPort   = dhcp4client.ServerPort
+	clientPort = dhcp4client.ClientPort
+	tftpPort   = 69
+)
+
+// PXEServer serves KernelPath and InitrdPath to PXE clients on Iface.
+type PXEServer struct {
+	// Iface is the interface to answer DHCP requests on.
+	Iface string
+
+	// KernelPath is the kernel to boot.
+	KernelPath string
+
+	// InitrdPath is the initramfs to boot. It is optional.
+	InitrdPath string
+
+	// Cmdline is the kernel command line.
+	Cmdline string
+
+	// BindAddr is the IPv4 address of the server on Iface, optionally
+	// with a prefix length as in "192.168.0.1/24". Clients are offered the
+	// other addresses of its subnet. If BindAddr has no prefix length,
+	// the one of the same address of Iface is used. If BindAddr is empty,
+	// the first IPv4 address of Iface is used.
+	BindAddr string
+}
+
+// addr returns the IP of s and its subnet.
+func (s *PXEServer) addr() (net.IP, *net.IPNet, error) {
+	if strings.Contains(s.BindAddr, "/") {
+		ip, ipnet, err := net.ParseCIDR(s.BindAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ip.To4() == nil {
+			return nil, nil, fmt.Errorf("%s is not an IPv4 address", s.BindAddr)
+		}
+		return ip.To4(), ipnet, nil
+	}
+
+	var want net.IP
+	if s.BindAddr != "" {
+		if want = net.ParseIP(s.BindAddr).To4(); want == nil {
+			return nil, nil, fmt.Errorf("%q is not an IPv4 address", s.BindAddr)
+		}
+	}
+	ifc, err := net.InterfaceByName(s.Iface)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if want == nil || want.Equal(ipnet.IP) {
+			return ipnet.IP.To4(), &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}, nil
+		}
+	}
+	if want != nil {
+		return nil, nil, fmt.Errorf("%s has no address %s", s.Iface, want)
+	}
+	return nil, nil, fmt.Errorf("%s has no IPv4 address", s.Iface)
+}
+
+// Serve answers DHCP requests on s.Iface and serves the boot files over TFTP
+// until ctx is done, in which case it returns ctx.Err(), or either server
+// fails.
+func (s *PXEServer) Serve(ctx context.Context) error {
+	ip, ipnet, err := s.addr()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.KernelPath); err != nil {
+		return err
+	}
+	if s.InitrdPath != "" {
+		if _, err := os.Stat(s.InitrdPath); err != nil {
+			return err
+		}
+	}
+
+	dconn, err := dhcp4client.NewIPv4UDPConn(s.Iface, dhcpPort)
+	if err != nil {
+		return fmt.Errorf("DHCP server: %v", err)
+	}
+	defer dconn.Close()
+	tconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: tftpPort})
+	if err != nil {
+		return fmt.Errorf("TFTP server: %v", err)
+	}
+	// tftp.Server.Close races with Serve, so stop it by closing its conn.
+	defer tconn.Close()
+	ts, err := tftp.NewServer("")
+	if err != nil {
+		return err
+	}
+	ts.ReadHandler(tftp.ReadHandlerFunc(s.serveFile))
+
+	d := newDHCPServer(ip, ipnet)
+	errs := make(chan error, 2)
+	go func() {
+		if err := ts.Serve(tconn); err != nil {
+			errs <- fmt.Errorf("TFTP server: %v", err)
+		}
+	}()
+	go func() {
+		errs <- fmt.Errorf("DHCP server: %v", d.serve(dconn))
+	}()
+	log.Printf("Serving %s on %s (%s)", s.KernelPath, s.Iface, ip)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errs:
+		return err
+	}
+}
+
+// config returns the syslinux config pointing at the files of s.
+func (s *PXEServer) config() string {
+	c := fmt.Sprintf("default %s\n\nlabel %s\n  kernel %s\n", kernelName, kernelName, kernelName)
+	if s.InitrdPath != "" {
+		c += fmt.Sprintf("  initrd %s\n", initrdName)
+	}
+	if s.Cmdline != "" {
+		c += fmt.Sprintf("  append %s\n", s.Cmdline)
+	}
+	return c
+}
+
+// serveFile answers a TFTP read request.
+func (s *PXEServer) serveFile(r tftp.ReadRequest) {
+	var path string
+	switch name := strings.TrimPrefix(r.Name(), "/"); {
+	case name == ConfigPath:
+		c := s.config()
+		r.WriteSize(int64(len(c)))
+		io.WriteString(r, c)
+		return
+	case name == kernelName:
+		path = s.KernelPath
+	case name == initrdName && s.InitrdPath != "":
+		path = s.InitrdPath
+	default:
+		r.WriteError(tftp.ErrCodeFileNotFound, fmt.Sprintf("%s not found", name))
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		r.WriteError(tftp.ErrCodeFileNotFound, err.Error())
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		r.WriteSize(fi.Size())
+	}
+	if _, err := io.Copy(r, f); err != nil {
+		log.Printf("TFTP: sending %s to %s: %v", path, r.Addr(), err)
+	}
+}
+
+// dhcpServer hands out the addresses of a subnet.
+type dhcpServer struct {
+	ip     net.IP
+	subnet *net.IPNet
+
+	mu     sync.Mutex
+	leases map[string]net.IP
+}
+
+func newDHCPServer(ip net.IP, subnet *net.IPNet) *dhcpServer {
+	return &dhcpServer{
+		ip:     ip,
+		subnet: subnet,
+		leases: make(map[string]net.IP),
+	}
+}
+
+// serve answers the requests read from conn until reading fails.
+func (d *dhcpServer) serve(conn net.PacketConn) error {
+	b := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		req := &dhcp4.Packet{}
+		if err := req.UnmarshalBinary(b[:n]); err != nil {
+			continue
+		}
+		reply := d.reply(req)
+		if reply == nil {
+			continue
+		}
+		p, err := reply.MarshalBinary()
+		if err != nil {
+			log.Printf("DHCP: %v", err)
+			continue
+		}
+		if _, err := conn.WriteTo(p, replyAddr(req)); err != nil {
+			log.Printf("DHCP: replying to %s: %v", req.CHAddr, err)
+		}
+	}
+}
+
+// replyAddr returns where the reply to req goes, as in RFC 2131, Section 4.1.
+func replyAddr(req *dhcp4.Packet) *net.UDPAddr {
+	switch {
+	case len(req.GIAddr) > 0 && !req.GIAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.GIAddr, Port: dhcpPort}
+	case !req.Broadcast && len(req.CIAddr) > 0 && !req.CIAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.CIAddr, Port: clientPort}
+	default:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}
+	}
+}
+
+// lease returns the address of the client with hardware address mac, picking
+// a free one if it has none yet, or nil if the subnet is exhausted.
+func (d *dhcpServer) lease(mac net.HardwareAddr) net.IP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ip, ok := d.leases[mac.String()]; ok {
+		return ip
+	}
+
+	used := make(map[string]bool)
+	for _, ip := range d.leases {
+		used[ip.String()] = true
+	}
+	base := binary.BigEndian.Uint32(d.subnet.IP.To4())
+	ones, bits := d.subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	start := binary.BigEndian.Uint32(d.ip) - base
+	// Skip the network and broadcast addresses.
+	for i := uint32(1); i < size; i++ {
+		host := (start + i) % size
+		if host == 0 || host == size-1 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+host)
+		if ip.Equal(d.ip) || used[ip.String()] {
+			continue
+		}
+		d.leases[mac.String()] = ip
+		return ip
+	}
+	return nil
+}
+
+// reply returns the answer to req, or nil if there is none.
+func (d *dhcpServer) reply(req *dhcp4.Packet) *dhcp4.Packet {
+	if req.Op != dhcp4.BootRequest {
+		return nil
+	}
+
+	var typ dhcp4opts.DHCPMessageType
+	switch dhcp4opts.GetDHCPMessageType(req.Options) {
+	case dhcp4opts.DHCPDiscover:
+		typ = dhcp4opts.DHCPOffer
+	case dhcp4opts.DHCPRequest:
+		if sid := dhcp4opts.GetServerIdentifier(req.Options); sid != nil && !net.IP(sid).Equal(d.ip) {
+			// The client took another offer.
+			return nil
+		}
+		typ = dhcp4opts.DHCPACK
+	default:
+		return nil
+	}
+
+	ip := d.lease(req.CHAddr)
+	if ip == nil {
+		log.Printf("DHCP: no address left for %s", req.CHAddr)
+		return nil
+	}
+	if typ == dhcp4opts.DHCPACK {
+		want := net.IP(dhcp4opts.GetRequestedIPAddress(req.Options))
+		if want == nil {
+			want = req.CIAddr
+		}
+		if !ip.Equal(want) {
+			typ = dhcp4opts.DHCPNAK
+		}
+	}
+
+	p := dhcp4.NewPacket(dhcp4.BootReply)
+	p.HType = req.HType
+	p.TransactionID = req.TransactionID
+	p.Broadcast = req.Broadcast
+	p.GIAddr = req.GIAddr
+	p.CHAddr = req.CHAddr
+	p.Options.Add(dhcp4.OptionDHCPMessageType, typ)
+	p.Options.Add(dhcp4.OptionServerIdentifier, dhcp4opts.IP(d.ip))
+	if typ == dhcp4opts.DHCPNAK {
+		return p
+	}
+
+	lease := make([]byte, 4)
+	binary.BigEndian.PutUint32(lease, uint32(LeaseTime/time.Second))
+	p.YIAddr = ip
+	p.SIAddr = d.ip
+	p.BootFile = ConfigPath
+	p.Options.Add(dhcp4.OptionSubnetMask, dhcp4opts.SubnetMask(d.subnet.Mask))
+	p.Options.AddRaw(dhcp4.OptionIPAddressLeaseTime, lease)
+	p.Options.Add(dhcp4.OptionTFTPServerName, dhcp4opts.String(d.ip.String()))
+	p.Options.Add(dhcp4.OptionBootFileName, dhcp4opts.String(ConfigPath))
+	return p
+}
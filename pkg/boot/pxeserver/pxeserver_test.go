@@ -0,0 +1,284 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pxeserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/u-root/dhcp4"
+	"github.com/u-root/dhcp4/dhcp4client"
+	"github.com/u-root/dhcp4/dhcp4opts"
+	"github.com/u-root/u-root/pkg/pxe"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"pack.ag/tftp"
+)
+
+func request(typ dhcp4opts.DHCPMessageType, mac byte, opts map[dhcp4.OptionCode]net.IP) *dhcp4.Packet {
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	p.TransactionID = [4]byte{1, 2, 3, mac}
+	p.CHAddr = net.HardwareAddr{2, 0, 0, 0, 0, mac}
+	p.Broadcast = true
+	p.Options.Add(dhcp4.OptionDHCPMessageType, typ)
+	for code, ip := range opts {
+		p.Options.Add(code, dhcp4opts.IP(ip))
+	}
+	return p
+}
+
+func TestReply(t *testing.T) {
+	server := net.IPv4(10, 0, 0, 1).To4()
+	d := newDHCPServer(server, &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(29, 32)})
+
+	offer := d.reply(request(dhcp4opts.DHCPDiscover, 1, nil))
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+	client := net.IPv4(10, 0, 0, 2).To4()
+	if got := dhcp4opts.GetDHCPMessageType(offer.Options); got != dhcp4opts.DHCPOffer {
+		t.Errorf("message type = %v, want offer", got)
+	}
+	if offer.Op != dhcp4.BootReply || offer.TransactionID != [4]byte{1, 2, 3, 1} {
+		t.Errorf("offer = %+v, want a reply to transaction 1.2.3.1", offer)
+	}
+	if !offer.YIAddr.Equal(client) || !offer.SIAddr.Equal(server) || offer.BootFile != ConfigPath {
+		t.Errorf("offer of %s from %s with %q, want %s from %s with %q", offer.YIAddr, offer.SIAddr, offer.BootFile, client, server, ConfigPath)
+	}
+	for code, want := range map[dhcp4.OptionCode]string{
+		dhcp4.OptionTFTPServerName: "10.0.0.1",
+		dhcp4.OptionBootFileName:   ConfigPath,
+	} {
+		if got := dhcp4opts.GetString(code, offer.Options); got != want {
+			t.Errorf("option %d = %q, want %q", code, got, want)
+		}
+	}
+	if got := net.IPMask(dhcp4opts.GetSubnetMask(offer.Options)).String(); got != "fffffff8" {
+		t.Errorf("subnet mask = %s, want fffffff8", got)
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts map[dhcp4.OptionCode]net.IP
+		want dhcp4opts.DHCPMessageType
+	}{
+		{"offered address", map[dhcp4.OptionCode]net.IP{dhcp4.OptionRequestedIPAddress: client, dhcp4.OptionServerIdentifier: server}, dhcp4opts.DHCPACK},
+		{"other address", map[dhcp4.OptionCode]net.IP{dhcp4.OptionRequestedIPAddress: net.IPv4(10, 0, 0, 5)}, dhcp4opts.DHCPNAK},
+		{"other server", map[dhcp4.OptionCode]net.IP{dhcp4.OptionRequestedIPAddress: client, dhcp4.OptionServerIdentifier: net.IPv4(10, 0, 0, 6)}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := d.reply(request(dhcp4opts.DHCPRequest, 1, tt.opts))
+			if tt.want == 0 {
+				if reply != nil {
+					t.Errorf("reply = %+v, want none", reply)
+				}
+				return
+			}
+			if reply == nil {
+				t.Fatal("no reply")
+			}
+			if got := dhcp4opts.GetDHCPMessageType(reply.Options); got != tt.want {
+				t.Errorf("message type = %v, want %v", got, tt.want)
+			}
+			if tt.want == dhcp4opts.DHCPACK && !reply.YIAddr.Equal(client) {
+				t.Errorf("ACK of %s, want %s", reply.YIAddr, client)
+			}
+		})
+	}
+
+	// 10.0.0.3 to 10.0.0.6 are left.
+	for mac := byte(2); mac <= 5; mac++ {
+		offer := d.reply(request(dhcp4opts.DHCPDiscover, mac, nil))
+		if want := net.IPv4(10, 0, 0, mac+1); offer == nil || !offer.YIAddr.Equal(want) {
+			t.Fatalf("offer to client %d = %+v, want %s", mac, offer, want)
+		}
+	}
+	if offer := d.reply(request(dhcp4opts.DHCPDiscover, 6, nil)); offer != nil {
+		t.Errorf("offer of %s from an exhausted subnet", offer.YIAddr)
+	}
+}
+
+// bootFiles writes a kernel and an initramfs and returns a server for them.
+func bootFiles(t *testing.T) (*PXEServer, func()) {
+	dir, err := ioutil.TempDir("", "pxeserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &PXEServer{
+		KernelPath: filepath.Join(dir, "bzImage"),
+		InitrdPath: filepath.Join(dir, "initramfs.cpio"),
+		Cmdline:    "console=ttyS0 earlyprintk",
+	}
+	if err := ioutil.WriteFile(s.KernelPath, []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.InitrdPath, []byte("initramfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// checkBoot fetches and checks the config of s from the TFTP server at host.
+func checkBoot(t *testing.T, s *PXEServer, host string) {
+	wd := &url.URL{Scheme: "tftp", Host: host, Path: "/"}
+	c, err := pxe.ParseConfigFile(ConfigPath, wd)
+	if err != nil {
+		t.Fatalf("ParseConfigFile() = %v", err)
+	}
+	li, ok := c.Entries[c.DefaultEntry]
+	if !ok {
+		t.Fatalf("no default entry in %+v", c)
+	}
+	if li.Cmdline != s.Cmdline {
+		t.Errorf("command line = %q, want %q", li.Cmdline, s.Cmdline)
+	}
+	for _, f := range []struct {
+		name string
+		r    io.ReaderAt
+		want string
+	}{
+		{"kernel", li.Kernel, "kernel"},
+		{"initramfs", li.Initrd, "initramfs"},
+	} {
+		b, err := uio.ReadAll(f.r)
+		if err != nil {
+			t.Errorf("reading %s: %v", f.name, err)
+		} else if string(b) != f.want {
+			t.Errorf("%s = %q, want %q", f.name, b, f.want)
+		}
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	s, cleanup := bootFiles(t)
+	defer cleanup()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := tftp.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.ReadHandler(tftp.ReadHandlerFunc(s.serveFile))
+	go ts.Serve(conn)
+	defer ts.Close()
+
+	checkBoot(t, s, conn.LocalAddr().String())
+
+	c, err := tftp.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(fmt.Sprintf("tftp://%s/bzImage", conn.LocalAddr())); err == nil {
+		t.Errorf("Get(bzImage) succeeded, want only %s to be served", kernelName)
+	}
+}
+
+// TestServe boots a DHCP client in another network namespace, connected to
+// the server by a veth pair.
+func TestServe(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("not root")
+	}
+	s, cleanup := bootFiles(t)
+	defer cleanup()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	host, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "pxes0"}, PeerName: "pxec0"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("creating veth pair: %v", err)
+	}
+	defer netlink.LinkDel(veth)
+	addr, _ := netlink.ParseAddr("192.168.77.1/24")
+	if err := netlink.AddrAdd(veth, addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := netlink.LinkByName("pxec0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Iface = "pxes0"
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("Serve() = %v, want %v", err, context.Canceled)
+		}
+	}()
+
+	client, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer netns.Set(host)
+	if err := netns.Set(host); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(client)); err != nil {
+		t.Fatal(err)
+	}
+	// From here on, this thread is the client.
+	if err := netns.Set(client); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err = netlink.LinkByName("pxec0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := dhcp4client.New(peer, dhcp4client.WithTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ack, err := c.Request()
+	if err != nil {
+		t.Fatalf("Request() = %v", err)
+	}
+	if got := dhcp4opts.GetDHCPMessageType(ack.Options); got != dhcp4opts.DHCPACK {
+		t.Fatalf("message type = %v, want ACK", got)
+	}
+	if want := net.IPv4(192, 168, 77, 2); !ack.YIAddr.Equal(want) {
+		t.Errorf("leased %s, want %s", ack.YIAddr, want)
+	}
+	server := dhcp4opts.GetString(dhcp4.OptionTFTPServerName, ack.Options)
+	if server != "192.168.77.1" || ack.BootFile != ConfigPath {
+		t.Errorf("boot file %s on %q, want %s on 192.168.77.1", ack.BootFile, server, ConfigPath)
+	}
+
+	lease := &netlink.Addr{IPNet: &net.IPNet{IP: ack.YIAddr, Mask: net.IPMask(dhcp4opts.GetSubnetMask(ack.Options))}}
+	if err := netlink.AddrAdd(peer, lease); err != nil {
+		t.Fatal(err)
+	}
+	checkBoot(t, s, server)
+}
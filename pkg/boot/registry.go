@@ -0,0 +1,158 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// TaggedImage is an OSImage with a name, tags such as "production" or
+// "recovery" to find it by, and a priority to choose the default image by.
+type TaggedImage struct {
+	Image    OSImage
+	Name     string
+	Tags     []string
+	Priority int
+}
+
+// HasTag returns whether t is tagged with tag.
+func (t TaggedImage) HasTag(tag string) bool {
+	for _, tt := range t.Tags {
+		if tt == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the name and tags of t as a menu shows them, as in
+// "stable [production, x86]".
+func (t TaggedImage) String() string {
+	if len(t.Tags) == 0 {
+		return t.Name
+	}
+	return fmt.Sprintf("%s [%s]", t.Name, strings.Join(t.Tags, ", "))
+}
+
+// ImageRegistry is a set of named boot images, in the order they were
+// registered.
+//
+// An ImageRegistry is JSON-encoded with each image as its boot package,
+// so it decodes to images of any type registered with RegisterOSImage.
+type ImageRegistry struct {
+	entries []TaggedImage
+}
+
+// Register adds img to r, replacing the image of the same name if there is
+// one.
+func (r *ImageRegistry) Register(img TaggedImage) {
+	for i, e := range r.entries {
+		if e.Name == img.Name {
+			r.entries[i] = img
+			return
+		}
+	}
+	r.entries = append(r.entries, img)
+}
+
+// Entries returns the images of r in the order they were registered.
+func (r *ImageRegistry) Entries() []TaggedImage {
+	return append([]TaggedImage(nil), r.entries...)
+}
+
+// FindByTag returns the images tagged with tag, in the order they were
+// registered.
+func (r *ImageRegistry) FindByTag(tag string) []TaggedImage {
+	var imgs []TaggedImage
+	for _, e := range r.entries {
+		if e.HasTag(tag) {
+			imgs = append(imgs, e)
+		}
+	}
+	return imgs
+}
+
+// FindByName returns the image called name.
+func (r *ImageRegistry) FindByName(name string) (TaggedImage, bool) {
+	for _, e := range r.entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return TaggedImage{}, false
+}
+
+// Highest returns the image with the highest Priority, the first registered
+// of those if several share it, or false if r is empty.
+func (r *ImageRegistry) Highest() (TaggedImage, bool) {
+	if len(r.entries) == 0 {
+		return TaggedImage{}, false
+	}
+	best := r.entries[0]
+	for _, e := range r.entries[1:] {
+		if e.Priority > best.Priority {
+			best = e
+		}
+	}
+	return best, true
+}
+
+type jsonTaggedImage struct {
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags,omitempty"`
+	Priority int      `json:"priority"`
+	// Package is the image packed as by Package.Pack, as a newc archive.
+	Package []byte `json:"package"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *ImageRegistry) MarshalJSON() ([]byte, error) {
+	entries := make([]jsonTaggedImage, 0, len(r.entries))
+	for _, e := range r.entries {
+		var b bytes.Buffer
+		w := cpio.Newc.Writer(&b)
+		if err := NewPackage(e.Image).Pack(w, nil); err != nil {
+			return nil, fmt.Errorf("packing image %q: %v", e.Name, err)
+		}
+		if err := cpio.WriteTrailer(w); err != nil {
+			return nil, err
+		}
+		entries = append(entries, jsonTaggedImage{
+			Name:     e.Name,
+			Tags:     e.Tags,
+			Priority: e.Priority,
+			Package:  b.Bytes(),
+		})
+	}
+	return json.Marshal(entries)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *ImageRegistry) UnmarshalJSON(b []byte) error {
+	var entries []jsonTaggedImage
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	var reg ImageRegistry
+	for _, e := range entries {
+		var p Package
+		if err := p.Unpack(cpio.Newc.Reader(bytes.NewReader(e.Package)), nil); err != nil {
+			return fmt.Errorf("unpacking image %q: %v", e.Name, err)
+		}
+		reg.Register(TaggedImage{
+			Image:    p.OSImage,
+			Name:     e.Name,
+			Tags:     e.Tags,
+			Priority: e.Priority,
+		})
+	}
+	*r = reg
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRegistry() *ImageRegistry {
+	var r ImageRegistry
+	for _, img := range []TaggedImage{
+		{Name: "stable", Tags: []string{"production", "x86"}, Priority: 10},
+		{Name: "canary", Tags: []string{"production", "test"}, Priority: 20},
+		{Name: "rescue", Tags: []string{"recovery"}, Priority: -1},
+		{Name: "dev"},
+		{Name: "next", Tags: []string{"test"}, Priority: 20},
+	} {
+		img.Image = &LinuxImage{Kernel: strings.NewReader("kernel " + img.Name), Cmdline: "console=ttyS0"}
+		r.Register(img)
+	}
+	return &r
+}
+
+func imageNames(imgs []TaggedImage) []string {
+	var names []string
+	for _, img := range imgs {
+		names = append(names, img.Name)
+	}
+	return names
+}
+
+func TestImageRegistryFindByTag(t *testing.T) {
+	r := testRegistry()
+	for _, tt := range []struct {
+		tag  string
+		want []string
+	}{
+		{"production", []string{"stable", "canary"}},
+		{"test", []string{"canary", "next"}},
+		{"recovery", []string{"rescue"}},
+		{"prod", nil},
+		{"", nil},
+	} {
+		if got := imageNames(r.FindByTag(tt.tag)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FindByTag(%q) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestImageRegistryFindByName(t *testing.T) {
+	r := testRegistry()
+	img, ok := r.FindByName("rescue")
+	if !ok || img.Name != "rescue" || img.Priority != -1 || !img.HasTag("recovery") {
+		t.Errorf("FindByName(rescue) = %v, %v, want rescue", img, ok)
+	}
+	if img, ok := r.FindByName("Rescue"); ok {
+		t.Errorf("FindByName(Rescue) = %v, want none", img)
+	}
+
+	// Registering a name again replaces its image in place.
+	r.Register(TaggedImage{Name: "stable", Tags: []string{"old"}})
+	if img, _ := r.FindByName("stable"); !reflect.DeepEqual(img.Tags, []string{"old"}) {
+		t.Errorf("FindByName(stable) after Register = %v, want tags [old]", img)
+	}
+	if got, want := imageNames(r.Entries()), []string{"stable", "canary", "rescue", "dev", "next"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries() = %v, want %v", got, want)
+	}
+}
+
+func TestImageRegistryHighest(t *testing.T) {
+	var r ImageRegistry
+	if img, ok := r.Highest(); ok {
+		t.Errorf("Highest() of empty registry = %v, want none", img)
+	}
+	r.Register(TaggedImage{Name: "rescue", Priority: -1})
+	if img, ok := r.Highest(); !ok || img.Name != "rescue" {
+		t.Errorf("Highest() = %v, %v, want rescue", img, ok)
+	}
+
+	// Of canary and next, both 20, the first registered wins.
+	if img, ok := testRegistry().Highest(); !ok || img.Name != "canary" {
+		t.Errorf("Highest() = %v, %v, want canary", img, ok)
+	}
+}
+
+func TestTaggedImageString(t *testing.T) {
+	for _, tt := range []struct {
+		img  TaggedImage
+		want string
+	}{
+		{TaggedImage{Name: "dev"}, "dev"},
+		{TaggedImage{Name: "stable", Tags: []string{"production", "x86"}}, "stable [production, x86]"},
+	} {
+		if got := tt.img.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestImageRegistryJSON(t *testing.T) {
+	r := testRegistry()
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ImageRegistry
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := r.Entries()
+	entries := got.Entries()
+	if len(entries) != len(want) {
+		t.Fatalf("decoded %d images, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		w := want[i]
+		if e.Name != w.Name || !reflect.DeepEqual(e.Tags, w.Tags) || e.Priority != w.Priority {
+			t.Errorf("image %d = %v priority %d, want %v priority %d", i, e, e.Priority, w, w.Priority)
+		}
+		li, ok := e.Image.(*LinuxImage)
+		if !ok || !imageEqual(li, w.Image.(*LinuxImage)) {
+			t.Errorf("image %s = %v, want %v", e.Name, e.Image, w.Image)
+		}
+	}
+
+	var empty ImageRegistry
+	if b, err := json.Marshal(&empty); err != nil || string(b) != "[]" {
+		t.Errorf("Marshal(empty) = %s, %v, want []", b, err)
+	}
+
+	errPack := errors.New("cannot pack")
+	r.Register(TaggedImage{Name: "broken", Image: &mockOSImage{packErr: errPack}})
+	if _, err := json.Marshal(r); err == nil {
+		t.Errorf("Marshal() of unpackable image succeeded")
+	}
+	for _, b := range []string{
+		`{}`,
+		`[{"name": "bad", "package": "bm90IGNwaW8="}]`,
+	} {
+		if err := json.Unmarshal([]byte(b), &got); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", b)
+		}
+	}
+	// A failed Unmarshal leaves the registry as it was.
+	if len(got.Entries()) != len(want) {
+		t.Errorf("Unmarshal() error changed the registry to %v", got.Entries())
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// Conflict is an overlap of two segments, A and B, by their indexes.
+type Conflict struct {
+	A, B    int
+	Overlap kexec.Range
+}
+
+// SegmentConflicts returns the overlaps of segments, which kexec_load(2)
+// refuses, with A < B.
+func SegmentConflicts(segments []kexec.Segment) []Conflict {
+	var cs []Conflict
+	for i, a := range segments {
+		for j := i + 1; j < len(segments); j++ {
+			b := segments[j].Phys
+			// Empty segments take no memory.
+			if a.Phys.Size == 0 || b.Size == 0 || !a.Phys.Overlaps(b) {
+				continue
+			}
+			start, end := a.Phys.Start, a.Phys.End()
+			if b.Start > start {
+				start = b.Start
+			}
+			if b.End() < end {
+				end = b.End()
+			}
+			cs = append(cs, Conflict{A: i, B: j, Overlap: kexec.Range{Start: start, Size: uint(end - start)}})
+		}
+	}
+	return cs
+}
+
+// segmentBarWidth is how many columns the memory map of VisualizeSegments
+// spans.
+const segmentBarWidth = 40
+
+// barColumns returns the columns [from, to) of the memory map, width
+// columns for min to min+span, that r covers. Every segment gets at least
+// one column.
+func barColumns(r kexec.Range, min uintptr, span uint64, width int) (int, int) {
+	col := func(addr uintptr, roundUp bool) uint64 {
+		// (addr-min)*width/span, without overflowing.
+		hi, lo := bits.Mul64(uint64(addr-min), uint64(width))
+		q, rem := bits.Div64(hi, lo, span)
+		if rem != 0 && roundUp {
+			q++
+		}
+		return q
+	}
+	from, to := int(col(r.Start, false)), int(col(r.End(), true))
+	if to <= from {
+		to = from + 1
+	}
+	if to > width {
+		from, to = width-1, width
+	}
+	return from, to
+}
+
+// humanSize returns n in bytes, KiB, MiB or GiB.
+func humanSize(n uint) string {
+	for _, u := range []struct {
+		shift uint
+		unit  string
+	}{{30, "GiB"}, {20, "MiB"}, {10, "KiB"}} {
+		if n >= 1<<u.shift && n%(1<<u.shift) == 0 {
+			return fmt.Sprintf("%d %s", n>>u.shift, u.unit)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// segmentName returns the name of segment i.
+func segmentName(segments []kexec.Segment, i int) string {
+	if n := segments[i].Name; n != "" {
+		return n
+	}
+	return fmt.Sprintf("segment %d", i)
+}
+
+// VisualizeSegments writes a memory map of segments to w, in order of
+// address: each segment is a line with its physical address range, its
+// size, a bar showing where it is between the lowest and highest address of
+// all segments, and its name. The bars of overlapping segments are drawn
+// with '!' instead of '#', and the overlaps are listed at the end.
+func VisualizeSegments(segments []kexec.Segment, w io.Writer) {
+	if len(segments) == 0 {
+		fmt.Fprintln(w, "no segments")
+		return
+	}
+	order := make([]int, len(segments))
+	min, max := segments[0].Phys.Start, segments[0].Phys.End()
+	for i, s := range segments {
+		order[i] = i
+		if s.Phys.Start < min {
+			min = s.Phys.Start
+		}
+		if s.Phys.End() > max {
+			max = s.Phys.End()
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return segments[order[i]].Phys.Start < segments[order[j]].Phys.Start
+	})
+	span := uint64(max - min)
+	if span == 0 {
+		span = 1
+	}
+
+	conflicts := SegmentConflicts(segments)
+	overlaps := make(map[int][]string)
+	for _, c := range conflicts {
+		overlaps[c.A] = append(overlaps[c.A], segmentName(segments, c.B))
+		overlaps[c.B] = append(overlaps[c.B], segmentName(segments, c.A))
+	}
+
+	for _, i := range order {
+		s := segments[i]
+		from, to := barColumns(s.Phys, min, span, segmentBarWidth)
+		mark := "#"
+		if len(overlaps[i]) > 0 {
+			mark = "!"
+		}
+		bar := strings.Repeat(" ", from) + strings.Repeat(mark, to-from) + strings.Repeat(" ", segmentBarWidth-to)
+		fmt.Fprintf(w, "%#016x-%#016x %10s |%s| %s", s.Phys.Start, s.Phys.End(), humanSize(s.Phys.Size), bar, segmentName(segments, i))
+		if o := overlaps[i]; len(o) > 0 {
+			fmt.Fprintf(w, " (overlaps %s)", strings.Join(o, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+	for _, c := range conflicts {
+		fmt.Fprintf(w, "conflict: %s and %s overlap at %v\n", segmentName(segments, c.A), segmentName(segments, c.B), c.Overlap)
+	}
+}
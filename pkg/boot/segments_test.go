@@ -0,0 +1,110 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+func segment(name string, start uintptr, size uint) kexec.Segment {
+	return kexec.Segment{Name: name, Phys: kexec.Range{Start: start, Size: size}}
+}
+
+func TestSegmentConflicts(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		segs []kexec.Segment
+		want []Conflict
+	}{
+		{
+			name: "adjacent",
+			segs: []kexec.Segment{segment("a", 0x1000, 0x1000), segment("b", 0x2000, 0x1000)},
+		},
+		{
+			name: "partial",
+			segs: []kexec.Segment{segment("a", 0x1000, 0x2000), segment("b", 0x2800, 0x1000)},
+			want: []Conflict{{A: 0, B: 1, Overlap: kexec.Range{Start: 0x2800, Size: 0x800}}},
+		},
+		{
+			name: "inside, out of order",
+			segs: []kexec.Segment{
+				segment("c", 0x10000, 0x100),
+				segment("a", 0x1000, 0x10000),
+				segment("b", 0x4000, 0x10),
+			},
+			want: []Conflict{
+				{A: 0, B: 1, Overlap: kexec.Range{Start: 0x10000, Size: 0x100}},
+				{A: 1, B: 2, Overlap: kexec.Range{Start: 0x4000, Size: 0x10}},
+			},
+		},
+		{
+			name: "empty segment",
+			segs: []kexec.Segment{segment("a", 0x1000, 0x2000), segment("b", 0x1800, 0)},
+		},
+		{
+			name: "top of memory",
+			segs: []kexec.Segment{segment("a", ^uintptr(0)-0xfff, 0xfff), segment("b", ^uintptr(0)-0x7ff, 0x10)},
+			want: []Conflict{{A: 0, B: 1, Overlap: kexec.Range{Start: ^uintptr(0) - 0x7ff, Size: 0x10}}},
+		},
+	} {
+		if got := SegmentConflicts(tt.segs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: SegmentConflicts() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBarColumns(t *testing.T) {
+	for _, tt := range []struct {
+		r        kexec.Range
+		min      uintptr
+		span     uint64
+		from, to int
+	}{
+		{kexec.Range{Start: 0, Size: 100}, 0, 400, 0, 10},
+		{kexec.Range{Start: 100, Size: 100}, 0, 400, 10, 20},
+		// Partial columns are covered.
+		{kexec.Range{Start: 105, Size: 100}, 0, 400, 10, 21},
+		// Tiny segments get a column.
+		{kexec.Range{Start: 0x1000, Size: 1}, 0x1000, 1 << 30, 0, 1},
+		{kexec.Range{Start: 0x1000 + 1<<30, Size: 0}, 0x1000, 1 << 30, 39, 40},
+		// Addresses this large overflow multiplying by the width.
+		{kexec.Range{Start: 1 << 62, Size: 1 << 62}, 0, 1 << 63, 20, 40},
+	} {
+		if from, to := barColumns(tt.r, tt.min, tt.span, 40); from != tt.from || to != tt.to {
+			t.Errorf("barColumns(%v, %#x, %#x) = [%d, %d), want [%d, %d)", tt.r, tt.min, tt.span, from, to, tt.from, tt.to)
+		}
+	}
+}
+
+func TestVisualizeSegments(t *testing.T) {
+	segs := []kexec.Segment{
+		segment("kernel", 0x1000000, 0x400000),
+		segment("purgatory", 0x90000, 0x1000),
+		segment("cmdline", 0x1300000, 6),
+		segment("", 0x1e00000, 0x200000),
+	}
+	var b bytes.Buffer
+	VisualizeSegments(segs, &b)
+	// The map spans 0x90000 to 0x2000000, in 40 columns.
+	want := `0x0000000000090000-0x0000000000091000      4 KiB |#                                       | purgatory
+0x0000000001000000-0x0000000001400000      4 MiB |                   !!!!!!               | kernel (overlaps cmdline)
+0x0000000001300000-0x0000000001300006        6 B |                       !                | cmdline (overlaps kernel)
+0x0000000001e00000-0x0000000002000000      2 MiB |                                     ###| segment 3
+conflict: kernel and cmdline overlap at [0x1300000, 0x1300006)
+`
+	if got := b.String(); got != want {
+		t.Errorf("VisualizeSegments() =\n%s\nwant\n%s", got, want)
+	}
+
+	b.Reset()
+	VisualizeSegments(nil, &b)
+	if got := b.String(); got != "no segments\n" {
+		t.Errorf("VisualizeSegments(nil) = %q, want no segments", got)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sev
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// guestDevice is the SEV guest driver, sev-guest.
+const guestDevice = "/dev/sev-guest"
+
+// snpGetReport is SNP_GET_REPORT from linux/sev-guest.h, which is
+// _IOWR('S', 0x0, struct snp_guest_request_ioctl).
+const snpGetReport = 0xc0205300
+
+// guestRequest is struct snp_guest_request_ioctl.
+type guestRequest struct {
+	msgVersion uint8
+	_          [7]byte
+	reqData    uint64
+	respData   uint64
+	// exitInfo2 has the firmware error in its low and the hypervisor's
+	// in its high 32 bits.
+	exitInfo2 uint64
+}
+
+// reportRequest is struct snp_report_req.
+type reportRequest struct {
+	userData [64]byte
+	vmpl     uint32
+	_        [28]byte
+}
+
+// reportResponse is struct snp_report_resp, which holds a MSG_REPORT_RSP:
+// status, report size, 24 reserved bytes and the report.
+type reportResponse struct {
+	data [4000]byte
+}
+
+// snpReport gets an attestation report with data from the secure processor.
+func snpReport(data [64]byte) ([]byte, error) {
+	f, err := os.OpenFile(guestDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	req := reportRequest{userData: data}
+	var resp reportResponse
+	gr := guestRequest{
+		msgVersion: 1,
+		reqData:    uint64(uintptr(unsafe.Pointer(&req))),
+		respData:   uint64(uintptr(unsafe.Pointer(&resp))),
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), snpGetReport, uintptr(unsafe.Pointer(&gr))); errno != 0 {
+		return nil, fmt.Errorf("SNP_GET_REPORT: %v (firmware error %#x)", errno, uint32(gr.exitInfo2))
+	}
+
+	if status := binary.LittleEndian.Uint32(resp.data[0:]); status != 0 {
+		return nil, fmt.Errorf("SNP_GET_REPORT: status %#x", status)
+	}
+	n := binary.LittleEndian.Uint32(resp.data[4:])
+	if int(n) > len(resp.data)-32 {
+		return nil, fmt.Errorf("SNP_GET_REPORT: report of %d bytes", n)
+	}
+	return append([]byte(nil), resp.data[32:32+n]...), nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package sev
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestAttestOverlay(t *testing.T) {
+	s := &attestationServer{approved: map[string]bool{sha384("good kernel"): true}}
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	oldClient, oldReport := client, getReport
+	defer func() { client, getReport = oldClient, oldReport }()
+	client = ts.Client()
+	getReport = fakeReport
+
+	li := boot.NewLinuxImage(strings.NewReader("good kernel"), strings.NewReader("initrd"), "")
+	li.WithInitrdOverlay(fstest.MapFS{
+		"etc/hostname": {Data: []byte("overlay\n"), Mode: 0644},
+	})
+	if _, err := Attest(li, ts.URL); err != nil {
+		t.Fatalf("Attest() = %v", err)
+	}
+
+	initrd, closeInitrd, err := li.InitrdWithOverlays()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeInitrd()
+	b, err := uio.ReadAll(initrd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha512.Sum384(b)
+	if want := hex.EncodeToString(h[:]); s.got.InitrdSHA384 != want {
+		t.Errorf("server got initrd digest %s, want %s of the initrd with overlays", s.got.InitrdSHA384, want)
+	}
+	if s.got.InitrdSHA384 == sha384("initrd") {
+		t.Errorf("server got the digest of the initrd without overlays")
+	}
+}
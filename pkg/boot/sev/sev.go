@@ -0,0 +1,173 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sev has SEV-SNP guests attest the kernel they are about to kexec.
+//
+// The guest asks the AMD secure processor for an attestation report, whose
+// report data binds the digests of the kernel and initrd to a fresh nonce,
+// and POSTs it to an attestation server. Only if the server approves does
+// the guest boot the kernel.
+package sev
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// ErrAttestationDenied is returned when the attestation server does not
+// approve the kernel.
+var ErrAttestationDenied = errors.New("attestation denied")
+
+var (
+	// client talks to attestation servers. Tests replace it.
+	client = &http.Client{Timeout: 30 * time.Second}
+
+	// getReport asks for an attestation report. Tests replace it.
+	getReport = snpReport
+
+	// execute boots li. Tests replace it.
+	execute = (*boot.LinuxImage).Execute
+)
+
+// Request is what the guest POSTs to the attestation server, as JSON.
+type Request struct {
+	// Report is the attestation report of the secure processor. The
+	// first 48 bytes of its report data are the SHA-384 of the kernel
+	// and initrd digests, the last 16 Nonce.
+	Report []byte `json:"report"`
+
+	// KernelSHA384 and InitrdSHA384 are the hex digests of the images.
+	// The initrd is the one Execute boots, with any overlays appended.
+	// InitrdSHA384 is empty if there is no initrd.
+	KernelSHA384 string `json:"kernel_sha384"`
+	InitrdSHA384 string `json:"initrd_sha384,omitempty"`
+	Cmdline      string `json:"cmdline"`
+
+	// Nonce is a hex random number, which the approval must repeat.
+	Nonce string `json:"nonce"`
+}
+
+// Approval is how the attestation server answers with 200 OK, as JSON.
+type Approval struct {
+	Nonce string `json:"nonce"`
+	// Token is the server's approval, signed over the nonce.
+	Token string `json:"token"`
+}
+
+// digest returns the SHA-384 of r, or nil if r is nil.
+func digest(r io.ReaderAt) ([]byte, error) {
+	if r == nil {
+		return nil, nil
+	}
+	h := sha512.New384()
+	if _, err := io.Copy(h, uio.Reader(r)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// reportData binds the kernel and initrd digests to nonce.
+func reportData(kernel, initrd []byte, nonce [16]byte) [64]byte {
+	var d [64]byte
+	h := sha512.New384()
+	h.Write(kernel)
+	h.Write(initrd)
+	copy(d[:], h.Sum(nil))
+	copy(d[48:], nonce[:])
+	return d
+}
+
+// Attest gets li approved by the attestation server at the HTTPS URL
+// attestationServer, and returns the approval.
+func Attest(li *boot.LinuxImage, attestationServer string) (*Approval, error) {
+	u, err := url.Parse(attestationServer)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("attestation server %q does not use HTTPS", attestationServer)
+	}
+
+	kernel, err := digest(li.Kernel)
+	if err != nil {
+		return nil, fmt.Errorf("hashing kernel: %v", err)
+	}
+	// Execute boots the initrd with its overlays appended.
+	i, closeInitrd, err := li.InitrdWithOverlays()
+	if err != nil {
+		return nil, fmt.Errorf("building initrd: %v", err)
+	}
+	defer closeInitrd()
+	initrd, err := digest(i)
+	if err != nil {
+		return nil, fmt.Errorf("hashing initrd: %v", err)
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	report, err := getReport(reportData(kernel, initrd, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("getting attestation report: %v", err)
+	}
+
+	body, err := json.Marshal(&Request{
+		Report:       report,
+		KernelSHA384: hex.EncodeToString(kernel),
+		InitrdSHA384: hex.EncodeToString(initrd),
+		Cmdline:      li.Cmdline,
+		Nonce:        hex.EncodeToString(nonce[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(u.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrAttestationDenied
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("attestation server: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	var a Approval
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return nil, fmt.Errorf("bad approval: %v", err)
+	}
+	if a.Nonce != hex.EncodeToString(nonce[:]) {
+		return nil, fmt.Errorf("approval is for nonce %q, not ours", a.Nonce)
+	}
+	if a.Token == "" {
+		return nil, ErrAttestationDenied
+	}
+	return &a, nil
+}
+
+// AttestAndExecute gets li approved by the attestation server at the HTTPS
+// URL attestationServer, then executes it. It returns ErrAttestationDenied
+// if the server refuses.
+func AttestAndExecute(li *boot.LinuxImage, attestationServer string) error {
+	if _, err := Attest(li, attestationServer); err != nil {
+		return err
+	}
+	return execute(li)
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sev
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// fakeReport is an attestation report that is just its report data.
+func fakeReport(data [64]byte) ([]byte, error) {
+	return append([]byte("report:"), data[:]...), nil
+}
+
+// attestationServer approves kernels whose digest is in approved.
+type attestationServer struct {
+	approved map[string]bool
+	// nonce, if set, replaces the nonce of approvals.
+	nonce string
+	got   Request
+}
+
+func (s *attestationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	s.got = Request{}
+	if err := json.NewDecoder(r.Body).Decode(&s.got); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Check that the report binds the digests and nonce.
+	k, _ := hex.DecodeString(s.got.KernelSHA384)
+	i, _ := hex.DecodeString(s.got.InitrdSHA384)
+	n, _ := hex.DecodeString(s.got.Nonce)
+	var nonce [16]byte
+	copy(nonce[:], n)
+	data := reportData(k, i, nonce)
+	if !bytes.Equal(s.got.Report, append([]byte("report:"), data[:]...)) {
+		http.Error(w, "report does not match", http.StatusBadRequest)
+		return
+	}
+	if !s.approved[s.got.KernelSHA384] {
+		http.Error(w, "unknown kernel", http.StatusForbidden)
+		return
+	}
+	a := Approval{Nonce: s.got.Nonce, Token: "signed:" + s.got.Nonce}
+	if s.nonce != "" {
+		a.Nonce = s.nonce
+	}
+	json.NewEncoder(w).Encode(&a)
+}
+
+func sha384(s string) string {
+	h := sha512.Sum384([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestAttestAndExecute(t *testing.T) {
+	s := &attestationServer{approved: map[string]bool{sha384("good kernel"): true}}
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	oldClient, oldReport, oldExecute := client, getReport, execute
+	defer func() { client, getReport, execute = oldClient, oldReport, oldExecute }()
+	client = ts.Client()
+	getReport = fakeReport
+	var executed *boot.LinuxImage
+	execute = func(li *boot.LinuxImage) error {
+		executed = li
+		return nil
+	}
+
+	for _, tt := range []struct {
+		name   string
+		kernel string
+		initrd string
+		url    string
+		nonce  string
+		err    error
+		errStr string
+	}{
+		{name: "approved", kernel: "good kernel", initrd: "initrd"},
+		{name: "no initrd", kernel: "good kernel"},
+		{name: "denied", kernel: "bad kernel", err: ErrAttestationDenied},
+		{name: "replayed", kernel: "good kernel", nonce: "00", errStr: "nonce"},
+		{name: "not HTTPS", kernel: "good kernel", url: strings.Replace(ts.URL, "https", "http", 1), errStr: "HTTPS"},
+		{name: "bad URL", kernel: "good kernel", url: ts.URL + "/\x7f", errStr: "invalid"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			executed = nil
+			s.nonce = tt.nonce
+			li := &boot.LinuxImage{Kernel: strings.NewReader(tt.kernel), Cmdline: "console=ttyS0"}
+			if tt.initrd != "" {
+				li.Initrd = strings.NewReader(tt.initrd)
+			}
+			u := tt.url
+			if u == "" {
+				u = ts.URL
+			}
+			err := AttestAndExecute(li, u)
+			switch {
+			case tt.err != nil:
+				if err != tt.err {
+					t.Fatalf("AttestAndExecute() = %v, want %v", err, tt.err)
+				}
+			case tt.errStr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.errStr) {
+					t.Fatalf("AttestAndExecute() = %v, want error with %q", err, tt.errStr)
+				}
+			case err != nil:
+				t.Fatalf("AttestAndExecute() = %v", err)
+			}
+			if (err == nil) != (executed == li) {
+				t.Errorf("AttestAndExecute() = %v, but executed the image: %v", err, executed == li)
+			}
+			if err != nil {
+				return
+			}
+			if s.got.KernelSHA384 != sha384(tt.kernel) || s.got.Cmdline != li.Cmdline {
+				t.Errorf("server got digest %s and command line %q, want %s and %q", s.got.KernelSHA384, s.got.Cmdline, sha384(tt.kernel), li.Cmdline)
+			}
+			want := ""
+			if tt.initrd != "" {
+				want = sha384(tt.initrd)
+			}
+			if s.got.InitrdSHA384 != want {
+				t.Errorf("server got initrd digest %q, want %q", s.got.InitrdSHA384, want)
+			}
+		})
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	oldClient, oldReport := client, getReport
+	defer func() { client, getReport = oldClient, oldReport }()
+	client = ts.Client()
+	getReport = fakeReport
+
+	_, err := Attest(&boot.LinuxImage{Kernel: strings.NewReader("kernel")}, ts.URL)
+	if err == nil || err == ErrAttestationDenied || !strings.Contains(err.Error(), "overloaded") {
+		t.Errorf("Attest() = %v, want the server's error", err)
+	}
+
+	getReport = func([64]byte) ([]byte, error) { return nil, fmt.Errorf("no SEV") }
+	if _, err := Attest(&boot.LinuxImage{Kernel: strings.NewReader("kernel")}, ts.URL); err == nil {
+		t.Errorf("Attest() without a report succeeded")
+	}
+}
@@ -0,0 +1,565 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package squashfs reads files from squashfs 4.0 images.
+//
+// Only what is needed to find and read files is implemented: xattrs and the
+// export table are ignored, and of the compressors only gzip is supported.
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// Magic is the squashfs superblock magic, "hsqs" on disk.
+const Magic = 0x73717368
+
+const (
+	compressionGzip = 1
+
+	metadataSize         = 8192
+	metadataUncompressed = 1 << 15
+	blockUncompressed    = 1 << 24
+	noFragment           = 0xffffffff
+
+	// maxSymlinks is the number of symlinks followed before giving up.
+	maxSymlinks = 40
+)
+
+// Inode types.
+const (
+	typeDir        = 1
+	typeFile       = 2
+	typeSymlink    = 3
+	typeExtDir     = 8
+	typeExtFile    = 9
+	typeExtSymlink = 10
+)
+
+// ErrNotExist is returned for paths that are not in the image.
+var ErrNotExist = errors.New("file does not exist")
+
+type superblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentEntryCount  uint32
+	CompressionID       uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInodeRef        uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+type inodeHeader struct {
+	Type        uint16
+	Permissions uint16
+	UIDIndex    uint16
+	GIDIndex    uint16
+	MTime       uint32
+	InodeNumber uint32
+}
+
+type dirHeader struct {
+	Count       uint32
+	Start       uint32
+	InodeNumber uint32
+}
+
+type dirEntry struct {
+	Offset      uint16
+	InodeOffset int16
+	Type        uint16
+	NameSize    uint16
+}
+
+type fragmentEntry struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+// inode is the part of an inode needed to find its contents.
+type inode struct {
+	typ uint16
+
+	// Directories.
+	dirBlock  uint32
+	dirOffset uint16
+	dirSize   uint32
+
+	// Files.
+	blocksStart uint64
+	fileSize    uint64
+	fragment    uint32
+	fragOffset  uint32
+	blockSizes  []uint32
+
+	// Symlinks.
+	target string
+}
+
+func (i *inode) isDir() bool {
+	return i.typ == typeDir || i.typ == typeExtDir
+}
+
+// FS is a squashfs image.
+type FS struct {
+	r  io.ReaderAt
+	sb superblock
+}
+
+// New reads the superblock of the squashfs image in r.
+func New(r io.ReaderAt) (*FS, error) {
+	fs := &FS{r: r}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &fs.sb); err != nil {
+		return nil, fmt.Errorf("reading squashfs superblock: %v", err)
+	}
+	if fs.sb.Magic != Magic {
+		return nil, fmt.Errorf("squashfs magic got %#x, want %#x", fs.sb.Magic, Magic)
+	}
+	if fs.sb.VersionMajor != 4 {
+		return nil, fmt.Errorf("squashfs version %d.%d not supported", fs.sb.VersionMajor, fs.sb.VersionMinor)
+	}
+	if fs.sb.CompressionID != compressionGzip {
+		return nil, fmt.Errorf("squashfs compression %d not supported", fs.sb.CompressionID)
+	}
+	if fs.sb.BlockSize == 0 || fs.sb.BlockSize > 1<<20 {
+		return nil, fmt.Errorf("invalid squashfs block size %d", fs.sb.BlockSize)
+	}
+	return fs, nil
+}
+
+func (fs *FS) decompress(b []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// metadataReader reads sequentially through metadata blocks.
+type metadataReader struct {
+	fs   *FS
+	next int64
+	buf  []byte
+}
+
+// newMetadataReader starts reading at offset into the uncompressed metadata
+// block at pos.
+func (fs *FS) newMetadataReader(pos int64, offset uint16) (*metadataReader, error) {
+	m := &metadataReader{fs: fs, next: pos}
+	if err := m.fill(); err != nil {
+		return nil, err
+	}
+	if int(offset) > len(m.buf) {
+		return nil, fmt.Errorf("metadata offset %d beyond block of %d bytes", offset, len(m.buf))
+	}
+	m.buf = m.buf[offset:]
+	return m, nil
+}
+
+func (m *metadataReader) fill() error {
+	var hdr [2]byte
+	if _, err := m.fs.r.ReadAt(hdr[:], m.next); err != nil {
+		return fmt.Errorf("reading metadata block at %d: %v", m.next, err)
+	}
+	size := binary.LittleEndian.Uint16(hdr[:])
+	n := int(size &^ metadataUncompressed)
+	if n > metadataSize {
+		return fmt.Errorf("metadata block at %d has invalid size %d", m.next, n)
+	}
+	b := make([]byte, n)
+	if _, err := m.fs.r.ReadAt(b, m.next+2); err != nil {
+		return fmt.Errorf("reading metadata block at %d: %v", m.next, err)
+	}
+	m.next += 2 + int64(n)
+	if size&metadataUncompressed == 0 {
+		var err error
+		if b, err = m.fs.decompress(b); err != nil {
+			return fmt.Errorf("decompressing metadata block: %v", err)
+		}
+	}
+	m.buf = b
+	return nil
+}
+
+// Read implements io.Reader.
+func (m *metadataReader) Read(p []byte) (int, error) {
+	if len(m.buf) == 0 {
+		if err := m.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+func (m *metadataReader) read(data interface{}) error {
+	return binary.Read(m, binary.LittleEndian, data)
+}
+
+// readInode reads the inode referenced by ref: the metadata block offset
+// from the inode table in the upper, and the offset into it in the lower 16
+// bits.
+func (fs *FS) readInode(ref uint64) (*inode, error) {
+	m, err := fs.newMetadataReader(int64(fs.sb.InodeTableStart+(ref>>16)), uint16(ref))
+	if err != nil {
+		return nil, err
+	}
+	var hdr inodeHeader
+	if err := m.read(&hdr); err != nil {
+		return nil, err
+	}
+
+	i := &inode{typ: hdr.Type}
+	switch hdr.Type {
+	case typeDir:
+		var d struct {
+			BlockIndex  uint32
+			LinkCount   uint32
+			FileSize    uint16
+			BlockOffset uint16
+			ParentInode uint32
+		}
+		if err := m.read(&d); err != nil {
+			return nil, err
+		}
+		i.dirBlock, i.dirOffset, i.dirSize = d.BlockIndex, d.BlockOffset, uint32(d.FileSize)
+
+	case typeExtDir:
+		var d struct {
+			LinkCount   uint32
+			FileSize    uint32
+			BlockIndex  uint32
+			ParentInode uint32
+			IndexCount  uint16
+			BlockOffset uint16
+			XattrIndex  uint32
+		}
+		if err := m.read(&d); err != nil {
+			return nil, err
+		}
+		i.dirBlock, i.dirOffset, i.dirSize = d.BlockIndex, d.BlockOffset, d.FileSize
+
+	case typeFile:
+		var f struct {
+			BlocksStart uint32
+			Fragment    uint32
+			BlockOffset uint32
+			FileSize    uint32
+		}
+		if err := m.read(&f); err != nil {
+			return nil, err
+		}
+		i.blocksStart, i.fragment, i.fragOffset, i.fileSize = uint64(f.BlocksStart), f.Fragment, f.BlockOffset, uint64(f.FileSize)
+		if err := fs.readBlockSizes(m, i); err != nil {
+			return nil, err
+		}
+
+	case typeExtFile:
+		var f struct {
+			BlocksStart uint64
+			FileSize    uint64
+			Sparse      uint64
+			LinkCount   uint32
+			Fragment    uint32
+			BlockOffset uint32
+			XattrIndex  uint32
+		}
+		if err := m.read(&f); err != nil {
+			return nil, err
+		}
+		i.blocksStart, i.fragment, i.fragOffset, i.fileSize = f.BlocksStart, f.Fragment, f.BlockOffset, f.FileSize
+		if err := fs.readBlockSizes(m, i); err != nil {
+			return nil, err
+		}
+
+	case typeSymlink, typeExtSymlink:
+		var s struct {
+			LinkCount  uint32
+			TargetSize uint32
+		}
+		if err := m.read(&s); err != nil {
+			return nil, err
+		}
+		if s.TargetSize > 4096 {
+			return nil, fmt.Errorf("symlink target of %d bytes is too long", s.TargetSize)
+		}
+		t := make([]byte, s.TargetSize)
+		if _, err := io.ReadFull(m, t); err != nil {
+			return nil, err
+		}
+		i.target = string(t)
+	}
+	return i, nil
+}
+
+// readBlockSizes reads the list of data block sizes following a file inode.
+func (fs *FS) readBlockSizes(m *metadataReader, i *inode) error {
+	n := i.fileSize / uint64(fs.sb.BlockSize)
+	if i.fragment == noFragment && i.fileSize%uint64(fs.sb.BlockSize) != 0 {
+		n++
+	}
+	if n > i.fileSize {
+		return fmt.Errorf("invalid file size %d", i.fileSize)
+	}
+	i.blockSizes = make([]uint32, n)
+	return m.read(i.blockSizes)
+}
+
+// lookupDir finds the inode reference of name in directory dir.
+func (fs *FS) lookupDir(dir *inode, name string) (uint64, error) {
+	// The size includes 3 bytes for the implicit . and .. entries.
+	if dir.dirSize <= 3 {
+		return 0, ErrNotExist
+	}
+	m, err := fs.newMetadataReader(int64(fs.sb.DirectoryTableStart)+int64(dir.dirBlock), dir.dirOffset)
+	if err != nil {
+		return 0, err
+	}
+	lr := &io.LimitedReader{R: m, N: int64(dir.dirSize - 3)}
+	for lr.N > 0 {
+		var hdr dirHeader
+		if err := binary.Read(lr, binary.LittleEndian, &hdr); err != nil {
+			return 0, err
+		}
+		for j := uint32(0); j <= hdr.Count; j++ {
+			var e dirEntry
+			if err := binary.Read(lr, binary.LittleEndian, &e); err != nil {
+				return 0, err
+			}
+			n := make([]byte, int(e.NameSize)+1)
+			if _, err := io.ReadFull(lr, n); err != nil {
+				return 0, err
+			}
+			if string(n) == name {
+				return uint64(hdr.Start)<<16 | uint64(e.Offset), nil
+			}
+		}
+	}
+	return 0, ErrNotExist
+}
+
+// lookup resolves the absolute or root-relative path p, following symlinks.
+func (fs *FS) lookup(p string) (*inode, error) {
+	var (
+		symlinks int
+		dirs     []*inode
+	)
+	root, err := fs.readInode(fs.sb.RootInodeRef)
+	if err != nil {
+		return nil, err
+	}
+	cur := root
+	components := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	for len(components) > 0 {
+		c := components[0]
+		components = components[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 0 {
+				cur, dirs = dirs[len(dirs)-1], dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		if !cur.isDir() {
+			return nil, fmt.Errorf("%s: not a directory", p)
+		}
+		ref, err := fs.lookupDir(cur, c)
+		if err != nil {
+			return nil, err
+		}
+		next, err := fs.readInode(ref)
+		if err != nil {
+			return nil, err
+		}
+		if next.typ == typeSymlink || next.typ == typeExtSymlink {
+			if symlinks++; symlinks > maxSymlinks {
+				return nil, fmt.Errorf("%s: too many levels of symbolic links", p)
+			}
+			t := strings.Split(next.target, "/")
+			if strings.HasPrefix(next.target, "/") {
+				cur, dirs = root, nil
+			}
+			components = append(t, components...)
+			continue
+		}
+		dirs = append(dirs, cur)
+		cur = next
+	}
+	return cur, nil
+}
+
+// Open returns the contents of the regular file at path p.
+func (fs *FS) Open(p string) (*io.SectionReader, error) {
+	i, err := fs.lookup(p)
+	if err != nil {
+		return nil, fmt.Errorf("squashfs: %s: %v", p, err)
+	}
+	if i.typ != typeFile && i.typ != typeExtFile {
+		return nil, fmt.Errorf("squashfs: %s is not a regular file", p)
+	}
+	f := &file{fs: fs, i: i}
+	pos := int64(i.blocksStart)
+	for _, s := range i.blockSizes {
+		f.blockPos = append(f.blockPos, pos)
+		pos += int64(s &^ blockUncompressed)
+	}
+	return io.NewSectionReader(f, 0, int64(i.fileSize)), nil
+}
+
+// file reads the data blocks and fragment of a file.
+type file struct {
+	fs       *FS
+	i        *inode
+	blockPos []int64
+
+	// The most recently read block, as sequential reads are common.
+	mu       sync.Mutex
+	cached   int
+	cacheBuf []byte
+}
+
+// block returns the uncompressed data block n; n == len(blockPos) is the
+// fragment.
+func (f *file) block(n int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cacheBuf != nil && f.cached == n {
+		return f.cacheBuf, nil
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if n < len(f.blockPos) {
+		b, err = f.fs.readBlock(f.blockPos[n], f.i.blockSizes[n])
+	} else {
+		b, err = f.fs.readFragment(f.i.fragment)
+		if err == nil {
+			tail := int(f.i.fileSize % uint64(f.fs.sb.BlockSize))
+			if int(f.i.fragOffset)+tail > len(b) {
+				return nil, fmt.Errorf("fragment too short")
+			}
+			b = b[f.i.fragOffset : int(f.i.fragOffset)+tail]
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.cached, f.cacheBuf = n, b
+	return b, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	bs := int64(f.fs.sb.BlockSize)
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= int64(f.i.fileSize) {
+			return n, io.EOF
+		}
+		b, err := f.block(int(pos / bs))
+		if err != nil {
+			return n, err
+		}
+		start := int(pos % bs)
+		if start >= len(b) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], b[start:])
+	}
+	return n, nil
+}
+
+// readBlock reads the data block at pos with the on-disk size entry size.
+func (fs *FS) readBlock(pos int64, size uint32) ([]byte, error) {
+	n := size &^ blockUncompressed
+	if n == 0 {
+		// Sparse block.
+		return make([]byte, fs.sb.BlockSize), nil
+	}
+	if n > fs.sb.BlockSize {
+		return nil, fmt.Errorf("data block at %d has invalid size %d", pos, n)
+	}
+	b := make([]byte, n)
+	if _, err := fs.r.ReadAt(b, pos); err != nil {
+		return nil, err
+	}
+	if size&blockUncompressed != 0 {
+		return b, nil
+	}
+	return fs.decompress(b)
+}
+
+// readFragment reads the fragment block with index n.
+func (fs *FS) readFragment(n uint32) ([]byte, error) {
+	if n >= fs.sb.FragmentEntryCount {
+		return nil, fmt.Errorf("fragment %d out of range", n)
+	}
+	const entrySize = 16
+	const perBlock = metadataSize / entrySize
+
+	// The fragment table is a list of metadata block locations.
+	var loc [8]byte
+	if _, err := fs.r.ReadAt(loc[:], int64(fs.sb.FragmentTableStart)+int64(n/perBlock)*8); err != nil {
+		return nil, err
+	}
+	m, err := fs.newMetadataReader(int64(binary.LittleEndian.Uint64(loc[:])), uint16(n%perBlock*entrySize))
+	if err != nil {
+		return nil, err
+	}
+	var e fragmentEntry
+	if err := m.read(&e); err != nil {
+		return nil, err
+	}
+	return fs.readBlock(int64(e.Start), e.Size)
+}
+
+// LinuxImageFromSquashFS returns a LinuxImage of the kernel and, unless
+// initrdPath is empty, the initrd at the given paths in the squashfs image r.
+func LinuxImageFromSquashFS(r io.ReaderAt, kernelPath, initrdPath, cmdline string) (*boot.LinuxImage, error) {
+	fs, err := New(r)
+	if err != nil {
+		return nil, err
+	}
+	li := &boot.LinuxImage{Cmdline: cmdline}
+	if li.Kernel, err = fs.Open(kernelPath); err != nil {
+		return nil, err
+	}
+	if initrdPath != "" {
+		if li.Initrd, err = fs.Open(initrdPath); err != nil {
+			return nil, err
+		}
+	}
+	return li, nil
+}
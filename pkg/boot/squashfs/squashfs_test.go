@@ -0,0 +1,478 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+const testBlockSize = 4096
+
+// node is a file, directory or symlink to put into a test image.
+type node struct {
+	name     string
+	data     []byte
+	target   string
+	children []*node
+	// ext uses an extended file inode without fragment.
+	ext bool
+}
+
+func compress(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// metadataWriter writes metadata blocks, compressing those that shrink.
+type metadataWriter struct {
+	out bytes.Buffer
+	cur []byte
+}
+
+// ref returns the block position and offset at which the next byte is
+// written.
+func (m *metadataWriter) ref() (uint32, uint16) {
+	return uint32(m.out.Len()), uint16(len(m.cur))
+}
+
+func (m *metadataWriter) write(data interface{}) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, data)
+	m.cur = append(m.cur, b.Bytes()...)
+	for len(m.cur) >= metadataSize {
+		m.flush(m.cur[:metadataSize])
+		m.cur = m.cur[metadataSize:]
+	}
+}
+
+func (m *metadataWriter) flush(b []byte) {
+	size := uint16(len(b)) | metadataUncompressed
+	if c := compress(b); len(c) < len(b) {
+		b, size = c, uint16(len(c))
+	}
+	binary.Write(&m.out, binary.LittleEndian, size)
+	m.out.Write(b)
+}
+
+func (m *metadataWriter) finish() []byte {
+	if len(m.cur) > 0 {
+		m.flush(m.cur)
+		m.cur = nil
+	}
+	return m.out.Bytes()
+}
+
+// imageWriter builds a squashfs image in the layout mksquashfs uses:
+// superblock, data blocks, fragments, then the inode, directory, fragment
+// and id tables.
+type imageWriter struct {
+	data      bytes.Buffer
+	frag      []byte
+	inodes    metadataWriter
+	dirs      metadataWriter
+	nextInode uint32
+	// uncompressed alternates between compressed and uncompressed data
+	// blocks to exercise both.
+	uncompressed bool
+}
+
+func (w *imageWriter) writeBlock(b []byte) uint32 {
+	w.uncompressed = !w.uncompressed
+	if c := compress(b); !w.uncompressed && len(c) < len(b) {
+		w.data.Write(c)
+		return uint32(len(c))
+	}
+	w.data.Write(b)
+	return uint32(len(b)) | blockUncompressed
+}
+
+func (w *imageWriter) header(typ uint16, perm uint16) inodeHeader {
+	w.nextInode++
+	return inodeHeader{Type: typ, Permissions: perm, InodeNumber: w.nextInode}
+}
+
+// add writes n (and any children) and returns its inode reference, number
+// and type.
+func (w *imageWriter) add(n *node, parent uint32) (uint64, uint32, uint16) {
+	if n.children != nil {
+		return w.addDir(n, parent)
+	}
+
+	start, off := w.inodes.ref()
+	ref := uint64(start)<<16 | uint64(off)
+	if n.target != "" {
+		hdr := w.header(typeSymlink, 0777)
+		w.inodes.write(hdr)
+		w.inodes.write([]uint32{1, uint32(len(n.target))})
+		w.inodes.write([]byte(n.target))
+		return ref, hdr.InodeNumber, typeSymlink
+	}
+
+	blocksStart := superblockSize + uint64(w.data.Len())
+	full := len(n.data) / testBlockSize * testBlockSize
+	if n.ext {
+		full = len(n.data)
+	}
+	var sizes []uint32
+	for i := 0; i < full; i += testBlockSize {
+		end := i + testBlockSize
+		if end > full {
+			end = full
+		}
+		sizes = append(sizes, w.writeBlock(n.data[i:end]))
+	}
+	fragment, fragOffset := uint32(noFragment), uint32(0)
+	if tail := n.data[full:]; len(tail) > 0 {
+		fragment, fragOffset = 0, uint32(len(w.frag))
+		w.frag = append(w.frag, tail...)
+	}
+
+	if n.ext {
+		hdr := w.header(typeExtFile, 0644)
+		w.inodes.write(hdr)
+		w.inodes.write(struct {
+			BlocksStart, FileSize, Sparse           uint64
+			LinkCount, Fragment, BlockOffset, Xattr uint32
+		}{blocksStart, uint64(len(n.data)), 0, 1, fragment, fragOffset, noFragment})
+		w.inodes.write(sizes)
+		return ref, hdr.InodeNumber, typeFile
+	}
+	hdr := w.header(typeFile, 0644)
+	w.inodes.write(hdr)
+	w.inodes.write([]uint32{uint32(blocksStart), fragment, fragOffset, uint32(len(n.data))})
+	w.inodes.write(sizes)
+	return ref, hdr.InodeNumber, typeFile
+}
+
+func (w *imageWriter) addDir(n *node, parent uint32) (uint64, uint32, uint16) {
+	sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+
+	// Children's inodes come first, as mksquashfs does it.
+	type child struct {
+		ref  uint64
+		num  uint32
+		typ  uint16
+		name string
+	}
+	// Inodes are numbered in the order written, so ours is the last.
+	self := w.nextInode + uint32(countInodes(n))
+	var children []child
+	for _, c := range n.children {
+		ref, num, typ := w.add(c, self)
+		children = append(children, child{ref, num, typ, c.name})
+	}
+
+	dirBlock, dirOffset := w.dirs.ref()
+	var listing bytes.Buffer
+	for i := 0; i < len(children); {
+		// Each header covers entries in the same inode block.
+		j := i + 1
+		for j < len(children) && j-i < 256 && children[j].ref>>16 == children[i].ref>>16 {
+			j++
+		}
+		binary.Write(&listing, binary.LittleEndian, dirHeader{
+			Count:       uint32(j - i - 1),
+			Start:       uint32(children[i].ref >> 16),
+			InodeNumber: children[i].num,
+		})
+		for _, c := range children[i:j] {
+			binary.Write(&listing, binary.LittleEndian, dirEntry{
+				Offset:      uint16(c.ref),
+				InodeOffset: int16(c.num - children[i].num),
+				Type:        c.typ,
+				NameSize:    uint16(len(c.name) - 1),
+			})
+			listing.WriteString(c.name)
+		}
+		i = j
+	}
+	w.dirs.write(listing.Bytes())
+
+	start, off := w.inodes.ref()
+	hdr := w.header(typeDir, 0755)
+	w.inodes.write(hdr)
+	w.inodes.write(struct {
+		BlockIndex, LinkCount uint32
+		FileSize, BlockOffset uint16
+		ParentInode           uint32
+	}{dirBlock, 2, uint16(listing.Len() + 3), dirOffset, parent})
+	return uint64(start)<<16 | uint64(off), hdr.InodeNumber, typeDir
+}
+
+func countInodes(n *node) int {
+	c := 1
+	for _, ch := range n.children {
+		c += countInodes(ch)
+	}
+	return c
+}
+
+const superblockSize = 96
+
+// image returns a squashfs image of the tree under root.
+func image(root *node) []byte {
+	w := &imageWriter{}
+	rootRef, _, _ := w.add(root, uint32(countInodes(root)+1))
+
+	sb := superblock{
+		Magic:              Magic,
+		InodeCount:         w.nextInode,
+		BlockSize:          testBlockSize,
+		CompressionID:      compressionGzip,
+		BlockLog:           12,
+		IDCount:            1,
+		VersionMajor:       4,
+		RootInodeRef:       rootRef,
+		XattrIDTableStart:  ^uint64(0),
+		ExportTableStart:   ^uint64(0),
+		FragmentEntryCount: 0,
+	}
+
+	var fragEntries metadataWriter
+	if len(w.frag) > 0 {
+		start := superblockSize + uint64(w.data.Len())
+		size := w.writeBlock(w.frag)
+		fragEntries.write(fragmentEntry{Start: start, Size: size})
+		sb.FragmentEntryCount = 1
+	}
+
+	var img bytes.Buffer
+	img.Write(make([]byte, superblockSize))
+	img.Write(w.data.Bytes())
+
+	sb.InodeTableStart = uint64(img.Len())
+	img.Write(w.inodes.finish())
+	sb.DirectoryTableStart = uint64(img.Len())
+	img.Write(w.dirs.finish())
+
+	fragBlock := uint64(img.Len())
+	img.Write(fragEntries.finish())
+	sb.FragmentTableStart = uint64(img.Len())
+	binary.Write(&img, binary.LittleEndian, fragBlock)
+
+	var ids metadataWriter
+	ids.write(uint32(0))
+	idBlock := uint64(img.Len())
+	img.Write(ids.finish())
+	sb.IDTableStart = uint64(img.Len())
+	binary.Write(&img, binary.LittleEndian, idBlock)
+
+	sb.BytesUsed = uint64(img.Len())
+	var hdr bytes.Buffer
+	binary.Write(&hdr, binary.LittleEndian, sb)
+	b := img.Bytes()
+	copy(b, hdr.Bytes())
+	return b
+}
+
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		// Partly compressible, partly not.
+		if i%3 == 0 {
+			b[i] = seed
+		} else {
+			b[i] = byte(i*7) ^ byte(i>>8) ^ seed
+		}
+	}
+	return b
+}
+
+func testTree() (*node, map[string][]byte) {
+	kernel := pattern(3*testBlockSize+1808, 1)
+	initrd := pattern(100, 2)
+	big := pattern(2*testBlockSize+17, 3)
+
+	// Enough files to spill the inode table into more metadata blocks.
+	var many []*node
+	want := map[string][]byte{
+		"boot/vmlinuz-4.18": kernel,
+		"boot/initrd.img":   initrd,
+		"big":               big,
+	}
+	for i := 0; i < 400; i++ {
+		name := fmt.Sprintf("f%03d", i)
+		data := []byte(name)
+		many = append(many, &node{name: name, data: data})
+		want["many/"+name] = data
+	}
+
+	root := &node{children: []*node{
+		{name: "boot", children: []*node{
+			{name: "vmlinuz-4.18", data: kernel},
+			{name: "initrd.img", data: initrd},
+			{name: "vmlinuz", target: "vmlinuz-4.18"},
+		}},
+		{name: "vmlinuz", target: "/boot/vmlinuz"},
+		{name: "initrd", target: "boot/../boot/initrd.img"},
+		{name: "big", data: big, ext: true},
+		{name: "many", children: many},
+		{name: "empty", children: []*node{}},
+	}}
+	want["vmlinuz"] = kernel
+	want["initrd"] = initrd
+	return root, want
+}
+
+func TestOpen(t *testing.T) {
+	root, want := testTree()
+	fs, err := New(bytes.NewReader(image(root)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range want {
+		r, err := fs.Open(name)
+		if err != nil {
+			t.Errorf("Open(%q) = %v", name, err)
+			continue
+		}
+		got, err := uio.ReadAll(r)
+		if err != nil {
+			t.Errorf("reading %q: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("contents of %q differ: got %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+
+	// Reads in the middle of a file and across blocks.
+	r, err := fs.Open("/boot/vmlinuz-4.18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 100)
+	if _, err := r.ReadAt(b, testBlockSize-50); err != nil {
+		t.Fatal(err)
+	}
+	if k := want["vmlinuz"]; !bytes.Equal(b, k[testBlockSize-50:testBlockSize+50]) {
+		t.Errorf("ReadAt across blocks returned wrong data")
+	}
+
+	for _, name := range []string{"nonexistent", "boot/nonexistent", "boot", "empty/x", "big/x"} {
+		if _, err := fs.Open(name); err == nil {
+			t.Errorf("Open(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	root, _ := testTree()
+	img := image(root)
+	for _, tt := range []struct {
+		name string
+		mod  func([]byte)
+	}{
+		{"magic", func(b []byte) { b[0] = 'x' }},
+		{"version", func(b []byte) { b[28] = 3 }},
+		{"compression", func(b []byte) { b[20] = 4 }},
+	} {
+		b := append([]byte(nil), img...)
+		tt.mod(b)
+		if _, err := New(bytes.NewReader(b)); err == nil {
+			t.Errorf("New with bad %s = nil, want error", tt.name)
+		}
+	}
+	if _, err := New(bytes.NewReader(nil)); err == nil {
+		t.Errorf("New(empty) = nil, want error")
+	}
+}
+
+func TestLinuxImageFromSquashFS(t *testing.T) {
+	root, want := testTree()
+	img := image(root)
+
+	li, err := LinuxImageFromSquashFS(bytes.NewReader(img), "vmlinuz", "boot/initrd.img", "console=ttyS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li.Cmdline != "console=ttyS0" {
+		t.Errorf("Cmdline = %q, want console=ttyS0", li.Cmdline)
+	}
+	for _, f := range []struct {
+		name string
+		r    io.ReaderAt
+		want []byte
+	}{
+		{"kernel", li.Kernel, want["vmlinuz"]},
+		{"initrd", li.Initrd, want["initrd"]},
+	} {
+		got, err := uio.ReadAll(f.r)
+		if err != nil || !bytes.Equal(got, f.want) {
+			t.Errorf("%s: got %d bytes (%v), want %d", f.name, len(got), err, len(f.want))
+		}
+	}
+
+	li, err = LinuxImageFromSquashFS(bytes.NewReader(img), "vmlinuz", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li.Initrd != nil {
+		t.Errorf("Initrd = %v, want nil", li.Initrd)
+	}
+
+	if _, err := LinuxImageFromSquashFS(bytes.NewReader(img), "vmlinuz", "initrd.gz", ""); err == nil {
+		t.Errorf("LinuxImageFromSquashFS with missing initrd = nil, want error")
+	}
+}
+
+// TestMksquashfs checks against an image made by the real thing.
+func TestMksquashfs(t *testing.T) {
+	mksquashfs, err := exec.LookPath("mksquashfs")
+	if err != nil {
+		t.Skip("Skipping, mksquashfs not found")
+	}
+	dir, err := ioutil.TempDir("", "squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel := pattern(300000, 4)
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "boot"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "boot", "vmlinuz-4.18"), kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("boot/vmlinuz-4.18", filepath.Join(root, "vmlinuz")); err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(dir, "img.sqfs")
+	if out, err := exec.Command(mksquashfs, root, img, "-comp", "gzip", "-noappend").CombinedOutput(); err != nil {
+		t.Fatalf("mksquashfs: %v: %s", err, out)
+	}
+
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	li, err := LinuxImageFromSquashFS(f, "vmlinuz", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := uio.ReadAll(li.Kernel)
+	if err != nil || !bytes.Equal(got, kernel) {
+		t.Errorf("kernel: got %d bytes (%v), want %d", len(got), err, len(kernel))
+	}
+}
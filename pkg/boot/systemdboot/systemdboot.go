@@ -0,0 +1,263 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package systemdboot reads systemd-boot configuration.
+//
+// Type 1 entries of the Boot Loader Specification are read from
+// $ESP/loader/entries/*.conf; see
+// https://systemd.io/BOOT_LOADER_SPECIFICATION.
+package systemdboot
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// loaderGUID is the vendor GUID of the EFI variables systemd-boot uses.
+const loaderGUID = "4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"
+
+// efivarsDir is where efivarfs is mounted.
+var efivarsDir = "/sys/firmware/efi/efivars"
+
+// efiArch maps GOARCH to the architecture names used by entries.
+var efiArch = map[string]string{
+	"386":     "ia32",
+	"amd64":   "x64",
+	"arm":     "arm",
+	"arm64":   "aa64",
+	"riscv64": "riscv64",
+}
+
+// Entry is a Type 1 boot loader entry.
+type Entry struct {
+	// ID is the file name of the entry without .conf.
+	ID string
+
+	Title        string
+	Version      string
+	MachineID    string
+	Architecture string
+	Linux        string
+	Initrds      []string
+	Options      string
+}
+
+// ParseEntry parses the entry with the given ID from r.
+func ParseEntry(id string, r io.Reader) (*Entry, error) {
+	e := &Entry{ID: id}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		key, value := fields[0], strings.TrimSpace(strings.TrimPrefix(l, fields[0]))
+		switch key {
+		case "title":
+			e.Title = value
+		case "version":
+			e.Version = value
+		case "machine-id":
+			e.MachineID = value
+		case "architecture":
+			e.Architecture = strings.ToLower(value)
+		case "linux":
+			e.Linux = value
+		case "initrd":
+			e.Initrds = append(e.Initrds, value)
+		case "options":
+			// Multiple options lines are all passed on.
+			if e.Options != "" {
+				e.Options += " "
+			}
+			e.Options += value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// name returns what systemd-boot displays for e.
+func (e *Entry) name() string {
+	if e.Title != "" {
+		return e.Title
+	}
+	return e.ID
+}
+
+// Entries returns the entries in esp/loader/entries that can be booted on
+// this architecture, sorted by title.
+func Entries(esp string) ([]*Entry, error) {
+	dir := filepath.Join(esp, "loader", "entries")
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".conf") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		e, err := ParseEntry(strings.TrimSuffix(fi.Name(), ".conf"), f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fi.Name(), err)
+		}
+		// Entries for EFI programs other than Linux cannot be kexec'd.
+		if e.Linux == "" {
+			continue
+		}
+		if e.Architecture != "" && e.Architecture != efiArch[runtime.GOARCH] {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].name() != entries[j].name() {
+			return entries[i].name() < entries[j].name()
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// LinuxImage returns a LinuxImage for e, with the paths in e relative to esp.
+func (e *Entry) LinuxImage(esp string) (*boot.LinuxImage, error) {
+	li := &boot.LinuxImage{Cmdline: e.Options}
+	k, err := os.Open(espPath(esp, e.Linux))
+	if err != nil {
+		return nil, err
+	}
+	li.Kernel = k
+
+	switch len(e.Initrds) {
+	case 0:
+	case 1:
+		if li.Initrd, err = os.Open(espPath(esp, e.Initrds[0])); err != nil {
+			k.Close()
+			return nil, err
+		}
+	default:
+		// Like systemd-boot, concatenate all initrds.
+		var b bytes.Buffer
+		for _, i := range e.Initrds {
+			c, err := ioutil.ReadFile(espPath(esp, i))
+			if err != nil {
+				k.Close()
+				return nil, err
+			}
+			b.Write(c)
+		}
+		li.Initrd = bytes.NewReader(b.Bytes())
+	}
+	return li, nil
+}
+
+// espPath returns the path of the ESP-relative path p, which uses / as
+// separator, as it would on FAT.
+func espPath(esp, p string) string {
+	return filepath.Join(esp, filepath.FromSlash(path.Clean("/"+strings.Replace(p, "\\", "/", -1))))
+}
+
+// LinuxImages returns the LinuxImages of all entries in esp, sorted by title.
+func LinuxImages(esp string) ([]*boot.LinuxImage, error) {
+	entries, err := Entries(esp)
+	if err != nil {
+		return nil, err
+	}
+	var images []*boot.LinuxImage
+	for _, e := range entries {
+		li, err := e.LinuxImage(esp)
+		if err != nil {
+			return nil, fmt.Errorf("entry %s: %v", e.ID, err)
+		}
+		images = append(images, li)
+	}
+	return images, nil
+}
+
+// readEFIString reads the UTF-16 string in the loader EFI variable name.
+func readEFIString(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(efivarsDir, name+"-"+loaderGUID))
+	if err != nil {
+		return "", err
+	}
+	// The first 4 bytes are the variable attributes.
+	if len(b) < 4 || len(b)%2 != 0 {
+		return "", fmt.Errorf("EFI variable %s is malformed", name)
+	}
+	b = b[4:]
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := uint16(b[i]) | uint16(b[i+1])<<8
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+// Default returns the default entry among entries, as chosen by the default
+// key of esp/loader/loader.conf.
+//
+// The default is a glob matched against entry IDs or, if it is @saved, the
+// entry systemd-boot last booted. If several entries match, the last one
+// wins; without a match, the first entry is the default.
+func Default(esp string, entries []*Entry) (*Entry, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+
+	pattern := ""
+	if f, err := os.Open(filepath.Join(esp, "loader", "loader.conf")); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) >= 2 && fields[0] == "default" {
+				pattern = fields[1]
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if pattern == "@saved" {
+		var err error
+		if pattern, err = readEFIString("LoaderEntryLastBooted"); err != nil {
+			pattern = ""
+		}
+	}
+	if pattern != "" {
+		pattern = strings.TrimSuffix(pattern, ".conf")
+		for i := len(entries) - 1; i >= 0; i-- {
+			if ok, _ := path.Match(pattern, entries[i].ID); ok {
+				return entries[i], nil
+			}
+		}
+	}
+	return entries[0], nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package systemdboot
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Entries as written by common distributions.
+var entryFiles = map[string]string{
+	// Arch Linux, as on the wiki.
+	"arch.conf": `title   Arch Linux
+linux   /vmlinuz-linux
+initrd  /intel-ucode.img
+initrd  /initramfs-linux.img
+options root=PARTUUID=14420948-2cea-4de7-b042-40f67c618660 rw
+`,
+	// Fedora, via kernel-install.
+	"6a9857a393724b7a981ebb5b8495b9ea-4.18.16-300.fc29.x86_64.conf": `title Fedora (4.18.16-300.fc29.x86_64) 29 (Workstation Edition)
+version 4.18.16-300.fc29.x86_64
+machine-id 6a9857a393724b7a981ebb5b8495b9ea
+options root=/dev/mapper/fedora-root ro rd.lvm.lv=fedora/root rhgb quiet
+linux /6a9857a393724b7a981ebb5b8495b9ea/4.18.16-300.fc29.x86_64/linux
+initrd /6a9857a393724b7a981ebb5b8495b9ea/4.18.16-300.fc29.x86_64/initrd
+`,
+	// Comments, a second options line and architecture.
+	"ubuntu.conf": `# Managed by hand.
+title      Ubuntu 18.04
+linux      \EFI\ubuntu\vmlinuz
+options    root=/dev/sda2
+options    quiet splash
+
+architecture x64
+`,
+	// An EFI program, which cannot be kexec'd.
+	"memtest.conf": `title Memtest86+
+efi /EFI/memtest86/memtest.efi
+`,
+	// Another architecture.
+	"pi.conf": `title Raspberry Pi
+linux /pi/Image
+architecture aa64
+`,
+	"notes.txt": "not an entry",
+}
+
+var files = map[string]string{
+	"vmlinuz-linux":       "arch kernel",
+	"intel-ucode.img":     "ucode|",
+	"initramfs-linux.img": "arch initramfs",
+	"6a9857a393724b7a981ebb5b8495b9ea/4.18.16-300.fc29.x86_64/linux":  "fedora kernel",
+	"6a9857a393724b7a981ebb5b8495b9ea/4.18.16-300.fc29.x86_64/initrd": "fedora initrd",
+	"EFI/ubuntu/vmlinuz": "ubuntu kernel",
+	"pi/Image":           "pi kernel",
+}
+
+func mkESP(t *testing.T, loaderConf string) string {
+	esp, err := ioutil.TempDir("", "esp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		p := filepath.Join(esp, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range entryFiles {
+		write(filepath.Join("loader", "entries", name), content)
+	}
+	for name, content := range files {
+		write(name, content)
+	}
+	if loaderConf != "" {
+		write("loader/loader.conf", loaderConf)
+	}
+	return esp
+}
+
+func TestParseEntry(t *testing.T) {
+	e, err := ParseEntry("arch", strings.NewReader(entryFiles["arch.conf"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Entry{
+		ID:      "arch",
+		Title:   "Arch Linux",
+		Linux:   "/vmlinuz-linux",
+		Initrds: []string{"/intel-ucode.img", "/initramfs-linux.img"},
+		Options: "root=PARTUUID=14420948-2cea-4de7-b042-40f67c618660 rw",
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("ParseEntry = %+v, want %+v", e, want)
+	}
+
+	e, err = ParseEntry("ubuntu", strings.NewReader(entryFiles["ubuntu.conf"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Options != "root=/dev/sda2 quiet splash" || e.Architecture != "x64" {
+		t.Errorf("ParseEntry(ubuntu) = %+v", e)
+	}
+
+	id := "6a9857a393724b7a981ebb5b8495b9ea-4.18.16-300.fc29.x86_64"
+	e, err = ParseEntry(id, strings.NewReader(entryFiles[id+".conf"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.MachineID != "6a9857a393724b7a981ebb5b8495b9ea" || e.Version != "4.18.16-300.fc29.x86_64" {
+		t.Errorf("ParseEntry(fedora) = %+v", e)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	esp := mkESP(t, "")
+	defer os.RemoveAll(esp)
+
+	entries, err := Entries(esp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, e := range entries {
+		titles = append(titles, e.Title)
+	}
+	want := []string{"Arch Linux", "Fedora (4.18.16-300.fc29.x86_64) 29 (Workstation Edition)"}
+	switch efiArch[runtime.GOARCH] {
+	case "x64":
+		want = append(want, "Ubuntu 18.04")
+	case "aa64":
+		want = []string{"Arch Linux", "Fedora (4.18.16-300.fc29.x86_64) 29 (Workstation Edition)", "Raspberry Pi"}
+	}
+	if !reflect.DeepEqual(titles, want) {
+		t.Errorf("Entries = %q, want %q", titles, want)
+	}
+
+	images, err := LinuxImages(esp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != len(want) {
+		t.Fatalf("LinuxImages returned %d images, want %d", len(images), len(want))
+	}
+	for i, tt := range []struct {
+		kernel, initrd, cmdline string
+	}{
+		{"arch kernel", "ucode|arch initramfs", "root=PARTUUID=14420948-2cea-4de7-b042-40f67c618660 rw"},
+		{"fedora kernel", "fedora initrd", "root=/dev/mapper/fedora-root ro rd.lvm.lv=fedora/root rhgb quiet"},
+	} {
+		li := images[i]
+		k, err := uio.ReadAll(li.Kernel)
+		if err != nil || string(k) != tt.kernel {
+			t.Errorf("image %d: kernel = %q, %v, want %q", i, k, err, tt.kernel)
+		}
+		initrd, err := uio.ReadAll(li.Initrd)
+		if err != nil || string(initrd) != tt.initrd {
+			t.Errorf("image %d: initrd = %q, %v, want %q", i, initrd, err, tt.initrd)
+		}
+		if li.Cmdline != tt.cmdline {
+			t.Errorf("image %d: cmdline = %q, want %q", i, li.Cmdline, tt.cmdline)
+		}
+	}
+}
+
+func TestMissingKernel(t *testing.T) {
+	esp := mkESP(t, "")
+	defer os.RemoveAll(esp)
+	if err := os.Remove(filepath.Join(esp, "vmlinuz-linux")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinuxImages(esp); err == nil {
+		t.Errorf("LinuxImages with missing kernel = nil, want error")
+	}
+}
+
+func writeEFIString(t *testing.T, dir, name, value string) {
+	b := []byte{7, 0, 0, 0}
+	for _, c := range utf16.Encode([]rune(value + "\x00")) {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-"+loaderGUID), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	vars, err := ioutil.TempDir("", "efivars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vars)
+	defer func(old string) { efivarsDir = old }(efivarsDir)
+	efivarsDir = vars
+
+	fedora := "6a9857a393724b7a981ebb5b8495b9ea-4.18.16-300.fc29.x86_64"
+	for _, tt := range []struct {
+		name       string
+		loaderConf string
+		saved      string
+		want       string
+	}{
+		{"none", "", "", "arch"},
+		{"exact", "timeout 3\ndefault arch.conf\n", "", "arch"},
+		{"glob", "default 6a9857a393724b7a981ebb5b8495b9ea-*\n", "", fedora},
+		{"no match", "default debian*\n", "", "arch"},
+		{"saved", "default @saved\n", fedora, fedora},
+		{"saved missing", "default @saved\n", "", "arch"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			esp := mkESP(t, tt.loaderConf)
+			defer os.RemoveAll(esp)
+
+			os.Remove(filepath.Join(vars, "LoaderEntryLastBooted-"+loaderGUID))
+			if tt.saved != "" {
+				writeEFIString(t, vars, "LoaderEntryLastBooted", tt.saved)
+			}
+
+			entries, err := Entries(esp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := Default(esp, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.ID != tt.want {
+				t.Errorf("Default = %s, want %s", e.ID, tt.want)
+			}
+		})
+	}
+
+	if _, err := Default("", nil); err == nil {
+		t.Errorf("Default with no entries = nil, want error")
+	}
+}
+
+func readAll(t *testing.T, r io.ReaderAt) string {
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestInstallSystemdBootEntry(t *testing.T) {
+	esp := mkESP(t, "")
+	defer os.RemoveAll(esp)
+
+	for _, li := range []*boot.LinuxImage{
+		boot.NewLinuxImage(strings.NewReader("u-root kernel"), strings.NewReader("u-root initrd"), "console=ttyS0 quiet"),
+		boot.NewLinuxImage(strings.NewReader("minimal kernel"), nil, ""),
+	} {
+		name := strings.Fields(readAll(t, li.Kernel))[0]
+		if err := boot.InstallSystemdBootEntry(li, esp, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := Entries(esp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]*Entry)
+	for _, e := range entries {
+		found[e.ID] = e
+	}
+	for _, tt := range []struct {
+		id, kernel, initrd, cmdline string
+	}{
+		{"u-root", "u-root kernel", "u-root initrd", "console=ttyS0 quiet"},
+		{"minimal", "minimal kernel", "", ""},
+	} {
+		e, ok := found[tt.id]
+		if !ok {
+			t.Errorf("Entries() has no %s entry: %v", tt.id, entries)
+			continue
+		}
+		if e.Title != tt.id {
+			t.Errorf("%s: title = %q, want %q", tt.id, e.Title, tt.id)
+		}
+		li, err := e.LinuxImage(esp)
+		if err != nil {
+			t.Errorf("%s: LinuxImage() = %v", tt.id, err)
+			continue
+		}
+		if k := readAll(t, li.Kernel); k != tt.kernel {
+			t.Errorf("%s: kernel = %q, want %q", tt.id, k, tt.kernel)
+		}
+		var initrd string
+		if li.Initrd != nil {
+			initrd = readAll(t, li.Initrd)
+		}
+		if initrd != tt.initrd || li.Cmdline != tt.cmdline {
+			t.Errorf("%s: initrd, cmdline = %q, %q, want %q, %q", tt.id, initrd, li.Cmdline, tt.initrd, tt.cmdline)
+		}
+	}
+}
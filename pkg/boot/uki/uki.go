@@ -0,0 +1,308 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package uki reads and builds Unified Kernel Images.
+//
+// A UKI is an EFI stub with the kernel, initrd, command line and some
+// metadata added to it as PE/COFF sections; see
+// https://uapi-group.org/specifications/specs/unified_kernel_image/.
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// UKI is what a Unified Kernel Image holds. Only Kernel is always set.
+type UKI struct {
+	// Kernel is the .linux section.
+	Kernel io.ReaderAt
+	// Initrd is the .initrd section.
+	Initrd io.ReaderAt
+	// Cmdline is the .cmdline section.
+	Cmdline string
+	// Uname is the .uname section, the kernel release.
+	Uname string
+	// OSRelease is the .osrel section, the os-release(5) of the OS.
+	OSRelease map[string]string
+	// DTB is the .dtb section, a device tree for the kernel.
+	DTB io.ReaderAt
+}
+
+// ErrNoKernel is returned for PE binaries without a .linux section.
+var ErrNoKernel = errors.New("no .linux section; not a UKI")
+
+// sectionReader returns the contents of s in r. The raw data of sections is
+// padded to the file alignment, which VirtualSize leaves out.
+func sectionReader(r io.ReaderAt, s *pe.Section) io.ReaderAt {
+	size := s.Size
+	if s.VirtualSize != 0 && s.VirtualSize < size {
+		size = s.VirtualSize
+	}
+	return io.NewSectionReader(r, int64(s.Offset), int64(size))
+}
+
+// readString returns the section s in r as a string, without the NULs and
+// white space it may end with.
+func readString(r io.ReaderAt, s *pe.Section) (string, error) {
+	b, err := uio.ReadAll(sectionReader(r, s))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", s.Name, err)
+	}
+	return strings.TrimRight(string(b), "\x00 \t\r\n"), nil
+}
+
+// parseOSRelease parses os-release(5) KEY=VALUE lines.
+func parseOSRelease(s string) map[string]string {
+	m := make(map[string]string)
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		m[kv[0]] = v
+	}
+	return m
+}
+
+// Parse returns the sections of the UKI r.
+func Parse(r io.ReaderAt) (*UKI, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("parsing PE: %v", err)
+	}
+	u := &UKI{}
+	for _, s := range f.Sections {
+		switch s.Name {
+		case ".linux":
+			u.Kernel = sectionReader(r, s)
+		case ".initrd":
+			u.Initrd = sectionReader(r, s)
+		case ".dtb":
+			u.DTB = sectionReader(r, s)
+		case ".cmdline":
+			if u.Cmdline, err = readString(r, s); err != nil {
+				return nil, err
+			}
+		case ".uname":
+			if u.Uname, err = readString(r, s); err != nil {
+				return nil, err
+			}
+		case ".osrel":
+			osrel, err := readString(r, s)
+			if err != nil {
+				return nil, err
+			}
+			u.OSRelease = parseOSRelease(osrel)
+		}
+	}
+	if u.Kernel == nil {
+		return nil, ErrNoKernel
+	}
+	return u, nil
+}
+
+// LinuxImageFromUKI returns the kernel, initrd and command line of the UKI
+// r as a LinuxImage. The .uname section, if any, becomes the Version of its
+// metadata and .osrel its CustomTags.
+//
+// The .dtb section is not used, as kexec_file_load(2) hands the kernel the
+// device tree it booted with; Parse returns it.
+func LinuxImageFromUKI(r io.ReaderAt) (*boot.LinuxImage, error) {
+	u, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	li := boot.NewLinuxImage(u.Kernel, u.Initrd, u.Cmdline)
+	if u.Uname != "" || len(u.OSRelease) > 0 {
+		li.SetMetadata(boot.ImageMetadata{Version: u.Uname, CustomTags: u.OSRelease})
+	}
+	return li, nil
+}
+
+// section is a section to add to a PE binary.
+type section struct {
+	name string
+	data []byte
+}
+
+// BuildUKI returns the UKI made of the EFI stub efistub, such as systemd's
+// linuxx64.efi.stub, and li: its kernel, initrd with overlays and command
+// line, and, if li has metadata, its Version as .uname and CustomTags as
+// .osrel.
+//
+// The UKI is not signed. efistub must not be either, as adding sections
+// breaks the signature.
+func BuildUKI(li *boot.LinuxImage, efistub io.ReaderAt) ([]byte, error) {
+	if li.Kernel == nil {
+		return nil, boot.ErrKernelMissing
+	}
+	stub, err := uio.ReadAll(efistub)
+	if err != nil {
+		return nil, fmt.Errorf("reading EFI stub: %v", err)
+	}
+
+	var secs []section
+	if m, err := li.GetMetadata(); err == nil {
+		if len(m.CustomTags) > 0 {
+			var keys []string
+			for k := range m.CustomTags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var b strings.Builder
+			for _, k := range keys {
+				fmt.Fprintf(&b, "%s=%q\n", k, m.CustomTags[k])
+			}
+			secs = append(secs, section{".osrel", []byte(b.String())})
+		}
+		if m.Version != "" {
+			secs = append(secs, section{".uname", []byte(m.Version)})
+		}
+	}
+	if li.Cmdline != "" {
+		secs = append(secs, section{".cmdline", []byte(li.Cmdline)})
+	}
+	initrd, closeInitrd, err := li.InitrdWithOverlays()
+	if err != nil {
+		return nil, fmt.Errorf("building initrd: %v", err)
+	}
+	defer closeInitrd()
+	if initrd != nil {
+		b, err := uio.ReadAll(initrd)
+		if err != nil {
+			return nil, fmt.Errorf("reading initrd: %v", err)
+		}
+		secs = append(secs, section{".initrd", b})
+	}
+	kernel, err := uio.ReadAll(li.Kernel)
+	if err != nil {
+		return nil, fmt.Errorf("reading kernel: %v", err)
+	}
+	secs = append(secs, section{".linux", kernel})
+	return addSections(stub, secs)
+}
+
+// Offsets in the PE/COFF headers.
+const (
+	peSignatureOffset = 0x3c
+
+	coffNumberOfSections     = 2
+	coffSizeOfOptionalHeader = 16
+	coffHeaderLen            = 20
+
+	optSectionAlignment = 32
+	optFileAlignment    = 36
+	optSizeOfImage      = 56
+	optSizeOfHeaders    = 60
+	optCheckSum         = 64
+	pe32DataDirectories = 96
+	pe64DataDirectories = 112
+
+	sectionHeaderLen = 40
+
+	// The certificate table is data directory 4.
+	certTableDirectory = 4
+
+	scnInitializedData = 0x00000040
+	scnMemRead         = 0x40000000
+)
+
+func align(n, a uint32) uint32 {
+	if a == 0 {
+		return n
+	}
+	return (n + a - 1) / a * a
+}
+
+// addSections returns stub with secs added after its sections, as
+// read-only data.
+func addSections(stub []byte, secs []section) ([]byte, error) {
+	if _, err := pe.NewFile(bytes.NewReader(stub)); err != nil {
+		return nil, fmt.Errorf("parsing EFI stub: %v", err)
+	}
+	le := binary.LittleEndian
+	coff := int(le.Uint32(stub[peSignatureOffset:])) + 4
+	opt := coff + coffHeaderLen
+	optLen := int(le.Uint16(stub[coff+coffSizeOfOptionalHeader:]))
+	nsecs := int(le.Uint16(stub[coff+coffNumberOfSections:]))
+	if optLen < optSizeOfHeaders+4 {
+		return nil, fmt.Errorf("EFI stub optional header of %d bytes is too short", optLen)
+	}
+
+	dirs := opt + pe64DataDirectories
+	if le.Uint16(stub[opt:]) == 0x10b {
+		dirs = opt + pe32DataDirectories
+	}
+	if cert := dirs + 8*certTableDirectory; cert+8 <= opt+optLen && le.Uint32(stub[cert+4:]) != 0 {
+		return nil, errors.New("EFI stub is signed; sign the UKI instead")
+	}
+
+	sectionAlign := le.Uint32(stub[opt+optSectionAlignment:])
+	fileAlign := le.Uint32(stub[opt+optFileAlignment:])
+	headersLen := le.Uint32(stub[opt+optSizeOfHeaders:])
+	table := opt + optLen
+	end := table + (nsecs+len(secs))*sectionHeaderLen
+	if uint32(end) > headersLen || end > len(stub) {
+		return nil, fmt.Errorf("EFI stub has room in its headers for %d more sections, want %d", (int(headersLen)-table)/sectionHeaderLen-nsecs, len(secs))
+	}
+
+	// New sections go after the old ones, in memory and in the file.
+	va := le.Uint32(stub[opt+optSizeOfImage:])
+	for i := 0; i < nsecs; i++ {
+		h := stub[table+i*sectionHeaderLen:]
+		if e := le.Uint32(h[12:]) + le.Uint32(h[8:]); e > va {
+			va = e
+		}
+	}
+	fileEnd := uint32(len(stub))
+
+	out := append([]byte(nil), stub...)
+	for i, s := range secs {
+		va = align(va, sectionAlign)
+		off := align(fileEnd, fileAlign)
+		rawLen := align(uint32(len(s.data)), fileAlign)
+
+		h := out[table+(nsecs+i)*sectionHeaderLen:][:sectionHeaderLen]
+		for j := range h {
+			h[j] = 0
+		}
+		copy(h, s.name)
+		le.PutUint32(h[8:], uint32(len(s.data)))
+		le.PutUint32(h[12:], va)
+		le.PutUint32(h[16:], rawLen)
+		le.PutUint32(h[20:], off)
+		le.PutUint32(h[36:], scnInitializedData|scnMemRead)
+
+		if pad := int(off) - len(out); pad > 0 {
+			out = append(out, make([]byte, pad)...)
+		}
+		out = append(out, s.data...)
+		out = append(out, make([]byte, rawLen-uint32(len(s.data)))...)
+		va += uint32(len(s.data))
+		fileEnd = off + rawLen
+	}
+	le.PutUint16(out[coff+coffNumberOfSections:], uint16(nsecs+len(secs)))
+	le.PutUint32(out[opt+optSizeOfImage:], align(va, sectionAlign))
+	// EFI firmware does not check the checksum.
+	le.PutUint32(out[opt+optCheckSum:], 0)
+	return out, nil
+}
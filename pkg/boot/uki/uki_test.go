@@ -0,0 +1,202 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// efiStub returns a PE32+ EFI application with a .text section, laid out as
+// a linker would, with room in its headers for more sections.
+func efiStub() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 0x600)
+	copy(b, "MZ")
+	le.PutUint32(b[peSignatureOffset:], 0x40)
+	copy(b[0x40:], "PE\x00\x00")
+
+	coff := 0x44
+	le.PutUint16(b[coff:], pe.IMAGE_FILE_MACHINE_AMD64)
+	le.PutUint16(b[coff+coffNumberOfSections:], 1)
+	le.PutUint16(b[coff+coffSizeOfOptionalHeader:], 240)
+	le.PutUint16(b[coff+18:], 0x22)
+
+	opt := coff + coffHeaderLen
+	le.PutUint16(b[opt:], 0x20b)
+	le.PutUint32(b[opt+optSectionAlignment:], 0x1000)
+	le.PutUint32(b[opt+optFileAlignment:], 0x200)
+	le.PutUint32(b[opt+optSizeOfImage:], 0x2000)
+	le.PutUint32(b[opt+optSizeOfHeaders:], 0x400)
+	// EFI application.
+	le.PutUint16(b[opt+68:], 10)
+	le.PutUint32(b[opt+108:], 16)
+
+	text := b[opt+240:]
+	copy(text, ".text")
+	le.PutUint32(text[8:], 0x10)
+	le.PutUint32(text[12:], 0x1000)
+	le.PutUint32(text[16:], 0x200)
+	le.PutUint32(text[20:], 0x400)
+	le.PutUint32(text[36:], 0x60000020)
+	copy(b[0x400:], "stub code")
+	return b
+}
+
+func readAll(t *testing.T, r io.ReaderAt) string {
+	t.Helper()
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestBuildUKI(t *testing.T) {
+	li := boot.NewLinuxImage(strings.NewReader("kernel image"), strings.NewReader("initramfs"), "console=ttyS0 quiet")
+	li.SetMetadata(boot.ImageMetadata{
+		Version:    "6.1.0-u-root",
+		CustomTags: map[string]string{"ID": "uroot", "PRETTY_NAME": "u-root 6.1"},
+	})
+	stub := efiStub()
+	b, err := BuildUKI(li, bytes.NewReader(stub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := pe.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("UKI is not a PE binary: %v", err)
+	}
+	var names []string
+	var lastEnd uint32
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+		if s.VirtualAddress%0x1000 != 0 || s.Offset%0x200 != 0 {
+			t.Errorf("section %s at %#x (file %#x) is not aligned", s.Name, s.VirtualAddress, s.Offset)
+		}
+		if s.VirtualAddress < lastEnd {
+			t.Errorf("section %s at %#x overlaps the one before, which ends at %#x", s.Name, s.VirtualAddress, lastEnd)
+		}
+		lastEnd = s.VirtualAddress + s.VirtualSize
+	}
+	if want := []string{".text", ".osrel", ".uname", ".cmdline", ".initrd", ".linux"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("sections = %v, want %v", names, want)
+	}
+	if got := f.OptionalHeader.(*pe.OptionalHeader64).SizeOfImage; got < lastEnd || got%0x1000 != 0 {
+		t.Errorf("SizeOfImage = %#x, want the aligned end of the last section, %#x", got, lastEnd)
+	}
+	if !bytes.Equal(b[:len(stub)][0x400:], stub[0x400:]) {
+		t.Errorf("the stub's sections changed")
+	}
+
+	got, err := LinuxImageFromUKI(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := readAll(t, got.Kernel); k != "kernel image" {
+		t.Errorf("kernel = %q, want %q", k, "kernel image")
+	}
+	if i := readAll(t, got.Initrd); i != "initramfs" {
+		t.Errorf("initrd = %q, want %q", i, "initramfs")
+	}
+	if got.Cmdline != li.Cmdline {
+		t.Errorf("cmdline = %q, want %q", got.Cmdline, li.Cmdline)
+	}
+	m, err := got.GetMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := li.GetMetadata()
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("metadata = %+v, want %+v", m, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	b, err := addSections(efiStub(), []section{
+		{".osrel", []byte("# The OS.\nNAME='u-root'\nVERSION_ID=7\nNOTAKEY\n\n")},
+		{".cmdline", []byte("root=/dev/sda1\n\x00")},
+		{".uname", []byte("5.10.0\n")},
+		{".dtb", []byte("\xd0\x0d\xfe\xed device tree")},
+		{".sbat", []byte("sbat,1\n")},
+		{".linux", []byte("kernel image")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := readAll(t, u.Kernel); k != "kernel image" {
+		t.Errorf("Kernel = %q, want %q", k, "kernel image")
+	}
+	if u.Initrd != nil {
+		t.Errorf("Initrd = %v, want nil", u.Initrd)
+	}
+	if u.Cmdline != "root=/dev/sda1" {
+		t.Errorf("Cmdline = %q, want root=/dev/sda1", u.Cmdline)
+	}
+	if u.Uname != "5.10.0" {
+		t.Errorf("Uname = %q, want 5.10.0", u.Uname)
+	}
+	if want := map[string]string{"NAME": "u-root", "VERSION_ID": "7"}; !reflect.DeepEqual(u.OSRelease, want) {
+		t.Errorf("OSRelease = %v, want %v", u.OSRelease, want)
+	}
+	if d := readAll(t, u.DTB); d != "\xd0\x0d\xfe\xed device tree" {
+		t.Errorf("DTB = %q, want the device tree", d)
+	}
+
+	li, err := LinuxImageFromUKI(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li.Initrd != nil || li.Cmdline != "root=/dev/sda1" {
+		t.Errorf("LinuxImageFromUKI() = %v, want no initrd and command line root=/dev/sda1", li)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := Parse(strings.NewReader("not a PE binary")); err == nil {
+		t.Errorf("Parse() of a text file succeeded")
+	}
+	if _, err := Parse(bytes.NewReader(efiStub())); err != ErrNoKernel {
+		t.Errorf("Parse() of the stub = %v, want ErrNoKernel", err)
+	}
+	if _, err := LinuxImageFromUKI(bytes.NewReader(efiStub())); err != ErrNoKernel {
+		t.Errorf("LinuxImageFromUKI() of the stub = %v, want ErrNoKernel", err)
+	}
+
+	li := boot.NewLinuxImage(strings.NewReader("kernel"), nil, "")
+	if _, err := BuildUKI(&boot.LinuxImage{}, bytes.NewReader(efiStub())); err != boot.ErrKernelMissing {
+		t.Errorf("BuildUKI() without a kernel = %v, want ErrKernelMissing", err)
+	}
+	if _, err := BuildUKI(li, strings.NewReader("not a PE binary")); err == nil {
+		t.Errorf("BuildUKI() with a text file as stub succeeded")
+	}
+
+	signed := efiStub()
+	cert := 0x44 + coffHeaderLen + pe64DataDirectories + 8*certTableDirectory
+	binary.LittleEndian.PutUint32(signed[cert:], 0x600)
+	binary.LittleEndian.PutUint32(signed[cert+4:], 0x100)
+	if _, err := BuildUKI(li, bytes.NewReader(signed)); err == nil {
+		t.Errorf("BuildUKI() with a signed stub succeeded")
+	}
+
+	full := efiStub()
+	binary.LittleEndian.PutUint32(full[0x44+coffHeaderLen+optSizeOfHeaders:], uint32(0x44+coffHeaderLen+240+sectionHeaderLen))
+	if _, err := BuildUKI(li, bytes.NewReader(full)); err == nil {
+		t.Errorf("BuildUKI() with a stub without room for sections succeeded")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wgboot fetches Linux images through a connection to the boot
+// server, such as one over a WireGuard tunnel, so that only authenticated
+// clients are served.
+//
+// The connection is made by the caller. The userspace WireGuard
+// implementation, golang.zx2c4.com/wireguard, is not vendored in this tree,
+// so there is no dialer here; its netstack package returns a net.Conn to
+// the server from (*netstack.Net).Dial.
+package wgboot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/netboot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// errConnUsed is returned when the server needs a second connection, which
+// happens if it closes the first one.
+var errConnUsed = errors.New("the connection to the boot server was closed")
+
+// connDialer returns its connection once.
+type connDialer struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (d *connDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return nil, errConnUsed
+	}
+	c := d.conn
+	d.conn = nil
+	return c, nil
+}
+
+// LinuxImageOverWireGuard returns a LinuxImage of the kernel and, unless
+// initrdURL is empty, the initrd fetched over HTTP through conn. The hosts
+// of the URLs are only sent to the server; all requests go through conn,
+// which is closed when the files are fetched.
+//
+// Both files are read in full, as the second request can only be sent on
+// conn once the first response has been read.
+func LinuxImageOverWireGuard(conn net.Conn, kernelURL, initrdURL, cmdline string) (*boot.LinuxImage, error) {
+	tr := &http.Transport{DialContext: (&connDialer{conn: conn}).DialContext}
+	defer func() {
+		tr.CloseIdleConnections()
+		conn.Close()
+	}()
+	client := &http.Client{Transport: tr}
+
+	fetch := func(u string) ([]byte, error) {
+		c, err := netboot.NewHTTPBootClient(u, netboot.WithHTTPClient(client))
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.Fetch("")
+		if err != nil {
+			return nil, err
+		}
+		return uio.ReadAll(r)
+	}
+
+	kernel, err := fetch(kernelURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching kernel: %v", err)
+	}
+	li := boot.NewLinuxImage(bytes.NewReader(kernel), nil, cmdline)
+	if initrdURL != "" {
+		initrd, err := fetch(initrdURL)
+		if err != nil {
+			return nil, fmt.Errorf("fetching initrd: %v", err)
+		}
+		li.Initrd = bytes.NewReader(initrd)
+	}
+	return li, nil
+}
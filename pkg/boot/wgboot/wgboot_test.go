@@ -0,0 +1,112 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgboot
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// server serves a kernel and an initrd, and counts the connections made to
+// it.
+type server struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	conns int
+}
+
+func newServer(t *testing.T, h http.HandlerFunc) *server {
+	s := &server{}
+	s.Server = httptest.NewUnstartedServer(h)
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+		}
+	}
+	s.Start()
+	return s
+}
+
+func files(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/boot/vmlinuz":
+		w.Write([]byte(strings.Repeat("kernel", 10000)))
+	case "/boot/initrd":
+		w.Write([]byte("initrd"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLinuxImageOverWireGuard(t *testing.T) {
+	s := newServer(t, files)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host in the URLs is not dialed.
+	li, err := LinuxImageOverWireGuard(conn, "http://boot.example/boot/vmlinuz", "http://boot.example/boot/initrd", "console=ttyS0")
+	if err != nil {
+		t.Fatalf("LinuxImageOverWireGuard() = %v", err)
+	}
+	k, err := uio.ReadAll(li.Kernel)
+	if err != nil || string(k) != strings.Repeat("kernel", 10000) {
+		t.Errorf("kernel = %d bytes, %v; want the kernel", len(k), err)
+	}
+	i, err := uio.ReadAll(li.Initrd)
+	if err != nil || string(i) != "initrd" {
+		t.Errorf("initrd = %q, %v; want initrd", i, err)
+	}
+	if li.Cmdline != "console=ttyS0" {
+		t.Errorf("cmdline = %q, want console=ttyS0", li.Cmdline)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns != 1 {
+		t.Errorf("server got %d connections, want 1", s.conns)
+	}
+}
+
+func TestLinuxImageOverWireGuardErrors(t *testing.T) {
+	s := newServer(t, files)
+	defer s.Close()
+
+	for _, tt := range []struct {
+		name, kernel, initrd string
+	}{
+		{"no kernel", "http://boot.example/boot/none", ""},
+		{"no initrd", "http://boot.example/boot/vmlinuz", "http://boot.example/boot/none"},
+		{"not HTTP", "tftp://boot.example/boot/vmlinuz", ""},
+	} {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LinuxImageOverWireGuard(conn, tt.kernel, tt.initrd, ""); err == nil {
+			t.Errorf("%s: LinuxImageOverWireGuard() = nil, want error", tt.name)
+		}
+	}
+
+	// Without an initrd, the image has none.
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err := LinuxImageOverWireGuard(conn, "http://boot.example/boot/vmlinuz", "", "")
+	if err != nil || li.Initrd != nil {
+		t.Errorf("LinuxImageOverWireGuard() without initrd = %+v, %v; want no initrd", li, err)
+	}
+}
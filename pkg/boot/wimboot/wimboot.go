@@ -0,0 +1,176 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wimboot reads the files injected into iPXE's wimboot.
+//
+// wimboot (https://ipxe.org/wimboot) has no table of its own: iPXE hands it
+// each file given with "initrd -n NAME" as a newc cpio record, and files can
+// likewise be appended to wimboot.efi itself as newc records. This package
+// finds those records, whether they follow the wimboot binary or stand
+// alone, so that u-root can take the place of wimboot in a PXE chain and
+// boot the kernel and initrds found there.
+package wimboot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// Names of the injected files with a special meaning.
+const (
+	// CmdlineName is the file holding the kernel command line.
+	CmdlineName = "cmdline"
+
+	// ScriptName is the file holding an iPXE script.
+	ScriptName = "script"
+)
+
+// kernelNames are the names a kernel is injected as.
+var kernelNames = []string{"vmlinuz", "bzImage", "kernel", "linux"}
+
+// newcMagic starts every newc record.
+const newcMagic = "070701"
+
+// File is an injected file.
+type File struct {
+	Name string
+	io.ReaderAt
+	Size int64
+}
+
+// Image is the set of files injected into wimboot.
+type Image struct {
+	// Files are all injected files, in order.
+	Files []File
+
+	// Cmdline is the content of the file named CmdlineName.
+	Cmdline string
+
+	// Script is the content of the file named ScriptName.
+	Script string
+}
+
+// start returns the offset of the first newc record in r, which is 4-byte
+// aligned like all records.
+func start(r io.ReaderAt, size int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for off := int64(0); off < size; off += int64(len(buf)) - int64(len(newcMagic)) {
+		n, err := r.ReadAt(buf, off)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		b := buf[:n]
+		for i := 0; ; {
+			j := bytes.Index(b[i:], []byte(newcMagic))
+			if j < 0 {
+				break
+			}
+			pos := off + int64(i+j)
+			if pos%4 == 0 {
+				// A valid first record rules out a stray magic.
+				if _, err := cpio.Newc.Reader(io.NewSectionReader(r, pos, size-pos)).ReadRecord(); err == nil {
+					return pos, nil
+				}
+			}
+			i += j + 1
+		}
+		if int64(n) < int64(len(buf)) {
+			break
+		}
+	}
+	return 0, fmt.Errorf("no injected files found")
+}
+
+// Parse reads the files injected into r, which is size bytes long and is
+// either wimboot.efi with files appended or the files alone.
+func Parse(r io.ReaderAt, size int64) (*Image, error) {
+	off, err := start(r, size)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := cpio.ReadAllRecords(cpio.Newc.Reader(io.NewSectionReader(r, off, size-off)))
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{}
+	for _, rec := range recs {
+		if rec.Mode&unix.S_IFMT != unix.S_IFREG {
+			continue
+		}
+		f := File{Name: path.Base(rec.Name), ReaderAt: rec.ReaderAt, Size: int64(rec.FileSize)}
+		img.Files = append(img.Files, f)
+
+		var s *string
+		switch f.Name {
+		case CmdlineName:
+			s = &img.Cmdline
+		case ScriptName:
+			s = &img.Script
+		default:
+			continue
+		}
+		b, err := uio.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", f.Name, err)
+		}
+		*s = strings.TrimSpace(string(b))
+	}
+	return img, nil
+}
+
+func isKernel(name string) bool {
+	for _, k := range kernelNames {
+		if name == k || strings.HasPrefix(name, k+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func isInitrd(name string) bool {
+	return strings.HasPrefix(name, "initrd") || strings.HasPrefix(name, "initramfs")
+}
+
+// LinuxImage returns a LinuxImage of the first injected kernel with all
+// injected initrds, concatenated in order, and the injected command line.
+func (img *Image) LinuxImage() (*boot.LinuxImage, error) {
+	var kernel io.ReaderAt
+	var initrds []*io.SectionReader
+	for _, f := range img.Files {
+		switch {
+		case kernel == nil && isKernel(f.Name):
+			kernel = io.NewSectionReader(f, 0, f.Size)
+		case isInitrd(f.Name):
+			initrds = append(initrds, io.NewSectionReader(f, 0, f.Size))
+		}
+	}
+	if kernel == nil {
+		return nil, fmt.Errorf("no kernel among the injected files; want one named %s", strings.Join(kernelNames, ", "))
+	}
+
+	var initrd io.ReaderAt
+	switch len(initrds) {
+	case 0:
+	case 1:
+		initrd = initrds[0]
+	default:
+		var b bytes.Buffer
+		for _, i := range initrds {
+			if _, err := io.Copy(&b, i); err != nil {
+				return nil, err
+			}
+		}
+		initrd = bytes.NewReader(b.Bytes())
+	}
+	return boot.NewLinuxImage(kernel, initrd, img.Cmdline), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wimboot
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// injected returns bin followed by newc records of files, padded to 4 bytes
+// first as wimboot requires.
+func injected(t *testing.T, bin string, trailer bool, files ...[2]string) []byte {
+	var b bytes.Buffer
+	b.WriteString(bin)
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+	w := cpio.Newc.Writer(&b)
+	if err := w.WriteRecord(cpio.Directory("boot", 0755)); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := w.WriteRecord(cpio.StaticFile(f[0], f[1], 0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if trailer {
+		if err := cpio.WriteTrailer(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	// A stray unaligned magic and an aligned one without a valid header,
+	// as a binary might contain.
+	fakeEFI := "MZ\x90\x00PE\x00\x00" + "x070701" + strings.Repeat("\x00", 5) + "070701garbage" + strings.Repeat("\xcc", 100)
+	files := [][2]string{
+		{"boot/vmlinuz", "kernel blob"},
+		{"initrd.cpio", "first initrd|"},
+		{"cmdline", "console=ttyS0 root=/dev/nfs\n"},
+		{"script", "#!ipxe\nboot\n"},
+		{"initramfs-extra", "second initrd"},
+	}
+	for _, tt := range []struct {
+		name    string
+		bin     string
+		trailer bool
+	}{
+		{"appended to wimboot", fakeEFI, true},
+		{"alone", "", true},
+		{"no trailer", fakeEFI, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := injected(t, tt.bin, tt.trailer, files...)
+			img, err := Parse(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+			var names []string
+			for _, f := range img.Files {
+				names = append(names, f.Name)
+			}
+			if want := []string{"vmlinuz", "initrd.cpio", "cmdline", "script", "initramfs-extra"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("files = %q, want %q", names, want)
+			}
+			if img.Cmdline != "console=ttyS0 root=/dev/nfs" || img.Script != "#!ipxe\nboot" {
+				t.Errorf("command line %q and script %q", img.Cmdline, img.Script)
+			}
+
+			li, err := img.LinuxImage()
+			if err != nil {
+				t.Fatalf("LinuxImage() = %v", err)
+			}
+			for _, f := range []struct {
+				name string
+				r    io.ReaderAt
+				want string
+			}{
+				{"kernel", li.Kernel, "kernel blob"},
+				{"initrd", li.Initrd, "first initrd|second initrd"},
+			} {
+				got, err := uio.ReadAll(f.r)
+				if err != nil || string(got) != f.want {
+					t.Errorf("%s = %q, %v, want %q", f.name, got, err, f.want)
+				}
+			}
+			if li.Cmdline != img.Cmdline {
+				t.Errorf("LinuxImage command line = %q, want %q", li.Cmdline, img.Cmdline)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bin := []byte("MZ no files here 070701")
+	if _, err := Parse(bytes.NewReader(bin), int64(len(bin))); err == nil {
+		t.Errorf("Parse() of a bare binary succeeded")
+	}
+
+	b := injected(t, "MZ", true, [2]string{"initrd", "initrd"}, [2]string{"cmdline", "quiet"})
+	img, err := Parse(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.LinuxImage(); err == nil {
+		t.Errorf("LinuxImage() without a kernel succeeded")
+	}
+}
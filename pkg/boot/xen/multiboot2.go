@@ -0,0 +1,455 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xen
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// Multiboot2 magic numbers, see
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html.
+const (
+	mb2HeaderMagic = 0xe85250d6
+	mb2BootMagic   = 0x36d76289
+	mb2ArchI386    = 0
+
+	// The header is in the first 32 KiB of the image, 8-byte aligned.
+	mb2HeaderSearch = 32 << 10
+	mb2HeaderAlign  = 8
+)
+
+// Multiboot2 header tags.
+const (
+	hdrTagEnd         = 0
+	hdrTagInfoRequest = 1
+	hdrTagAddress     = 2
+	hdrTagEntry       = 3
+
+	hdrFlagOptional = 1
+)
+
+// Multiboot2 boot information tags.
+const (
+	mbiTagEnd            = 0
+	mbiTagCmdline        = 1
+	mbiTagBootLoaderName = 2
+	mbiTagModule         = 3
+	mbiTagBasicMeminfo   = 4
+	mbiTagMmap           = 6
+)
+
+// mbiTags are the boot information tags loadSegments provides.
+var mbiTags = map[uint32]bool{
+	mbiTagCmdline:        true,
+	mbiTagBootLoaderName: true,
+	mbiTagModule:         true,
+	mbiTagBasicMeminfo:   true,
+	mbiTagMmap:           true,
+}
+
+// Xen ELF notes, see xen/include/public/elfnote.h.
+const (
+	xenNoteName        = "Xen"
+	xenElfnoteEntry    = 1
+	xenElfnotePhys32En = 18
+)
+
+// e820RAM is the type of usable RAM in the firmware memory map and in the
+// multiboot2 memory map.
+const e820RAM = 1
+
+// bootLoaderName is what Xen is told loaded it.
+const bootLoaderName = "u-root"
+
+// mb2Header is what matters of a multiboot2 header to u-root.
+type mb2Header struct {
+	// entry is the physical entry point of the entry address tag, if
+	// hasEntry.
+	entry    uint32
+	hasEntry bool
+}
+
+// readHeader finds and checks the multiboot2 header of image.
+func readHeader(image []byte) (*mb2Header, error) {
+	le := binary.LittleEndian
+	end := len(image)
+	if end > mb2HeaderSearch {
+		end = mb2HeaderSearch
+	}
+	for off := 0; off+16 <= end; off += mb2HeaderAlign {
+		if le.Uint32(image[off:]) != mb2HeaderMagic {
+			continue
+		}
+		arch, length, sum := le.Uint32(image[off+4:]), le.Uint32(image[off+8:]), le.Uint32(image[off+12:])
+		if mb2HeaderMagic+arch+length+sum != 0 {
+			continue
+		}
+		if arch != mb2ArchI386 {
+			return nil, fmt.Errorf("multiboot2 header is for architecture %d, want i386", arch)
+		}
+		if length < 16 || uint64(off)+uint64(length) > uint64(len(image)) {
+			return nil, fmt.Errorf("multiboot2 header of %d bytes does not fit the image", length)
+		}
+		return parseHeaderTags(image[off+16 : off+int(length)])
+	}
+	return nil, errors.New("no multiboot2 header")
+}
+
+// parseHeaderTags parses the tags of a multiboot2 header.
+func parseHeaderTags(tags []byte) (*mb2Header, error) {
+	le := binary.LittleEndian
+	h := &mb2Header{}
+	for len(tags) >= 8 {
+		typ, flags, size := le.Uint16(tags), le.Uint16(tags[2:]), le.Uint32(tags[4:])
+		if size < 8 || uint64(size) > uint64(len(tags)) {
+			return nil, fmt.Errorf("multiboot2 header tag %d of %d bytes does not fit the header", typ, size)
+		}
+		data := tags[8:size]
+		optional := flags&hdrFlagOptional != 0
+		switch typ {
+		case hdrTagEnd:
+			return h, nil
+		case hdrTagInfoRequest:
+			for i := 0; !optional && i+4 <= len(data); i += 4 {
+				if t := le.Uint32(data[i:]); !mbiTags[t] {
+					return nil, fmt.Errorf("image requires boot information tag %d, which is unsupported", t)
+				}
+			}
+		case hdrTagAddress:
+			// This is for images which are not ELF files.
+			if !optional {
+				return nil, errors.New("multiboot2 address tags are unsupported")
+			}
+		case hdrTagEntry:
+			if len(data) < 4 {
+				return nil, errors.New("multiboot2 entry address tag is too short")
+			}
+			h.entry, h.hasEntry = le.Uint32(data), true
+		}
+		// Tags are 8-byte aligned.
+		size = (size + 7) &^ 7
+		if uint64(size) >= uint64(len(tags)) {
+			break
+		}
+		tags = tags[size:]
+	}
+	return nil, errors.New("multiboot2 header has no end tag")
+}
+
+// xenNotes returns the types of the Xen ELF notes of f.
+func xenNotes(f *elf.File) (map[uint32]bool, error) {
+	notes := make(map[uint32]bool)
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_NOTE {
+			continue
+		}
+		b, err := ioutil.ReadAll(p.Open())
+		if err != nil {
+			return nil, fmt.Errorf("reading ELF notes: %v", err)
+		}
+		for len(b) >= 12 {
+			namesz, descsz, typ := f.ByteOrder.Uint32(b), f.ByteOrder.Uint32(b[4:]), f.ByteOrder.Uint32(b[8:])
+			nameEnd := 12 + uint64(namesz)
+			next := nameEnd + (4-uint64(namesz)%4)%4 + (uint64(descsz)+3)&^3
+			if nameEnd > uint64(len(b)) {
+				break
+			}
+			if string(bytes.TrimRight(b[12:nameEnd], "\x00")) == xenNoteName {
+				notes[typ] = true
+			}
+			if next > uint64(len(b)) {
+				break
+			}
+			b = b[next:]
+		}
+	}
+	return notes, nil
+}
+
+// hypervisor is a Xen ELF image with a multiboot2 header.
+type hypervisor struct {
+	elf    *elf.File
+	header *mb2Header
+}
+
+// parseHypervisor checks that image is a Xen hypervisor that can be booted
+// with multiboot2.
+func parseHypervisor(image []byte) (*hypervisor, error) {
+	h, err := readHeader(image)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return nil, fmt.Errorf("hypervisor is not an ELF file: %v", err)
+	}
+	if f.Machine != elf.EM_386 && f.Machine != elf.EM_X86_64 {
+		return nil, fmt.Errorf("hypervisor is for %v, want x86", f.Machine)
+	}
+	notes, err := xenNotes(f)
+	if err != nil {
+		return nil, err
+	}
+	if !notes[xenElfnoteEntry] && !notes[xenElfnotePhys32En] {
+		return nil, errors.New("hypervisor has no XEN_ELFNOTE_ENTRY note; not Xen")
+	}
+	return &hypervisor{elf: f, header: h}, nil
+}
+
+// entry returns the physical address multiboot2 starts h at.
+func (h *hypervisor) entry() (uint32, error) {
+	if h.header.hasEntry {
+		return h.header.entry, nil
+	}
+	// The ELF entry point is virtual.
+	for _, p := range h.elf.Progs {
+		if p.Type == elf.PT_LOAD && p.Vaddr <= h.elf.Entry && h.elf.Entry < p.Vaddr+p.Memsz {
+			e := h.elf.Entry - p.Vaddr + p.Paddr
+			if e >= 1<<32 {
+				return 0, fmt.Errorf("entry point %#x is above 4 GiB", e)
+			}
+			return uint32(e), nil
+		}
+	}
+	return 0, fmt.Errorf("entry point %#x is in no loaded segment", h.elf.Entry)
+}
+
+// segments returns the PT_LOAD segments of h at their physical addresses.
+func (h *hypervisor) segments() ([]kexec.Segment, error) {
+	pageSize := uint64(os.Getpagesize())
+	var segs []kexec.Segment
+	for _, p := range h.elf.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+		// Segments must start on a page.
+		pad := p.Paddr % pageSize
+		b, err := ioutil.ReadAll(p.Open())
+		if err != nil {
+			return nil, fmt.Errorf("reading segment at %#x: %v", p.Paddr, err)
+		}
+		if uint64(len(b)) != p.Filesz || p.Filesz > p.Memsz {
+			return nil, fmt.Errorf("segment at %#x has %d of %d bytes in the file and takes %d in memory", p.Paddr, len(b), p.Filesz, p.Memsz)
+		}
+		segs = append(segs, kexec.Segment{
+			Buf:  append(make([]byte, pad), b...),
+			Phys: kexec.Range{Start: uintptr(p.Paddr - pad), Size: uint(pad + p.Memsz)},
+			Name: "xen",
+		})
+	}
+	if len(segs) == 0 {
+		return nil, errors.New("hypervisor has no loadable segments")
+	}
+	return segs, nil
+}
+
+// module is a multiboot2 module.
+type module struct {
+	data    []byte
+	cmdline string
+}
+
+// Where loadSegments puts the trampoline and boot information, in the low
+// memory every x86 machine has.
+const (
+	trampolineAddr = 0x10000
+	mbiAddr        = 0x11000
+)
+
+// Offsets of what trampoline fills in.
+const (
+	trampolineMBI   = 0x4b
+	trampolineEntry = 0x50
+	trampolineGDT   = 0x58
+	trampolineGDTR  = 0x70
+)
+
+// trampolineCode is entered identity mapped in long mode, as kexec_load(2)
+// leaves the machine, and starts a multiboot2 image in 32-bit protected mode
+// with paging off, as the image expects:
+//
+//	cli
+//	lgdt gdtr(%rip)
+//	pushq $0x08
+//	leaq prot32(%rip), %rax
+//	pushq %rax
+//	lretq
+//	.code32
+//	prot32:
+//	mov $0x10, %eax
+//	mov %eax, %ds; %es; %fs; %gs; %ss
+//	mov %cr0, %eax; and $~CR0_PG, %eax; mov %eax, %cr0
+//	mov $MSR_EFER, %ecx; rdmsr; and $~EFER_LME, %eax; wrmsr
+//	mov %cr4, %eax; and $~CR4_PAE, %eax; mov %eax, %cr4
+//	mov $mb2BootMagic, %eax
+//	mov $mbi, %ebx
+//	mov $entry, %ecx
+//	jmp *%ecx
+//	.align 8
+//	gdt: null, flat 32-bit code, flat data
+//	gdtr: .word 23; .quad gdt
+var trampolineCode = []byte{
+	0xfa, 0x0f, 0x01, 0x15, 0x68, 0x00, 0x00, 0x00, 0x6a, 0x08, 0x48, 0x8d,
+	0x05, 0x03, 0x00, 0x00, 0x00, 0x50, 0x48, 0xcb, 0xb8, 0x10, 0x00, 0x00,
+	0x00, 0x8e, 0xd8, 0x8e, 0xc0, 0x8e, 0xe0, 0x8e, 0xe8, 0x8e, 0xd0, 0x0f,
+	0x20, 0xc0, 0x25, 0xff, 0xff, 0xff, 0x7f, 0x0f, 0x22, 0xc0, 0xb9, 0x80,
+	0x00, 0x00, 0xc0, 0x0f, 0x32, 0x25, 0xff, 0xfe, 0xff, 0xff, 0x0f, 0x30,
+	0x0f, 0x20, 0xe0, 0x83, 0xe0, 0xdf, 0x0f, 0x22, 0xe0, 0xb8, 0x89, 0x62,
+	0xd7, 0x36, 0xbb, 0x00, 0x00, 0x00, 0x00, 0xb9, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xe1, 0x66, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0x00, 0x00, 0x00, 0x9a, 0xcf, 0x00, 0xff, 0xff, 0x00, 0x00,
+	0x00, 0x92, 0xcf, 0x00, 0x17, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00,
+}
+
+// trampoline returns trampolineCode, placed at trampolineAddr, starting
+// entry with the boot information at mbi.
+func trampoline(mbi, entry uint32) []byte {
+	b := append([]byte(nil), trampolineCode...)
+	binary.LittleEndian.PutUint32(b[trampolineMBI:], mbi)
+	binary.LittleEndian.PutUint32(b[trampolineEntry:], entry)
+	binary.LittleEndian.PutUint64(b[trampolineGDTR+2:], trampolineAddr+trampolineGDT)
+	return b
+}
+
+// appendTag appends a boot information tag to mbi, padded to 8 bytes.
+func appendTag(mbi []byte, typ uint32, data []byte) []byte {
+	var h [8]byte
+	binary.LittleEndian.PutUint32(h[:], typ)
+	binary.LittleEndian.PutUint32(h[4:], uint32(8+len(data)))
+	mbi = append(mbi, h[:]...)
+	mbi = append(mbi, data...)
+	for len(mbi)%8 != 0 {
+		mbi = append(mbi, 0)
+	}
+	return mbi
+}
+
+// bootInformation returns the multiboot2 boot information for cmdline,
+// modules placed at addrs and the memory map mem.
+func bootInformation(cmdline string, modules []module, addrs []uint32, mem []kexec.MemoryMapEntry) []byte {
+	le := binary.LittleEndian
+	// The total size and a reserved field come first.
+	mbi := make([]byte, 8)
+	mbi = appendTag(mbi, mbiTagCmdline, append([]byte(cmdline), 0))
+	mbi = appendTag(mbi, mbiTagBootLoaderName, append([]byte(bootLoaderName), 0))
+	for i, m := range modules {
+		d := make([]byte, 8, 8+len(m.cmdline)+1)
+		le.PutUint32(d, addrs[i])
+		le.PutUint32(d[4:], addrs[i]+uint32(len(m.data)))
+		mbi = appendTag(mbi, mbiTagModule, append(append(d, m.cmdline...), 0))
+	}
+
+	// Basic memory information is in KiB of the RAM at 0 and at 1 MiB.
+	var lower, upper uint64
+	for _, m := range mem {
+		if m.Type != e820RAM {
+			continue
+		}
+		if m.Start == 0 {
+			lower = uint64(m.Size)
+			if lower > 640<<10 {
+				lower = 640 << 10
+			}
+		}
+		if m.Start <= 1<<20 && 1<<20 < m.End() {
+			upper = uint64(m.End()) - 1<<20
+			if upper > 0xffffffff<<10 {
+				upper = 0xffffffff << 10
+			}
+		}
+	}
+	d := make([]byte, 8)
+	le.PutUint32(d, uint32(lower>>10))
+	le.PutUint32(d[4:], uint32(upper>>10))
+	mbi = appendTag(mbi, mbiTagBasicMeminfo, d)
+
+	// Multiboot2 memory types are e820 types.
+	d = make([]byte, 8+24*len(mem))
+	le.PutUint32(d, 24)
+	for i, m := range mem {
+		e := d[8+24*i:]
+		le.PutUint64(e, uint64(m.Start))
+		le.PutUint64(e[8:], uint64(m.Size))
+		le.PutUint32(e[16:], m.Type)
+	}
+	mbi = appendTag(mbi, mbiTagMmap, d)
+
+	mbi = appendTag(mbi, mbiTagEnd, nil)
+	le.PutUint32(mbi, uint32(len(mbi)))
+	return mbi
+}
+
+// inRAM returns whether r is all in one RAM range of mem.
+func inRAM(mem []kexec.MemoryMapEntry, r kexec.Range) bool {
+	for _, m := range mem {
+		if m.Type == e820RAM && m.Start <= r.Start && r.End() <= m.End() {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSegments lays out the hypervisor image with cmdline and modules in
+// the RAM of mem, as a multiboot2 loader would, and returns the segments and
+// their entry point. Modules go page aligned after the hypervisor.
+func loadSegments(image []byte, cmdline string, modules []module, mem []kexec.MemoryMapEntry) (uintptr, []kexec.Segment, error) {
+	h, err := parseHypervisor(image)
+	if err != nil {
+		return 0, nil, err
+	}
+	entry, err := h.entry()
+	if err != nil {
+		return 0, nil, err
+	}
+	segs, err := h.segments()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pageSize := uintptr(os.Getpagesize())
+	var next uintptr
+	for _, s := range segs {
+		if e := s.Phys.End(); e > next {
+			next = e
+		}
+	}
+	addrs := make([]uint32, len(modules))
+	for i, m := range modules {
+		next = (next + pageSize - 1) &^ (pageSize - 1)
+		if uint64(next)+uint64(len(m.data)) > 1<<32 {
+			return 0, nil, fmt.Errorf("module %d does not fit below 4 GiB", i)
+		}
+		addrs[i] = uint32(next)
+		segs = append(segs, kexec.Segment{Buf: m.data, Phys: kexec.Range{Start: next, Size: uint(len(m.data))}, Name: fmt.Sprintf("module %d", i)})
+		next += uintptr(len(m.data))
+	}
+
+	mbi := bootInformation(cmdline, modules, addrs, mem)
+	segs = append([]kexec.Segment{
+		{Buf: trampoline(mbiAddr, entry), Phys: kexec.Range{Start: trampolineAddr, Size: uint(pageSize)}, Name: "purgatory"},
+		{Buf: mbi, Phys: kexec.Range{Start: mbiAddr, Size: uint(len(mbi))}, Name: "boot information"},
+	}, segs...)
+
+	for i, s := range segs {
+		if !inRAM(mem, s.Phys) {
+			return 0, nil, fmt.Errorf("segment %v is not in RAM", s)
+		}
+		for _, s2 := range segs[:i] {
+			if s.Phys.Overlaps(s2.Phys) {
+				return 0, nil, fmt.Errorf("segments %v and %v overlap", s2, s)
+			}
+		}
+	}
+	return trampolineAddr, segs, nil
+}
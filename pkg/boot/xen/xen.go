@@ -0,0 +1,232 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package xen boots Linux under the Xen hypervisor.
+//
+// Xen is started with multiboot2, as GRUB's multiboot2 and module2 commands
+// would, with the dom0 kernel and initrd as modules.
+package xen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/kexec"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// XenImage implements OSImage for a Xen hypervisor with a dom0 kernel and
+// initramfs.
+type XenImage struct {
+	// Hypervisor is the Xen ELF image, or xen.gz.
+	Hypervisor io.ReaderAt
+	Kernel     io.ReaderAt
+	Initrd     io.ReaderAt
+
+	KernelCmdline string
+	XenCmdline    string
+}
+
+var _ boot.OSImage = &XenImage{}
+
+// packageType is the package_type of packed XenImages.
+const packageType = "xen"
+
+func init() {
+	boot.RegisterOSImage(packageType, newFromArchive)
+}
+
+// newFromArchive reads a XenImage from a CPIO file archive written by Pack.
+func newFromArchive(a *cpio.Archive) (boot.OSImage, error) {
+	x := &XenImage{}
+	var ok bool
+	if x.Hypervisor, ok = a.Files["modules/xen/content"]; !ok {
+		return nil, fmt.Errorf("hypervisor missing from archive")
+	}
+	if x.Kernel, ok = a.Files["modules/kernel/content"]; !ok {
+		return nil, fmt.Errorf("kernel missing from archive")
+	}
+	if initrd, ok := a.Files["modules/initrd/content"]; ok {
+		x.Initrd = initrd
+	}
+	for name, s := range map[string]*string{
+		"modules/xen/params":    &x.XenCmdline,
+		"modules/kernel/params": &x.KernelCmdline,
+	} {
+		if params, ok := a.Files[name]; ok {
+			b, err := uio.ReadAll(params)
+			if err != nil {
+				return nil, err
+			}
+			*s = string(b)
+		}
+	}
+	return x, nil
+}
+
+// Pack implements OSImage.Pack and writes the hypervisor, kernel and initrd
+// and their command lines to the modules directory of sw.
+func (x *XenImage) Pack(sw cpio.RecordWriter) error {
+	if x.Hypervisor == nil {
+		return fmt.Errorf("must have non-nil hypervisor")
+	}
+	if x.Kernel == nil {
+		return boot.ErrKernelMissing
+	}
+	files := []struct {
+		name    string
+		content io.ReaderAt
+		params  *string
+	}{
+		{"xen", x.Hypervisor, &x.XenCmdline},
+		{"kernel", x.Kernel, &x.KernelCmdline},
+		{"initrd", x.Initrd, nil},
+	}
+	if err := sw.WriteRecord(cpio.Directory("modules", 0700)); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.content == nil {
+			continue
+		}
+		dir := "modules/" + f.name
+		if err := sw.WriteRecord(cpio.Directory(dir, 0700)); err != nil {
+			return err
+		}
+		b, err := uio.ReadAll(f.content)
+		if err != nil {
+			return err
+		}
+		if err := sw.WriteRecord(cpio.StaticFile(dir+"/content", string(b), 0700)); err != nil {
+			return err
+		}
+		if f.params != nil {
+			if err := sw.WriteRecord(cpio.StaticFile(dir+"/params", *f.params, 0700)); err != nil {
+				return err
+			}
+		}
+	}
+	return sw.WriteRecord(cpio.StaticFile("package_type", packageType, 0700))
+}
+
+// hypervisor returns the Xen ELF image, decompressing xen.gz.
+func (x *XenImage) hypervisor() ([]byte, error) {
+	if x.Hypervisor == nil {
+		return nil, fmt.Errorf("must have non-nil hypervisor")
+	}
+	b, err := uio.ReadAll(x.Hypervisor)
+	if err != nil {
+		return nil, fmt.Errorf("reading hypervisor: %v", err)
+	}
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return b, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing hypervisor: %v", err)
+	}
+	if b, err = ioutil.ReadAll(zr); err != nil {
+		return nil, fmt.Errorf("decompressing hypervisor: %v", err)
+	}
+	return b, nil
+}
+
+// Validate returns why the hypervisor cannot be booted: it must be an x86
+// ELF image with a multiboot2 header and a XEN_ELFNOTE_ENTRY note.
+func (x *XenImage) Validate() error {
+	if x.Kernel == nil {
+		return boot.ErrKernelMissing
+	}
+	b, err := x.hypervisor()
+	if err != nil {
+		return err
+	}
+	_, err = parseHypervisor(b)
+	return err
+}
+
+// modules returns the multiboot2 modules of x: the kernel and initrd.
+//
+// Unless GRUB 2 loaded it, Xen drops the first word of every command line as
+// the name of the image, so each starts with one.
+func (x *XenImage) modules() ([]module, error) {
+	if x.Kernel == nil {
+		return nil, boot.ErrKernelMissing
+	}
+	kernel, err := uio.ReadAll(x.Kernel)
+	if err != nil {
+		return nil, fmt.Errorf("reading kernel: %v", err)
+	}
+	mods := []module{{data: kernel, cmdline: "vmlinuz " + x.KernelCmdline}}
+	if x.Initrd != nil {
+		initrd, err := uio.ReadAll(x.Initrd)
+		if err != nil {
+			return nil, fmt.Errorf("reading initrd: %v", err)
+		}
+		mods = append(mods, module{data: initrd, cmdline: "initrd"})
+	}
+	return mods, nil
+}
+
+// segments lays out x in the RAM of mem.
+func (x *XenImage) segments(mem []kexec.MemoryMapEntry) (uintptr, []kexec.Segment, error) {
+	image, err := x.hypervisor()
+	if err != nil {
+		return 0, nil, err
+	}
+	mods, err := x.modules()
+	if err != nil {
+		return 0, nil, err
+	}
+	return loadSegments(image, "xen "+x.XenCmdline, mods, mem)
+}
+
+// ExecutionInfo implements OSImage.ExecutionInfo.
+func (x *XenImage) ExecutionInfo(l *log.Logger) {
+	l.Printf("Xen command line: %s", x.XenCmdline)
+	l.Printf("Kernel command line: %s", x.KernelCmdline)
+	if x.Initrd == nil {
+		l.Printf("No initrd")
+	}
+	if err := x.Validate(); err != nil {
+		l.Printf("Hypervisor: %v", err)
+		return
+	}
+	mem, err := kexec.FirmwareMemoryMap()
+	if err != nil {
+		l.Printf("Reading memory map: %v", err)
+		return
+	}
+	_, segs, err := x.segments(mem)
+	if err != nil {
+		l.Printf("Laying out segments: %v", err)
+		return
+	}
+	for _, s := range segs {
+		l.Printf("Segment: %v", s)
+	}
+}
+
+// Execute implements OSImage.Execute. It loads Xen with kexec_load(2), as
+// kexec_file_load(2) only loads Linux, and reboots into it.
+func (x *XenImage) Execute() error {
+	mem, err := kexec.FirmwareMemoryMap()
+	if err != nil {
+		return fmt.Errorf("reading memory map: %v", err)
+	}
+	entry, segs, err := x.segments(mem)
+	if err != nil {
+		return err
+	}
+	if err := kexec.Load(entry, segs, 0); err != nil {
+		return err
+	}
+	return kexec.Reboot()
+}
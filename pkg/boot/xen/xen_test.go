@@ -0,0 +1,356 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/kexec"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Where fakeXen puts things.
+const (
+	xenAddr     = 0x200000
+	xenEntry    = xenAddr + 0x40
+	xenMemsz    = 0x3000
+	xenMB2      = 0x1000
+	xenNote     = 0x1100
+	xenLoadSize = 0x200
+)
+
+// xenOptions change what fakeXen builds.
+type xenOptions struct {
+	headerTags []byte
+	checksum   uint32
+	noteType   uint32
+	noteName   string
+}
+
+// fakeXen returns an ELF32 image laid out like xen: one segment loaded at
+// 2 MiB starting with a multiboot2 header, and a Xen ELF note.
+func fakeXen(t *testing.T, o xenOptions) []byte {
+	le := binary.LittleEndian
+	if o.noteType == 0 {
+		o.noteType = xenElfnotePhys32En
+	}
+	if o.noteName == "" {
+		o.noteName = xenNoteName
+	}
+	if o.headerTags == nil {
+		o.headerTags = tag(hdrTagInfoRequest, 0, le32(mbiTagBasicMeminfo, mbiTagMmap))
+	}
+	o.headerTags = append(o.headerTags, tag(hdrTagEnd, 0, nil)...)
+
+	b := make([]byte, xenMB2+xenLoadSize)
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS], ident[elf.EI_DATA], ident[elf.EI_VERSION] = byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)
+	h := elf.Header32{
+		Ident:     ident,
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_386),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     xenEntry,
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     2,
+	}
+	progs := []elf.Prog32{
+		{Type: uint32(elf.PT_LOAD), Off: xenMB2, Vaddr: xenAddr, Paddr: xenAddr, Filesz: xenLoadSize, Memsz: xenMemsz, Flags: uint32(elf.PF_R | elf.PF_X), Align: 0x1000},
+		{Type: uint32(elf.PT_NOTE), Off: xenNote, Filesz: 20, Align: 4},
+	}
+	var w bytes.Buffer
+	binary.Write(&w, le, h)
+	binary.Write(&w, le, progs)
+	copy(b, w.Bytes())
+
+	mb2 := b[xenMB2:]
+	length := uint32(16 + len(o.headerTags))
+	le.PutUint32(mb2, mb2HeaderMagic)
+	le.PutUint32(mb2[8:], length)
+	le.PutUint32(mb2[12:], -(mb2HeaderMagic+length)+o.checksum)
+	copy(mb2[16:], o.headerTags)
+
+	note := b[xenNote:]
+	le.PutUint32(note, 4)
+	le.PutUint32(note[4:], 4)
+	le.PutUint32(note[8:], o.noteType)
+	copy(note[12:], o.noteName)
+	le.PutUint32(note[16:], xenEntry)
+	return b
+}
+
+func le32(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+// tag returns a multiboot2 header tag, padded to 8 bytes.
+func tag(typ, flags uint16, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data)+7)
+	binary.LittleEndian.PutUint16(b, typ)
+	binary.LittleEndian.PutUint16(b[2:], flags)
+	binary.LittleEndian.PutUint32(b[4:], uint32(8+len(data)))
+	b = append(b, data...)
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return z.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	kernel := strings.NewReader("bzImage")
+	for _, tt := range []struct {
+		name     string
+		image    []byte
+		noKernel bool
+		wantErr  string
+	}{
+		{name: "xen", image: fakeXen(t, xenOptions{})},
+		{name: "XEN_ELFNOTE_ENTRY", image: fakeXen(t, xenOptions{noteType: xenElfnoteEntry})},
+		{name: "xen.gz", image: gzipped(t, fakeXen(t, xenOptions{}))},
+		{name: "optional request", image: fakeXen(t, xenOptions{headerTags: tag(hdrTagInfoRequest, hdrFlagOptional, le32(8))})},
+		{name: "no kernel", image: fakeXen(t, xenOptions{}), noKernel: true, wantErr: "kernel"},
+		{name: "not ELF", image: []byte("xen"), wantErr: "no multiboot2 header"},
+		{name: "bad checksum", image: fakeXen(t, xenOptions{checksum: 1}), wantErr: "no multiboot2 header"},
+		{name: "not Xen", image: fakeXen(t, xenOptions{noteName: "GNU"}), wantErr: "XEN_ELFNOTE_ENTRY"},
+		{name: "other note", image: fakeXen(t, xenOptions{noteType: 2}), wantErr: "XEN_ELFNOTE_ENTRY"},
+		{name: "framebuffer request", image: fakeXen(t, xenOptions{headerTags: tag(hdrTagInfoRequest, 0, le32(8))}), wantErr: "tag 8"},
+		{name: "address tag", image: fakeXen(t, xenOptions{headerTags: tag(hdrTagAddress, 0, le32(0, 0, 0, 0))}), wantErr: "address"},
+		{name: "bad gzip", image: []byte{0x1f, 0x8b, 0}, wantErr: "decompressing"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &XenImage{Hypervisor: bytes.NewReader(tt.image), Kernel: kernel}
+			if tt.noKernel {
+				x.Kernel = nil
+			}
+			err := x.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// mbiTag is a parsed boot information tag.
+type mbiTag struct {
+	typ  uint32
+	data []byte
+}
+
+func parseMBI(t *testing.T, mbi []byte) []mbiTag {
+	le := binary.LittleEndian
+	if total := le.Uint32(mbi); int(total) != len(mbi) {
+		t.Fatalf("boot information is %d bytes, says %d", len(mbi), total)
+	}
+	var tags []mbiTag
+	for off := 8; off < len(mbi); {
+		typ, size := le.Uint32(mbi[off:]), le.Uint32(mbi[off+4:])
+		if typ == mbiTagEnd {
+			if size != 8 || off+8 != len(mbi) {
+				t.Errorf("end tag of %d bytes at %d of %d", size, off, len(mbi))
+			}
+			return tags
+		}
+		tags = append(tags, mbiTag{typ, mbi[off+8 : off+int(size)]})
+		off += (int(size) + 7) &^ 7
+	}
+	t.Fatalf("boot information has no end tag")
+	return nil
+}
+
+func TestSegments(t *testing.T) {
+	le := binary.LittleEndian
+	pageSize := uintptr(os.Getpagesize())
+	mem := []kexec.MemoryMapEntry{
+		{Range: kexec.Range{Start: 0, Size: 0x9f000}, Type: e820RAM},
+		{Range: kexec.Range{Start: 0xf0000, Size: 0x10000}, Type: 2},
+		{Range: kexec.Range{Start: 0x100000, Size: 0x7f00000}, Type: e820RAM},
+	}
+	x := &XenImage{
+		Hypervisor:    bytes.NewReader(gzipped(t, fakeXen(t, xenOptions{}))),
+		Kernel:        strings.NewReader("bzImage"),
+		Initrd:        strings.NewReader("initramfs"),
+		XenCmdline:    "dom0_mem=1G console=com1",
+		KernelCmdline: "console=hvc0 root=/dev/sda1",
+	}
+	entry, segs, err := x.segments(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != trampolineAddr {
+		t.Errorf("entry = %#x, want the trampoline at %#x", entry, trampolineAddr)
+	}
+	kernelAddr := (xenAddr + xenMemsz + pageSize - 1) &^ (pageSize - 1)
+	initrdAddr := (kernelAddr + 7 + pageSize - 1) &^ (pageSize - 1)
+	want := []kexec.Range{
+		{Start: trampolineAddr, Size: uint(pageSize)},
+		{Start: mbiAddr, Size: uint(len(segs[1].Buf))},
+		{Start: xenAddr, Size: xenMemsz},
+		{Start: kernelAddr, Size: 7},
+		{Start: initrdAddr, Size: 9},
+	}
+	if len(segs) != len(want) {
+		t.Fatalf("segments = %v, want segments at %v", segs, want)
+	}
+	for i, s := range segs {
+		if s.Phys != want[i] {
+			t.Errorf("segment %d is at %v, want %v", i, s.Phys, want[i])
+		}
+	}
+
+	tr := segs[0].Buf
+	if got := le.Uint32(tr[trampolineMBI:]); got != mbiAddr {
+		t.Errorf("trampoline passes boot information at %#x, want %#x", got, mbiAddr)
+	}
+	if got := le.Uint32(tr[trampolineEntry:]); got != xenEntry {
+		t.Errorf("trampoline jumps to %#x, want %#x", got, xenEntry)
+	}
+	if got := le.Uint64(tr[trampolineGDTR+2:]); got != trampolineAddr+trampolineGDT {
+		t.Errorf("trampoline GDT is at %#x, want %#x", got, trampolineAddr+trampolineGDT)
+	}
+	// The immediates being filled in are those of mov $imm32, %ebx; %ecx.
+	if tr[trampolineMBI-1] != 0xbb || tr[trampolineEntry-1] != 0xb9 || le.Uint16(tr[trampolineGDTR:]) != 23 {
+		t.Errorf("trampoline offsets do not match its code")
+	}
+	if !bytes.Equal(segs[2].Buf[:4], le32(mb2HeaderMagic)) || string(segs[3].Buf) != "bzImage" || string(segs[4].Buf) != "initramfs" {
+		t.Errorf("segments hold %q, %q and %q, want xen, kernel and initrd", segs[2].Buf[:4], segs[3].Buf, segs[4].Buf)
+	}
+
+	tags := parseMBI(t, segs[1].Buf)
+	var types []uint32
+	for _, tg := range tags {
+		types = append(types, tg.typ)
+	}
+	if want := []uint32{mbiTagCmdline, mbiTagBootLoaderName, mbiTagModule, mbiTagModule, mbiTagBasicMeminfo, mbiTagMmap}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("boot information tags = %v, want %v", types, want)
+	}
+	if got := string(tags[0].data); got != "xen dom0_mem=1G console=com1\x00" {
+		t.Errorf("command line = %q", got)
+	}
+	if got := string(tags[1].data); got != "u-root\x00" {
+		t.Errorf("boot loader name = %q", got)
+	}
+	for i, m := range []struct {
+		start, end uintptr
+		cmdline    string
+	}{
+		{kernelAddr, kernelAddr + 7, "vmlinuz console=hvc0 root=/dev/sda1\x00"},
+		{initrdAddr, initrdAddr + 9, "initrd\x00"},
+	} {
+		d := tags[2+i].data
+		if uintptr(le.Uint32(d)) != m.start || uintptr(le.Uint32(d[4:])) != m.end || string(d[8:]) != m.cmdline {
+			t.Errorf("module %d = [%#x, %#x) %q, want [%#x, %#x) %q", i, le.Uint32(d), le.Uint32(d[4:]), d[8:], m.start, m.end, m.cmdline)
+		}
+	}
+	if lower, upper := le.Uint32(tags[4].data), le.Uint32(tags[4].data[4:]); lower != 0x9f000>>10 || upper != 0x7f00000>>10 {
+		t.Errorf("basic memory information = %d KiB lower, %d KiB upper", lower, upper)
+	}
+	mmap := tags[5].data
+	if le.Uint32(mmap) != 24 || len(mmap) != 8+24*len(mem) {
+		t.Fatalf("memory map of %d bytes with %d byte entries", len(mmap), le.Uint32(mmap))
+	}
+	for i, m := range mem {
+		e := mmap[8+24*i:]
+		if uintptr(le.Uint64(e)) != m.Start || uint(le.Uint64(e[8:])) != m.Size || le.Uint32(e[16:]) != m.Type {
+			t.Errorf("memory map entry %d = %x, want %v", i, e[:24], m)
+		}
+	}
+
+	// An entry address tag takes the place of the ELF entry point.
+	x.Hypervisor = bytes.NewReader(fakeXen(t, xenOptions{headerTags: tag(hdrTagEntry, 0, le32(xenAddr+0x80))}))
+	if _, segs, err := x.segments(mem); err != nil || le.Uint32(segs[0].Buf[trampolineEntry:]) != xenAddr+0x80 {
+		t.Errorf("with an entry address tag, segments() = %v, want trampoline to %#x", err, xenAddr+0x80)
+	}
+
+	// Xen must be loaded in RAM.
+	x.Hypervisor = bytes.NewReader(fakeXen(t, xenOptions{}))
+	if _, _, err := x.segments(mem[:1]); err == nil {
+		t.Errorf("segments() with 636 KiB of RAM succeeded")
+	}
+}
+
+func TestPack(t *testing.T) {
+	xen := fakeXen(t, xenOptions{})
+	for _, x := range []*XenImage{
+		{Hypervisor: bytes.NewReader(xen), Kernel: strings.NewReader("bzImage"), Initrd: strings.NewReader("initramfs"), XenCmdline: "console=com1", KernelCmdline: "console=hvc0"},
+		{Hypervisor: bytes.NewReader(xen), Kernel: strings.NewReader("bzImage")},
+	} {
+		a := cpio.InMemArchive()
+		if err := boot.NewPackage(x).Pack(a, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := a.Get("modules/xen/content"); !ok {
+			t.Errorf("Pack() did not write modules/xen/content")
+		}
+		var p boot.Package
+		if err := p.Unpack(a.Reader(), nil); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := p.OSImage.(*XenImage)
+		if !ok {
+			t.Fatalf("Unpack() = %T, want *XenImage", p.OSImage)
+		}
+		if got.XenCmdline != x.XenCmdline || got.KernelCmdline != x.KernelCmdline {
+			t.Errorf("Unpack() command lines = %q, %q, want %q, %q", got.XenCmdline, got.KernelCmdline, x.XenCmdline, x.KernelCmdline)
+		}
+		for _, f := range []struct {
+			name      string
+			got, want io.ReaderAt
+		}{
+			{"hypervisor", got.Hypervisor, x.Hypervisor},
+			{"kernel", got.Kernel, x.Kernel},
+			{"initrd", got.Initrd, x.Initrd},
+		} {
+			if (f.want == nil) != (f.got == nil) {
+				t.Errorf("Unpack() %s = %v, want %v", f.name, f.got, f.want)
+				continue
+			}
+			if f.want == nil {
+				continue
+			}
+			gb, _ := uio.ReadAll(f.got)
+			wb, _ := uio.ReadAll(f.want)
+			if !bytes.Equal(gb, wb) {
+				t.Errorf("Unpack() %s = %q, want %q", f.name, gb, wb)
+			}
+		}
+	}
+
+	if err := (&XenImage{Kernel: strings.NewReader("bzImage")}).Pack(cpio.InMemArchive()); err == nil {
+		t.Errorf("Pack() without a hypervisor succeeded")
+	}
+	if err := (&XenImage{Hypervisor: bytes.NewReader(xen)}).Pack(cpio.InMemArchive()); err != boot.ErrKernelMissing {
+		t.Errorf("Pack() without a kernel = %v, want ErrKernelMissing", err)
+	}
+}
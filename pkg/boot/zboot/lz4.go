@@ -0,0 +1,122 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zboot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// lz4LegacyMagic starts the legacy LZ4 frames made by "lz4 -l",
+	// which is how the kernel compresses with LZ4.
+	lz4LegacyMagic = 0x184c2102
+
+	// lz4LegacyBlockSize is the most a legacy block decompresses to.
+	lz4LegacyBlockSize = 8 << 20
+)
+
+// decompressLZ4 decompresses the legacy LZ4 frames in b. Like the kernel's
+// unlz4, it ignores the 4-byte size the kernel build appends.
+func decompressLZ4(b []byte) ([]byte, error) {
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != lz4LegacyMagic {
+		return nil, errors.New("not a legacy LZ4 frame")
+	}
+	b = b[4:]
+	var out []byte
+	for len(b) >= 4 {
+		size := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if size == lz4LegacyMagic {
+			// Frames may be concatenated.
+			continue
+		}
+		if len(b) == 0 {
+			// The appended size.
+			break
+		}
+		if uint64(size) > uint64(len(b)) {
+			return nil, fmt.Errorf("LZ4 block of %d bytes is truncated to %d", size, len(b))
+		}
+		var err error
+		if out, err = decompressLZ4Block(out, b[:size]); err != nil {
+			return nil, err
+		}
+		b = b[size:]
+	}
+	return out, nil
+}
+
+// decompressLZ4Block appends the decompressed LZ4 block src to dst. Matches
+// may refer to earlier blocks, as the kernel's decompressor allows.
+func decompressLZ4Block(dst, src []byte) ([]byte, error) {
+	start := len(dst)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		n, err := lz4Length(src, &i, int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		if n > len(src)-i {
+			return nil, errors.New("LZ4 literals run past the end of the block")
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+		if i == len(src) {
+			// The last sequence has only literals.
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, errors.New("LZ4 match offset is truncated")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("LZ4 match offset %d is out of range", offset)
+		}
+		if n, err = lz4Length(src, &i, int(token&0xf)); err != nil {
+			return nil, err
+		}
+		n += 4
+		if len(dst)-start+n > lz4LegacyBlockSize {
+			return nil, errors.New("LZ4 block decompresses to more than 8 MiB")
+		}
+		// Matches may overlap what they append, so copy byte by byte.
+		for from := len(dst) - offset; n > 0; n-- {
+			dst = append(dst, dst[from])
+			from++
+		}
+	}
+	if len(dst)-start > lz4LegacyBlockSize {
+		return nil, errors.New("LZ4 block decompresses to more than 8 MiB")
+	}
+	return dst, nil
+}
+
+// lz4Length returns the literal or match length n from a token, extended by
+// the bytes at src[*i] if it is 15.
+func lz4Length(src []byte, i *int, n int) (int, error) {
+	if n != 15 {
+		return n, nil
+	}
+	for {
+		if *i >= len(src) {
+			return 0, errors.New("LZ4 length is truncated")
+		}
+		b := src[*i]
+		*i++
+		n += int(b)
+		if n > lz4LegacyBlockSize {
+			return 0, errors.New("LZ4 length is out of range")
+		}
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
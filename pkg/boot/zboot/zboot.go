@@ -0,0 +1,128 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package zboot unpacks zboot kernels.
+//
+// Since Linux 5.18, arm64 (and later riscv64 and loongarch) kernels can be
+// built as zboot images: an EFI application that decompresses the kernel
+// Image it carries. kexec and boot loaders that are not EFI want the Image
+// itself, which DecompressZBoot returns.
+//
+// The header, from drivers/firmware/efi/libstub/zboot-header.S, is
+//
+//	0x00	"MZ"
+//	0x04	"zimg"
+//	0x08	payload offset (le32)
+//	0x0c	payload size (le32)
+//	0x18	compression type, a NUL-padded string of 32 bytes
+//
+// Of the compression types, gzip and lz4 are supported.
+package zboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	headerLen = 0x38
+
+	compTypeOffset = 0x18
+	compTypeLen    = 32
+)
+
+var (
+	mzMagic   = []byte("MZ")
+	zimgMagic = []byte("zimg")
+)
+
+// Header is the zboot header.
+type Header struct {
+	// PayloadOffset is where the compressed Image starts in the file.
+	PayloadOffset uint32
+	// PayloadSize is the size of the compressed Image.
+	PayloadSize uint32
+	// CompType is how the Image is compressed, e.g. "gzip".
+	CompType string
+}
+
+// ErrUnsupportedCompression is returned by DecompressZBoot for kernels
+// compressed with an algorithm this package does not decompress.
+type ErrUnsupportedCompression struct {
+	CompType string
+}
+
+func (e *ErrUnsupportedCompression) Error() string {
+	return fmt.Sprintf("zboot compression %q is not supported", e.CompType)
+}
+
+// IsZBoot returns whether r starts with a zboot header.
+func IsZBoot(r io.ReaderAt) bool {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:], 0); err != nil {
+		return false
+	}
+	return bytes.Equal(b[:2], mzMagic) && bytes.Equal(b[4:], zimgMagic)
+}
+
+// ReadHeader returns the zboot header of r.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	b := make([]byte, headerLen)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("reading zboot header: %v", err)
+	}
+	if !bytes.Equal(b[:2], mzMagic) || !bytes.Equal(b[4:8], zimgMagic) {
+		return nil, fmt.Errorf("not a zboot image: magic is %q", b[:8])
+	}
+	comp := b[compTypeOffset : compTypeOffset+compTypeLen]
+	if i := bytes.IndexByte(comp, 0); i >= 0 {
+		comp = comp[:i]
+	}
+	return &Header{
+		PayloadOffset: binary.LittleEndian.Uint32(b[0x08:]),
+		PayloadSize:   binary.LittleEndian.Uint32(b[0x0c:]),
+		CompType:      string(comp),
+	}, nil
+}
+
+// DecompressZBoot returns the kernel Image in the zboot image r.
+func DecompressZBoot(r io.ReaderAt) (io.ReaderAt, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.PayloadOffset < headerLen {
+		return nil, fmt.Errorf("zboot payload at %#x overlaps the header", h.PayloadOffset)
+	}
+	payload := make([]byte, h.PayloadSize)
+	if n, err := r.ReadAt(payload, int64(h.PayloadOffset)); n != len(payload) {
+		return nil, fmt.Errorf("reading zboot payload of %d bytes at %#x: got %d bytes, %v", h.PayloadSize, h.PayloadOffset, n, err)
+	}
+
+	var image []byte
+	switch h.CompType {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing zboot payload: %v", err)
+		}
+		// The kernel appends the size of the Image to the gzip
+		// stream, which is not another member.
+		zr.Multistream(false)
+		if image, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("decompressing zboot payload: %v", err)
+		}
+	case "lz4":
+		if image, err = decompressLZ4(payload); err != nil {
+			return nil, fmt.Errorf("decompressing zboot payload: %v", err)
+		}
+	default:
+		return nil, &ErrUnsupportedCompression{CompType: h.CompType}
+	}
+	return bytes.NewReader(image), nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// image is a stand-in for an arm64 Image, whose magic is at 0x38.
+var image = []byte(strings.Repeat("\x00", 0x38) + "ARM\x64" + strings.Repeat("kernel ", 100))
+
+// makeZBoot returns a zboot image of the payload compressed with comp.
+func makeZBoot(comp string, payload []byte) []byte {
+	h := make([]byte, 0x40)
+	copy(h, "MZ")
+	copy(h[4:], "zimg")
+	binary.LittleEndian.PutUint32(h[0x08:], uint32(len(h)))
+	binary.LittleEndian.PutUint32(h[0x0c:], uint32(len(payload)))
+	copy(h[compTypeOffset:], comp)
+	// The EFI stub that follows is of no interest here.
+	return append(append(h, payload...), "PE stub"...)
+}
+
+// withSize appends the size of image, as the kernel build does.
+func withSize(b []byte) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(image)))
+	return append(b, size[:]...)
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// lz4Frame returns a legacy LZ4 frame of the blocks.
+func lz4Frame(blocks ...[]byte) []byte {
+	b := []byte{0x02, 0x21, 0x4c, 0x18}
+	for _, blk := range blocks {
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(blk)))
+		b = append(append(b, size[:]...), blk...)
+	}
+	return b
+}
+
+func TestIsZBoot(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"zboot", makeZBoot("gzip", nil), true},
+		{"Image", image, false},
+		{"PE without zimg", []byte("MZ\x00\x00PE\x00\x00"), false},
+		{"short", []byte("MZ"), false},
+		{"empty", nil, false},
+	} {
+		if got := IsZBoot(bytes.NewReader(tt.b)); got != tt.want {
+			t.Errorf("IsZBoot(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	h, err := ReadHeader(bytes.NewReader(makeZBoot("zstd", []byte("12345"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Header{PayloadOffset: 0x40, PayloadSize: 5, CompType: "zstd"}
+	if *h != want {
+		t.Errorf("ReadHeader() = %+v, want %+v", *h, want)
+	}
+	if _, err := ReadHeader(bytes.NewReader(image)); err == nil {
+		t.Errorf("ReadHeader() of an Image succeeded")
+	}
+}
+
+// decompress returns the Image in zboot, or fails the test.
+func decompress(t *testing.T, zboot []byte) []byte {
+	t.Helper()
+	r, err := DecompressZBoot(bytes.NewReader(zboot))
+	if err != nil {
+		t.Fatalf("DecompressZBoot() = %v", err)
+	}
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecompressZBoot(t *testing.T) {
+	t.Run("gzip", func(t *testing.T) {
+		got := decompress(t, makeZBoot("gzip", withSize(gzipped(t, image))))
+		if !bytes.Equal(got, image) {
+			t.Errorf("DecompressZBoot() = %q, want the Image", got)
+		}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+		want  string
+	}{
+		{
+			name:  "literals",
+			frame: lz4Frame([]byte("\x50hello")),
+			want:  "hello",
+		},
+		{
+			name: "overlapping match",
+			// "abc", then 9 bytes from 3 back, then "!".
+			frame: lz4Frame([]byte("\x35abc\x03\x00\x10!")),
+			want:  "abcabcabcabc!",
+		},
+		{
+			name: "long lengths",
+			// 20 literals, then 4+15+6 bytes from 1 back.
+			frame: lz4Frame([]byte("\xff\x05" + "0123456789abcdefghij" + "\x01\x00\x06")),
+			want:  "0123456789abcdefghij" + strings.Repeat("j", 25),
+		},
+		{
+			name: "match into the previous block",
+			frame: lz4Frame(
+				[]byte("\x40rest"),
+				[]byte("\x00\x04\x00\x20ed"),
+			),
+			want: "restrested",
+		},
+		{
+			name:  "concatenated frames",
+			frame: append(lz4Frame([]byte("\x30one")), lz4Frame([]byte("\x30two"))...),
+			want:  "onetwo",
+		},
+	} {
+		t.Run("lz4 "+tt.name, func(t *testing.T) {
+			var size [4]byte
+			binary.LittleEndian.PutUint32(size[:], uint32(len(tt.want)))
+			got := decompress(t, makeZBoot("lz4", append(tt.frame, size[:]...)))
+			if string(got) != tt.want {
+				t.Errorf("DecompressZBoot() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompressZBootErrors(t *testing.T) {
+	overlapping := makeZBoot("gzip", withSize(gzipped(t, image)))
+	binary.LittleEndian.PutUint32(overlapping[0x08:], 0x10)
+
+	for _, tt := range []struct {
+		name  string
+		zboot []byte
+	}{
+		{"Image", image},
+		{"payload past the end", makeZBoot("gzip", nil)[:0x40-1]},
+		{"payload in the header", overlapping},
+		{"truncated payload", makeZBoot("gzip", withSize(gzipped(t, image)))[:0x60]},
+		{"corrupt gzip", makeZBoot("gzip", []byte("not gzip"))},
+		{"LZ4 without magic", makeZBoot("lz4", []byte("\x00\x00\x00\x00\x50hello"))},
+		{"LZ4 offset out of range", makeZBoot("lz4", lz4Frame([]byte("\x10a\x02\x00")))},
+		{"LZ4 offset truncated", makeZBoot("lz4", lz4Frame([]byte("\x10a\x01")))},
+		{"LZ4 literals truncated", makeZBoot("lz4", lz4Frame([]byte("\x50hel")))},
+		{"LZ4 length truncated", makeZBoot("lz4", lz4Frame([]byte("\xf0\xff")))},
+		{"LZ4 block truncated", makeZBoot("lz4", append(lz4Frame([]byte("\x50hello"))[:8], "\x50he"...))},
+	} {
+		if r, err := DecompressZBoot(bytes.NewReader(tt.zboot)); err == nil {
+			t.Errorf("DecompressZBoot(%s) = %v, want error", tt.name, r)
+		}
+	}
+
+	if got := decompress(t, makeZBoot("lz4", lz4Frame([]byte("\x50hello")))); string(got) != "hello" {
+		t.Errorf("DecompressZBoot() without the appended size = %q, want hello", got)
+	}
+
+	_, err := DecompressZBoot(bytes.NewReader(makeZBoot("zstd", []byte("zstd payload"))))
+	if e, ok := err.(*ErrUnsupportedCompression); !ok || e.CompType != "zstd" {
+		t.Errorf("DecompressZBoot() of zstd = %v, want ErrUnsupportedCompression", err)
+	}
+}
@@ -459,3 +459,29 @@ func (b *BzImage) InitRAMFS() (int, int, error) {
 	}
 	return -1, -1, fmt.Errorf("no cpio found")
 }
+
+// ReadHeader reads the setup header of the bzImage in r.
+func ReadHeader(r io.ReaderAt) (*LinuxHeader, error) {
+	var h LinuxHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(h))), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("Can't read bzImage header: %v", err)
+	}
+	if h.HeaderMagic != HeaderMagic {
+		return nil, fmt.Errorf("Not a bzImage: magic should be %02x, and is %02x", HeaderMagic, h.HeaderMagic)
+	}
+	return &h, nil
+}
+
+// InitrdAddrMax returns the highest address the initrd of the bzImage in r
+// may occupy. Kernels before boot protocol 2.03 do not say, and take the
+// initrd up to DefaultInitrdAddrMax.
+func InitrdAddrMax(r io.ReaderAt) (uint32, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	if h.Protocolversion < 0x203 || h.InitrdAddrMax == 0 {
+		return DefaultInitrdAddrMax, nil
+	}
+	return h.InitrdAddrMax, nil
+}
@@ -5,6 +5,7 @@
 package bzimage
 
 import (
+	"bytes"
 	"io/ioutil"
 	"testing"
 
@@ -220,3 +221,21 @@ func TestInitRAMFS(t *testing.T) {
 	}
 
 }
+
+func TestInitrdAddrMax(t *testing.T) {
+	image, err := ioutil.ReadFile("testdata/bzImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max, err := InitrdAddrMax(bytes.NewReader(image)); err != nil || max != 0x7fffffff {
+		t.Errorf("InitrdAddrMax() = %#x, %v, want 0x7fffffff", max, err)
+	}
+	// Boot protocol 2.02 does not have initrd_addr_max.
+	image[0x206], image[0x207] = 0x02, 0x02
+	if max, err := InitrdAddrMax(bytes.NewReader(image)); err != nil || max != DefaultInitrdAddrMax {
+		t.Errorf("InitrdAddrMax() for protocol 2.02 = %#x, %v, want %#x", max, err, DefaultInitrdAddrMax)
+	}
+	if _, err := InitrdAddrMax(bytes.NewReader(badmagic)); err == nil {
+		t.Errorf("InitrdAddrMax(%q) = nil, want error", badmagic)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bzimage
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrVersionNotFound is returned by KernelVersion if r is neither a bzImage
+// nor a vmlinux with a version string.
+var ErrVersionNotFound = errors.New("kernel version not found")
+
+// linuxBanner starts the version string in the .rodata of a vmlinux.
+var linuxBanner = []byte("Linux version ")
+
+// maxVersionLen bounds the version string, which the kernel keeps short.
+const maxVersionLen = 512
+
+// KernelVersion returns the version string of the kernel in r, such as
+// "4.12.7 (rminnich@uroot) #6 Fri Aug 10 14:47:18 PDT 2018", which it reads
+// from the setup header of a bzImage, or from the Linux banner in a vmlinux
+// ELF.
+func KernelVersion(r io.ReaderAt) (string, error) {
+	if v, err := bzImageVersion(r); err != ErrVersionNotFound {
+		return v, err
+	}
+	return vmlinuxVersion(r)
+}
+
+// bzImageVersion returns the string that kernel_version points to. It is
+// relative to the end of the boot sector, at 0x200.
+func bzImageVersion(r io.ReaderAt) (string, error) {
+	var h [0x210]byte
+	if _, err := r.ReadAt(h[:], 0); err != nil {
+		return "", ErrVersionNotFound
+	}
+	if !bytes.Equal(h[0x202:0x206], HeaderMagic[:]) {
+		return "", ErrVersionNotFound
+	}
+	off := binary.LittleEndian.Uint16(h[0x20e:])
+	if off == 0 {
+		return "", ErrVersionNotFound
+	}
+	b := make([]byte, maxVersionLen)
+	n, err := r.ReadAt(b, int64(off)+0x200)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	b = b[:n]
+	i := bytes.IndexByte(b, 0)
+	if i <= 0 {
+		return "", ErrVersionNotFound
+	}
+	return string(b[:i]), nil
+}
+
+// vmlinuxVersion returns the Linux banner in the .rodata section of an ELF,
+// without "Linux version " and the trailing newline. Format strings that
+// start the same way, such as "Linux version %s", are skipped.
+func vmlinuxVersion(r io.ReaderAt) (string, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", ErrVersionNotFound
+	}
+	s := f.Section(".rodata")
+	if s == nil || s.Type == elf.SHT_NOBITS {
+		return "", ErrVersionNotFound
+	}
+	d, err := s.Data()
+	if err != nil {
+		return "", err
+	}
+	for {
+		i := bytes.Index(d, linuxBanner)
+		if i < 0 {
+			return "", ErrVersionNotFound
+		}
+		d = d[i+len(linuxBanner):]
+		v := d
+		if j := bytes.IndexAny(v, "\x00\n"); j >= 0 {
+			v = v[:j]
+		}
+		if len(v) > 0 && v[0] != '%' {
+			return string(v), nil
+		}
+	}
+}
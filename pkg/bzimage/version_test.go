@@ -0,0 +1,58 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bzimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestKernelVersion(t *testing.T) {
+	for _, tt := range []struct {
+		file, want string
+	}{
+		{"testdata/bzImage", "4.12.7 (rminnich@uroot) #6 Fri Aug 10 14:47:18 PDT 2018"},
+		{"testdata/vmlinux", "5.15.0-76-generic (buildd@lcy02-amd64-019) #83-Ubuntu SMP Thu Jun 15 19:16:32 UTC 2023"},
+	} {
+		f, err := os.Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if got, err := KernelVersion(f); err != nil || got != tt.want {
+			t.Errorf("KernelVersion(%s) = %q, %v, want %q", tt.file, got, err, tt.want)
+		}
+	}
+}
+
+func TestKernelVersionNotFound(t *testing.T) {
+	// A bzImage header whose kernel_version is not set.
+	noVersion := make([]byte, 0x400)
+	copy(noVersion[0x202:], HeaderMagic[:])
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"bad magic", badmagic},
+		{"no version", noVersion},
+		{"init without banner", mustRead(t, "testdata/init")},
+	} {
+		if v, err := KernelVersion(bytes.NewReader(tt.b)); err != ErrVersionNotFound {
+			t.Errorf("%s: KernelVersion() = %q, %v, want %v", tt.name, v, err, ErrVersionNotFound)
+		}
+	}
+}
+
+func mustRead(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -74,9 +74,9 @@ func parse(cmdlineReader io.Reader) CmdLine {
 	return line
 }
 
-// parseToMap turns a space-separated kernel commandline into a map
-func parseToMap(input string) map[string]string {
-
+// splitParams splits a kernel command line into parameters, keeping quoted
+// values with spaces in one parameter.
+func splitParams(input string) []string {
 	lastQuote := rune(0)
 	quotedFieldsCheck := func(c rune) bool {
 		switch {
@@ -92,9 +92,13 @@ func parseToMap(input string) map[string]string {
 			return unicode.IsSpace(c)
 		}
 	}
+	return strings.FieldsFunc(input, quotedFieldsCheck)
+}
 
+// parseToMap turns a space-separated kernel commandline into a map
+func parseToMap(input string) map[string]string {
 	flagMap := make(map[string]string)
-	for _, flag := range strings.FieldsFunc(string(input), quotedFieldsCheck) {
+	for _, flag := range splitParams(input) {
 		// kernel variables must allow '-' and '_' to be equivalent in variable
 		// names. We will replace dashes with underscores for processing.
 
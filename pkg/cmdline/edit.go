@@ -0,0 +1,93 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"strings"
+)
+
+// initSeparator separates the parameters of the kernel from the arguments
+// of init in a command line.
+const initSeparator = "--"
+
+// AppendCmdline returns cmdline with params added at the end.
+func AppendCmdline(cmdline string, params ...string) string {
+	return strings.Join(append(splitParams(cmdline), params...), " ")
+}
+
+// PrependCmdline returns cmdline with params added at the start.
+func PrependCmdline(cmdline string, params ...string) string {
+	return strings.Join(append(params, splitParams(cmdline)...), " ")
+}
+
+// paramKey returns the canonical name of a parameter: the part before the
+// first '=', with dashes as underscores.
+func paramKey(param string) string {
+	if i := strings.Index(param, "="); i >= 0 {
+		param = param[:i]
+	}
+	return strings.Replace(param, "-", "_", -1)
+}
+
+// Param returns the parameter key=value, or key if value is empty. Values
+// with spaces are quoted.
+func Param(key, value string) string {
+	if value == "" {
+		return key
+	}
+	if strings.ContainsAny(value, " \t\n") && !strings.ContainsAny(value, "\"") {
+		value = `"` + value + `"`
+	}
+	return key + "=" + value
+}
+
+// RemoveParam returns cmdline without the kernel parameters named key.
+// Dashes and underscores in key are equivalent, and arguments of init,
+// after "--", are left alone.
+func RemoveParam(cmdline, key string) string {
+	key = paramKey(key)
+	var out []string
+	params := splitParams(cmdline)
+	for i, p := range params {
+		if p == initSeparator {
+			out = append(out, params[i:]...)
+			break
+		}
+		if paramKey(p) != key {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// OverrideParam returns cmdline with the kernel parameters named key
+// replaced by param, which is where the first of them was, or added after
+// the other kernel parameters if there was none.
+func OverrideParam(cmdline, param string) string {
+	key := paramKey(param)
+	var out []string
+	done := false
+	params := splitParams(cmdline)
+	for i, p := range params {
+		if p == initSeparator {
+			if !done {
+				out = append(out, param)
+				done = true
+			}
+			out = append(out, params[i:]...)
+			break
+		}
+		if paramKey(p) != key {
+			out = append(out, p)
+		} else if !done {
+			out = append(out, param)
+			done = true
+		}
+	}
+	if !done {
+		out = append(out, param)
+	}
+	return strings.Join(out, " ")
+}
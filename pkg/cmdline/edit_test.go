@@ -0,0 +1,93 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"testing"
+)
+
+const editCmdline = `console=ttyS0 root=/dev/sda1 rd.break  uroot.initflags="a=1 b" console=tty0 ro -- single console=x`
+
+func TestEditCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{
+			name: "append",
+			got:  AppendCmdline(editCmdline, "quiet", "loglevel=3"),
+			want: `console=ttyS0 root=/dev/sda1 rd.break uroot.initflags="a=1 b" console=tty0 ro -- single console=x quiet loglevel=3`,
+		},
+		{
+			name: "append to nothing",
+			got:  AppendCmdline("", "quiet"),
+			want: `quiet`,
+		},
+		{
+			name: "prepend",
+			got:  PrependCmdline(editCmdline, "earlyprintk"),
+			want: `earlyprintk console=ttyS0 root=/dev/sda1 rd.break uroot.initflags="a=1 b" console=tty0 ro -- single console=x`,
+		},
+		{
+			name: "remove all of a key",
+			got:  RemoveParam(editCmdline, "console"),
+			want: `root=/dev/sda1 rd.break uroot.initflags="a=1 b" ro -- single console=x`,
+		},
+		{
+			name: "remove flag",
+			got:  RemoveParam(editCmdline, "rd.break"),
+			want: `console=ttyS0 root=/dev/sda1 uroot.initflags="a=1 b" console=tty0 ro -- single console=x`,
+		},
+		{
+			name: "remove with dashes",
+			got:  RemoveParam("a_b=1 c=2", "a-b"),
+			want: `c=2`,
+		},
+		{
+			name: "remove missing",
+			got:  RemoveParam(editCmdline, "init"),
+			want: `console=ttyS0 root=/dev/sda1 rd.break uroot.initflags="a=1 b" console=tty0 ro -- single console=x`,
+		},
+		{
+			name: "override in place",
+			got:  OverrideParam(editCmdline, "console=ttyS1,115200"),
+			want: `console=ttyS1,115200 root=/dev/sda1 rd.break uroot.initflags="a=1 b" ro -- single console=x`,
+		},
+		{
+			name: "override quoted",
+			got:  OverrideParam(editCmdline, Param("uroot.initflags", "c d")),
+			want: `console=ttyS0 root=/dev/sda1 rd.break uroot.initflags="c d" console=tty0 ro -- single console=x`,
+		},
+		{
+			name: "override adds before init arguments",
+			got:  OverrideParam(editCmdline, "init=/bin/sh"),
+			want: `console=ttyS0 root=/dev/sda1 rd.break uroot.initflags="a=1 b" console=tty0 ro init=/bin/sh -- single console=x`,
+		},
+		{
+			name: "override adds at the end",
+			got:  OverrideParam("ro", "rw"),
+			want: `ro rw`,
+		},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestParam(t *testing.T) {
+	for _, tt := range []struct {
+		key, value, want string
+	}{
+		{"quiet", "", "quiet"},
+		{"root", "/dev/sda1", "root=/dev/sda1"},
+		{"uroot.uinitflags", "-a b", `uroot.uinitflags="-a b"`},
+	} {
+		if got := Param(tt.key, tt.value); got != tt.want {
+			t.Errorf("Param(%q, %q) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !nozero
+// +build !nozero
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+)
+
+// RecordsFromBytes returns the records of the newc archive b, without the
+// trailer, like ReadAllRecords(Newc.Reader(bytes.NewReader(b))).
+//
+// The names and contents of the records point into b instead of being
+// copied: the records live in one slice and their contents in another, and
+// nothing else is allocated unless the archive has extended attributes. b
+// must therefore not be modified while the records are in use. Build with
+// the nozero tag to copy the names instead.
+func RecordsFromBytes(b []byte) ([]Record, error) {
+	// Check the archive and count its records first, so the slices are
+	// allocated once.
+	n := 0
+	for off := 0; off < len(b); {
+		r, err := nextRecord(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if r.name == Trailer {
+			break
+		}
+		if _, ok := xattrHeaderFor(r.name); !ok {
+			n++
+		}
+		off = r.next
+	}
+
+	records := make([]Record, 0, n)
+	contents := make([]bytes.Reader, n)
+	var (
+		xattrs    map[string][]byte
+		xattrsFor string
+	)
+	for off := 0; off < len(b); {
+		r, _ := nextRecord(b, off)
+		if xattrs != nil && r.name != xattrsFor {
+			return nil, fmt.Errorf("xattr header for %q is followed by %q", xattrsFor, r.name)
+		}
+		if r.name == Trailer {
+			break
+		}
+		content := b[r.filePos : r.filePos+int(r.hdr.FileSize)]
+		if owner, ok := xattrHeaderFor(r.name); ok {
+			var err error
+			if xattrs, err = readXAttrHeader(bytes.NewReader(content), uint64(r.hdr.FileSize)); err != nil {
+				return nil, fmt.Errorf("record at %d: %v", off, err)
+			}
+			xattrsFor = owner
+			off = r.next
+			continue
+		}
+
+		c := &contents[len(records)]
+		c.Reset(content)
+		info := r.hdr.Info()
+		info.Name = r.name
+		records = append(records, Record{
+			ReaderAt: c,
+			Info:     info,
+			XAttrs:   xattrs,
+			RecPos:   int64(off),
+			RecLen:   uint64(r.filePos - off),
+			FilePos:  int64(r.filePos),
+		})
+		xattrs = nil
+		off = r.next
+	}
+	if xattrs != nil {
+		return nil, fmt.Errorf("xattr header for %q ends the archive", xattrsFor)
+	}
+	return records, nil
+}
+
+// byteRecord is a record of an archive in memory.
+type byteRecord struct {
+	hdr  header
+	name string
+	// filePos is where the content starts and next where the next
+	// record does.
+	filePos, next int
+}
+
+// nextRecord decodes the record at off in b without allocating. Its name
+// points into b.
+func nextRecord(b []byte, off int) (byteRecord, error) {
+	var r byteRecord
+	if len(b)-off < headerLen {
+		return r, fmt.Errorf("record at %d: header is truncated", off)
+	}
+	h := b[off : off+headerLen]
+	if string(h[:magicLen]) != newcMagic {
+		return r, fmt.Errorf("record at %d: magic got %q, want %q", off, h[:magicLen], newcMagic)
+	}
+	var fields [13]uint32
+	for i := range fields {
+		v, ok := parseHex32(h[magicLen+8*i : magicLen+8*(i+1)])
+		if !ok {
+			return r, fmt.Errorf("record at %d: bad hex field %q", off, h[magicLen+8*i:magicLen+8*(i+1)])
+		}
+		fields[i] = v
+	}
+	r.hdr = header{
+		Ino:        fields[0],
+		Mode:       fields[1],
+		UID:        fields[2],
+		GID:        fields[3],
+		NLink:      fields[4],
+		MTime:      fields[5],
+		FileSize:   fields[6],
+		Major:      fields[7],
+		Minor:      fields[8],
+		Rmajor:     fields[9],
+		Rminor:     fields[10],
+		NameLength: fields[11],
+		CRC:        fields[12],
+	}
+	if r.hdr.NameLength == 0 {
+		return r, fmt.Errorf("record at %d has no name", off)
+	}
+	if r.hdr.NameLength > maxNameLength {
+		return r, fmt.Errorf("record at %d has a name of %d bytes, more than the maximum of %d", off, r.hdr.NameLength, maxNameLength)
+	}
+
+	namePos := off + headerLen
+	nameLen := int(r.hdr.NameLength) - 1
+	if len(b)-namePos < int(r.hdr.NameLength) {
+		return r, fmt.Errorf("record at %d: name is truncated", off)
+	}
+	if nameLen > 0 {
+		r.name = unsafe.String(&b[namePos], nameLen)
+	}
+
+	r.filePos = int(round4(int64(namePos + nameLen + 1)))
+	end := int64(r.filePos) + int64(r.hdr.FileSize)
+	if end > int64(len(b)) {
+		return r, fmt.Errorf("record at %d: content of %d bytes is truncated", off, r.hdr.FileSize)
+	}
+	r.next = int(round4(end))
+	return r, nil
+}
+
+// parseHex32 decodes the 8 hex digits of h.
+func parseHex32(h []byte) (uint32, bool) {
+	var v uint32
+	for _, c := range h {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		v = v<<4 | uint32(c)
+	}
+	return v, true
+}
@@ -0,0 +1,19 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build nozero
+// +build nozero
+
+package cpio
+
+import "bytes"
+
+// RecordsFromBytes returns the records of the newc archive b, without the
+// trailer.
+//
+// With the nozero tag, it is ReadAllRecords(Newc.Reader(bytes.NewReader(b)))
+// and the records' names are copies.
+func RecordsFromBytes(b []byte) ([]Record, error) {
+	return ReadAllRecords(Newc.Reader(bytes.NewReader(b)))
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// testArchive returns a newc archive of n files of size bytes each, a
+// directory, a symlink and a file with extended attributes.
+func testArchive(t testing.TB, n, size int) []byte {
+	records := []Record{
+		Directory("dir", 0755),
+		Symlink("dir/link", "../file0"),
+	}
+	for i := 0; i < n; i++ {
+		records = append(records, StaticRecord(randomData(size), Info{
+			Name:  fmt.Sprintf("file%d", i),
+			Mode:  unix.S_IFREG | 0644,
+			MTime: uint64(i),
+		}))
+	}
+	labelled := StaticFile("labelled", "content", 0600)
+	labelled.XAttrs = map[string][]byte{"security.selinux": []byte("system_u:object_r:bin_t:s0\x00")}
+	records = append(records, labelled)
+
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	if err := WriteRecords(w, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestRecordsFromBytes(t *testing.T) {
+	archive := testArchive(t, 5, 33)
+	want, err := ReadAllRecords(Newc.Reader(bytes.NewReader(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := RecordsFromBytes(archive)
+	if err != nil {
+		t.Fatalf("RecordsFromBytes() = %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("RecordsFromBytes() = %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Info != want[i].Info {
+			t.Errorf("record %d: Info = %+v, want %+v", i, got[i].Info, want[i].Info)
+		}
+		if !reflect.DeepEqual(got[i].XAttrs, want[i].XAttrs) {
+			t.Errorf("record %q: XAttrs = %q, want %q", want[i].Name, got[i].XAttrs, want[i].XAttrs)
+		}
+		if got[i].RecPos != want[i].RecPos || got[i].RecLen != want[i].RecLen || got[i].FilePos != want[i].FilePos {
+			t.Errorf("record %q: at (%d, %d, %d), want (%d, %d, %d)", want[i].Name,
+				got[i].RecPos, got[i].RecLen, got[i].FilePos, want[i].RecPos, want[i].RecLen, want[i].FilePos)
+		}
+		gc, err := uio.ReadAll(got[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc, err := uio.ReadAll(want[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gc, wc) {
+			t.Errorf("record %q: content = %q, want %q", want[i].Name, gc, wc)
+		}
+	}
+
+	if got, err := RecordsFromBytes(nil); err != nil || len(got) != 0 {
+		t.Errorf("RecordsFromBytes(nil) = %v, %v, want no records", got, err)
+	}
+}
+
+func TestRecordsFromBytesErrors(t *testing.T) {
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	header := StaticFile(xattrHeaderPrefix+"file", "14 user.test=a\n", 0644)
+	if err := w.WriteRecord(header); err != nil {
+		t.Fatal(err)
+	}
+	for name, archive := range map[string][]byte{
+		"bad magic":        append([]byte("070702"), testArchive(t, 1, 1)[magicLen:]...),
+		"bad hex":          append([]byte("070701zz"), testArchive(t, 1, 1)[8:]...),
+		"dangling xattrs":  b.Bytes(),
+		"misplaced xattrs": append(b.Bytes(), testArchive(t, 1, 1)...),
+	} {
+		if _, err := RecordsFromBytes(archive); err == nil {
+			t.Errorf("RecordsFromBytes(%s) = nil, want error", name)
+		}
+	}
+}
+
+// BenchmarkRecordsFromBytes compares parsing an archive in memory with
+// copying it to a temporary file to read it from there.
+func BenchmarkRecordsFromBytes(b *testing.B) {
+	archive := testArchive(b, 100, 4<<10)
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(archive)))
+		for i := 0; i < b.N; i++ {
+			if _, err := RecordsFromBytes(archive); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("reader", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(archive)))
+		for i := 0; i < b.N; i++ {
+			if _, err := ReadAllRecords(Newc.Reader(bytes.NewReader(archive))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("tempfile", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(archive)))
+		for i := 0; i < b.N; i++ {
+			f, err := ioutil.TempFile("", "cpio-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(f, bytes.NewReader(archive)); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := ReadAllRecords(Newc.Reader(f)); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+			os.Remove(f.Name())
+		}
+	})
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// AutoDecompressReader returns a reader for the uncompressed contents of r.
+//
+// gzip and bzip2 compression are detected by their magic numbers and
+// decompressed lazily, as the returned io.ReaderAt is read. If r is not
+// compressed in a known format, r itself is returned.
+//
+// OZIP files are decrypted with OZIPKeys first, and their payload is
+// decompressed in turn.
+func AutoDecompressReader(r io.ReaderAt) (io.ReaderAt, error) {
+	if IsOZIP(r) {
+		p, err := UnwrapOZIP(r)
+		if err != nil {
+			return nil, err
+		}
+		return AutoDecompressReader(p)
+	}
+
+	magic := make([]byte, 3)
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	magic = magic[:n]
+
+	sr := io.NewSectionReader(r, 0, 1<<63-1)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(sr)
+		if err != nil {
+			return nil, err
+		}
+		return uio.NewCachingReader(zr), nil
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return uio.NewCachingReader(bzip2.NewReader(sr)), nil
+	}
+	return r, nil
+}
+
+// gzipMember is the compressed form of a chunk, once done is closed.
+type gzipMember struct {
+	done chan struct{}
+	buf  bytes.Buffer
+	err  error
+}
+
+// parallelGzipWriter is the io.WriteCloser of ParallelGzipWriter.
+type parallelGzipWriter struct {
+	chunkSize int
+	chunk     []byte
+	// workers limits the chunks being compressed at once.
+	workers chan struct{}
+	// members are written to w in order by the writing goroutine, which
+	// sends what went wrong, or nil, to written when members is closed.
+	members chan *gzipMember
+	written chan error
+	started bool
+
+	mu  sync.Mutex
+	err error
+}
+
+// ParallelGzipWriter returns a writer that compresses what is written to it
+// with gzip, workers chunks of chunkSize bytes at a time, and writes the
+// compressed chunks to w in order. Each chunk is a gzip member of its own,
+// and members concatenate to a gzip stream, so that any gzip reader reads
+// the whole.
+//
+// workers defaults to the number of CPUs, and chunkSize to 1 MiB. Smaller
+// chunks compress less well. Close must be called to write the last chunk;
+// it does not close w.
+func ParallelGzipWriter(w io.Writer, workers int, chunkSize int64) io.WriteCloser {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if chunkSize <= 0 {
+		chunkSize = 1 << 20
+	}
+	p := &parallelGzipWriter{
+		chunkSize: int(chunkSize),
+		workers:   make(chan struct{}, workers),
+		members:   make(chan *gzipMember, workers),
+		written:   make(chan error, 1),
+	}
+	go p.write(w)
+	return p
+}
+
+func (p *parallelGzipWriter) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// write writes the members to w as they are done.
+func (p *parallelGzipWriter) write(w io.Writer) {
+	var err error
+	for m := range p.members {
+		<-m.done
+		if err == nil {
+			if err = m.err; err == nil {
+				_, err = w.Write(m.buf.Bytes())
+			}
+			if err != nil {
+				p.mu.Lock()
+				p.err = err
+				p.mu.Unlock()
+			}
+		}
+	}
+	p.written <- err
+}
+
+// compress starts compressing the current chunk.
+func (p *parallelGzipWriter) compress() {
+	chunk := p.chunk
+	p.chunk = nil
+	p.started = true
+	m := &gzipMember{done: make(chan struct{})}
+	p.workers <- struct{}{}
+	p.members <- m
+	go func() {
+		defer func() { <-p.workers }()
+		defer close(m.done)
+		zw := gzip.NewWriter(&m.buf)
+		if _, err := zw.Write(chunk); err != nil {
+			m.err = err
+			return
+		}
+		m.err = zw.Close()
+	}()
+}
+
+// Write implements io.Writer.
+func (p *parallelGzipWriter) Write(b []byte) (int, error) {
+	if p.members == nil {
+		return 0, errors.New("cpio: write to closed gzip writer")
+	}
+	var n int
+	for n < len(b) {
+		if err := p.error(); err != nil {
+			return n, err
+		}
+		if p.chunk == nil {
+			p.chunk = make([]byte, 0, p.chunkSize)
+		}
+		c := copy(p.chunk[len(p.chunk):p.chunkSize], b[n:])
+		p.chunk = p.chunk[:len(p.chunk)+c]
+		n += c
+		if len(p.chunk) == p.chunkSize {
+			p.compress()
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk and waits for all of them to be written.
+func (p *parallelGzipWriter) Close() error {
+	if p.members == nil {
+		return p.error()
+	}
+	// Empty input is still a gzip stream of one empty member.
+	if len(p.chunk) > 0 || !p.started {
+		p.compress()
+	}
+	close(p.members)
+	err := <-p.written
+	p.members = nil
+	return err
+}
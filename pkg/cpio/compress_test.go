@@ -0,0 +1,206 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestAutoDecompressReader(t *testing.T) {
+	var archive bytes.Buffer
+	w := Newc.Writer(&archive)
+	if err := WriteRecords(w, []Record{StaticFile("etc/hostname", "u-root\n", 0644)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(archive.Bytes())
+	zw.Close()
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"raw", archive.Bytes()},
+		{"gzip", gz.Bytes()},
+	} {
+		r, err := AutoDecompressReader(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: AutoDecompressReader = %v", tt.name, err)
+			continue
+		}
+		recs, err := ReadAllRecords(Newc.Reader(r))
+		if err != nil {
+			t.Errorf("%s: ReadAllRecords = %v", tt.name, err)
+			continue
+		}
+		if len(recs) != 1 || recs[0].Name != "etc/hostname" {
+			t.Errorf("%s: records = %v, want etc/hostname", tt.name, recs)
+			continue
+		}
+		if b, err := uio.ReadAll(recs[0]); err != nil || string(b) != "u-root\n" {
+			t.Errorf("%s: contents = %q, %v, want %q", tt.name, b, err, "u-root\n")
+		}
+	}
+}
+
+func TestAutoDecompressReaderBadGzip(t *testing.T) {
+	if _, err := AutoDecompressReader(bytes.NewReader([]byte{0x1f, 0x8b, 0})); err == nil {
+		t.Errorf("AutoDecompressReader(truncated gzip) = nil, want error")
+	}
+}
+
+// gzipMembers returns the content of each member of the gzip stream b.
+func gzipMembers(t *testing.T, b []byte) [][]byte {
+	br := bytes.NewReader(b)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members [][]byte
+	for {
+		zr.Multistream(false)
+		m, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, m)
+		if err := zr.Reset(br); err == io.EOF {
+			return members
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	data := append(randomData(5000), bytes.Repeat([]byte("u-root"), 1000)...)
+	for _, tt := range []struct {
+		workers   int
+		chunkSize int64
+		writeSize int
+		members   int
+	}{
+		{1, 1000, 100, 11},
+		{4, 1000, 1, 11},
+		{4, 1000, 1000, 11},
+		{4, 3000, 7000, 4},
+		{0, 0, len(data), 1},
+	} {
+		t.Run(fmt.Sprintf("workers=%d,chunk=%d,write=%d", tt.workers, tt.chunkSize, tt.writeSize), func(t *testing.T) {
+			var b bytes.Buffer
+			w := ParallelGzipWriter(&b, tt.workers, tt.chunkSize)
+			for off := 0; off < len(data); off += tt.writeSize {
+				end := off + tt.writeSize
+				if end > len(data) {
+					end = len(data)
+				}
+				if n, err := w.Write(data[off:end]); n != end-off || err != nil {
+					t.Fatalf("Write() = %d, %v, want %d, nil", n, err, end-off)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := gzip.NewReader(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("decompressed %d bytes, %v, want the %d written", len(got), err, len(data))
+			}
+		})
+	}
+}
+
+func TestParallelGzipWriterMembers(t *testing.T) {
+	data := randomData(10000)
+	var b bytes.Buffer
+	w := ParallelGzipWriter(&b, 3, 4000)
+	w.Write(data)
+	w.Close()
+
+	members := gzipMembers(t, b.Bytes())
+	if len(members) != 3 {
+		t.Fatalf("wrote %d gzip members, want 3", len(members))
+	}
+	// Members are in the order of the input.
+	if !bytes.Equal(bytes.Join(members, nil), data) {
+		t.Errorf("gzip members are not the input in order")
+	}
+
+	// No input is one empty member.
+	b.Reset()
+	ParallelGzipWriter(&b, 3, 4000).Close()
+	if members := gzipMembers(t, b.Bytes()); len(members) != 1 || len(members[0]) != 0 {
+		t.Errorf("empty input wrote gzip members %q, want one empty one", members)
+	}
+}
+
+// failingWriter fails writes after n bytes.
+type failingWriter struct {
+	n int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		return 0, errWriteFailed
+	}
+	f.n -= len(p)
+	return len(p), nil
+}
+
+func TestParallelGzipWriterErrors(t *testing.T) {
+	w := ParallelGzipWriter(&failingWriter{}, 2, 100)
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = w.Write(randomData(100))
+	}
+	if err != errWriteFailed {
+		t.Errorf("Write() to a failing writer = %v, want %v", err, errWriteFailed)
+	}
+	if err := w.Close(); err != errWriteFailed {
+		t.Errorf("Close() to a failing writer = %v, want %v", err, errWriteFailed)
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Errorf("Write() after Close() succeeded")
+	}
+}
+
+// BenchmarkParallelGzipWriter compresses 100 MB of zeros with one worker and
+// with four.
+func BenchmarkParallelGzipWriter(b *testing.B) {
+	zeros := make([]byte, 100<<20)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(zeros)))
+			for i := 0; i < b.N; i++ {
+				w := ParallelGzipWriter(ioutil.Discard, workers, 1<<20)
+				if _, err := w.Write(zeros); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// recordKeys maps path patterns, as in path.Match, to AES-256-GCM ciphers.
+type recordKeys struct {
+	// patterns are sorted, so that a name matching several patterns
+	// always gets the same key.
+	patterns []string
+	aeads    map[string]cipher.AEAD
+}
+
+func newRecordKeys(keys map[string][]byte) (*recordKeys, error) {
+	rk := &recordKeys{aeads: make(map[string]cipher.AEAD)}
+	for pattern, key := range keys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", pattern, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key for %q is %d bytes, want 32 for AES-256", pattern, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		rk.patterns = append(rk.patterns, pattern)
+		rk.aeads[pattern] = aead
+	}
+	sort.Strings(rk.patterns)
+	return rk, nil
+}
+
+// aead returns the cipher of the first pattern rec matches, if it is a
+// regular file.
+func (rk *recordKeys) aead(rec Record) cipher.AEAD {
+	if rec.Info.Mode&unix.S_IFMT != unix.S_IFREG {
+		return nil
+	}
+	for _, p := range rk.patterns {
+		if ok, _ := path.Match(p, rec.Name); ok {
+			return rk.aeads[p]
+		}
+	}
+	return nil
+}
+
+// EncryptingWriter is a RecordWriter that encrypts the contents of regular
+// files whose names match a pattern with AES-256-GCM.
+//
+// The content of an encrypted record is the nonce followed by the
+// ciphertext. The name of the record is authenticated too, so it cannot be
+// renamed. Records are encrypted in memory, so this is meant for small
+// files, such as keys.
+type EncryptingWriter struct {
+	w    RecordWriter
+	keys *recordKeys
+}
+
+// NewEncryptingWriter returns a writer that encrypts records whose names
+// match a pattern in keys, as in path.Match, with its 32 byte key, and writes
+// them to w. If a name matches several patterns, the first in sorted order
+// is used.
+func NewEncryptingWriter(w RecordWriter, keys map[string][]byte) (*EncryptingWriter, error) {
+	rk, err := newRecordKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptingWriter{w: w, keys: rk}, nil
+}
+
+// WriteRecord implements RecordWriter.
+func (ew *EncryptingWriter) WriteRecord(rec Record) error {
+	aead := ew.keys.aead(rec)
+	if aead == nil {
+		return ew.w.WriteRecord(rec)
+	}
+	plaintext, err := uio.ReadAll(rec)
+	if err != nil {
+		return fmt.Errorf("reading %q: %v", rec.Name, err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	return ew.w.WriteRecord(StaticRecord(aead.Seal(nonce, nonce, plaintext, []byte(rec.Name)), rec.Info))
+}
+
+// DecryptingReader is a RecordReader that decrypts records written by
+// EncryptingWriter.
+type DecryptingReader struct {
+	r    RecordReader
+	keys *recordKeys
+}
+
+// NewDecryptingReader returns a reader that decrypts the records of r whose
+// names match a pattern in keys, which should be the keys they were
+// encrypted with.
+func NewDecryptingReader(r RecordReader, keys map[string][]byte) (*DecryptingReader, error) {
+	rk, err := newRecordKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptingReader{r: r, keys: rk}, nil
+}
+
+// ReadRecord implements RecordReader. It fails if a record that should be
+// encrypted cannot be decrypted, because it was tampered with or the key is
+// wrong.
+func (dr *DecryptingReader) ReadRecord() (Record, error) {
+	rec, err := dr.r.ReadRecord()
+	if err != nil {
+		return rec, err
+	}
+	aead := dr.keys.aead(rec)
+	if aead == nil {
+		return rec, nil
+	}
+	b, err := uio.ReadAll(rec)
+	if err != nil {
+		return Record{}, fmt.Errorf("reading %q: %v", rec.Name, err)
+	}
+	if len(b) < aead.NonceSize() {
+		return Record{}, fmt.Errorf("%q is too short to be encrypted", rec.Name)
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(rec.Name))
+	if err != nil {
+		return Record{}, fmt.Errorf("decrypting %q: %v", rec.Name, err)
+	}
+	dec := StaticRecord(plaintext, rec.Info)
+	dec.RecPos, dec.RecLen, dec.FilePos = rec.RecPos, rec.RecLen, rec.FilePos
+	return dec, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"io"
+	"os"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// IDMap maps the user or group ID of a file to another.
+type IDMap func(id uint32) uint32
+
+// ExtractionOptions controls the ownership of extracted files.
+type ExtractionOptions struct {
+	// UIDMap and GIDMap map the IDs stored in the archive to the IDs the
+	// extracted files get. A nil map leaves IDs unchanged if
+	// PreserveOwnership is set and maps them to the current user's IDs
+	// otherwise.
+	UIDMap IDMap
+	GIDMap IDMap
+
+	// PreserveOwnership keeps the IDs stored in the archive. Changing
+	// ownership to other users usually requires root.
+	PreserveOwnership bool
+}
+
+func (o ExtractionOptions) uid(id uint64) uint64 {
+	if o.UIDMap != nil {
+		return uint64(o.UIDMap(uint32(id)))
+	}
+	if o.PreserveOwnership {
+		return id
+	}
+	return uint64(os.Getuid())
+}
+
+func (o ExtractionOptions) gid(id uint64) uint64 {
+	if o.GIDMap != nil {
+		return uint64(o.GIDMap(uint32(id)))
+	}
+	if o.PreserveOwnership {
+		return id
+	}
+	return uint64(os.Getgid())
+}
+
+// Extract extracts the newc archive read from r into dir, with file ownership
+// decided by opts. It streams the archive, so it works on pipes and needs
+// little memory, however big the files in it.
+func Extract(r io.Reader, dir string, opts ExtractionOptions) error {
+	return StreamRecords(r, func(rec Record, content io.Reader) error {
+		rec.UID = opts.uid(rec.UID)
+		rec.GID = opts.gid(rec.GID)
+		return createFileInRoot(rec, content, dir)
+	})
+}
+
+// ExtractWithOptions extracts the newc archive r into dir, with file ownership
+// decided by opts.
+func ExtractWithOptions(r io.ReaderAt, dir string, opts ExtractionOptions) error {
+	return Extract(uio.Reader(r), dir, opts)
+}
+
+// ExtractUnprivileged extracts the newc archive r into dir with all files
+// owned by the current user, which works without root privileges.
+func ExtractUnprivileged(r io.ReaderAt, dir string) error {
+	return ExtractWithOptions(r, dir, ExtractionOptions{})
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// ownedArchive returns an archive whose records belong to uid:gid.
+func ownedArchive(t *testing.T, uid, gid uint64) []byte {
+	var recs []Record
+	for _, r := range []Record{
+		Directory("etc", 0755),
+		StaticFile("etc/shadow", "root:*:17000::::::\n", 0600),
+		StaticFile("bin/init", "#!/bin/sh\n", 0755),
+	} {
+		r.UID, r.GID = uid, gid
+		recs = append(recs, r)
+	}
+
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	if err := WriteRecords(w, recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func checkOwner(t *testing.T, dir string, uid, gid uint32) {
+	for _, name := range []string{"etc", "etc/shadow", "bin/init"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != uid || st.Gid != gid {
+			t.Errorf("%s is owned by %d:%d, want %d:%d", name, st.Uid, st.Gid, uid, gid)
+		}
+	}
+}
+
+func TestExtractUnprivileged(t *testing.T) {
+	// 4242 is neither root nor, usually, the current user.
+	for _, id := range []uint64{0, 4242} {
+		dir, err := ioutil.TempDir("", "cpio-extract")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ExtractUnprivileged(bytes.NewReader(ownedArchive(t, id, id)), dir); err != nil {
+			t.Fatalf("ExtractUnprivileged(records owned by %d) = %v", id, err)
+		}
+		checkOwner(t, dir, uint32(os.Getuid()), uint32(os.Getgid()))
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "etc/shadow"))
+		if err != nil || string(b) != "root:*:17000::::::\n" {
+			t.Errorf("etc/shadow = %q, %v", b, err)
+		}
+	}
+}
+
+func TestExtractWithOptions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, changing ownership to other users requires root")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		opts     ExtractionOptions
+		uid, gid uint32
+	}{
+		{"preserve", ExtractionOptions{PreserveOwnership: true}, 4242, 4242},
+		{"map", ExtractionOptions{
+			UIDMap: func(id uint32) uint32 { return id + 100000 },
+			GIDMap: func(id uint32) uint32 { return id + 200000 },
+		}, 104242, 204242},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cpio-extract")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := ExtractWithOptions(bytes.NewReader(ownedArchive(t, 4242, 4242)), dir, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			checkOwner(t, dir, tt.uid, tt.gid)
+		})
+	}
+}
+
+func TestExtractPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A pipe has no ReadAt, so this needs the archive streamed.
+	pr, pw := io.Pipe()
+	go func() {
+		w := Newc.Writer(pw)
+		err := WriteRecords(w, []Record{
+			Directory("etc", 0755),
+			StaticFile("etc/hostname", "u-root\n", 0644),
+			Symlink("etc/name", "hostname"),
+		})
+		if err == nil {
+			err = WriteTrailer(w)
+		}
+		pw.CloseWithError(err)
+	}()
+	if err := Extract(pr, dir, ExtractionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "etc", "name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "u-root\n" {
+		t.Errorf("etc/name = %q, want %q", b, "u-root\n")
+	}
+}
@@ -103,12 +103,27 @@ func CreateFile(f Record) error {
 }
 
 func CreateFileInRoot(f Record, rootDir string) error {
+	return createFileInRoot(f, uio.Reader(f), rootDir)
+}
+
+// createFileInRoot creates f below rootDir with the contents read from
+// content, and sets its extended attributes.
+func createFileInRoot(f Record, content io.Reader, rootDir string) error {
+	f.Name = filepath.Clean(filepath.Join(rootDir, f.Name))
+	if err := createFile(f, content); err != nil {
+		return err
+	}
+	// Changing the owner clears security.capability, so the attributes
+	// come last.
+	return writeXAttrs(f.Name, f.XAttrs)
+}
+
+func createFile(f Record, content io.Reader) error {
 	m, err := linuxModeToFileType(f.Mode)
 	if err != nil {
 		return err
 	}
 
-	f.Name = filepath.Clean(filepath.Join(rootDir, f.Name))
 	dir := filepath.Dir(f.Name)
 	// The problem: many cpio archives do not specify the directories and
 	// hence the permissions. They just specify the whole path.  In order
@@ -130,7 +145,7 @@ func CreateFileInRoot(f Record, rootDir string) error {
 			return err
 		}
 		defer nf.Close()
-		if _, err := io.Copy(nf, uio.Reader(f)); err != nil {
+		if _, err := io.Copy(nf, content); err != nil {
 			return err
 		}
 		return setModes(f)
@@ -154,11 +169,11 @@ func CreateFileInRoot(f Record, rootDir string) error {
 		return setModes(f)
 
 	case os.ModeSymlink:
-		content, err := ioutil.ReadAll(uio.Reader(f))
+		target, err := ioutil.ReadAll(content)
 		if err != nil {
 			return err
 		}
-		return os.Symlink(string(content), f.Name)
+		return os.Symlink(string(target), f.Name)
 
 	default:
 		return fmt.Errorf("%v: Unknown type %#o", f.Name, m)
@@ -210,7 +225,22 @@ func inode(i Info) (Info, bool) {
 	return i, false
 }
 
+// GetRecord returns a record for the file at path, without following
+// symlinks. Extended attributes are left out; see GetRecordWithXAttrs.
 func GetRecord(path string) (Record, error) {
+	return getRecord(path, false)
+}
+
+// GetRecordWithXAttrs is GetRecord with the extended attributes of the file.
+//
+// Hosts with SELinux label every file, and readers that do not know the
+// PaxHeaders records carrying the attributes, like the kernel, unpack them
+// as files, so this is only for archives that need the attributes.
+func GetRecordWithXAttrs(path string) (Record, error) {
+	return getRecord(path, true)
+}
+
+func getRecord(path string, xattrs bool) (Record, error) {
 	fi, err := os.Lstat(path)
 	if err != nil {
 		return Record{}, err
@@ -219,21 +249,29 @@ func GetRecord(path string) (Record, error) {
 	sys := fi.Sys().(*syscall.Stat_t)
 	info, done := inode(sysInfo(path, sys))
 
+	var rec Record
 	switch fi.Mode() & os.ModeType {
 	case 0: // Regular file.
+		// Hard links share the attributes of the first record.
 		if done {
 			return Record{Info: info}, nil
 		}
-		return Record{Info: info, ReaderAt: NewLazyFile(path)}, nil
+		rec = Record{Info: info, ReaderAt: NewLazyFile(path)}
 
 	case os.ModeSymlink:
 		linkname, err := os.Readlink(path)
 		if err != nil {
 			return Record{}, err
 		}
-		return StaticRecord([]byte(linkname), info), nil
+		rec = StaticRecord([]byte(linkname), info)
 
 	default:
-		return StaticRecord(nil, info), nil
+		rec = StaticRecord(nil, info)
+	}
+	if xattrs {
+		if rec.XAttrs, err = readXAttrs(path); err != nil {
+			return Record{}, err
+		}
 	}
+	return rec, nil
 }
@@ -0,0 +1,162 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// ArchiveOptions configure ArchiveFromFS.
+type ArchiveOptions struct {
+	// Normalization is applied to every record.
+	Normalization NormalizationOptions
+
+	// UIDMap and GIDMap, if set, map the owner of each file. Files of an
+	// fs.FS are owned by 0 unless their FileInfo.Sys is a
+	// *syscall.Stat_t, as it is for os.DirFS.
+	UIDMap IDMap
+	GIDMap IDMap
+}
+
+// readLinkFS is the fs.ReadLinkFS of newer Go versions. An fs.FS without
+// ReadLink cannot have symlinks in the archive.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// linuxMode returns the Linux mode_t of m.
+func linuxMode(m fs.FileMode) uint64 {
+	mode := uint64(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= modeDir
+	case m&fs.ModeSymlink != 0:
+		mode |= modeSymlink
+	case m&fs.ModeNamedPipe != 0:
+		mode |= modeFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= modeSocket
+	case m&fs.ModeCharDevice != 0:
+		mode |= modeChar
+	case m&fs.ModeDevice != 0:
+		mode |= modeBlock
+	default:
+		mode |= modeFile
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= modeSUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= modeSGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= modeSticky
+	}
+	return mode
+}
+
+// openFile returns the contents of name in fsys, read when they are first
+// needed.
+func openFile(fsys fs.FS, name string) uio.ReadAtCloser {
+	return uio.NewLazyOpenerAt(func() (io.ReaderAt, error) {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		if ra, ok := f.(io.ReaderAt); ok {
+			return ra, nil
+		}
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(b), nil
+	})
+}
+
+// closingWriter closes the contents of each record once it is written.
+type closingWriter struct {
+	w RecordWriter
+}
+
+// WriteRecord implements RecordWriter.
+func (cw closingWriter) WriteRecord(rec Record) error {
+	err := cw.w.WriteRecord(rec)
+	if c, ok := rec.ReaderAt.(io.Closer); ok {
+		c.Close()
+	}
+	return err
+}
+
+// ArchiveFromFS writes a newc archive of the files in fsys to w, from the
+// root of fsys down in lexical order, followed by a trailer.
+//
+// Regular files, directories and, if fsys has a ReadLink method, symlinks
+// are archived; anything else, like devices, is written without contents.
+func ArchiveFromFS(w io.Writer, fsys fs.FS, opts ArchiveOptions) error {
+	rw := NewNormalizingWriter(closingWriter{Newc.Writer(w)}, opts.Normalization)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		info := Info{
+			Name: name,
+			Mode: linuxMode(fi.Mode()),
+		}
+		// Files of an embed.FS have no modification time.
+		if t := fi.ModTime(); !t.IsZero() {
+			info.MTime = uint64(t.Unix())
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			info.UID, info.GID = uint64(st.Uid), uint64(st.Gid)
+		}
+		if opts.UIDMap != nil {
+			info.UID = uint64(opts.UIDMap(uint32(info.UID)))
+		}
+		if opts.GIDMap != nil {
+			info.GID = uint64(opts.GIDMap(uint32(info.GID)))
+		}
+
+		switch {
+		case fi.Mode().IsRegular():
+			info.FileSize = uint64(fi.Size())
+			return rw.WriteRecord(Record{ReaderAt: openFile(fsys, name), Info: info})
+		case fi.Mode()&fs.ModeSymlink != 0:
+			rl, ok := fsys.(readLinkFS)
+			if !ok {
+				return fmt.Errorf("%s: symlink in a file system without ReadLink", name)
+			}
+			target, err := rl.ReadLink(name)
+			if err != nil {
+				return err
+			}
+			return rw.WriteRecord(StaticRecord([]byte(target), info))
+		default:
+			return rw.WriteRecord(StaticRecord(nil, info))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return WriteTrailer(rw)
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package cpio
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+//go:embed testdata/fsys
+var testFS embed.FS
+
+var time0 = time.Unix(1500000000, 0)
+
+type fsRecord struct {
+	name     string
+	mode     uint64
+	uid, gid uint64
+	content  string
+}
+
+func readFSArchive(t *testing.T, b []byte) []fsRecord {
+	recs, err := ReadAllRecords(Newc.Reader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []fsRecord
+	for _, rec := range recs {
+		c, err := uio.ReadAll(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fsRecord{rec.Name, rec.Mode, rec.UID, rec.GID, string(c)})
+	}
+	return got
+}
+
+func TestArchiveFromEmbedFS(t *testing.T) {
+	fsys, err := fs.Sub(testFS, "testdata/fsys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := ArchiveFromFS(&b, fsys, ArchiveOptions{}); err != nil {
+		t.Fatalf("ArchiveFromFS() = %v", err)
+	}
+	want := []fsRecord{
+		{name: "etc", mode: modeDir | 0555},
+		{name: "etc/hostname", mode: modeFile | 0444, content: "u-root\n"},
+		{name: "init", mode: modeFile | 0444, content: "#!/bin/sh\necho hi\n"},
+		{name: "usr", mode: modeDir | 0555},
+		{name: "usr/share", mode: modeDir | 0555},
+		{name: "usr/share/motd", mode: modeFile | 0444, content: "hello\n"},
+	}
+	if got := readFSArchive(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("ArchiveFromFS() wrote %+v, want %+v", got, want)
+	}
+}
+
+func TestArchiveFromDirFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio-fsarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "file"), time0, time0); err != nil {
+		t.Fatal(err)
+	}
+	fsys := os.DirFS(dir)
+	_, symlinks := fsys.(readLinkFS)
+	if symlinks {
+		if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b bytes.Buffer
+	err = ArchiveFromFS(&b, fsys, ArchiveOptions{
+		UIDMap: func(uid uint32) uint32 { return uid + 1000 },
+		GIDMap: func(gid uint32) uint32 { return gid + 2000 },
+	})
+	if err != nil {
+		t.Fatalf("ArchiveFromFS() = %v", err)
+	}
+	uid, gid := uint64(os.Getuid())+1000, uint64(os.Getgid())+2000
+	want := []fsRecord{
+		{name: "dir", mode: modeDir | 0700, uid: uid, gid: gid},
+		{name: "file", mode: modeFile | 0640, uid: uid, gid: gid, content: "content"},
+	}
+	if symlinks {
+		want = append(want, fsRecord{name: "link", mode: modeSymlink | 0777, uid: uid, gid: gid, content: "file"})
+	}
+	if got := readFSArchive(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("ArchiveFromFS() wrote %+v, want %+v", got, want)
+	}
+	recs, err := ReadAllRecords(Newc.Reader(bytes.NewReader(b.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recs[1].MTime != uint64(time0.Unix()) {
+		t.Errorf("file has mtime %d, want %d", recs[1].MTime, time0.Unix())
+	}
+
+	// Normalized archives are owned by root and have no times.
+	b.Reset()
+	err = ArchiveFromFS(&b, fsys, ArchiveOptions{
+		Normalization: NormalizationOptions{ZeroTimestamps: true, ZeroOwnership: true},
+		UIDMap:        func(uid uint32) uint32 { return uid + 1000 },
+	})
+	if err != nil {
+		t.Fatalf("ArchiveFromFS() = %v", err)
+	}
+	recs, err = ReadAllRecords(Newc.Reader(bytes.NewReader(b.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if rec.MTime != 0 || rec.UID != 0 || rec.GID != 0 {
+			t.Errorf("normalized record %s has mtime %d and owner %d:%d, want 0", rec.Name, rec.MTime, rec.UID, rec.GID)
+		}
+	}
+}
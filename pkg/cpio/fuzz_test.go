@@ -0,0 +1,68 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.18
+
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// newcArchive returns the newc archive of recs, with a trailer.
+func newcArchive(f *testing.F, recs ...Record) []byte {
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	if err := WriteRecords(w, recs); err != nil {
+		f.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		f.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// corrupt returns a copy of archive with the hex header field at index i of
+// the first record set to v.
+func corrupt(archive []byte, i int, v string) []byte {
+	b := append([]byte{}, archive...)
+	copy(b[magicLen+8*i:], v)
+	return b
+}
+
+func FuzzNewcReader(f *testing.F) {
+	valid := newcArchive(f, StaticFile("a", "content", 0644), Directory("d", 0755), Symlink("d/l", "../a"))
+	// Header fields are in the order of header: FileSize is 6 and
+	// NameLength 11.
+	for _, seed := range [][]byte{
+		valid,
+		{},
+		newcArchive(f),
+		valid[:len(valid)/2],
+		valid[:headerLen-1],
+		corrupt(valid, 6, "FFFFFFFF"),
+		corrupt(valid, 6, "8000000G"),
+		corrupt(valid, 11, "00000000"),
+		corrupt(valid, 11, "FFFFFFFF"),
+		corrupt(valid, 11, "00000003"),
+		append([]byte("07070"), valid[5:]...),
+		// Content not padded to 4 bytes.
+		bytes.Replace(valid, []byte("content\x00"), []byte("content"), 1),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, archive []byte) {
+		r := Newc.Reader(bytes.NewReader(archive))
+		for {
+			rec, err := r.ReadRecord()
+			if err != nil {
+				return
+			}
+			// Reading the content must not panic either.
+			io.Copy(io.Discard, io.NewSectionReader(rec, 0, int64(rec.FileSize)))
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package httpserver serves the contents of a cpio archive over HTTP.
+//
+// Each URL path corresponds to the record of the same name, so that an
+// initramfs can be browsed without extracting it.
+package httpserver
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// entry is the location of a record's contents in the archive.
+type entry struct {
+	info cpio.Info
+	off  int64
+}
+
+// handler is an http.Handler serving a cpio archive.
+type handler struct {
+	r io.ReaderAt
+
+	once    sync.Once
+	err     error
+	archive io.ReaderAt
+	entries map[string]entry
+	// children maps each directory to the sorted records in it.
+	children map[string][]string
+}
+
+// NewHandler returns an http.Handler serving the files in the cpio archive r.
+//
+// r may be compressed in any format known to cpio.AutoDecompressReader. The
+// archive is indexed on the first request.
+func NewHandler(r io.ReaderAt) http.Handler {
+	return &handler{r: r}
+}
+
+// Serve serves the files in the cpio archive r via HTTP on addr.
+func Serve(r io.ReaderAt, addr string) error {
+	return http.ListenAndServe(addr, NewHandler(r))
+}
+
+// index reads through the archive once and remembers where each record is.
+func (h *handler) index() error {
+	h.once.Do(func() {
+		h.archive, h.err = cpio.AutoDecompressReader(h.r)
+		if h.err != nil {
+			return
+		}
+		h.entries = map[string]entry{"": {info: cpio.Info{Mode: unix.S_IFDIR | 0755}}}
+		h.children = make(map[string][]string)
+		h.err = cpio.ForEachRecord(cpio.Newc.Reader(h.archive), func(rec cpio.Record) error {
+			name := path.Clean(cpio.Normalize(rec.Name))
+			if name == "." {
+				name = ""
+			}
+			if _, ok := h.entries[name]; !ok && name != "" {
+				dir := path.Dir(name)
+				if dir == "." {
+					dir = ""
+				}
+				h.children[dir] = append(h.children[dir], name)
+			}
+			h.entries[name] = entry{info: rec.Info, off: rec.FilePos}
+			return nil
+		})
+		for _, c := range h.children {
+			sort.Strings(c)
+		}
+	})
+	return h.err
+}
+
+const listing = `<!DOCTYPE html>
+<html>
+<head><title>Index of /{{.Dir}}</title></head>
+<body>
+<h1>Index of /{{.Dir}}</h1>
+<pre>
+{{range .Entries}}{{.Mode}} {{printf "%10d" .Size}} <a href="/{{.Name}}">{{.Base}}</a>
+{{end}}</pre>
+</body>
+</html>
+`
+
+var listingTemplate = template.Must(template.New("listing").Parse(listing))
+
+type listingEntry struct {
+	Name string
+	Base string
+	Mode string
+	Size uint64
+}
+
+func (h *handler) serveDir(w http.ResponseWriter, dir string) {
+	var entries []listingEntry
+	for _, name := range h.children[dir] {
+		e := h.entries[name]
+		rec := cpio.Record{
+			ReaderAt: io.NewSectionReader(h.archive, e.off, int64(e.info.FileSize)),
+			Info:     e.info,
+		}
+		base := path.Base(name)
+		if e.info.Mode&unix.S_IFMT == unix.S_IFDIR {
+			base += "/"
+		}
+		entries = append(entries, listingEntry{
+			Name: name,
+			Base: base,
+			Mode: cpio.LSInfoFromRecord(rec).Mode.String(),
+			Size: e.info.FileSize,
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listingTemplate.Execute(w, struct {
+		Dir     string
+		Entries []listingEntry
+	}{dir, entries}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := h.index(); err != nil {
+		http.Error(w, fmt.Sprintf("reading archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	name := cpio.Normalize(path.Clean(req.URL.Path))
+	if name == "." {
+		name = ""
+	}
+	e, ok := h.entries[name]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	content := io.NewSectionReader(h.archive, e.off, int64(e.info.FileSize))
+	switch e.info.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		h.serveDir(w, name)
+
+	case unix.S_IFLNK:
+		target, err := uio.ReadAll(content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t := string(target)
+		if !path.IsAbs(t) {
+			t = path.Join("/", path.Dir(name), t)
+		}
+		http.Redirect(w, req, t, http.StatusFound)
+
+	case unix.S_IFREG:
+		http.ServeContent(w, req, name, time.Unix(int64(e.info.MTime), 0), content)
+
+	default:
+		http.Error(w, fmt.Sprintf("%s is not a regular file", name), http.StatusForbidden)
+	}
+}
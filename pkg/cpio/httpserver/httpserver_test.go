@@ -0,0 +1,121 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func testArchive(t *testing.T) []byte {
+	var b bytes.Buffer
+	w := cpio.Newc.Writer(&b)
+	if err := cpio.WriteRecords(w, []cpio.Record{
+		cpio.Directory("etc", 0755),
+		cpio.StaticFile("etc/passwd", "root:x:0:0:root:/root:/bin/sh\n", 0644),
+		cpio.StaticFile("index.html", "<html><body>hi</body></html>", 0644),
+		cpio.Directory("bin", 0755),
+		cpio.Symlink("bin/sh", "elvish"),
+		cpio.StaticFile("bin/elvish", "#!elvish", 0755),
+		cpio.CharDev("dev/console", 0600, 5, 1),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func testServe(t *testing.T, archive []byte) {
+	s := httptest.NewServer(NewHandler(bytes.NewReader(archive)))
+	defer s.Close()
+
+	for _, tt := range []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/etc/passwd", http.StatusOK, "text/plain; charset=utf-8", "root:x:0:0:root:/root:/bin/sh\n"},
+		{"/index.html", http.StatusOK, "text/html; charset=utf-8", "<html><body>hi</body></html>"},
+		{"/bin/sh", http.StatusOK, "", "#!elvish"},
+		{"/etc/shadow", http.StatusNotFound, "", ""},
+		{"/dev/console", http.StatusForbidden, "", ""},
+	} {
+		resp, body := get(t, s.URL+tt.path)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); tt.contentType != "" && ct != tt.contentType {
+			t.Errorf("GET %s: Content-Type %q, want %q", tt.path, ct, tt.contentType)
+		}
+		if body != tt.body {
+			t.Errorf("GET %s = %q, want %q", tt.path, body, tt.body)
+		}
+	}
+
+	resp, body := get(t, s.URL+"/")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("GET /: Content-Type %q, want text/html", ct)
+	}
+	for _, want := range []string{`<a href="/etc">etc/</a>`, `<a href="/bin">bin/</a>`, `<a href="/index.html">index.html</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET / = %s, want it to contain %s", body, want)
+		}
+	}
+	if strings.Contains(body, "passwd") {
+		t.Errorf("GET / lists files in subdirectories: %s", body)
+	}
+
+	_, body = get(t, s.URL+"/etc")
+	if !strings.Contains(body, `<a href="/etc/passwd">passwd</a>`) {
+		t.Errorf("GET /etc = %s, want it to list passwd", body)
+	}
+}
+
+func TestServe(t *testing.T) {
+	testServe(t, testArchive(t))
+}
+
+func TestServeGzip(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(testArchive(t))
+	zw.Close()
+	testServe(t, b.Bytes())
+}
+
+func TestServeBadArchive(t *testing.T) {
+	s := httptest.NewServer(NewHandler(bytes.NewReader(bytes.Repeat([]byte("not a cpio archive"), 10))))
+	defer s.Close()
+	if resp, _ := get(t, s.URL+"/"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("GET / of bad archive: status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// maxSymlinks is the number of symlinks LazyFS follows before giving up.
+const maxSymlinks = 40
+
+// LazyFS is an fs.FS of the files in a cpio archive.
+//
+// Files are only extracted from the archive when they are opened, and kept
+// in a temporary directory for later opens. Close removes that directory.
+type LazyFS struct {
+	rr  RecordReader
+	tmp string
+
+	mu sync.Mutex
+	// records are the records found so far, by normalized name.
+	records map[string]Record
+	// scanned is set once the whole archive has been read.
+	scanned bool
+	// dirs maps directory names to their sorted entries. It is built on
+	// the first directory access.
+	dirs map[string][]fs.DirEntry
+	// extracted maps records to their copy in tmp.
+	extracted map[string]string
+}
+
+var (
+	_ fs.FS        = &LazyFS{}
+	_ fs.ReadDirFS = &LazyFS{}
+)
+
+// NewLazyFS returns a LazyFS for the newc archive r, which may be compressed
+// in any format known to AutoDecompressReader.
+func NewLazyFS(r io.ReaderAt) (*LazyFS, error) {
+	ur, err := AutoDecompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir("", "cpio-lazyfs")
+	if err != nil {
+		return nil, err
+	}
+	return &LazyFS{
+		rr:        Newc.Reader(ur),
+		tmp:       tmp,
+		records:   make(map[string]Record),
+		extracted: make(map[string]string),
+	}, nil
+}
+
+// Close removes all extracted files.
+func (l *LazyFS) Close() error {
+	return os.RemoveAll(l.tmp)
+}
+
+func cleanName(name string) string {
+	name = path.Clean(Normalize(name))
+	if name == "/" {
+		return "."
+	}
+	return name
+}
+
+// scan reads records until one named name is found or, if name is empty,
+// through the whole archive. l.mu must be held.
+func (l *LazyFS) scan(name string) (Record, bool, error) {
+	if rec, ok := l.records[name]; ok || l.scanned {
+		return rec, ok, nil
+	}
+
+	// Continue where the last scan stopped; everything before that is
+	// already in l.records.
+	for {
+		rec, err := l.rr.ReadRecord()
+		if err == io.EOF {
+			l.scanned = true
+			return Record{}, false, nil
+		}
+		if err != nil {
+			return Record{}, false, err
+		}
+		n := cleanName(rec.Name)
+		rec.Name = n
+		l.records[n] = rec
+		if name != "" && n == name {
+			return rec, true, nil
+		}
+	}
+}
+
+// index builds the directory listings. l.mu must be held.
+func (l *LazyFS) index() error {
+	if l.dirs != nil {
+		return nil
+	}
+	if _, _, err := l.scan(""); err != nil {
+		return err
+	}
+
+	entries := make(map[string]map[string]fs.DirEntry)
+	add := func(name string, fi fileInfo, implicit bool) {
+		dir := path.Dir(name)
+		if entries[dir] == nil {
+			entries[dir] = make(map[string]fs.DirEntry)
+		}
+		if _, ok := entries[dir][fi.Name()]; !ok || !implicit {
+			entries[dir][fi.Name()] = dirEntry{fi}
+		}
+	}
+	for name, rec := range l.records {
+		if name == "." {
+			continue
+		}
+		add(name, recordInfo(rec), false)
+		// Archives often do not contain all parent directories.
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := l.records[dir]; ok {
+				break
+			}
+			add(dir, implicitDir(dir), true)
+		}
+	}
+
+	l.dirs = make(map[string][]fs.DirEntry)
+	for dir, m := range entries {
+		for _, e := range m {
+			l.dirs[dir] = append(l.dirs[dir], e)
+		}
+		sort.Slice(l.dirs[dir], func(i, j int) bool {
+			return l.dirs[dir][i].Name() < l.dirs[dir][j].Name()
+		})
+	}
+	return nil
+}
+
+// lookup finds the record for name, following symlinks. l.mu must be held.
+func (l *LazyFS) lookup(name string) (Record, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		rec, ok, err := l.scan(name)
+		if err != nil {
+			return Record{}, err
+		}
+		if !ok {
+			return Record{}, fs.ErrNotExist
+		}
+		if rec.Mode&modeTypeMask != modeSymlink {
+			return rec, nil
+		}
+		target, err := uio.ReadAll(rec)
+		if err != nil {
+			return Record{}, err
+		}
+		t := string(target)
+		if !path.IsAbs(t) {
+			t = path.Join(path.Dir(name), t)
+		}
+		name = cleanName(t)
+	}
+	return Record{}, fmt.Errorf("too many levels of symbolic links")
+}
+
+// extract copies the contents of rec to the cache. l.mu must be held.
+func (l *LazyFS) extract(rec Record) (string, error) {
+	if p, ok := l.extracted[rec.Name]; ok {
+		return p, nil
+	}
+	p := filepath.Join(l.tmp, filepath.FromSlash(rec.Name))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, uio.Reader(rec)); err != nil {
+		f.Close()
+		os.Remove(p)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(p)
+		return "", err
+	}
+	l.extracted[rec.Name] = p
+	return p, nil
+}
+
+// Open implements fs.FS.Open.
+func (l *LazyFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec, err := l.lookup(name)
+	if err == fs.ErrNotExist {
+		// The root and parent directories may not have records.
+		if ierr := l.index(); ierr != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: ierr}
+		}
+		if entries, ok := l.dirs[name]; ok || name == "." {
+			return &lazyDir{info: implicitDir(name), entries: entries}, nil
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	info := recordInfo(rec)
+	switch rec.Mode & modeTypeMask {
+	case modeDir:
+		if err := l.index(); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &lazyDir{info: info, entries: l.dirs[rec.Name]}, nil
+
+	case modeFile:
+		p, err := l.extract(rec)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		return &lazyFile{SectionReader: io.NewSectionReader(f, 0, info.Size()), f: f, info: info}, nil
+
+	default:
+		// Devices and the like have no contents.
+		return &lazyFile{SectionReader: io.NewSectionReader(bytes.NewReader(nil), 0, 0), info: info}, nil
+	}
+}
+
+// ReadDir implements fs.ReadDirFS.ReadDir.
+func (l *LazyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.index(); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries, ok := l.dirs[name]
+	if !ok && name != "." {
+		if rec, ok := l.records[name]; !ok || rec.Mode&modeTypeMask != modeDir {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return append([]fs.DirEntry(nil), entries...), nil
+}
+
+// fileInfo implements fs.FileInfo for a record.
+type fileInfo struct {
+	Info
+}
+
+func recordInfo(rec Record) fileInfo {
+	return fileInfo{rec.Info}
+}
+
+func implicitDir(name string) fileInfo {
+	return fileInfo{Info{Name: name, Mode: modeDir | 0755}}
+}
+
+func (fi fileInfo) Name() string       { return path.Base(fi.Info.Name) }
+func (fi fileInfo) Size() int64        { return int64(fi.FileSize) }
+func (fi fileInfo) Mode() fs.FileMode  { return modeFromLinux(fi.Info.Mode) }
+func (fi fileInfo) ModTime() time.Time { return time.Unix(int64(fi.MTime), 0) }
+func (fi fileInfo) IsDir() bool        { return fi.Info.Mode&modeTypeMask == modeDir }
+func (fi fileInfo) Sys() interface{}   { return fi.Info }
+
+// dirEntry implements fs.DirEntry.
+type dirEntry struct {
+	fi fileInfo
+}
+
+func (d dirEntry) Name() string               { return d.fi.Name() }
+func (d dirEntry) IsDir() bool                { return d.fi.IsDir() }
+func (d dirEntry) Type() fs.FileMode          { return d.fi.Mode().Type() }
+func (d dirEntry) Info() (fs.FileInfo, error) { return d.fi, nil }
+
+// lazyFile is an opened record. f is nil for records without contents.
+type lazyFile struct {
+	*io.SectionReader
+	f    *os.File
+	info fileInfo
+}
+
+func (f *lazyFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *lazyFile) Close() error {
+	if f.f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
+
+// lazyDir is an opened directory.
+type lazyDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *lazyDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *lazyDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Info.Name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *lazyDir) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *lazyDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return append([]fs.DirEntry(nil), rest...), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.pos += n
+	return append([]fs.DirEntry(nil), rest[:n]...), nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package cpio
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+func lazyArchive(t *testing.T) []byte {
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	if err := WriteRecords(w, []Record{
+		Directory("etc", 0755),
+		StaticFile("etc/passwd", "root:x:0:0::/:/bin/sh\n", 0644),
+		StaticFile("etc/hostname", "u-root\n", 0644),
+		StaticFile("bin/init", "#!/bin/sh\n", 0755),
+		Symlink("bin/sh", "elvish"),
+		StaticFile("bin/elvish", "elvish", 0755),
+		Symlink("init", "/bin/init"),
+		CharDev("dev/console", 0600, 5, 1),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// extractedFiles lists the regular files in the cache of l.
+func extractedFiles(t *testing.T, l *LazyFS) []string {
+	var files []string
+	err := filepath.Walk(l.tmp, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			rel, _ := filepath.Rel(l.tmp, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestLazyFSOpen(t *testing.T) {
+	l, err := NewLazyFS(bytes.NewReader(lazyArchive(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Out of archive order, and twice, to use the cache.
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"bin/init", "#!/bin/sh\n"},
+		{"etc/passwd", "root:x:0:0::/:/bin/sh\n"},
+		{"bin/init", "#!/bin/sh\n"},
+		{"bin/sh", "elvish"},
+		{"init", "#!/bin/sh\n"},
+	} {
+		b, err := fs.ReadFile(l, tt.name)
+		if err != nil {
+			t.Errorf("ReadFile(%q) = %v", tt.name, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("ReadFile(%q) = %q, want %q", tt.name, b, tt.want)
+		}
+	}
+
+	want := []string{"bin/elvish", "bin/init", "etc/passwd"}
+	if got := extractedFiles(t, l); !reflect.DeepEqual(got, want) {
+		t.Errorf("extracted %v, want only %v", got, want)
+	}
+
+	fi, err := fs.Stat(l, "etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "passwd" || fi.Size() != 22 || fi.Mode() != 0644 {
+		t.Errorf("Stat(etc/passwd) = %s %d %v, want passwd 22 -rw-r--r--", fi.Name(), fi.Size(), fi.Mode())
+	}
+
+	for _, name := range []string{"etc/shadow", "/etc/passwd", "../etc"} {
+		if _, err := l.Open(name); err == nil {
+			t.Errorf("Open(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestLazyFSReadDir(t *testing.T) {
+	l, err := NewLazyFS(bytes.NewReader(lazyArchive(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, tt := range []struct {
+		dir  string
+		want []string
+	}{
+		{".", []string{"bin", "dev", "etc", "init"}},
+		{"etc", []string{"hostname", "passwd"}},
+		// bin and dev have no records of their own.
+		{"bin", []string{"elvish", "init", "sh"}},
+		{"dev", []string{"console"}},
+	} {
+		entries, err := fs.ReadDir(l, tt.dir)
+		if err != nil {
+			t.Errorf("ReadDir(%q) = %v", tt.dir, err)
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadDir(%q) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+	if _, err := fs.ReadDir(l, "etc/passwd"); err == nil {
+		t.Errorf("ReadDir(etc/passwd) = nil, want error")
+	}
+
+	if got := extractedFiles(t, l); len(got) != 0 {
+		t.Errorf("listing directories extracted %v", got)
+	}
+}
+
+func TestLazyFSTestFS(t *testing.T) {
+	l, err := NewLazyFS(bytes.NewReader(lazyArchive(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := fstest.TestFS(l, "etc/passwd", "etc/hostname", "bin/init", "bin/sh", "dev/console", "init"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLazyFSClose(t *testing.T) {
+	l, err := NewLazyFS(bytes.NewReader(lazyArchive(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(l, "etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadDir(l.tmp); !os.IsNotExist(err) {
+		t.Errorf("cache directory exists after Close: %v", err)
+	}
+}
@@ -5,11 +5,13 @@
 package cpio
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/u-root/u-root/pkg/uio"
 )
@@ -115,7 +117,18 @@ func (w *writer) pad() error {
 
 // WriteRecord writes newc cpio records. It pads the header+name write to 4
 // byte alignment and pads the data write as well.
+//
+// If f has XAttrs, a header record holding them is written first.
 func (w *writer) WriteRecord(f Record) error {
+	if len(f.XAttrs) > 0 {
+		if err := w.writeRecord(xattrHeader(f)); err != nil {
+			return err
+		}
+	}
+	return w.writeRecord(f)
+}
+
+func (w *writer) writeRecord(f Record) error {
 	// Write magic.
 	if _, err := w.Write([]byte(w.n.magic)); err != nil {
 		return err
@@ -174,6 +187,30 @@ func (w *writer) WriteRecord(f Record) error {
 	return nil
 }
 
+// headerLen is the length of the magic and hex encoded header.
+var headerLen = magicLen + hex.EncodedLen(binary.Size(header{}))
+
+// decodeHeader checks the magic in buf and decodes the header after it.
+func (n newc) decodeHeader(buf []byte) (header, error) {
+	var hdr header
+	// Check the magic.
+	if magic := string(buf[:magicLen]); magic != n.magic {
+		return hdr, fmt.Errorf("reader: magic got %q, want %q", magic, n.magic)
+	}
+	Debug("Header is %v\n", buf)
+
+	// Decode hex header fields.
+	dst := make([]byte, binary.Size(hdr))
+	if _, err := hex.Decode(dst, buf[magicLen:]); err != nil {
+		return hdr, fmt.Errorf("reader: error decoding hex: %v", err)
+	}
+	if err := binary.Read(bytes.NewReader(dst), binary.BigEndian, &hdr); err != nil {
+		return hdr, err
+	}
+	Debug("Decoded header is %v\n", hdr)
+	return hdr, nil
+}
+
 type reader struct {
 	n   newc
 	r   io.ReaderAt
@@ -204,32 +241,55 @@ func (r *reader) readAligned(p []byte) error {
 }
 
 // ReadRecord implements RecordReader for the newc cpio format.
+//
+// The extended attributes in a header record are returned as the XAttrs of
+// the record after it.
 func (r *reader) ReadRecord() (Record, error) {
-	hdr := header{}
+	rec, err := r.readRecord()
+	if err != nil {
+		return Record{}, err
+	}
+	name, ok := xattrHeaderFor(rec.Name)
+	if !ok {
+		return rec, nil
+	}
+	xattrs, err := readXAttrHeader(uio.Reader(rec), rec.FileSize)
+	if err != nil {
+		return Record{}, fmt.Errorf("record at %d: %v", rec.RecPos, err)
+	}
+	next, err := r.readRecord()
+	if err == io.EOF {
+		return Record{}, fmt.Errorf("xattr header at %d for %q ends the archive", rec.RecPos, name)
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	if next.Name != name {
+		return Record{}, fmt.Errorf("xattr header at %d for %q is followed by %q", rec.RecPos, name, next.Name)
+	}
+	next.XAttrs = xattrs
+	return next, nil
+}
+
+func (r *reader) readRecord() (Record, error) {
 	recPos := r.pos
 
 	Debug("Next record: pos is %d\n", r.pos)
 
-	buf := make([]byte, hex.EncodedLen(binary.Size(hdr))+magicLen)
+	buf := make([]byte, headerLen)
 	if err := r.read(buf); err != nil {
 		return Record{}, err
 	}
-
-	// Check the magic.
-	if magic := string(buf[:magicLen]); magic != r.n.magic {
-		return Record{}, fmt.Errorf("reader: magic got %q, want %q", magic, r.n.magic)
+	hdr, err := r.n.decodeHeader(buf)
+	if err != nil {
+		return Record{}, err
 	}
-	Debug("Header is %v\n", buf)
-
-	// Decode hex header fields.
-	dst := make([]byte, binary.Size(hdr))
-	if _, err := hex.Decode(dst, buf[magicLen:]); err != nil {
-		return Record{}, fmt.Errorf("reader: error decoding hex: %v", err)
+	if hdr.NameLength == 0 {
+		return Record{}, fmt.Errorf("record at %d has no name", recPos)
 	}
-	if err := binary.Read(bytes.NewReader(dst), binary.BigEndian, &hdr); err != nil {
-		return Record{}, err
+	if hdr.NameLength > maxNameLength {
+		return Record{}, fmt.Errorf("record at %d has a name of %d bytes, more than the maximum of %d", recPos, hdr.NameLength, maxNameLength)
 	}
-	Debug("Decoded header is %v\n", hdr)
 
 	// Get the name.
 	nameBuf := make([]byte, hdr.NameLength)
@@ -253,6 +313,134 @@ func (r *reader) ReadRecord() (Record, error) {
 	}, nil
 }
 
+// streamBufferSize is the size of the read buffer of StreamRecords.
+const streamBufferSize = 64 << 10
+
+// maxNameLength bounds the names of records read, so that a corrupt
+// header cannot make it allocate gigabytes. It is Linux's PATH_MAX.
+const maxNameLength = 4096
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// readFull reads len(p) bytes, where running out of data at the start of a
+// record is io.EOF and anywhere else an error.
+func (c *countingReader) readFull(p []byte) error {
+	pos := c.pos
+	n, err := io.ReadFull(c, p)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("read(pos = %d): got %d, want %d bytes; error %v", pos, n, len(p), err)
+	}
+	return nil
+}
+
+// skip discards the rest of the data and padding up to pos.
+func (c *countingReader) skip(pos int64) error {
+	if n := pos - c.pos; n > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c, n); err != nil {
+			return fmt.Errorf("skipping to %d: %v", pos, err)
+		}
+	}
+	return nil
+}
+
+// StreamRecords reads the newc archive r up to its trailer and calls fn with
+// each record, but the trailer, and a reader of its contents.
+//
+// Unlike Newc.Reader, StreamRecords needs no io.ReaderAt and holds no more
+// than a small buffer of the archive in memory, however big the records. In
+// return, the records' ReaderAt is nil and the content reader is only valid
+// until fn returns. fn should consume it; what is left is skipped.
+func StreamRecords(r io.Reader, fn func(Record, io.Reader) error) error {
+	return Newc.(newc).stream(r, fn)
+}
+
+func (n newc) stream(r io.Reader, fn func(Record, io.Reader) error) error {
+	c := &countingReader{r: bufio.NewReaderSize(r, streamBufferSize)}
+	buf := make([]byte, headerLen)
+	// xattrs, if not nil, are for the record called xattrsFor, which must
+	// be next.
+	var (
+		xattrs    map[string][]byte
+		xattrsFor string
+	)
+	for {
+		recPos := c.pos
+		// Like Newc.Reader, take the end of r at a record boundary as
+		// the end of the archive.
+		if err := c.readFull(buf); err == io.EOF && xattrs == nil {
+			return nil
+		} else if err == io.EOF {
+			return fmt.Errorf("xattr header for %q ends the archive", xattrsFor)
+		} else if err != nil {
+			return err
+		}
+		hdr, err := n.decodeHeader(buf)
+		if err != nil {
+			return err
+		}
+		if hdr.NameLength == 0 {
+			return fmt.Errorf("record at %d has no name", recPos)
+		}
+		if hdr.NameLength > maxNameLength {
+			return fmt.Errorf("record at %d has a name of %d bytes, more than the maximum of %d", recPos, hdr.NameLength, maxNameLength)
+		}
+		name := make([]byte, hdr.NameLength)
+		if err := c.readFull(name); err != nil {
+			return err
+		}
+		if err := c.skip(round4(c.pos)); err != nil {
+			return err
+		}
+
+		info := hdr.Info()
+		info.Name = string(name[:hdr.NameLength-1])
+		if xattrs != nil && info.Name != xattrsFor {
+			return fmt.Errorf("xattr header for %q is followed by %q", xattrsFor, info.Name)
+		}
+		if info.Name == Trailer {
+			return nil
+		}
+		end := round4(c.pos + int64(hdr.FileSize))
+		if owner, ok := xattrHeaderFor(info.Name); ok {
+			if xattrs, err = readXAttrHeader(c, info.FileSize); err != nil {
+				return fmt.Errorf("record at %d: %v", recPos, err)
+			}
+			xattrsFor = owner
+			if err := c.skip(end); err != nil {
+				return err
+			}
+			continue
+		}
+		rec := Record{
+			Info:    info,
+			XAttrs:  xattrs,
+			RecLen:  uint64(c.pos - recPos),
+			RecPos:  recPos,
+			FilePos: c.pos,
+		}
+		xattrs = nil
+		if err := fn(rec, io.LimitReader(c, int64(hdr.FileSize))); err != nil {
+			return err
+		}
+		if err := c.skip(end); err != nil {
+			return err
+		}
+	}
+}
+
 func init() {
 	formatMap["newc"] = Newc
 }
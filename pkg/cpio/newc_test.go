@@ -6,9 +6,11 @@ package cpio
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"reflect"
+	"runtime"
 	"syscall"
 	"testing"
 
@@ -539,3 +541,117 @@ func TestReproducible(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamRecords(t *testing.T) {
+	want, err := ReadAllRecords(Newc.Reader(bytes.NewReader(testCPIO)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i int
+	// Only read every other file, to check that the rest is skipped.
+	err = StreamRecords(bytes.NewReader(testCPIO), func(rec Record, r io.Reader) error {
+		if i >= len(want) {
+			t.Fatalf("StreamRecords() got more than %d records", len(want))
+		}
+		w := want[i]
+		if rec.Info != w.Info || rec.RecPos != w.RecPos || rec.RecLen != w.RecLen || rec.FilePos != w.FilePos {
+			t.Errorf("record %d = %+v, want %+v", i, rec, w)
+		}
+		if i%2 == 0 {
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := uio.ReadAll(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("content of %q = %q, want %q", rec.Name, got, content)
+			}
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamRecords() = %v", err)
+	}
+	if i != len(want) {
+		t.Errorf("StreamRecords() got %d records, want %d", i, len(want))
+	}
+
+	errStop := errors.New("stop")
+	if err := StreamRecords(bytes.NewReader(testCPIO), func(Record, io.Reader) error { return errStop }); err != errStop {
+		t.Errorf("StreamRecords() = %v, want %v", err, errStop)
+	}
+
+	noop := func(Record, io.Reader) error { return nil }
+	if err := StreamRecords(bytes.NewReader(badMagicCPIO), noop); err == nil {
+		t.Errorf("StreamRecords(badMagicCPIO) succeeded")
+	}
+	// Cut the archive in the contents of its first file.
+	if err := StreamRecords(bytes.NewReader(testCPIO[:int(want[0].FilePos)+1]), noop); err == nil && want[0].FileSize > 1 {
+		t.Errorf("StreamRecords() of a truncated archive succeeded")
+	}
+	if err := StreamRecords(bytes.NewReader(testCPIO[:10]), noop); err == nil {
+		t.Errorf("StreamRecords() of a truncated header succeeded")
+	}
+}
+
+// patternReaderAt is a file of size bytes that is never in memory.
+type patternReaderAt int64
+
+func (p patternReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(p) {
+		return 0, io.EOF
+	}
+	if rest := int64(p) - off; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	for i := range b {
+		b[i] = byte(off + int64(i))
+	}
+	return len(b), nil
+}
+
+func TestStreamRecordsMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping writing a 100 MB archive in short mode")
+	}
+	const size = 100 << 20
+	pr, pw := io.Pipe()
+	go func() {
+		w := Newc.Writer(pw)
+		rec := Record{ReaderAt: patternReaderAt(size), Info: Info{Name: "big", Mode: syscall.S_IFREG | 0644, FileSize: size}}
+		err := WriteRecords(w, []Record{rec, StaticFile("small", "small", 0644)})
+		if err == nil {
+			err = WriteTrailer(w)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var names []string
+	var n int64
+	err := StreamRecords(pr, func(rec Record, r io.Reader) error {
+		names = append(names, rec.Name)
+		m, err := io.Copy(ioutil.Discard, r)
+		n += m
+		return err
+	})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"big", "small"}) || n != size+5 {
+		t.Errorf("StreamRecords() got %v with %d bytes, want [big small] with %d bytes", names, n, size+5)
+	}
+	// Everything allocated meanwhile, including by the writer, bounds the
+	// peak.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 8<<20 {
+		t.Errorf("StreamRecords() of a %d byte archive allocated %d bytes", size, alloc)
+	}
+}
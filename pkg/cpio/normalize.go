@@ -0,0 +1,116 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"sort"
+)
+
+// NormalizationOptions say which metadata NormalizeRecords and
+// NormalizingWriter strip so that archives built from the same files on
+// different machines are identical.
+//
+// Fields that only describe the file system a record was read from, which
+// are the inode, device and link count, are always cleared and names are
+// made relative, as in MakeReproducible.
+type NormalizationOptions struct {
+	// ZeroTimestamps sets all modification times to 0.
+	ZeroTimestamps bool
+
+	// ZeroOwnership sets all UIDs and GIDs to 0.
+	ZeroOwnership bool
+
+	// SortByName orders records by name. The trailer stays last.
+	SortByName bool
+
+	// StripXattrs drops extended attributes, which differ between hosts,
+	// e.g. in their SELinux labels.
+	StripXattrs bool
+}
+
+// normalize returns rec stripped as opts say.
+func (opts NormalizationOptions) normalize(rec Record) Record {
+	rec.Name = Normalize(rec.Name)
+	rec.Ino = 0
+	rec.Dev = 0
+	rec.Major = 0
+	rec.Minor = 0
+	rec.NLink = 0
+	if opts.ZeroTimestamps {
+		rec.MTime = 0
+	}
+	if opts.ZeroOwnership {
+		rec.UID = 0
+		rec.GID = 0
+	}
+	if opts.StripXattrs {
+		rec.XAttrs = nil
+	}
+	return rec
+}
+
+// sortByName sorts records by name, keeping trailers last.
+func sortByName(records []Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		if ti, tj := records[i].Name == Trailer, records[j].Name == Trailer; ti || tj {
+			return !ti && tj
+		}
+		return records[i].Name < records[j].Name
+	})
+}
+
+// NormalizeRecords returns a copy of records normalized as opts say.
+func NormalizeRecords(records []Record, opts NormalizationOptions) []Record {
+	n := make([]Record, 0, len(records))
+	for _, rec := range records {
+		n = append(n, opts.normalize(rec))
+	}
+	if opts.SortByName {
+		sortByName(n)
+	}
+	return n
+}
+
+// NormalizingWriter is a RecordWriter that normalizes each record as its
+// options say before writing it.
+//
+// With SortByName, records are held back until the trailer is written or
+// Flush is called, and then written in order of their names.
+type NormalizingWriter struct {
+	w    RecordWriter
+	opts NormalizationOptions
+
+	pending []Record
+}
+
+// NewNormalizingWriter returns a writer that normalizes records as opts say
+// and writes them to w.
+func NewNormalizingWriter(w RecordWriter, opts NormalizationOptions) *NormalizingWriter {
+	return &NormalizingWriter{w: w, opts: opts}
+}
+
+// WriteRecord implements RecordWriter.
+func (nw *NormalizingWriter) WriteRecord(rec Record) error {
+	rec = nw.opts.normalize(rec)
+	if !nw.opts.SortByName {
+		return nw.w.WriteRecord(rec)
+	}
+	if rec.Name != Trailer {
+		nw.pending = append(nw.pending, rec)
+		return nil
+	}
+	if err := nw.Flush(); err != nil {
+		return err
+	}
+	return nw.w.WriteRecord(rec)
+}
+
+// Flush writes the records held back for sorting.
+func (nw *NormalizingWriter) Flush() error {
+	sortByName(nw.pending)
+	err := WriteRecords(nw.w, nw.pending)
+	nw.pending = nil
+	return err
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+var reproducible = NormalizationOptions{
+	ZeroTimestamps: true,
+	ZeroOwnership:  true,
+	SortByName:     true,
+	StripXattrs:    true,
+}
+
+// buildTree creates the same files below a new directory on every call, with
+// the given umask and modification time, and returns their records in the
+// order names lists them, as if uid had built them.
+func buildTree(t *testing.T, umask int, mtime time.Time, uid uint64, names []string) ([]Record, func()) {
+	dir, err := ioutil.TempDir("", "normalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := syscall.Umask(umask)
+	defer syscall.Umask(old)
+
+	files := map[string]string{"bin/init": "#!/bin/sh\n", "etc/hostname": "u-root\n"}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Builds set the permissions they need; the umask changes the rest.
+	for _, name := range []string{"bin", "etc", "etc/hostname"} {
+		if err := os.Chmod(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "bin/init"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []Record
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := GetRecord(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.ReaderAt != nil {
+			// The archive is written several times, so read the
+			// lazily opened file now.
+			b, err := uio.ReadAll(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec = StaticRecord(b, rec.Info)
+		}
+		rec.Name = name
+		rec.UID, rec.GID = uid, uid
+		recs = append(recs, rec)
+	}
+	return recs, func() { os.RemoveAll(dir) }
+}
+
+func archive(t *testing.T, recs []Record, wrap func(RecordWriter) RecordWriter) []byte {
+	var b bytes.Buffer
+	w := wrap(Newc.Writer(&b))
+	if err := WriteRecords(w, recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestNormalizeReproducible(t *testing.T) {
+	recs1, cleanup1 := buildTree(t, 022, time.Unix(1500000000, 0), 0,
+		[]string{"bin", "bin/init", "etc", "etc/hostname"})
+	defer cleanup1()
+	recs2, cleanup2 := buildTree(t, 077, time.Unix(1600000000, 0), 1000,
+		[]string{"etc", "etc/hostname", "bin", "bin/init"})
+	defer cleanup2()
+
+	plain := func(w RecordWriter) RecordWriter { return w }
+	if bytes.Equal(archive(t, recs1, plain), archive(t, recs2, plain)) {
+		t.Fatalf("archives are equal without normalization")
+	}
+
+	normalizing := func(w RecordWriter) RecordWriter { return NewNormalizingWriter(w, reproducible) }
+	a1, a2 := archive(t, recs1, normalizing), archive(t, recs2, normalizing)
+	if !bytes.Equal(a1, a2) {
+		t.Errorf("NormalizingWriter archives differ:\n%q\n%q", a1, a2)
+	}
+
+	a3 := archive(t, NormalizeRecords(recs2, reproducible), plain)
+	if !bytes.Equal(a1, a3) {
+		t.Errorf("NormalizeRecords archive differs from NormalizingWriter archive:\n%q\n%q", a3, a1)
+	}
+
+	extracted, err := ReadAllRecords(Newc.Reader(bytes.NewReader(a1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rec := range extracted {
+		names = append(names, rec.Name)
+		if rec.MTime != 0 || rec.UID != 0 || rec.GID != 0 || rec.Ino != 0 {
+			t.Errorf("record %v was not normalized", rec.Info)
+		}
+	}
+	if want := []string{"bin", "bin/init", "etc", "etc/hostname"}; !equalStrings(names, want) {
+		t.Errorf("records are %v, want %v", names, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNormalizeRecordsOptions(t *testing.T) {
+	recs := []Record{
+		StaticRecord([]byte("b"), Info{Name: "/b", MTime: 5, UID: 7, GID: 8, Ino: 9, NLink: 1}),
+		StaticRecord([]byte("a"), Info{Name: "a", MTime: 6, UID: 7, GID: 8}),
+	}
+	for _, tt := range []struct {
+		opts NormalizationOptions
+		want []Info
+	}{
+		{
+			opts: NormalizationOptions{},
+			want: []Info{
+				{Name: "b", MTime: 5, UID: 7, GID: 8, FileSize: 1},
+				{Name: "a", MTime: 6, UID: 7, GID: 8, FileSize: 1},
+			},
+		},
+		{
+			opts: NormalizationOptions{ZeroTimestamps: true},
+			want: []Info{
+				{Name: "b", UID: 7, GID: 8, FileSize: 1},
+				{Name: "a", UID: 7, GID: 8, FileSize: 1},
+			},
+		},
+		{
+			opts: NormalizationOptions{ZeroOwnership: true, SortByName: true},
+			want: []Info{
+				{Name: "a", MTime: 6, FileSize: 1},
+				{Name: "b", MTime: 5, FileSize: 1},
+			},
+		},
+	} {
+		got := NormalizeRecords(recs, tt.opts)
+		if len(got) != len(tt.want) {
+			t.Fatalf("NormalizeRecords(%+v) returned %d records, want %d", tt.opts, len(got), len(tt.want))
+		}
+		for i := range got {
+			if got[i].Info != tt.want[i] {
+				t.Errorf("NormalizeRecords(%+v)[%d] = %v, want %v", tt.opts, i, got[i].Info, tt.want[i])
+			}
+		}
+	}
+	if recs[0].Name != "/b" || recs[0].MTime != 5 {
+		t.Errorf("NormalizeRecords changed its input: %v", recs[0].Info)
+	}
+}
+
+func TestNormalizeStripXattrs(t *testing.T) {
+	rec := StaticFile("etc/hostname", "u-root\n", 0644)
+	rec.XAttrs = map[string][]byte{"security.selinux": []byte("system_u:object_r:etc_t:s0")}
+
+	if got := NormalizeRecords([]Record{rec}, NormalizationOptions{}); len(got[0].XAttrs) != 1 {
+		t.Errorf("NormalizeRecords() without StripXattrs has xattrs %q, want them kept", got[0].XAttrs)
+	}
+	if got := NormalizeRecords([]Record{rec}, NormalizationOptions{StripXattrs: true}); got[0].XAttrs != nil {
+		t.Errorf("NormalizeRecords() with StripXattrs has xattrs %q, want none", got[0].XAttrs)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+// OZIP is the encrypted container some Android vendors, OPPO first, ship
+// firmware in. It is not a sparse image, and there is no key shared by all
+// devices: each vendor and device family has its own AES-128 key.
+//
+// An OZIP file is a 0x1050 byte header starting with ozipMagic, followed by
+// the payload in chunks of ozipChunk bytes. Only the first AES block of each
+// chunk is encrypted, with AES-128-ECB; the rest of the chunk is plain.
+const (
+	ozipHeaderSize = 0x1050
+	ozipChunk      = aes.BlockSize + 0x4000
+)
+
+var ozipMagic = []byte("OPPOENCRYPT!")
+
+// OZIPKeys are the AES-128 keys UnwrapOZIP tries, in order. u-root knows no
+// keys of its own; add those of the devices whose images are to be read.
+var OZIPKeys [][]byte
+
+// payloadMagics are the starts of payloads UnwrapOZIP recognizes a key by.
+var payloadMagics = [][]byte{gzipMagic, bzip2Magic, []byte(newcMagic), []byte("PK\x03\x04")}
+
+// IsOZIP returns whether r starts with the OZIP magic.
+func IsOZIP(r io.ReaderAt) bool {
+	magic := make([]byte, len(ozipMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, ozipMagic)
+}
+
+// UnwrapOZIP returns the decrypted payload of the OZIP file r, which is
+// decrypted lazily as it is read. The key is the first of OZIPKeys that
+// decrypts the payload to a gzip, bzip2, newc cpio or zip file.
+func UnwrapOZIP(r io.ReaderAt) (io.ReaderAt, error) {
+	if !IsOZIP(r) {
+		return nil, fmt.Errorf("not an OZIP file")
+	}
+	first := make([]byte, aes.BlockSize)
+	if _, err := r.ReadAt(first, ozipHeaderSize); err != nil {
+		return nil, fmt.Errorf("OZIP payload: %v", err)
+	}
+	plain := make([]byte, aes.BlockSize)
+	for _, key := range OZIPKeys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("OZIP key %x: %v", key, err)
+		}
+		block.Decrypt(plain, first)
+		for _, m := range payloadMagics {
+			if bytes.HasPrefix(plain, m) {
+				return &ozipReader{r: r, block: block}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("none of the %d OZIP keys decrypts this file", len(OZIPKeys))
+}
+
+// ozipReader decrypts an OZIP payload.
+type ozipReader struct {
+	r     io.ReaderAt
+	block cipher.Block
+}
+
+// ReadAt implements io.ReaderAt.
+func (o *ozipReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n, err := o.r.ReadAt(p, ozipHeaderSize+off)
+	p = p[:n]
+
+	// Decrypt the first block of each chunk p overlaps.
+	buf := make([]byte, aes.BlockSize)
+	for c := off / ozipChunk * ozipChunk; c < off+int64(n); c += ozipChunk {
+		m, rerr := o.r.ReadAt(buf, ozipHeaderSize+c)
+		if m < aes.BlockSize {
+			// A partial last block cannot have been encrypted.
+			if rerr != nil && rerr != io.EOF {
+				return 0, rerr
+			}
+			break
+		}
+		o.block.Decrypt(buf, buf)
+		if c >= off {
+			copy(p[c-off:], buf)
+		} else if c+aes.BlockSize > off {
+			copy(p, buf[off-c:])
+		}
+	}
+	return n, err
+}
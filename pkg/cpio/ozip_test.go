@@ -0,0 +1,110 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"io"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+var ozipTestKey = []byte("0123456789abcdef")
+
+// ozip wraps payload in an OZIP file encrypted with key.
+func ozip(t *testing.T, key, payload []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, ozipHeaderSize, ozipHeaderSize+len(payload))
+	copy(b, ozipMagic)
+	for off := 0; off < len(payload); off += ozipChunk {
+		chunk := make([]byte, ozipChunk)
+		chunk = chunk[:copy(chunk, payload[off:])]
+		if len(chunk) >= aes.BlockSize {
+			block.Encrypt(chunk, chunk)
+		}
+		b = append(b, chunk...)
+	}
+	return b
+}
+
+func withOZIPKeys(keys ...[]byte) func() {
+	old := OZIPKeys
+	OZIPKeys = keys
+	return func() { OZIPKeys = old }
+}
+
+func TestUnwrapOZIP(t *testing.T) {
+	defer withOZIPKeys([]byte("fedcba9876543210"), ozipTestKey)()
+
+	// A payload over several chunks, with a partial block at the end.
+	payload := append([]byte(newcMagic), make([]byte, 3*ozipChunk+7)...)
+	for i := range payload[len(newcMagic):] {
+		payload[len(newcMagic)+i] = byte(i * 7)
+	}
+	file := ozip(t, ozipTestKey, payload)
+	if !IsOZIP(bytes.NewReader(file)) {
+		t.Fatalf("IsOZIP() = false, want true")
+	}
+	if IsOZIP(bytes.NewReader(payload)) {
+		t.Errorf("IsOZIP(payload) = true, want false")
+	}
+
+	r, err := UnwrapOZIP(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("UnwrapOZIP() = %v", err)
+	}
+	if got, err := uio.ReadAll(r); err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("UnwrapOZIP() payload differs: %v", err)
+	}
+	// Reads that start or end inside an encrypted block.
+	for _, rg := range [][2]int{{3, 10}, {ozipChunk - 5, 30}, {ozipChunk + 8, 2}, {len(payload) - 4, 4}} {
+		p := make([]byte, rg[1])
+		n, err := r.ReadAt(p, int64(rg[0]))
+		if err != nil && err != io.EOF || !bytes.Equal(p[:n], payload[rg[0]:rg[0]+rg[1]]) {
+			t.Errorf("ReadAt(%d bytes at %d) = %x, %v, want %x", rg[1], rg[0], p[:n], err, payload[rg[0]:rg[0]+rg[1]])
+		}
+	}
+
+	if _, err := UnwrapOZIP(bytes.NewReader(payload)); err == nil {
+		t.Errorf("UnwrapOZIP(not OZIP) succeeded")
+	}
+	defer withOZIPKeys([]byte("fedcba9876543210"))()
+	if _, err := UnwrapOZIP(bytes.NewReader(file)); err == nil {
+		t.Errorf("UnwrapOZIP() with the wrong key succeeded")
+	}
+}
+
+func TestAutoDecompressReaderOZIP(t *testing.T) {
+	defer withOZIPKeys(ozipTestKey)()
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	w := Newc.Writer(zw)
+	if err := WriteRecords(w, []Record{StaticFile("init", "#!/bin/sh\n", 0755)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+
+	r, err := AutoDecompressReader(bytes.NewReader(ozip(t, ozipTestKey, gz.Bytes())))
+	if err != nil {
+		t.Fatalf("AutoDecompressReader() = %v", err)
+	}
+	recs, err := ReadAllRecords(Newc.Reader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Name != "init" {
+		t.Errorf("records = %v, want init", recs)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// chunk is the data of r from idx*size, or what there was of it.
+type chunk struct {
+	idx  int64
+	done chan struct{}
+	// data and err are set once done is closed. data is shorter than a
+	// chunk only at the end of r or on error, and err is io.EOF at the end.
+	data []byte
+	err  error
+}
+
+// failed returns whether c is done but could not be read, so that it should
+// be read again.
+func (c *chunk) failed() bool {
+	select {
+	case <-c.done:
+		return c.err != nil && c.err != io.EOF
+	default:
+		return false
+	}
+}
+
+// prefetchingReader is the io.ReaderAt of PrefetchingReader.
+type prefetchingReader struct {
+	r    io.ReaderAt
+	size int64
+
+	mu sync.Mutex
+	// chunks are the two buffers. Chunk idx goes in chunks[idx%2], so
+	// the one being read and the next are both kept.
+	chunks [2]*chunk
+}
+
+// PrefetchingReader returns an io.ReaderAt of r that reads r in chunks of
+// prefetchSize bytes and, while the caller goes through one chunk, reads
+// the next in the background. This speeds up reading an archive in order
+// from slow storage, where each read of r waits for the disk.
+//
+// Reads anywhere are correct, but only reads in order gain: reading
+// elsewhere throws away both chunks. Reads of a chunk that is still being
+// prefetched wait for it rather than reading r again.
+func PrefetchingReader(r io.ReaderAt, prefetchSize int64) io.ReaderAt {
+	if prefetchSize <= 0 {
+		prefetchSize = 1 << 20
+	}
+	return &prefetchingReader{r: r, size: prefetchSize}
+}
+
+// fetch returns chunk idx, starting to read it unless it is already there.
+// p.mu must be held.
+func (p *prefetchingReader) fetch(idx int64) *chunk {
+	slot := &p.chunks[idx%2]
+	if c := *slot; c != nil && c.idx == idx && !c.failed() {
+		return c
+	}
+	c := &chunk{idx: idx, done: make(chan struct{})}
+	*slot = c
+	go func() {
+		defer close(c.done)
+		b := make([]byte, p.size)
+		n, err := p.r.ReadAt(b, idx*p.size)
+		if n == len(b) {
+			err = nil
+		} else if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		c.data, c.err = b[:n], err
+	}()
+	return c
+}
+
+// ReadAt implements io.ReaderAt.
+func (p *prefetchingReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("cpio: negative offset")
+	}
+	var n int
+	for n < len(b) {
+		pos := off + int64(n)
+		idx := pos / p.size
+		p.mu.Lock()
+		c := p.fetch(idx)
+		p.fetch(idx + 1)
+		p.mu.Unlock()
+
+		<-c.done
+		start := pos - idx*p.size
+		if start < int64(len(c.data)) {
+			n += copy(b[n:], c.data[start:])
+		}
+		if int64(len(c.data)) < p.size && n < len(b) {
+			return n, c.err
+		}
+	}
+	return n, nil
+}
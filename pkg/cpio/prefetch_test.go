@@ -0,0 +1,191 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingReaderAt counts the reads of r at each offset.
+type countingReaderAt struct {
+	r io.ReaderAt
+
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (c *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.reads[off]++
+	c.mu.Unlock()
+	return c.r.ReadAt(b, off)
+}
+
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestPrefetchingReaderInOrder(t *testing.T) {
+	data := randomData(10000)
+	for _, size := range []int64{1, 64, 1000, 10000, 1 << 20} {
+		for _, bufSize := range []int{1, 7, 333, 4096, 20000} {
+			c := &countingReaderAt{r: bytes.NewReader(data), reads: make(map[int64]int)}
+			r := PrefetchingReader(c, size)
+			var got []byte
+			buf := make([]byte, bufSize)
+			for off := int64(0); ; {
+				n, err := r.ReadAt(buf, off)
+				got = append(got, buf[:n]...)
+				off += int64(n)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("chunk %d, buffer %d: ReadAt(%d) = %v", size, bufSize, off, err)
+				}
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("chunk %d, buffer %d: read %d bytes that differ from the %d written", size, bufSize, len(got), len(data))
+			}
+			// Reading in order reads each chunk once.
+			c.mu.Lock()
+			for off, n := range c.reads {
+				if n != 1 {
+					t.Errorf("chunk %d, buffer %d: read offset %d %d times, want once", size, bufSize, off, n)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func TestPrefetchingReaderRandom(t *testing.T) {
+	data := randomData(5000)
+	want := bytes.NewReader(data)
+	r := PrefetchingReader(bytes.NewReader(data), 512)
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, rnd.Intn(2000))
+		off := rnd.Int63n(int64(len(data)) + 100)
+		wb := make([]byte, len(b))
+		wn, werr := want.ReadAt(wb, off)
+		n, err := r.ReadAt(b, off)
+		if n != wn || (err == nil) != (werr == nil) || !bytes.Equal(b[:n], wb[:wn]) {
+			t.Fatalf("ReadAt(%d bytes, %d) = %d, %v, want %d, %v", len(b), off, n, err, wn, werr)
+		}
+	}
+	if _, err := r.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Errorf("ReadAt(-1) = nil, want error")
+	}
+}
+
+// flakyReaderAt fails its first read at off.
+type flakyReaderAt struct {
+	r   io.ReaderAt
+	off int64
+
+	mu     sync.Mutex
+	failed bool
+}
+
+var errFlaky = errors.New("disk hiccup")
+
+func (f *flakyReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off == f.off && !f.failed {
+		f.failed = true
+		return 0, errFlaky
+	}
+	return f.r.ReadAt(b, off)
+}
+
+func TestPrefetchingReaderError(t *testing.T) {
+	data := randomData(4 * 1024)
+	for _, off := range []int64{0, 1024} {
+		r := PrefetchingReader(&flakyReaderAt{r: bytes.NewReader(data), off: off}, 1024)
+		b := make([]byte, 10)
+		// A failed chunk is read again by the next read of it.
+		if _, err := r.ReadAt(b, off); err != errFlaky {
+			t.Errorf("first ReadAt(%d) = %v, want %v", off, err, errFlaky)
+		}
+		if _, err := r.ReadAt(b, off); err != nil || !bytes.Equal(b, data[off:off+10]) {
+			t.Errorf("second ReadAt(%d) = %q, %v, want %q", off, b, err, data[off:off+10])
+		}
+	}
+}
+
+func TestPrefetchingReaderArchive(t *testing.T) {
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	var want []Record
+	for i := 0; i < 100; i++ {
+		want = append(want, StaticFile(fmt.Sprintf("file%d", i), string(randomData(i*37)), 0644))
+	}
+	if err := WriteRecords(w, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadAllRecords(Newc.Reader(PrefetchingReader(bytes.NewReader(b.Bytes()), 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || !ReaderAtEqual(got[i], want[i]) {
+			t.Errorf("record %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// slowReaderAt takes latency for each read, like a disk seeking.
+type slowReaderAt struct {
+	r       io.ReaderAt
+	latency time.Duration
+}
+
+func (s slowReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	time.Sleep(s.latency)
+	return s.r.ReadAt(b, off)
+}
+
+// BenchmarkPrefetchingReader reads 1 MiB in 64 KiB reads, taking 1ms for
+// each read and to process each 64 KiB.
+func BenchmarkPrefetchingReader(b *testing.B) {
+	data := randomData(1 << 20)
+	const chunk = 64 << 10
+	for _, prefetch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prefetch=%v", prefetch), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var r io.ReaderAt = slowReaderAt{bytes.NewReader(data), time.Millisecond}
+				if prefetch {
+					r = PrefetchingReader(r, chunk)
+				}
+				buf := make([]byte, chunk)
+				for off := int64(0); off < int64(len(data)); off += chunk {
+					if _, err := r.ReadAt(buf, off); err != nil && err != io.EOF {
+						b.Fatal(err)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// tarName returns name as a path relative to the root of an archive, or ""
+// for the root itself, which neither format needs an entry for.
+func tarName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// TarToCPIO writes the files of the tar archive tr to w as a newc archive,
+// followed by a trailer. Permissions, ownership, modification times,
+// symlinks, devices and FIFOs are kept; the entry for the root directory
+// is dropped.
+//
+// Hard links become records sharing an inode number with their target, as
+// the kernel unpacks them: the first record, the target, has the contents
+// and the links none. As the link count of the target must be known before
+// it is written, the whole archive is read into memory first.
+func TarToCPIO(tr *tar.Reader, w io.Writer) error {
+	var recs []Record
+	// files are the indexes in recs of regular files, by name.
+	files := make(map[string]int)
+	for ino := uint64(1); ; ino++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := tarName(h.Name)
+		if name == "" || h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		info := Info{
+			Ino:    ino,
+			Mode:   uint64(h.Mode) & 07777,
+			UID:    uint64(h.Uid),
+			GID:    uint64(h.Gid),
+			NLink:  1,
+			MTime:  uint64(h.ModTime.Unix()),
+			Rmajor: uint64(h.Devmajor),
+			Rminor: uint64(h.Devminor),
+			Name:   name,
+		}
+		var content []byte
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			info.Mode |= unix.S_IFREG
+			if content, err = ioutil.ReadAll(tr); err != nil {
+				return fmt.Errorf("reading %s: %v", h.Name, err)
+			}
+			files[name] = len(recs)
+		case tar.TypeLink:
+			i, ok := files[tarName(h.Linkname)]
+			if !ok {
+				return fmt.Errorf("%s: hard link to %s, which is not a file before it", h.Name, h.Linkname)
+			}
+			target := &recs[i].Info
+			target.NLink++
+			info = *target
+			info.Name = name
+			info.FileSize = 0
+			recs = append(recs, Record{Info: info})
+			continue
+		case tar.TypeSymlink:
+			info.Mode |= unix.S_IFLNK
+			content = []byte(h.Linkname)
+		case tar.TypeDir:
+			info.Mode |= unix.S_IFDIR
+		case tar.TypeChar:
+			info.Mode |= unix.S_IFCHR
+		case tar.TypeBlock:
+			info.Mode |= unix.S_IFBLK
+		case tar.TypeFifo:
+			info.Mode |= unix.S_IFIFO
+		default:
+			return fmt.Errorf("%s: tar type %q has no cpio equivalent", h.Name, h.Typeflag)
+		}
+		recs = append(recs, StaticRecord(content, info))
+	}
+
+	// Links share the link count of their target.
+	nlink := make(map[uint64]uint64)
+	for _, r := range recs {
+		if r.Mode&unix.S_IFMT == unix.S_IFREG && r.NLink > nlink[r.Ino] {
+			nlink[r.Ino] = r.NLink
+		}
+	}
+	rw := Newc.Writer(w)
+	for _, r := range recs {
+		if n, ok := nlink[r.Ino]; ok {
+			r.NLink = n
+		}
+		if err := rw.WriteRecord(r); err != nil {
+			return fmt.Errorf("writing %s: %v", r.Name, err)
+		}
+	}
+	return WriteTrailer(rw)
+}
+
+// CPIOToTar writes the records of the newc archive r to tw. tw is not
+// closed. Permissions, ownership, modification times, symlinks, devices and
+// FIFOs are kept; a record for the root directory is dropped.
+//
+// Records with the same inode and device numbers and a link count above 1
+// are hard links. The first becomes a file with the contents, whichever
+// record carries them, and the others links to it. Sockets have no tar
+// equivalent and are an error.
+func CPIOToTar(r io.ReaderAt, tw *tar.Writer) error {
+	recs, err := ReadAllRecords(Newc.Reader(r))
+	if err != nil {
+		return err
+	}
+
+	type inode struct {
+		ino, major, minor uint64
+	}
+	key := func(r Record) (inode, bool) {
+		if r.Mode&unix.S_IFMT != unix.S_IFREG || r.NLink < 2 {
+			return inode{}, false
+		}
+		return inode{r.Ino, r.Major, r.Minor}, true
+	}
+	// contents are the records with the contents of each hard linked
+	// inode: the kernel takes them from the first record, GNU cpio puts
+	// them in the last.
+	contents := make(map[inode]Record)
+	for _, r := range recs {
+		if k, ok := key(r); ok {
+			if c, ok := contents[k]; !ok || c.FileSize == 0 {
+				contents[k] = r
+			}
+		}
+	}
+	// written is the name each hard linked inode was first written as.
+	written := make(map[inode]string)
+
+	for _, r := range recs {
+		name := tarName(r.Name)
+		if name == "" {
+			continue
+		}
+		h := &tar.Header{
+			Name:     name,
+			Mode:     int64(r.Mode & 07777),
+			Uid:      int(r.UID),
+			Gid:      int(r.GID),
+			ModTime:  time.Unix(int64(r.MTime), 0),
+			Devmajor: int64(r.Rmajor),
+			Devminor: int64(r.Rminor),
+		}
+		var content io.ReaderAt
+		switch r.Mode & unix.S_IFMT {
+		case unix.S_IFREG:
+			h.Typeflag = tar.TypeReg
+			content = r.ReaderAt
+			h.Size = int64(r.FileSize)
+			if k, ok := key(r); ok {
+				if target, ok := written[k]; ok {
+					h.Typeflag, h.Linkname, h.Size, content = tar.TypeLink, target, 0, nil
+				} else {
+					written[k] = name
+					c := contents[k]
+					content, h.Size = c.ReaderAt, int64(c.FileSize)
+				}
+			}
+		case unix.S_IFDIR:
+			h.Typeflag = tar.TypeDir
+			h.Name += "/"
+		case unix.S_IFLNK:
+			h.Typeflag = tar.TypeSymlink
+			target, err := uio.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("reading %s: %v", r.Name, err)
+			}
+			h.Linkname = string(target)
+		case unix.S_IFCHR:
+			h.Typeflag = tar.TypeChar
+		case unix.S_IFBLK:
+			h.Typeflag = tar.TypeBlock
+		case unix.S_IFIFO:
+			h.Typeflag = tar.TypeFifo
+		default:
+			return fmt.Errorf("%s: mode %#o has no tar equivalent", r.Name, r.Mode)
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return fmt.Errorf("writing %s: %v", r.Name, err)
+		}
+		if h.Size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(content, 0, h.Size)); err != nil {
+				return fmt.Errorf("writing %s: %v", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
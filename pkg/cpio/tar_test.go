@@ -0,0 +1,257 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tarEntry is a tar header and the contents of the file.
+type tarEntry struct {
+	h       tar.Header
+	content string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		h := e.h
+		h.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// readTar returns the entries of the tar archive b, with only the fields
+// both formats have.
+func readTar(t *testing.T, b []byte) []tarEntry {
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{tar.Header{
+			Typeflag: h.Typeflag,
+			Name:     h.Name,
+			Linkname: h.Linkname,
+			Mode:     h.Mode,
+			Uid:      h.Uid,
+			Gid:      h.Gid,
+			ModTime:  h.ModTime.UTC(),
+			Devmajor: h.Devmajor,
+			Devminor: h.Devminor,
+		}, string(c)})
+	}
+}
+
+var (
+	mtime1 = time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC)
+	mtime2 = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+)
+
+// tarEntries are the kinds of files both formats have.
+var tarEntries = []tarEntry{
+	{h: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0644, Uid: 1, Gid: 2, ModTime: mtime2}, content: "root:x:0:0::/:/bin/sh\n"},
+	{h: tar.Header{Typeflag: tar.TypeReg, Name: "etc/empty", Mode: 0600, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/link", Linkname: "passwd", Mode: 0777, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hard", Linkname: "etc/passwd", Mode: 0644, Uid: 1, Gid: 2, ModTime: mtime2}},
+	{h: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hard2", Linkname: "etc/passwd", Mode: 0644, Uid: 1, Gid: 2, ModTime: mtime2}},
+	{h: tar.Header{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0755, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0660, Gid: 6, Devmajor: 8, Devminor: 0, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeFifo, Name: "dev/initctl", Mode: 0600, ModTime: mtime1}},
+	{h: tar.Header{Typeflag: tar.TypeReg, Name: "bin/su", Mode: 04755, ModTime: mtime2}, content: "\x7fELF"},
+}
+
+func TestTarToCPIO(t *testing.T) {
+	// Just like tar does, start with the root and use ./ names.
+	in := []tarEntry{{h: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755, ModTime: mtime1}}}
+	for _, e := range tarEntries {
+		e.h.Name = "./" + e.h.Name
+		if e.h.Typeflag == tar.TypeLink {
+			e.h.Linkname = "./" + e.h.Linkname
+		}
+		in = append(in, e)
+	}
+
+	var c bytes.Buffer
+	if err := TarToCPIO(tar.NewReader(bytes.NewReader(makeTar(t, in))), &c); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := ReadAllRecords(Newc.Reader(bytes.NewReader(c.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]Record)
+	var names []string
+	for _, r := range recs {
+		names = append(names, r.Name)
+		byName[r.Name] = r
+	}
+	if want := []string{"etc", "etc/passwd", "etc/empty", "etc/link", "etc/hard", "etc/hard2", "dev", "dev/null", "dev/sda", "dev/initctl", "bin/su"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("records = %v, want %v", names, want)
+	}
+
+	passwd, hard := byName["etc/passwd"], byName["etc/hard"]
+	if passwd.Mode != unix.S_IFREG|0644 || passwd.UID != 1 || passwd.GID != 2 || passwd.MTime != uint64(mtime2.Unix()) {
+		t.Errorf("etc/passwd = %v, want a 0644 file of 1:2 modified at %v", passwd.Info, mtime2)
+	}
+	if passwd.Ino != hard.Ino || passwd.NLink != 3 || hard.NLink != 3 {
+		t.Errorf("etc/passwd = %v and etc/hard = %v, want one inode with 3 links", passwd.Info, hard.Info)
+	}
+	if passwd.FileSize == 0 || hard.FileSize != 0 {
+		t.Errorf("etc/passwd has %d and etc/hard %d bytes, want the contents in the first record only", passwd.FileSize, hard.FileSize)
+	}
+	if sda := byName["dev/sda"]; sda.Mode != unix.S_IFBLK|0660 || sda.Rmajor != 8 || sda.Rminor != 0 {
+		t.Errorf("dev/sda = %v, want block device 8:0", sda.Info)
+	}
+	if null := byName["dev/null"]; null.Mode != unix.S_IFCHR|0666 || null.Rmajor != 1 || null.Rminor != 3 {
+		t.Errorf("dev/null = %v, want character device 1:3", null.Info)
+	}
+	if fifo := byName["dev/initctl"]; fifo.Mode != unix.S_IFIFO|0600 {
+		t.Errorf("dev/initctl = %v, want a FIFO", fifo.Info)
+	}
+	if su := byName["bin/su"]; su.Mode != unix.S_IFREG|04755 {
+		t.Errorf("bin/su mode = %#o, want setuid", su.Mode)
+	}
+	if link := byName["etc/link"]; link.Mode != unix.S_IFLNK|0777 || recordContent(t, link) != "passwd" {
+		t.Errorf("etc/link = %v, want a symlink to passwd", link.Info)
+	}
+	inos := make(map[uint64]bool)
+	for _, r := range recs {
+		if r.Name != "etc/hard" && r.Name != "etc/hard2" && inos[r.Ino] {
+			t.Errorf("%s shares inode %d with another file", r.Name, r.Ino)
+		}
+		inos[r.Ino] = true
+	}
+}
+
+// recordContent returns the contents of r.
+func recordContent(t *testing.T, r Record) string {
+	t.Helper()
+	b, err := ioutil.ReadAll(io.NewSectionReader(r, 0, int64(r.FileSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	var c bytes.Buffer
+	if err := TarToCPIO(tar.NewReader(bytes.NewReader(makeTar(t, tarEntries))), &c); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	if err := CPIOToTar(bytes.NewReader(c.Bytes()), tw); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := readTar(t, makeTar(t, tarEntries))
+	got := readTar(t, out.Bytes())
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCPIOToTarHardLinks(t *testing.T) {
+	// GNU cpio puts the contents of hard links in the last record.
+	link := Info{Ino: 7, Mode: unix.S_IFREG | 0644, NLink: 2, MTime: uint64(mtime1.Unix())}
+	first, last := link, link
+	first.Name, last.Name = "a", "b"
+	var c bytes.Buffer
+	w := Newc.Writer(&c)
+	if err := WriteRecords(w, []Record{
+		Directory(".", 0755),
+		StaticRecord(nil, first),
+		StaticRecord([]byte("contents"), last),
+		StaticFile("c", "other inode", 0644),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	if err := CPIOToTar(bytes.NewReader(c.Bytes()), tw); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	got := readTar(t, out.Bytes())
+	if len(got) != 3 {
+		t.Fatalf("got %d entries, want a, b and c: %+v", len(got), got)
+	}
+	if got[0].h.Name != "a" || got[0].h.Typeflag != tar.TypeReg || got[0].content != "contents" {
+		t.Errorf("entry 0 = %+v, want file a with the contents of b", got[0])
+	}
+	if got[1].h.Name != "b" || got[1].h.Typeflag != tar.TypeLink || got[1].h.Linkname != "a" {
+		t.Errorf("entry 1 = %+v, want b linked to a", got[1])
+	}
+	if got[2].h.Name != "c" || got[2].content != "other inode" {
+		t.Errorf("entry 2 = %+v, want file c", got[2])
+	}
+}
+
+func TestTarConversionErrors(t *testing.T) {
+	for _, e := range [][]tarEntry{
+		{{h: tar.Header{Typeflag: tar.TypeLink, Name: "hard", Linkname: "missing"}}},
+		{{h: tar.Header{Typeflag: tar.TypeDir, Name: "dir/"}}, {h: tar.Header{Typeflag: tar.TypeLink, Name: "hard", Linkname: "dir"}}},
+		{{h: tar.Header{Typeflag: tar.TypeCont, Name: "contiguous"}}},
+	} {
+		if err := TarToCPIO(tar.NewReader(bytes.NewReader(makeTar(t, e))), ioutil.Discard); err == nil {
+			t.Errorf("TarToCPIO(%+v) = nil, want error", e)
+		}
+	}
+	if err := TarToCPIO(tar.NewReader(bytes.NewReader([]byte("not a tar archive"))), ioutil.Discard); err == nil {
+		t.Errorf("TarToCPIO(garbage) = nil, want error")
+	}
+
+	var c bytes.Buffer
+	w := Newc.Writer(&c)
+	if err := WriteRecords(w, []Record{StaticRecord(nil, Info{Name: "socket", Mode: unix.S_IFSOCK | 0777})}); err != nil {
+		t.Fatal(err)
+	}
+	WriteTrailer(w)
+	if err := CPIOToTar(bytes.NewReader(c.Bytes()), tar.NewWriter(ioutil.Discard)); err == nil {
+		t.Errorf("CPIOToTar() of a socket = nil, want error")
+	}
+}
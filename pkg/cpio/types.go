@@ -25,6 +25,10 @@ type Record struct {
 	// Info is metadata describing the CPIO record.
 	Info
 
+	// XAttrs are the extended attributes of the file, such as SELinux
+	// labels or capabilities, by name.
+	XAttrs map[string][]byte
+
 	// metadata about this item's place in the file
 	RecPos  int64  // Where in the file this record is
 	RecLen  uint64 // How big the record is.
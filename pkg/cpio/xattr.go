@@ -0,0 +1,205 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The newc format has no room for extended attributes. Like GNU tar in
+// pax archives, the writers put them in a header record written right
+// before the record they belong to, named xattrHeaderPrefix followed by
+// that record's name. Its content is pax records
+//
+//	<length> SCHILY.xattr.<name>=<value>\n
+//
+// where length counts the whole line. Readers attach the attributes to the
+// next record and do not return the header. Readers that do not know about
+// it, like Linux's initramfs unpacker, see a regular file below PaxHeaders/.
+const (
+	xattrHeaderPrefix = "PaxHeaders/"
+	xattrKeyPrefix    = "SCHILY.xattr."
+
+	// maxXAttrHeaderSize bounds the size of the header records read. Linux
+	// allows no more than 64 KiB of attributes per file in the first
+	// place.
+	maxXAttrHeaderSize = 1 << 20
+)
+
+// xattrHeader returns the header record for the XAttrs of rec.
+func xattrHeader(rec Record) Record {
+	keys := make([]string, 0, len(rec.XAttrs))
+	for k := range rec.XAttrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		// The length includes its own digits: add them, and one more
+		// if adding them made it a digit longer.
+		line := " " + xattrKeyPrefix + k + "=" + string(rec.XAttrs[k]) + "\n"
+		n := len(line) + len(strconv.Itoa(len(line)))
+		if len(strconv.Itoa(n)) > len(strconv.Itoa(len(line))) {
+			n++
+		}
+		fmt.Fprintf(&b, "%d%s", n, line)
+	}
+	return StaticRecord(b.Bytes(), Info{
+		Name:  xattrHeaderPrefix + rec.Name,
+		Mode:  modeFile | 0644,
+		MTime: rec.MTime,
+	})
+}
+
+// xattrHeaderFor returns the name of the record whose attributes the record
+// called name holds, if it is a header record.
+func xattrHeaderFor(name string) (string, bool) {
+	if !strings.HasPrefix(name, xattrHeaderPrefix) || len(name) == len(xattrHeaderPrefix) {
+		return "", false
+	}
+	return name[len(xattrHeaderPrefix):], true
+}
+
+// readXAttrHeader decodes the header record of size bytes read from r.
+func readXAttrHeader(r io.Reader, size uint64) (map[string][]byte, error) {
+	if size > maxXAttrHeaderSize {
+		return nil, fmt.Errorf("xattr header of %d bytes is more than the maximum of %d", size, maxXAttrHeaderSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for len(b) > 0 {
+		sp := bytes.IndexByte(b, ' ')
+		if sp <= 0 {
+			return nil, fmt.Errorf("xattr header: record has no length")
+		}
+		n, err := strconv.Atoi(string(b[:sp]))
+		if err != nil || n <= sp+1 || n > len(b) || b[n-1] != '\n' {
+			return nil, fmt.Errorf("xattr header: bad record length %q", b[:sp])
+		}
+		kv := string(b[sp+1 : n-1])
+		b = b[n:]
+
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("xattr header: record %q has no value", kv)
+		}
+		// Other pax keywords say nothing about xattrs. Skip them.
+		if k := kv[:eq]; strings.HasPrefix(k, xattrKeyPrefix) && len(k) > len(xattrKeyPrefix) {
+			xattrs[k[len(xattrKeyPrefix):]] = []byte(kv[eq+1:])
+		}
+	}
+	return xattrs, nil
+}
+
+// isXAttrUnsupported returns whether err means that there are no extended
+// attributes: the file system does not support them, or the kernel was
+// built without CONFIG_XATTR.
+func isXAttrUnsupported(err error) bool {
+	return err == unix.ENOTSUP || err == unix.EOPNOTSUPP || err == unix.ENOSYS
+}
+
+// listXAttrs returns the names of the extended attributes of path, not
+// following symlinks.
+func listXAttrs(path string) ([]string, error) {
+	for {
+		n, err := unix.Llistxattr(path, nil)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		b := make([]byte, n)
+		n, err = unix.Llistxattr(path, b)
+		// Attributes were added since the size was asked for.
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(b[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXAttr returns the value of the extended attribute name of path.
+func getXAttr(path, name string) ([]byte, error) {
+	for {
+		n, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return []byte{}, nil
+		}
+		b := make([]byte, n)
+		n, err = unix.Lgetxattr(path, name, b)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+
+// readXAttrs returns the extended attributes of path, or none if its file
+// system does not support them.
+func readXAttrs(path string) (map[string][]byte, error) {
+	names, err := listXAttrs(path)
+	if isXAttrUnsupported(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing xattrs of %q: %v", path, err)
+	}
+	var xattrs map[string][]byte
+	for _, name := range names {
+		v, err := getXAttr(path, name)
+		// The attribute was removed since it was listed.
+		if err == errNoXAttr {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading xattr %q of %q: %v", name, path, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = v
+	}
+	return xattrs, nil
+}
+
+// writeXAttrs sets the extended attributes of path, not following
+// symlinks. It sets none if the file system does not support them.
+func writeXAttrs(path string, xattrs map[string][]byte) error {
+	for name, v := range xattrs {
+		err := unix.Lsetxattr(path, name, v, 0)
+		if isXAttrUnsupported(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("setting xattr %q of %q: %v", name, path, err)
+		}
+	}
+	return nil
+}
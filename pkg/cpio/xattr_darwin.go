@@ -0,0 +1,12 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// errNoXAttr is the error getxattr(2) returns for missing attributes.
+const errNoXAttr = unix.ENOATTR
@@ -0,0 +1,225 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+func TestXAttrHeader(t *testing.T) {
+	// Values of every length up to 1000 cross the line lengths where
+	// counting the length's digits adds a digit.
+	xattrs := map[string][]byte{
+		"security.capability": {1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0},
+		"security.selinux":    []byte("system_u:object_r:bin_t:s0\x00"),
+		"user.empty":          {},
+		"user.tricky":         []byte("a=b\n12 c=d\n"),
+	}
+	for n := 0; n < 1000; n++ {
+		xattrs["user.v"+strings.Repeat("x", n%7)+string(rune('a'+n%26))+strings.Repeat("0", n/26)] = bytes.Repeat([]byte{'v'}, n)
+	}
+	rec := xattrHeader(Record{Info: Info{Name: "bin/ping"}, XAttrs: xattrs})
+	if rec.Name != "PaxHeaders/bin/ping" {
+		t.Errorf("header name = %q, want PaxHeaders/bin/ping", rec.Name)
+	}
+	got, err := readXAttrHeader(uio.Reader(rec), rec.FileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, xattrs) {
+		t.Errorf("readXAttrHeader(xattrHeader(%d xattrs)) = %d different xattrs", len(xattrs), len(got))
+	}
+
+	// Other pax keywords are skipped.
+	if got, err := readXAttrHeader(strings.NewReader("12 path=abc\n"), 12); err != nil || len(got) != 0 {
+		t.Errorf("readXAttrHeader(path) = %v, %v, want no xattrs", got, err)
+	}
+	for _, bad := range []string{
+		"12 SCHILY.xattr.user.a=b",
+		"x SCHILY.xattr.user.a=b\n",
+		" SCHILY.xattr.user.a=b\n",
+		"99 SCHILY.xattr.user.a=b\n",
+		"25 SCHILY.xattr.user.a=b\n\n",
+		"20 SCHILY.xattr.user\n",
+		"2 ",
+	} {
+		if got, err := readXAttrHeader(strings.NewReader(bad), uint64(len(bad))); err == nil {
+			t.Errorf("readXAttrHeader(%q) = %v, want error", bad, got)
+		}
+	}
+	if _, err := readXAttrHeader(strings.NewReader(""), maxXAttrHeaderSize+1); err == nil {
+		t.Errorf("readXAttrHeader() of a huge header succeeded")
+	}
+}
+
+func TestXAttrArchive(t *testing.T) {
+	recs := []Record{
+		Directory("bin", 0755),
+		StaticFile("bin/ping", "ELF", 0755),
+		Symlink("bin/sh", "busybox"),
+		StaticFile("etc/passwd", "root:x:0:0::/:/bin/sh\n", 0644),
+	}
+	recs[1].XAttrs = map[string][]byte{"security.capability": {1, 2, 3}, "user.comment": []byte("pong")}
+	recs[2].XAttrs = map[string][]byte{"trusted.overlay.opaque": []byte("y")}
+
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	if err := WriteRecords(w, recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	got, err := ReadAllRecords(Newc.Reader(bytes.NewReader(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(recs) {
+		t.Fatalf("read %d records, want %d", len(got), len(recs))
+	}
+	var streamed []Record
+	if err := StreamRecords(bytes.NewReader(archive), func(rec Record, content io.Reader) error {
+		streamed = append(streamed, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(streamed) != len(recs) {
+		t.Fatalf("streamed %d records, want %d", len(streamed), len(recs))
+	}
+	for i, want := range recs {
+		for _, rec := range []Record{got[i], streamed[i]} {
+			if rec.Name != want.Name || !reflect.DeepEqual(rec.XAttrs, want.XAttrs) {
+				t.Errorf("record %d = %s with xattrs %v, want %s with %v", i, rec.Name, rec.XAttrs, want.Name, want.XAttrs)
+			}
+		}
+		if got[i].RecPos != streamed[i].RecPos || got[i].FilePos != streamed[i].FilePos {
+			t.Errorf("record %d is at %d, %d, streamed at %d, %d", i, got[i].RecPos, got[i].FilePos, streamed[i].RecPos, streamed[i].FilePos)
+		}
+	}
+	if content, err := uio.ReadAll(got[1]); err != nil || string(content) != "ELF" {
+		t.Errorf("content of %s = %q, %v, want ELF", got[1].Name, content, err)
+	}
+}
+
+func TestXAttrArchiveBad(t *testing.T) {
+	header := xattrHeader(Record{Info: Info{Name: "bin/ping"}, XAttrs: map[string][]byte{"user.a": []byte("b")}})
+	for _, tt := range []struct {
+		name string
+		recs []Record
+	}{
+		{"other record next", []Record{header, StaticFile("bin/sh", "", 0755)}},
+		{"header next", []Record{header, header}},
+		{"trailer next", []Record{header}},
+		{"bad header", []Record{StaticFile("PaxHeaders/bin/ping", "5 a=b", 0644), StaticFile("bin/ping", "", 0755)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			w := Newc.Writer(&b)
+			if err := WriteRecords(w, tt.recs); err != nil {
+				t.Fatal(err)
+			}
+			withoutTrailer := b.Len()
+			if err := WriteTrailer(w); err != nil {
+				t.Fatal(err)
+			}
+			for _, archive := range [][]byte{b.Bytes(), b.Bytes()[:withoutTrailer]} {
+				if recs, err := ReadAllRecords(Newc.Reader(bytes.NewReader(archive))); err == nil {
+					t.Errorf("ReadAllRecords() = %v, want error", recs)
+				}
+				if err := StreamRecords(bytes.NewReader(archive), func(Record, io.Reader) error { return nil }); err == nil {
+					t.Errorf("StreamRecords() succeeded")
+				}
+			}
+		})
+	}
+}
+
+func TestXAttrFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio-xattr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	labeled, plain := filepath.Join(src, "labeled"), filepath.Join(src, "plain")
+	for _, f := range []string{labeled, plain} {
+		if err := ioutil.WriteFile(f, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string][]byte{"user.u-root.label": []byte("boot"), "user.u-root.empty": {}}
+	for name, v := range want {
+		if err := unix.Setxattr(labeled, name, v, 0); err != nil {
+			t.Skipf("setting xattrs in %s: %v", dir, err)
+		}
+	}
+
+	// GetRecord takes files whose inode it saw before, in files since
+	// deleted, for hard links without content or xattrs.
+	inodeMap = map[devInode]Info{}
+	if rec, err := GetRecord(labeled); err != nil || len(rec.XAttrs) != 0 {
+		t.Errorf("GetRecord(%s) = %q, %v, want no xattrs", labeled, rec.XAttrs, err)
+	}
+	inodeMap = map[devInode]Info{}
+
+	var b bytes.Buffer
+	w := Newc.Writer(&b)
+	for _, f := range []string{labeled, plain} {
+		rec, err := GetRecordWithXAttrs(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Other attributes, like SELinux labels, may come with the
+		// file system.
+		for name, v := range want {
+			got, ok := rec.XAttrs[name]
+			if f == plain && ok {
+				t.Errorf("GetRecordWithXAttrs(%s) xattr %s = %q, want none", f, name, got)
+			}
+			if f == labeled && (!ok || !bytes.Equal(got, v)) {
+				t.Errorf("GetRecordWithXAttrs(%s) xattr %s = %q, want %q", f, name, got, v)
+			}
+		}
+		rec.Name = filepath.Base(f)
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Extract(&b, dst, ExtractionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readXAttrs(filepath.Join(dst, "labeled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range want {
+		if g, ok := got[name]; !ok || !bytes.Equal(g, v) {
+			t.Errorf("extracted xattr %s = %q, want %q", name, got[name], v)
+		}
+	}
+	if got, err := readXAttrs(filepath.Join(dst, "plain")); err != nil || len(got["user.u-root.label"]) != 0 {
+		t.Errorf("extracted xattrs of plain = %q, %v, want no user.u-root.label", got, err)
+	}
+}
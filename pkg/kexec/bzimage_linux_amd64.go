@@ -0,0 +1,349 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/bzimage"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Offsets in struct boot_params, see Documentation/x86/zero-page.txt.
+const (
+	bpExtRamdiskImage = 0x0c0
+	bpExtRamdiskSize  = 0x0c4
+	bpExtCmdlinePtr   = 0x0c8
+	bpE820Entries     = 0x1e8
+	bpSetupHeader     = 0x1f1
+	bpJump            = 0x200
+	bpTypeOfLoader    = 0x210
+	bpRamdiskImage    = 0x218
+	bpRamdiskSize     = 0x21c
+	bpCmdlinePtr      = 0x228
+	bpE820Table       = 0x2d0
+
+	bootParamsSize = 0x1000
+	maxE820Entries = 128
+	e820EntrySize  = 20
+)
+
+// xlfKernel64 is the XLoadFlags bit of kernels with a 64-bit entry point at
+// 0x200 past their load address.
+const xlfKernel64 = 0x1
+
+// Where loadBzImage puts what the kernel needs besides itself, in the low
+// memory every x86 machine has.
+const (
+	trampolineAddr = 0x10000
+	bootParamsAddr = 0x11000
+	cmdlineAddr    = 0x12000
+
+	// defaultKernelAddr is where kernels go that do not say where they
+	// prefer to be.
+	defaultKernelAddr = 0x1000000
+)
+
+// e820 memory types.
+const (
+	e820RAM      = 1
+	e820Reserved = 2
+)
+
+var e820Types = map[string]uint32{
+	"System RAM":                e820RAM,
+	"Reserved":                  e820Reserved,
+	"ACPI Tables":               3,
+	"ACPI Non-volatile Storage": 4,
+	"Unusable memory":           5,
+	"Persistent Memory":         7,
+}
+
+var (
+	// memmapDir is where the firmware memory map is in sysfs.
+	memmapDir = "/sys/firmware/memmap"
+
+	// load is Load, replaced in tests.
+	load = Load
+)
+
+// memoryRange is an entry of the firmware memory map.
+type memoryRange struct {
+	Range
+	typ uint32
+}
+
+// memoryMap reads the firmware memory map from dir.
+func memoryMap(dir string) ([]memoryRange, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	read := func(entry, name string) (string, error) {
+		b, err := ioutil.ReadFile(filepath.Join(dir, entry, name))
+		return strings.TrimSpace(string(b)), err
+	}
+	var mem []memoryRange
+	for _, e := range entries {
+		var v [3]string
+		for i, name := range []string{"start", "end", "type"} {
+			if v[i], err = read(e.Name(), name); err != nil {
+				return nil, err
+			}
+		}
+		start, err := strconv.ParseUint(v[0], 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseUint(v[1], 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		typ, ok := e820Types[v[2]]
+		if !ok {
+			typ = e820Reserved
+		}
+		// The end is inclusive.
+		mem = append(mem, memoryRange{Range{Start: uintptr(start), Size: uint(end - start + 1)}, typ})
+	}
+	sort.Slice(mem, func(i, j int) bool { return mem[i].Start < mem[j].Start })
+	return mem, nil
+}
+
+// MemoryMapEntry is an entry of the firmware memory map. Type is its e820
+// type, which multiboot uses too.
+type MemoryMapEntry struct {
+	Range
+	Type uint32
+}
+
+// FirmwareMemoryMap returns the firmware memory map, sorted by address, for
+// callers laying out segments for Load themselves.
+func FirmwareMemoryMap() ([]MemoryMapEntry, error) {
+	mem, err := memoryMap(memmapDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]MemoryMapEntry, 0, len(mem))
+	for _, m := range mem {
+		entries = append(entries, MemoryMapEntry{m.Range, m.typ})
+	}
+	return entries, nil
+}
+
+// inRAM returns whether r is all in one RAM range of mem.
+func inRAM(mem []memoryRange, r Range) bool {
+	for _, m := range mem {
+		if m.typ == e820RAM && m.Start <= r.Start && r.End() <= m.End() {
+			return true
+		}
+	}
+	return false
+}
+
+// placeInitrd returns the highest page aligned address of RAM in mem that
+// fits size bytes at or above min and below max.
+func placeInitrd(mem []memoryRange, size uint, min, max uintptr) (uintptr, bool) {
+	pageSize := uintptr(os.Getpagesize())
+	for i := len(mem) - 1; i >= 0; i-- {
+		m := mem[i]
+		top := m.End()
+		if top > max {
+			top = max
+		}
+		top &^= pageSize - 1
+		if m.typ != e820RAM || top < uintptr(size) {
+			continue
+		}
+		addr := (top - uintptr(size)) &^ (pageSize - 1)
+		if addr >= m.Start && addr >= min {
+			return addr, true
+		}
+	}
+	return 0, false
+}
+
+// trampoline returns code starting the 64-bit entry point of a kernel at
+// entry with its boot_params at bootParams, as the boot protocol asks:
+//
+//	mov $bootParams, %rsi
+//	mov $entry, %rax
+//	jmp *%rax
+func trampoline(bootParams, entry uintptr) []byte {
+	b := []byte{
+		0x48, 0xbe, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x48, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0,
+		0xff, 0xe0,
+	}
+	binary.LittleEndian.PutUint64(b[2:], uint64(bootParams))
+	binary.LittleEndian.PutUint64(b[12:], uint64(entry))
+	return b
+}
+
+// bzImageSegments lays out kernel, a bzImage, with initrd and cmdline in mem
+// for the 64-bit boot protocol of Documentation/x86/boot.txt, and returns the
+// segments and their entry point. The kernel goes at kernelAt and the initrd
+// at initrdAt, or where the kernel prefers if they are 0.
+func bzImageSegments(kernel, initrd []byte, cmdline string, mem []memoryRange, kernelAt, initrdAt uintptr) (uintptr, []Segment, error) {
+	var h bzimage.LinuxHeader
+	if len(kernel) < binary.Size(h) {
+		return 0, nil, fmt.Errorf("%d byte kernel is too short to be a bzImage", len(kernel))
+	}
+	if err := binary.Read(bytes.NewReader(kernel), binary.LittleEndian, &h); err != nil {
+		return 0, nil, err
+	}
+	if h.HeaderMagic != bzimage.HeaderMagic {
+		return 0, nil, fmt.Errorf("kernel is not a bzImage: magic is %q, want %q", h.HeaderMagic, bzimage.HeaderMagic)
+	}
+	if h.Protocolversion < 0x20c || h.XLoadFlags&xlfKernel64 == 0 {
+		return 0, nil, fmt.Errorf("bzImage with boot protocol %#x has no 64-bit entry point", h.Protocolversion)
+	}
+	if h.CmdLineSize != 0 && uint32(len(cmdline)) > h.CmdLineSize {
+		return 0, nil, fmt.Errorf("command line is %d bytes, kernel takes %d", len(cmdline), h.CmdLineSize)
+	}
+
+	// The real-mode setup code, which we skip, comes first.
+	setupSects := int(h.SetupSects)
+	if setupSects == 0 {
+		setupSects = 4
+	}
+	setupSize := (setupSects + 1) * 512
+	hdrEnd := bpJump + 2 + int(kernel[bpJump+1])
+	if len(kernel) <= setupSize || hdrEnd > setupSize || hdrEnd > bootParamsSize {
+		return 0, nil, fmt.Errorf("bzImage has %d setup sectors and a %d byte header, but is %d bytes", setupSects, hdrEnd-bpSetupHeader, len(kernel))
+	}
+	code := kernel[setupSize:]
+
+	kernelAddr := uintptr(h.PrefAddress)
+	if kernelAddr == 0 {
+		kernelAddr = defaultKernelAddr
+	}
+	if kernelAt != 0 && kernelAt != kernelAddr {
+		if h.RelocatableKernel == 0 {
+			return 0, nil, fmt.Errorf("bzImage is not relocatable and must be at %#x, not %#x", kernelAddr, kernelAt)
+		}
+		if h.Kernelalignment != 0 && kernelAt%uintptr(h.Kernelalignment) != 0 {
+			return 0, nil, fmt.Errorf("kernel address %#x is not aligned to %#x", kernelAt, h.Kernelalignment)
+		}
+		kernelAddr = kernelAt
+	}
+	kernelSize := uint(len(code))
+	if uint(h.InitSize) > kernelSize {
+		kernelSize = uint(h.InitSize)
+	}
+
+	params := make([]byte, bootParamsSize)
+	copy(params[bpSetupHeader:hdrEnd], kernel[bpSetupHeader:hdrEnd])
+	params[bpTypeOfLoader] = 0xff
+	binary.LittleEndian.PutUint32(params[bpCmdlinePtr:], cmdlineAddr)
+	binary.LittleEndian.PutUint32(params[bpExtCmdlinePtr:], 0)
+
+	var e820 int
+	for _, m := range mem {
+		if e820 == maxE820Entries {
+			break
+		}
+		e := params[bpE820Table+e820*e820EntrySize:]
+		binary.LittleEndian.PutUint64(e, uint64(m.Start))
+		binary.LittleEndian.PutUint64(e[8:], uint64(m.Size))
+		binary.LittleEndian.PutUint32(e[16:], m.typ)
+		e820++
+	}
+	params[bpE820Entries] = uint8(e820)
+
+	c := append([]byte(cmdline), 0)
+	segs := []Segment{
+		{Buf: trampoline(bootParamsAddr, kernelAddr+bpJump), Phys: Range{Start: trampolineAddr, Size: uint(os.Getpagesize())}, Name: "purgatory"},
+		{Buf: params, Phys: Range{Start: bootParamsAddr, Size: bootParamsSize}, Name: "boot params"},
+		{Buf: c, Phys: Range{Start: cmdlineAddr, Size: uint(len(c))}, Name: "cmdline"},
+		{Buf: code, Phys: Range{Start: kernelAddr, Size: kernelSize}, Name: "kernel"},
+	}
+	if len(initrd) > 0 {
+		max := ^uintptr(0)
+		if h.InitrdAddrMax != 0 {
+			max = uintptr(h.InitrdAddrMax) + 1
+		}
+		addr := initrdAt
+		if addr == 0 {
+			var ok bool
+			if addr, ok = placeInitrd(mem, uint(len(initrd)), segs[3].Phys.End(), max); !ok {
+				return 0, nil, fmt.Errorf("no room for %d byte initrd below %#x", len(initrd), max)
+			}
+		} else if addr%uintptr(os.Getpagesize()) != 0 || addr+uintptr(len(initrd)) > max {
+			return 0, nil, fmt.Errorf("initrd address %#x is not page aligned or the initrd ends above %#x", addr, max)
+		}
+		binary.LittleEndian.PutUint32(params[bpRamdiskImage:], uint32(addr))
+		binary.LittleEndian.PutUint32(params[bpExtRamdiskImage:], uint32(uint64(addr)>>32))
+		binary.LittleEndian.PutUint32(params[bpRamdiskSize:], uint32(len(initrd)))
+		binary.LittleEndian.PutUint32(params[bpExtRamdiskSize:], uint32(uint64(len(initrd))>>32))
+		segs = append(segs, Segment{Buf: initrd, Phys: Range{Start: addr, Size: uint(len(initrd))}, Name: "initrd"})
+	}
+
+	for i, s := range segs {
+		if !inRAM(mem, s.Phys) {
+			return 0, nil, fmt.Errorf("segment %v is not in RAM", s)
+		}
+		for _, o := range segs[:i] {
+			if s.Phys.Overlaps(o.Phys) {
+				return 0, nil, fmt.Errorf("segment %v overlaps %v", s, o)
+			}
+		}
+	}
+	return trampolineAddr, segs, nil
+}
+
+// bzImageLayout lays out kernel, a bzImage, with ramfs and cmdline in the
+// RAM of the firmware memory map, as bzImageSegments does.
+func bzImageLayout(kernel, ramfs *os.File, cmdline string, kernelAt, initrdAt uintptr) (uintptr, []Segment, error) {
+	k, err := uio.ReadAll(kernel)
+	if err != nil {
+		return 0, nil, err
+	}
+	var initrd []byte
+	if ramfs != nil {
+		if initrd, err = uio.ReadAll(ramfs); err != nil {
+			return 0, nil, err
+		}
+	}
+	mem, err := memoryMap(memmapDir)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading memory map: %v", err)
+	}
+	return bzImageSegments(k, initrd, cmdline, mem, kernelAt, initrdAt)
+}
+
+// InspectSegments returns the segments kexec_load(2) would be given to boot
+// kernel, a bzImage, with initrd and cmdline, without loading anything. The
+// first segment holds the entry point. initrd may be nil.
+func InspectSegments(kernel, initrd *os.File, cmdline string) ([]Segment, error) {
+	_, segs, err := bzImageLayout(kernel, initrd, cmdline, 0, 0)
+	return segs, err
+}
+
+// loadBzImage loads kernel, a bzImage, with ramfs and cmdline using
+// kexec_load(2).
+func loadBzImage(kernel, ramfs *os.File, cmdline string) error {
+	return LoadBzImageAt(kernel, ramfs, cmdline, 0, 0)
+}
+
+// LoadBzImageAt loads kernel, a bzImage, with ramfs and cmdline using
+// kexec_load(2), with the kernel at physical address kernelAddr and ramfs at
+// initrdAddr. Either may be 0 to leave it where FileLoad would put it. Only
+// relocatable kernels go elsewhere than their preferred address.
+func LoadBzImageAt(kernel, ramfs *os.File, cmdline string, kernelAddr, initrdAddr uintptr) error {
+	entry, segs, err := bzImageLayout(kernel, ramfs, cmdline, kernelAddr, initrdAddr)
+	if err != nil {
+		return err
+	}
+	return load(entry, segs, 0)
+}
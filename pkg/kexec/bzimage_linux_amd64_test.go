@@ -0,0 +1,363 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/bzimage"
+	"golang.org/x/sys/unix"
+)
+
+// fakeBzImage returns a bzImage with one setup sector and code as its
+// protected-mode code.
+func fakeBzImage(t *testing.T, version uint16, code string) []byte {
+	h := bzimage.LinuxHeader{
+		SetupSects:        1,
+		Bootsectormagic:   0xaa55,
+		Jump:              0x66eb,
+		HeaderMagic:       bzimage.HeaderMagic,
+		Protocolversion:   version,
+		InitrdAddrMax:     0x7fffffff,
+		Kernelalignment:   0x200000,
+		RelocatableKernel: 1,
+		XLoadFlags:        xlfKernel64,
+		CmdLineSize:       2047,
+		PrefAddress:       0x1000000,
+		InitSize:          0x400000,
+	}
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, h); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(make([]byte, 1024-b.Len()))
+	b.WriteString(code)
+	return b.Bytes()
+}
+
+// fakeMemmap writes a firmware memory map to a temporary directory.
+func fakeMemmap(t *testing.T, ranges ...string) func() {
+	dir, err := ioutil.TempDir("", "memmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range ranges {
+		f := strings.SplitN(r, " ", 3)
+		for j, name := range []string{"start", "end", "type"} {
+			p := filepath.Join(dir, fmt.Sprint(i), name)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(f[j]+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := memmapDir
+	memmapDir = dir
+	return func() {
+		memmapDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+func tempFile(t *testing.T, b []byte) *os.File {
+	f, err := ioutil.TempFile("", "kexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// mockKexec makes kexec_file_load(2) fail with errno and records what is
+// passed to kexec_load(2) instead.
+func mockKexec(errno syscall.Errno) (*uintptr, *[]Segment, func()) {
+	oldFileLoad, oldLoad := fileLoad, load
+	fileLoad = func(kernelfd, ramfsfd uintptr, cmdPtr *byte, cmdLen, flags uintptr) syscall.Errno {
+		return errno
+	}
+	entry := new(uintptr)
+	segs := new([]Segment)
+	load = func(e uintptr, s []Segment, flags uint64) error {
+		*entry, *segs = e, s
+		return nil
+	}
+	return entry, segs, func() { fileLoad, load = oldFileLoad, oldLoad }
+}
+
+func TestFileLoadFallback(t *testing.T) {
+	defer fakeMemmap(t,
+		"0x0 0x9fbff System RAM",
+		"0x9fc00 0x9ffff Reserved",
+		"0x100000 0x7ffdffff System RAM",
+		"0x7ffe0000 0x7fffffff Reserved",
+		"0x100000000 0x13fffffff System RAM",
+	)()
+	entry, segs, done := mockKexec(unix.ENOSYS)
+	defer done()
+
+	kernel := tempFile(t, fakeBzImage(t, 0x20d, "protected mode code"))
+	defer kernel.Close()
+	initrd := tempFile(t, []byte("initramfs"))
+	defer initrd.Close()
+	if err := FileLoad(kernel, initrd, "console=ttyS0"); err != nil {
+		t.Fatalf("FileLoad() = %v", err)
+	}
+
+	if *entry != trampolineAddr {
+		t.Errorf("entry = %#x, want %#x", *entry, trampolineAddr)
+	}
+	if len(*segs) != 5 {
+		t.Fatalf("segments = %v, want trampoline, boot params, command line, kernel and initrd", *segs)
+	}
+	tramp, params, cmdline, code, ramfs := (*segs)[0], (*segs)[1], (*segs)[2], (*segs)[3], (*segs)[4]
+
+	if !bytes.Equal(tramp.Buf, trampoline(bootParamsAddr, 0x1000200)) {
+		t.Errorf("trampoline = %x, want a jump to 0x1000200", tramp.Buf)
+	}
+	if string(cmdline.Buf) != "console=ttyS0\x00" || cmdline.Phys.Start != cmdlineAddr {
+		t.Errorf("command line segment = %q at %v", cmdline.Buf, cmdline.Phys)
+	}
+	if string(code.Buf) != "protected mode code" || code.Phys != (Range{Start: 0x1000000, Size: 0x400000}) {
+		t.Errorf("kernel segment = %q at %v, want its code at [0x1000000, 0x1400000)", code.Buf, code.Phys)
+	}
+	// The initrd goes as high as InitrdAddrMax lets it.
+	if want := (Range{Start: 0x7ffdf000, Size: 9}); string(ramfs.Buf) != "initramfs" || ramfs.Phys != want {
+		t.Errorf("initrd segment = %q at %v, want it at %v", ramfs.Buf, ramfs.Phys, want)
+	}
+
+	p := params.Buf
+	le := binary.LittleEndian
+	for _, f := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"type_of_loader", uint64(p[bpTypeOfLoader]), 0xff},
+		{"cmd_line_ptr", uint64(le.Uint32(p[bpCmdlinePtr:])), cmdlineAddr},
+		{"ramdisk_image", uint64(le.Uint32(p[bpRamdiskImage:])), 0x7ffdf000},
+		{"ramdisk_size", uint64(le.Uint32(p[bpRamdiskSize:])), 9},
+		{"header magic", uint64(le.Uint32(p[0x202:])), uint64(le.Uint32(bzimage.HeaderMagic[:]))},
+		{"e820_entries", uint64(p[bpE820Entries]), 5},
+		{"e820 2 start", le.Uint64(p[bpE820Table+2*e820EntrySize:]), 0x100000},
+		{"e820 2 size", le.Uint64(p[bpE820Table+2*e820EntrySize+8:]), 0x7fee0000},
+		{"e820 3 type", uint64(le.Uint32(p[bpE820Table+3*e820EntrySize+16:])), e820Reserved},
+	} {
+		if f.got != f.want {
+			t.Errorf("boot params %s = %#x, want %#x", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestFileLoadFallbackErrors(t *testing.T) {
+	defer fakeMemmap(t, "0x0 0x9ffff System RAM", "0x100000 0x1ffffff System RAM")()
+
+	for _, tt := range []struct {
+		name    string
+		errno   syscall.Errno
+		kernel  []byte
+		cmdline string
+		want    string
+	}{
+		{
+			name:   "other error",
+			errno:  unix.EPERM,
+			kernel: fakeBzImage(t, 0x20d, "code"),
+			want:   "operation not permitted",
+		},
+		{
+			name:   "not a bzImage",
+			errno:  unix.ENOSYS,
+			kernel: make([]byte, 4096),
+			want:   "not a bzImage",
+		},
+		{
+			name:   "32-bit boot protocol",
+			errno:  unix.ENOSYS,
+			kernel: fakeBzImage(t, 0x20a, "code"),
+			want:   "no 64-bit entry point",
+		},
+		{
+			name:    "command line too long",
+			errno:   unix.ENOSYS,
+			kernel:  fakeBzImage(t, 0x20d, "code"),
+			cmdline: strings.Repeat("x", 2048),
+			want:    "command line is 2048 bytes",
+		},
+		{
+			name:   "kernel beyond RAM",
+			errno:  unix.ENOSYS,
+			kernel: fakeBzImage(t, 0x20d, strings.Repeat("code", 0x400000)+"x"),
+			want:   "not in RAM",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, segs, done := mockKexec(tt.errno)
+			defer done()
+			kernel := tempFile(t, tt.kernel)
+			defer kernel.Close()
+			err := FileLoad(kernel, nil, tt.cmdline)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("FileLoad() = %v, want an error with %q", err, tt.want)
+			}
+			if *segs != nil {
+				t.Errorf("kexec_load(2) called with %v", *segs)
+			}
+		})
+	}
+}
+
+func TestInspectSegments(t *testing.T) {
+	defer fakeMemmap(t, "0x0 0x9ffff System RAM", "0x100000 0x3ffffff System RAM")()
+	_, loaded, done := mockKexec(unix.ENOSYS)
+	defer done()
+
+	kernel := tempFile(t, fakeBzImage(t, 0x20d, "code"))
+	defer kernel.Close()
+	initrd := tempFile(t, make([]byte, 5000))
+	defer initrd.Close()
+
+	segs, err := InspectSegments(kernel, initrd, "quiet")
+	if err != nil {
+		t.Fatalf("InspectSegments() = %v", err)
+	}
+	if *loaded != nil {
+		t.Errorf("InspectSegments() loaded %v", *loaded)
+	}
+	pageSize := uint(os.Getpagesize())
+	want := []Range{
+		{Start: trampolineAddr, Size: pageSize},
+		{Start: bootParamsAddr, Size: bootParamsSize},
+		{Start: cmdlineAddr, Size: 6},
+		{Start: 0x1000000, Size: 0x400000},
+		// Two pages below the top of RAM.
+		{Start: 0x4000000 - 2*uintptr(pageSize), Size: 5000},
+	}
+	if len(segs) != len(want) {
+		t.Fatalf("InspectSegments() = %v, want segments at %v", segs, want)
+	}
+	names := []string{"purgatory", "boot params", "cmdline", "kernel", "initrd"}
+	for i, s := range segs {
+		if s.Phys != want[i] {
+			t.Errorf("segment %d is at %v, want %v", i, s.Phys, want[i])
+		}
+		if s.Name != names[i] {
+			t.Errorf("segment %d is named %q, want %q", i, s.Name, names[i])
+		}
+	}
+
+	// FileLoad's fallback loads the same segments.
+	if err := FileLoad(kernel, initrd, "quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*loaded) != len(segs) {
+		t.Fatalf("FileLoad() loaded %v, want %v", *loaded, segs)
+	}
+	for i, s := range *loaded {
+		if s.Phys != segs[i].Phys || !bytes.Equal(s.Buf, segs[i].Buf) {
+			t.Errorf("FileLoad() segment %d = %v, InspectSegments() said %v", i, s, segs[i])
+		}
+	}
+
+	// Without an initrd, there is no initrd segment.
+	if segs, err := InspectSegments(kernel, nil, ""); err != nil || len(segs) != 4 {
+		t.Errorf("InspectSegments() without initrd = %v, %v, want 4 segments", segs, err)
+	}
+	if _, err := InspectSegments(initrd, nil, ""); err == nil {
+		t.Errorf("InspectSegments() of a non-bzImage succeeded")
+	}
+}
+
+func TestLoadBzImageAt(t *testing.T) {
+	defer fakeMemmap(t, "0x0 0x9ffff System RAM", "0x100000 0x3ffffff System RAM", "0x100000000 0x13fffffff System RAM")()
+	entry, segs, done := mockKexec(0)
+	defer done()
+
+	relocatable := fakeBzImage(t, 0x20d, "code")
+	fixed := fakeBzImage(t, 0x20d, "code")
+	fixed[0x234] = 0
+	for _, tt := range []struct {
+		name                 string
+		kernel               []byte
+		kernelAt, initrdAt   uintptr
+		wantKernel, wantRamd uintptr
+		wantErr              string
+	}{
+		{name: "default", kernel: relocatable, wantKernel: 0x1000000, wantRamd: 0x3ffe000},
+		{name: "placed", kernel: relocatable, kernelAt: 0x2000000, initrdAt: 0x1800000, wantKernel: 0x2000000, wantRamd: 0x1800000},
+		{name: "kernel placed", kernel: relocatable, kernelAt: 0x3000000, wantKernel: 0x3000000, wantRamd: 0x3ffe000},
+		{name: "initrd placed", kernel: relocatable, initrdAt: 0x2000000, wantKernel: 0x1000000, wantRamd: 0x2000000},
+		{name: "not relocatable", kernel: fixed, kernelAt: 0x2000000, wantErr: "not relocatable"},
+		{name: "preferred address", kernel: fixed, kernelAt: 0x1000000, wantKernel: 0x1000000, wantRamd: 0x3ffe000},
+		{name: "kernel unaligned", kernel: relocatable, kernelAt: 0x2100000, wantErr: "not aligned"},
+		{name: "kernel beyond RAM", kernel: relocatable, kernelAt: 0x3e00000, initrdAt: 0x2000000, wantErr: "not in RAM"},
+		{name: "initrd unaligned", kernel: relocatable, initrdAt: 0x2000010, wantErr: "not page aligned"},
+		{name: "initrd above InitrdAddrMax", kernel: relocatable, initrdAt: 0x100000000, wantErr: "ends above"},
+		{name: "initrd over kernel", kernel: relocatable, initrdAt: 0x1200000, wantErr: "overlaps"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*entry, *segs = 0, nil
+			kernel := tempFile(t, tt.kernel)
+			defer kernel.Close()
+			initrd := tempFile(t, make([]byte, 5000))
+			defer initrd.Close()
+
+			err := LoadBzImageAt(kernel, initrd, "", tt.kernelAt, tt.initrdAt)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadBzImageAt() = %v, want an error with %q", err, tt.wantErr)
+				}
+				if *segs != nil {
+					t.Errorf("kexec_load(2) called with %v", *segs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadBzImageAt() = %v", err)
+			}
+			if len(*segs) != 5 {
+				t.Fatalf("segments = %v, want 5", *segs)
+			}
+			code, ramfs := (*segs)[3], (*segs)[4]
+			if code.Phys.Start != tt.wantKernel || ramfs.Phys.Start != tt.wantRamd {
+				t.Errorf("kernel at %#x and initrd at %#x, want %#x and %#x", code.Phys.Start, ramfs.Phys.Start, tt.wantKernel, tt.wantRamd)
+			}
+			if want := trampoline(bootParamsAddr, tt.wantKernel+bpJump); !bytes.Equal((*segs)[0].Buf, want) {
+				t.Errorf("trampoline = %x, want a jump to %#x", (*segs)[0].Buf, tt.wantKernel+bpJump)
+			}
+			if got := binary.LittleEndian.Uint32((*segs)[1].Buf[bpRamdiskImage:]); uintptr(got) != tt.wantRamd {
+				t.Errorf("ramdisk_image = %#x, want %#x", got, tt.wantRamd)
+			}
+		})
+	}
+}
+
+func TestFirmwareMemoryMap(t *testing.T) {
+	defer fakeMemmap(t, "0x100000 0x3ffffff System RAM", "0x0 0x9ffff System RAM", "0xf0000 0xfffff Reserved")()
+	mem, err := FirmwareMemoryMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MemoryMapEntry{
+		{Range{Start: 0, Size: 0xa0000}, e820RAM},
+		{Range{Start: 0xf0000, Size: 0x10000}, e820Reserved},
+		{Range{Start: 0x100000, Size: 0x3f00000}, e820RAM},
+	}
+	if !reflect.DeepEqual(mem, want) {
+		t.Errorf("FirmwareMemoryMap() = %v, want %v", mem, want)
+	}
+}
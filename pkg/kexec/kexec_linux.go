@@ -9,8 +9,10 @@ import (
 	"syscall"
 )
 
-// Reboot executes a kernel previously loaded with FileInit.
+// Reboot executes a kernel previously loaded with FileInit, after running
+// ShutdownHooks.
 func Reboot() error {
+	runShutdownHooks()
 	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_KEXEC); err != nil {
 		return fmt.Errorf("sys_reboot(..., kexec) = %v", err)
 	}
@@ -6,7 +6,9 @@ package kexec
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -22,7 +24,9 @@ const (
 // FileLoad loads the given kernel as the new kernel with the given ramfs and
 // cmdline.
 //
-// The kexec_file_load(2) syscall is x86-64 bit only.
+// The kexec_file_load(2) syscall is x86-64 bit only. If the running kernel
+// was built without it, FileLoad lays out the kernel, which must be a
+// bzImage, itself and loads it with kexec_load(2).
 func FileLoad(kernel, ramfs *os.File, cmdline string) error {
 	var flags uintptr
 	var ramfsfd uintptr
@@ -41,15 +45,26 @@ func FileLoad(kernel, ramfs *os.File, cmdline string) error {
 		cmdLen++
 	}
 
-	if _, _, errno := unix.Syscall6(
+	errno := fileLoad(kernel.Fd(), ramfsfd, cmdPtr, cmdLen, flags)
+	if errno == unix.ENOSYS {
+		log.Printf("kexec_file_load(2) is not supported, falling back to kexec_load(2)")
+		return loadBzImage(kernel, ramfs, cmdline)
+	}
+	if errno != 0 {
+		return fmt.Errorf("sys_kexec(%d, %d, %s, %x) = %v", kernel.Fd(), ramfsfd, cmdline, flags, errno)
+	}
+	return nil
+}
+
+// fileLoad is kexec_file_load(2), replaced in tests.
+var fileLoad = func(kernelfd, ramfsfd uintptr, cmdPtr *byte, cmdLen, flags uintptr) syscall.Errno {
+	_, _, errno := unix.Syscall6(
 		unix.SYS_KEXEC_FILE_LOAD,
-		kernel.Fd(),
+		kernelfd,
 		ramfsfd,
 		cmdLen,
 		uintptr(unsafe.Pointer(cmdPtr)),
 		flags,
-		0); errno != 0 {
-		return fmt.Errorf("sys_kexec(%d, %d, %s, %x) = %v", kernel.Fd(), ramfsfd, cmdline, flags, errno)
-	}
-	return nil
+		0)
+	return errno
 }
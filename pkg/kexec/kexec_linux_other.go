@@ -14,3 +14,24 @@ import (
 func FileLoad(kernel, ramfs *os.File, cmdline string) error {
 	return syscall.ENOSYS
 }
+
+// InspectSegments is only implemented for bzImages on amd64.
+func InspectSegments(kernel, initrd *os.File, cmdline string) ([]Segment, error) {
+	return nil, syscall.ENOSYS
+}
+
+// LoadBzImageAt is only implemented on amd64.
+func LoadBzImageAt(kernel, ramfs *os.File, cmdline string, kernelAddr, initrdAddr uintptr) error {
+	return syscall.ENOSYS
+}
+
+// MemoryMapEntry is an entry of the firmware memory map.
+type MemoryMapEntry struct {
+	Range
+	Type uint32
+}
+
+// FirmwareMemoryMap is only implemented on amd64.
+func FirmwareMemoryMap() ([]MemoryMapEntry, error) {
+	return nil, syscall.ENOSYS
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// kexecSegment is struct kexec_segment of kexec_load(2).
+type kexecSegment struct {
+	buf   uintptr
+	bufsz uint
+	mem   uintptr
+	memsz uint
+}
+
+// Load loads segments into memory, to be started at entry by Reboot.
+//
+// Unlike FileLoad, Load leaves it to the caller to lay out the kernel and
+// whatever it needs to start.
+func Load(entry uintptr, segments []Segment, flags uint64) error {
+	pageSize := uint(os.Getpagesize())
+	segs := make([]kexecSegment, 0, len(segments))
+	for _, s := range segments {
+		if s.Phys.Start%uintptr(pageSize) != 0 {
+			return fmt.Errorf("segment %v is not page aligned", s)
+		}
+		if uint(len(s.Buf)) > s.Phys.Size {
+			return fmt.Errorf("segment %v does not fit its buffer", s)
+		}
+		ks := kexecSegment{
+			bufsz: uint(len(s.Buf)),
+			mem:   s.Phys.Start,
+			memsz: (s.Phys.Size + pageSize - 1) &^ (pageSize - 1),
+		}
+		if len(s.Buf) > 0 {
+			ks.buf = uintptr(unsafe.Pointer(&s.Buf[0]))
+		}
+		segs = append(segs, ks)
+	}
+
+	var segPtr uintptr
+	if len(segs) > 0 {
+		segPtr = uintptr(unsafe.Pointer(&segs[0]))
+	}
+	if _, _, errno := unix.Syscall6(
+		unix.SYS_KEXEC_LOAD,
+		entry,
+		uintptr(len(segs)),
+		segPtr,
+		uintptr(flags),
+		0, 0); errno != 0 {
+		return fmt.Errorf("sys_kexec_load(%#x, %d segments, %#x) = %v", entry, len(segs), flags, errno)
+	}
+	// The kernel has copied the buffers by now.
+	runtime.KeepAlive(segs)
+	runtime.KeepAlive(segments)
+	return nil
+}
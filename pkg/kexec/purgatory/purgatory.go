@@ -0,0 +1,128 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package purgatory customizes kexec purgatories, the code that runs
+// between the old kernel and the new one.
+//
+// A purgatory is an ELF object, such as the kernel's purgatory.ro, with
+// variables the loader fills in: the digest of the segments to check,
+// where the boot parameters are, or a random seed for the new kernel's
+// KASLR. PatchPurgatory writes them by symbol name.
+package purgatory
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+)
+
+// Symbols of the Linux purgatory.
+const (
+	// SHA256DigestSymbol holds the digest of the segments that the
+	// purgatory checks before jumping to the kernel.
+	SHA256DigestSymbol = "purgatory_sha256_digest"
+	// BootParamsSymbol holds the address of the boot parameters.
+	BootParamsSymbol = "boot_params"
+	// RandomSeedSymbol holds entropy for the new kernel's KASLR.
+	RandomSeedSymbol = "purgatory_random_seed"
+)
+
+// symbolOffset returns the offset in the file of sym, the symbol of f, and
+// how many bytes from there are in its section.
+func symbolOffset(f *elf.File, sym elf.Symbol) (uint64, uint64, error) {
+	if sym.Section == elf.SHN_UNDEF || sym.Section >= elf.SHN_LORESERVE || int(sym.Section) >= len(f.Sections) {
+		return 0, 0, fmt.Errorf("symbol %q is not defined in a section", sym.Name)
+	}
+	s := f.Sections[sym.Section]
+	if s.Type == elf.SHT_NOBITS {
+		return 0, 0, fmt.Errorf("symbol %q is in %s, which has no content in the file", sym.Name, s.Name)
+	}
+	// In relocatable objects, like the kernel's purgatory.ro, symbol
+	// values are offsets into their section. Elsewhere, they are
+	// addresses.
+	off := sym.Value
+	if f.Type != elf.ET_REL {
+		if sym.Value < s.Addr {
+			return 0, 0, fmt.Errorf("symbol %q at %#x is before its section %s at %#x", sym.Name, sym.Value, s.Name, s.Addr)
+		}
+		off = sym.Value - s.Addr
+	}
+	if off > s.Size {
+		return 0, 0, fmt.Errorf("symbol %q at %#x is past the end of its section %s", sym.Name, sym.Value, s.Name)
+	}
+	return s.Offset + off, s.Size - off, nil
+}
+
+// PatchPurgatory returns a copy of the purgatory ELF object with the bytes
+// of each patch written over the symbol it is named after.
+//
+// A patch may be no larger than its symbol, where the symbol table gives a
+// size, and must be within the symbol's section.
+func PatchPurgatory(purgatory []byte, patches map[string][]byte) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(purgatory))
+	if err != nil {
+		return nil, fmt.Errorf("purgatory is not ELF: %v", err)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("reading purgatory symbols: %v", err)
+	}
+	byName := make(map[string]elf.Symbol, len(syms))
+	for _, sym := range syms {
+		byName[sym.Name] = sym
+	}
+
+	patched := append([]byte(nil), purgatory...)
+	for name, patch := range patches {
+		sym, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("purgatory has no symbol %q", name)
+		}
+		if sym.Size != 0 && uint64(len(patch)) > sym.Size {
+			return nil, fmt.Errorf("patch of %d bytes is larger than symbol %q of %d bytes", len(patch), name, sym.Size)
+		}
+		off, room, err := symbolOffset(f, sym)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(patch)) > room || off+uint64(len(patch)) > uint64(len(patched)) {
+			return nil, fmt.Errorf("patch of %d bytes for symbol %q runs past its section", len(patch), name)
+		}
+		copy(patched[off:], patch)
+	}
+	return patched, nil
+}
+
+// InjectRandomSeed returns a copy of purgatory with its RandomSeedSymbol
+// filled with entropy read from r, such as crypto/rand.Reader.
+func InjectRandomSeed(purgatory []byte, r io.Reader) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(purgatory))
+	if err != nil {
+		return nil, fmt.Errorf("purgatory is not ELF: %v", err)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("reading purgatory symbols: %v", err)
+	}
+	for _, sym := range syms {
+		if sym.Name != RandomSeedSymbol {
+			continue
+		}
+		if sym.Size == 0 {
+			return nil, fmt.Errorf("symbol %q has no size", RandomSeedSymbol)
+		}
+		if _, room, err := symbolOffset(f, sym); err != nil {
+			return nil, err
+		} else if sym.Size > room {
+			return nil, fmt.Errorf("symbol %q of %d bytes runs past its section", RandomSeedSymbol, sym.Size)
+		}
+		seed := make([]byte, sym.Size)
+		if _, err := io.ReadFull(r, seed); err != nil {
+			return nil, fmt.Errorf("reading random seed: %v", err)
+		}
+		return PatchPurgatory(purgatory, map[string][]byte{RandomSeedSymbol: seed})
+	}
+	return nil, fmt.Errorf("purgatory has no symbol %q", RandomSeedSymbol)
+}
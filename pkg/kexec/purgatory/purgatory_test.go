@@ -0,0 +1,238 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package purgatory
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Sections of the synthetic purgatory, by index.
+const (
+	secText = 1 + iota
+	secData
+	secBss
+	secSymtab
+	secStrtab
+	secShstrtab
+	numSections
+)
+
+const sectionSize = 64
+
+type testSymbol struct {
+	name    string
+	section elf.SectionIndex
+	off     uint64
+	size    uint64
+}
+
+var testSymbols = []testSymbol{
+	{"purgatory_start", secText, 0, 16},
+	{SHA256DigestSymbol, secData, 0, 32},
+	{RandomSeedSymbol, secData, 32, 8},
+	{BootParamsSymbol, secData, 40, 8},
+	{"sizeless", secData, 48, 0},
+	{"stack", secBss, 0, 32},
+	{"undefined", elf.SHN_UNDEF, 0, 0},
+}
+
+// dataOffset is where .data is in the file.
+const dataOffset = 64 + sectionSize
+
+// syntheticPurgatory returns a little-endian ELF64 object of type typ with
+// the testSymbols. Symbol values are offsets into their sections for
+// ET_REL and addresses from base otherwise.
+func syntheticPurgatory(t *testing.T, typ elf.Type, base uint64) []byte {
+	var strtab, shstrtab bytes.Buffer
+	str := func(b *bytes.Buffer, s string) uint32 {
+		off := uint32(b.Len())
+		b.WriteString(s)
+		b.WriteByte(0)
+		return off
+	}
+	str(&strtab, "")
+	str(&shstrtab, "")
+
+	addr := func(sec elf.SectionIndex) uint64 {
+		if typ == elf.ET_REL {
+			return 0
+		}
+		return base + uint64(sec-secText)*sectionSize
+	}
+	symtab := make([]elf.Sym64, 1)
+	for _, s := range testSymbols {
+		value := s.off
+		if s.section != elf.SHN_UNDEF {
+			value += addr(s.section)
+		}
+		symtab = append(symtab, elf.Sym64{
+			Name:  str(&strtab, s.name),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT),
+			Shndx: uint16(s.section),
+			Value: value,
+			Size:  s.size,
+		})
+	}
+	var symBuf bytes.Buffer
+	if err := binary.Write(&symBuf, binary.LittleEndian, symtab); err != nil {
+		t.Fatal(err)
+	}
+
+	// The contents follow the ELF header; .bss takes none.
+	text := bytes.Repeat([]byte{0x90}, sectionSize)
+	data := make([]byte, sectionSize)
+	contents := [][]byte{text, data, symBuf.Bytes(), strtab.Bytes()}
+	shdrs := make([]elf.Section64, numSections)
+	off := uint64(binary.Size(elf.Header64{}))
+	add := func(sec elf.SectionIndex, name string, typ elf.SectionType, content []byte) {
+		shdrs[sec] = elf.Section64{
+			Name:      str(&shstrtab, name),
+			Type:      uint32(typ),
+			Off:       off,
+			Size:      uint64(len(content)),
+			Addr:      addr(sec),
+			Addralign: 1,
+		}
+		off += uint64(len(content))
+	}
+	add(secText, ".text", elf.SHT_PROGBITS, contents[0])
+	add(secData, ".data", elf.SHT_PROGBITS, contents[1])
+	add(secBss, ".bss", elf.SHT_NOBITS, nil)
+	shdrs[secBss].Size = sectionSize
+	add(secSymtab, ".symtab", elf.SHT_SYMTAB, contents[2])
+	shdrs[secSymtab].Link = secStrtab
+	shdrs[secSymtab].Info = 1
+	shdrs[secSymtab].Entsize = uint64(binary.Size(elf.Sym64{}))
+	shdrs[secSymtab].Addr = 0
+	add(secStrtab, ".strtab", elf.SHT_STRTAB, contents[3])
+	shdrs[secStrtab].Addr = 0
+	name := str(&shstrtab, ".shstrtab")
+	shdrs[secShstrtab] = elf.Section64{Name: name, Type: uint32(elf.SHT_STRTAB), Off: off, Size: uint64(shstrtab.Len()), Addralign: 1}
+	off += uint64(shstrtab.Len())
+
+	hdr := elf.Header64{
+		Type:      uint16(typ),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     off,
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     numSections,
+		Shstrndx:  secShstrtab,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var b bytes.Buffer
+	for _, v := range []interface{}{hdr, text, data, symBuf.Bytes(), strtab.Bytes(), shstrtab.Bytes(), shdrs} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestPatchPurgatory(t *testing.T) {
+	digest := bytes.Repeat([]byte{0xd1}, 32)
+	seed := []byte("entropy!")
+	params := []byte{0x00, 0x10, 0x09, 0, 0, 0, 0, 0}
+	for _, tt := range []struct {
+		name string
+		typ  elf.Type
+	}{
+		{"relocatable", elf.ET_REL},
+		{"executable", elf.ET_EXEC},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := syntheticPurgatory(t, tt.typ, 0x1000)
+			got, err := PatchPurgatory(p, map[string][]byte{
+				SHA256DigestSymbol: digest,
+				RandomSeedSymbol:   seed,
+				BootParamsSymbol:   params,
+				// Symbols without size take any patch that
+				// fits their section.
+				"sizeless": []byte("short"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]byte(nil), p...)
+			copy(want[dataOffset:], digest)
+			copy(want[dataOffset+32:], seed)
+			copy(want[dataOffset+40:], params)
+			copy(want[dataOffset+48:], "short")
+			if !bytes.Equal(got, want) {
+				t.Errorf("PatchPurgatory() .data = %x, want %x", got[dataOffset:dataOffset+sectionSize], want[dataOffset:dataOffset+sectionSize])
+			}
+			if bytes.Equal(got, p) {
+				t.Errorf("PatchPurgatory() changed its input")
+			}
+
+			// A patch may be shorter than its symbol.
+			got, err = PatchPurgatory(p, map[string][]byte{"purgatory_start": {0xcc}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got[64] != 0xcc || got[65] != 0x90 {
+				t.Errorf("PatchPurgatory(purgatory_start) .text = %x, want cc90...", got[64:66])
+			}
+		})
+	}
+}
+
+func TestPatchPurgatoryErrors(t *testing.T) {
+	p := syntheticPurgatory(t, elf.ET_REL, 0)
+	for _, tt := range []struct {
+		name    string
+		patches map[string][]byte
+		err     string
+	}{
+		{"missing", map[string][]byte{"purgatory_entropy": {1}}, "no symbol"},
+		{"too large", map[string][]byte{RandomSeedSymbol: make([]byte, 9)}, "larger than symbol"},
+		{"past section", map[string][]byte{"sizeless": make([]byte, 17)}, "past its section"},
+		{"bss", map[string][]byte{"stack": {1}}, "no content"},
+		{"undefined", map[string][]byte{"undefined": {1}}, "not defined"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := PatchPurgatory(p, tt.patches); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("PatchPurgatory() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+	if _, err := PatchPurgatory([]byte("not ELF"), nil); err == nil {
+		t.Errorf("PatchPurgatory(not ELF) succeeded")
+	}
+
+	// Addresses before their section are corrupt.
+	exec := syntheticPurgatory(t, elf.ET_EXEC, 0x1000)
+	f, err := elf.NewFile(bytes.NewReader(exec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := symbolOffset(f, elf.Symbol{Name: "early", Section: secData, Value: 0x1000}); err == nil {
+		t.Errorf("symbolOffset() of a symbol before its section succeeded")
+	}
+}
+
+func TestInjectRandomSeed(t *testing.T) {
+	p := syntheticPurgatory(t, elf.ET_REL, 0)
+	seed := []byte("01234567")
+	got, err := InjectRandomSeed(p, bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := got[dataOffset+32 : dataOffset+40]; !bytes.Equal(s, seed) {
+		t.Errorf("InjectRandomSeed() wrote %q, want %q", s, seed)
+	}
+	if _, err := InjectRandomSeed(p, strings.NewReader("short")); err == nil {
+		t.Errorf("InjectRandomSeed() with too little entropy succeeded")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import "fmt"
+
+// Range is a range of physical memory.
+type Range struct {
+	Start uintptr
+	Size  uint
+}
+
+// End returns the first address after r.
+func (r Range) End() uintptr {
+	return r.Start + uintptr(r.Size)
+}
+
+// Overlaps returns whether r and r2 share any addresses.
+func (r Range) Overlaps(r2 Range) bool {
+	return r.Start < r2.End() && r2.Start < r.End()
+}
+
+// String implements fmt.Stringer.
+func (r Range) String() string {
+	return fmt.Sprintf("[%#x, %#x)", r.Start, r.End())
+}
+
+// Segment is a kexec_load(2) segment: Buf is copied to the physical memory
+// at Phys, which may be larger than Buf.
+type Segment struct {
+	Buf  []byte
+	Phys Range
+
+	// Name says what the segment holds, such as kernel or initrd, for
+	// debugging. It is not given to the kernel.
+	Name string
+}
+
+// String implements fmt.Stringer.
+func (s Segment) String() string {
+	return fmt.Sprintf("%d bytes at %v", len(s.Buf), s.Phys)
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ShutdownHooks are run by Reboot before it executes the new kernel,
+	// in the reverse order of their registration, like deferred calls.
+	// Use RegisterShutdownHook to add to them.
+	ShutdownHooks []func() error
+
+	// ShutdownTimeout bounds how long Reboot runs ShutdownHooks. Hooks
+	// still to run after it are skipped.
+	ShutdownTimeout = 10 * time.Second
+
+	hooksMu sync.Mutex
+)
+
+// RegisterShutdownHook adds fn to ShutdownHooks, to unmount file systems,
+// flush logs and the like before a kexec reboot.
+func RegisterShutdownHook(fn func() error) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	ShutdownHooks = append(ShutdownHooks, fn)
+}
+
+// runShutdownHooks runs ShutdownHooks, last first. Errors are logged, and do
+// not stop the others. A hook still running at ShutdownTimeout is left
+// behind along with the rest.
+func runShutdownHooks() {
+	hooksMu.Lock()
+	hooks := append([]func() error(nil), ShutdownHooks...)
+	hooksMu.Unlock()
+
+	deadline := time.After(ShutdownTimeout)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		errs := make(chan error, 1)
+		go func(fn func() error) {
+			errs <- fn()
+		}(hooks[i])
+		select {
+		case err := <-errs:
+			if err != nil {
+				log.Printf("kexec: shutdown hook %d: %v", i, err)
+			}
+		case <-deadline:
+			log.Printf("kexec: shutdown hooks timed out after %v, skipping %d of %d", ShutdownTimeout, i+1, len(hooks))
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setHooks sets ShutdownHooks and ShutdownTimeout until the returned
+// function is called.
+func setHooks(timeout time.Duration) func() {
+	oldHooks, oldTimeout := ShutdownHooks, ShutdownTimeout
+	ShutdownHooks, ShutdownTimeout = nil, timeout
+	return func() {
+		ShutdownHooks, ShutdownTimeout = oldHooks, oldTimeout
+	}
+}
+
+// hookLog records which hooks ran.
+type hookLog struct {
+	mu  sync.Mutex
+	ran []int
+}
+
+func (l *hookLog) hook(i int, err error, d time.Duration) func() error {
+	return func() error {
+		time.Sleep(d)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.ran = append(l.ran, i)
+		return err
+	}
+}
+
+func (l *hookLog) get() []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]int(nil), l.ran...)
+}
+
+func TestShutdownHooksOrder(t *testing.T) {
+	defer setHooks(time.Second)()
+	var l hookLog
+	RegisterShutdownHook(l.hook(1, nil, 0))
+	RegisterShutdownHook(l.hook(2, errors.New("flushing logs failed"), 0))
+	RegisterShutdownHook(l.hook(3, nil, 0))
+
+	runShutdownHooks()
+	if got, want := l.get(), []int{3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks ran in order %v, want %v", got, want)
+	}
+}
+
+func TestShutdownHooksTimeout(t *testing.T) {
+	defer setHooks(100 * time.Millisecond)()
+	var l hookLog
+	RegisterShutdownHook(l.hook(1, nil, 0))
+	RegisterShutdownHook(l.hook(2, nil, time.Second))
+	RegisterShutdownHook(l.hook(3, nil, 0))
+
+	start := time.Now()
+	runShutdownHooks()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("hooks ran for %v, want at most the 100ms timeout", d)
+	}
+	if got, want := l.get(), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks %v finished before the timeout, want %v", got, want)
+	}
+	// The slow hook finishes on its own, but the one after it never runs.
+	time.Sleep(1200 * time.Millisecond)
+	if got, want := l.get(), []int{3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks %v ran, want %v", got, want)
+	}
+}
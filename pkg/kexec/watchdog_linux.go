@@ -0,0 +1,104 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrRebootTimeout is returned by RebootWithTimeout if the reboot did not
+// happen in time.
+var ErrRebootTimeout = errors.New("kexec reboot timed out")
+
+// DefaultWatchdog is the watchdog RebootWithTimeout arms.
+const DefaultWatchdog = "/dev/watchdog"
+
+var (
+	// watchdogDevice is the watchdog RebootWithTimeout arms. Tests
+	// change it.
+	watchdogDevice = DefaultWatchdog
+
+	// reboot is Reboot. Tests replace it.
+	reboot = Reboot
+
+	// watchdogIoctl does an ioctl on a watchdog whose argument points to
+	// an int. Tests replace it.
+	watchdogIoctl = func(f *os.File, req uint, arg *int32) error {
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(req), uintptr(unsafe.Pointer(arg))); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+)
+
+// RebootWithTimeout executes a kernel previously loaded with FileLoad, like
+// Reboot. If the machine has not rebooted after timeout, because shutting
+// down devices hangs, it arms the watchdog to reset the machine in a second
+// and returns ErrRebootTimeout.
+func RebootWithTimeout(timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- reboot()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(timeout):
+	}
+	if err := ArmWatchdog(watchdogDevice, time.Second); err != nil {
+		return fmt.Errorf("%v, and arming the watchdog failed: %v", ErrRebootTimeout, err)
+	}
+	return ErrRebootTimeout
+}
+
+// openWatchdog opens device. Opening a watchdog starts it, and closing it
+// leaves it running, as we never write the magic close character 'V'.
+func openWatchdog(device string) (*os.File, error) {
+	return os.OpenFile(device, os.O_WRONLY, 0)
+}
+
+// ArmWatchdog starts the watchdog device, such as /dev/watchdog0, to reset
+// the machine unless it is pet within timeout, which is rounded up to
+// seconds.
+func ArmWatchdog(device string, timeout time.Duration) error {
+	secs := int32((timeout + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	f, err := openWatchdog(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := watchdogIoctl(f, unix.WDIOC_SETTIMEOUT, &secs); err != nil {
+		return fmt.Errorf("setting timeout of %s to %ds: %v", device, secs, err)
+	}
+	// The new timeout counts from now.
+	var unused int32
+	if err := watchdogIoctl(f, unix.WDIOC_KEEPALIVE, &unused); err != nil {
+		return fmt.Errorf("petting %s: %v", device, err)
+	}
+	return nil
+}
+
+// PetWatchdog restarts the timeout of the watchdog device.
+func PetWatchdog(device string) error {
+	f, err := openWatchdog(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Any write pets a watchdog.
+	if _, err := f.Write([]byte{0}); err != nil {
+		return fmt.Errorf("petting %s: %v", device, err)
+	}
+	return nil
+}
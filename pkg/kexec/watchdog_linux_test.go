@@ -0,0 +1,137 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeWatchdog records the ioctls done on a watchdog, which is a regular
+// file in a temporary directory.
+type fakeWatchdog struct {
+	path     string
+	ioctls   []uint
+	timeout  int32
+	failWith error
+}
+
+func newFakeWatchdog(t *testing.T) (*fakeWatchdog, func()) {
+	dir, err := ioutil.TempDir("", "watchdog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &fakeWatchdog{path: filepath.Join(dir, "watchdog0")}
+	if err := ioutil.WriteFile(w.path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldIoctl, oldDevice := watchdogIoctl, watchdogDevice
+	watchdogIoctl = func(f *os.File, req uint, arg *int32) error {
+		if f.Name() != w.path {
+			t.Errorf("ioctl on %s, want %s", f.Name(), w.path)
+		}
+		if w.failWith != nil {
+			return w.failWith
+		}
+		w.ioctls = append(w.ioctls, req)
+		if req == unix.WDIOC_SETTIMEOUT {
+			w.timeout = *arg
+		}
+		return nil
+	}
+	watchdogDevice = w.path
+	return w, func() {
+		watchdogIoctl, watchdogDevice = oldIoctl, oldDevice
+		os.RemoveAll(dir)
+	}
+}
+
+func TestArmWatchdog(t *testing.T) {
+	w, done := newFakeWatchdog(t)
+	defer done()
+
+	for _, tt := range []struct {
+		timeout time.Duration
+		secs    int32
+	}{
+		{30 * time.Second, 30},
+		{1500 * time.Millisecond, 2},
+		{0, 1},
+	} {
+		w.ioctls = nil
+		if err := ArmWatchdog(w.path, tt.timeout); err != nil {
+			t.Fatal(err)
+		}
+		if want := []uint{unix.WDIOC_SETTIMEOUT, unix.WDIOC_KEEPALIVE}; !reflect.DeepEqual(w.ioctls, want) {
+			t.Errorf("ArmWatchdog() did ioctls %#x, want %#x", w.ioctls, want)
+		}
+		if w.timeout != tt.secs {
+			t.Errorf("ArmWatchdog(%v) set timeout %ds, want %ds", tt.timeout, w.timeout, tt.secs)
+		}
+	}
+
+	w.failWith = unix.ENOTTY
+	if err := ArmWatchdog(w.path, time.Second); err == nil {
+		t.Errorf("ArmWatchdog() of a device that is not a watchdog succeeded")
+	}
+	if err := ArmWatchdog(filepath.Join(filepath.Dir(w.path), "missing"), time.Second); err == nil {
+		t.Errorf("ArmWatchdog() of a missing device succeeded")
+	}
+}
+
+func TestPetWatchdog(t *testing.T) {
+	w, done := newFakeWatchdog(t)
+	defer done()
+	for i := 0; i < 2; i++ {
+		if err := PetWatchdog(w.path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) == 0 {
+		t.Errorf("PetWatchdog() did not write to the watchdog")
+	}
+}
+
+func TestRebootWithTimeout(t *testing.T) {
+	w, done := newFakeWatchdog(t)
+	defer done()
+	defer func(old func() error) { reboot = old }(reboot)
+
+	// A reboot that hangs.
+	hang := make(chan struct{})
+	defer close(hang)
+	reboot = func() error {
+		<-hang
+		return nil
+	}
+	if err := RebootWithTimeout(10 * time.Millisecond); err != ErrRebootTimeout {
+		t.Errorf("RebootWithTimeout() = %v, want %v", err, ErrRebootTimeout)
+	}
+	if w.timeout != 1 {
+		t.Errorf("RebootWithTimeout() armed the watchdog with %ds, want 1s", w.timeout)
+	}
+
+	// A reboot that fails.
+	w.timeout = 0
+	errReboot := errors.New("no kernel loaded")
+	reboot = func() error { return errReboot }
+	if err := RebootWithTimeout(time.Minute); err != errReboot {
+		t.Errorf("RebootWithTimeout() = %v, want %v", err, errReboot)
+	}
+	if w.timeout != 0 {
+		t.Errorf("RebootWithTimeout() armed the watchdog after the reboot failed")
+	}
+}
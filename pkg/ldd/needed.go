@@ -0,0 +1,408 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldd
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ldsoCache is the cache ldconfig writes.
+	ldsoCache = "/etc/ld.so.cache"
+	// ldsoConf lists the directories ldconfig caches.
+	ldsoConf = "/etc/ld.so.conf"
+)
+
+// Dep is a shared library an ELF file needs.
+type Dep struct {
+	// Name is the name in DT_NEEDED.
+	Name string
+	// Path is where the library is, or empty if it was not found.
+	Path string
+	// Addr is the address the library is linked at, which is 0 for
+	// position independent libraries.
+	Addr uint64
+}
+
+// dynamic is what Needed needs from the dynamic section of an ELF file.
+type dynamic struct {
+	needed  []string
+	rpath   []string
+	runpath []string
+	class   elf.Class
+	machine elf.Machine
+	addr    uint64
+}
+
+// readDynamic reads the PT_DYNAMIC segment of the ELF file at path. Files
+// without one have no dependencies.
+func readDynamic(path string) (*dynamic, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &dynamic{class: f.Class, machine: f.Machine}
+	var dynProg *elf.Prog
+	first := true
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_DYNAMIC:
+			dynProg = p
+		case elf.PT_LOAD:
+			if first || p.Vaddr < d.addr {
+				d.addr = p.Vaddr
+			}
+			first = false
+		}
+	}
+	if dynProg == nil {
+		return d, nil
+	}
+	b := make([]byte, dynProg.Filesz)
+	if _, err := dynProg.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("%s: reading PT_DYNAMIC: %v", path, err)
+	}
+
+	// Entries are a tag and a value, each a word.
+	size := 8
+	word := func(b []byte) uint64 { return uint64(f.ByteOrder.Uint32(b)) }
+	if f.Class == elf.ELFCLASS64 {
+		size = 16
+		word = f.ByteOrder.Uint64
+	}
+	var strtab, strsz uint64
+	var needed, rpath, runpath []uint64
+entries:
+	for ; len(b) >= size; b = b[size:] {
+		tag, val := elf.DynTag(word(b)), word(b[size/2:])
+		switch tag {
+		case elf.DT_NULL:
+			break entries
+		case elf.DT_NEEDED:
+			needed = append(needed, val)
+		case elf.DT_RPATH:
+			rpath = append(rpath, val)
+		case elf.DT_RUNPATH:
+			runpath = append(runpath, val)
+		case elf.DT_STRTAB:
+			strtab = val
+		case elf.DT_STRSZ:
+			strsz = val
+		}
+	}
+	if len(needed)+len(rpath)+len(runpath) == 0 {
+		return d, nil
+	}
+
+	// DT_STRTAB is an address, so find the segment it is loaded from.
+	var strs []byte
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || strtab < p.Vaddr || strtab+strsz > p.Vaddr+p.Filesz {
+			continue
+		}
+		strs = make([]byte, strsz)
+		if _, err := p.ReadAt(strs, int64(strtab-p.Vaddr)); err != nil {
+			return nil, fmt.Errorf("%s: reading DT_STRTAB: %v", path, err)
+		}
+		break
+	}
+	if strs == nil {
+		return nil, fmt.Errorf("%s: DT_STRTAB %#x is not in a PT_LOAD segment", path, strtab)
+	}
+	str := func(off uint64) (string, error) {
+		if off >= uint64(len(strs)) {
+			return "", fmt.Errorf("%s: string %#x is outside DT_STRTAB", path, off)
+		}
+		s := strs[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return string(s), nil
+	}
+	for _, off := range needed {
+		s, err := str(off)
+		if err != nil {
+			return nil, err
+		}
+		d.needed = append(d.needed, s)
+	}
+	// Both are colon separated lists, in which $ORIGIN is the
+	// directory of the file.
+	origin := filepath.Dir(path)
+	for _, l := range []struct {
+		offs []uint64
+		dirs *[]string
+	}{{rpath, &d.rpath}, {runpath, &d.runpath}} {
+		for _, off := range l.offs {
+			s, err := str(off)
+			if err != nil {
+				return nil, err
+			}
+			s = strings.Replace(s, "${ORIGIN}", origin, -1)
+			s = strings.Replace(s, "$ORIGIN", origin, -1)
+			*l.dirs = append(*l.dirs, filepath.SplitList(s)...)
+		}
+	}
+	return d, nil
+}
+
+// ReadCache returns the libraries in an ld.so.cache written by ldconfig, by
+// name. A name may have several paths, for different architectures.
+func ReadCache(path string) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCache(b)
+}
+
+const (
+	cacheMagicOld = "ld.so-1.7.0"
+	cacheMagicNew = "glibc-ld.so.cache1.1"
+)
+
+func parseCache(b []byte) (map[string][]string, error) {
+	// The old format has 12 byte entries, and may be followed by the
+	// new format, which has 24 byte ones. Strings in the old format
+	// are at offsets from the end of its entries, in the new format
+	// at offsets from its start.
+	if bytes.HasPrefix(b, []byte(cacheMagicOld)) {
+		if len(b) < 16 {
+			return nil, fmt.Errorf("ld.so.cache is truncated")
+		}
+		n := uint64(binary.LittleEndian.Uint32(b[12:]))
+		end := 16 + 12*n
+		if end > uint64(len(b)) {
+			return nil, fmt.Errorf("ld.so.cache is truncated")
+		}
+		// Entries are aligned like the new header.
+		newStart := (end + 7) &^ 7
+		if newStart < uint64(len(b)) && bytes.HasPrefix(b[newStart:], []byte(cacheMagicNew)) {
+			return parseNewCache(b[newStart:])
+		}
+		return cacheEntries(b[16:end], 12, n, b[end:], binary.LittleEndian)
+	}
+	if bytes.HasPrefix(b, []byte(cacheMagicNew)) {
+		return parseNewCache(b)
+	}
+	return nil, fmt.Errorf("ld.so.cache has an unknown format")
+}
+
+func parseNewCache(b []byte) (map[string][]string, error) {
+	const headerLen = 48
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("ld.so.cache is truncated")
+	}
+	// The cache is in the byte order of the machine it is for. The
+	// number of libraries is much less than 1<<16.
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(b[20:]) > 0xffff {
+		order = binary.BigEndian
+	}
+	n := uint64(order.Uint32(b[20:]))
+	end := headerLen + 24*n
+	if end > uint64(len(b)) {
+		return nil, fmt.Errorf("ld.so.cache is truncated")
+	}
+	return cacheEntries(b[headerLen:end], 24, n, b, order)
+}
+
+// cacheEntries reads n entries of size bytes, which start with flags, key and
+// value, the latter two offsets into strs.
+func cacheEntries(entries []byte, size, n uint64, strs []byte, order binary.ByteOrder) (map[string][]string, error) {
+	str := func(off uint32) (string, error) {
+		if uint64(off) >= uint64(len(strs)) {
+			return "", fmt.Errorf("ld.so.cache: string %#x is out of range", off)
+		}
+		s := strs[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return string(s), nil
+	}
+	libs := make(map[string][]string)
+	for i := uint64(0); i < n; i++ {
+		e := entries[i*size:]
+		key, err := str(order.Uint32(e[4:]))
+		if err != nil {
+			return nil, err
+		}
+		value, err := str(order.Uint32(e[8:]))
+		if err != nil {
+			return nil, err
+		}
+		libs[key] = append(libs[key], value)
+	}
+	return libs, nil
+}
+
+// ReadConf returns the directories listed in an ld.so.conf, following
+// include lines.
+func ReadConf(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dirs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := s.Text()
+		if i := strings.IndexByte(l, '#'); i >= 0 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "include" {
+			dirs = append(dirs, fields...)
+			continue
+		}
+		for _, pattern := range fields[1:] {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			names, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range names {
+				d, err := ReadConf(n)
+				if err != nil {
+					return nil, err
+				}
+				dirs = append(dirs, d...)
+			}
+		}
+	}
+	return dirs, s.Err()
+}
+
+// Resolver finds shared libraries the way ld.so does, without running it.
+type Resolver struct {
+	// LibraryPath is searched after DT_RPATH, like LD_LIBRARY_PATH.
+	LibraryPath []string
+	// Cache is searched after DT_RUNPATH, like ld.so.cache.
+	Cache map[string][]string
+	// ConfDirs are searched after Cache, for libraries that are
+	// missing from an out of date cache.
+	ConfDirs []string
+	// DefaultDirs are searched last.
+	DefaultDirs []string
+}
+
+// NewResolver returns a Resolver using LD_LIBRARY_PATH, /etc/ld.so.cache and
+// /etc/ld.so.conf. Missing files are not an error.
+func NewResolver() (*Resolver, error) {
+	r := &Resolver{
+		LibraryPath: filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")),
+		DefaultDirs: []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"},
+	}
+	var err error
+	if r.Cache, err = ReadCache(ldsoCache); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if r.ConfDirs, err = ReadConf(ldsoConf); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return r, nil
+}
+
+// compatible returns whether path is a library that can be loaded into a
+// file of class and machine.
+func compatible(path string, class elf.Class, machine elf.Machine) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Class == class && f.Machine == machine
+}
+
+// find returns where the library name needed by a file with dynamic section
+// d is. rpath is the DT_RPATH of the files that loaded it.
+func (r *Resolver) find(name string, d *dynamic, rpath []string) string {
+	if strings.ContainsRune(name, '/') {
+		if compatible(name, d.class, d.machine) {
+			return name
+		}
+		return ""
+	}
+	var dirs []string
+	// DT_RPATH is ignored if there is a DT_RUNPATH.
+	if len(d.runpath) == 0 {
+		dirs = append(dirs, rpath...)
+	}
+	dirs = append(dirs, r.LibraryPath...)
+	dirs = append(dirs, d.runpath...)
+	var paths []string
+	for _, dir := range dirs {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	paths = append(paths, r.Cache[name]...)
+	for _, dir := range append(r.ConfDirs, r.DefaultDirs...) {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	for _, p := range paths {
+		if compatible(p, d.class, d.machine) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Needed returns the shared libraries the ELF file at path needs, directly
+// or through other libraries, in the order ld.so would load them. Libraries
+// that are not found have an empty Path.
+func (r *Resolver) Needed(path string) ([]Dep, error) {
+	type pending struct {
+		path  string
+		d     *dynamic
+		rpath []string
+	}
+	d, err := readDynamic(path)
+	if err != nil {
+		return nil, err
+	}
+	var deps []Dep
+	seen := map[string]bool{}
+	queue := []pending{{path, d, d.rpath}}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, name := range p.d.needed {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			lib := r.find(name, p.d, p.rpath)
+			if lib == "" {
+				deps = append(deps, Dep{Name: name})
+				continue
+			}
+			ld, err := readDynamic(lib)
+			if err != nil {
+				return nil, err
+			}
+			deps = append(deps, Dep{Name: name, Path: lib, Addr: ld.addr})
+			// Its dependencies are searched for in its DT_RPATH,
+			// then in those of what loaded it.
+			queue = append(queue, pending{lib, ld, append(append([]string{}, ld.rpath...), p.rpath...)})
+		}
+	}
+	return deps, nil
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldd
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeELF describes a synthetic ELF file.
+type fakeELF struct {
+	machine elf.Machine
+	addr    uint64
+	needed  []string
+	rpath   string
+	runpath string
+}
+
+// write writes a 64 bit ELF file with only the program headers and dynamic
+// section Needed reads.
+func (e fakeELF) write(t *testing.T, path string) {
+	if e.machine == 0 {
+		e.machine = elf.EM_X86_64
+	}
+	const (
+		ehsize = 64
+		phsize = 56
+	)
+	strs := []byte{0}
+	str := func(s string) uint64 {
+		off := uint64(len(strs))
+		strs = append(strs, s...)
+		strs = append(strs, 0)
+		return off
+	}
+	var dyn []elf.Dyn64
+	for _, n := range e.needed {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: str(n)})
+	}
+	if e.rpath != "" {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_RPATH), Val: str(e.rpath)})
+	}
+	if e.runpath != "" {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_RUNPATH), Val: str(e.runpath)})
+	}
+	strOff := uint64(ehsize + 2*phsize)
+	dynOff := (strOff + uint64(len(strs)) + 7) &^ 7
+	dyn = append(dyn,
+		elf.Dyn64{Tag: int64(elf.DT_STRTAB), Val: e.addr + strOff},
+		elf.Dyn64{Tag: int64(elf.DT_STRSZ), Val: uint64(len(strs))},
+		elf.Dyn64{Tag: int64(elf.DT_NULL)},
+	)
+	dynSize := uint64(len(dyn) * 16)
+	size := dynOff + dynSize
+
+	var b bytes.Buffer
+	h := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(e.machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Ehsize:    ehsize,
+		Phentsize: phsize,
+		Phnum:     2,
+	}
+	copy(h.Ident[:], elf.ELFMAG)
+	h.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	progs := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R), Vaddr: e.addr, Paddr: e.addr, Filesz: size, Memsz: size, Align: 0x1000},
+		{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R), Off: dynOff, Vaddr: e.addr + dynOff, Paddr: e.addr + dynOff, Filesz: dynSize, Memsz: dynSize, Align: 8},
+	}
+	for _, v := range []interface{}{h, progs, strs, make([]byte, dynOff-strOff-uint64(len(strs))), dyn} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNeeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	// bin needs liba, in its DT_RPATH, which needs libb, found through
+	// the DT_RPATH of bin, and libc, in the cache. libb needs libc
+	// again and libm, in the default directories, where there is also
+	// a libm for the wrong machine.
+	fakeELF{addr: 0x400000, needed: []string{"liba.so.1", "libmissing.so"}, rpath: "$ORIGIN/../rpath:" + p("rpath2")}.write(t, p("bin/prog"))
+	fakeELF{needed: []string{"libb.so", "libc.so.6"}}.write(t, p("rpath/liba.so.1"))
+	fakeELF{needed: []string{"libc.so.6", "libm.so.6"}}.write(t, p("rpath2/libb.so"))
+	fakeELF{addr: 0x1000}.write(t, p("cache/libc.so.6"))
+	fakeELF{machine: elf.EM_AARCH64}.write(t, p("default1/libm.so.6"))
+	fakeELF{}.write(t, p("default2/libm.so.6"))
+
+	r := &Resolver{
+		Cache:       map[string][]string{"libc.so.6": {p("cache/libc.so.6")}},
+		DefaultDirs: []string{p("default1"), p("default2")},
+	}
+	deps, err := r.Needed(p("bin/prog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Dep{
+		{Name: "liba.so.1", Path: p("bin/../rpath/liba.so.1")},
+		{Name: "libmissing.so"},
+		{Name: "libb.so", Path: p("rpath2/libb.so")},
+		{Name: "libc.so.6", Path: p("cache/libc.so.6"), Addr: 0x1000},
+		{Name: "libm.so.6", Path: p("default2/libm.so.6")},
+	}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("Needed() = %+v, want %+v", deps, want)
+	}
+}
+
+func TestNeededSearchOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := func(name string) string { return filepath.Join(dir, name) }
+	for _, d := range []string{"rpath", "env", "runpath", "cache", "conf", "default"} {
+		fakeELF{}.write(t, p(d+"/libx.so"))
+	}
+	fakeELF{}.write(t, p("direct/libx.so"))
+
+	for _, tt := range []struct {
+		name string
+		bin  fakeELF
+		r    Resolver
+		want string
+	}{
+		{
+			name: "DT_RPATH before LD_LIBRARY_PATH",
+			bin:  fakeELF{needed: []string{"libx.so"}, rpath: p("rpath")},
+			r:    Resolver{LibraryPath: []string{p("env")}},
+			want: p("rpath/libx.so"),
+		},
+		{
+			name: "DT_RUNPATH hides DT_RPATH",
+			bin:  fakeELF{needed: []string{"libx.so"}, rpath: p("rpath"), runpath: p("runpath")},
+			want: p("runpath/libx.so"),
+		},
+		{
+			name: "LD_LIBRARY_PATH before DT_RUNPATH",
+			bin:  fakeELF{needed: []string{"libx.so"}, runpath: p("runpath")},
+			r:    Resolver{LibraryPath: []string{p("env")}},
+			want: p("env/libx.so"),
+		},
+		{
+			name: "cache before ld.so.conf",
+			bin:  fakeELF{needed: []string{"libx.so"}},
+			r:    Resolver{Cache: map[string][]string{"libx.so": {p("cache/libx.so")}}, ConfDirs: []string{p("conf")}},
+			want: p("cache/libx.so"),
+		},
+		{
+			name: "ld.so.conf before default",
+			bin:  fakeELF{needed: []string{"libx.so"}},
+			r:    Resolver{ConfDirs: []string{p("conf")}, DefaultDirs: []string{p("default")}},
+			want: p("conf/libx.so"),
+		},
+		{
+			name: "path",
+			bin:  fakeELF{needed: []string{p("direct/libx.so")}},
+			r:    Resolver{DefaultDirs: []string{p("default")}},
+			want: p("direct/libx.so"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.bin.write(t, p("bin"))
+			deps, err := tt.r.Needed(p("bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deps) != 1 || deps[0].Path != tt.want {
+				t.Errorf("Needed() = %+v, want libx.so at %s", deps, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeededStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "bin")
+	fakeELF{}.write(t, bin)
+	deps, err := (&Resolver{}).Needed(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 0 {
+		t.Errorf("Needed() = %+v, want none", deps)
+	}
+
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Resolver{}).Needed(bin); err == nil {
+		t.Errorf("Needed() of a script succeeded")
+	}
+}
+
+// cache returns an ld.so.cache in the new format, optionally after an empty
+// old one.
+func cache(libs [][2]string, old bool) []byte {
+	var b bytes.Buffer
+	if old {
+		b.WriteString(cacheMagicOld + "\x00")
+		binary.Write(&b, binary.LittleEndian, uint32(0))
+	}
+	strOff := 48 + 24*len(libs)
+	var strs []byte
+	b.WriteString(cacheMagicNew)
+	binary.Write(&b, binary.LittleEndian, []uint32{uint32(len(libs)), 0, 0, 0, 0, 0, 0})
+	for _, l := range libs {
+		key := strOff + len(strs)
+		strs = append(append(strs, l[0]...), 0)
+		value := strOff + len(strs)
+		strs = append(append(strs, l[1]...), 0)
+		binary.Write(&b, binary.LittleEndian, []uint32{0x303, uint32(key), uint32(value), 0, 0, 0})
+	}
+	b.Write(strs)
+	return b.Bytes()
+}
+
+func TestParseCache(t *testing.T) {
+	libs := [][2]string{
+		{"libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6"},
+		{"libc.so.6", "/lib32/libc.so.6"},
+		{"libm.so.6", "/lib/x86_64-linux-gnu/libm.so.6"},
+	}
+	want := map[string][]string{
+		"libc.so.6": {"/lib/x86_64-linux-gnu/libc.so.6", "/lib32/libc.so.6"},
+		"libm.so.6": {"/lib/x86_64-linux-gnu/libm.so.6"},
+	}
+	for _, old := range []bool{false, true} {
+		got, err := parseCache(cache(libs, old))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCache(old = %v) = %v, want %v", old, got, want)
+		}
+	}
+
+	b := cache(libs, false)
+	for _, bad := range [][]byte{[]byte("not a cache"), b[:60]} {
+		if _, err := parseCache(bad); err == nil {
+			t.Errorf("parseCache(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestReadConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, c := range map[string]string{
+		"ld.so.conf":           "# libc default\n/usr/local/lib\ninclude ld.so.conf.d/*.conf\n",
+		"ld.so.conf.d/a.conf":  "/opt/a/lib /opt/a/lib64 # two\n",
+		"ld.so.conf.d/b.conf":  "\n/opt/b/lib\n",
+		"ld.so.conf.d/c.other": "/not/included\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ReadConf(filepath.Join(dir, "ld.so.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/usr/local/lib", "/opt/a/lib", "/opt/a/lib64", "/opt/b/lib"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadConf() = %q, want %q", got, want)
+	}
+}
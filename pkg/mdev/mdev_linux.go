@@ -0,0 +1,195 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mdev creates device nodes as the kernel reports devices, like
+// busybox's mdev.
+//
+// It is for systems without devtmpfs, or to create nodes in another
+// directory. The kernel sends uevents on a NETLINK_KOBJECT_UEVENT socket,
+// and the devices it already has are in /sys/dev.
+package mdev
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Uevent is a message from the kernel about a device.
+type Uevent struct {
+	// Action is add, remove, change, or others that are ignored.
+	Action string
+	// Env are the variables of the event, such as DEVNAME, MAJOR and
+	// MINOR.
+	Env map[string]string
+}
+
+// ParseUevent parses a uevent from the kernel: a header of action@devpath
+// followed by NUL separated KEY=value pairs.
+func ParseUevent(b []byte) (*Uevent, error) {
+	fields := bytes.Split(bytes.TrimRight(b, "\x00"), []byte{0})
+	header := string(fields[0])
+	i := strings.IndexByte(header, '@')
+	if i < 0 {
+		return nil, fmt.Errorf("uevent header %q is not action@devpath", header)
+	}
+	u := &Uevent{Action: header[:i], Env: make(map[string]string)}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(string(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("uevent variable %q is not KEY=value", f)
+		}
+		u.Env[kv[0]] = kv[1]
+	}
+	if a, ok := u.Env["ACTION"]; ok && a != u.Action {
+		return nil, fmt.Errorf("uevent action is %q in the header and %q in ACTION", u.Action, a)
+	}
+	return u, nil
+}
+
+// defaultMode is the permissions of nodes whose uevent has no DEVMODE.
+const defaultMode = 0660
+
+// Apply creates or removes the node in dev the uevent is about. Uevents of
+// devices without node, and with other actions, are ignored.
+func (u *Uevent) Apply(dev string) error {
+	name := u.Env["DEVNAME"]
+	if name == "" || u.Env["MAJOR"] == "" {
+		return nil
+	}
+	// DEVNAME may be a path, such as bus/usb/001/002, but not outside
+	// dev.
+	p := filepath.Join(dev, filepath.Clean("/"+name))
+
+	switch u.Action {
+	case "add", "change":
+		major, err := strconv.ParseUint(u.Env["MAJOR"], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: bad MAJOR: %v", name, err)
+		}
+		minor, err := strconv.ParseUint(u.Env["MINOR"], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: bad MINOR: %v", name, err)
+		}
+		mode := uint64(defaultMode)
+		if m, ok := u.Env["DEVMODE"]; ok {
+			if mode, err = strconv.ParseUint(m, 8, 32); err != nil {
+				return fmt.Errorf("%s: bad DEVMODE: %v", name, err)
+			}
+		}
+		typ := uint32(unix.S_IFCHR)
+		if u.Env["SUBSYSTEM"] == "block" {
+			typ = unix.S_IFBLK
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		// The node may be left from before, with another number.
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return unix.Mknod(p, typ|uint32(mode), int(unix.Mkdev(uint32(major), uint32(minor))))
+
+	case "remove":
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Coldplug creates the nodes in dev of the devices in sys/dev, which the
+// kernel found before anyone listened to its uevents. It tries all devices,
+// and returns the first error.
+func Coldplug(sys, dev string) error {
+	var firstErr error
+	for _, subsystem := range []string{"char", "block"} {
+		files, err := filepath.Glob(filepath.Join(sys, "dev", subsystem, "*", "uevent"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			u := &Uevent{Action: "add", Env: make(map[string]string)}
+			for _, l := range strings.Split(string(b), "\n") {
+				if kv := strings.SplitN(l, "=", 2); len(kv) == 2 {
+					u.Env[kv[0]] = kv[1]
+				}
+			}
+			if subsystem == "block" {
+				u.Env["SUBSYSTEM"] = "block"
+			}
+			if err := u.Apply(dev); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Serve reads uevents from r, one per Read, and applies them to dev until r
+// fails. Bad uevents are logged and skipped.
+func Serve(r io.Reader, dev string) error {
+	// Uevents are at most a page.
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return err
+		}
+		// udev rebroadcasts events with a binary header; only the
+		// kernel's are for us.
+		if bytes.HasPrefix(buf[:n], []byte("libudev")) {
+			continue
+		}
+		u, err := ParseUevent(buf[:n])
+		if err != nil {
+			log.Printf("mdev: %v", err)
+			continue
+		}
+		if err := u.Apply(dev); err != nil {
+			log.Printf("mdev: %v", err)
+		}
+	}
+}
+
+// Listen returns a socket the kernel sends uevents to.
+func Listen() (io.ReadCloser, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "uevent"), nil
+}
+
+// Run creates the nodes of all devices in dev, using sysfs at /sys, and
+// keeps creating and removing them as devices come and go. It only returns
+// on error.
+func Run(dev string) error {
+	// Listen first, so that no device is missed between the two.
+	l, err := Listen()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := Coldplug("/sys", dev); err != nil {
+		return err
+	}
+	return Serve(l, dev)
+}
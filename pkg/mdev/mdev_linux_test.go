@@ -0,0 +1,186 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdev
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseUevent(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want *Uevent
+	}{
+		{
+			in: "add@/devices/virtual/block/loop0\x00ACTION=add\x00DEVPATH=/devices/virtual/block/loop0\x00SUBSYSTEM=block\x00MAJOR=7\x00MINOR=0\x00DEVNAME=loop0\x00SEQNUM=1234\x00",
+			want: &Uevent{Action: "add", Env: map[string]string{
+				"ACTION":    "add",
+				"DEVPATH":   "/devices/virtual/block/loop0",
+				"SUBSYSTEM": "block",
+				"MAJOR":     "7",
+				"MINOR":     "0",
+				"DEVNAME":   "loop0",
+				"SEQNUM":    "1234",
+			}},
+		},
+		{
+			in:   "remove@/devices/x",
+			want: &Uevent{Action: "remove", Env: map[string]string{}},
+		},
+		{in: "no header\x00A=b"},
+		{in: "add@/devices/x\x00NOVALUE"},
+		{in: "add@/devices/x\x00ACTION=remove"},
+	} {
+		got, err := ParseUevent([]byte(tt.in))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseUevent(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseUevent(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating device nodes requires root")
+	}
+	dir, err := ioutil.TempDir("", "mdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// checkNode checks that path is a node of type typ and number major:minor.
+func checkNode(t *testing.T, path string, typ, perm, major, minor uint32) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	gotMajor, gotMinor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	if st.Mode&unix.S_IFMT != typ || st.Mode&0777 != perm || gotMajor != major || gotMinor != minor {
+		t.Errorf("%s is %#o %d:%d, want %#o %d:%d", path, st.Mode, gotMajor, gotMinor, typ|perm, major, minor)
+	}
+}
+
+func TestApply(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	m := unix.Umask(0)
+	defer unix.Umask(m)
+
+	for _, u := range []*Uevent{
+		{Action: "add", Env: map[string]string{"SUBSYSTEM": "block", "MAJOR": "8", "MINOR": "17", "DEVNAME": "sdb1"}},
+		{Action: "add", Env: map[string]string{"SUBSYSTEM": "usb", "MAJOR": "189", "MINOR": "1", "DEVNAME": "bus/usb/001/002", "DEVMODE": "0664"}},
+		{Action: "add", Env: map[string]string{"SUBSYSTEM": "tty", "MAJOR": "4", "MINOR": "65", "DEVNAME": "../../ttyS1"}},
+		// Not a device node.
+		{Action: "add", Env: map[string]string{"SUBSYSTEM": "net", "INTERFACE": "eth0"}},
+	} {
+		if err := u.Apply(dir); err != nil {
+			t.Fatalf("Apply(%v) = %v", u, err)
+		}
+	}
+	checkNode(t, filepath.Join(dir, "sdb1"), unix.S_IFBLK, 0660, 8, 17)
+	checkNode(t, filepath.Join(dir, "bus/usb/001/002"), unix.S_IFCHR, 0664, 189, 1)
+	checkNode(t, filepath.Join(dir, "ttyS1"), unix.S_IFCHR, 0660, 4, 65)
+
+	rm := &Uevent{Action: "remove", Env: map[string]string{"SUBSYSTEM": "block", "MAJOR": "8", "MINOR": "17", "DEVNAME": "sdb1"}}
+	if err := rm.Apply(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "sdb1")); !os.IsNotExist(err) {
+		t.Errorf("sdb1 was not removed: %v", err)
+	}
+
+	bad := &Uevent{Action: "add", Env: map[string]string{"MAJOR": "x", "MINOR": "1", "DEVNAME": "bad"}}
+	if err := bad.Apply(dir); err == nil {
+		t.Errorf("Apply(%v) succeeded", bad)
+	}
+}
+
+func TestColdplug(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	sys, dev := filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+	for name, c := range map[string]string{
+		"dev/char/1:3/uevent":    "MAJOR=1\nMINOR=3\nDEVNAME=null\nDEVMODE=0666\n",
+		"dev/char/4:64/uevent":   "MAJOR=4\nMINOR=64\nDEVNAME=ttyS0\n",
+		"dev/block/8:0/uevent":   "MAJOR=8\nMINOR=0\nDEVNAME=sda\nDEVTYPE=disk\n",
+		"dev/block/259:0/uevent": "MAJOR=259\nMINOR=0\nDEVNAME=nvme0n1\n",
+	} {
+		p := filepath.Join(sys, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := unix.Umask(0)
+	defer unix.Umask(m)
+	if err := Coldplug(sys, dev); err != nil {
+		t.Fatal(err)
+	}
+	checkNode(t, filepath.Join(dev, "null"), unix.S_IFCHR, 0666, 1, 3)
+	checkNode(t, filepath.Join(dev, "ttyS0"), unix.S_IFCHR, 0660, 4, 64)
+	checkNode(t, filepath.Join(dev, "sda"), unix.S_IFBLK, 0660, 8, 0)
+	checkNode(t, filepath.Join(dev, "nvme0n1"), unix.S_IFBLK, 0660, 259, 0)
+}
+
+// datagrams returns each message in one Read, like a netlink socket.
+type datagrams []string
+
+func (d *datagrams) Read(b []byte) (int, error) {
+	if len(*d) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*d)[0])
+	*d = (*d)[1:]
+	return n, nil
+}
+
+func TestServe(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	d := &datagrams{
+		"add@/devices/virtual/block/loop1\x00ACTION=add\x00SUBSYSTEM=block\x00MAJOR=7\x00MINOR=1\x00DEVNAME=loop1",
+		"libudev\x00\xfe\xed\xca\xfe",
+		"garbage",
+		"add@/devices/virtual/mem/kmsg\x00ACTION=add\x00SUBSYSTEM=mem\x00MAJOR=1\x00MINOR=11\x00DEVNAME=kmsg\x00DEVMODE=0644",
+		"remove@/devices/virtual/block/loop1\x00ACTION=remove\x00SUBSYSTEM=block\x00MAJOR=7\x00MINOR=1\x00DEVNAME=loop1",
+	}
+	m := unix.Umask(0)
+	defer unix.Umask(m)
+	if err := Serve(d, dir); err != io.EOF {
+		t.Fatalf("Serve() = %v, want %v", err, io.EOF)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if strings.Join(names, " ") != "kmsg" {
+		t.Errorf("Serve() left %q, want kmsg", names)
+	}
+	checkNode(t, filepath.Join(dir, "kmsg"), unix.S_IFCHR, 0644, 1, 11)
+}
@@ -0,0 +1,21 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import "testing"
+
+func TestUnescapeMountInfo(t *testing.T) {
+	for in, want := range map[string]string{
+		`/boot`:                "/boot",
+		`/media/EFI\040System`: "/media/EFI System",
+		`/a\011b\134c\012`:     "/a\tb\\c\n",
+		`/trailing\04`:         `/trailing\04`,
+		`/not\999octal\`:       `/not\999octal\`,
+	} {
+		if got := UnescapeMountInfo(in); got != want {
+			t.Errorf("UnescapeMountInfo(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
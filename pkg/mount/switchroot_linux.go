@@ -0,0 +1,193 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountInfo lists the mounts of this process.
+var mountInfo = "/proc/self/mountinfo"
+
+// MountPoints returns the mount points of this process.
+func MountPoints() ([]string, error) {
+	f, err := os.Open(mountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// See proc(5): the mount point is the fifth field.
+	var points []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		points = append(points, UnescapeMountInfo(fields[4]))
+	}
+	return points, s.Err()
+}
+
+// under returns whether path is dir or in it.
+func under(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// movableMounts returns the mounts of points to move to newRoot: all but /,
+// newRoot, the mounts it is in and the mounts in it, dropping those in
+// another mount to move, which they move with.
+func movableMounts(points []string, newRoot string) []string {
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, p := range points {
+		if seen[p] || p == "/" || under(newRoot, p) || under(p, newRoot) {
+			continue
+		}
+		seen[p] = true
+		candidates = append(candidates, p)
+	}
+	var moves []string
+	for _, p := range candidates {
+		top := true
+		for _, q := range candidates {
+			if p != q && under(p, q) {
+				top = false
+				break
+			}
+		}
+		if top {
+			moves = append(moves, p)
+		}
+	}
+	return moves
+}
+
+// ensureMount bind-mounts dir on itself unless it is a mount point already.
+//
+// The root can only be moved or pivoted to a mount, and a directory on the
+// same file system as the old root, such as one in the initramfs, is not
+// one.
+func ensureMount(dir string, points []string) error {
+	for _, p := range points {
+		if p == dir {
+			return nil
+		}
+	}
+	if err := unix.Mount(dir, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mounting %s on itself: %v", dir, err)
+	}
+	return nil
+}
+
+// moveMountTo moves the mount at point to the same place under newRoot,
+// making the mount point if need be.
+func moveMountTo(point, newRoot string) error {
+	fi, err := os.Stat(point)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(newRoot, point)
+	if fi.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return unix.Mount(point, target, "", unix.MS_MOVE, "")
+}
+
+// resolveRoot returns the absolute path of root with symlinks resolved, as
+// mountinfo has it.
+func resolveRoot(root string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+// MoveRoot moves the mount at newRoot over / and makes it the root of this
+// process and its working directory.
+//
+// Unlike pivot_root(2), this works from an initramfs, whose root cannot be
+// pivoted away from. The old root stays underneath.
+func MoveRoot(newRoot string) error {
+	if err := os.Chdir(newRoot); err != nil {
+		return err
+	}
+	if err := unix.Mount(newRoot, "/", "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("moving %s to /: %v", newRoot, err)
+	}
+	if err := unix.Chroot("."); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+// SwitchRoot makes newRoot the root of this process, which need not be a
+// mount point.
+//
+// The mounts of the old root move to the same places in newRoot. Only the
+// mounts that cannot move are left behind, detached. Unlike switch_root,
+// the files of the old root are kept.
+func SwitchRoot(newRoot string) error {
+	newRoot, err := resolveRoot(newRoot)
+	if err != nil {
+		return err
+	}
+	if newRoot == "/" {
+		return fmt.Errorf("new root is already /")
+	}
+	points, err := MountPoints()
+	if err != nil {
+		return err
+	}
+	if err := ensureMount(newRoot, points); err != nil {
+		return err
+	}
+	for _, p := range movableMounts(points, newRoot) {
+		if err := moveMountTo(p, newRoot); err != nil {
+			log.Printf("switch root: moving %s: %v; detaching it", p, err)
+			if err := unix.Unmount(p, unix.MNT_DETACH); err != nil {
+				log.Printf("switch root: detaching %s: %v", p, err)
+			}
+		}
+	}
+	return MoveRoot(newRoot)
+}
+
+// PivotRoot makes newRoot the root, with the old root at putOld, which must
+// be in newRoot. newRoot need not be a mount point.
+func PivotRoot(newRoot, putOld string) error {
+	newRoot, err := resolveRoot(newRoot)
+	if err != nil {
+		return err
+	}
+	points, err := MountPoints()
+	if err != nil {
+		return err
+	}
+	if err := ensureMount(newRoot, points); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(newRoot, putOld); err != nil {
+		return fmt.Errorf("pivot_root %s %s: %v", newRoot, putOld, err)
+	}
+	return os.Chdir("/")
+}
@@ -0,0 +1,28 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMovableMounts(t *testing.T) {
+	points := []string{"/", "/proc", "/sys", "/sys/fs/cgroup", "/mnt", "/mnt/root", "/mnt/root/boot", "/dev", "/dev/pts", "/proc", "/run2"}
+	got := movableMounts(points, "/mnt/root")
+	want := []string{"/proc", "/sys", "/dev", "/run2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("movableMounts() = %q, want %q", got, want)
+	}
+	if got := movableMounts([]string{"/", "/run", "/runner"}, "/run/root"); !reflect.DeepEqual(got, []string{"/runner"}) {
+		t.Errorf("movableMounts() = %q, want [/runner]", got)
+	}
+}
+
+func TestSwitchRootToRoot(t *testing.T) {
+	if err := SwitchRoot("/"); err == nil {
+		t.Errorf("SwitchRoot(/) = nil, want error")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BOOTP, as in RFC 951, is what DHCP grew out of. Some old PXE ROMs and
+// boot servers speak nothing else.
+const (
+	bootpRequest = 1
+	bootpReply   = 2
+
+	// bootpLen is the length of a BOOTP message with its 64-byte vendor
+	// area.
+	bootpLen = 300
+
+	// Offsets of the fields of a BOOTP message.
+	bootpXID    = 4
+	bootpFlags  = 10
+	bootpYIAddr = 16
+	bootpSIAddr = 20
+	bootpGIAddr = 24
+	bootpCHAddr = 28
+	bootpSName  = 44
+	bootpFile   = 108
+	bootpVend   = 236
+
+	bootpServerPort = 67
+	bootpClientPort = 68
+)
+
+// bootpCookie starts a vendor area holding RFC 1048 options.
+var bootpCookie = []byte{99, 130, 83, 99}
+
+var (
+	// bootpTimeout is how long to wait for a reply to each request.
+	bootpTimeout = 4 * time.Second
+	// bootpRetries is how many requests are sent before giving up.
+	bootpRetries = 3
+)
+
+// BOOTPReply is the configuration handed out by a BOOTP server.
+type BOOTPReply struct {
+	// IP is the address assigned to the client.
+	IP net.IP
+	// Netmask is the subnet mask, if the server sent one.
+	Netmask net.IPMask
+	// Gateway is the first router the server sent or, if it sent none,
+	// the BOOTP relay the reply came through. It may be nil.
+	Gateway net.IP
+	// ServerIP is the address of the boot server.
+	ServerIP net.IP
+	// ServerName is the optional host name of the boot server.
+	ServerName string
+	// BootFile is the path of the boot file on the server.
+	BootFile string
+}
+
+// BOOTPDiscover broadcasts a BOOTP request on iface, which must be up, and
+// returns the first reply to it.
+func BOOTPDiscover(iface string) (*BOOTPReply, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", bootpClientPort))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dest := &net.UDPAddr{IP: net.IPv4bcast, Port: bootpServerPort}
+	r, err := bootpExchange(conn, dest, ifi.HardwareAddr)
+	if err != nil {
+		return nil, fmt.Errorf("BOOTP on %s: %v", iface, err)
+	}
+	return r, nil
+}
+
+// bootpExchange sends BOOTP requests for mac on conn to dest until one is
+// answered.
+func bootpExchange(conn net.PacketConn, dest net.Addr, mac net.HardwareAddr) (*BOOTPReply, error) {
+	if len(mac) == 0 || len(mac) > 16 {
+		return nil, fmt.Errorf("hardware address %q cannot be sent over BOOTP", mac)
+	}
+	var xid [4]byte
+	if _, err := rand.Read(xid[:]); err != nil {
+		return nil, err
+	}
+	req := bootpRequestPacket(xid, mac)
+	buf := make([]byte, 1500)
+	for try := 0; try < bootpRetries; try++ {
+		if _, err := conn.WriteTo(req, dest); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(bootpTimeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			p := buf[:n]
+			if len(p) < bootpVend || p[0] != bootpReply || !bytes.Equal(p[bootpXID:bootpXID+4], xid[:]) ||
+				!bytes.Equal(p[bootpCHAddr:bootpCHAddr+len(mac)], mac) {
+				continue
+			}
+			r, err := parseBOOTPReply(p)
+			if err != nil {
+				return nil, err
+			}
+			// Servers leave siaddr unset when they boot the client
+			// themselves.
+			if r.ServerIP.IsUnspecified() {
+				if u, ok := from.(*net.UDPAddr); ok {
+					r.ServerIP = u.IP.To4()
+				}
+			}
+			return r, nil
+		}
+	}
+	return nil, errors.New("no reply")
+}
+
+// bootpRequestPacket returns a BOOTREQUEST with transaction ID xid from
+// the client with hardware address mac. It asks for a broadcast reply, as
+// the client has no address yet, and for RFC 1048 vendor options.
+func bootpRequestPacket(xid [4]byte, mac net.HardwareAddr) []byte {
+	p := make([]byte, bootpLen)
+	p[0] = bootpRequest
+	// Hardware type: Ethernet.
+	p[1] = 1
+	p[2] = byte(len(mac))
+	copy(p[bootpXID:], xid[:])
+	binary.BigEndian.PutUint16(p[bootpFlags:], 0x8000)
+	copy(p[bootpCHAddr:], mac)
+	copy(p[bootpVend:], bootpCookie)
+	p[bootpVend+len(bootpCookie)] = 255
+	return p
+}
+
+// parseBOOTPReply decodes the BOOTREPLY p. The vendor area is read if it
+// starts with the RFC 1048 magic cookie and ignored otherwise.
+func parseBOOTPReply(p []byte) (*BOOTPReply, error) {
+	if len(p) < bootpVend {
+		return nil, fmt.Errorf("BOOTP reply of %d bytes is too short", len(p))
+	}
+	r := &BOOTPReply{
+		IP:         net.IP(append([]byte(nil), p[bootpYIAddr:bootpYIAddr+4]...)),
+		ServerIP:   net.IP(append([]byte(nil), p[bootpSIAddr:bootpSIAddr+4]...)),
+		ServerName: cString(p[bootpSName:bootpFile]),
+		BootFile:   cString(p[bootpFile:bootpVend]),
+	}
+	if gw := net.IP(p[bootpGIAddr : bootpGIAddr+4]); !gw.IsUnspecified() {
+		r.Gateway = append(net.IP(nil), gw...)
+	}
+	vend := p[bootpVend:]
+	if !bytes.HasPrefix(vend, bootpCookie) {
+		return r, nil
+	}
+	for opts := vend[len(bootpCookie):]; len(opts) > 0; {
+		code := opts[0]
+		if code == 255 {
+			break
+		}
+		if code == 0 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("BOOTP option %d is truncated", code)
+		}
+		val := opts[2 : 2+opts[1]]
+		opts = opts[2+opts[1]:]
+		switch code {
+		case 1:
+			if len(val) == 4 {
+				r.Netmask = append(net.IPMask(nil), val...)
+			}
+		case 3:
+			if len(val) >= 4 {
+				r.Gateway = append(net.IP(nil), val[:4]...)
+			}
+		}
+	}
+	return r, nil
+}
+
+// cString returns b up to its first NUL.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
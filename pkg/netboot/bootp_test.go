@@ -0,0 +1,207 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testMAC = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// bootpServer answers BOOTP requests on a local UDP socket with the reply
+// made by answer, which may return nil to drop a request.
+func bootpServer(t *testing.T, answer func(req []byte) [][]byte) (*net.UDPAddr, func()) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, r := range answer(append([]byte(nil), buf[:n]...)) {
+				conn.WriteTo(r, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), func() { conn.Close() }
+}
+
+// bootpReplyTo returns a reply to req assigning 10.0.0.2 from siaddr with
+// the vendor area vend.
+func bootpReplyTo(req []byte, siaddr net.IP, vend []byte) []byte {
+	r := make([]byte, bootpLen)
+	copy(r, req[:bootpVend])
+	r[0] = bootpReply
+	copy(r[bootpYIAddr:], net.IPv4(10, 0, 0, 2).To4())
+	copy(r[bootpSIAddr:], siaddr.To4())
+	copy(r[bootpSName:], "bootserver")
+	copy(r[bootpFile:], "/pxelinux.0")
+	copy(r[bootpVend:], vend)
+	return r
+}
+
+func withBOOTPTimeout(d time.Duration) func() {
+	old := bootpTimeout
+	bootpTimeout = d
+	return func() { bootpTimeout = old }
+}
+
+func TestBOOTPExchange(t *testing.T) {
+	defer withBOOTPTimeout(100 * time.Millisecond)()
+
+	rfc1048 := append(append([]byte(nil), bootpCookie...),
+		0, // Pad.
+		1, 4, 255, 255, 255, 0,
+		3, 8, 10, 0, 0, 254, 10, 0, 0, 253,
+		255)
+	for _, tt := range []struct {
+		name   string
+		answer func(req []byte) [][]byte
+		want   *BOOTPReply
+	}{
+		{
+			name: "RFC 1048 vendor area",
+			answer: func(req []byte) [][]byte {
+				return [][]byte{bootpReplyTo(req, net.IPv4(10, 0, 0, 1), rfc1048)}
+			},
+			want: &BOOTPReply{
+				IP:         net.IPv4(10, 0, 0, 2).To4(),
+				Netmask:    net.IPv4Mask(255, 255, 255, 0),
+				Gateway:    net.IPv4(10, 0, 0, 254).To4(),
+				ServerIP:   net.IPv4(10, 0, 0, 1).To4(),
+				ServerName: "bootserver",
+				BootFile:   "/pxelinux.0",
+			},
+		},
+		{
+			name: "plain BOOTP",
+			answer: func(req []byte) [][]byte {
+				r := bootpReplyTo(req, net.IPv4(10, 0, 0, 1), []byte("CMU vendor data"))
+				copy(r[bootpGIAddr:], net.IPv4(10, 0, 0, 253).To4())
+				return [][]byte{r}
+			},
+			want: &BOOTPReply{
+				IP:         net.IPv4(10, 0, 0, 2).To4(),
+				Gateway:    net.IPv4(10, 0, 0, 253).To4(),
+				ServerIP:   net.IPv4(10, 0, 0, 1).To4(),
+				ServerName: "bootserver",
+				BootFile:   "/pxelinux.0",
+			},
+		},
+		{
+			name: "server is the sender",
+			answer: func(req []byte) [][]byte {
+				return [][]byte{bootpReplyTo(req, net.IPv4zero, nil)}
+			},
+			want: &BOOTPReply{
+				IP:         net.IPv4(10, 0, 0, 2).To4(),
+				ServerIP:   net.IPv4(127, 0, 0, 1).To4(),
+				ServerName: "bootserver",
+				BootFile:   "/pxelinux.0",
+			},
+		},
+		{
+			name: "replies to others are ignored",
+			answer: func(req []byte) [][]byte {
+				otherXID := bootpReplyTo(req, net.IPv4(10, 0, 0, 9), nil)
+				otherXID[bootpXID]++
+				otherMAC := bootpReplyTo(req, net.IPv4(10, 0, 0, 9), nil)
+				otherMAC[bootpCHAddr]++
+				request := bootpReplyTo(req, net.IPv4(10, 0, 0, 9), nil)
+				request[0] = bootpRequest
+				return [][]byte{otherXID, otherMAC, request, []byte("short"), bootpReplyTo(req, net.IPv4(10, 0, 0, 1), nil)}
+			},
+			want: &BOOTPReply{
+				IP:         net.IPv4(10, 0, 0, 2).To4(),
+				ServerIP:   net.IPv4(10, 0, 0, 1).To4(),
+				ServerName: "bootserver",
+				BootFile:   "/pxelinux.0",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var reqs [][]byte
+			addr, stop := bootpServer(t, func(req []byte) [][]byte {
+				reqs = append(reqs, req)
+				// Drop the first request to check that it is
+				// sent again.
+				if len(reqs) == 1 {
+					return nil
+				}
+				return tt.answer(req)
+			})
+			defer stop()
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			got, err := bootpExchange(conn, addr, testMAC)
+			if err != nil {
+				t.Fatalf("bootpExchange() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bootpExchange() = %+v, want %+v", got, tt.want)
+			}
+
+			if len(reqs) != 2 {
+				t.Fatalf("got %d requests, want 2", len(reqs))
+			}
+			req := reqs[1]
+			if len(req) != bootpLen || req[0] != bootpRequest || req[1] != 1 || int(req[2]) != len(testMAC) {
+				t.Errorf("request header is % x, want a BOOTREQUEST from an Ethernet address", req[:4])
+			}
+			if !bytes.Equal(req[bootpCHAddr:bootpCHAddr+len(testMAC)], testMAC) {
+				t.Errorf("request chaddr is % x, want %v", req[bootpCHAddr:bootpCHAddr+16], testMAC)
+			}
+			if req[bootpFlags]&0x80 == 0 {
+				t.Errorf("request does not ask for a broadcast reply")
+			}
+			if !bytes.HasPrefix(req[bootpVend:], bootpCookie) {
+				t.Errorf("request vendor area is % x, want the RFC 1048 cookie", req[bootpVend:bootpVend+8])
+			}
+			if !bytes.Equal(req[bootpXID:bootpXID+4], reqs[0][bootpXID:bootpXID+4]) {
+				t.Errorf("retransmitted request has a new transaction ID")
+			}
+		})
+	}
+}
+
+func TestBOOTPExchangeErrors(t *testing.T) {
+	defer withBOOTPTimeout(20 * time.Millisecond)()
+
+	addr, stop := bootpServer(t, func(req []byte) [][]byte {
+		if bytes.Equal(req[bootpCHAddr:bootpCHAddr+len(testMAC)], testMAC) {
+			return nil
+		}
+		truncated := bootpReplyTo(req, net.IPv4(10, 0, 0, 1), append(append([]byte(nil), bootpCookie...), 3, 200))
+		return [][]byte{truncated}
+	})
+	defer stop()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if r, err := bootpExchange(conn, addr, testMAC); err == nil {
+		t.Errorf("bootpExchange() without a reply = %+v, want error", r)
+	}
+	if r, err := bootpExchange(conn, addr, net.HardwareAddr{1, 2, 3, 4, 5, 6}); err == nil {
+		t.Errorf("bootpExchange() with a truncated option = %+v, want error", r)
+	}
+	if r, err := bootpExchange(conn, addr, nil); err == nil {
+		t.Errorf("bootpExchange() without a hardware address = %+v, want error", r)
+	}
+}
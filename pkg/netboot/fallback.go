@@ -0,0 +1,128 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"pack.ag/tftp"
+)
+
+// DefaultFallbackTimeout is how long FallbackFetcher waits for the HTTP
+// server unless Timeout is set.
+const DefaultFallbackTimeout = 5 * time.Second
+
+// tftpPort is the port of the TFTP servers found over BOOTP.
+var tftpPort = "69"
+
+// FallbackFetcher fetches files over HTTP and, if the HTTP server cannot be
+// reached, over TFTP and then from a boot server found over BOOTP.
+type FallbackFetcher struct {
+	// HTTP is tried first, unless it is nil.
+	HTTP *HTTPBootClient
+	// TFTP is tried if HTTP fails with a network error or times out.
+	TFTP *TFTPClient
+	// BOOTPInterface, if not empty, is the interface to look for a boot
+	// server on over BOOTP if TFTP cannot be reached either. Files are
+	// then fetched from the server over TFTP.
+	BOOTPInterface string
+	// Timeout bounds waiting for the HTTP server to respond. If it is
+	// 0, DefaultFallbackTimeout is used.
+	Timeout time.Duration
+
+	// discover, if not nil, is used instead of BOOTPDiscover.
+	discover func(iface string) (*BOOTPReply, error)
+	// bootp is the boot server found over BOOTP, so that it is only
+	// looked for once.
+	bootp *TFTPClient
+}
+
+// Fetch returns the contents of the file at path on the HTTP server or,
+// failing that, the TFTP server or the BOOTP boot server. Errors from a
+// server that responds, such as a missing file, are returned rather than
+// trying the next one.
+func (f *FallbackFetcher) Fetch(path string) (io.ReaderAt, error) {
+	if f.HTTP != nil {
+		timeout := f.Timeout
+		if timeout == 0 {
+			timeout = DefaultFallbackTimeout
+		}
+		r, err := f.HTTP.fetch(path, timeout)
+		if err == nil {
+			log.Printf("Fetched %s over HTTP", path)
+			return r, nil
+		}
+		if _, ok := err.(net.Error); !ok || (f.TFTP == nil && f.BOOTPInterface == "") {
+			return nil, err
+		}
+		log.Printf("Fetching %s over HTTP failed, trying TFTP: %v", path, err)
+	}
+	if f.TFTP != nil {
+		r, err := f.TFTP.Fetch(path)
+		if err == nil {
+			log.Printf("Fetched %s over TFTP", path)
+			return r, nil
+		}
+		if tftp.IsRemoteError(err) || f.BOOTPInterface == "" {
+			return nil, err
+		}
+		log.Printf("Fetching %s over TFTP failed, trying BOOTP: %v", path, err)
+	}
+	if f.BOOTPInterface == "" {
+		return nil, fmt.Errorf("no boot server to fetch %s from", path)
+	}
+	c, err := f.bootpServer()
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetched %s from the BOOTP boot server", path)
+	return r, nil
+}
+
+// bootpServer returns a client of the boot server on BOOTPInterface.
+func (f *FallbackFetcher) bootpServer() (*TFTPClient, error) {
+	if f.bootp != nil {
+		return f.bootp, nil
+	}
+	discover := f.discover
+	if discover == nil {
+		discover = BOOTPDiscover
+	}
+	r, err := discover(f.BOOTPInterface)
+	if err != nil {
+		return nil, err
+	}
+	if r.ServerIP == nil || r.ServerIP.IsUnspecified() {
+		return nil, fmt.Errorf("BOOTP reply on %s names no boot server", f.BOOTPInterface)
+	}
+	log.Printf("BOOTP on %s: address %v, boot server %v, boot file %q", f.BOOTPInterface, r.IP, r.ServerIP, r.BootFile)
+	f.bootp = NewTFTPClient(net.JoinHostPort(r.ServerIP.String(), tftpPort))
+	return f.bootp, nil
+}
+
+// LinuxImage fetches the kernel and initrd at the given paths and returns
+// them as a LinuxImage booting with cmdline. The initrd is optional.
+func (f *FallbackFetcher) LinuxImage(kernelPath, initrdPath, cmdline string) (*boot.LinuxImage, error) {
+	kernel, err := f.Fetch(kernelPath)
+	if err != nil {
+		return nil, fmt.Errorf("fetching kernel: %v", err)
+	}
+	var initrd io.ReaderAt
+	if initrdPath != "" {
+		if initrd, err = f.Fetch(initrdPath); err != nil {
+			return nil, fmt.Errorf("fetching initrd: %v", err)
+		}
+	}
+	return boot.NewLinuxImage(kernel, initrd, cmdline), nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"pack.ag/tftp"
+)
+
+// tftpServer serves files on a local port and returns its address.
+func tftpServer(t *testing.T, files map[string]string) (string, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tftp.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(tftp.ReadHandlerFunc(func(r tftp.ReadRequest) {
+		c, ok := files[r.Name()]
+		if !ok {
+			r.WriteError(tftp.ErrCodeFileNotFound, "no such file")
+			return
+		}
+		r.WriteSize(int64(len(c)))
+		r.Write([]byte(c))
+	}))
+	go s.Serve(conn)
+	return conn.LocalAddr().String(), func() { s.Close() }
+}
+
+// httpServer returns a client of a server running h, which is stopped by the
+// returned function.
+func httpServer(t *testing.T, h http.HandlerFunc) (*HTTPBootClient, func()) {
+	s := httptest.NewServer(h)
+	c, err := NewHTTPBootClient(s.URL + "/boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s.Close
+}
+
+func readString(t *testing.T, f *FallbackFetcher, path string) string {
+	r, err := f.Fetch(path)
+	if err != nil {
+		t.Fatalf("Fetch(%q) = %v", path, err)
+	}
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFallbackFetcher(t *testing.T) {
+	addr, stop := tftpServer(t, map[string]string{"vmlinuz": "tftp kernel", "initrd": "tftp initrd"})
+	defer stop()
+	tc := NewTFTPClient(addr)
+
+	t.Run("HTTP works", func(t *testing.T) {
+		hc, stop := httpServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/boot/vmlinuz" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte("http kernel"))
+		})
+		defer stop()
+		f := &FallbackFetcher{HTTP: hc, TFTP: tc}
+		if got := readString(t, f, "/vmlinuz"); got != "http kernel" {
+			t.Errorf("Fetch() = %q, want the HTTP kernel", got)
+		}
+		// The server is up, so a missing file is not retried.
+		if _, err := f.Fetch("/initrd"); err == nil {
+			t.Errorf("Fetch() of a file missing from the HTTP server succeeded")
+		}
+	})
+
+	t.Run("HTTP down", func(t *testing.T) {
+		hc, stop := httpServer(t, nil)
+		stop()
+		f := &FallbackFetcher{HTTP: hc, TFTP: tc}
+		li, err := f.LinuxImage("/vmlinuz", "/initrd", "console=ttyS0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, r := range map[string]io.ReaderAt{"tftp kernel": li.Kernel, "tftp initrd": li.Initrd} {
+			b, err := uio.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != name {
+				t.Errorf("got %q, want %q", b, name)
+			}
+		}
+		if li.Cmdline != "console=ttyS0" {
+			t.Errorf("Cmdline = %q, want console=ttyS0", li.Cmdline)
+		}
+	})
+
+	t.Run("HTTP hangs", func(t *testing.T) {
+		done := make(chan struct{})
+		hc, stop := httpServer(t, func(w http.ResponseWriter, r *http.Request) {
+			<-done
+		})
+		defer stop()
+		defer close(done)
+		f := &FallbackFetcher{HTTP: hc, TFTP: tc, Timeout: 50 * time.Millisecond}
+		start := time.Now()
+		if got := readString(t, f, "/vmlinuz"); got != "tftp kernel" {
+			t.Errorf("Fetch() = %q, want the TFTP kernel", got)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("Fetch() took %v, want about the timeout", d)
+		}
+	})
+
+	t.Run("BOOTP", func(t *testing.T) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldPort := tftpPort
+		tftpPort = port
+		defer func() { tftpPort = oldPort }()
+
+		hc, stop := httpServer(t, nil)
+		stop()
+		var discovered []string
+		f := &FallbackFetcher{
+			HTTP:           hc,
+			TFTP:           NewTFTPClient("127.0.0.1:1", tftp.ClientRetransmit(1)),
+			BOOTPInterface: "eth0",
+			discover: func(iface string) (*BOOTPReply, error) {
+				discovered = append(discovered, iface)
+				return &BOOTPReply{IP: net.IPv4(10, 0, 0, 2), ServerIP: net.IPv4(127, 0, 0, 1)}, nil
+			},
+		}
+		li, err := f.LinuxImage("/vmlinuz", "/initrd", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, r := range map[string]io.ReaderAt{"tftp kernel": li.Kernel, "tftp initrd": li.Initrd} {
+			b, err := uio.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != name {
+				t.Errorf("got %q, want %q", b, name)
+			}
+		}
+		if len(discovered) != 1 || discovered[0] != "eth0" {
+			t.Errorf("BOOTP discovery ran on %v, want once on eth0", discovered)
+		}
+
+		// A TFTP server that responds is not skipped.
+		f = &FallbackFetcher{TFTP: tc, BOOTPInterface: "eth0", discover: f.discover}
+		if _, err := f.Fetch("/missing"); err == nil {
+			t.Errorf("Fetch() of a file missing from the TFTP server succeeded")
+		}
+		if len(discovered) != 1 {
+			t.Errorf("BOOTP discovery ran although the TFTP server responded")
+		}
+
+		f = &FallbackFetcher{BOOTPInterface: "eth0", discover: func(string) (*BOOTPReply, error) {
+			return &BOOTPReply{IP: net.IPv4(10, 0, 0, 2)}, nil
+		}}
+		if _, err := f.Fetch("/vmlinuz"); err == nil {
+			t.Errorf("Fetch() with a BOOTP reply naming no server succeeded")
+		}
+	})
+
+	t.Run("both down", func(t *testing.T) {
+		hc, stop := httpServer(t, nil)
+		stop()
+		f := &FallbackFetcher{HTTP: hc, TFTP: tc}
+		if li, err := f.LinuxImage("/missing", "", ""); err == nil {
+			t.Errorf("LinuxImage() = %v, want error", li)
+		}
+		if _, err := (&FallbackFetcher{}).Fetch("/vmlinuz"); err == nil {
+			t.Errorf("Fetch() without servers succeeded")
+		}
+	})
+}
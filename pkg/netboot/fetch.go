@@ -0,0 +1,195 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netboot fetches kernels and initrds from boot servers.
+package netboot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"pack.ag/tftp"
+)
+
+// HTTPBootClient fetches files from an HTTP boot server.
+type HTTPBootClient struct {
+	base   *url.URL
+	client *http.Client
+
+	// tls, if set, is the TLS configuration from the TLS options.
+	tls *tls.Config
+	// customClient is whether client was given by WithHTTPClient.
+	customClient bool
+	// err is the first error of an option.
+	err error
+}
+
+// HTTPBootClientOption configures an HTTPBootClient.
+type HTTPBootClientOption func(*HTTPBootClient)
+
+// WithHTTPClient makes an HTTPBootClient send its requests with client, for
+// example one whose transport dials through a tunnel.
+func WithHTTPClient(client *http.Client) HTTPBootClientOption {
+	return func(c *HTTPBootClient) {
+		c.client = client
+		c.customClient = true
+	}
+}
+
+func (c *HTTPBootClient) tlsConfig() *tls.Config {
+	if c.tls == nil {
+		c.tls = &tls.Config{}
+	}
+	return c.tls
+}
+
+// WithClientCert makes an HTTPBootClient present the certificate certPEM,
+// whose private key is keyPEM, to servers that ask for one.
+func WithClientCert(certPEM, keyPEM []byte) HTTPBootClientOption {
+	return func(c *HTTPBootClient) {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			if c.err == nil {
+				c.err = fmt.Errorf("client certificate: %v", err)
+			}
+			return
+		}
+		cfg := c.tlsConfig()
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+}
+
+// WithRootCA makes an HTTPBootClient only trust servers whose certificates
+// are signed by the CA certificates in caPEM, rather than the system's.
+func WithRootCA(caPEM []byte) HTTPBootClientOption {
+	return func(c *HTTPBootClient) {
+		cfg := c.tlsConfig()
+		if cfg.RootCAs == nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+		if !cfg.RootCAs.AppendCertsFromPEM(caPEM) && c.err == nil {
+			c.err = fmt.Errorf("no CA certificate found in the root CA PEM")
+		}
+	}
+}
+
+// WithInsecureSkipVerify makes an HTTPBootClient trust any server.
+//
+// Deprecated: it is only meant for development, as anyone in the path to the
+// boot server can then serve the kernel. Use WithRootCA instead.
+func WithInsecureSkipVerify() HTTPBootClientOption {
+	return func(c *HTTPBootClient) {
+		log.Printf("Warning: not verifying the certificate of boot server %s; do not use WithInsecureSkipVerify in production", c.base.Host)
+		c.tlsConfig().InsecureSkipVerify = true
+	}
+}
+
+// NewHTTPBootClient returns a client that fetches paths relative to the URL
+// base, such as http://10.0.0.1/boot/.
+func NewHTTPBootClient(base string, opts ...HTTPBootClientOption) (*HTTPBootClient, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("boot server URL %q is not HTTP", base)
+	}
+	c := &HTTPBootClient{base: u, client: &http.Client{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.tls != nil {
+		if c.customClient {
+			return nil, fmt.Errorf("WithHTTPClient cannot be combined with TLS options; configure the TLS of its transport")
+		}
+		c.client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.tls,
+		}}
+	}
+	return c, nil
+}
+
+// resolve returns the URL of p on the server.
+func (c *HTTPBootClient) resolve(p string) string {
+	u := *c.base
+	u.Path = path.Join(u.Path, p)
+	return u.String()
+}
+
+// Fetch returns the contents of the file at path on the server. The file is
+// downloaded as it is read.
+func (c *HTTPBootClient) Fetch(path string) (io.ReaderAt, error) {
+	return c.fetch(path, 0)
+}
+
+// fetch is Fetch, failing if no response arrives within timeout, if it is
+// not 0. The timeout does not apply to reading the file.
+func (c *HTTPBootClient) fetch(path string, timeout time.Duration) (io.ReaderAt, error) {
+	req, err := http.NewRequest("GET", c.resolve(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	var t *time.Timer
+	if timeout != 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		t = time.AfterFunc(timeout, cancel)
+		req = req.WithContext(ctx)
+	}
+	resp, err := c.client.Do(req)
+	if t != nil && !t.Stop() {
+		// The request was canceled or, if the response arrived just
+		// as the timer fired, reading the body would fail.
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: fmt.Errorf("no response after %v", timeout)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: HTTP status %d, want 200", req.URL, resp.StatusCode)
+	}
+	return uio.NewCachingReader(resp.Body), nil
+}
+
+// TFTPClient fetches files from a TFTP server.
+type TFTPClient struct {
+	server string
+	opts   []tftp.ClientOpt
+}
+
+// NewTFTPClient returns a client that fetches files from server, which is a
+// host optionally followed by a port.
+func NewTFTPClient(server string, opts ...tftp.ClientOpt) *TFTPClient {
+	return &TFTPClient{server: server, opts: opts}
+}
+
+// Fetch returns the contents of the file at path on the server.
+func (c *TFTPClient) Fetch(path string) (io.ReaderAt, error) {
+	client, err := tftp.NewClient(c.opts...)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "tftp", Host: c.server, Path: path}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return uio.NewCachingReader(resp), nil
+}
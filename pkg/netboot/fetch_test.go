@@ -0,0 +1,135 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// testCert returns a certificate for cn signed by parent, or self-signed if
+// parent is nil, with its key.
+func testCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestHTTPBootClientMutualTLS(t *testing.T) {
+	ca, caKey, _, _ := testCert(t, "client CA", nil, nil)
+	_, _, clientPEM, clientKeyPEM := testCert(t, "client0", ca, caKey)
+	_, _, otherPEM, otherKeyPEM := testCert(t, "impostor", nil, nil)
+
+	var clients []string
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients = append(clients, r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.Write([]byte("kernel"))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	s.StartTLS()
+	defer s.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+
+	fetch := func(opts ...HTTPBootClientOption) error {
+		c, err := NewHTTPBootClient(s.URL+"/boot", opts...)
+		if err != nil {
+			t.Fatalf("NewHTTPBootClient() = %v", err)
+		}
+		r, err := c.Fetch("vmlinuz")
+		if err != nil {
+			return err
+		}
+		b, err := uio.ReadAll(r)
+		if err == nil && string(b) != "kernel" {
+			t.Errorf("Fetch() = %q, want kernel", b)
+		}
+		return err
+	}
+
+	if err := fetch(WithClientCert(clientPEM, clientKeyPEM), WithRootCA(serverCA)); err != nil {
+		t.Errorf("Fetch() with client certificate = %v", err)
+	}
+	if err := fetch(WithClientCert(clientPEM, clientKeyPEM), WithInsecureSkipVerify()); err != nil {
+		t.Errorf("Fetch() skipping verification = %v", err)
+	}
+	if len(clients) != 2 || clients[0] != "client0" || clients[1] != "client0" {
+		t.Errorf("server saw clients %q, want client0 twice", clients)
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts []HTTPBootClientOption
+	}{
+		{"no client certificate", []HTTPBootClientOption{WithRootCA(serverCA)}},
+		{"client certificate of another CA", []HTTPBootClientOption{WithClientCert(otherPEM, otherKeyPEM), WithRootCA(serverCA)}},
+		{"server of another CA", []HTTPBootClientOption{WithClientCert(clientPEM, clientKeyPEM), WithRootCA(otherPEM)}},
+	} {
+		if err := fetch(tt.opts...); err == nil {
+			t.Errorf("Fetch() with %s = nil, want error", tt.name)
+		}
+	}
+	if len(clients) != 2 {
+		t.Errorf("server served %q, want only the first two", clients)
+	}
+}
+
+func TestHTTPBootClientOptionErrors(t *testing.T) {
+	_, _, certPEM, keyPEM := testCert(t, "client", nil, nil)
+	for _, tt := range []struct {
+		name string
+		opts []HTTPBootClientOption
+	}{
+		{"bad certificate", []HTTPBootClientOption{WithClientCert([]byte("cert"), keyPEM)}},
+		{"mismatched key", []HTTPBootClientOption{WithClientCert(certPEM, []byte("key"))}},
+		{"bad root CA", []HTTPBootClientOption{WithRootCA([]byte("ca"))}},
+		{"HTTP client and TLS", []HTTPBootClientOption{WithHTTPClient(&http.Client{}), WithRootCA(certPEM)}},
+	} {
+		if _, err := NewHTTPBootClient("https://10.0.0.1/boot", tt.opts...); err == nil {
+			t.Errorf("NewHTTPBootClient() with %s = nil, want error", tt.name)
+		}
+	}
+}
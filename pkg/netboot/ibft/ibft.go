@@ -0,0 +1,264 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ibft reads the iSCSI Boot Firmware Table and logs in to the boot
+// target it describes.
+//
+// See https://msdn.microsoft.com/en-us/library/dn802095.aspx for the table
+// and RFC 7143 for iSCSI.
+package ibft
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the iSCSI port targets listen on if the table has none.
+const DefaultPort = 3260
+
+// sysfs is where sysfs is mounted. Tests change it.
+var sysfs = "/sys"
+
+// Flags of iBFT structures.
+const (
+	flagValid    = 1 << 0
+	flagSelected = 1 << 1
+)
+
+// CHAP types of iBFT targets.
+const (
+	chapNone   = 0
+	chapOneWay = 1
+)
+
+var (
+	// ErrNoIBFT is returned when the firmware did not provide an iBFT.
+	ErrNoIBFT = errors.New("no iBFT in /sys/firmware/ibft")
+
+	// ErrNoTarget is returned when the iBFT has no valid target.
+	ErrNoTarget = errors.New("no valid iSCSI target in the iBFT")
+)
+
+// IBFTData is the boot target of an iBFT, and the NIC to reach it with.
+type IBFTData struct {
+	// InitiatorName is the IQN to log in with.
+	InitiatorName string
+
+	// MAC is the address of the NIC the firmware used.
+	MAC net.HardwareAddr
+	// IP is the address and netmask of the NIC, which is nil if the
+	// firmware used DHCP and did not record the lease.
+	IP      *net.IPNet
+	Gateway net.IP
+
+	TargetIP   net.IP
+	TargetPort int
+	TargetName string
+	LUN        uint64
+
+	// CHAPName and CHAPSecret are set if the target needs CHAP.
+	CHAPName   string
+	CHAPSecret string
+}
+
+// attrs reads the sysfs attributes in dir. Missing ones, which the kernel
+// hides when they are zero, read as empty.
+type attrs string
+
+func (a attrs) String(name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(string(a), name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (a attrs) Int(name string) (int, error) {
+	s := a.String(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", filepath.Join(string(a), name), err)
+	}
+	return n, nil
+}
+
+func (a attrs) IP(name string) (net.IP, error) {
+	s := a.String(name)
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%s: bad IP address %q", filepath.Join(string(a), name), s)
+	}
+	if ip.IsUnspecified() {
+		return nil, nil
+	}
+	return ip, nil
+}
+
+// parseLUN decodes the first level of a SCSI LUN as the kernel prints it.
+//
+// The kernel formats each of the 8 bytes with %x, so bytes do not have a
+// fixed width. In practice only the second byte, which holds the LUN in
+// peripheral addressing, is over 15; that is what we assume if the length
+// does not tell.
+func parseLUN(s string) (uint64, error) {
+	var b [8]byte
+	switch {
+	case s == "":
+		return 0, nil
+	case len(s) == 16:
+		for i := range b {
+			n, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+			if err != nil {
+				return 0, fmt.Errorf("bad LUN %q", s)
+			}
+			b[i] = byte(n)
+		}
+	case len(s) >= 8 && len(s) <= 9:
+		digits := []string{s[:1], s[1 : len(s)-6]}
+		for i := 0; i < 6; i++ {
+			digits = append(digits, s[len(s)-6+i:len(s)-5+i])
+		}
+		for i, d := range digits {
+			n, err := strconv.ParseUint(d, 16, 8)
+			if err != nil {
+				return 0, fmt.Errorf("bad LUN %q", s)
+			}
+			b[i] = byte(n)
+		}
+	default:
+		return 0, fmt.Errorf("bad LUN %q", s)
+	}
+	switch b[0] >> 6 {
+	case 0:
+		// Peripheral device addressing.
+		return uint64(b[1]), nil
+	case 1:
+		// Flat space addressing.
+		return uint64(b[0]&0x3f)<<8 | uint64(b[1]), nil
+	}
+	return 0, fmt.Errorf("LUN %q uses unsupported addressing", s)
+}
+
+// target returns the directory of the target to boot from: the one the
+// firmware selected, or else the first valid one.
+func target(dir string) (string, error) {
+	targets, err := filepath.Glob(filepath.Join(dir, "target*"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(targets)
+	var valid []string
+	for _, t := range targets {
+		flags, err := attrs(t).Int("flags")
+		if err != nil {
+			return "", err
+		}
+		if flags&flagValid == 0 {
+			continue
+		}
+		if flags&flagSelected != 0 {
+			return t, nil
+		}
+		valid = append(valid, t)
+	}
+	if len(valid) == 0 {
+		return "", ErrNoTarget
+	}
+	return valid[0], nil
+}
+
+// ParseIBFT reads the boot target from the iBFT in /sys/firmware/ibft.
+func ParseIBFT() (*IBFTData, error) {
+	dir := filepath.Join(sysfs, "firmware", "ibft")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, ErrNoIBFT
+	}
+
+	d := &IBFTData{
+		InitiatorName: attrs(filepath.Join(dir, "initiator")).String("initiator-name"),
+	}
+	if d.InitiatorName == "" {
+		return nil, fmt.Errorf("iBFT has no initiator name")
+	}
+
+	tdir, err := target(dir)
+	if err != nil {
+		return nil, err
+	}
+	t := attrs(tdir)
+	if d.TargetIP, err = t.IP("ip-addr"); err != nil {
+		return nil, err
+	}
+	if d.TargetIP == nil {
+		return nil, fmt.Errorf("%s has no IP address", tdir)
+	}
+	if d.TargetPort, err = t.Int("port"); err != nil {
+		return nil, err
+	}
+	if d.TargetPort == 0 {
+		d.TargetPort = DefaultPort
+	}
+	if d.TargetName = t.String("target-name"); d.TargetName == "" {
+		return nil, fmt.Errorf("%s has no target name", tdir)
+	}
+	if d.LUN, err = parseLUN(t.String("lun")); err != nil {
+		return nil, fmt.Errorf("%s: %v", tdir, err)
+	}
+	chap, err := t.Int("chap-type")
+	if err != nil {
+		return nil, err
+	}
+	switch chap {
+	case chapNone:
+	case chapOneWay:
+		d.CHAPName, d.CHAPSecret = t.String("chap-name"), t.String("chap-secret")
+	default:
+		return nil, fmt.Errorf("%s: mutual CHAP is not supported", tdir)
+	}
+
+	nic, err := t.Int("nic-assoc")
+	if err != nil {
+		return nil, err
+	}
+	e := attrs(filepath.Join(dir, fmt.Sprintf("ethernet%d", nic)))
+	if mac := e.String("mac"); mac != "" {
+		if d.MAC, err = net.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("%s: %v", string(e), err)
+		}
+	}
+	ip, err := e.IP("ip-addr")
+	if err != nil {
+		return nil, err
+	}
+	mask, err := e.IP("subnet-mask")
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil && mask != nil {
+		// The kernel prints the prefix length of the table as an IPv4
+		// netmask, even for IPv6.
+		ones, _ := net.IPMask(mask.To4()).Size()
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		d.IP = &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*len(ip))}
+	}
+	if d.Gateway, err = e.IP("gateway"); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
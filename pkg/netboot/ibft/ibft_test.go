@@ -0,0 +1,212 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ibft
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSysfs creates files, relative to a new sysfs, with their contents.
+func fakeSysfs(t *testing.T, files map[string]string) func() {
+	dir, err := ioutil.TempDir("", "ibft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(s+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := sysfs
+	sysfs = dir
+	return func() {
+		sysfs = old
+		os.RemoveAll(dir)
+	}
+}
+
+func ibftFiles() map[string]string {
+	return map[string]string{
+		"firmware/ibft/initiator/initiator-name": "iqn.2018-01.org.u-root:initiator",
+		"firmware/ibft/initiator/flags":          "3",
+		"firmware/ibft/ethernet0/mac":            "52:54:00:12:34:56",
+		"firmware/ibft/ethernet0/ip-addr":        "192.168.1.10",
+		"firmware/ibft/ethernet0/subnet-mask":    "255.255.255.0",
+		"firmware/ibft/ethernet0/gateway":        "192.168.1.1",
+		"firmware/ibft/ethernet1/mac":            "52:54:00:12:34:57",
+		"firmware/ibft/ethernet1/ip-addr":        "fd00::10",
+		"firmware/ibft/ethernet1/subnet-mask":    "255.255.255.192",
+		"firmware/ibft/ethernet1/gateway":        "::",
+		"firmware/ibft/target0/flags":            "1",
+		"firmware/ibft/target0/ip-addr":          "192.168.1.2",
+		"firmware/ibft/target0/port":             "3261",
+		"firmware/ibft/target0/target-name":      "iqn.2018-01.org.u-root:first",
+		"firmware/ibft/target0/lun":              "0000000000000000",
+		"firmware/ibft/target0/nic-assoc":        "0",
+		"firmware/ibft/target1/flags":            "3",
+		"firmware/ibft/target1/ip-addr":          "fd00::2",
+		"firmware/ibft/target1/target-name":      "iqn.2018-01.org.u-root:boot",
+		"firmware/ibft/target1/lun":              "0002000000000000",
+		"firmware/ibft/target1/chap-type":        "1",
+		"firmware/ibft/target1/chap-name":        "user",
+		"firmware/ibft/target1/chap-secret":      "secretsecret",
+		"firmware/ibft/target1/nic-assoc":        "1",
+	}
+}
+
+func TestParseIBFT(t *testing.T) {
+	files := ibftFiles()
+	for _, tt := range []struct {
+		name   string
+		change map[string]string
+		remove []string
+		want   *IBFTData
+	}{
+		{
+			name: "selected target",
+			want: &IBFTData{
+				InitiatorName: "iqn.2018-01.org.u-root:initiator",
+				MAC:           net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x57},
+				IP:            &net.IPNet{IP: net.ParseIP("fd00::10"), Mask: net.CIDRMask(26, 128)},
+				TargetIP:      net.ParseIP("fd00::2"),
+				TargetPort:    DefaultPort,
+				TargetName:    "iqn.2018-01.org.u-root:boot",
+				LUN:           2,
+				CHAPName:      "user",
+				CHAPSecret:    "secretsecret",
+			},
+		},
+		{
+			name:   "first valid target",
+			change: map[string]string{"firmware/ibft/target1/flags": "1"},
+			want: &IBFTData{
+				InitiatorName: "iqn.2018-01.org.u-root:initiator",
+				MAC:           net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56},
+				IP:            &net.IPNet{IP: net.IPv4(192, 168, 1, 10).To4(), Mask: net.CIDRMask(24, 32)},
+				Gateway:       net.ParseIP("192.168.1.1"),
+				TargetIP:      net.ParseIP("192.168.1.2"),
+				TargetPort:    3261,
+				TargetName:    "iqn.2018-01.org.u-root:first",
+			},
+		},
+		{
+			name:   "DHCP",
+			change: map[string]string{"firmware/ibft/target1/flags": "0"},
+			remove: []string{"firmware/ibft/ethernet0/ip-addr", "firmware/ibft/ethernet0/gateway"},
+			want: &IBFTData{
+				InitiatorName: "iqn.2018-01.org.u-root:initiator",
+				MAC:           net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56},
+				TargetIP:      net.ParseIP("192.168.1.2"),
+				TargetPort:    3261,
+				TargetName:    "iqn.2018-01.org.u-root:first",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := make(map[string]string)
+			for k, v := range files {
+				f[k] = v
+			}
+			for k, v := range tt.change {
+				f[k] = v
+			}
+			for _, k := range tt.remove {
+				delete(f, k)
+			}
+			defer fakeSysfs(t, f)()
+			got, err := ParseIBFT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseIBFT() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIBFTErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		change map[string]string
+		remove []string
+		err    error
+	}{
+		{name: "no initiator", remove: []string{"firmware/ibft/initiator/initiator-name"}},
+		{name: "no valid target", change: map[string]string{"firmware/ibft/target0/flags": "0", "firmware/ibft/target1/flags": "2"}, err: ErrNoTarget},
+		{name: "bad flags", change: map[string]string{"firmware/ibft/target0/flags": "x"}},
+		{name: "no target IP", change: map[string]string{"firmware/ibft/target1/ip-addr": "0.0.0.0"}},
+		{name: "bad target IP", change: map[string]string{"firmware/ibft/target1/ip-addr": "fd00::2::"}},
+		{name: "no target name", remove: []string{"firmware/ibft/target1/target-name"}},
+		{name: "bad LUN", change: map[string]string{"firmware/ibft/target1/lun": "000"}},
+		{name: "mutual CHAP", change: map[string]string{"firmware/ibft/target1/chap-type": "2"}},
+		{name: "bad MAC", change: map[string]string{"firmware/ibft/ethernet1/mac": "52:54"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ibftFiles()
+			for k, v := range tt.change {
+				f[k] = v
+			}
+			for _, k := range tt.remove {
+				delete(f, k)
+			}
+			defer fakeSysfs(t, f)()
+			d, err := ParseIBFT()
+			if err == nil {
+				t.Fatalf("ParseIBFT() = %+v, want error", d)
+			}
+			if tt.err != nil && err != tt.err {
+				t.Errorf("ParseIBFT() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNoIBFT(t *testing.T) {
+	defer fakeSysfs(t, nil)()
+	if _, err := ParseIBFT(); err != ErrNoIBFT {
+		t.Errorf("ParseIBFT() = %v, want %v", err, ErrNoIBFT)
+	}
+}
+
+func TestParseLUN(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want uint64
+		err  bool
+	}{
+		{in: "", want: 0},
+		{in: "0000000000000000", want: 0},
+		{in: "0007000000000000", want: 7},
+		{in: "00ff000000000000", want: 255},
+		{in: "4101000000000000", want: 0x101},
+		// How some kernels print LUNs, with %x per byte.
+		{in: "00000000", want: 0},
+		{in: "03000000", want: 3},
+		{in: "0ff000000", want: 255},
+		{in: "c000000000000000", err: true},
+		{in: "000", err: true},
+		{in: "zz00000000000000", err: true},
+		{in: "0z000000", err: true},
+	} {
+		got, err := parseLUN(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseLUN(%q) = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseLUN(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
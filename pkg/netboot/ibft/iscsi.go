@@ -0,0 +1,369 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ibft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// dialTimeout bounds connecting to the target.
+	dialTimeout = 30 * time.Second
+	// scanTimeout bounds waiting for the disk to show up after login.
+	scanTimeout = 30 * time.Second
+
+	// isid is the initiator part of the session ID. It has the format of
+	// an OUI, here that of open-iscsi, and a qualifier.
+	isid = [6]byte{0x00, 0x02, 0x3d, 0x00, 0x00, 0x01}
+)
+
+// Session defaults of open-iscsi.
+const (
+	cmdsMax    = 128
+	queueDepth = 32
+)
+
+// iSCSI parameters, from enum iscsi_param in scsi/iscsi_if.h.
+const (
+	paramMaxRecvDLength   = 0
+	paramMaxXmitDLength   = 1
+	paramHdrDgstEn        = 2
+	paramDataDgstEn       = 3
+	paramInitialR2TEn     = 4
+	paramMaxR2T           = 5
+	paramImmDataEn        = 6
+	paramFirstBurst       = 7
+	paramMaxBurst         = 8
+	paramPDUInOrderEn     = 9
+	paramDataSeqInOrderEn = 10
+	paramERL              = 11
+	paramIFMarkerEn       = 12
+	paramOFMarkerEn       = 13
+	paramExpStatSN        = 14
+	paramTargetName       = 15
+	paramTPGT             = 16
+	paramPersistentAddr   = 17
+	paramPersistentPort   = 18
+	paramInitiatorName    = 34
+)
+
+// transport is the kernel's iSCSI transport interface.
+type transport interface {
+	createSession(handle uint64, cmdSN uint32) (sid, host uint32, err error)
+	destroySession(sid uint32) error
+	createConn(sid uint32) (cid uint32, err error)
+	destroyConn(sid, cid uint32) error
+	bindConn(sid, cid uint32, fd int) error
+	setParam(sid, cid, param uint32, value string) error
+	startConn(sid, cid uint32) error
+	close() error
+}
+
+// newTransport opens the kernel's transport interface. Tests replace it.
+var newTransport = func() (transport, error) {
+	return dialNetlink()
+}
+
+func yesNo(s string) string {
+	if s == "Yes" {
+		return "1"
+	}
+	return "0"
+}
+
+// kernelParams are the session parameters the kernel needs, from the login.
+func kernelParams(d *IBFTData, s *session) map[uint32]string {
+	p := map[uint32]string{
+		paramMaxRecvDLength:   strconv.Itoa(maxRecvDataLength),
+		paramHdrDgstEn:        "0",
+		paramDataDgstEn:       "0",
+		paramInitialR2TEn:     yesNo(s.params["InitialR2T"]),
+		paramMaxR2T:           s.params["MaxOutstandingR2T"],
+		paramImmDataEn:        yesNo(s.params["ImmediateData"]),
+		paramFirstBurst:       s.params["FirstBurstLength"],
+		paramMaxBurst:         s.params["MaxBurstLength"],
+		paramPDUInOrderEn:     yesNo(s.params["DataPDUInOrder"]),
+		paramDataSeqInOrderEn: yesNo(s.params["DataSequenceInOrder"]),
+		paramERL:              s.params["ErrorRecoveryLevel"],
+		paramIFMarkerEn:       "0",
+		paramOFMarkerEn:       "0",
+		paramExpStatSN:        strconv.FormatUint(uint64(s.expStatSN), 10),
+		paramTargetName:       d.TargetName,
+		paramPersistentAddr:   d.TargetIP.String(),
+		paramPersistentPort:   strconv.Itoa(d.TargetPort),
+		paramInitiatorName:    d.InitiatorName,
+		// The target declares how much it takes in its own
+		// MaxRecvDataSegmentLength, which defaults to 8192.
+		paramMaxXmitDLength: "8192",
+	}
+	if v, ok := s.params["TargetPortalGroupTag"]; ok {
+		p[paramTPGT] = v
+	}
+	if v, ok := s.params["MaxRecvDataSegmentLength"]; ok {
+		p[paramMaxXmitDLength] = v
+	}
+	return p
+}
+
+// ConnectISCSI logs in to the target described by ibft, hands the session
+// to the kernel and returns the path of the disk at the target's LUN.
+//
+// The network must already be configured, and the iscsi_tcp module loaded.
+func ConnectISCSI(ibft *IBFTData) (devicePath string, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(sysfs, "class", "iscsi_transport", "tcp", "handle"))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no iSCSI TCP transport; is iscsi_tcp loaded?")
+	}
+	if err != nil {
+		return "", err
+	}
+	handle, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad iSCSI transport handle %q", b)
+	}
+
+	addr := net.JoinHostPort(ibft.TargetIP.String(), strconv.Itoa(ibft.TargetPort))
+	c, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	s, err := login(c, ibft, isid)
+	if err != nil {
+		return "", err
+	}
+	// The kernel takes its own reference to the socket.
+	f, err := c.(*net.TCPConn).File()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	t, err := newTransport()
+	if err != nil {
+		return "", err
+	}
+	defer t.close()
+	sid, host, err := t.createSession(handle, s.cmdSN)
+	if err != nil {
+		return "", fmt.Errorf("creating iSCSI session: %v", err)
+	}
+	cid, err := t.createConn(sid)
+	if err != nil {
+		t.destroySession(sid)
+		return "", fmt.Errorf("creating iSCSI connection: %v", err)
+	}
+	if err := startConn(t, sid, cid, int(f.Fd()), kernelParams(ibft, s)); err != nil {
+		t.destroyConn(sid, cid)
+		t.destroySession(sid)
+		return "", err
+	}
+	return findDisk(host, ibft.LUN)
+}
+
+func startConn(t transport, sid, cid uint32, fd int, params map[uint32]string) error {
+	if err := t.bindConn(sid, cid, fd); err != nil {
+		return fmt.Errorf("binding iSCSI connection: %v", err)
+	}
+	for p, v := range params {
+		if err := t.setParam(sid, cid, p, v); err != nil {
+			return fmt.Errorf("setting iSCSI parameter %d to %q: %v", p, v, err)
+		}
+	}
+	if err := t.startConn(sid, cid); err != nil {
+		return fmt.Errorf("starting iSCSI connection: %v", err)
+	}
+	return nil
+}
+
+// findDisk scans the SCSI host of a session and waits for the disk at lun.
+func findDisk(host uint32, lun uint64) (string, error) {
+	h := filepath.Join(sysfs, "class", "scsi_host", fmt.Sprintf("host%d", host))
+	if err := ioutil.WriteFile(filepath.Join(h, "scan"), []byte("- - -"), 0); err != nil {
+		return "", err
+	}
+	pattern := filepath.Join(h, "device", "session*", "target*", fmt.Sprintf("%d:*:*:%d", host, lun), "block", "*")
+	for deadline := time.Now().Add(scanTimeout); ; {
+		disks, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		if len(disks) > 0 {
+			return filepath.Join("/dev", filepath.Base(disks[0])), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no disk for LUN %d on SCSI host %d after %v", lun, host, scanTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// iSCSI netlink events, from scsi/iscsi_if.h.
+const (
+	netlinkISCSI = 8
+
+	eventCreateSession  = 11
+	eventDestroySession = 12
+	eventCreateConn     = 13
+	eventDestroyConn    = 14
+	eventBindConn       = 15
+	eventSetParam       = 16
+	eventStartConn      = 17
+
+	// sizeofUevent is the size of struct iscsi_uevent: a 16 byte header,
+	// then unions of 24 bytes for requests and 16 for replies.
+	sizeofUevent = 56
+	uOffset      = 16
+	rOffset      = 40
+)
+
+// netlinkTransport talks to scsi_transport_iscsi over netlink.
+type netlinkTransport struct {
+	fd     int
+	seq    uint32
+	handle uint64
+}
+
+func dialNetlink() (*netlinkTransport, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, netlinkISCSI)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &netlinkTransport{fd: fd}, nil
+}
+
+func (n *netlinkTransport) close() error {
+	return unix.Close(n.fd)
+}
+
+// request sends an event whose request union is u, followed by data, and
+// returns the reply union.
+func (n *netlinkTransport) request(typ uint32, u []byte, data []byte) ([]byte, error) {
+	n.seq++
+	ev := make([]byte, sizeofUevent, sizeofUevent+len(data))
+	binary.LittleEndian.PutUint32(ev[0:], typ)
+	binary.LittleEndian.PutUint64(ev[8:], n.handle)
+	copy(ev[uOffset:rOffset], u)
+	ev = append(ev, data...)
+
+	b := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(ev))
+	binary.LittleEndian.PutUint32(b[0:], uint32(unix.SizeofNlMsghdr+len(ev)))
+	binary.LittleEndian.PutUint16(b[4:], uint16(typ))
+	binary.LittleEndian.PutUint16(b[6:], unix.NLM_F_REQUEST)
+	binary.LittleEndian.PutUint32(b[8:], n.seq)
+	binary.LittleEndian.PutUint32(b[12:], uint32(os.Getpid()))
+	b = append(b, ev...)
+	if err := unix.Sendto(n.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	r := make([]byte, 4096)
+	for {
+		l, _, err := unix.Recvfrom(n.fd, r, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		if l < unix.SizeofNlMsghdr+sizeofUevent {
+			continue
+		}
+		// Replies carry the type of the request.
+		if binary.LittleEndian.Uint16(r[4:]) != uint16(typ) {
+			continue
+		}
+		ev := r[unix.SizeofNlMsghdr:]
+		if e := int32(binary.LittleEndian.Uint32(ev[4:])); e != 0 {
+			return nil, syscall.Errno(-e)
+		}
+		return append([]byte(nil), ev[rOffset:sizeofUevent]...), nil
+	}
+}
+
+// retcode checks the return code in the reply union.
+func retcode(r []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if rc := int32(binary.LittleEndian.Uint32(r)); rc != 0 {
+		if rc < 0 {
+			return syscall.Errno(-rc)
+		}
+		return fmt.Errorf("iSCSI error %d", rc)
+	}
+	return nil
+}
+
+func u32s(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+func (n *netlinkTransport) createSession(handle uint64, cmdSN uint32) (uint32, uint32, error) {
+	n.handle = handle
+	u := make([]byte, 8)
+	binary.LittleEndian.PutUint32(u[0:], cmdSN)
+	binary.LittleEndian.PutUint16(u[4:], cmdsMax)
+	binary.LittleEndian.PutUint16(u[6:], queueDepth)
+	r, err := n.request(eventCreateSession, u, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	return binary.LittleEndian.Uint32(r[0:]), binary.LittleEndian.Uint32(r[4:]), nil
+}
+
+func (n *netlinkTransport) destroySession(sid uint32) error {
+	return retcode(n.request(eventDestroySession, u32s(sid), nil))
+}
+
+func (n *netlinkTransport) createConn(sid uint32) (uint32, error) {
+	r, err := n.request(eventCreateConn, u32s(sid, 0), nil)
+	if err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(r[0:]) != sid {
+		return 0, fmt.Errorf("iSCSI connection created in session %d, not %d", binary.LittleEndian.Uint32(r[0:]), sid)
+	}
+	return binary.LittleEndian.Uint32(r[4:]), nil
+}
+
+func (n *netlinkTransport) destroyConn(sid, cid uint32) error {
+	return retcode(n.request(eventDestroyConn, u32s(sid, cid), nil))
+}
+
+func (n *netlinkTransport) bindConn(sid, cid uint32, fd int) error {
+	u := make([]byte, 24)
+	binary.LittleEndian.PutUint32(u[0:], sid)
+	binary.LittleEndian.PutUint32(u[4:], cid)
+	binary.LittleEndian.PutUint64(u[8:], uint64(fd))
+	// The first connection of a session leads it.
+	binary.LittleEndian.PutUint32(u[16:], 1)
+	return retcode(n.request(eventBindConn, u, nil))
+}
+
+func (n *netlinkTransport) setParam(sid, cid, param uint32, value string) error {
+	data := append([]byte(value), 0)
+	return retcode(n.request(eventSetParam, u32s(sid, cid, param, uint32(len(data))), data))
+}
+
+func (n *netlinkTransport) startConn(sid, cid uint32) error {
+	return retcode(n.request(eventStartConn, u32s(sid, cid), nil))
+}
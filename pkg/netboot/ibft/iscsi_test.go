@@ -0,0 +1,192 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ibft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeTransport records what it is asked to do and, once a connection is
+// started, creates the disk in the fake sysfs.
+type fakeTransport struct {
+	handle  uint64
+	params  map[uint32]string
+	bound   bool
+	started bool
+	// disk is the block device below the session's host.
+	disk string
+	// fail makes setParam fail.
+	fail bool
+
+	destroyed bool
+	closed    bool
+}
+
+func (f *fakeTransport) createSession(handle uint64, cmdSN uint32) (uint32, uint32, error) {
+	f.handle = handle
+	return 1, 4, nil
+}
+
+func (f *fakeTransport) destroySession(sid uint32) error {
+	f.destroyed = true
+	return nil
+}
+
+func (f *fakeTransport) createConn(sid uint32) (uint32, error) {
+	return 0, nil
+}
+
+func (f *fakeTransport) destroyConn(sid, cid uint32) error {
+	return nil
+}
+
+func (f *fakeTransport) bindConn(sid, cid uint32, fd int) error {
+	if fd < 0 {
+		return fmt.Errorf("bad fd %d", fd)
+	}
+	f.bound = true
+	return nil
+}
+
+func (f *fakeTransport) setParam(sid, cid, param uint32, value string) error {
+	if f.fail {
+		return fmt.Errorf("no")
+	}
+	f.params[param] = value
+	return nil
+}
+
+func (f *fakeTransport) startConn(sid, cid uint32) error {
+	f.started = true
+	return os.MkdirAll(filepath.Join(sysfs, "class", "scsi_host", "host4", "device", "session1", "target4:0:0", f.disk), 0755)
+}
+
+func (f *fakeTransport) close() error {
+	f.closed = true
+	return nil
+}
+
+// listen starts f on a local port and returns the address.
+func listen(t *testing.T, f *fakeTarget) (*net.TCPAddr, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(c)
+			// Keep the connection, as the kernel would use it.
+		}
+	}()
+	return l.Addr().(*net.TCPAddr), func() { l.Close() }
+}
+
+func TestConnectISCSI(t *testing.T) {
+	f := &fakeTarget{name: "iqn.2018-01.org.u-root:boot", keys: textKeys{{"MaxRecvDataSegmentLength", "65536"}}}
+	addr, stop := listen(t, f)
+	defer stop()
+	defer fakeSysfs(t, map[string]string{
+		"class/iscsi_transport/tcp/handle": "18446612682162044928",
+		"class/scsi_host/host4/scan":       "",
+	})()
+	tr := &fakeTransport{params: make(map[uint32]string), disk: "4:0:0:2/block/sdb"}
+	defer func(old func() (transport, error)) { newTransport = old }(newTransport)
+	newTransport = func() (transport, error) { return tr, nil }
+
+	d := &IBFTData{
+		InitiatorName: "iqn.2018-01.org.u-root:initiator",
+		TargetIP:      addr.IP,
+		TargetPort:    addr.Port,
+		TargetName:    f.name,
+		LUN:           2,
+	}
+	dev, err := ConnectISCSI(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev != "/dev/sdb" {
+		t.Errorf("ConnectISCSI() = %q, want /dev/sdb", dev)
+	}
+	if tr.handle != 18446612682162044928 || !tr.bound || !tr.started || !tr.closed {
+		t.Errorf("transport is %+v, want session with handle 18446612682162044928, bound and started and closed", tr)
+	}
+	for p, want := range map[uint32]string{
+		paramMaxRecvDLength: "262144",
+		paramMaxXmitDLength: "65536",
+		paramInitialR2TEn:   "0",
+		paramImmDataEn:      "1",
+		paramTargetName:     f.name,
+		paramInitiatorName:  d.InitiatorName,
+		paramTPGT:           "1",
+		paramPersistentAddr: "127.0.0.1",
+		paramPersistentPort: fmt.Sprint(addr.Port),
+		paramExpStatSN:      "101",
+	} {
+		if got := tr.params[p]; got != want {
+			t.Errorf("parameter %d = %q, want %q", p, got, want)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(sysfs, "class", "scsi_host", "host4", "scan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "- - -" {
+		t.Errorf("scan = %q, want %q", b, "- - -")
+	}
+}
+
+func TestConnectISCSIErrors(t *testing.T) {
+	f := &fakeTarget{name: "iqn.2018-01.org.u-root:boot"}
+	addr, stop := listen(t, f)
+	defer stop()
+	d := &IBFTData{
+		InitiatorName: "iqn.2018-01.org.u-root:initiator",
+		TargetIP:      addr.IP,
+		TargetPort:    addr.Port,
+		TargetName:    f.name,
+	}
+	defer func(old func() (transport, error)) { newTransport = old }(newTransport)
+	defer func(old time.Duration) { scanTimeout = old }(scanTimeout)
+	scanTimeout = 100 * time.Millisecond
+
+	t.Run("no transport", func(t *testing.T) {
+		defer fakeSysfs(t, nil)()
+		if _, err := ConnectISCSI(d); err == nil {
+			t.Errorf("ConnectISCSI() without iscsi_tcp succeeded")
+		}
+	})
+	t.Run("bad parameter", func(t *testing.T) {
+		defer fakeSysfs(t, map[string]string{"class/iscsi_transport/tcp/handle": "1"})()
+		tr := &fakeTransport{params: make(map[uint32]string), fail: true}
+		newTransport = func() (transport, error) { return tr, nil }
+		if _, err := ConnectISCSI(d); err == nil {
+			t.Errorf("ConnectISCSI() succeeded")
+		}
+		if !tr.destroyed {
+			t.Errorf("ConnectISCSI() did not destroy the session")
+		}
+	})
+	t.Run("no disk", func(t *testing.T) {
+		defer fakeSysfs(t, map[string]string{
+			"class/iscsi_transport/tcp/handle": "1",
+			"class/scsi_host/host4/scan":       "",
+		})()
+		tr := &fakeTransport{params: make(map[uint32]string), disk: "4:0:0:3/block/sdb"}
+		newTransport = func() (transport, error) { return tr, nil }
+		if dev, err := ConnectISCSI(d); err == nil {
+			t.Errorf("ConnectISCSI() = %q, want error as there is no LUN 0", dev)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ibft
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Opcodes and flags of login PDUs, from RFC 7143 11.12 and 11.13.
+const (
+	opLoginRequest  = 0x03
+	opLoginResponse = 0x23
+	opImmediate     = 0x40
+
+	loginTransit  = 0x80
+	loginContinue = 0x40
+
+	bhsLen = 48
+
+	// maxLoginRounds bounds how often we go back and forth with a target
+	// that never moves on to the next stage.
+	maxLoginRounds = 16
+)
+
+// Login stages.
+const (
+	stageSecurity    = 0
+	stageOperational = 1
+	stageFullFeature = 3
+)
+
+// maxRecvDataLength is the largest data segment we accept.
+const maxRecvDataLength = 262144
+
+// pdu is an iSCSI PDU without additional header segments or digests.
+type pdu struct {
+	bhs  [bhsLen]byte
+	data []byte
+}
+
+func (p *pdu) write(w io.Writer) error {
+	n := len(p.data)
+	p.bhs[5], p.bhs[6], p.bhs[7] = byte(n>>16), byte(n>>8), byte(n)
+	b := append(p.bhs[:], p.data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readPDU(r io.Reader) (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(r, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	ahs := 4 * int(p.bhs[4])
+	n := int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+	b := make([]byte, ahs+(n+3)&^3)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	p.data = b[ahs : ahs+n]
+	return p, nil
+}
+
+// textKeys is a list of key=value pairs, in order.
+type textKeys [][2]string
+
+func (k textKeys) encode() []byte {
+	var b bytes.Buffer
+	for _, kv := range k {
+		b.WriteString(kv[0] + "=" + kv[1])
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func parseKeys(b []byte) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(string(b), "\x00") {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			m[kv[:i]] = kv[i+1:]
+		}
+	}
+	return m
+}
+
+// session is the outcome of a login.
+type session struct {
+	isid      [6]byte
+	tsih      uint16
+	cmdSN     uint32
+	expStatSN uint32
+	// params are the negotiated operational keys, and the target's
+	// declarations.
+	params map[string]string
+}
+
+// operationalKeys are the keys we offer, which are those the kernel can do.
+var operationalKeys = textKeys{
+	{"HeaderDigest", "None"},
+	{"DataDigest", "None"},
+	{"MaxRecvDataSegmentLength", strconv.Itoa(maxRecvDataLength)},
+	{"InitialR2T", "No"},
+	{"ImmediateData", "Yes"},
+	{"MaxBurstLength", "16776192"},
+	{"FirstBurstLength", "262144"},
+	{"MaxOutstandingR2T", "1"},
+	{"MaxConnections", "1"},
+	{"DefaultTime2Wait", "2"},
+	{"DefaultTime2Retain", "0"},
+	{"DataPDUInOrder", "Yes"},
+	{"DataSequenceInOrder", "Yes"},
+	{"ErrorRecoveryLevel", "0"},
+	{"IFMarker", "No"},
+	{"OFMarker", "No"},
+}
+
+// chapResponse computes the CHAP response of RFC 1994 with MD5.
+func chapResponse(id byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+func parseHex(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return nil, fmt.Errorf("%q is not a hex value", s)
+	}
+	return hex.DecodeString(s[2:])
+}
+
+// login runs the login phase of a normal session on rw, the connection to
+// the target.
+func login(rw io.ReadWriter, d *IBFTData, isid [6]byte) (*session, error) {
+	s := &session{isid: isid, params: make(map[string]string)}
+	for _, kv := range operationalKeys {
+		// Ours is a declaration, so only the target's goes in params.
+		if kv[0] != "MaxRecvDataSegmentLength" {
+			s.params[kv[0]] = kv[1]
+		}
+	}
+
+	auth := "None"
+	if d.CHAPName != "" {
+		auth = "CHAP,None"
+	}
+	keys := textKeys{
+		{"InitiatorName", d.InitiatorName},
+		{"TargetName", d.TargetName},
+		{"SessionType", "Normal"},
+		{"AuthMethod", auth},
+	}
+	stage, next := stageSecurity, stageOperational
+	sentOperational := false
+
+	for round := 0; round < maxLoginRounds; round++ {
+		req := &pdu{data: keys.encode()}
+		req.bhs[0] = opImmediate | opLoginRequest
+		req.bhs[1] = byte(stage<<2 | next)
+		if next != stage {
+			req.bhs[1] |= loginTransit
+		}
+		copy(req.bhs[8:14], s.isid[:])
+		binary.BigEndian.PutUint16(req.bhs[14:], s.tsih)
+		binary.BigEndian.PutUint32(req.bhs[24:], s.cmdSN)
+		binary.BigEndian.PutUint32(req.bhs[28:], s.expStatSN)
+		if err := req.write(rw); err != nil {
+			return nil, err
+		}
+
+		resp, err := readPDU(rw)
+		if err != nil {
+			return nil, fmt.Errorf("reading login response: %v", err)
+		}
+		if resp.bhs[0]&0x3f != opLoginResponse {
+			return nil, fmt.Errorf("got opcode %#x during login", resp.bhs[0]&0x3f)
+		}
+		if class, detail := resp.bhs[36], resp.bhs[37]; class != 0 {
+			return nil, fmt.Errorf("login to %s failed with status %d/%d", d.TargetName, class, detail)
+		}
+		if resp.bhs[1]&loginContinue != 0 {
+			return nil, fmt.Errorf("continued login responses are not supported")
+		}
+		s.tsih = binary.BigEndian.Uint16(resp.bhs[14:])
+		s.expStatSN = binary.BigEndian.Uint32(resp.bhs[24:]) + 1
+		s.cmdSN = binary.BigEndian.Uint32(resp.bhs[28:])
+		got := parseKeys(resp.data)
+
+		if resp.bhs[1]&loginTransit != 0 {
+			stage = int(resp.bhs[1] & 3)
+		}
+		if stage == stageFullFeature {
+			for k, v := range got {
+				s.params[k] = v
+			}
+			return s, nil
+		}
+
+		keys = nil
+		switch stage {
+		case stageSecurity:
+			switch {
+			case got["CHAP_C"] != "":
+				id, err := strconv.Atoi(got["CHAP_I"])
+				if err != nil {
+					return nil, fmt.Errorf("bad CHAP_I %q", got["CHAP_I"])
+				}
+				c, err := parseHex(got["CHAP_C"])
+				if err != nil {
+					return nil, fmt.Errorf("bad CHAP_C: %v", err)
+				}
+				keys = textKeys{
+					{"CHAP_N", d.CHAPName},
+					{"CHAP_R", "0x" + hex.EncodeToString(chapResponse(byte(id), d.CHAPSecret, c))},
+				}
+				next = stageOperational
+			case got["AuthMethod"] == "CHAP":
+				if d.CHAPName == "" {
+					return nil, fmt.Errorf("target wants CHAP, but the iBFT has no CHAP name")
+				}
+				// MD5 is the only algorithm we know.
+				keys = textKeys{{"CHAP_A", "5"}}
+				next = stageSecurity
+			case got["AuthMethod"] == "None" || got["AuthMethod"] == "":
+				next = stageOperational
+			default:
+				return nil, fmt.Errorf("target wants authentication method %q", got["AuthMethod"])
+			}
+			if tpgt, ok := got["TargetPortalGroupTag"]; ok {
+				s.params["TargetPortalGroupTag"] = tpgt
+			}
+		case stageOperational:
+			for k, v := range got {
+				s.params[k] = v
+			}
+			if !sentOperational {
+				keys = operationalKeys
+				sentOperational = true
+			}
+			next = stageFullFeature
+		default:
+			return nil, fmt.Errorf("target moved to login stage %d", stage)
+		}
+	}
+	return nil, fmt.Errorf("login to %s did not finish after %d rounds", d.TargetName, maxLoginRounds)
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ibft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeTarget is the login side of an iSCSI target.
+type fakeTarget struct {
+	name   string
+	secret string
+	// keys are declarations and answers sent in the operational stage.
+	keys textKeys
+	// status fails logins with this class and detail if it is not 0.
+	status uint16
+
+	// got are all keys from the initiator.
+	got map[string]string
+}
+
+func (f *fakeTarget) respond(w io.Writer, req *pdu, flags byte, keys textKeys) error {
+	resp := &pdu{data: keys.encode()}
+	resp.bhs[0] = opLoginResponse
+	resp.bhs[1] = flags
+	copy(resp.bhs[8:14], req.bhs[8:14])
+	binary.BigEndian.PutUint16(resp.bhs[14:], 7)
+	binary.BigEndian.PutUint32(resp.bhs[24:], 100)
+	binary.BigEndian.PutUint32(resp.bhs[28:], binary.BigEndian.Uint32(req.bhs[24:]))
+	binary.BigEndian.PutUint16(resp.bhs[36:], f.status)
+	return resp.write(w)
+}
+
+// serve runs the target's side of a login.
+func (f *fakeTarget) serve(rw io.ReadWriter) error {
+	f.got = make(map[string]string)
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for {
+		req, err := readPDU(rw)
+		if err != nil {
+			return err
+		}
+		if req.bhs[0] != opImmediate|opLoginRequest {
+			return fmt.Errorf("got opcode %#x, want login request", req.bhs[0])
+		}
+		keys := parseKeys(req.data)
+		for k, v := range keys {
+			f.got[k] = v
+		}
+		if f.status != 0 {
+			return f.respond(rw, req, 0, nil)
+		}
+		transit := req.bhs[1]&loginTransit != 0
+		csg, nsg := req.bhs[1]>>2&3, req.bhs[1]&3
+
+		switch {
+		case csg == stageSecurity && keys["AuthMethod"] != "":
+			if f.secret == "" {
+				if err := f.respond(rw, req, loginTransit|stageSecurity<<2|stageOperational, textKeys{{"AuthMethod", "None"}, {"TargetPortalGroupTag", "1"}}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := f.respond(rw, req, stageSecurity<<2, textKeys{{"AuthMethod", "CHAP"}, {"TargetPortalGroupTag", "1"}}); err != nil {
+				return err
+			}
+		case csg == stageSecurity && keys["CHAP_A"] == "5":
+			if err := f.respond(rw, req, stageSecurity<<2, textKeys{{"CHAP_A", "5"}, {"CHAP_I", "9"}, {"CHAP_C", "0x" + hex.EncodeToString(challenge)}}); err != nil {
+				return err
+			}
+		case csg == stageSecurity && keys["CHAP_R"] != "":
+			r, err := parseHex(keys["CHAP_R"])
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(r, chapResponse(9, f.secret, challenge)) {
+				f.status = 0x0201
+				return f.respond(rw, req, 0, nil)
+			}
+			if err := f.respond(rw, req, loginTransit|stageSecurity<<2|stageOperational, nil); err != nil {
+				return err
+			}
+		case csg == stageOperational && transit && nsg == stageFullFeature:
+			return f.respond(rw, req, loginTransit|stageOperational<<2|stageFullFeature, f.keys)
+		default:
+			return fmt.Errorf("unexpected login request %x %q", req.bhs[1], req.data)
+		}
+	}
+}
+
+func testLogin(t *testing.T, f *fakeTarget, d *IBFTData) (*session, error) {
+	c, s := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f.serve(s)
+		s.Close()
+	}()
+	sess, err := login(c, d, isid)
+	c.Close()
+	if terr := <-errs; err == nil && terr != nil {
+		t.Fatalf("target: %v", terr)
+	}
+	return sess, err
+}
+
+func TestLogin(t *testing.T) {
+	d := &IBFTData{
+		InitiatorName: "iqn.2018-01.org.u-root:initiator",
+		TargetName:    "iqn.2018-01.org.u-root:boot",
+	}
+	f := &fakeTarget{
+		name: d.TargetName,
+		keys: textKeys{
+			{"MaxRecvDataSegmentLength", "65536"},
+			{"InitialR2T", "Yes"},
+			{"MaxBurstLength", "262144"},
+			{"FirstBurstLength", "65536"},
+		},
+	}
+	s, err := testLogin(t, f, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.tsih != 7 || s.expStatSN != 101 {
+		t.Errorf("session has TSIH %d and ExpStatSN %d, want 7 and 101", s.tsih, s.expStatSN)
+	}
+	for k, want := range map[string]string{
+		"TargetPortalGroupTag":     "1",
+		"MaxRecvDataSegmentLength": "65536",
+		"InitialR2T":               "Yes",
+		"ImmediateData":            "Yes",
+		"MaxBurstLength":           "262144",
+		"FirstBurstLength":         "65536",
+		"ErrorRecoveryLevel":       "0",
+	} {
+		if got := s.params[k]; got != want {
+			t.Errorf("session has %s=%q, want %q", k, got, want)
+		}
+	}
+	for k, want := range map[string]string{
+		"InitiatorName":            d.InitiatorName,
+		"TargetName":               d.TargetName,
+		"SessionType":              "Normal",
+		"AuthMethod":               "None",
+		"MaxRecvDataSegmentLength": "262144",
+		"HeaderDigest":             "None",
+	} {
+		if got := f.got[k]; got != want {
+			t.Errorf("target got %s=%q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestLoginCHAP(t *testing.T) {
+	d := &IBFTData{
+		InitiatorName: "iqn.2018-01.org.u-root:initiator",
+		TargetName:    "iqn.2018-01.org.u-root:boot",
+		CHAPName:      "user",
+		CHAPSecret:    "secretsecret",
+	}
+	f := &fakeTarget{name: d.TargetName, secret: d.CHAPSecret}
+	if _, err := testLogin(t, f, d); err != nil {
+		t.Fatal(err)
+	}
+	if f.got["AuthMethod"] != "CHAP,None" || f.got["CHAP_N"] != "user" {
+		t.Errorf("target got AuthMethod=%q CHAP_N=%q, want CHAP,None and user", f.got["AuthMethod"], f.got["CHAP_N"])
+	}
+
+	d.CHAPSecret = "wrong"
+	if _, err := testLogin(t, f, d); err == nil {
+		t.Errorf("login with the wrong secret succeeded")
+	}
+
+	d.CHAPName = ""
+	f.status = 0
+	if _, err := testLogin(t, f, d); err == nil {
+		t.Errorf("login without CHAP to a target that needs it succeeded")
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	d := &IBFTData{InitiatorName: "iqn.2018-01.org.u-root:initiator", TargetName: "iqn.2018-01.org.u-root:none"}
+	f := &fakeTarget{name: d.TargetName, status: 0x0203}
+	if _, err := testLogin(t, f, d); err == nil {
+		t.Errorf("login to a target that refuses succeeded")
+	}
+}
+
+func TestPDU(t *testing.T) {
+	p := &pdu{data: []byte("abcde")}
+	p.bhs[0] = opLoginRequest
+	var b bytes.Buffer
+	if err := p.write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != bhsLen+8 {
+		t.Errorf("PDU is %d bytes, want %d", b.Len(), bhsLen+8)
+	}
+	got, err := readPDU(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.bhs != p.bhs || string(got.data) != "abcde" {
+		t.Errorf("readPDU() = %v %q, want %v %q", got.bhs, got.data, p.bhs, p.data)
+	}
+	if _, err := readPDU(bytes.NewReader(p.bhs[:])); err == nil {
+		t.Errorf("readPDU() of a truncated PDU succeeded")
+	}
+}
+
+func TestChapResponse(t *testing.T) {
+	// MD5 of "\x01" + "secret" + "\x00\x01\x02\x03".
+	want := "e82cb2ed1efe04893c9cf73d4dd12e2d"
+	if got := hex.EncodeToString(chapResponse(1, "secret", []byte{0, 1, 2, 3})); got != want {
+		t.Errorf("chapResponse() = %s, want %s", got, want)
+	}
+}
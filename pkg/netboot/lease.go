@@ -0,0 +1,435 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/u-root/dhcp4"
+	"github.com/u-root/dhcp4/dhcp4client"
+	"github.com/u-root/dhcp4/dhcp4opts"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/netboot/opt43"
+	"github.com/vishvananda/netlink"
+)
+
+// LeaseState is a state of the DHCPv4 client, as in RFC 2131, Section 4.4.
+type LeaseState int
+
+// The states LeaseManager goes through. INIT-REBOOT and REBOOTING are not
+// used, as no lease is remembered across Starts.
+const (
+	StateInit LeaseState = iota
+	StateSelecting
+	StateRequesting
+	StateBound
+	StateRenewing
+	StateRebinding
+)
+
+var leaseStates = map[LeaseState]string{
+	StateInit:       "INIT",
+	StateSelecting:  "SELECTING",
+	StateRequesting: "REQUESTING",
+	StateBound:      "BOUND",
+	StateRenewing:   "RENEWING",
+	StateRebinding:  "REBINDING",
+}
+
+func (s LeaseState) String() string {
+	if n, ok := leaseStates[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("LeaseState(%d)", int(s))
+}
+
+// LeaseEventType is what happened to a lease.
+type LeaseEventType int
+
+// Lease events.
+const (
+	// LeaseAcquired is a new lease, from INIT.
+	LeaseAcquired LeaseEventType = iota
+	// LeaseRenewed is a lease extended by RENEWING or REBINDING.
+	LeaseRenewed
+	// LeaseExpired is a lease that ran out or that the server refused
+	// to extend. The manager goes back to INIT.
+	LeaseExpired
+)
+
+var leaseEventTypes = map[LeaseEventType]string{
+	LeaseAcquired: "acquired",
+	LeaseRenewed:  "renewed",
+	LeaseExpired:  "expired",
+}
+
+func (t LeaseEventType) String() string {
+	if n, ok := leaseEventTypes[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("LeaseEventType(%d)", int(t))
+}
+
+// LeaseEvent is a change of the lease of a LeaseManager.
+type LeaseEvent struct {
+	Type LeaseEventType
+
+	// Ack is the DHCPACK of the lease.
+	Ack *dhcp4.Packet
+
+	// Lease is the address leased.
+	Lease *net.IPNet
+
+	// VendorOptions are the sub-options of the vendor-specific
+	// information (option 43) of Ack, parsed for the vendor class of
+	// Ack, or nil if there is none or it cannot be parsed.
+	VendorOptions map[uint8][]byte
+
+	// Err is the error configuring the interface for the event, if any.
+	Err error
+}
+
+// infiniteLease is the lease time of leases that do not expire.
+const infiniteLease = math.MaxUint32
+
+// DefaultLeaseTimeout is how long LeaseManager waits for a reply unless
+// Timeout is set.
+const DefaultLeaseTimeout = 5 * time.Second
+
+// LeaseManager keeps a DHCPv4 lease on an interface, renewing it at T1 and
+// rebinding it at T2 as RFC 2131 describes, and starting over when it
+// expires.
+type LeaseManager struct {
+	// Events receives the lease events. Start makes a buffered channel if
+	// it is nil. Events that do not fit are dropped rather than holding
+	// up the lease.
+	Events chan LeaseEvent
+
+	// Timeout is how long to wait for each reply. If it is 0,
+	// DefaultLeaseTimeout is used.
+	Timeout time.Duration
+
+	// Retry is how many times each message is sent before giving up. If
+	// it is 0, it is sent 3 times.
+	Retry int
+
+	// Configure applies each event to the interface. If it is nil, leases
+	// are configured with dhclient.Configure4, which sets the address,
+	// default route and /etc/resolv.conf, and the address of expired
+	// leases is removed.
+	Configure func(iface netlink.Link, ev LeaseEvent) error
+
+	// conn, if not nil, is used instead of a packet socket on the
+	// interface.
+	conn net.PacketConn
+
+	// second is a second of lease time. If it is 0, time.Second is
+	// used.
+	second time.Duration
+
+	mu    sync.Mutex
+	state LeaseState
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// State returns the current state of m.
+func (m *LeaseManager) State() LeaseState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *LeaseManager) setState(s LeaseState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = s
+}
+
+// Start starts acquiring and keeping a lease on iface, which must be up, in
+// a goroutine, until Stop is called.
+func (m *LeaseManager) Start(iface string) error {
+	if m.stop != nil {
+		return errors.New("lease manager already started")
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+
+	timeout, retry := m.Timeout, m.Retry
+	if timeout == 0 {
+		timeout = DefaultLeaseTimeout
+	}
+	if retry == 0 {
+		retry = 3
+	}
+	opts := []dhcp4client.ClientOpt{dhcp4client.WithTimeout(timeout), dhcp4client.WithRetry(retry)}
+	if m.conn != nil {
+		opts = append(opts, dhcp4client.WithConn(m.conn))
+	}
+	c, err := dhcp4client.New(link, opts...)
+	if err != nil {
+		return err
+	}
+
+	if m.Events == nil {
+		m.Events = make(chan LeaseEvent, 16)
+	}
+	if m.Configure == nil {
+		m.Configure = configureLease
+	}
+	if m.second == 0 {
+		m.second = time.Second
+	}
+	m.setState(StateInit)
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(c, link)
+	return nil
+}
+
+// Stop stops m and waits for it to finish. The lease is neither released
+// nor removed from the interface.
+func (m *LeaseManager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// configureLease is the default LeaseManager.Configure.
+func configureLease(iface netlink.Link, ev LeaseEvent) error {
+	if ev.Type == LeaseExpired {
+		return netlink.AddrDel(iface, &netlink.Addr{IPNet: ev.Lease})
+	}
+	return dhclient.Configure4(iface, ev.Ack)
+}
+
+// wait waits until t and returns false if m is stopped first.
+func (m *LeaseManager) wait(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-m.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (m *LeaseManager) stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// lease is a bound lease, with the times of T1, T2 and its expiry.
+type lease struct {
+	ack            *dhcp4.Packet
+	server         net.IP
+	t1, t2, expiry time.Time
+	infinite       bool
+}
+
+// bind starts a lease with ack, received at now.
+func (m *LeaseManager) bind(ack *dhcp4.Packet, now time.Time) *lease {
+	l := &lease{ack: ack, server: net.IP(dhcp4opts.GetServerIdentifier(ack.Options))}
+	leaseTime := uint32Option(ack.Options, dhcp4.OptionIPAddressLeaseTime, infiniteLease)
+	if leaseTime == infiniteLease {
+		l.infinite = true
+		return l
+	}
+	// Defaults of RFC 2131, Section 4.4.5.
+	t1 := uint32Option(ack.Options, dhcp4.OptionRenewalTimeValue, leaseTime/2)
+	t2 := uint32Option(ack.Options, dhcp4.OptionRebindingTimeValue, uint32(uint64(leaseTime)*7/8))
+	l.t1 = now.Add(time.Duration(t1) * m.second)
+	l.t2 = now.Add(time.Duration(t2) * m.second)
+	l.expiry = now.Add(time.Duration(leaseTime) * m.second)
+	return l
+}
+
+// uint32Option returns the 32 bit option code of o, or def.
+func uint32Option(o dhcp4.Options, code dhcp4.OptionCode, def uint32) uint32 {
+	v := o.Get(code)
+	if len(v) != 4 {
+		return def
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+// vendorOptions returns the parsed option 43 of ack, if any.
+func vendorOptions(ack *dhcp4.Packet) map[uint8][]byte {
+	data := ack.Options.Get(dhcp4.OptionVendorSpecificInformation)
+	if data == nil {
+		return nil
+	}
+	opts, err := opt43.ParseVendorSpecific(data, string(ack.Options.Get(dhcp4.OptionVendorClassIdentifier)))
+	if err != nil {
+		log.Printf("Ignoring vendor-specific information of lease of %s: %v", ack.YIAddr, err)
+		return nil
+	}
+	return opts
+}
+
+// event configures the interface for an event and sends it.
+func (m *LeaseManager) event(iface netlink.Link, typ LeaseEventType, ack *dhcp4.Packet) {
+	ev := LeaseEvent{Type: typ, Ack: ack, Lease: dhclient.NewPacket4(ack).Lease(), VendorOptions: vendorOptions(ack)}
+	if err := m.Configure(iface, ev); err != nil {
+		ev.Err = fmt.Errorf("configuring %s for %s lease of %s: %v", iface.Attrs().Name, typ, ev.Lease, err)
+		log.Print(ev.Err)
+	}
+	select {
+	case m.Events <- ev:
+	default:
+		log.Printf("Dropped %s lease event of %s", typ, ev.Lease)
+	}
+}
+
+// extendPacket returns the DHCPREQUEST extending the lease of ack in
+// RENEWING and REBINDING: the address is in ciaddr, and there is neither a
+// requested address nor a server identifier.
+func extendPacket(iface netlink.Link, ack *dhcp4.Packet) *dhcp4.Packet {
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	rand.Read(p.TransactionID[:])
+	p.CHAddr = iface.Attrs().HardwareAddr
+	p.CIAddr = ack.YIAddr
+	p.Options.Add(dhcp4.OptionDHCPMessageType, dhcp4opts.DHCPRequest)
+	return p
+}
+
+// exchange sends p to dest and returns the first ACK or NAK.
+func exchange(c *dhcp4client.Client, dest *net.UDPAddr, p *dhcp4.Packet) (*dhcp4.Packet, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg, out, errCh := c.SimpleSendAndRead(ctx, dest, p)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for r := range out {
+		switch dhcp4opts.GetDHCPMessageType(r.Packet.Options) {
+		case dhcp4opts.DHCPACK, dhcp4opts.DHCPNAK:
+			return r.Packet, nil
+		}
+	}
+	if err, ok := <-errCh; ok && err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no reply")
+}
+
+// retransmitAt returns when to try again to extend a lease until end: after
+// half of the time left, but at least 60 seconds (RFC 2131, Section 4.4.5).
+func (m *LeaseManager) retransmitAt(now, end time.Time) time.Time {
+	wait := end.Sub(now) / 2
+	if min := 60 * m.second; wait < min {
+		wait = min
+	}
+	if t := now.Add(wait); t.Before(end) {
+		return t
+	}
+	return end
+}
+
+func (m *LeaseManager) run(c *dhcp4client.Client, iface netlink.Link) {
+	defer close(m.done)
+	defer c.Close()
+
+	var offer *dhcp4.Packet
+	var l *lease
+	for !m.stopped() {
+		switch m.State() {
+		case StateInit:
+			l = nil
+			m.setState(StateSelecting)
+
+		case StateSelecting:
+			var err error
+			if offer, err = c.DiscoverOffer(); err != nil {
+				log.Printf("DHCP on %s: no offer: %v", iface.Attrs().Name, err)
+				if !m.wait(time.Now().Add(10 * m.second)) {
+					return
+				}
+				continue
+			}
+			m.setState(StateRequesting)
+
+		case StateRequesting:
+			ack, err := exchange(c, dhcp4client.DefaultServers, c.RequestPacket(offer))
+			if err != nil || dhcp4opts.GetDHCPMessageType(ack.Options) != dhcp4opts.DHCPACK {
+				log.Printf("DHCP on %s: offer of %s not acknowledged: %v", iface.Attrs().Name, offer.YIAddr, err)
+				m.setState(StateInit)
+				continue
+			}
+			l = m.bind(ack, time.Now())
+			m.setState(StateBound)
+			m.event(iface, LeaseAcquired, ack)
+
+		case StateBound:
+			if l.infinite {
+				<-m.stop
+				return
+			}
+			if !m.wait(l.t1) {
+				return
+			}
+			m.setState(StateRenewing)
+
+		case StateRenewing, StateRebinding:
+			state := m.State()
+			dest, end := &net.UDPAddr{IP: l.server, Port: dhcp4client.ServerPort}, l.t2
+			if state == StateRebinding || l.server == nil {
+				dest = dhcp4client.DefaultServers
+			}
+			if state == StateRebinding {
+				end = l.expiry
+			}
+			expire := func() {
+				m.setState(StateInit)
+				m.event(iface, LeaseExpired, l.ack)
+			}
+			ack, err := exchange(c, dest, extendPacket(iface, l.ack))
+			now := time.Now()
+			switch {
+			case err == nil && dhcp4opts.GetDHCPMessageType(ack.Options) == dhcp4opts.DHCPACK:
+				l = m.bind(ack, now)
+				m.setState(StateBound)
+				m.event(iface, LeaseRenewed, ack)
+
+			case err == nil:
+				log.Printf("DHCP on %s: lease of %s refused", iface.Attrs().Name, l.ack.YIAddr)
+				expire()
+
+			case !now.Before(l.expiry):
+				expire()
+
+			default:
+				if now.Before(end) && !m.wait(m.retransmitAt(now, end)) {
+					return
+				}
+				switch now := time.Now(); {
+				case !now.Before(l.expiry):
+					expire()
+				case !now.Before(end):
+					m.setState(StateRebinding)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/u-root/dhcp4"
+	"github.com/u-root/dhcp4/dhcp4client"
+	"github.com/u-root/dhcp4/dhcp4opts"
+	"github.com/vishvananda/netlink"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type request struct {
+	dest *net.UDPAddr
+	p    *dhcp4.Packet
+}
+
+// mockServer is a DHCP server behind a net.PacketConn, which hands out
+// 10.0.0.2 for 10 seconds.
+type mockServer struct {
+	replies chan []byte
+
+	mu       sync.Mutex
+	deadline time.Time
+	requests []request
+	// answer is whether to answer a request sent to dest.
+	answer func(dest *net.UDPAddr) bool
+}
+
+var (
+	serverIP = net.IPv4(10, 0, 0, 1).To4()
+	clientIP = net.IPv4(10, 0, 0, 2).To4()
+)
+
+func newMockServer() *mockServer {
+	return &mockServer{
+		replies: make(chan []byte, 10),
+		answer:  func(*net.UDPAddr) bool { return true },
+	}
+}
+
+func (s *mockServer) setAnswer(answer func(dest *net.UDPAddr) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answer = answer
+}
+
+func (s *mockServer) log() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+func (s *mockServer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	req := &dhcp4.Packet{}
+	if err := req.UnmarshalBinary(b); err != nil {
+		return 0, err
+	}
+	dest := addr.(*net.UDPAddr)
+	s.mu.Lock()
+	s.requests = append(s.requests, request{dest, req})
+	answer := s.answer(dest)
+	s.mu.Unlock()
+	if !answer {
+		return len(b), nil
+	}
+
+	reply := dhcp4.NewPacket(dhcp4.BootReply)
+	reply.TransactionID = req.TransactionID
+	reply.CHAddr = req.CHAddr
+	reply.YIAddr = clientIP
+	typ := dhcp4opts.DHCPACK
+	if dhcp4opts.GetDHCPMessageType(req.Options) == dhcp4opts.DHCPDiscover {
+		typ = dhcp4opts.DHCPOffer
+	}
+	reply.Options.Add(dhcp4.OptionDHCPMessageType, typ)
+	reply.Options.Add(dhcp4.OptionServerIdentifier, dhcp4opts.IP(serverIP))
+	reply.Options.Add(dhcp4.OptionSubnetMask, dhcp4opts.SubnetMask(net.CIDRMask(24, 32)))
+	lease := make([]byte, 4)
+	binary.BigEndian.PutUint32(lease, 10)
+	reply.Options.AddRaw(dhcp4.OptionIPAddressLeaseTime, lease)
+	p, err := reply.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	s.replies <- p
+	return len(b), nil
+}
+
+func (s *mockServer) ReadFrom(b []byte) (int, net.Addr, error) {
+	s.mu.Lock()
+	d := time.Until(s.deadline)
+	s.mu.Unlock()
+	select {
+	case p := <-s.replies:
+		return copy(b, p), &net.UDPAddr{IP: serverIP, Port: dhcp4client.ServerPort}, nil
+	case <-time.After(d):
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (s *mockServer) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	return nil
+}
+
+func (s *mockServer) Close() error                       { return nil }
+func (s *mockServer) LocalAddr() net.Addr                { return &net.UDPAddr{Port: dhcp4client.ClientPort} }
+func (s *mockServer) SetDeadline(t time.Time) error      { return s.SetReadDeadline(t) }
+func (s *mockServer) SetWriteDeadline(t time.Time) error { return nil }
+
+func nextEvent(t *testing.T, m *LeaseManager, want LeaseEventType) LeaseEvent {
+	t.Helper()
+	select {
+	case ev := <-m.Events:
+		if ev.Type != want {
+			t.Fatalf("event %v, want %v", ev.Type, want)
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %v event, in state %v", want, m.State())
+	}
+	return LeaseEvent{}
+}
+
+func TestLeaseManager(t *testing.T) {
+	s := newMockServer()
+	var mu sync.Mutex
+	var configured []LeaseEventType
+	m := &LeaseManager{
+		Timeout: 5 * time.Millisecond,
+		Retry:   1,
+		Configure: func(iface netlink.Link, ev LeaseEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			configured = append(configured, ev.Type)
+			return nil
+		},
+		conn: s,
+		// The 10 second lease lasts 1s. Each exchange takes 100ms, the
+		// read timeout of dhcp4client.
+		second: 100 * time.Millisecond,
+	}
+	if err := m.Start("lo"); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	acquired := time.Now()
+	ev := nextEvent(t, m, LeaseAcquired)
+	if ev.Lease.String() != "10.0.0.2/24" || ev.Err != nil {
+		t.Errorf("acquired %v (%v), want 10.0.0.2/24", ev.Lease, ev.Err)
+	}
+
+	// Renewed at T1, from the server that granted the lease.
+	nextEvent(t, m, LeaseRenewed)
+	if d := time.Since(acquired); d < 500*time.Millisecond {
+		t.Errorf("renewed after %v, want T1 of 500ms", d)
+	}
+	reqs := s.log()
+	renew := reqs[len(reqs)-1]
+	if !renew.dest.IP.Equal(serverIP) || !renew.p.CIAddr.Equal(clientIP) {
+		t.Errorf("renewal sent to %v for %v, want to %v for %v", renew.dest, renew.p.CIAddr, serverIP, clientIP)
+	}
+	if renew.p.Options.Get(dhcp4.OptionRequestedIPAddress) != nil || renew.p.Options.Get(dhcp4.OptionServerIdentifier) != nil {
+		t.Errorf("renewal has requested address or server identifier: %v", renew.p.Options)
+	}
+
+	// If the server does not answer, any server is asked at T2.
+	s.setAnswer(func(dest *net.UDPAddr) bool { return dest.IP.Equal(net.IPv4bcast) })
+	renewed := time.Now()
+	nextEvent(t, m, LeaseRenewed)
+	if d := time.Since(renewed); d < 875*time.Millisecond {
+		t.Errorf("rebound after %v, want T2 of 875ms", d)
+	}
+	reqs = s.log()
+	if rebind := reqs[len(reqs)-1]; !rebind.dest.IP.Equal(net.IPv4bcast) || !rebind.p.CIAddr.Equal(clientIP) {
+		t.Errorf("rebinding sent to %v for %v, want broadcast for %v", rebind.dest, rebind.p.CIAddr, clientIP)
+	}
+	if unicast := reqs[len(reqs)-2]; !unicast.dest.IP.Equal(serverIP) {
+		t.Errorf("renewal before rebinding sent to %v, want %v", unicast.dest, serverIP)
+	}
+
+	// Without any server, the lease expires, and it starts over.
+	s.setAnswer(func(*net.UDPAddr) bool { return false })
+	rebound := time.Now()
+	nextEvent(t, m, LeaseExpired)
+	if d := time.Since(rebound); d < time.Second {
+		t.Errorf("expired after %v, want 1s", d)
+	}
+	s.setAnswer(func(*net.UDPAddr) bool { return true })
+	nextEvent(t, m, LeaseAcquired)
+
+	m.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	want := []LeaseEventType{LeaseAcquired, LeaseRenewed, LeaseRenewed, LeaseExpired, LeaseAcquired}
+	if len(configured) != len(want) {
+		t.Fatalf("configured %v, want %v", configured, want)
+	}
+	for i := range want {
+		if configured[i] != want[i] {
+			t.Errorf("configured %v, want %v", configured, want)
+		}
+	}
+}
+
+func TestLeaseManagerNak(t *testing.T) {
+	s := newMockServer()
+	m := &LeaseManager{
+		Timeout:   5 * time.Millisecond,
+		Retry:     1,
+		Configure: func(netlink.Link, LeaseEvent) error { return nil },
+		conn:      s,
+		second:    100 * time.Millisecond,
+	}
+	if err := m.Start("lo"); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Start("lo"); err == nil {
+		t.Errorf("second Start() = nil, want error")
+	}
+
+	nextEvent(t, m, LeaseAcquired)
+	// Refuse the renewal.
+	s.setAnswer(func(*net.UDPAddr) bool {
+		s.replies <- nak(t, s)
+		return false
+	})
+	nextEvent(t, m, LeaseExpired)
+}
+
+// nak returns a NAK to the last request.
+func nak(t *testing.T, s *mockServer) []byte {
+	req := s.requests[len(s.requests)-1]
+	reply := dhcp4.NewPacket(dhcp4.BootReply)
+	reply.TransactionID = req.p.TransactionID
+	reply.Options.Add(dhcp4.OptionDHCPMessageType, dhcp4opts.DHCPNAK)
+	p, err := reply.MarshalBinary()
+	if err != nil {
+		t.Error(err)
+	}
+	return p
+}
+
+func TestLeaseTimes(t *testing.T) {
+	m := &LeaseManager{second: time.Second}
+	now := time.Now()
+	ack := dhcp4.NewPacket(dhcp4.BootReply)
+
+	if l := m.bind(ack, now); !l.infinite {
+		t.Errorf("lease without a lease time is not infinite: %+v", l)
+	}
+
+	for _, tt := range []struct {
+		opts           map[dhcp4.OptionCode]uint32
+		t1, t2, expiry time.Duration
+	}{
+		{map[dhcp4.OptionCode]uint32{dhcp4.OptionIPAddressLeaseTime: 3600}, 1800 * time.Second, 3150 * time.Second, time.Hour},
+		{map[dhcp4.OptionCode]uint32{dhcp4.OptionIPAddressLeaseTime: 3600, dhcp4.OptionRenewalTimeValue: 60, dhcp4.OptionRebindingTimeValue: 120}, time.Minute, 2 * time.Minute, time.Hour},
+	} {
+		ack := dhcp4.NewPacket(dhcp4.BootReply)
+		for code, v := range tt.opts {
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, v)
+			ack.Options.AddRaw(code, b)
+		}
+		l := m.bind(ack, now)
+		if l.infinite || l.t1.Sub(now) != tt.t1 || l.t2.Sub(now) != tt.t2 || l.expiry.Sub(now) != tt.expiry {
+			t.Errorf("lease with %v: T1 %v T2 %v expiry %v, want %v %v %v", tt.opts, l.t1.Sub(now), l.t2.Sub(now), l.expiry.Sub(now), tt.t1, tt.t2, tt.expiry)
+		}
+	}
+}
+
+func TestVendorOptions(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		class string
+		data  []byte
+		want  map[uint8][]byte
+	}{
+		{name: "none"},
+		{
+			name: "generic",
+			data: []byte{241, 4, 10, 0, 0, 1, 255},
+			want: map[uint8][]byte{241: {10, 0, 0, 1}},
+		},
+		{
+			name:  "PXE",
+			class: "PXEClient:Arch:00000:UNDI:002001",
+			data:  []byte{6, 1, 8, 255},
+			want:  map[uint8][]byte{6: {8}},
+		},
+		{
+			name: "truncated",
+			data: []byte{241, 4, 10},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := dhcp4.NewPacket(dhcp4.BootReply)
+			if tt.data != nil {
+				ack.Options.AddRaw(dhcp4.OptionVendorSpecificInformation, tt.data)
+			}
+			if tt.class != "" {
+				ack.Options.AddRaw(dhcp4.OptionVendorClassIdentifier, []byte(tt.class))
+			}
+			if got := vendorOptions(ack); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("vendorOptions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mdns finds boot servers that advertise themselves on the local
+// network with multicast DNS, as in RFC 6762, and DNS-SD, as in RFC 6763.
+//
+// A boot server advertises an instance of the service _u-root-boot._tcp
+// with an SRV record for its HTTP server, and a TXT record whose kernel=,
+// initrd= and cmdline= keys say what to boot, for example:
+//
+//	lab._u-root-boot._tcp.local. SRV 0 0 8080 bootserver.local.
+//	lab._u-root-boot._tcp.local. TXT "kernel=/boot/vmlinuz" "initrd=/boot/initrd" "cmdline=console=ttyS0"
+package mdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/netboot"
+	"golang.org/x/sys/unix"
+)
+
+// Service is the DNS-SD service boot servers advertise.
+const Service = "_u-root-boot._tcp.local."
+
+// DNS record types and classes.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+
+	classIN = 1
+	// classUnicastResponse, in a question, asks for a unicast reply.
+	classUnicastResponse = 0x8000
+	// flagResponse is the QR bit of the header.
+	flagResponse = 0x8000
+
+	headerLen = 12
+)
+
+var (
+	// mdnsGroup is where queries are sent.
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	// defaultTimeout is how long DiscoverBootServers collects replies
+	// for, unless its context has a deadline.
+	defaultTimeout = 2 * time.Second
+	// resendInterval is how often the query is sent again while
+	// collecting replies, as multicast may be lost.
+	resendInterval = time.Second
+)
+
+// BootServer is a boot server found over mDNS.
+type BootServer struct {
+	// Instance is the name of the service instance, such as
+	// lab._u-root-boot._tcp.local.
+	Instance string
+	// Host is the target of its SRV record.
+	Host string
+	// IP is the address of Host or, if there is no address record for
+	// it, of the server that replied.
+	IP   net.IP
+	Port int
+
+	// Kernel, Initrd and Cmdline are from the TXT record. Kernel and
+	// Initrd are paths on the HTTP server; Initrd may be empty.
+	Kernel  string
+	Initrd  string
+	Cmdline string
+}
+
+// URL returns the URL of the HTTP server of s.
+func (s *BootServer) URL() string {
+	return fmt.Sprintf("http://%s/", net.JoinHostPort(s.IP.String(), strconv.Itoa(s.Port)))
+}
+
+// LinuxImage fetches the kernel and initrd of s from its HTTP server.
+func (s *BootServer) LinuxImage(opts ...netboot.HTTPBootClientOption) (*boot.LinuxImage, error) {
+	if s.Kernel == "" {
+		return nil, fmt.Errorf("boot server %s has no kernel", s.Instance)
+	}
+	c, err := netboot.NewHTTPBootClient(s.URL(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	kernel, err := c.Fetch(s.Kernel)
+	if err != nil {
+		return nil, err
+	}
+	li := boot.NewLinuxImage(kernel, nil, s.Cmdline)
+	if s.Initrd != "" {
+		if li.Initrd, err = c.Fetch(s.Initrd); err != nil {
+			return nil, err
+		}
+	}
+	return li, nil
+}
+
+// DiscoverBootServers queries for boot servers on iface, which must be up,
+// and returns those that reply until ctx is done, or for two seconds if it
+// has no deadline, in the order they replied.
+func DiscoverBootServers(ctx context.Context, iface string) ([]*BootServer, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+	// Replies to a query from a port other than 5353 are sent back to
+	// it, as to a plain DNS client.
+	conn, err := lc.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	servers, err := discover(ctx, conn, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("mDNS on %s: %v", iface, err)
+	}
+	return servers, nil
+}
+
+// FetchLinuxImage fetches the image of the first boot server to reply on
+// iface.
+func FetchLinuxImage(ctx context.Context, iface string, opts ...netboot.HTTPBootClientOption) (*boot.LinuxImage, error) {
+	servers, err := DiscoverBootServers(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no boot server replied on %s", iface)
+	}
+	return servers[0].LinuxImage(opts...)
+}
+
+// discover sends queries on conn to dest and collects the replies.
+func discover(ctx context.Context, conn net.PacketConn, dest net.Addr) ([]*BootServer, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	query := queryPacket(binary.BigEndian.Uint16(id[:]), Service)
+
+	var a answers
+	buf := make([]byte, 9000)
+	for {
+		if _, err := conn.WriteTo(query, dest); err != nil {
+			return nil, err
+		}
+		deadline, _ := ctx.Deadline()
+		if resend := time.Now().Add(resendInterval); resend.Before(deadline) {
+			deadline = resend
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var src net.IP
+			if u, ok := from.(*net.UDPAddr); ok {
+				src = u.IP
+			}
+			// Replies that cannot be read are someone else's problem.
+			a.add(buf[:n], binary.BigEndian.Uint16(id[:]), src)
+		}
+		if ctx.Err() != nil {
+			return a.servers(Service), nil
+		}
+	}
+}
+
+// queryPacket returns a query for the PTR records of service.
+func queryPacket(id uint16, service string) []byte {
+	p := make([]byte, headerLen, 64)
+	binary.BigEndian.PutUint16(p, id)
+	// One question.
+	binary.BigEndian.PutUint16(p[4:], 1)
+	p = appendName(p, service)
+	var q [4]byte
+	binary.BigEndian.PutUint16(q[:], typePTR)
+	binary.BigEndian.PutUint16(q[2:], classIN|classUnicastResponse)
+	return append(p, q[:]...)
+}
+
+// appendName appends name, with dots between its labels, in the wire
+// format of DNS.
+func appendName(p []byte, name string) []byte {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		p = append(p, byte(len(l)))
+		p = append(p, l...)
+	}
+	return append(p, 0)
+}
+
+var errMalformed = errors.New("malformed DNS message")
+
+// readName returns the name at off in the message p, following
+// compression pointers, and the offset after it.
+func readName(p []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for {
+		if off >= len(p) {
+			return "", 0, errMalformed
+		}
+		l := int(p[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(p) {
+				return "", 0, errMalformed
+			}
+			// Pointers must go back, so that they cannot loop.
+			to := int(binary.BigEndian.Uint16(p[off:]) & 0x3fff)
+			if to >= off {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = to
+		case l&0xc0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+l > len(p) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(p[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// srv is the data of an SRV record.
+type srv struct {
+	target string
+	port   int
+}
+
+// ptr is a PTR record: instance is an instance of service.
+type ptr struct {
+	service, instance string
+}
+
+// answers are the records of the replies to a query. Names are lower case,
+// but for the instances of ptrs, which are kept as they came.
+type answers struct {
+	// ptrs are in the order they arrived.
+	ptrs  []ptr
+	seen  map[string]bool
+	srvs  map[string]srv
+	txts  map[string][]string
+	addrs map[string][]net.IP
+	// from is the address of the server that told of each instance.
+	from map[string]net.IP
+}
+
+// add adds the records of the reply p, whose ID must be id, or 0 as for
+// multicast replies, from src.
+func (a *answers) add(p []byte, id uint16, src net.IP) error {
+	if len(p) < headerLen {
+		return errMalformed
+	}
+	if binary.BigEndian.Uint16(p[2:])&flagResponse == 0 {
+		return nil
+	}
+	if rid := binary.BigEndian.Uint16(p); rid != id && rid != 0 {
+		return nil
+	}
+	if a.seen == nil {
+		a.seen = make(map[string]bool)
+		a.srvs = make(map[string]srv)
+		a.txts = make(map[string][]string)
+		a.addrs = make(map[string][]net.IP)
+		a.from = make(map[string]net.IP)
+	}
+
+	off := headerLen
+	for i := 0; i < int(binary.BigEndian.Uint16(p[4:])); i++ {
+		var err error
+		if _, off, err = readName(p, off); err != nil {
+			return err
+		}
+		off += 4
+	}
+	records := 0
+	for _, c := range []int{6, 8, 10} {
+		records += int(binary.BigEndian.Uint16(p[c:]))
+	}
+	for i := 0; i < records; i++ {
+		name, next, err := readName(p, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(p) {
+			return errMalformed
+		}
+		typ := binary.BigEndian.Uint16(p[next:])
+		rdlen := int(binary.BigEndian.Uint16(p[next+8:]))
+		start := next + 10
+		if start+rdlen > len(p) {
+			return errMalformed
+		}
+		rdata := p[start : start+rdlen]
+		off = start + rdlen
+		name = strings.ToLower(name)
+
+		switch typ {
+		case typePTR:
+			target, _, err := readName(p, start)
+			if err != nil {
+				return err
+			}
+			key := strings.ToLower(target)
+			if !a.seen[key] {
+				a.seen[key] = true
+				a.ptrs = append(a.ptrs, ptr{service: name, instance: target})
+				a.from[key] = src
+			}
+		case typeSRV:
+			if rdlen < 7 {
+				return errMalformed
+			}
+			target, _, err := readName(p, start+6)
+			if err != nil {
+				return err
+			}
+			a.srvs[name] = srv{target: strings.ToLower(target), port: int(binary.BigEndian.Uint16(rdata[4:]))}
+		case typeTXT:
+			var txt []string
+			for len(rdata) > 0 {
+				l := int(rdata[0])
+				if 1+l > len(rdata) {
+					return errMalformed
+				}
+				txt = append(txt, string(rdata[1:1+l]))
+				rdata = rdata[1+l:]
+			}
+			a.txts[name] = txt
+		case typeA, typeAAAA:
+			if len(rdata) == net.IPv4len || len(rdata) == net.IPv6len {
+				a.addrs[name] = append(a.addrs[name], append(net.IP(nil), rdata...))
+			}
+		}
+	}
+	return nil
+}
+
+// servers returns the boot servers that are instances of service and have
+// an SRV record.
+func (a *answers) servers(service string) []*BootServer {
+	var servers []*BootServer
+	for _, p := range a.ptrs {
+		if p.service != strings.ToLower(service) {
+			continue
+		}
+		key := strings.ToLower(p.instance)
+		rec, ok := a.srvs[key]
+		if !ok {
+			continue
+		}
+		s := &BootServer{Instance: p.instance, Host: rec.target, Port: rec.port, IP: a.from[key]}
+		// IPv4 is preferred, as the interface may have no IPv6 route.
+		if addrs := a.addrs[rec.target]; len(addrs) > 0 {
+			s.IP = addrs[0]
+			for _, ip := range addrs {
+				if ip.To4() != nil {
+					s.IP = ip
+					break
+				}
+			}
+		}
+		for _, kv := range a.txts[key] {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 {
+				continue
+			}
+			switch strings.ToLower(kv[:i]) {
+			case "kernel":
+				s.Kernel = kv[i+1:]
+			case "initrd":
+				s.Initrd = kv[i+1:]
+			case "cmdline":
+				s.Cmdline = kv[i+1:]
+			}
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
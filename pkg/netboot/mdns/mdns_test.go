@@ -0,0 +1,294 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// message builds a DNS message, compressing names as a responder would.
+type message struct {
+	b []byte
+	// names are where each name suffix written so far is.
+	names   map[string]int
+	records int
+}
+
+func newMessage(id uint16) *message {
+	m := &message{b: make([]byte, headerLen), names: make(map[string]int)}
+	binary.BigEndian.PutUint16(m.b, id)
+	binary.BigEndian.PutUint16(m.b[2:], flagResponse|0x0400)
+	return m
+}
+
+func (m *message) name(n string) {
+	for n != "" && n != "." {
+		if off, ok := m.names[n]; ok {
+			m.b = append(m.b, 0xc0|byte(off>>8), byte(off))
+			return
+		}
+		m.names[n] = len(m.b)
+		i := strings.IndexByte(n, '.')
+		m.b = append(m.b, byte(i))
+		m.b = append(m.b, n[:i]...)
+		n = n[i+1:]
+	}
+	m.b = append(m.b, 0)
+}
+
+// record appends a record, calling rdata to append its data.
+func (m *message) record(name string, typ uint16, rdata func()) {
+	m.name(name)
+	var h [10]byte
+	binary.BigEndian.PutUint16(h[:], typ)
+	binary.BigEndian.PutUint16(h[2:], classIN)
+	binary.BigEndian.PutUint32(h[4:], 120)
+	m.b = append(m.b, h[:]...)
+	lenOff := len(m.b) - 2
+	rdata()
+	binary.BigEndian.PutUint16(m.b[lenOff:], uint16(len(m.b)-lenOff-2))
+	m.records++
+	binary.BigEndian.PutUint16(m.b[6:], uint16(m.records))
+}
+
+func (m *message) ptr(service, instance string) {
+	m.record(service, typePTR, func() { m.name(instance) })
+}
+
+func (m *message) srv(instance, target string, port uint16) {
+	m.record(instance, typeSRV, func() {
+		var b [6]byte
+		binary.BigEndian.PutUint16(b[4:], port)
+		m.b = append(m.b, b[:]...)
+		m.name(target)
+	})
+}
+
+func (m *message) txt(instance string, kvs ...string) {
+	m.record(instance, typeTXT, func() {
+		for _, kv := range kvs {
+			m.b = append(m.b, byte(len(kv)))
+			m.b = append(m.b, kv...)
+		}
+	})
+}
+
+func (m *message) a(host string, ip net.IP) {
+	m.record(host, typeA, func() { m.b = append(m.b, ip.To4()...) })
+}
+
+// responder answers queries for Service on loopback with replies.
+func responder(t *testing.T, replies func(id uint16) [][]byte) (*net.UDPAddr, func()) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			want := queryPacket(binary.BigEndian.Uint16(q), Service)
+			if !reflect.DeepEqual(q, want) {
+				t.Errorf("responder got query %x, want %x", q, want)
+				continue
+			}
+			for _, r := range replies(binary.BigEndian.Uint16(q)) {
+				conn.WriteTo(r, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), func() { conn.Close() }
+}
+
+func testDiscover(t *testing.T, dest net.Addr) []*BootServer {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	servers, err := discover(ctx, conn, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+func TestDiscover(t *testing.T) {
+	addr, stop := responder(t, func(id uint16) [][]byte {
+		lab := newMessage(id)
+		lab.ptr(Service, "Lab."+Service)
+		lab.srv("Lab."+Service, "bootserver.local.", 8080)
+		lab.txt("Lab."+Service, "kernel=/boot/vmlinuz", "Initrd=/boot/initrd", "cmdline=console=ttyS0 root=/dev/sda1", "note")
+		lab.a("bootserver.local.", net.IPv4(10, 0, 0, 1))
+
+		// Without an address record, the server's own address is
+		// used.
+		spare := newMessage(0)
+		spare.ptr(Service, "spare."+Service)
+		spare.srv("spare."+Service, "spare.local.", 80)
+		spare.txt("spare."+Service, "kernel=vmlinuz")
+
+		// Other services, queries, other IDs, instances without SRV
+		// records and garbage are ignored.
+		other := newMessage(id)
+		other.ptr("_http._tcp.local.", "printer._http._tcp.local.")
+		other.srv("printer._http._tcp.local.", "printer.local.", 631)
+		query := queryPacket(id, Service)
+		stale := newMessage(id + 1)
+		stale.ptr(Service, "stale."+Service)
+		stale.srv("stale."+Service, "stale.local.", 80)
+		nosrv := newMessage(id)
+		nosrv.ptr(Service, "nosrv."+Service)
+		loop := newMessage(id)
+		loop.b = append(loop.b, 0xc0, headerLen)
+		binary.BigEndian.PutUint16(loop.b[6:], 1)
+
+		// The same servers again, as for a second query.
+		return [][]byte{other.b, query, lab.b, stale.b, nosrv.b, loop.b, {1}, spare.b, lab.b}
+	})
+	defer stop()
+
+	want := []*BootServer{
+		{
+			Instance: "Lab." + Service,
+			Host:     "bootserver.local.",
+			IP:       net.IPv4(10, 0, 0, 1).To4(),
+			Port:     8080,
+			Kernel:   "/boot/vmlinuz",
+			Initrd:   "/boot/initrd",
+			Cmdline:  "console=ttyS0 root=/dev/sda1",
+		},
+		{
+			Instance: "spare." + Service,
+			Host:     "spare.local.",
+			IP:       net.IPv4(127, 0, 0, 1).To4(),
+			Port:     80,
+			Kernel:   "vmlinuz",
+		},
+	}
+	servers := testDiscover(t, addr)
+	if len(servers) == 2 && servers[1].IP.Equal(want[1].IP) {
+		servers[1].IP = want[1].IP
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("discover() =")
+		for _, s := range servers {
+			t.Errorf("\t%+v", s)
+		}
+		t.Errorf("want")
+		for _, s := range want {
+			t.Errorf("\t%+v", s)
+		}
+	}
+	if u := want[0].URL(); u != "http://10.0.0.1:8080/" {
+		t.Errorf("URL() = %s, want http://10.0.0.1:8080/", u)
+	}
+
+	// Nobody answering is not an error.
+	silent, stop := responder(t, func(uint16) [][]byte { return nil })
+	defer stop()
+	if servers := testDiscover(t, silent); len(servers) != 0 {
+		t.Errorf("discover() without replies = %v, want none", servers)
+	}
+}
+
+func TestReadName(t *testing.T) {
+	m := newMessage(0)
+	m.name("lab._u-root-boot._tcp.local.")
+	second := len(m.b)
+	m.name("spare._u-root-boot._tcp.local.")
+	for _, tt := range []struct {
+		off  int
+		name string
+		end  int
+	}{
+		{headerLen, "lab._u-root-boot._tcp.local.", second},
+		{second, "spare._u-root-boot._tcp.local.", len(m.b)},
+	} {
+		name, end, err := readName(m.b, tt.off)
+		if err != nil || name != tt.name || end != tt.end {
+			t.Errorf("readName(%d) = %q, %d, %v, want %q, %d", tt.off, name, end, err, tt.name, tt.end)
+		}
+	}
+	for _, b := range [][]byte{
+		{3, 'a', 'b'},
+		{0xc0},
+		{0xc0, 0},
+		{0x40, 0},
+		{1, 'a', 0xc0, 2},
+	} {
+		if name, _, err := readName(b, 0); err == nil {
+			t.Errorf("readName(%x) = %q, want error", b, name)
+		}
+	}
+}
+
+func TestFetchLinuxImage(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/boot/vmlinuz":
+			w.Write([]byte("kernel"))
+		case "/boot/initrd":
+			w.Write([]byte("initrd"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	port := uint16(s.Listener.Addr().(*net.TCPAddr).Port)
+	addr, stop := responder(t, func(id uint16) [][]byte {
+		m := newMessage(id)
+		m.ptr(Service, "lab."+Service)
+		m.srv("lab."+Service, "localhost.", port)
+		m.txt("lab."+Service, "kernel=/boot/vmlinuz", "initrd=/boot/initrd", "cmdline=quiet")
+		m.a("localhost.", net.IPv4(127, 0, 0, 1))
+		return [][]byte{m.b}
+	})
+	defer stop()
+
+	defer func(g *net.UDPAddr) { mdnsGroup = g }(mdnsGroup)
+	mdnsGroup = addr
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	li, err := FetchLinuxImage(ctx, "lo")
+	if os.IsPermission(err) || err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skipf("binding to lo: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := uio.ReadAll(li.Kernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := uio.ReadAll(li.Initrd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(k) != "kernel" || string(i) != "initrd" || li.Cmdline != "quiet" {
+		t.Errorf("FetchLinuxImage() = %q, %q, %q, want kernel, initrd, quiet", k, i, li.Cmdline)
+	}
+
+	if _, err := (&BootServer{Instance: "empty"}).LinuxImage(); err == nil {
+		t.Errorf("LinuxImage() of a server without kernel succeeded")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package opt43 parses the vendor-specific information of DHCP option 43,
+// which PXE and other netboot environments use to pass boot parameters.
+package opt43
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Decoder returns the sub-options in the option 43 data of a vendor.
+type Decoder func(data []byte) (map[uint8][]byte, error)
+
+// decoders are the known Decoders, by prefix of the vendor class identifier
+// (option 60) they are for.
+var decoders = []struct {
+	prefix string
+	decode Decoder
+}{
+	{"PXEClient", ParsePXE},
+}
+
+// ParseVendorSpecific returns the sub-options in data, option 43 of a
+// DHCP reply to a client of vendorClass.
+//
+// Known vendor classes are checked by their decoders. All others use
+// ParseSubOptions, the encapsulated format that RFC 2132 suggests.
+func ParseVendorSpecific(data []byte, vendorClass string) (map[uint8][]byte, error) {
+	for _, d := range decoders {
+		if strings.HasPrefix(vendorClass, d.prefix) {
+			return d.decode(data)
+		}
+	}
+	return ParseSubOptions(data)
+}
+
+// Sub-option codes that carry no length.
+const (
+	pad = 0
+	end = 255
+)
+
+// ParseSubOptions returns the sub-options of data, each a code, a length
+// and that many bytes of value, up to an end sub-option or the end of data.
+// Pad sub-options are skipped and the values of a repeated code are
+// concatenated, as for options in RFC 3396.
+func ParseSubOptions(data []byte) (map[uint8][]byte, error) {
+	opts := make(map[uint8][]byte)
+	for i := 0; i < len(data); {
+		code := data[i]
+		if code == end {
+			break
+		}
+		if code == pad {
+			i++
+			continue
+		}
+		if i+1 >= len(data) {
+			return nil, fmt.Errorf("sub-option %d at %d has no length", code, i)
+		}
+		n := int(data[i+1])
+		if i+2+n > len(data) {
+			return nil, fmt.Errorf("sub-option %d at %d has %d bytes, want %d", code, i, len(data)-i-2, n)
+		}
+		v, ok := opts[code]
+		if !ok {
+			v = []byte{}
+		}
+		opts[code] = append(v, data[i+2:i+2+n]...)
+		i += 2 + n
+	}
+	return opts, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package opt43
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseVendorSpecific(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		class string
+		data  []byte
+		want  map[uint8][]byte
+	}{
+		{
+			// Boot from the file in the reply without discovery.
+			name:  "PXE use boot file",
+			class: "PXEClient",
+			data:  []byte{0x06, 0x01, 0x08, 0xff},
+			want:  map[uint8][]byte{PXEDiscoveryControl: {0x08}},
+		},
+		{
+			// Multicast discovery on 224.0.1.2, a boot server of type 0x8000 on
+			// 10.0.0.1, a menu and a prompt with a 10 second timeout.
+			name:  "PXE boot menu",
+			class: "PXEClient:Arch:00000:UNDI:002001",
+			data: []byte{
+				0x06, 0x01, 0x03,
+				0x07, 0x04, 224, 0, 1, 2,
+				0x08, 0x07, 0x80, 0x00, 0x01, 10, 0, 0, 1,
+				0x09, 0x0c, 0x80, 0x00, 0x09, 'u', '-', 'r', 'o', 'o', 't', ' ', 'o', 's',
+				0x0a, 0x07, 0x0a, 'S', 'e', 'l', 'e', 'c', 't',
+				0x00, 0x00,
+				0xff,
+				0x00, 0x00, 0x00,
+			},
+			want: map[uint8][]byte{
+				PXEDiscoveryControl:     {0x03},
+				PXEDiscoveryMulticastIP: {224, 0, 1, 2},
+				PXEBootServers:          {0x80, 0x00, 0x01, 10, 0, 0, 1},
+				PXEBootMenu:             []byte("\x80\x00\x09u-root os"),
+				PXEMenuPrompt:           []byte("\x0aSelect"),
+			},
+		},
+		{
+			// Cisco lightweight access points get their controllers in
+			// sub-option 241.
+			name:  "Cisco AP",
+			class: "Cisco AP c1240",
+			data:  []byte{0xf1, 0x08, 192, 168, 10, 5, 192, 168, 10, 6},
+			want:  map[uint8][]byte{241: {192, 168, 10, 5, 192, 168, 10, 6}},
+		},
+		{
+			// Long values are split over repeated sub-options.
+			name: "repeated",
+			data: []byte{0x01, 0x02, 'a', 'b', 0x02, 0x00, 0x01, 0x01, 'c'},
+			want: map[uint8][]byte{1: []byte("abc"), 2: {}},
+		},
+		{name: "empty", data: nil, want: map[uint8][]byte{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVendorSpecific(tt.data, tt.class)
+			if err != nil {
+				t.Fatalf("ParseVendorSpecific() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVendorSpecific() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVendorSpecificErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		class string
+		data  []byte
+	}{
+		{"no length", "", []byte{0x01, 0x01, 'a', 0x02}},
+		{"truncated", "", []byte{0x01, 0x05, 'a', 'b'}},
+		{"PXE discovery control size", "PXEClient", []byte{0x06, 0x02, 0x08, 0x00}},
+		{"PXE multicast IP size", "PXEClient", []byte{0x07, 0x03, 224, 0, 1}},
+		{"not sub-options", "", []byte("10.0.0.1")},
+	} {
+		if _, err := ParseVendorSpecific(tt.data, tt.class); err == nil {
+			t.Errorf("ParseVendorSpecific(%s) = nil, want error", tt.name)
+		}
+	}
+	// Other vendors may use the PXE sub-option codes for anything.
+	if _, err := ParseVendorSpecific([]byte{0x06, 0x02, 0x08, 0x00}, "MSFT 5.0"); err != nil {
+		t.Errorf("ParseVendorSpecific() of another vendor = %v, want nil", err)
+	}
+}
+
+func TestPXEDiscovery(t *testing.T) {
+	opts, err := ParsePXE([]byte{0x06, 0x01, PXEDisableBroadcast | PXEServerListOnly, 0x07, 0x04, 224, 0, 1, 2, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, mcast := PXEDiscovery(opts)
+	if control != PXEDisableBroadcast|PXEServerListOnly || !mcast.Equal(net.IPv4(224, 0, 1, 2)) {
+		t.Errorf("PXEDiscovery() = %#x, %v, want 0x5, 224.0.1.2", control, mcast)
+	}
+	if control, mcast := PXEDiscovery(nil); control != 0 || mcast != nil {
+		t.Errorf("PXEDiscovery(nil) = %#x, %v, want 0, nil", control, mcast)
+	}
+}
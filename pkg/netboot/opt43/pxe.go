@@ -0,0 +1,78 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package opt43
+
+import (
+	"fmt"
+	"net"
+)
+
+// PXE sub-options, from the PXE specification 2.1.
+const (
+	PXEMTFTPIP              = 1
+	PXEMTFTPClientPort      = 2
+	PXEMTFTPServerPort      = 3
+	PXEMTFTPTimeout         = 4
+	PXEMTFTPDelay           = 5
+	PXEDiscoveryControl     = 6
+	PXEDiscoveryMulticastIP = 7
+	PXEBootServers          = 8
+	PXEBootMenu             = 9
+	PXEMenuPrompt           = 10
+	PXEBootItem             = 71
+)
+
+// Bits of PXEDiscoveryControl.
+const (
+	// PXEDisableBroadcast disables broadcast discovery of boot servers.
+	PXEDisableBroadcast = 1 << 0
+	// PXEDisableMulticast disables multicast discovery of boot servers.
+	PXEDisableMulticast = 1 << 1
+	// PXEServerListOnly accepts only the servers of PXEBootServers.
+	PXEServerListOnly = 1 << 2
+	// PXEUseBootFile downloads the boot file of the reply without
+	// discovering boot servers.
+	PXEUseBootFile = 1 << 3
+)
+
+// pxeSizes are the sizes of the fixed-size PXE sub-options.
+var pxeSizes = map[uint8]int{
+	PXEMTFTPIP:              4,
+	PXEMTFTPClientPort:      2,
+	PXEMTFTPServerPort:      2,
+	PXEMTFTPTimeout:         1,
+	PXEMTFTPDelay:           1,
+	PXEDiscoveryControl:     1,
+	PXEDiscoveryMulticastIP: 4,
+	PXEBootItem:             4,
+}
+
+// ParsePXE is the Decoder of PXE clients. It checks the sizes of the PXE
+// sub-options of fixed size.
+func ParsePXE(data []byte) (map[uint8][]byte, error) {
+	opts, err := ParseSubOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	for code, size := range pxeSizes {
+		if v, ok := opts[code]; ok && len(v) != size {
+			return nil, fmt.Errorf("PXE sub-option %d has %d bytes, want %d", code, len(v), size)
+		}
+	}
+	return opts, nil
+}
+
+// PXEDiscovery returns the discovery control bits and the multicast
+// discovery address of the PXE sub-options opts, which are 0 and nil if
+// not set.
+func PXEDiscovery(opts map[uint8][]byte) (control uint8, multicast net.IP) {
+	if v := opts[PXEDiscoveryControl]; len(v) == 1 {
+		control = v[0]
+	}
+	if v := opts[PXEDiscoveryMulticastIP]; len(v) == 4 {
+		multicast = net.IP(append([]byte(nil), v...))
+	}
+	return control, multicast
+}
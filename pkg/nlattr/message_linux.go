@@ -0,0 +1,53 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nlattr
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Message is a raw netlink message.
+type Message struct {
+	Type  uint16
+	Flags uint16
+	Seq   uint32
+	Data  []byte
+}
+
+// ParseMessages splits a datagram into netlink messages.
+func ParseMessages(b []byte) ([]Message, error) {
+	var msgs []Message
+	for len(b) >= unix.SizeofNlMsghdr {
+		l := int(Native.Uint32(b[0:]))
+		if l < unix.SizeofNlMsghdr || l > len(b) {
+			return nil, fmt.Errorf("netlink message of length %d in %d bytes", l, len(b))
+		}
+		msgs = append(msgs, Message{
+			Type:  Native.Uint16(b[4:]),
+			Flags: Native.Uint16(b[6:]),
+			Seq:   Native.Uint32(b[8:]),
+			Data:  b[unix.SizeofNlMsghdr:l],
+		})
+		if Align4(l) >= len(b) {
+			break
+		}
+		b = b[Align4(l):]
+	}
+	return msgs, nil
+}
+
+// Err returns the error in an NLMSG_ERROR message, which is nil for an ack.
+func (m Message) Err() error {
+	if len(m.Data) < 4 {
+		return fmt.Errorf("short netlink error")
+	}
+	if errno := int32(Native.Uint32(m.Data)); errno != 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
+}
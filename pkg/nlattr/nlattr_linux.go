@@ -0,0 +1,166 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nlattr encodes and decodes netlink attributes and messages, for
+// netlink families that github.com/vishvananda/netlink does not speak.
+//
+// Attribute headers are in host byte order, but families differ in the byte
+// order of the values, hence the numeric helpers take one.
+package nlattr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Native is the host byte order, which netlink headers use.
+var Native = nativeOrder()
+
+func nativeOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Attr is a netlink attribute.
+type Attr struct {
+	Type uint16
+	Data []byte
+}
+
+// Align4 rounds n up to the 4 byte alignment of attributes and messages.
+func Align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// U8 returns an attribute with the value v.
+func U8(typ uint16, v uint8) Attr {
+	return Attr{typ, []byte{v}}
+}
+
+// U16 returns an attribute with the value v in byte order order.
+func U16(order binary.ByteOrder, typ uint16, v uint16) Attr {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return Attr{typ, b}
+}
+
+// U32 returns an attribute with the value v in byte order order.
+func U32(order binary.ByteOrder, typ uint16, v uint32) Attr {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return Attr{typ, b}
+}
+
+// Flag returns an attribute that is set by being there.
+func Flag(typ uint16) Attr {
+	return Attr{typ, nil}
+}
+
+// String returns an attribute with s NUL-terminated.
+func String(typ uint16, s string) Attr {
+	return Attr{typ, append([]byte(s), 0)}
+}
+
+// Nested returns an attribute holding attrs.
+func Nested(typ uint16, attrs ...Attr) Attr {
+	return Attr{typ | unix.NLA_F_NESTED, Encode(attrs)}
+}
+
+// Encode encodes attrs, each padded to 4 bytes.
+func Encode(attrs []Attr) []byte {
+	var b []byte
+	for _, a := range attrs {
+		l := unix.SizeofNlAttr + len(a.Data)
+		h := make([]byte, Align4(l))
+		Native.PutUint16(h[0:], uint16(l))
+		Native.PutUint16(h[2:], a.Type)
+		copy(h[unix.SizeofNlAttr:], a.Data)
+		b = append(b, h...)
+	}
+	return b
+}
+
+// Parse decodes attributes, dropping the nested and byte order flags from
+// their types.
+func Parse(b []byte) ([]Attr, error) {
+	var attrs []Attr
+	for len(b) >= unix.SizeofNlAttr {
+		l := int(Native.Uint16(b[0:]))
+		if l < unix.SizeofNlAttr || l > len(b) {
+			return nil, fmt.Errorf("netlink attribute of length %d in %d bytes", l, len(b))
+		}
+		attrs = append(attrs, Attr{
+			Type: Native.Uint16(b[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			Data: b[unix.SizeofNlAttr:l],
+		})
+		if Align4(l) >= len(b) {
+			break
+		}
+		b = b[Align4(l):]
+	}
+	return attrs, nil
+}
+
+// Map maps attribute types to their data.
+type Map map[uint16][]byte
+
+// ParseMap decodes the attributes in b into a Map.
+func ParseMap(b []byte) (Map, error) {
+	attrs, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	m := make(Map)
+	for _, a := range attrs {
+		m[a.Type] = a.Data
+	}
+	return m, nil
+}
+
+// U16 returns the value of attribute typ in byte order order, and whether
+// there is one.
+func (m Map) U16(order binary.ByteOrder, typ uint16) (uint16, bool) {
+	b, ok := m[typ]
+	if !ok || len(b) < 2 {
+		return 0, false
+	}
+	return order.Uint16(b), true
+}
+
+// U32 returns the value of attribute typ in byte order order, and whether
+// there is one.
+func (m Map) U32(order binary.ByteOrder, typ uint16) (uint32, bool) {
+	b, ok := m[typ]
+	if !ok || len(b) < 4 {
+		return 0, false
+	}
+	return order.Uint32(b), true
+}
+
+// U64 returns the value of attribute typ in byte order order, and whether
+// there is one.
+func (m Map) U64(order binary.ByteOrder, typ uint16) (uint64, bool) {
+	b, ok := m[typ]
+	if !ok || len(b) < 8 {
+		return 0, false
+	}
+	return order.Uint64(b), true
+}
+
+// String returns the NUL-terminated string in attribute typ.
+func (m Map) String(typ uint16) string {
+	b := m[typ]
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
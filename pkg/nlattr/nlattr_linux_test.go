@@ -0,0 +1,109 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nlattr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAttrs(t *testing.T) {
+	in := []Attr{
+		U8(1, 7),
+		U32(Native, 2, 0xdeadbeef),
+		String(3, "wlan0"),
+		Flag(4),
+		Nested(5, U16(Native, 1, 42), Attr{2, []byte("abc")}),
+		U32(binary.BigEndian, 6, 0x01020304),
+	}
+	b := Encode(in)
+	if len(b)%4 != 0 {
+		t.Errorf("encoded length %d is not aligned", len(b))
+	}
+	m, err := ParseMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(in) {
+		t.Fatalf("ParseMap has %d attributes, want %d", len(m), len(in))
+	}
+	if !bytes.Equal(m[1], []byte{7}) {
+		t.Errorf("u8 = %v", m[1])
+	}
+	if v, ok := m.U32(Native, 2); !ok || v != 0xdeadbeef {
+		t.Errorf("u32 = %#x, %v", v, ok)
+	}
+	if s := m.String(3); s != "wlan0" {
+		t.Errorf("string = %q, want wlan0", s)
+	}
+	if d, ok := m[4]; !ok || len(d) != 0 {
+		t.Errorf("flag = %v, %v", d, ok)
+	}
+	n, err := ParseMap(m[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := n.U16(Native, 1); !ok || v != 42 {
+		t.Errorf("nested u16 = %d, %v", v, ok)
+	}
+	if !bytes.Equal(n[2], []byte("abc")) {
+		t.Errorf("nested data = %q", n[2])
+	}
+	if !bytes.Equal(m[6], []byte{1, 2, 3, 4}) {
+		t.Errorf("big endian u32 = %v", m[6])
+	}
+	if v, ok := m.U32(binary.BigEndian, 6); !ok || v != 0x01020304 {
+		t.Errorf("big endian u32 = %#x, %v", v, ok)
+	}
+	if _, ok := m.U64(binary.BigEndian, 6); ok {
+		t.Errorf("u64 of a u32 attribute is ok, want not")
+	}
+
+	if _, err := Parse([]byte{200, 0, 1, 0}); err == nil {
+		t.Errorf("Parse with a bad length = nil, want error")
+	}
+}
+
+func TestParseMessages(t *testing.T) {
+	msg := func(typ uint16, seq uint32, data []byte) []byte {
+		b := make([]byte, Align4(unix.SizeofNlMsghdr+len(data)))
+		Native.PutUint32(b[0:], uint32(unix.SizeofNlMsghdr+len(data)))
+		Native.PutUint16(b[4:], typ)
+		Native.PutUint16(b[6:], unix.NLM_F_MULTI)
+		Native.PutUint32(b[8:], seq)
+		copy(b[unix.SizeofNlMsghdr:], data)
+		return b
+	}
+	errno := make([]byte, 4)
+	e := -int32(syscall.ENODEV)
+	Native.PutUint32(errno, uint32(e))
+	b := append(msg(30, 1, []byte{1, 2, 3, 4, 5}), msg(unix.NLMSG_ERROR, 2, errno)...)
+	b = append(b, msg(unix.NLMSG_ERROR, 3, make([]byte, 4))...)
+
+	msgs, err := ParseMessages(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if m := msgs[0]; m.Type != 30 || m.Flags != unix.NLM_F_MULTI || m.Seq != 1 || !bytes.Equal(m.Data, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("message = %+v", m)
+	}
+	if err := msgs[1].Err(); err != syscall.ENODEV {
+		t.Errorf("Err() = %v, want %v", err, syscall.ENODEV)
+	}
+	if err := msgs[2].Err(); err != nil {
+		t.Errorf("Err() of an ack = %v, want nil", err)
+	}
+
+	if _, err := ParseMessages(b[:unix.SizeofNlMsghdr]); err == nil {
+		t.Errorf("ParseMessages of a truncated message = nil, want error")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DefaultSpillThreshold is the size up to which a DiskBackedBuffer is kept in
+// memory by default.
+const DefaultSpillThreshold = 64 << 20
+
+var errNegativeOffset = errors.New("negative offset")
+
+// DiskBackedBuffer is an io.WriterAt and io.ReaderAt that holds its contents
+// in memory up to a threshold and in a temporary file beyond that.
+//
+// WriteAt may be called concurrently for ranges that do not overlap.
+type DiskBackedBuffer struct {
+	threshold int64
+
+	mu   sync.RWMutex
+	size int64
+	mem  []byte
+	f    *os.File
+
+	// shared is set when mem or f is used by a snapshot, which must not
+	// change. The next write copies them first.
+	shared bool
+	// retired are files that only snapshots still use.
+	retired []*os.File
+	closed  bool
+}
+
+var (
+	_ io.WriterAt = &DiskBackedBuffer{}
+	_ io.ReaderAt = &DiskBackedBuffer{}
+	_ io.Closer   = &DiskBackedBuffer{}
+)
+
+// NewDiskBackedBuffer returns a DiskBackedBuffer that spills to disk once it
+// is larger than threshold bytes. If threshold is 0 or less,
+// DefaultSpillThreshold is used.
+func NewDiskBackedBuffer(threshold int64) *DiskBackedBuffer {
+	if threshold <= 0 {
+		threshold = DefaultSpillThreshold
+	}
+	return &DiskBackedBuffer{threshold: threshold}
+}
+
+// tempFile returns an already removed temporary file, so that nothing is left
+// behind if we never get to Close.
+func tempFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", "uio-buffer")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// unshare gives b its own copy of the data used by snapshots. b.mu must be
+// held for writing.
+func (b *DiskBackedBuffer) unshare() error {
+	if !b.shared {
+		return nil
+	}
+	if b.f == nil {
+		b.mem = append([]byte(nil), b.mem...)
+		b.shared = false
+		return nil
+	}
+	f, err := tempFile()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(b.f, 0, b.size)); err != nil {
+		f.Close()
+		return err
+	}
+	b.retired = append(b.retired, b.f)
+	b.f = f
+	b.shared = false
+	return nil
+}
+
+// spill moves the contents of b to a file. b.mu must be held for writing.
+func (b *DiskBackedBuffer) spill() error {
+	f, err := tempFile()
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(b.mem[:b.size], 0); err != nil {
+		f.Close()
+		return err
+	}
+	b.f = f
+	b.mem = nil
+	b.shared = false
+	return nil
+}
+
+// prepare makes b ready for a write ending at end. b.mu must be held for
+// writing.
+func (b *DiskBackedBuffer) prepare(end int64) error {
+	if b.closed {
+		return os.ErrClosed
+	}
+	if err := b.unshare(); err != nil {
+		return err
+	}
+	if b.f == nil && end > b.threshold {
+		if err := b.spill(); err != nil {
+			return err
+		}
+	}
+	if b.f == nil && end > int64(len(b.mem)) {
+		if end > int64(cap(b.mem)) {
+			c := 2 * int64(cap(b.mem))
+			if c < end {
+				c = end
+			}
+			if c > b.threshold {
+				c = b.threshold
+			}
+			mem := make([]byte, end, c)
+			copy(mem, b.mem)
+			b.mem = mem
+		} else {
+			b.mem = b.mem[:end]
+		}
+	}
+	if end > b.size {
+		b.size = end
+	}
+	return nil
+}
+
+// ready tells whether a write ending at end can go ahead without changing b.
+// b.mu must be held.
+func (b *DiskBackedBuffer) ready(end int64) bool {
+	return !b.closed && !b.shared && end <= b.size && (b.f != nil || end <= int64(len(b.mem)))
+}
+
+// WriteAt implements io.WriterAt.WriteAt.
+func (b *DiskBackedBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	end := off + int64(len(p))
+
+	for {
+		// Writes within the current size only need the read lock, so
+		// that writes to distinct ranges can go on concurrently.
+		b.mu.RLock()
+		if b.ready(end) {
+			defer b.mu.RUnlock()
+			if b.f != nil {
+				return b.f.WriteAt(p, off)
+			}
+			return copy(b.mem[off:], p), nil
+		}
+		b.mu.RUnlock()
+
+		b.mu.Lock()
+		err := b.prepare(end)
+		b.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readAt reads from data of size bytes held in mem or f.
+func readAt(mem []byte, f *os.File, size int64, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := p
+	if rest := size - off; int64(len(p)) > rest {
+		want = p[:rest]
+	}
+	var n int
+	var err error
+	if f != nil {
+		n, err = f.ReadAt(want, off)
+	} else {
+		n = copy(want, mem[off:])
+	}
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (b *DiskBackedBuffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	return readAt(b.mem, b.f, b.size, p, off)
+}
+
+// Size returns the size of the data, which is the end of the furthest write.
+func (b *DiskBackedBuffer) Size() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.size
+}
+
+// Reader returns an io.ReaderAt of the current contents of b, which later
+// writes to b do not change. It is valid until b is closed.
+//
+// Taking a snapshot is cheap; the next write to b copies the data.
+func (b *DiskBackedBuffer) Reader() io.ReaderAt {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return bytes.NewReader(nil)
+	}
+	b.shared = true
+	s := &snapshot{f: b.f, size: b.size}
+	if b.f == nil {
+		s.mem = b.mem[:b.size:b.size]
+	}
+	return s
+}
+
+// Close releases the memory and temporary files of b and its snapshots.
+func (b *DiskBackedBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.mem = nil
+
+	var err error
+	for _, f := range append(b.retired, b.f) {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	b.f, b.retired = nil, nil
+	return err
+}
+
+type snapshot struct {
+	mem  []byte
+	f    *os.File
+	size int64
+}
+
+func (s *snapshot) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(s.mem, s.f, s.size, p, off)
+}
+
+// Size returns the size of the snapshot.
+func (s *snapshot) Size() int64 {
+	return s.size
+}
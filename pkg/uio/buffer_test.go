@@ -0,0 +1,170 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+func readAll(t *testing.T, r io.ReaderAt, size int64) []byte {
+	t.Helper()
+	b := make([]byte, size)
+	if n, err := r.ReadAt(b, 0); int64(n) != size || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt = %d, %v, want %d", n, err, size)
+	}
+	return b
+}
+
+func TestDiskBackedBuffer(t *testing.T) {
+	for _, threshold := range []int64{4, 8, 1 << 20} {
+		t.Run(fmt.Sprintf("threshold=%d", threshold), func(t *testing.T) {
+			b := NewDiskBackedBuffer(threshold)
+			defer b.Close()
+
+			if _, err := b.WriteAt([]byte("world"), 6); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.WriteAt([]byte("hello"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.Size(); got != 11 {
+				t.Errorf("Size = %d, want 11", got)
+			}
+			if got, want := readAll(t, b, 11), []byte("hello\x00world"); !bytes.Equal(got, want) {
+				t.Errorf("contents = %q, want %q", got, want)
+			}
+			if threshold < 11 && b.f == nil {
+				t.Errorf("buffer of 11 bytes with threshold %d did not spill", threshold)
+			}
+			if threshold >= 11 && b.f != nil {
+				t.Errorf("buffer of 11 bytes with threshold %d spilled", threshold)
+			}
+
+			p := make([]byte, 4)
+			if n, err := b.ReadAt(p, 9); n != 2 || err != io.EOF || string(p[:n]) != "ld" {
+				t.Errorf("ReadAt(9) = %d, %v, %q, want 2, EOF, ld", n, err, p[:n])
+			}
+			if _, err := b.ReadAt(p, 11); err != io.EOF {
+				t.Errorf("ReadAt(11) = %v, want EOF", err)
+			}
+			if _, err := b.ReadAt(p, -1); err == nil {
+				t.Errorf("ReadAt(-1) = nil, want error")
+			}
+			if _, err := b.WriteAt(p, -1); err == nil {
+				t.Errorf("WriteAt(-1) = nil, want error")
+			}
+
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.WriteAt(p, 0); err == nil {
+				t.Errorf("WriteAt after Close = nil, want error")
+			}
+			if _, err := b.ReadAt(p, 0); err == nil {
+				t.Errorf("ReadAt after Close = nil, want error")
+			}
+		})
+	}
+}
+
+func TestDiskBackedBufferSnapshot(t *testing.T) {
+	for _, threshold := range []int64{4, 1 << 20} {
+		t.Run(fmt.Sprintf("threshold=%d", threshold), func(t *testing.T) {
+			b := NewDiskBackedBuffer(threshold)
+			defer b.Close()
+
+			b.WriteAt([]byte("before"), 0)
+			r := b.Reader()
+			b.WriteAt([]byte("AFTER!"), 0)
+			b.WriteAt([]byte(" and more"), 6)
+
+			if got := string(readAll(t, r, 6)); got != "before" {
+				t.Errorf("snapshot = %q, want before", got)
+			}
+			if _, err := r.ReadAt(make([]byte, 1), 6); err != io.EOF {
+				t.Errorf("snapshot ReadAt past its size = %v, want EOF", err)
+			}
+			if got := string(readAll(t, b, b.Size())); got != "AFTER! and more" {
+				t.Errorf("buffer = %q, want %q", got, "AFTER! and more")
+			}
+
+			// A second snapshot sees the new contents.
+			if got := string(readAll(t, b.Reader(), 15)); got != "AFTER! and more" {
+				t.Errorf("second snapshot = %q", got)
+			}
+		})
+	}
+}
+
+func TestDiskBackedBufferConcurrent(t *testing.T) {
+	const (
+		writers = 8
+		chunk   = 4096
+		chunks  = 16
+	)
+	for _, threshold := range []int64{chunk, 1 << 30} {
+		t.Run(fmt.Sprintf("threshold=%d", threshold), func(t *testing.T) {
+			b := NewDiskBackedBuffer(threshold)
+			defer b.Close()
+
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					p := bytes.Repeat([]byte{byte(w + 1)}, chunk)
+					// Interleave the writers' chunks.
+					for c := 0; c < chunks; c++ {
+						off := int64((c*writers + w) * chunk)
+						if _, err := b.WriteAt(p, off); err != nil {
+							t.Error(err)
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			size := int64(writers * chunks * chunk)
+			if b.Size() != size {
+				t.Fatalf("Size = %d, want %d", b.Size(), size)
+			}
+			got := readAll(t, b, size)
+			for i := 0; i < writers*chunks; i++ {
+				want := byte(i%writers + 1)
+				c := got[i*chunk : (i+1)*chunk]
+				if !bytes.Equal(c, bytes.Repeat([]byte{want}, chunk)) {
+					t.Fatalf("chunk %d is not all %d", i, want)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkWriteAt(b *testing.B, threshold int64) {
+	const size = 16 << 20
+	p := make([]byte, 64<<10)
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		buf := NewDiskBackedBuffer(threshold)
+		for off := int64(0); off < size; off += int64(len(p)) {
+			if _, err := buf.WriteAt(p, off); err != nil {
+				b.Fatal(err)
+			}
+		}
+		buf.Close()
+	}
+}
+
+func BenchmarkDiskBackedBufferMemory(b *testing.B) {
+	benchmarkWriteAt(b, DefaultSpillThreshold)
+}
+
+func BenchmarkDiskBackedBufferSpill(b *testing.B) {
+	benchmarkWriteAt(b, 1<<20)
+}
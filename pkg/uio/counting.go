@@ -0,0 +1,34 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CountingReaderAt is an io.ReaderAt that counts the bytes read from R, such
+// as how much of a kernel was fetched over the network, which may not be its
+// size.
+//
+// BytesRead is updated atomically and may be read with atomic.LoadInt64
+// while ReadAt is being called.
+type CountingReaderAt struct {
+	R         io.ReaderAt
+	BytesRead int64
+}
+
+// NewCountingReaderAt returns a CountingReaderAt of r.
+func NewCountingReaderAt(r io.ReaderAt) *CountingReaderAt {
+	return &CountingReaderAt{R: r}
+}
+
+// ReadAt implements io.ReaderAt. It counts the bytes returned, which are
+// fewer than len(p) on a short read.
+func (c *CountingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.R.ReadAt(p, off)
+	atomic.AddInt64(&c.BytesRead, int64(n))
+	return n, err
+}
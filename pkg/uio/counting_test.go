@@ -0,0 +1,69 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountingReaderAt(t *testing.T) {
+	c := NewCountingReaderAt(strings.NewReader("u-root kernel"))
+	p := make([]byte, 6)
+	if n, err := c.ReadAt(p, 0); n != 6 || err != nil {
+		t.Fatalf("ReadAt() = %d, %v, want 6, nil", n, err)
+	}
+	// A short read counts what it returned.
+	if n, err := c.ReadAt(p, 10); n != 3 || err != io.EOF {
+		t.Fatalf("ReadAt() = %d, %v, want 3, EOF", n, err)
+	}
+	if _, err := c.ReadAt(p, 100); err != io.EOF {
+		t.Fatalf("ReadAt() past the end = %v, want EOF", err)
+	}
+	if c.BytesRead != 9 {
+		t.Errorf("BytesRead = %d, want 9", c.BytesRead)
+	}
+
+	// Reading it all counts it, however it is read.
+	c = NewCountingReaderAt(strings.NewReader("u-root kernel"))
+	if b, err := ReadAll(c); err != nil || string(b) != "u-root kernel" {
+		t.Fatalf("ReadAll() = %q, %v", b, err)
+	}
+	if c.BytesRead != 13 {
+		t.Errorf("BytesRead after ReadAll() = %d, want 13", c.BytesRead)
+	}
+}
+
+func TestCountingReaderAtConcurrent(t *testing.T) {
+	const (
+		readers = 8
+		reads   = 1000
+		size    = 7
+	)
+	c := NewCountingReaderAt(strings.NewReader(strings.Repeat("x", 100)))
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := make([]byte, size)
+			for j := 0; j < reads; j++ {
+				if _, err := c.ReadAt(p, int64(i)); err != nil {
+					t.Errorf("ReadAt() = %v", err)
+					return
+				}
+				// BytesRead can be read while ReadAt is called.
+				atomic.LoadInt64(&c.BytesRead)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if want := int64(readers * reads * size); c.BytesRead != want {
+		t.Errorf("BytesRead = %d, want %d", c.BytesRead, want)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows,!plan9
+
+package uio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+var errMmapClosed = errors.New("read of unmapped file")
+
+// mmapReaderAt is an io.ReaderAt of a read-only memory mapping of a file.
+type mmapReaderAt struct {
+	data []byte
+	// mapped is whether data is mapped, and must be unmapped by Close;
+	// empty files are not.
+	mapped bool
+}
+
+// MemoryMapFile maps all of f into memory read-only and returns an
+// io.ReaderAt of the mapping, whose ReadAt copies from memory without
+// making a syscall. This is quicker than reading a large file, like a
+// kernel, in many small reads of f.
+//
+// The file must not be truncated while it is mapped. Close unmaps it; f
+// may be closed at any time.
+func MemoryMapFile(f *os.File) (ReadAtCloser, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return &mmapReaderAt{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%s is too large to map: %d bytes", f.Name(), size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+	}
+	return &mmapReaderAt{data: data, mapped: true}, nil
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (m *mmapReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if m.data == nil && m.mapped {
+		return 0, errMmapClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close implements io.Closer.Close by unmapping the file.
+func (m *mmapReaderAt) Close() error {
+	if !m.mapped || m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows,!plan9
+
+package uio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// randomFile returns a file of size random bytes, and its content.
+func randomFile(t testing.TB, size int) (*os.File, []byte) {
+	f, err := ioutil.TempFile("", "uio-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f, data
+}
+
+func TestMemoryMapFile(t *testing.T) {
+	f, data := randomFile(t, 10000)
+	defer f.Close()
+	m, err := MemoryMapFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.NewReader(data)
+	for _, tt := range []struct {
+		size int
+		off  int64
+	}{
+		{100, 0},
+		{100, 5000},
+		{100, 9950},
+		{100, 10000},
+		{100, 20000},
+		{0, 10000},
+		{10000, 0},
+	} {
+		b, wb := make([]byte, tt.size), make([]byte, tt.size)
+		n, err := m.ReadAt(b, tt.off)
+		wn, werr := want.ReadAt(wb, tt.off)
+		if n != wn || err != werr || !bytes.Equal(b[:n], wb[:wn]) {
+			t.Errorf("ReadAt(%d bytes, %d) = %d, %v, want %d, %v", tt.size, tt.off, n, err, wn, werr)
+		}
+	}
+	if _, err := m.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Errorf("ReadAt(-1) = nil, want error")
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Errorf("ReadAt() after Close() = nil, want error")
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close() = %v, want nil", err)
+	}
+}
+
+func TestMemoryMapEmptyFile(t *testing.T) {
+	f, _ := randomFile(t, 0)
+	defer f.Close()
+	m, err := MemoryMapFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if n, err := m.ReadAt(make([]byte, 1), 0); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt() of empty file = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func benchmarkReadAt(b *testing.B, r io.ReaderAt) {
+	buf := make([]byte, 4096)
+	b.SetBytes(1000 * int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		for j := int64(0); j < 1000; j++ {
+			if _, err := r.ReadAt(buf, j*int64(len(buf))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// The benchmarks make 1000 4 KiB reads in order of a 50 MiB file.
+func BenchmarkFileReadAt(b *testing.B) {
+	f, _ := randomFile(b, 50<<20)
+	defer f.Close()
+	b.ResetTimer()
+	benchmarkReadAt(b, f)
+}
+
+func BenchmarkMemoryMapReadAt(b *testing.B) {
+	f, _ := randomFile(b, 50<<20)
+	defer f.Close()
+	m, err := MemoryMapFile(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+	b.ResetTimer()
+	benchmarkReadAt(b, m)
+}
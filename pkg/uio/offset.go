@@ -0,0 +1,37 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"io"
+)
+
+// offsetWriter writes to consecutive offsets of a WriterAt.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+// WriterAtToWriter returns a Writer that writes to w sequentially, starting
+// at startOffset.
+func WriterAtToWriter(w io.WriterAt, startOffset int64) io.Writer {
+	return &offsetWriter{w: w, off: startOffset}
+}
+
+// Write implements io.Writer.
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// ReaderAtToReader returns a Reader that reads at most limit bytes from r
+// sequentially, starting at startOffset.
+func ReaderAtToReader(r io.ReaderAt, startOffset, limit int64) io.Reader {
+	return io.NewSectionReader(r, startOffset, limit)
+}
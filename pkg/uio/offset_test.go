@@ -0,0 +1,77 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// bufferAt is a WriterAt growing as needed.
+type bufferAt []byte
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(*b) {
+		*b = append(*b, make([]byte, end-len(*b))...)
+	}
+	return copy((*b)[off:], p), nil
+}
+
+// shortWriterAt writes at most one byte at a time.
+type shortWriterAt struct {
+	bufferAt
+}
+
+func (s *shortWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return s.bufferAt.WriteAt(p[:1], off)
+}
+
+func TestWriterAtToWriter(t *testing.T) {
+	b := bufferAt("0123456789")
+	w := WriterAtToWriter(&b, 2)
+	for _, s := range []string{"ab", "", "cde", "fghij"} {
+		if n, err := io.WriteString(w, s); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v, want %d, nil", s, n, err, len(s))
+		}
+	}
+	if want := "01abcdefghij"; string(b) != want {
+		t.Errorf("buffer = %q, want %q", b, want)
+	}
+
+	sw := &shortWriterAt{bufferAt("xyz")}
+	w = WriterAtToWriter(sw, 1)
+	if n, err := io.WriteString(w, "ab"); n != 1 || err != io.ErrShortWrite {
+		t.Errorf("Write() = %d, %v, want 1, %v", n, err, io.ErrShortWrite)
+	}
+	// The failed write still advances by what was written.
+	io.WriteString(w, "c")
+	if want := "xac"; string(sw.bufferAt) != want {
+		t.Errorf("buffer = %q, want %q", sw.bufferAt, want)
+	}
+}
+
+func TestReaderAtToReader(t *testing.T) {
+	r := strings.NewReader("0123456789")
+	for _, tt := range []struct {
+		off, limit int64
+		want       string
+	}{
+		{0, 10, "0123456789"},
+		{3, 4, "3456"},
+		{8, 10, "89"},
+		{10, 5, ""},
+		{2, 0, ""},
+	} {
+		b, err := ioutil.ReadAll(ReaderAtToReader(r, tt.off, tt.limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("ReaderAtToReader(%d, %d) read %q, want %q", tt.off, tt.limit, b, tt.want)
+		}
+	}
+}
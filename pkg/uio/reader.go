@@ -8,12 +8,17 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"os"
 )
 
 type inMemReaderAt interface {
 	Bytes() []byte
 }
 
+type sizedReaderAt interface {
+	Size() int64
+}
+
 // ReadAll reads everything that r contains.
 //
 // Callers *must* not modify bytes in the returned byte slice.
@@ -27,6 +32,23 @@ func ReadAll(r io.ReaderAt) ([]byte, error) {
 	return ioutil.ReadAll(Reader(r))
 }
 
+// Size returns the size of r. It avoids reading r if it knows its size, as
+// in-memory readers, io.SectionReader and regular files do, and otherwise
+// reads r to its end without keeping the data.
+func Size(r io.ReaderAt) (int64, error) {
+	switch s := r.(type) {
+	case inMemReaderAt:
+		return int64(len(s.Bytes())), nil
+	case sizedReaderAt:
+		return s.Size(), nil
+	case *os.File:
+		if fi, err := s.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), nil
+		}
+	}
+	return io.Copy(ioutil.Discard, Reader(r))
+}
+
 // Reader generates a Reader from a ReaderAt.
 func Reader(r io.ReaderAt) io.Reader {
 	return io.NewSectionReader(r, 0, math.MaxInt64)
@@ -0,0 +1,66 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readCounter counts the bytes read from r.
+type readCounter struct {
+	r io.ReaderAt
+	n int
+}
+
+func (c *readCounter) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += n
+	return n, err
+}
+
+func TestSize(t *testing.T) {
+	const data = "u-root initramfs"
+	f, err := ioutil.TempFile("", "size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewDiskBackedBuffer(0)
+	defer b.Close()
+	if _, err := b.WriteAt([]byte(data), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		r    io.ReaderAt
+	}{
+		{"bytes", bytes.NewReader([]byte(data))},
+		{"strings", strings.NewReader(data)},
+		{"section", io.NewSectionReader(strings.NewReader(data+"more"), 0, int64(len(data)))},
+		{"file", f},
+		{"snapshot", b.Reader()},
+	} {
+		if n, err := Size(tt.r); err != nil || n != int64(len(data)) {
+			t.Errorf("Size() of %s = %d, %v, want %d", tt.name, n, err, len(data))
+		}
+	}
+
+	// Other readers are read to the end.
+	c := &readCounter{r: strings.NewReader(data)}
+	if n, err := Size(c); err != nil || n != int64(len(data)) || c.n != len(data) {
+		t.Errorf("Size() of a plain io.ReaderAt = %d, %v after reading %d bytes, want %d", n, err, c.n, len(data))
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import "io"
+
+type retryingReaderAt struct {
+	r          io.ReaderAt
+	maxRetries int
+}
+
+// RetryingReaderAt returns an io.ReaderAt that reads from r until it fills
+// p, for sources such as network-backed ones that return fewer bytes than
+// asked for without an error, against the io.ReaderAt contract.
+//
+// Each ReadAt reads the rest of p after a short read, up to maxRetries
+// times, and returns io.ErrUnexpectedEOF if p is still not full. Errors of
+// r, io.EOF included, are returned as they are with what has been read. A
+// negative maxRetries is taken as 0.
+func RetryingReaderAt(r io.ReaderAt, maxRetries int) io.ReaderAt {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	return &retryingReaderAt{r: r, maxRetries: maxRetries}
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *retryingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for retries := 0; ; retries++ {
+		m, err := r.r.ReadAt(p[n:], off+int64(n))
+		n += m
+		if err != nil || n == len(p) {
+			return n, err
+		}
+		if retries >= r.maxRetries {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+}
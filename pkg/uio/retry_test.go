@@ -0,0 +1,71 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uio
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// shortReaderAt returns at most max bytes and no error from each of its
+// first short reads.
+type shortReaderAt struct {
+	r     io.ReaderAt
+	short int
+	max   int
+	calls int
+}
+
+func (s *shortReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.calls++
+	if s.calls <= s.short && len(p) > s.max {
+		return s.r.ReadAt(p[:s.max], off)
+	}
+	return s.r.ReadAt(p, off)
+}
+
+func TestRetryingReaderAt(t *testing.T) {
+	const data = "u-root kernel"
+	for _, tt := range []struct {
+		name       string
+		short, max int
+		maxRetries int
+		off        int64
+		size       int
+		want       string
+		wantErr    error
+		wantCalls  int
+	}{
+		{name: "full read", maxRetries: 3, size: 6, want: "u-root", wantCalls: 1},
+		{name: "retried", short: 2, max: 2, maxRetries: 3, size: 6, want: "u-root", wantCalls: 3},
+		{name: "retried at offset", short: 3, max: 1, maxRetries: 3, off: 7, size: 6, want: "kernel", wantCalls: 4},
+		{name: "nothing read", short: 2, max: 0, maxRetries: 2, size: 6, want: "u-root", wantCalls: 3},
+		{name: "retries exhausted", short: 5, max: 1, maxRetries: 2, size: 6, want: "u-r", wantErr: io.ErrUnexpectedEOF, wantCalls: 3},
+		{name: "no retries", short: 1, max: 4, size: 6, want: "u-ro", wantErr: io.ErrUnexpectedEOF, wantCalls: 1},
+		{name: "negative retries", short: 1, max: 4, maxRetries: -1, size: 6, want: "u-ro", wantErr: io.ErrUnexpectedEOF, wantCalls: 1},
+		{name: "no progress", short: 100, max: 0, maxRetries: 2, size: 6, want: "", wantErr: io.ErrUnexpectedEOF, wantCalls: 3},
+		{name: "no progress with negative retries", short: 100, max: 0, maxRetries: -1, size: 6, want: "", wantErr: io.ErrUnexpectedEOF, wantCalls: 1},
+		{name: "end", short: 1, max: 2, maxRetries: 3, off: 9, size: 6, want: "rnel", wantErr: io.EOF, wantCalls: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &shortReaderAt{r: strings.NewReader(data), short: tt.short, max: tt.max}
+			p := make([]byte, tt.size)
+			n, err := RetryingReaderAt(s, tt.maxRetries).ReadAt(p, tt.off)
+			if got := string(p[:n]); got != tt.want || err != tt.wantErr {
+				t.Errorf("ReadAt() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if s.calls != tt.wantCalls {
+				t.Errorf("ReadAt() called the source %d times, want %d", s.calls, tt.wantCalls)
+			}
+		})
+	}
+
+	// Reading it all through uio.Reader gets everything.
+	s := &shortReaderAt{r: strings.NewReader(data), short: 100, max: 3}
+	if b, err := ReadAll(RetryingReaderAt(s, 10)); err != nil || string(b) != data {
+		t.Errorf("ReadAll() = %q, %v, want %q", b, err, data)
+	}
+}
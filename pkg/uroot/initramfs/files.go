@@ -25,6 +25,11 @@ type Files struct {
 	// cpio.Record. If or when there is another archival mode, we can add a
 	// similar uroot.Record type.
 	Records map[string]cpio.Record
+
+	// XAttrs makes WriteTo carry the extended attributes of host files.
+	// It is off by default: hosts with SELinux label every file, and the
+	// kernel unpacks the records carrying the labels as junk files.
+	XAttrs bool
 }
 
 // NewFiles returns a new archive files map.
@@ -179,7 +184,7 @@ func (af *Files) WriteTo(w Writer) error {
 			}
 		}
 		if src, ok := af.Files[path]; ok {
-			if err := writeFile(w, src, path); err != nil {
+			if err := writeFile(w, src, path, af.XAttrs); err != nil {
 				return err
 			}
 		}
@@ -191,8 +196,13 @@ func (af *Files) WriteTo(w Writer) error {
 // archive `w` at path `dest`.
 //
 // If `src` is a directory, its children will be added to the archive as well.
-func writeFile(w Writer, src, dest string) error {
-	record, err := cpio.GetRecord(src)
+// Its extended attributes are added if `xattrs` is set.
+func writeFile(w Writer, src, dest string, xattrs bool) error {
+	getRecord := cpio.GetRecord
+	if xattrs {
+		getRecord = cpio.GetRecordWithXAttrs
+	}
+	record, err := getRecord(src)
 	if err != nil {
 		return err
 	}
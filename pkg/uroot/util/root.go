@@ -12,11 +12,14 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/u-root/u-root/pkg/cmdline"
+	mnt "github.com/u-root/u-root/pkg/mount"
 	"golang.org/x/sys/unix"
 )
 
@@ -102,16 +105,131 @@ func (d Dev) String() string {
 	return fmt.Sprintf("dev %q (mode %#o; magic %d)", d.Name, d.Mode, d.Dev)
 }
 
+// DevTmpfs mounts devtmpfs on Target or, if the kernel was built without
+// CONFIG_DEVTMPFS, creates the StaticDevs in it.
+type DevTmpfs struct {
+	Target string
+}
+
+func (d DevTmpfs) Create() error {
+	if mounted, err := isMounted(d.Target); err != nil || mounted {
+		return err
+	}
+	err := mount("devtmpfs", d.Target, "devtmpfs", 0, "")
+	if err == nil {
+		return nil
+	}
+	log.Printf("Mounting devtmpfs on %q failed, creating static devices: %v", d.Target, err)
+	return CreateStaticDevs(d.Target)
+}
+
+func (d DevTmpfs) String() string {
+	return fmt.Sprintf("devtmpfs %q", d.Target)
+}
+
+// StaticDevs are the device nodes, relative to /dev, created when there is no
+// devtmpfs.
+var StaticDevs = []Dev{
+	{Name: "mem", Mode: syscall.S_IFCHR | 0640, Dev: mkdev(1, 1)},
+	{Name: "null", Mode: syscall.S_IFCHR | 0666, Dev: mkdev(1, 3)},
+	{Name: "port", Mode: syscall.S_IFCHR | 0640, Dev: mkdev(1, 4)},
+	{Name: "zero", Mode: syscall.S_IFCHR | 0666, Dev: mkdev(1, 5)},
+	{Name: "random", Mode: syscall.S_IFCHR | 0666, Dev: mkdev(1, 8)},
+	{Name: "urandom", Mode: syscall.S_IFCHR | 0666, Dev: mkdev(1, 9)},
+	{Name: "kmsg", Mode: syscall.S_IFCHR | 0644, Dev: mkdev(1, 11)},
+	{Name: "ttyS0", Mode: syscall.S_IFCHR | 0660, Dev: mkdev(4, 64)},
+	{Name: "tty", Mode: syscall.S_IFCHR | 0666, Dev: mkdev(5, 0)},
+	{Name: "console", Mode: syscall.S_IFCHR | 0600, Dev: mkdev(5, 1)},
+	{Name: "loop0", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 0)},
+	{Name: "loop1", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 1)},
+	{Name: "loop2", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 2)},
+	{Name: "loop3", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 3)},
+	{Name: "loop4", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 4)},
+	{Name: "loop5", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 5)},
+	{Name: "loop6", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 6)},
+	{Name: "loop7", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(7, 7)},
+	{Name: "sda", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(8, 0)},
+	{Name: "sda1", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(8, 1)},
+	{Name: "sda2", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(8, 2)},
+	{Name: "sda3", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(8, 3)},
+	{Name: "sda4", Mode: syscall.S_IFBLK | 0660, Dev: mkdev(8, 4)},
+}
+
+func mkdev(major, minor uint32) int {
+	return int(unix.Mkdev(major, minor))
+}
+
+// CreateStaticDevs creates the StaticDevs in dir. It tries them all, and
+// returns the first error.
+func CreateStaticDevs(dir string) error {
+	var firstErr error
+	for _, d := range StaticDevs {
+		d.Name = filepath.Join(dir, d.Name)
+		if err := d.Create(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("creating %s: %v", d, err)
+		}
+	}
+	return firstErr
+}
+
 type Mount struct {
 	Source string
 	Target string
 	FSType string
 	Flags  uintptr
 	Opts   string
+	// IfSupported skips the mount if the kernel does not list FSType
+	// in /proc/filesystems.
+	IfSupported bool
 }
 
+// Create mounts m, unless something is already mounted at its target.
 func (m Mount) Create() error {
-	return syscall.Mount(m.Source, m.Target, m.FSType, m.Flags, m.Opts)
+	if mounted, err := isMounted(m.Target); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+	if m.IfSupported {
+		if ok, err := isSupported(m.FSType); err != nil || !ok {
+			return err
+		}
+	}
+	return mount(m.Source, m.Target, m.FSType, m.Flags, m.Opts)
+}
+
+// isMounted returns whether target is in /proc/mounts. Before /proc is
+// mounted, nothing is.
+func isMounted(target string) (bool, error) {
+	b, err := ioutil.ReadFile(mountsFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) > 1 && mnt.UnescapeMountInfo(f[1]) == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isSupported returns whether /proc/filesystems lists fsType.
+func isSupported(fsType string) (bool, error) {
+	b, err := ioutil.ReadFile(filesystemsFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		// Lines are "nodev<TAB>sysfs" or "<TAB>ext4".
+		if f := strings.Fields(l); len(f) > 0 && f[len(f)-1] == fsType {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (m Mount) String() string {
@@ -119,6 +237,17 @@ func (m Mount) String() string {
 }
 
 var (
+	// mount is syscall.Mount. Tests replace it.
+	mount = syscall.Mount
+	// mountsFile lists what is mounted where.
+	mountsFile = "/proc/mounts"
+	// filesystemsFile lists the file systems the kernel supports.
+	filesystemsFile = "/proc/filesystems"
+
+	// noExec are the mount flags of file systems that only the kernel
+	// should fill.
+	noExec uintptr = syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV
+
 	namespace = []Creator{
 		Dir{Name: "/buildbin", Mode: 0777},
 		Dir{Name: "/ubin", Mode: 0777},
@@ -133,18 +262,20 @@ var (
 		Dir{Name: "/etc", Mode: 0777},
 
 		Dir{Name: "/proc", Mode: 0555},
-		Mount{Source: "proc", Target: "/proc", FSType: "proc"},
+		Mount{Source: "proc", Target: "/proc", FSType: "proc", Flags: noExec},
 		Mount{Source: "tmpfs", Target: "/tmp", FSType: "tmpfs"},
+		Dir{Name: "/run", Mode: 0755},
+		Mount{Source: "tmpfs", Target: "/run", FSType: "tmpfs", Opts: "mode=0755,size=10%"},
 
 		Dir{Name: "/dev", Mode: 0777},
 		Dev{Name: "/dev/tty", Mode: syscall.S_IFCHR | 0666, Dev: 0x0500},
 		Dev{Name: "/dev/urandom", Mode: syscall.S_IFCHR | 0444, Dev: 0x0109},
 		Dev{Name: "/dev/port", Mode: syscall.S_IFCHR | 0640, Dev: 0x0104},
 
-		// Kernel must be compiled with CONFIG_DEVTMPFS.
-		// Note that things kind of work even if this mount fails.
+		// Without CONFIG_DEVTMPFS, this creates the most commonly
+		// used devices instead.
 		// TODO: move the Dir commands above below this line?
-		Mount{Source: "devtmpfs", Target: "/dev", FSType: "devtmpfs"},
+		DevTmpfs{Target: "/dev"},
 
 		Dir{Name: "/dev/pts", Mode: 0777},
 		Mount{Source: "devpts", Target: "/dev/pts", FSType: "devpts", Opts: "newinstance,ptmxmode=666,gid=5,mode=620"},
@@ -156,7 +287,8 @@ var (
 		Mount{Source: "tmpfs", Target: "/dev/shm", FSType: "tmpfs"},
 
 		Dir{Name: "/sys", Mode: 0555},
-		Mount{Source: "sysfs", Target: "/sys", FSType: "sysfs"},
+		Mount{Source: "sysfs", Target: "/sys", FSType: "sysfs", Flags: noExec},
+		Mount{Source: "securityfs", Target: "/sys/kernel/security", FSType: "securityfs", IfSupported: true},
 	}
 	cgroupsnamespace = []Creator{
 		Mount{Source: "cgroup", Target: "/sys/fs/cgroup", FSType: "tmpfs"},
@@ -199,11 +331,15 @@ func GoBin() string {
 	return fmt.Sprintf("/go/bin/%s_%s:/go/bin:/go/pkg/tool/%s_%s", runtime.GOOS, runtime.GOARCH, runtime.GOOS, runtime.GOARCH)
 }
 
-func create(namespace []Creator) {
+func create(namespace []Creator, o *rootfsOpts) {
 	// Clear umask bits so that we get stuff like ptmx right.
 	m := unix.Umask(0)
 	defer unix.Umask(m)
 	for _, c := range namespace {
+		if o.skipped(c) {
+			log.Printf("Skipped %v", c)
+			continue
+		}
 		if err := c.Create(); err != nil {
 			log.Printf("Error creating %s: %v", c, err)
 		} else {
@@ -212,13 +348,45 @@ func create(namespace []Creator) {
 	}
 }
 
+// RootfsOption changes what Rootfs creates.
+type RootfsOption func(*rootfsOpts)
+
+type rootfsOpts struct {
+	skip []string
+}
+
+// SkipMount makes Rootfs mount nothing at or below target, such as /proc.
+func SkipMount(target string) RootfsOption {
+	return func(o *rootfsOpts) {
+		o.skip = append(o.skip, target)
+	}
+}
+
+// skipped returns whether c mounts something the options skip.
+func (o *rootfsOpts) skipped(c Creator) bool {
+	m, ok := c.(Mount)
+	if !ok {
+		return false
+	}
+	for _, s := range o.skip {
+		if m.Target == s || strings.HasPrefix(m.Target, s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // build the root file system.
-func Rootfs() {
+func Rootfs(opts ...RootfsOption) {
+	o := &rootfsOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	Env["PATH"] = fmt.Sprintf("%v:%v:%v:%v", GoBin(), PATHHEAD, PATHMID, PATHTAIL)
 	for k, v := range Env {
 		os.Setenv(k, v)
 	}
-	create(namespace)
+	create(namespace, o)
 
 	// systemd gets upset when it discovers something has already setup cgroups
 	// We have to do this after the base namespace is created, so we have /proc
@@ -226,7 +394,7 @@ func Rootfs() {
 	systemd, present := initFlags["systemd"]
 	systemdEnabled, boolErr := strconv.ParseBool(systemd)
 	if !present || boolErr != nil || systemdEnabled == false {
-		create(cgroupsnamespace)
+		create(cgroupsnamespace, o)
 	}
 
 }
@@ -0,0 +1,210 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeProc makes mountsFile and filesystemsFile have the given contents, and
+// mount record its arguments in mounts, until the returned function is
+// called.
+func fakeProc(t *testing.T, procMounts, filesystems string, mounts *[]string) func() {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldMounts, oldFilesystems, oldMount := mountsFile, filesystemsFile, mount
+	mountsFile, filesystemsFile = filepath.Join(dir, "mounts"), filepath.Join(dir, "filesystems")
+	for f, c := range map[string]string{mountsFile: procMounts, filesystemsFile: filesystems} {
+		if err := ioutil.WriteFile(f, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mount = func(source, target, fstype string, flags uintptr, data string) error {
+		*mounts = append(*mounts, fmt.Sprintf("%s %s %s %#x %s", source, target, fstype, flags, data))
+		return nil
+	}
+	return func() {
+		mountsFile, filesystemsFile, mount = oldMounts, oldFilesystems, oldMount
+		os.RemoveAll(dir)
+	}
+}
+
+const testFilesystems = "nodev\tsysfs\nnodev\tproc\nnodev\ttmpfs\n\text4\n"
+
+func TestMount(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mounts string
+		fs     string
+		m      Mount
+		want   []string
+	}{
+		{
+			name: "not mounted",
+			m:    Mount{Source: "proc", Target: "/proc", FSType: "proc", Flags: 0xe},
+			want: []string{"proc /proc proc 0xe "},
+		},
+		{
+			name:   "mounted",
+			mounts: "rootfs / rootfs rw 0 0\nproc /proc proc rw,nosuid,nodev,noexec 0 0\n",
+			m:      Mount{Source: "proc", Target: "/proc", FSType: "proc"},
+		},
+		{
+			name:   "escaped",
+			mounts: "tmpfs /my\\040run tmpfs rw 0 0\n",
+			m:      Mount{Source: "tmpfs", Target: "/my run", FSType: "tmpfs"},
+		},
+		{
+			name: "supported",
+			fs:   testFilesystems + "nodev\tsecurityfs\n",
+			m:    Mount{Source: "securityfs", Target: "/sys/kernel/security", FSType: "securityfs", IfSupported: true},
+			want: []string{"securityfs /sys/kernel/security securityfs 0x0 "},
+		},
+		{
+			name: "not supported",
+			fs:   testFilesystems,
+			m:    Mount{Source: "securityfs", Target: "/sys/kernel/security", FSType: "securityfs", IfSupported: true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			defer fakeProc(t, tt.mounts, tt.fs, &got)()
+			if err := tt.m.Create(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Create() mounted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaceMounts(t *testing.T) {
+	want := map[string]Mount{
+		"/proc":                {Source: "proc", Target: "/proc", FSType: "proc", Flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV},
+		"/sys":                 {Source: "sysfs", Target: "/sys", FSType: "sysfs", Flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV},
+		"/run":                 {Source: "tmpfs", Target: "/run", FSType: "tmpfs", Opts: "mode=0755,size=10%"},
+		"/sys/kernel/security": {Source: "securityfs", Target: "/sys/kernel/security", FSType: "securityfs", IfSupported: true},
+	}
+	for _, c := range namespace {
+		if m, ok := c.(Mount); ok && want[m.Target] != (Mount{}) {
+			if m != want[m.Target] {
+				t.Errorf("namespace has %v, want %v", m, want[m.Target])
+			}
+			delete(want, m.Target)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("namespace does not mount %v", want)
+	}
+}
+
+func TestSkipMount(t *testing.T) {
+	var got []string
+	defer fakeProc(t, "", testFilesystems+"nodev\tsecurityfs\n", &got)()
+	ns := []Creator{
+		Mount{Source: "proc", Target: "/proc", FSType: "proc"},
+		Mount{Source: "tmpfs", Target: "/run", FSType: "tmpfs"},
+		Mount{Source: "sysfs", Target: "/sys", FSType: "sysfs"},
+		Mount{Source: "securityfs", Target: "/sys/kernel/security", FSType: "securityfs", IfSupported: true},
+		Mount{Source: "tmpfs", Target: "/system", FSType: "tmpfs"},
+	}
+	o := &rootfsOpts{}
+	SkipMount("/sys")(o)
+	SkipMount("/run")(o)
+	create(ns, o)
+	want := []string{"proc /proc proc 0x0 ", "tmpfs /system tmpfs 0x0 "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("create() mounted %q, want %q", got, want)
+	}
+}
+
+func TestDevTmpfs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating device nodes requires root")
+	}
+	var mounts []string
+	defer fakeProc(t, "", testFilesystems, &mounts)()
+
+	for _, tt := range []struct {
+		name     string
+		mountErr error
+		static   bool
+	}{
+		{name: "devtmpfs", static: false},
+		{name: "no devtmpfs", mountErr: errors.New("no such device"), static: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var mounted string
+			mount = func(source, target, fstype string, flags uintptr, data string) error {
+				mounted = fstype + " " + target
+				return tt.mountErr
+			}
+			if err := (DevTmpfs{Target: dir}).Create(); err != nil {
+				t.Fatal(err)
+			}
+			if mounted != "devtmpfs "+dir {
+				t.Errorf("mounted %q, want devtmpfs on %s", mounted, dir)
+			}
+
+			fis, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.static {
+				if len(fis) != 0 {
+					t.Errorf("created %d files on top of devtmpfs, want none", len(fis))
+				}
+				return
+			}
+			if len(fis) != len(StaticDevs) {
+				t.Errorf("created %d files, want %d", len(fis), len(StaticDevs))
+			}
+			for _, want := range []struct {
+				name         string
+				typ          uint32
+				major, minor uint32
+			}{
+				{"null", syscall.S_IFCHR, 1, 3},
+				{"console", syscall.S_IFCHR, 5, 1},
+				{"ttyS0", syscall.S_IFCHR, 4, 64},
+				{"kmsg", syscall.S_IFCHR, 1, 11},
+				{"sda", syscall.S_IFBLK, 8, 0},
+				{"sda4", syscall.S_IFBLK, 8, 4},
+				{"loop7", syscall.S_IFBLK, 7, 7},
+			} {
+				fi, err := os.Lstat(filepath.Join(dir, want.name))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				st := fi.Sys().(*syscall.Stat_t)
+				major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+				if st.Mode&syscall.S_IFMT != want.typ || major != want.major || minor != want.minor {
+					t.Errorf("%s is type %#o %d:%d, want type %#o %d:%d", want.name, st.Mode&syscall.S_IFMT, major, minor, want.typ, want.major, want.minor)
+				}
+			}
+		})
+	}
+}
@@ -44,6 +44,7 @@ var (
 		"core": {
 			"github.com/u-root/u-root/cmds/ansi",
 			"github.com/u-root/u-root/cmds/boot",
+			"github.com/u-root/u-root/cmds/bridge",
 			"github.com/u-root/u-root/cmds/cat",
 			"github.com/u-root/u-root/cmds/cbmem",
 			"github.com/u-root/u-root/cmds/chmod",
@@ -77,8 +78,10 @@ var (
 			"github.com/u-root/u-root/cmds/installcommand",
 			"github.com/u-root/u-root/cmds/io",
 			"github.com/u-root/u-root/cmds/ip",
+			"github.com/u-root/u-root/cmds/iwconfig",
 			"github.com/u-root/u-root/cmds/kexec",
 			"github.com/u-root/u-root/cmds/kill",
+			"github.com/u-root/u-root/cmds/ldd",
 			"github.com/u-root/u-root/cmds/lddfiles",
 			"github.com/u-root/u-root/cmds/ln",
 			"github.com/u-root/u-root/cmds/losetup",
@@ -92,6 +95,8 @@ var (
 			"github.com/u-root/u-root/cmds/msr",
 			"github.com/u-root/u-root/cmds/mv",
 			"github.com/u-root/u-root/cmds/netcat",
+			"github.com/u-root/u-root/cmds/nft",
+			"github.com/u-root/u-root/cmds/nsenter",
 			"github.com/u-root/u-root/cmds/ntpdate",
 			"github.com/u-root/u-root/cmds/pci",
 			"github.com/u-root/u-root/cmds/ping",
@@ -111,6 +116,8 @@ var (
 			"github.com/u-root/u-root/cmds/switch_root",
 			"github.com/u-root/u-root/cmds/sync",
 			"github.com/u-root/u-root/cmds/tail",
+			"github.com/u-root/u-root/cmds/tc",
+			"github.com/u-root/u-root/cmds/tcpdump",
 			"github.com/u-root/u-root/cmds/tee",
 			"github.com/u-root/u-root/cmds/true",
 			"github.com/u-root/u-root/cmds/truncate",
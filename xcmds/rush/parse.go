@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
@@ -35,6 +36,9 @@ type Command struct {
 	files map[int]io.Closer
 	link  string
 	bg    bool
+	// sub is set on the commands of a process substitution, which
+	// run alongside the command using them.
+	sub bool
 
 	// These are set up by the shell as it evaluates the Commands
 	// provided by the parser.
@@ -42,6 +46,9 @@ type Command struct {
 	// of argv in their builtins. We do that for them.
 	cmd  string
 	argv []string
+	// subs are the process substitutions in argv, passed to
+	// the command as fds 3 and up.
+	subs []*procSub
 }
 
 var (
@@ -86,9 +93,18 @@ func tok(b *bufio.Reader) (string, string) {
 	switch c {
 	case 0:
 		return "EOF", ""
-	case '>':
-		return "FD", "1"
-	case '<':
+	case '<', '>':
+		// peek ahead for a process substitution.
+		nc := one(b)
+		if nc == '(' {
+			return string(c) + "(", subst(b)
+		}
+		if nc != 0 {
+			pushback(b)
+		}
+		if c == '>' {
+			return "FD", "1"
+		}
 		return "FD", "0"
 	// yes, I realize $ handling is still pretty hokey.
 	case '$':
@@ -155,6 +171,37 @@ func tok(b *bufio.Reader) (string, string) {
 
 }
 
+// subst reads the command of a process substitution up to the matching ')'.
+// It is left as it is, to be parsed when the substitution is run, so it may
+// contain substitutions too.
+func subst(b *bufio.Reader) string {
+	var s string
+	for depth := 1; ; {
+		c := one(b)
+		switch c {
+		case 0:
+			panic(errors.New("unterminated process substitution"))
+		case '\\':
+			s += string(c)
+			c = one(b)
+		case '\'':
+			for {
+				s += string(c)
+				if c = one(b); c == '\'' || c == 0 {
+					break
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return s
+			}
+		}
+		s += string(c)
+	}
+}
+
 // get an ARG. It has to work.
 func getArg(b *bufio.Reader, what string) string {
 	for {
@@ -183,13 +230,17 @@ func parsestring(b *bufio.Reader, c *Command) (*Command, string) {
 				s = filepath.Join(envDir, s)
 			}
 			b, err := ioutil.ReadFile(s)
+			// Unset is empty, unless set -u.
+			if os.IsNotExist(err) && !opts.nounset {
+				err = nil
+			}
 			if err != nil {
 				panic(fmt.Errorf("%s: %v", s, err))
 			}
 			f := bufio.NewReader(bytes.NewReader(b))
 			// the whole string is consumed.
 			parsestring(f, c)
-		case "ARG":
+		case "ARG", "<(", ">(":
 			c.args = append(c.args, arg{s, t})
 		case "white":
 		case "FD":
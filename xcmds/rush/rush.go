@@ -10,6 +10,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +18,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -49,7 +51,7 @@ func wire(cmds []*Command) error {
 				return err
 			}
 		}
-		if c.link != "|" {
+		if c.link != "|" && c.Stdout == nil {
 			if c.Stdout, err = openWrite(c, os.Stdout, 1); err != nil {
 				return err
 			}
@@ -82,11 +84,17 @@ func wire(cmds []*Command) error {
 }
 
 func runit(c *Command) error {
+	for _, p := range c.subs {
+		p.start()
+	}
 	defer func() {
 		for fd, f := range c.files {
 			f.Close()
 			delete(c.files, fd)
 		}
+		for _, p := range c.subs {
+			p.wait()
+		}
 	}()
 	if b, ok := builtins[c.cmd]; ok {
 		if err := b(c); err != nil {
@@ -96,7 +104,7 @@ func runit(c *Command) error {
 		c.Cmd.SysProcAttr = &syscall.SysProcAttr{}
 		if c.bg {
 			c.Cmd.SysProcAttr.Setpgid = true
-		} else {
+		} else if !c.sub {
 			c.Cmd.SysProcAttr.Foreground = true
 			c.Cmd.SysProcAttr.Ctty = int(ttyf.Fd())
 		}
@@ -144,6 +152,15 @@ func doArgs(cmds []*Command) error {
 				// It goes in as one argument. Not sure if this is what we want
 				// but it gets very weird to start splitting it on spaces. Or maybe not?
 				globargv = append(globargv, string(b))
+			} else if v.mod == "<(" || v.mod == ">(" {
+				p, err := newProcSub(v)
+				if err != nil {
+					return err
+				}
+				globargv = append(globargv, fmt.Sprintf("/dev/fd/%d", 3+len(c.subs)))
+				c.subs = append(c.subs, p)
+			} else if opts.noglob {
+				globargv = append(globargv, v.val)
 			} else if globs, err := filepath.Glob(v.val); err == nil && len(globs) > 0 {
 				globargv = append(globargv, globs...)
 			} else {
@@ -164,6 +181,9 @@ func doArgs(cmds []*Command) error {
 func commands(cmds []*Command) error {
 	for _, c := range cmds {
 		c.Cmd = exec.Command(c.cmd, c.argv[:]...)
+		for _, p := range c.subs {
+			c.Cmd.ExtraFiles = append(c.Cmd.ExtraFiles, p.remote)
+		}
 		// this is a Very Special Case related to a Go issue.
 		// we're not able to unshare correctly in builtin.
 		// Not sure of the issue but this hack will have to do until
@@ -175,6 +195,74 @@ func commands(cmds []*Command) error {
 	return nil
 }
 
+// procSub is a process substitution: <(cmd) or >(cmd).
+type procSub struct {
+	cmds []*Command
+	// local is the end of the pipe that cmds use, and remote is
+	// the end the outer command gets as /dev/fd/N.
+	local  *os.File
+	remote *os.File
+	done   chan struct{}
+}
+
+func newProcSub(v arg) (*procSub, error) {
+	cmds, _, err := getCommand(bufio.NewReader(strings.NewReader(v.val)))
+	if err != nil {
+		return nil, err
+	}
+	if len(cmds) == 0 {
+		return nil, errors.New("empty process substitution")
+	}
+	// This takes care of substitutions within this one.
+	if err := doArgs(cmds); err != nil {
+		return nil, err
+	}
+	if err := commands(cmds); err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p := &procSub{cmds: cmds, done: make(chan struct{})}
+	if v.mod == "<(" {
+		p.local, p.remote = w, r
+	} else {
+		p.local, p.remote = r, w
+	}
+	for i, c := range cmds {
+		c.sub = true
+		if v.mod == "<(" && c.link != "|" {
+			c.Stdout = w
+		}
+		if v.mod == ">(" && (i == 0 || cmds[i-1].link != "|") {
+			c.Stdin = r
+		}
+	}
+	if err := wire(cmds); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// start runs the commands in the background.
+func (p *procSub) start() {
+	go func() {
+		run(p.cmds)
+		p.local.Close()
+		close(p.done)
+	}()
+}
+
+// wait is called once the outer command exits. Closing our copy of its end
+// of the pipe lets the commands see EOF, or EPIPE if it stopped reading.
+func (p *procSub) wait() {
+	p.remote.Close()
+	<-p.done
+}
+
 func command(c *Command) error {
 	// for now, bg will just happen in background.
 	if c.bg {
@@ -190,6 +278,54 @@ func command(c *Command) error {
 	return nil
 }
 
+// run runs cmds in order, as far as their && and || links allow.
+func run(cmds []*Command) {
+	// failed is the command that fails the current pipeline: the last
+	// one, or with pipefail the rightmost one that failed.
+	var failed *Command
+	for _, c := range cmds {
+		if opts.xtrace {
+			trace(c)
+		}
+		err := command(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed = c
+		}
+		// The rest of a pipeline runs regardless.
+		if c.link == "|" {
+			continue
+		}
+		if err == nil && !opts.pipefail {
+			failed = nil
+		}
+		f := failed
+		failed = nil
+		if f == nil {
+			if c.link == "||" {
+				break
+			}
+			continue
+		}
+		if opts.errexit && !c.sub && c.link != "&&" && c.link != "||" {
+			// Take the terminal back, as the next prompt would.
+			foreground()
+			os.Exit(exitStatus(f))
+		}
+		if c.link != "||" {
+			break
+		}
+	}
+}
+
+// exitStatus is the exit status of a failed command.
+func exitStatus(c *Command) int {
+	if c.ProcessState != nil && c.ProcessState.ExitCode() > 0 {
+		return c.ProcessState.ExitCode()
+	}
+	return 1
+}
+
 func main() {
 	if len(os.Args) != 1 {
 		fmt.Println("no scripts/args yet")
@@ -217,24 +353,7 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			continue
 		}
-		for _, c := range cmds {
-			if err := command(c); err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err)
-				if c.link == "||" {
-					continue
-				}
-				// yes, not needed, but useful so you know
-				// what goes on here.
-				if c.link == "&&" {
-					break
-				}
-				break
-			} else {
-				if c.link == "||" {
-					break
-				}
-			}
-		}
+		run(cmds)
 		if status == "EOF" {
 			break
 		}
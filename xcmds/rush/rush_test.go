@@ -30,6 +30,23 @@ var tests = []struct {
 	{"exit abcd\n", "% % ", "Non numeric argument\n", 0},
 	{"time cd .\n", "% % ", `real 0.0\d\d\n`, 0},
 	{"time sleep 0.25\n", "% % ", `real \d+.\d{3}\nuser \d+.\d{3}\nsys \d+.\d{3}\n`, 0},
+	{"diff <(echo a) <(echo b)\n", "% 1c1\n< a\n---\n> b\n% ", "wait: exit status 1\n", 0},
+	{"diff <(echo a) <(echo a)\n", "% % ", "", 0},
+	{"cat <(cat <(echo nested))\n", "% nested\n% ", "", 0},
+	{"sh -c 'echo out >$0' >(tr a-z A-Z)\n", "% OUT\n% ", "", 0},
+	{"true <(yes)\n", "% % ", "wait: signal: broken pipe\n", 0},
+	{"set -e\nfalse\necho no\n", "% % ", "wait: exit status 1\n", 1},
+	{"set -e\nsh -c 'exit 5'\n", "% % ", "wait: exit status 5\n", 5},
+	{"set -e\nfalse || echo ok\n", "% % ok\n% ", "wait: exit status 1\n", 0},
+	{"set -e\nset +e\nfalse\n", "% % % % ", "wait: exit status 1\n", 0},
+	{"echo x $nosuch\n", "% x\n% ", "", 0},
+	{"set -u\necho x $nosuch\n", "% % % % ", "/env/nosuch: open /env/nosuch: no such file or directory\n", 0},
+	{"set -x\necho hi\nset +x\necho bye\n", "% % hi\n% % bye\n% ", "\\+ echo hi\n\\+ set \\+x\n", 0},
+	{"set -f\necho /*\n", "% % /\\*\n% ", "", 0},
+	{"false | true && echo yes\n", "% yes\n% ", "wait: exit status 1\n", 0},
+	{"set -o pipefail\nfalse | true && echo yes\n", "% % % ", "wait: exit status 1\n", 0},
+	{"set -euo pipefail\nset +u\nset\n", "% % % set -o errexit\nset \\+o nounset\nset \\+o xtrace\nset \\+o noglob\nset -o pipefail\n% ", "", 0},
+	{"set -z\n", "% % ", "set: -z: invalid option\n", 0},
 }
 
 func TestRush(t *testing.T) {
@@ -0,0 +1,103 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Set shell options.
+//
+// Synopsis:
+//     set [-+efux] [-+o NAME]...
+//
+// Description:
+//     -e or -o errexit: exit when a command fails, unless it is followed
+//         by && or ||.
+//     -u or -o nounset: an unset $VAR is an error rather than empty.
+//     -x or -o xtrace: print commands to stderr before running them.
+//     -f or -o noglob: do not expand globs.
+//     -o pipefail: a pipeline fails if any of its commands fails, rather
+//         than only if the last one does.
+//
+//     + instead of - turns an option off. With no arguments, set prints
+//     the options in a form that set accepts.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// opts are the options of this shell, as changed by set.
+var opts struct {
+	errexit  bool
+	nounset  bool
+	xtrace   bool
+	noglob   bool
+	pipefail bool
+}
+
+var options = []struct {
+	letter byte
+	name   string
+	on     *bool
+}{
+	{'e', "errexit", &opts.errexit},
+	{'u', "nounset", &opts.nounset},
+	{'x', "xtrace", &opts.xtrace},
+	{'f', "noglob", &opts.noglob},
+	{0, "pipefail", &opts.pipefail},
+}
+
+func init() {
+	addBuiltIn("set", set)
+}
+
+func set(c *Command) error {
+	if len(c.argv) == 0 {
+		for _, o := range options {
+			sign := '+'
+			if *o.on {
+				sign = '-'
+			}
+			fmt.Fprintf(c.Stdout, "set %co %s\n", sign, o.name)
+		}
+		return nil
+	}
+	for i := 0; i < len(c.argv); i++ {
+		a := c.argv[i]
+		if len(a) < 2 || (a[0] != '-' && a[0] != '+') {
+			return fmt.Errorf("set: %v: positional parameters are not supported", a)
+		}
+		on := a[0] == '-'
+		for _, l := range []byte(a[1:]) {
+			var name string
+			if l == 'o' {
+				if i++; i == len(c.argv) {
+					return fmt.Errorf("set: %co requires an option name", a[0])
+				}
+				name = c.argv[i]
+			}
+			if err := setOption(l, name, on); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setOption sets the option with the letter l, or with the name if l is 'o'.
+func setOption(l byte, name string, on bool) error {
+	for _, o := range options {
+		if (l == 'o' && o.name == name) || (l != 'o' && o.letter == l) {
+			*o.on = on
+			return nil
+		}
+	}
+	if l == 'o' {
+		return fmt.Errorf("set: %v: invalid option name", name)
+	}
+	return fmt.Errorf("set: -%c: invalid option", l)
+}
+
+// trace prints c, as set -x does.
+func trace(c *Command) {
+	fmt.Fprintf(c.Stderr, "+ %v\n", strings.Join(append([]string{c.cmd}, c.argv...), " "))
+}
@@ -57,6 +57,7 @@ func runtime(c *Command) error {
 		nCmd.Stdin = c.Stdin
 		nCmd.Stdout = c.Stdout
 		nCmd.Stderr = c.Stderr
+		nCmd.ExtraFiles = c.ExtraFiles
 		c.Cmd = nCmd
 		err = runit(c)
 	}